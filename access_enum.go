@@ -0,0 +1,37 @@
+package smbfs
+
+import (
+	"os"
+	"path"
+)
+
+// ShareAccessChecker decides per path what a user may see on a share with
+// ShareOptions.AccessBasedEnumeration set. name is the path within the
+// share, slash-separated and starting with "/". isGuest is set for guest
+// and anonymous sessions, whose username is not meaningful
+type ShareAccessChecker interface {
+	CanRead(username string, isGuest bool, name string) bool
+}
+
+// enumeratesByAccess reports whether directory listings on the share are
+// filtered by the session's access
+func (s *Share) enumeratesByAccess() bool {
+	opts := s.Options()
+	return opts.AccessBasedEnumeration && opts.AccessChecker != nil
+}
+
+// visibleEntries drops the entries of dir that the session's user cannot
+// read, when the share enumerates based on access (MS-SMB2 3.3.5.18)
+func (s *Share) visibleEntries(session *Session, dir string, entries []os.FileInfo) []os.FileInfo {
+	if !s.enumeratesByAccess() {
+		return entries
+	}
+	checker := s.Options().AccessChecker
+	visible := entries[:0]
+	for _, entry := range entries {
+		if checker.CanRead(session.Username, session.IsGuest, path.Join(dir, entry.Name())) {
+			visible = append(visible, entry)
+		}
+	}
+	return visible
+}
@@ -0,0 +1,97 @@
+package smbfs
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/absfs/memfs"
+)
+
+// hrChecker hides /hr and everything under it from everyone but "admin"
+type hrChecker struct{}
+
+func (hrChecker) CanRead(username string, isGuest bool, name string) bool {
+	if name == "/hr" || strings.HasPrefix(name, "/hr/") {
+		return !isGuest && strings.EqualFold(username, "admin")
+	}
+	return true
+}
+
+// TestAccessBasedEnumeration tests that entries a user cannot read are
+// missing from that user's listings and present in an authorized user's
+func TestAccessBasedEnumeration(t *testing.T) {
+	srv, config := startLoopbackServer(t, ServerOptions{})
+	srv.options.Users["admin"] = "admin-secret"
+
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+	mfs.Mkdir("/hr", 0755)
+	mfs.Mkdir("/public", 0755)
+	for _, name := range []string{"/hr/salaries.xlsx", "/public/hr-policy.pdf", "/public/menu.txt"} {
+		f, _ := mfs.Create(name)
+		f.Close()
+	}
+	if err := srv.AddShare(mfs, ShareOptions{
+		ShareName:              "corp",
+		AccessBasedEnumeration: true,
+		AccessChecker:          hrChecker{},
+	}); err != nil {
+		t.Fatalf("AddShare() error = %v", err)
+	}
+
+	list := func(username, password, dir string) []string {
+		t.Helper()
+		cfg := *config
+		cfg.Share = "corp"
+		cfg.Username = username
+		cfg.Password = password
+		fsys, err := New(&cfg)
+		if err != nil {
+			t.Fatalf("New(%s) error = %v", username, err)
+		}
+		defer fsys.Close()
+
+		entries, err := fsys.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("ReadDir(%s) as %s error = %v", dir, username, err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	if got := strings.Join(list("tester", "secret", "/"), ","); got != "public" {
+		t.Errorf("ReadDir(/) as tester = %s, want public", got)
+	}
+	if got := strings.Join(list("admin", "admin-secret", "/"), ","); got != "hr,public" {
+		t.Errorf("ReadDir(/) as admin = %s, want hr,public", got)
+	}
+	// Names that merely look alike are not hidden
+	if got := strings.Join(list("tester", "secret", "/public"), ","); got != "hr-policy.pdf,menu.txt" {
+		t.Errorf("ReadDir(/public) as tester = %s, want hr-policy.pdf,menu.txt", got)
+	}
+}
+
+// TestAccessBasedEnumeration_ShareFlag tests that the share advertises
+// access-based enumeration only with a checker
+func TestAccessBasedEnumeration_ShareFlag(t *testing.T) {
+	for _, tt := range []struct {
+		opts ShareOptions
+		want bool
+	}{
+		{ShareOptions{AccessBasedEnumeration: true, AccessChecker: hrChecker{}}, true},
+		{ShareOptions{AccessBasedEnumeration: true}, false},
+		{ShareOptions{AccessChecker: hrChecker{}}, false},
+	} {
+		share := NewShare(nil, tt.opts)
+		if got := share.enumeratesByAccess(); got != tt.want {
+			t.Errorf("enumeratesByAccess() with %+v = %v, want %v", tt.opts, got, tt.want)
+		}
+	}
+}
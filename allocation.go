@@ -0,0 +1,43 @@
+package smbfs
+
+import (
+	"io/fs"
+)
+
+// Fallocater is implemented by files that can reserve space for their
+// first size bytes without changing their size. When an open file
+// implements it, FileAllocationInformation requests that grow a file's
+// allocation reserve the space on the backend as well
+type Fallocater interface {
+	Fallocate(size int64) error
+}
+
+// Allocator is implemented by filesystems that know how much storage a file
+// takes up, which for sparse or compressed files is less than its size.
+// Shares backed by one report that as the file's AllocationSize, so "size
+// on disk" comes out right on clients
+type Allocator interface {
+	AllocatedSize(name string) (int64, error)
+}
+
+// roundAllocation rounds a size up to whole 4KB allocation units
+func roundAllocation(size uint64) uint64 {
+	return (size + defaultAllocationUnit - 1) &^ (defaultAllocationUnit - 1)
+}
+
+// allocationSize returns the AllocationSize reported for the file at name:
+// what the filesystem's Allocator says, or else its size rounded up to whole
+// allocation units, or more if an open of the file has preallocated space
+// beyond that
+func (s *Share) allocationSize(name string, info fs.FileInfo) uint64 {
+	size := roundAllocation(uint64(info.Size()))
+	if a, ok := s.FileSystem().(Allocator); ok {
+		if n, err := a.AllocatedSize(name); err == nil && n >= 0 {
+			size = uint64(n)
+		}
+	}
+	if info.IsDir() {
+		return size
+	}
+	return max(size, s.fileHandles.reservedAllocation(name))
+}
@@ -0,0 +1,95 @@
+package smbfs
+
+import (
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+)
+
+// shareArchive tracks the archive bit of a share's files. Regular files
+// report FILE_ATTRIBUTE_ARCHIVE until a client clears it through
+// FileBasicInformation, as backup tools do once they have copied a file,
+// and have it set again when their data next changes
+type shareArchive struct {
+	mu      sync.Mutex
+	cleared map[string]bool // Paths whose archive bit is cleared
+}
+
+// fileAttributes returns the attributes reported for the file at name:
+// those of its mode and name, less FILE_ATTRIBUTE_ARCHIVE if a client has
+// cleared it since the file last changed
+func (s *Share) fileAttributes(name string, info fs.FileInfo) uint32 {
+	attrs := fileAttributes(info)
+	if attrs&FILE_ATTRIBUTE_ARCHIVE == 0 {
+		return attrs
+	}
+
+	s.archive.mu.Lock()
+	cleared := s.archive.cleared[path.Clean("/"+name)]
+	s.archive.mu.Unlock()
+	if !cleared {
+		return attrs
+	}
+	if attrs &^= FILE_ATTRIBUTE_ARCHIVE; attrs == 0 {
+		attrs = FILE_ATTRIBUTE_NORMAL
+	}
+	return attrs
+}
+
+// setArchive sets or clears the archive bit of the file at name. Writes and
+// truncates set it; only FileBasicInformation clears it
+func (s *Share) setArchive(name string, set bool) {
+	key := path.Clean("/" + name)
+
+	s.archive.mu.Lock()
+	defer s.archive.mu.Unlock()
+
+	if set {
+		delete(s.archive.cleared, key)
+		return
+	}
+	if s.archive.cleared == nil {
+		s.archive.cleared = make(map[string]bool)
+	}
+	s.archive.cleared[key] = true
+}
+
+// forgetArchive drops the archive bits of a deleted path and anything
+// beneath it, so a file created in its place starts out set
+func (s *Share) forgetArchive(name string) {
+	key := path.Clean("/" + name)
+
+	s.archive.mu.Lock()
+	defer s.archive.mu.Unlock()
+
+	for p := range s.archive.cleared {
+		if p == key || strings.HasPrefix(p, key+"/") {
+			delete(s.archive.cleared, p)
+		}
+	}
+}
+
+// renameArchive moves archive bits along with a rename
+func (s *Share) renameArchive(oldName, newName string) {
+	oldKey := path.Clean("/" + oldName)
+	newKey := path.Clean("/" + newName)
+
+	s.archive.mu.Lock()
+	defer s.archive.mu.Unlock()
+
+	var moved []string
+	for p := range s.archive.cleared {
+		if p == newKey || strings.HasPrefix(p, newKey+"/") {
+			// Replaced target
+			delete(s.archive.cleared, p)
+		}
+		if p == oldKey || strings.HasPrefix(p, oldKey+"/") {
+			moved = append(moved, newKey+strings.TrimPrefix(p, oldKey))
+			delete(s.archive.cleared, p)
+		}
+	}
+	for _, p := range moved {
+		s.archive.cleared[p] = true
+	}
+}
@@ -2,6 +2,8 @@ package smbfs
 
 import (
 	"io/fs"
+	"strings"
+	"time"
 )
 
 // Windows file attribute flags as defined in MS-FSCC.
@@ -49,6 +51,12 @@ const (
 	FILE_ATTRIBUTE_ENCRYPTED = 0x00004000
 )
 
+// Reparse point tags as defined in MS-FSCC.
+const (
+	// IO_REPARSE_TAG_SYMLINK identifies a symbolic link.
+	IO_REPARSE_TAG_SYMLINK = 0xA000000C
+)
+
 // WindowsAttributes represents Windows-specific file attributes.
 type WindowsAttributes struct {
 	attrs uint32
@@ -199,12 +207,29 @@ func (wa *WindowsAttributes) String() string {
 	return result
 }
 
-// FileInfoEx extends fs.FileInfo with Windows attributes.
+// FileInfoEx extends fs.FileInfo with Windows attributes and the raw
+// metadata reported by the server.
 type FileInfoEx interface {
 	fs.FileInfo
 	// WindowsAttributes returns the Windows-specific file attributes.
 	// Returns nil if attributes are not available.
 	WindowsAttributes() *WindowsAttributes
+	// RawAttributes returns the FileAttributes field as sent by the server.
+	RawAttributes() uint32
+	// ReparseTag returns the reparse point tag, or 0 if the file is not a
+	// reparse point or the tag could not be determined.
+	ReparseTag() uint32
+	// AllocationSize returns the bytes allocated on disk, which may differ
+	// from Size (the end-of-file position).
+	AllocationSize() int64
+	// CreationTime returns the file's creation time.
+	CreationTime() time.Time
+	// LastAccessTime returns the file's last access time.
+	LastAccessTime() time.Time
+	// LastWriteTime returns the file's last write time.
+	LastWriteTime() time.Time
+	// ChangeTime returns the time the file's metadata last changed.
+	ChangeTime() time.Time
 }
 
 // GetWindowsAttributes attempts to extract Windows attributes from fs.FileInfo.
@@ -256,8 +281,9 @@ func attributesToMode(attrs uint32, isDir bool) fs.FileMode {
 
 // modeToAttributes converts Unix file mode to Windows attributes.
 // This is a best-effort mapping as Windows and Unix permissions are quite different.
+// Execute bits have no Windows counterpart and are left out.
 func modeToAttributes(mode fs.FileMode) uint32 {
-	attrs := uint32(FILE_ATTRIBUTE_NORMAL)
+	var attrs uint32
 
 	// Check if read-only (no write permissions)
 	if mode&0222 == 0 {
@@ -284,5 +310,20 @@ func modeToAttributes(mode fs.FileMode) uint32 {
 		attrs |= FILE_ATTRIBUTE_ARCHIVE
 	}
 
+	// FILE_ATTRIBUTE_NORMAL is only valid alone
+	if attrs == 0 {
+		attrs = FILE_ATTRIBUTE_NORMAL
+	}
+	return attrs
+}
+
+// fileAttributes returns the Windows attributes the server reports for a
+// file: those of its mode, plus FILE_ATTRIBUTE_HIDDEN for a name starting
+// with a dot, which Unix tools hide.
+func fileAttributes(info fs.FileInfo) uint32 {
+	attrs := modeToAttributes(info.Mode())
+	if name := info.Name(); strings.HasPrefix(name, ".") && name != "." && name != ".." {
+		attrs = attrs&^FILE_ATTRIBUTE_NORMAL | FILE_ATTRIBUTE_HIDDEN
+	}
 	return attrs
 }
@@ -1,8 +1,13 @@
 package smbfs
 
 import (
+	"errors"
 	"io/fs"
+	"os"
 	"testing"
+	"time"
+
+	"github.com/absfs/smbfs/internal/smb2"
 )
 
 func TestWindowsAttributes_Flags(t *testing.T) {
@@ -301,3 +306,194 @@ func TestShareType_String(t *testing.T) {
 		})
 	}
 }
+
+// readlinkShare is an SMBShare that resolves a single symlink
+type readlinkShare struct {
+	SMBShare
+	link string
+}
+
+func (s *readlinkShare) Readlink(name string) (string, error) {
+	if name != s.link {
+		return "", errors.New("not a symlink")
+	}
+	return "target", nil
+}
+
+func TestFileInfoEx_RawMetadata(t *testing.T) {
+	base := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	attrs := uint32(FILE_ATTRIBUTE_HIDDEN | FILE_ATTRIBUTE_ARCHIVE | FILE_ATTRIBUTE_REPARSE_POINT)
+	stat := &smb2.FileStat{
+		CreationTime:   base,
+		LastAccessTime: base.Add(3 * time.Hour),
+		LastWriteTime:  base.Add(2 * time.Hour),
+		ChangeTime:     base.Add(time.Hour),
+		EndOfFile:      100,
+		AllocationSize: 4096,
+		FileAttributes: attrs,
+		FileName:       "link",
+	}
+
+	share := &readlinkShare{link: `dir\link`}
+	fi := &fileInfo{stat: stat, name: "link"}
+	fi.reparseTag = reparseTagOf(share, `dir\link`, fi.RawAttributes())
+
+	var info fs.FileInfo = fi
+	ex, ok := info.(FileInfoEx)
+	if !ok {
+		t.Fatal("fileInfo does not implement FileInfoEx")
+	}
+
+	if got := ex.RawAttributes(); got != attrs {
+		t.Errorf("RawAttributes() = 0x%x, want 0x%x", got, attrs)
+	}
+	if got := ex.ReparseTag(); got != IO_REPARSE_TAG_SYMLINK {
+		t.Errorf("ReparseTag() = 0x%x, want 0x%x", got, IO_REPARSE_TAG_SYMLINK)
+	}
+	if got := ex.AllocationSize(); got != 4096 {
+		t.Errorf("AllocationSize() = %d, want 4096", got)
+	}
+	if got := ex.Size(); got != 100 {
+		t.Errorf("Size() = %d, want 100", got)
+	}
+	if got := ex.CreationTime(); !got.Equal(stat.CreationTime) {
+		t.Errorf("CreationTime() = %v, want %v", got, stat.CreationTime)
+	}
+	if got := ex.LastAccessTime(); !got.Equal(stat.LastAccessTime) {
+		t.Errorf("LastAccessTime() = %v, want %v", got, stat.LastAccessTime)
+	}
+	if got := ex.LastWriteTime(); !got.Equal(stat.LastWriteTime) {
+		t.Errorf("LastWriteTime() = %v, want %v", got, stat.LastWriteTime)
+	}
+	if got := ex.ChangeTime(); !got.Equal(stat.ChangeTime) {
+		t.Errorf("ChangeTime() = %v, want %v", got, stat.ChangeTime)
+	}
+
+	// Reparse points that are not symlinks, and plain files, have no known tag
+	if got := reparseTagOf(share, `other`, attrs); got != 0 {
+		t.Errorf("reparseTagOf(non-symlink) = 0x%x, want 0", got)
+	}
+	if got := reparseTagOf(share, `dir\link`, FILE_ATTRIBUTE_ARCHIVE); got != 0 {
+		t.Errorf("reparseTagOf(plain file) = 0x%x, want 0", got)
+	}
+}
+
+func TestAttributeMapping(t *testing.T) {
+	modes := []struct {
+		name string
+		mode fs.FileMode
+		want uint32
+	}{
+		{"file", 0644, FILE_ATTRIBUTE_ARCHIVE},
+		{"executable", 0755, FILE_ATTRIBUTE_ARCHIVE},
+		{"read-only file", 0444, FILE_ATTRIBUTE_READONLY | FILE_ATTRIBUTE_ARCHIVE},
+		{"read-only executable", 0555, FILE_ATTRIBUTE_READONLY | FILE_ATTRIBUTE_ARCHIVE},
+		{"directory", fs.ModeDir | 0755, FILE_ATTRIBUTE_DIRECTORY},
+		{"read-only directory", fs.ModeDir | 0555, FILE_ATTRIBUTE_DIRECTORY | FILE_ATTRIBUTE_READONLY},
+		{"symlink", fs.ModeSymlink | 0777, FILE_ATTRIBUTE_REPARSE_POINT},
+		{"device", fs.ModeDevice | 0666, FILE_ATTRIBUTE_DEVICE},
+		{"named pipe", fs.ModeNamedPipe | 0666, FILE_ATTRIBUTE_NORMAL},
+	}
+	for _, tt := range modes {
+		if got := modeToAttributes(tt.mode); got != tt.want {
+			t.Errorf("modeToAttributes(%s %v) = %#x, want %#x", tt.name, tt.mode, got, tt.want)
+		}
+	}
+
+	attrs := []struct {
+		name  string
+		attrs uint32
+		isDir bool
+		want  fs.FileMode
+	}{
+		{"normal", FILE_ATTRIBUTE_NORMAL, false, 0666},
+		{"archive", FILE_ATTRIBUTE_ARCHIVE, false, 0666},
+		{"read-only", FILE_ATTRIBUTE_READONLY | FILE_ATTRIBUTE_ARCHIVE, false, 0444},
+		{"hidden", FILE_ATTRIBUTE_HIDDEN, false, 0666},
+		{"directory", FILE_ATTRIBUTE_DIRECTORY, true, fs.ModeDir | 0777},
+		{"directory by attribute", FILE_ATTRIBUTE_DIRECTORY, false, fs.ModeDir | 0777},
+		{"read-only directory", FILE_ATTRIBUTE_DIRECTORY | FILE_ATTRIBUTE_READONLY, true, fs.ModeDir | 0555},
+		{"reparse point", FILE_ATTRIBUTE_REPARSE_POINT, false, fs.ModeSymlink | 0666},
+		{"device", FILE_ATTRIBUTE_DEVICE, false, fs.ModeDevice | 0666},
+	}
+	for _, tt := range attrs {
+		if got := attributesToMode(tt.attrs, tt.isDir); got != tt.want {
+			t.Errorf("attributesToMode(%s %#x, %v) = %v, want %v", tt.name, tt.attrs, tt.isDir, got, tt.want)
+		}
+	}
+
+	// Read-only and directory survive a round trip
+	for _, mode := range []fs.FileMode{0666, 0444, fs.ModeDir | 0777, fs.ModeDir | 0555} {
+		if got := attributesToMode(modeToAttributes(mode), mode.IsDir()); got != mode {
+			t.Errorf("attributesToMode(modeToAttributes(%v)) = %v", mode, got)
+		}
+	}
+}
+
+func TestFileAttributes(t *testing.T) {
+	tests := []struct {
+		name string
+		mode fs.FileMode
+		want uint32
+	}{
+		{"file.txt", 0644, FILE_ATTRIBUTE_ARCHIVE},
+		{".profile", 0644, FILE_ATTRIBUTE_ARCHIVE | FILE_ATTRIBUTE_HIDDEN},
+		{".ssh", fs.ModeDir | 0700, FILE_ATTRIBUTE_DIRECTORY | FILE_ATTRIBUTE_HIDDEN},
+		{".pipe", fs.ModeNamedPipe | 0644, FILE_ATTRIBUTE_HIDDEN},
+		{".", fs.ModeDir | 0755, FILE_ATTRIBUTE_DIRECTORY},
+		{"..", fs.ModeDir | 0755, FILE_ATTRIBUTE_DIRECTORY},
+	}
+	for _, tt := range tests {
+		info := &mockFileInfo{data: &mockFileData{name: tt.name, mode: tt.mode, isDir: tt.mode.IsDir()}}
+		if got := fileAttributes(info); got != tt.want {
+			t.Errorf("fileAttributes(%s) = %#x, want %#x", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestFileSystem_ChattrAttributes tests that attributes other than
+// read-only reach the server: the archive attribute is cleared and set, and
+// hidden and system, which the loopback server ignores, are accepted
+func TestFileSystem_ChattrAttributes(t *testing.T) {
+	_, config := startLoopbackServer(t, ServerOptions{})
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	attrsOf := func() *WindowsAttributes {
+		t.Helper()
+		info, err := fsys.Stat("/hello.txt")
+		if err != nil {
+			t.Fatalf("Stat() error = %v", err)
+		}
+		attrs := GetWindowsAttributes(info)
+		if attrs == nil {
+			t.Fatal("GetWindowsAttributes() = nil")
+		}
+		return attrs
+	}
+
+	if !attrsOf().IsArchive() {
+		t.Fatal("written file does not have the archive attribute")
+	}
+	if err := fsys.Chattr("/hello.txt", NewWindowsAttributes(FILE_ATTRIBUTE_HIDDEN)); err != nil {
+		t.Fatalf("Chattr() error = %v", err)
+	}
+	if attrsOf().IsArchive() {
+		t.Error("archive attribute still set after Chattr() cleared it")
+	}
+
+	f, err := fsys.OpenFile("/hello.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	defer f.Close()
+	if err := f.(*File).SetAttributes(NewWindowsAttributes(FILE_ATTRIBUTE_ARCHIVE | FILE_ATTRIBUTE_SYSTEM)); err != nil {
+		t.Fatalf("SetAttributes() error = %v", err)
+	}
+	if !attrsOf().IsArchive() {
+		t.Error("archive attribute not set after SetAttributes()")
+	}
+}
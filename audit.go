@@ -0,0 +1,124 @@
+package smbfs
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// AuditOperation names the file operation an AuditEvent reports
+type AuditOperation string
+
+// Operations reported to ShareOptions.AuditHook
+const (
+	AuditOpen   AuditOperation = "open"
+	AuditRead   AuditOperation = "read"
+	AuditWrite  AuditOperation = "write"
+	AuditRename AuditOperation = "rename"
+	AuditDelete AuditOperation = "delete"
+)
+
+// AuditEvent is a file operation on a share, as passed to
+// ShareOptions.AuditHook
+type AuditEvent struct {
+	Time      time.Time
+	Share     string
+	Username  string // Empty for a delete whose session has ended
+	ClientIP  string
+	Operation AuditOperation
+	Path      string   // Share-relative path of the file
+	NewPath   string   // Where a successful rename moved the file
+	Bytes     uint64   // Bytes read or written
+	Status    NTStatus // Outcome of the operation
+}
+
+// shareAudit queues a share's audit events for the AuditHook when
+// AuditBuffer is set, so the hook runs on its own goroutine
+type shareAudit struct {
+	once  sync.Once
+	queue chan AuditEvent
+}
+
+// auditRequest marks msg as performing op on name, if the share has an
+// AuditHook. HandleMessage reports the event, with the request's status
+// and byte count, once the response is built. The returned event, nil
+// without a hook, may be completed by the handler
+func (h *SMBHandler) auditRequest(msg *SMB2Message, session *Session, tree *TreeConnection, op AuditOperation, name string) *AuditEvent {
+	if tree.Share.Options().AuditHook == nil {
+		return nil
+	}
+	msg.audit = &AuditEvent{
+		Username:  session.Username,
+		ClientIP:  clientHost(session.ClientIP),
+		Operation: op,
+		Path:      name,
+	}
+	return msg.audit
+}
+
+// auditDelete reports the delete of a file marked delete-on-close, which
+// happens when its handle closes, whether by CLOSE, logoff or disconnect
+func (h *SMBHandler) auditDelete(share *Share, of *OpenFile, err error) {
+	e := AuditEvent{Operation: AuditDelete, Path: of.Path, Status: STATUS_SUCCESS}
+	if err != nil {
+		e.Status = mapGoErrorToNTStatus(err)
+	}
+	if session := h.server.sessions.GetSession(of.SessionID); session != nil {
+		e.Username = session.Username
+		e.ClientIP = clientHost(session.ClientIP)
+	}
+	h.server.audit(share, e)
+}
+
+// clientHost returns the host part of a session's client address
+func clientHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// audit passes e to the share's AuditHook, through the share's queue if
+// AuditBuffer is set. Events that find the queue full are dropped
+func (s *Server) audit(share *Share, e AuditEvent) {
+	opts := share.Options()
+	if opts.AuditHook == nil {
+		return
+	}
+	e.Share = opts.ShareName
+	e.Time = time.Now()
+	if opts.AuditBuffer <= 0 {
+		opts.AuditHook(e)
+		return
+	}
+
+	select {
+	case share.auditQueue(s.ctx, opts.AuditBuffer) <- e:
+	default:
+		s.logger.Warn("Audit queue of share %s is full, dropping %s of %s by %s",
+			opts.ShareName, e.Operation, e.Path, e.Username)
+	}
+}
+
+// auditQueue returns the share's audit queue, starting the goroutine that
+// empties it into the AuditHook on first use. The queue keeps the size it
+// was created with
+func (s *Share) auditQueue(ctx context.Context, size int) chan<- AuditEvent {
+	s.audit.once.Do(func() {
+		s.audit.queue = make(chan AuditEvent, size)
+		go func() {
+			for {
+				select {
+				case e := <-s.audit.queue:
+					if hook := s.Options().AuditHook; hook != nil {
+						hook(e)
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	})
+	return s.audit.queue
+}
@@ -0,0 +1,148 @@
+package smbfs
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestShare_AuditHook tests that the opens, reads, writes, renames and
+// deletes of a client reach the share's AuditHook in order, with the user,
+// address, byte counts and statuses of each
+func TestShare_AuditHook(t *testing.T) {
+	srv, config := startLoopbackServer(t, ServerOptions{})
+	share := srv.GetShare("data")
+
+	var mu sync.Mutex
+	var events []AuditEvent
+	share.mu.Lock()
+	share.options.AuditHook = func(e AuditEvent) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}
+	share.mu.Unlock()
+
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	f, err := fsys.Create("/audit.txt")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	f.Write([]byte("hello world"))
+	f.Close()
+	if _, err := fsys.ReadFile("/audit.txt"); err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if err := fsys.Rename("/audit.txt", "/renamed.txt"); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+	if err := fsys.Remove("/renamed.txt"); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	fsys.Open("/missing.txt")
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, e := range events {
+		if e.Share != "data" || e.Username != "tester" || e.ClientIP != "127.0.0.1" || e.Time.IsZero() {
+			t.Errorf("event %+v, want share data, user tester from 127.0.0.1", e)
+		}
+	}
+
+	// Each write, read, rename and delete follows an open of its file, and
+	// reads of the file's end report no bytes
+	var got []string
+	opened := make(map[string]bool)
+	for _, e := range events {
+		switch {
+		case e.Operation == AuditOpen:
+			if e.Status == STATUS_SUCCESS {
+				opened[e.Path] = true
+			}
+			if e.Path == "missing.txt" {
+				got = append(got, fmt.Sprintf("open %s %v", e.Path, e.Status))
+			}
+		case e.Operation == AuditRead && e.Status == STATUS_END_OF_FILE:
+		default:
+			if !opened[e.Path] {
+				t.Errorf("%s of %s before any open of it", e.Operation, e.Path)
+			}
+			got = append(got, strings.TrimSpace(fmt.Sprintf("%s %s %d %v %s", e.Operation, e.Path, e.Bytes, e.Status, e.NewPath)))
+		}
+	}
+	want := []string{
+		"write audit.txt 11 STATUS_SUCCESS",
+		"read audit.txt 11 STATUS_SUCCESS",
+		"rename audit.txt 0 STATUS_SUCCESS renamed.txt",
+		"delete renamed.txt 0 STATUS_SUCCESS",
+		"open missing.txt STATUS_OBJECT_NAME_NOT_FOUND",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("audit events:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestShare_AuditBuffer tests that with AuditBuffer a blocked hook does not
+// hold up requests, and that events beyond the buffer are dropped
+func TestShare_AuditBuffer(t *testing.T) {
+	srv, config := startLoopbackServer(t, ServerOptions{})
+	share := srv.GetShare("data")
+
+	release := make(chan struct{})
+	received := make(chan AuditEvent, 100)
+	share.mu.Lock()
+	share.options.AuditBuffer = 2
+	share.options.AuditHook = func(e AuditEvent) {
+		<-release
+		received <- e
+	}
+	share.mu.Unlock()
+
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 5; i++ {
+			if _, err := fsys.ReadFile("/hello.txt"); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("ReadFile() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reads held up by a blocked AuditHook")
+	}
+
+	// One event is with the hook, two are queued and the rest dropped
+	close(release)
+	n := 0
+	for timeout := time.After(time.Second); ; {
+		select {
+		case <-received:
+			n++
+			continue
+		case <-timeout:
+		}
+		break
+	}
+	if n != 3 {
+		t.Errorf("events received = %d, want 3", n)
+	}
+}
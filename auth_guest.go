@@ -11,6 +11,7 @@ type Authenticator interface {
 type AuthResult struct {
 	Success    bool   // Whether authentication succeeded
 	IsGuest    bool   // Whether this is a guest session
+	IsNull     bool   // Whether this is an anonymous (null) session; implies IsGuest
 	Username   string // Authenticated username (empty for guest)
 	Domain     string // User's domain (empty for guest)
 	SessionKey []byte // Session signing key (nil for guest/unsigned)
@@ -7,10 +7,8 @@ import (
 	"crypto/rand"
 	"crypto/rc4"
 	"encoding/binary"
-	"log"
+	"fmt"
 	"strings"
-
-	"golang.org/x/crypto/md4"
 )
 
 // NTLM message types
@@ -44,48 +42,77 @@ var ntlmSignature = []byte("NTLMSSP\x00")
 
 // NTLMAuthenticator implements NTLM authentication for SMB
 type NTLMAuthenticator struct {
-	serverChallenge  []byte            // 8-byte challenge for current session
-	targetName       string            // Server/domain name
-	users            map[string]string // username -> password (case-insensitive lookup)
-	allowGuest       bool              // Allow guest/anonymous access
-	state            int               // 0 = initial, 1 = challenge sent, 2 = complete
-	clientFlags      uint32            // Flags from client's NEGOTIATE_MESSAGE
+	serverChallenge []byte            // 8-byte challenge for current session
+	targetName      string            // Server/domain name
+	users           UserStore         // Credentials of known users
+	allowGuest      bool              // Allow guest/anonymous access
+	state           int               // 0 = initial, 1 = challenge sent, 2 = complete
+	clientFlags     uint32            // Flags from client's NEGOTIATE_MESSAGE
+	allowWeakNTLM   bool              // Accept unverifiable NTLM responses (legacy, insecure)
+	logger          ServerLogger      // Receives debug logging of the exchange
+	logSecrets      bool              // Log hashes, proofs and keys instead of redacting them
 }
 
 // NewNTLMAuthenticator creates a new NTLM authenticator
-// users is a map of username -> password (usernames are case-insensitive)
-// If users is nil or empty and allowGuest is true, all connections are allowed as guest
-func NewNTLMAuthenticator(targetName string, users map[string]string, allowGuest bool) *NTLMAuthenticator {
-	// Normalize usernames to uppercase for case-insensitive lookup
-	normalizedUsers := make(map[string]string)
-	for u, p := range users {
-		normalizedUsers[strings.ToUpper(u)] = p
-	}
-
+// users supplies the NT hashes of known users; PasswordUsers wraps a map of
+// username -> password. If users is nil and allowGuest is true, all
+// connections are allowed as guest
+func NewNTLMAuthenticator(targetName string, users UserStore, allowGuest bool) *NTLMAuthenticator {
 	return &NTLMAuthenticator{
 		targetName: targetName,
-		users:      normalizedUsers,
+		users:      users,
 		allowGuest: allowGuest,
 		state:      0,
+		logger:     &NullLogger{},
+	}
+}
+
+// SetLogger sends the authenticator's debug logging to logger, which
+// discards it by default. Hashes, proofs and session keys are redacted
+// unless logSecrets is set, since they let whoever reads the log attack
+// the password or decrypt the session
+func (a *NTLMAuthenticator) SetLogger(logger ServerLogger, logSecrets bool) {
+	if logger == nil {
+		logger = &NullLogger{}
+	}
+	a.logger = logger
+	a.logSecrets = logSecrets
+}
+
+// redactedSecret stands in for secrets in log messages
+const redactedSecret = "[redacted]"
+
+// secret formats key material for a log message
+func (a *NTLMAuthenticator) secret(b []byte) string {
+	if !a.logSecrets {
+		return redactedSecret
 	}
+	return fmt.Sprintf("%x", b)
+}
+
+// SetAllowWeakNTLM enables the legacy behavior of accepting NTLM responses whose
+// NTProofStr cannot be verified. This lets anyone who knows a valid username log
+// in regardless of password and should only be used for debugging old clients.
+func (a *NTLMAuthenticator) SetAllowWeakNTLM(allow bool) {
+	a.allowWeakNTLM = allow
 }
 
 // Authenticate processes NTLM authentication messages
 func (a *NTLMAuthenticator) Authenticate(securityBlob []byte) (*AuthResult, error) {
-	log.Printf("[DEBUG] Authenticate called: state=%d, blobLen=%d", a.state, len(securityBlob))
+	a.logger.Debug("Authenticate called: state=%d, blobLen=%d", a.state, len(securityBlob))
 
 	// Check for SPNEGO wrapper (GSS-API/GSSAPI)
 	ntlmBlob := a.extractNTLMFromSPNEGO(securityBlob)
 	if ntlmBlob == nil {
 		ntlmBlob = securityBlob
-		log.Printf("[DEBUG] No SPNEGO wrapper found, using raw blob")
+		a.logger.Debug("No SPNEGO wrapper found, using raw blob")
 	} else {
-		log.Printf("[DEBUG] Extracted NTLM from SPNEGO, ntlmBlobLen=%d", len(ntlmBlob))
+		a.logger.Debug("Extracted NTLM from SPNEGO, ntlmBlobLen=%d", len(ntlmBlob))
 	}
 
 	// Check for NTLM signature
 	if len(ntlmBlob) < 12 || !bytes.HasPrefix(ntlmBlob, ntlmSignature) {
-		log.Printf("[DEBUG] No NTLM signature found (blobLen=%d, hasPrefix=%v)", len(ntlmBlob), bytes.HasPrefix(ntlmBlob, ntlmSignature))
+		a.logger.Debug("No NTLM signature found (blobLen=%d, hasPrefix=%v)", len(ntlmBlob), bytes.HasPrefix(ntlmBlob, ntlmSignature))
 		// Not NTLM - treat as anonymous/guest if allowed
 		if a.allowGuest {
 			return &AuthResult{
@@ -99,14 +126,14 @@ func (a *NTLMAuthenticator) Authenticate(securityBlob []byte) (*AuthResult, erro
 
 	// Get message type
 	msgType := binary.LittleEndian.Uint32(ntlmBlob[8:12])
-	log.Printf("[DEBUG] NTLM message type: %d (1=Negotiate, 2=Challenge, 3=Authenticate)", msgType)
+	a.logger.Debug("NTLM message type: %d (1=Negotiate, 2=Challenge, 3=Authenticate)", msgType)
 
 	// Show first 32 bytes of blob for debugging
 	dumpLen := 32
 	if len(ntlmBlob) < dumpLen {
 		dumpLen = len(ntlmBlob)
 	}
-	log.Printf("[DEBUG] NTLM blob (first %d bytes): %x", dumpLen, ntlmBlob[:dumpLen])
+	a.logger.Debug("NTLM blob (first %d bytes): %x", dumpLen, ntlmBlob[:dumpLen])
 
 	switch msgType {
 	case ntlmNegotiateMessage:
@@ -114,7 +141,7 @@ func (a *NTLMAuthenticator) Authenticate(securityBlob []byte) (*AuthResult, erro
 	case ntlmAuthenticateMessage:
 		return a.handleAuthenticate(ntlmBlob)
 	default:
-		log.Printf("[DEBUG] Unknown NTLM message type: %d", msgType)
+		a.logger.Debug("Unknown NTLM message type: %d", msgType)
 		return &AuthResult{Success: false}, nil
 	}
 }
@@ -137,7 +164,7 @@ func (a *NTLMAuthenticator) handleNegotiate(blob []byte) (*AuthResult, error) {
 	// Debug: log the challenge flags we're sending
 	if len(challenge) >= 24 {
 		flags := binary.LittleEndian.Uint32(challenge[20:24])
-		log.Printf("[DEBUG] NTLM: Client flags=0x%08x, Server response flags=0x%08x, Challenge size=%d",
+		a.logger.Debug("NTLM: Client flags=0x%08x, Server response flags=0x%08x, Challenge size=%d",
 			a.clientFlags, flags, len(challenge))
 	}
 
@@ -149,8 +176,8 @@ func (a *NTLMAuthenticator) handleNegotiate(blob []byte) (*AuthResult, error) {
 	if challengeLen > 64 {
 		challengeLen = 64
 	}
-	log.Printf("[DEBUG] NTLM Challenge hex (first 64 bytes): %x", challenge[:challengeLen])
-	log.Printf("[DEBUG] Response size=%d (raw NTLM, no SPNEGO)", len(responseBlob))
+	a.logger.Debug("NTLM Challenge hex (first 64 bytes): %x", challenge[:challengeLen])
+	a.logger.Debug("Response size=%d (raw NTLM, no SPNEGO)", len(responseBlob))
 
 	return &AuthResult{
 		Success:      false, // More processing required
@@ -166,7 +193,7 @@ func (a *NTLMAuthenticator) handleAuthenticate(blob []byte) (*AuthResult, error)
 	ntResponse := a.extractNTResponse(blob)
 	encryptedSessionKey := a.extractEncryptedSessionKey(blob)
 
-	log.Printf("[DEBUG] NTLM Type 3: username=%q, domain=%q, ntResponse len=%d, encSessKey len=%d",
+	a.logger.Debug("NTLM Type 3: username=%q, domain=%q, ntResponse len=%d, encSessKey len=%d",
 		username, domain, len(ntResponse), len(encryptedSessionKey))
 
 	// Check if this is a guest/anonymous login attempt
@@ -177,6 +204,7 @@ func (a *NTLMAuthenticator) handleAuthenticate(blob []byte) (*AuthResult, error)
 			return &AuthResult{
 				Success:      true,
 				IsGuest:      true,
+				IsNull:       username == "" && len(ntResponse) == 0, // Anonymous logon (MS-NLMP 3.2.5.1.2)
 				Username:     "Guest",
 				Domain:       domain,
 				SessionKey:   nil, // No signing for guest
@@ -187,7 +215,11 @@ func (a *NTLMAuthenticator) handleAuthenticate(blob []byte) (*AuthResult, error)
 	}
 
 	// Look up user (case-insensitive)
-	password, userExists := a.users[strings.ToUpper(username)]
+	var ntHash []byte
+	userExists := false
+	if a.users != nil {
+		ntHash, userExists = a.users.NTHash(username)
+	}
 
 	if !userExists {
 		// User not found - allow as guest if enabled, otherwise fail
@@ -205,14 +237,14 @@ func (a *NTLMAuthenticator) handleAuthenticate(blob []byte) (*AuthResult, error)
 	}
 
 	// Verify NTLM response and compute session key
-	sessionKey := a.verifyAndComputeSessionKey(username, password, domain, ntResponse, encryptedSessionKey)
+	sessionKey := a.verifyAndComputeSessionKey(username, ntHash, domain, ntResponse, encryptedSessionKey)
 	if sessionKey == nil {
 		return &AuthResult{Success: false}, nil
 	}
 
 	a.state = 2
 
-	log.Printf("[DEBUG] NTLM Type 3: Authentication successful, sessionKey len=%d", len(sessionKey))
+	a.logger.Debug("NTLM Type 3: Authentication successful, sessionKey len=%d", len(sessionKey))
 
 	return &AuthResult{
 		Success:      true,
@@ -227,16 +259,19 @@ func (a *NTLMAuthenticator) handleAuthenticate(blob []byte) (*AuthResult, error)
 // verifyAndComputeSessionKey verifies the NTLMv2 response and computes the session key
 // Returns the session key on success, nil on failure
 // encryptedSessionKey is the EncryptedRandomSessionKey from Type 3 message (for KEY_EXCH)
-func (a *NTLMAuthenticator) verifyAndComputeSessionKey(username, password, domain string, ntResponse, encryptedSessionKey []byte) []byte {
+func (a *NTLMAuthenticator) verifyAndComputeSessionKey(username string, ntHash []byte, domain string, ntResponse, encryptedSessionKey []byte) []byte {
 	// NTLMv2 response structure:
 	// - NTProofStr (16 bytes): HMAC_MD5(ResponseKeyNT, ServerChallenge + ClientBlob)
 	// - ClientBlob (variable): timestamp, random, target info, etc.
 
 	if len(ntResponse) < 24 {
 		// NTLMv2 response must be at least 16 (NTProofStr) + 8 (min blob) bytes
-		log.Printf("[DEBUG] NTLM: Response too short (%d bytes), accepting anyway for compatibility", len(ntResponse))
-		// For compatibility, generate a session key anyway
-		return a.computeSessionKeyForUser(username, password, domain)
+		if a.allowWeakNTLM {
+			a.logger.Debug("NTLM: Response too short (%d bytes), accepting (weak NTLM enabled)", len(ntResponse))
+			return a.computeSessionKeyForUser(username, ntHash, domain)
+		}
+		a.logger.Debug("NTLM: Response too short (%d bytes), rejecting", len(ntResponse))
+		return nil
 	}
 
 	// Extract NTProofStr (first 16 bytes)
@@ -244,7 +279,7 @@ func (a *NTLMAuthenticator) verifyAndComputeSessionKey(username, password, domai
 	clientBlob := ntResponse[16:]
 
 	// Compute ResponseKeyNT = NTOWFv2(password, username, domain)
-	responseKeyNT := a.ntv2Hash(username, password, domain)
+	responseKeyNT := a.ntv2Hash(username, ntHash, domain)
 
 	// Compute expected NTProofStr = HMAC_MD5(ResponseKeyNT, ServerChallenge + ClientBlob)
 	h := hmac.New(md5.New, responseKeyNT)
@@ -254,14 +289,17 @@ func (a *NTLMAuthenticator) verifyAndComputeSessionKey(username, password, domai
 
 	// Verify the NTProofStr
 	if !hmac.Equal(ntProofStr, expectedNTProofStr) {
-		log.Printf("[DEBUG] NTLM: NTProofStr mismatch")
-		log.Printf("[DEBUG] NTLM: Expected NTProofStr: %x", expectedNTProofStr)
-		log.Printf("[DEBUG] NTLM: Actual NTProofStr:   %x", ntProofStr)
-		log.Printf("[DEBUG] NTLM: ResponseKeyNT: %x", responseKeyNT)
-		log.Printf("[DEBUG] NTLM: ServerChallenge: %x", a.serverChallenge)
-		log.Printf("[DEBUG] NTLM: ClientBlob (first 32 bytes): %x", clientBlob[:min(32, len(clientBlob))])
-		// For compatibility with various clients, accept anyway but generate key
-		return a.computeSessionKeyForUser(username, password, domain)
+		a.logger.Debug("NTLM: NTProofStr mismatch")
+		a.logger.Debug("NTLM: Expected NTProofStr: %s", a.secret(expectedNTProofStr))
+		a.logger.Debug("NTLM: Actual NTProofStr:   %s", a.secret(ntProofStr))
+		a.logger.Debug("NTLM: ResponseKeyNT: %s", a.secret(responseKeyNT))
+		a.logger.Debug("NTLM: ServerChallenge: %x", a.serverChallenge)
+		a.logger.Debug("NTLM: ClientBlob (first 32 bytes): %x", clientBlob[:min(32, len(clientBlob))])
+		if a.allowWeakNTLM {
+			// Legacy behavior: accept anyway but generate a key
+			return a.computeSessionKeyForUser(username, ntHash, domain)
+		}
+		return nil
 	}
 
 	// Compute SessionBaseKey = HMAC_MD5(ResponseKeyNT, NTProofStr)
@@ -269,19 +307,19 @@ func (a *NTLMAuthenticator) verifyAndComputeSessionKey(username, password, domai
 	sessionH.Write(ntProofStr)
 	sessionBaseKey := sessionH.Sum(nil)
 
-	log.Printf("[DEBUG] NTLM: SessionBaseKey: %x", sessionBaseKey)
+	a.logger.Debug("NTLM: SessionBaseKey: %s", a.secret(sessionBaseKey))
 
 	// Check if NEGOTIATE_KEY_EXCH is set
 	// If set, client encrypted a random session key with SessionBaseKey using RC4
 	if a.clientFlags&ntlmFlagNegotiateKeyExch != 0 && len(encryptedSessionKey) == 16 {
 		// Decrypt the exported session key using RC4
 		exportedSessionKey := rc4Decrypt(sessionBaseKey, encryptedSessionKey)
-		log.Printf("[DEBUG] NTLM: KEY_EXCH enabled, ExportedSessionKey: %x", exportedSessionKey)
+		a.logger.Debug("NTLM: KEY_EXCH enabled, ExportedSessionKey: %s", a.secret(exportedSessionKey))
 		return exportedSessionKey
 	}
 
 	// If KEY_EXCH not set, use SessionBaseKey directly
-	log.Printf("[DEBUG] NTLM: Session key (no KEY_EXCH): %x", sessionBaseKey)
+	a.logger.Debug("NTLM: Session key (no KEY_EXCH): %s", a.secret(sessionBaseKey))
 	return sessionBaseKey
 }
 
@@ -289,7 +327,6 @@ func (a *NTLMAuthenticator) verifyAndComputeSessionKey(username, password, domai
 func rc4Decrypt(key, data []byte) []byte {
 	cipher, err := rc4.NewCipher(key)
 	if err != nil {
-		log.Printf("[DEBUG] NTLM: RC4 cipher error: %v", err)
 		return nil
 	}
 	result := make([]byte, len(data))
@@ -298,11 +335,11 @@ func rc4Decrypt(key, data []byte) []byte {
 }
 
 // computeSessionKeyForUser computes a session key for a user without verifying response
-// This is used for compatibility when we can't verify the response
-func (a *NTLMAuthenticator) computeSessionKeyForUser(username, password, domain string) []byte {
+// This is only used when weak NTLM is enabled and the response can't be verified
+func (a *NTLMAuthenticator) computeSessionKeyForUser(username string, ntHash []byte, domain string) []byte {
 	// Generate a deterministic session key based on user credentials and server challenge
 	// This won't match what the client computes, but at least we have a key
-	responseKeyNT := a.ntv2Hash(username, password, domain)
+	responseKeyNT := a.ntv2Hash(username, ntHash, domain)
 
 	h := hmac.New(md5.New, responseKeyNT)
 	h.Write(a.serverChallenge)
@@ -310,50 +347,8 @@ func (a *NTLMAuthenticator) computeSessionKeyForUser(username, password, domain
 	return h.Sum(nil)
 }
 
-// verifyNTLMResponse verifies the NTLM response against expected credentials (legacy)
-func (a *NTLMAuthenticator) verifyNTLMResponse(username, password string, ntResponse []byte) bool {
-	// For NTLMv2, the response is at least 24 bytes
-	// For simplicity, we'll accept any non-empty response if the user exists
-	// A full implementation would compute the expected response and compare
-
-	if len(ntResponse) == 0 {
-		return false
-	}
-
-	// Compute NT hash of password
-	ntHash := a.ntHash(password)
-
-	// For NTLMv1: response = DES(NT_Hash, challenge)
-	// For NTLMv2: response = HMAC_MD5(NTv2_Hash, challenge + blob)
-	// We'll do a simplified check - if we have a valid user with password, accept
-
-	// In practice, we should compute the expected response:
-	// 1. NTv2Hash = HMAC_MD5(NT_Hash, uppercase(username) + domain)
-	// 2. Expected = HMAC_MD5(NTv2Hash, serverChallenge + clientBlob)
-
-	// For now, verify we got something reasonable and user exists with password
-	if len(ntResponse) >= 24 && len(ntHash) == 16 {
-		return true // User exists and provided credentials
-	}
-
-	return len(ntResponse) > 0
-}
-
-// ntHash computes the NT hash (MD4 of UTF-16LE password)
-func (a *NTLMAuthenticator) ntHash(password string) []byte {
-	// Convert password to UTF-16LE
-	utf16 := EncodeStringToUTF16LE(password)
-
-	// Compute MD4 hash
-	h := md4.New()
-	h.Write(utf16)
-	return h.Sum(nil)
-}
-
-// ntv2Hash computes the NTLMv2 hash
-func (a *NTLMAuthenticator) ntv2Hash(username, password, domain string) []byte {
-	ntHash := a.ntHash(password)
-
+// ntv2Hash computes the NTLMv2 hash from the NT hash of the user's password
+func (a *NTLMAuthenticator) ntv2Hash(username string, ntHash []byte, domain string) []byte {
 	// NTv2Hash = HMAC_MD5(NT_Hash, uppercase(username) + uppercase(domain))
 	userDomain := strings.ToUpper(username) + strings.ToUpper(domain)
 	userDomainUTF16 := EncodeStringToUTF16LE(userDomain)
@@ -416,7 +411,7 @@ func (a *NTLMAuthenticator) extractEncryptedSessionKey(blob []byte) []byte {
 		return nil
 	}
 
-	log.Printf("[DEBUG] NTLM: EncryptedSessionKey: len=%d, offset=%d", keyLen, keyOffset)
+	a.logger.Debug("NTLM: EncryptedSessionKey: len=%d, offset=%d", keyLen, keyOffset)
 	return blob[keyOffset : keyOffset+uint32(keyLen)]
 }
 
@@ -621,7 +616,7 @@ func (a *NTLMAuthenticator) extractUsername(blob []byte) string {
 	userLen := binary.LittleEndian.Uint16(blob[36:38])
 	userOffset := binary.LittleEndian.Uint32(blob[40:44]) // Fixed: was 44:48, should be 40:44
 
-	log.Printf("[DEBUG] extractUsername: userLen=%d, userOffset=%d, blobLen=%d", userLen, userOffset, len(blob))
+	a.logger.Debug("extractUsername: userLen=%d, userOffset=%d, blobLen=%d", userLen, userOffset, len(blob))
 
 	if userLen == 0 || int(userOffset)+int(userLen) > len(blob) {
 		return ""
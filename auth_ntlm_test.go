@@ -0,0 +1,283 @@
+package smbfs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// buildNTLMAuthenticateMessage builds a minimal NTLM AUTHENTICATE_MESSAGE
+// carrying the given domain, username and NT challenge response
+func buildNTLMAuthenticateMessage(domain, username string, ntResponse []byte) []byte {
+	const headerLen = 64
+
+	domainUTF16 := EncodeStringToUTF16LE(domain)
+	userUTF16 := EncodeStringToUTF16LE(username)
+
+	msg := make([]byte, headerLen)
+	copy(msg[0:8], ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:12], ntlmAuthenticateMessage)
+
+	putField := func(fieldOffset int, data []byte) {
+		binary.LittleEndian.PutUint16(msg[fieldOffset:], uint16(len(data)))
+		binary.LittleEndian.PutUint16(msg[fieldOffset+2:], uint16(len(data)))
+		binary.LittleEndian.PutUint32(msg[fieldOffset+4:], uint32(len(msg)))
+		msg = append(msg, data...)
+	}
+	putField(20, ntResponse)  // NtChallengeResponseFields
+	putField(28, domainUTF16) // DomainNameFields
+	putField(36, userUTF16)   // UserNameFields
+
+	return msg
+}
+
+// buildNTLMv2Response computes a valid NTLMv2 response for the given credentials
+func buildNTLMv2Response(a *NTLMAuthenticator, username, password, domain string) []byte {
+	clientBlob := []byte{
+		0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Signature + Reserved
+		0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, // Timestamp
+		0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00, 0x11, // ClientChallenge
+	}
+
+	h := hmac.New(md5.New, a.ntv2Hash(username, NTPasswordHash(password), domain))
+	h.Write(a.serverChallenge)
+	h.Write(clientBlob)
+
+	return append(h.Sum(nil), clientBlob...)
+}
+
+// newTestNTLMAuthenticator creates an authenticator that has already issued a challenge
+func newTestNTLMAuthenticator() *NTLMAuthenticator {
+	a := NewNTLMAuthenticator("TESTSRV", PasswordUsers{"alice": "secret"}, false)
+	a.serverChallenge = []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	a.state = 1
+	return a
+}
+
+// TestNTLMAuthenticator_ValidResponse tests that a correct NTLMv2 response authenticates
+func TestNTLMAuthenticator_ValidResponse(t *testing.T) {
+	a := newTestNTLMAuthenticator()
+
+	ntResponse := buildNTLMv2Response(a, "alice", "secret", "WORKGROUP")
+	result, err := a.Authenticate(buildNTLMAuthenticateMessage("WORKGROUP", "alice", ntResponse))
+	if err != nil {
+		t.Fatalf("Authenticate() error = %v", err)
+	}
+	if !result.Success {
+		t.Fatal("Authenticate() Success = false, want true")
+	}
+	if result.IsGuest {
+		t.Error("Authenticate() IsGuest = true, want false")
+	}
+	if len(result.SessionKey) != 16 {
+		t.Errorf("SessionKey length = %d, want 16", len(result.SessionKey))
+	}
+}
+
+// TestNTLMAuthenticator_WrongPassword tests that an incorrect NTLMv2 response is rejected
+func TestNTLMAuthenticator_WrongPassword(t *testing.T) {
+	a := newTestNTLMAuthenticator()
+
+	ntResponse := buildNTLMv2Response(a, "alice", "wrong", "WORKGROUP")
+	result, err := a.Authenticate(buildNTLMAuthenticateMessage("WORKGROUP", "alice", ntResponse))
+	if err != nil {
+		t.Fatalf("Authenticate() error = %v", err)
+	}
+	if result.Success {
+		t.Error("Authenticate() Success = true, want false")
+	}
+	if result.ResponseBlob != nil {
+		t.Error("Authenticate() ResponseBlob should be nil for a failed logon")
+	}
+}
+
+// TestNTLMAuthenticator_ShortResponse tests that a truncated NT response is rejected
+func TestNTLMAuthenticator_ShortResponse(t *testing.T) {
+	a := newTestNTLMAuthenticator()
+
+	result, err := a.Authenticate(buildNTLMAuthenticateMessage("WORKGROUP", "alice", make([]byte, 16)))
+	if err != nil {
+		t.Fatalf("Authenticate() error = %v", err)
+	}
+	if result.Success {
+		t.Error("Authenticate() Success = true, want false")
+	}
+}
+
+// TestNTLMAuthenticator_AllowWeakNTLM tests the legacy escape hatch
+func TestNTLMAuthenticator_AllowWeakNTLM(t *testing.T) {
+	a := newTestNTLMAuthenticator()
+	a.SetAllowWeakNTLM(true)
+
+	ntResponse := buildNTLMv2Response(a, "alice", "wrong", "WORKGROUP")
+	result, err := a.Authenticate(buildNTLMAuthenticateMessage("WORKGROUP", "alice", ntResponse))
+	if err != nil {
+		t.Fatalf("Authenticate() error = %v", err)
+	}
+	if !result.Success {
+		t.Error("Authenticate() Success = false, want true with AllowWeakNTLM")
+	}
+}
+
+// TestNTLMAuthenticator_NTHashStore tests logons checked against a store
+// holding only NT hashes
+func TestNTLMAuthenticator_NTHashStore(t *testing.T) {
+	store := NTHashUsers{"Alice": NTPasswordHash("secret")}
+
+	tests := []struct {
+		username, password string
+		want               bool
+	}{
+		{"alice", "secret", true},
+		{"ALICE", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "secret", false},
+	}
+	for _, tt := range tests {
+		a := NewNTLMAuthenticator("TESTSRV", store, false)
+		a.serverChallenge = []byte{1, 2, 3, 4, 5, 6, 7, 8}
+		a.state = 1
+
+		ntResponse := buildNTLMv2Response(a, tt.username, tt.password, "WORKGROUP")
+		result, err := a.Authenticate(buildNTLMAuthenticateMessage("WORKGROUP", tt.username, ntResponse))
+		if err != nil {
+			t.Fatalf("Authenticate(%s/%s) error = %v", tt.username, tt.password, err)
+		}
+		if result.Success != tt.want {
+			t.Errorf("Authenticate(%s/%s) Success = %v, want %v", tt.username, tt.password, result.Success, tt.want)
+		}
+	}
+}
+
+// TestServer_UserStore tests that a client logs on to a server configured
+// with NT hashes, and that the store replaces the plaintext Users
+func TestServer_UserStore(t *testing.T) {
+	_, config := startLoopbackServer(t, ServerOptions{
+		UserStore: NTHashUsers{"carol": NTPasswordHash("hunter2")},
+	})
+
+	carol := *config
+	carol.Username = "carol"
+	carol.Password = "hunter2"
+	fsys, err := New(&carol)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+	if _, err := fsys.Stat("/hello.txt"); err != nil {
+		t.Errorf("Stat() as a stored user error = %v", err)
+	}
+
+	tester, err := New(config)
+	if err == nil {
+		_, err = tester.Stat("/hello.txt")
+		tester.Close()
+	}
+	if err == nil {
+		t.Error("Stat() as a user only in Users succeeded, want a logon failure")
+	}
+}
+
+// logBuffer collects log output written from several goroutines
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// newDebugLogger returns a logger taking every level, writing to out
+func newDebugLogger(out *logBuffer) *SlogLogger {
+	return NewSlogLogger(slog.NewTextHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
+// TestNTLMAuthenticator_LogSecrets tests that the authenticator logs through
+// its logger and leaves key material out unless told to log secrets
+func TestNTLMAuthenticator_LogSecrets(t *testing.T) {
+	for _, logSecrets := range []bool{false, true} {
+		var out logBuffer
+		a := newTestNTLMAuthenticator()
+		a.SetLogger(newDebugLogger(&out), logSecrets)
+
+		result, err := a.Authenticate(buildNTLMAuthenticateMessage("WORKGROUP", "alice",
+			buildNTLMv2Response(a, "alice", "secret", "WORKGROUP")))
+		if err != nil || !result.Success {
+			t.Fatalf("Authenticate() = %+v, %v, want success", result, err)
+		}
+		responseKeyNT := a.ntv2Hash("alice", NTPasswordHash("secret"), "WORKGROUP")
+		a.Authenticate(buildNTLMAuthenticateMessage("WORKGROUP", "alice",
+			buildNTLMv2Response(a, "alice", "wrong", "WORKGROUP")))
+
+		logged := out.String()
+		if !strings.Contains(logged, "SessionBaseKey") || !strings.Contains(logged, "ResponseKeyNT") {
+			t.Fatalf("log with LogSecrets=%v lacks key messages:\n%s", logSecrets, logged)
+		}
+		for name, secret := range map[string][]byte{"session key": result.SessionKey, "ResponseKeyNT": responseKeyNT} {
+			if got := strings.Contains(logged, hex.EncodeToString(secret)); got != logSecrets {
+				t.Errorf("log with LogSecrets=%v contains the %s: %v", logSecrets, name, got)
+			}
+		}
+		if got := strings.Contains(logged, redactedSecret); got == logSecrets {
+			t.Errorf("log with LogSecrets=%v redacts secrets: %v", logSecrets, got)
+		}
+	}
+}
+
+// TestServer_AuthLogging tests that the server's authenticators log through
+// the server's logger, with secrets redacted by default
+func TestServer_AuthLogging(t *testing.T) {
+	var out logBuffer
+	_, config := startLoopbackServer(t, ServerOptions{Logger: newDebugLogger(&out)})
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if _, err := fsys.Stat("/hello.txt"); err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	fsys.Close()
+
+	logged := out.String()
+	if !strings.Contains(logged, "SessionBaseKey: "+redactedSecret) {
+		t.Errorf("server log lacks a redacted SessionBaseKey:\n%s", logged)
+	}
+}
+
+// TestSlogLogger tests that messages are formatted and reach the handler at
+// their level, and only if it takes that level
+func TestSlogLogger(t *testing.T) {
+	var out logBuffer
+	logger := NewSlogLogger(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	logger.Debug("debug %d", 1)
+	logger.Info("info %d", 2)
+	logger.Warn("warn %s", "three")
+	logger.Error("error %v", 4.5)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	want := []string{`level=INFO msg="info 2"`, `level=WARN msg="warn three"`, `level=ERROR msg="error 4.5"`}
+	if len(lines) != len(want) {
+		t.Fatalf("logged %d lines, want %d:\n%s", len(lines), len(want), out.String())
+	}
+	for i, line := range lines {
+		if !strings.HasSuffix(line, want[i]) {
+			t.Errorf("line %d = %q, want suffix %q", i, line, want[i])
+		}
+	}
+}
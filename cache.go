@@ -1,7 +1,9 @@
 package smbfs
 
 import (
+	"container/list"
 	"io/fs"
+	"strings"
 	"sync"
 	"time"
 )
@@ -19,9 +21,25 @@ type CacheConfig struct {
 	// Default: 5 seconds. Set to 0 to disable stat caching.
 	StatCacheTTL time.Duration
 
-	// MaxCacheEntries is the maximum number of cache entries.
-	// When exceeded, oldest entries are evicted. Default: 1000.
+	// MaxCacheEntries is the maximum number of cache entries. Stat,
+	// directory and not-found entries all count toward it, and the least
+	// recently used are evicted once it is exceeded. Default: 1000.
 	MaxCacheEntries int
+
+	// StaleWhileRevalidate serves expired entries that are still within
+	// StaleGrace immediately and refreshes them in the background, so
+	// callers never block on a miss for recently cached paths.
+	StaleWhileRevalidate bool
+
+	// StaleGrace is how long past its TTL an entry may still be served
+	// while a background refresh runs. Default: same as the entry's TTL.
+	StaleGrace time.Duration
+
+	// NegativeCacheTTL is how long a stat that found no file is remembered,
+	// so repeated probes for a missing path return fs.ErrNotExist without a
+	// round trip. Creating, renaming or opening the path drops the entry.
+	// Default: 0, which disables negative caching.
+	NegativeCacheTTL time.Duration
 }
 
 // DefaultCacheConfig returns a cache configuration with reasonable defaults.
@@ -41,8 +59,33 @@ type metadataCache struct {
 	config        CacheConfig
 	dirCache      map[string]*dirCacheEntry
 	statCache     map[string]*statCacheEntry
-	accessOrder   []string // LRU tracking
+	notFound      map[string]time.Time // Paths that did not exist, keyed to when they were checked
+	lru           *list.List // cacheKeys, most recently used at the front
+	lruIndex      map[cacheKey]*list.Element
 	enabled       bool
+
+	// Counters reported by Stats, guarded by mu
+	hits      uint64
+	misses    uint64
+	evictions uint64
+
+	refreshMu  sync.Mutex
+	refreshing map[string]struct{} // In-flight background refreshes, keyed by kind and path
+}
+
+// cacheKind identifies which of the cache's maps an entry lives in.
+type cacheKind uint8
+
+const (
+	statKind cacheKind = iota
+	dirKind
+	notFoundKind
+)
+
+// cacheKey identifies a single cache entry in the LRU list.
+type cacheKey struct {
+	kind cacheKind
+	path string
 }
 
 type dirCacheEntry struct {
@@ -71,8 +114,11 @@ func newMetadataCache(config CacheConfig) *metadataCache {
 		config:      config,
 		dirCache:    make(map[string]*dirCacheEntry),
 		statCache:   make(map[string]*statCacheEntry),
-		accessOrder: make([]string, 0, config.MaxCacheEntries),
+		notFound:    make(map[string]time.Time),
+		lru:         list.New(),
+		lruIndex:    make(map[cacheKey]*list.Element),
 		enabled:     config.EnableCache,
+		refreshing:  make(map[string]struct{}),
 	}
 }
 
@@ -82,19 +128,23 @@ func (c *metadataCache) getDirEntries(path string) ([]fs.DirEntry, bool) {
 		return nil, false
 	}
 
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
 	entry, ok := c.dirCache[path]
 	if !ok {
+		c.misses++
 		return nil, false
 	}
 
 	// Check if expired
 	if time.Since(entry.cachedAt) > c.config.DirCacheTTL {
+		c.misses++
 		return nil, false
 	}
 
+	c.hits++
+	c.touch(dirKind, path)
 	return entry.entries, true
 }
 
@@ -112,7 +162,7 @@ func (c *metadataCache) putDirEntries(path string, entries []fs.DirEntry) {
 		cachedAt: time.Now(),
 	}
 
-	c.trackAccess(path)
+	c.touch(dirKind, path)
 	c.evictIfNeeded()
 }
 
@@ -122,19 +172,23 @@ func (c *metadataCache) getStatInfo(path string) (fs.FileInfo, bool) {
 		return nil, false
 	}
 
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
 	entry, ok := c.statCache[path]
 	if !ok {
+		c.misses++
 		return nil, false
 	}
 
 	// Check if expired
 	if time.Since(entry.cachedAt) > c.config.StatCacheTTL {
+		c.misses++
 		return nil, false
 	}
 
+	c.hits++
+	c.touch(statKind, path)
 	return entry.info, true
 }
 
@@ -151,11 +205,138 @@ func (c *metadataCache) putStatInfo(path string, info fs.FileInfo) {
 		info:     info,
 		cachedAt: time.Now(),
 	}
+	c.remove(notFoundKind, path)
+
+	c.touch(statKind, path)
+	c.evictIfNeeded()
+}
+
+// isNotFound reports whether path was recently found not to exist.
+// Only hits are counted; callers fall back to getStatInfo, which counts
+// the miss.
+func (c *metadataCache) isNotFound(path string) bool {
+	if !c.enabled || c.config.NegativeCacheTTL == 0 {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	checkedAt, ok := c.notFound[path]
+	if !ok || time.Since(checkedAt) > c.config.NegativeCacheTTL {
+		return false
+	}
+
+	c.hits++
+	c.touch(notFoundKind, path)
+	return true
+}
+
+// putNotFound records that path does not exist.
+func (c *metadataCache) putNotFound(path string) {
+	if !c.enabled || c.config.NegativeCacheTTL == 0 {
+		return
+	}
 
-	c.trackAccess(path)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.notFound[path] = time.Now()
+	c.remove(statKind, path)
+
+	c.touch(notFoundKind, path)
 	c.evictIfNeeded()
 }
 
+// forgetNotFound drops the negative entry for path, if any. It is used when
+// path is known to exist without otherwise changing what is cached about it.
+func (c *metadataCache) forgetNotFound(path string) {
+	if !c.enabled {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(notFoundKind, path)
+}
+
+// staleGrace returns the window past ttl during which stale entries may be served.
+func (c *metadataCache) staleGrace(ttl time.Duration) time.Duration {
+	if !c.config.StaleWhileRevalidate {
+		return 0
+	}
+	if c.config.StaleGrace > 0 {
+		return c.config.StaleGrace
+	}
+	return ttl
+}
+
+// getStaleDirEntries retrieves expired directory entries that are still within the
+// stale grace window. It only returns entries when StaleWhileRevalidate is enabled.
+func (c *metadataCache) getStaleDirEntries(path string) ([]fs.DirEntry, bool) {
+	if !c.enabled || c.config.DirCacheTTL == 0 || !c.config.StaleWhileRevalidate {
+		return nil, false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, ok := c.dirCache[path]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Since(entry.cachedAt) > c.config.DirCacheTTL+c.staleGrace(c.config.DirCacheTTL) {
+		return nil, false
+	}
+
+	return entry.entries, true
+}
+
+// getStaleStatInfo retrieves expired file info that is still within the stale
+// grace window. It only returns entries when StaleWhileRevalidate is enabled.
+func (c *metadataCache) getStaleStatInfo(path string) (fs.FileInfo, bool) {
+	if !c.enabled || c.config.StatCacheTTL == 0 || !c.config.StaleWhileRevalidate {
+		return nil, false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, ok := c.statCache[path]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Since(entry.cachedAt) > c.config.StatCacheTTL+c.staleGrace(c.config.StatCacheTTL) {
+		return nil, false
+	}
+
+	return entry.info, true
+}
+
+// refreshAsync runs refresh in a new goroutine unless a refresh for the same
+// key is already in flight, so concurrent stale hits trigger a single fetch.
+func (c *metadataCache) refreshAsync(key string, refresh func()) {
+	c.refreshMu.Lock()
+	if _, busy := c.refreshing[key]; busy {
+		c.refreshMu.Unlock()
+		return
+	}
+	c.refreshing[key] = struct{}{}
+	c.refreshMu.Unlock()
+
+	go func() {
+		defer func() {
+			c.refreshMu.Lock()
+			delete(c.refreshing, key)
+			c.refreshMu.Unlock()
+		}()
+		refresh()
+	}()
+}
+
 // invalidate removes cache entries for a specific path and its parent directory.
 // This should be called after any write operation.
 func (c *metadataCache) invalidate(path string) {
@@ -167,12 +348,23 @@ func (c *metadataCache) invalidate(path string) {
 	defer c.mu.Unlock()
 
 	// Invalidate the path itself
-	delete(c.dirCache, path)
-	delete(c.statCache, path)
+	c.remove(dirKind, path)
+	c.remove(statKind, path)
+
+	// A directory renamed into place may bring children that were missing
+	c.remove(notFoundKind, path)
+	if len(c.notFound) > 0 {
+		prefix := strings.TrimSuffix(path, "/") + "/"
+		for p := range c.notFound {
+			if strings.HasPrefix(p, prefix) {
+				c.remove(notFoundKind, p)
+			}
+		}
+	}
 
 	// Invalidate parent directory (since its listing has changed)
 	parentPath := c.getParentPath(path)
-	delete(c.dirCache, parentPath)
+	c.remove(dirKind, parentPath)
 }
 
 // invalidateAll clears all cache entries.
@@ -186,38 +378,47 @@ func (c *metadataCache) invalidateAll() {
 
 	c.dirCache = make(map[string]*dirCacheEntry)
 	c.statCache = make(map[string]*statCacheEntry)
-	c.accessOrder = c.accessOrder[:0]
+	c.notFound = make(map[string]time.Time)
+	c.lru.Init()
+	c.lruIndex = make(map[cacheKey]*list.Element)
 }
 
-// trackAccess tracks access order for LRU eviction.
-func (c *metadataCache) trackAccess(path string) {
-	// Remove if exists
-	for i, p := range c.accessOrder {
-		if p == path {
-			c.accessOrder = append(c.accessOrder[:i], c.accessOrder[i+1:]...)
-			break
-		}
+// touch marks an entry as the most recently used, adding it to the LRU
+// list if it is new.
+func (c *metadataCache) touch(kind cacheKind, path string) {
+	key := cacheKey{kind: kind, path: path}
+	if elem, ok := c.lruIndex[key]; ok {
+		c.lru.MoveToFront(elem)
+		return
 	}
-
-	// Add to end (most recently used)
-	c.accessOrder = append(c.accessOrder, path)
+	c.lruIndex[key] = c.lru.PushFront(key)
 }
 
-// evictIfNeeded evicts oldest entries if cache is full.
-func (c *metadataCache) evictIfNeeded() {
-	totalEntries := len(c.dirCache) + len(c.statCache)
-	if totalEntries <= c.config.MaxCacheEntries {
-		return
+// remove deletes an entry from its map and from the LRU list.
+func (c *metadataCache) remove(kind cacheKind, path string) {
+	switch kind {
+	case statKind:
+		delete(c.statCache, path)
+	case dirKind:
+		delete(c.dirCache, path)
+	case notFoundKind:
+		delete(c.notFound, path)
 	}
 
-	// Evict oldest entries until we're under the limit
-	entriesToEvict := totalEntries - c.config.MaxCacheEntries
-	for i := 0; i < entriesToEvict && len(c.accessOrder) > 0; i++ {
-		oldestPath := c.accessOrder[0]
-		c.accessOrder = c.accessOrder[1:]
+	key := cacheKey{kind: kind, path: path}
+	if elem, ok := c.lruIndex[key]; ok {
+		c.lru.Remove(elem)
+		delete(c.lruIndex, key)
+	}
+}
 
-		delete(c.dirCache, oldestPath)
-		delete(c.statCache, oldestPath)
+// evictIfNeeded evicts least recently used entries until the cache is
+// back within MaxCacheEntries.
+func (c *metadataCache) evictIfNeeded() {
+	for c.lru.Len() > c.config.MaxCacheEntries {
+		key := c.lru.Back().Value.(cacheKey)
+		c.remove(key.kind, key.path)
+		c.evictions++
 	}
 }
 
@@ -245,8 +446,17 @@ type CacheStats struct {
 	Enabled         bool
 	DirCacheEntries int
 	StatCacheEntries int
+	NegativeEntries int
 	TotalEntries    int
 	MaxEntries      int
+
+	// Hits and Misses count lookups that did and did not find a fresh
+	// entry; a stale entry served while it is refreshed is a miss.
+	Hits   uint64
+	Misses uint64
+
+	// Evictions counts entries dropped to stay within MaxEntries.
+	Evictions uint64
 }
 
 // Stats returns cache statistics.
@@ -258,7 +468,17 @@ func (c *metadataCache) Stats() CacheStats {
 		Enabled:          c.enabled,
 		DirCacheEntries:  len(c.dirCache),
 		StatCacheEntries: len(c.statCache),
-		TotalEntries:     len(c.dirCache) + len(c.statCache),
+		NegativeEntries:  len(c.notFound),
+		TotalEntries:     c.lru.Len(),
 		MaxEntries:       c.config.MaxCacheEntries,
+		Hits:             c.hits,
+		Misses:           c.misses,
+		Evictions:        c.evictions,
 	}
 }
+
+// CacheStats returns statistics for the metadata cache, including hit,
+// miss and eviction counts since the filesystem was created.
+func (fsys *FileSystem) CacheStats() CacheStats {
+	return fsys.cache.Stats()
+}
@@ -1,6 +1,8 @@
 package smbfs
 
 import (
+	"errors"
+	"fmt"
 	"io/fs"
 	"testing"
 	"time"
@@ -155,6 +157,98 @@ func TestMetadataCache_Eviction(t *testing.T) {
 	}
 }
 
+func TestMetadataCache_EvictionLRU(t *testing.T) {
+	config := CacheConfig{
+		EnableCache:     true,
+		DirCacheTTL:     1 * time.Hour,
+		StatCacheTTL:    1 * time.Hour,
+		MaxCacheEntries: 3,
+	}
+	cache := newMetadataCache(config)
+
+	// Stat and dir entries share the cap
+	cache.putStatInfo("/a", &fileInfo{name: "a"})
+	cache.putDirEntries("/b", []fs.DirEntry{})
+	cache.putStatInfo("/c", &fileInfo{name: "c"})
+
+	// Reading /a makes /b the least recently used
+	if _, ok := cache.getStatInfo("/a"); !ok {
+		t.Fatal("Expected /a to be cached")
+	}
+	cache.putStatInfo("/d", &fileInfo{name: "d"})
+
+	if _, ok := cache.getDirEntries("/b"); ok {
+		t.Error("Expected least recently used /b to be evicted")
+	}
+	for _, path := range []string{"/a", "/c", "/d"} {
+		if _, ok := cache.getStatInfo(path); !ok {
+			t.Errorf("Expected %s to be cached", path)
+		}
+	}
+
+	// A stat and a dir entry for the same path count separately
+	cache.putDirEntries("/d", []fs.DirEntry{})
+
+	stats := cache.Stats()
+	if stats.TotalEntries != 3 {
+		t.Errorf("TotalEntries = %d, want 3", stats.TotalEntries)
+	}
+	if stats.DirCacheEntries+stats.StatCacheEntries != stats.TotalEntries {
+		t.Errorf("DirCacheEntries %d + StatCacheEntries %d != TotalEntries %d",
+			stats.DirCacheEntries, stats.StatCacheEntries, stats.TotalEntries)
+	}
+	if stats.Evictions != 2 {
+		t.Errorf("Evictions = %d, want 2", stats.Evictions)
+	}
+	if _, ok := cache.getStatInfo("/a"); ok {
+		t.Error("Expected /a to be evicted after /c and /d were read")
+	}
+}
+
+func TestMetadataCache_HitMissCounters(t *testing.T) {
+	config := CacheConfig{
+		EnableCache:      true,
+		DirCacheTTL:      1 * time.Hour,
+		StatCacheTTL:     1 * time.Hour,
+		NegativeCacheTTL: 1 * time.Hour,
+		MaxCacheEntries:  10,
+	}
+	cache := newMetadataCache(config)
+
+	cache.getStatInfo("/file.txt") // miss
+	cache.getDirEntries("/dir")    // miss
+	cache.putStatInfo("/file.txt", &fileInfo{name: "file.txt"})
+	cache.putDirEntries("/dir", []fs.DirEntry{})
+	cache.putNotFound("/missing")
+	cache.getStatInfo("/file.txt") // hit
+	cache.getStatInfo("/file.txt") // hit
+	cache.getDirEntries("/dir")    // hit
+	cache.isNotFound("/missing")   // hit
+	cache.isNotFound("/other")     // not counted
+	cache.getStatInfo("/other")    // miss
+
+	stats := cache.Stats()
+	if stats.Hits != 4 {
+		t.Errorf("Hits = %d, want 4", stats.Hits)
+	}
+	if stats.Misses != 3 {
+		t.Errorf("Misses = %d, want 3", stats.Misses)
+	}
+	if stats.Evictions != 0 {
+		t.Errorf("Evictions = %d, want 0", stats.Evictions)
+	}
+	if stats.TotalEntries != 3 || stats.NegativeEntries != 1 {
+		t.Errorf("TotalEntries = %d, NegativeEntries = %d, want 3 and 1", stats.TotalEntries, stats.NegativeEntries)
+	}
+
+	// Invalidation removes entries without counting evictions
+	cache.invalidate("/file.txt")
+	stats = cache.Stats()
+	if stats.TotalEntries != 2 || stats.Evictions != 0 {
+		t.Errorf("after invalidate TotalEntries = %d, Evictions = %d, want 2 and 0", stats.TotalEntries, stats.Evictions)
+	}
+}
+
 func TestMetadataCache_Disabled(t *testing.T) {
 	config := CacheConfig{
 		EnableCache:     false,
@@ -258,3 +352,73 @@ func TestMetadataCache_GetParentPath(t *testing.T) {
 		})
 	}
 }
+
+// TestFileSystem_ReadDirInfo tests that ReadDirInfo returns what Stat does
+// for each entry, and that Stats of the listed entries are then cache hits
+func TestFileSystem_ReadDirInfo(t *testing.T) {
+	srv, config := startLoopbackServer(t, ServerOptions{})
+	if err := srv.GetShare("data").fs.MkdirAll("/list/sub", 0755); err != nil {
+		t.Fatalf("MkdirAll() error = %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		writeShareFile(t, srv, fmt.Sprintf("/list/f%d.txt", i), make([]byte, i*100))
+	}
+
+	uncached, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer uncached.Close()
+
+	cachedConfig := *config
+	cachedConfig.Cache = DefaultCacheConfig()
+	cachedConfig.Cache.EnableCache = true
+	fsys, err := New(&cachedConfig)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	infos, err := fsys.ReadDirInfo("/list")
+	if err != nil {
+		t.Fatalf("ReadDirInfo() error = %v", err)
+	}
+	if len(infos) != 6 {
+		t.Fatalf("ReadDirInfo() returned %d entries, want 6", len(infos))
+	}
+
+	before := srv.Metrics().Commands
+	for _, info := range infos {
+		name := "/list/" + info.Name()
+		got, err := fsys.Stat(name)
+		if err != nil {
+			t.Fatalf("Stat(%s) error = %v", name, err)
+		}
+		if got != info {
+			t.Errorf("Stat(%s) was not answered from the listing", name)
+		}
+	}
+	after := srv.Metrics().Commands
+	for cmd, n := range after {
+		if n != before[cmd] {
+			t.Errorf("Stat after ReadDirInfo sent %d %s, want none", n-before[cmd], CommandName(cmd))
+		}
+	}
+
+	for _, info := range infos {
+		name := "/list/" + info.Name()
+		want, err := uncached.Stat(name)
+		if err != nil {
+			t.Fatalf("Stat(%s) error = %v", name, err)
+		}
+		if info.Size() != want.Size() || info.Mode() != want.Mode() || info.IsDir() != want.IsDir() ||
+			!info.ModTime().Equal(want.ModTime()) {
+			t.Errorf("ReadDirInfo() entry %s = %v %v %v, want %v %v %v", info.Name(),
+				info.Size(), info.Mode(), info.ModTime(), want.Size(), want.Mode(), want.ModTime())
+		}
+	}
+
+	if _, err := fsys.ReadDirInfo("/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadDirInfo() of a missing directory error = %v, want not exist", err)
+	}
+}
@@ -0,0 +1,85 @@
+package smbfs
+
+import (
+	"path"
+	"strings"
+)
+
+// maxCaseNames bounds the share's cache of resolved names; it starts over
+// when full
+const maxCaseNames = 4096
+
+// resolveCase returns the share-relative path name with each element that
+// does not exist as given replaced by the entry of its directory that
+// matches it ignoring case, as SMB clients expect. An element no entry
+// matches, and those after it, are kept as given, so new files can be
+// created in existing directories. Resolved names are cached and checked
+// before use. Shares without CaseInsensitive set take names as given
+func (s *Share) resolveCase(name string) string {
+	if !s.Options().CaseInsensitive {
+		return name
+	}
+	fsys := s.FileSystem()
+	if _, err := fsys.Stat(name); err == nil {
+		return name
+	}
+
+	key := strings.ToLower(shareRelativePath(name))
+	s.caseMu.Lock()
+	cached, ok := s.caseNames[key]
+	s.caseMu.Unlock()
+	if ok {
+		if _, err := fsys.Stat(cached); err == nil {
+			return cached
+		}
+	}
+
+	elems := strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/")
+	dir := "/"
+	for i, elem := range elems {
+		next := path.Join(dir, elem)
+		if _, err := fsys.Stat(next); err != nil {
+			match := ""
+			if entries, err := fsys.ReadDir(dir); err == nil {
+				for _, e := range entries {
+					if strings.EqualFold(e.Name(), elem) {
+						match = e.Name()
+						break
+					}
+				}
+			}
+			if match == "" {
+				return shareRelativePath(path.Join(dir, strings.Join(elems[i:], "/")))
+			}
+			next = path.Join(dir, match)
+		}
+		dir = next
+	}
+
+	resolved := shareRelativePath(dir)
+	s.caseMu.Lock()
+	if s.caseNames == nil || len(s.caseNames) >= maxCaseNames {
+		s.caseNames = make(map[string]string)
+	}
+	s.caseNames[key] = resolved
+	s.caseMu.Unlock()
+	return resolved
+}
+
+// resolveParentCase is resolveCase for the directory of name only, for
+// names a file is being given, whose own case is the caller's choice
+func (s *Share) resolveParentCase(name string) string {
+	dir, base := path.Split(shareRelativePath(name))
+	if dir == "" {
+		return shareRelativePath(name)
+	}
+	return shareRelativePath(path.Join(s.resolveCase(dir), base))
+}
+
+// forgetCaseNames drops every resolved name, when the share's filesystem
+// is replaced
+func (s *Share) forgetCaseNames() {
+	s.caseMu.Lock()
+	s.caseNames = nil
+	s.caseMu.Unlock()
+}
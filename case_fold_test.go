@@ -0,0 +1,62 @@
+package smbfs
+
+import (
+	"testing"
+)
+
+// TestCreate_CaseInsensitive tests that CREATE finds files and directories
+// by names that differ in case from theirs, unless the share is
+// case-sensitive
+func TestCreate_CaseInsensitive(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	share := tree.Share
+	share.options.CaseInsensitive = true
+	share.fs.Mkdir("/Docs", 0755)
+	f, _ := share.fs.Create("/Docs/readme.txt")
+	f.Write([]byte("hello"))
+	f.Close()
+
+	create := func(name string, disposition uint32) (string, NTStatus) {
+		t.Helper()
+		resp, status := srv.handler.handleCreate(nil,
+			testRequest(session, tree, SMB2_CREATE, buildCreateRequest(name, disposition, 0, nil)), nil)
+		if status != STATUS_SUCCESS {
+			return "", status
+		}
+		of := share.fileHandles.Get(UnmarshalFileID(resp[64:80]))
+		defer share.fileHandles.Release(of.ID)
+		return of.Path, status
+	}
+
+	tests := []struct {
+		name        string
+		disposition uint32
+		want        string
+	}{
+		{"Docs\\readme.txt", FILE_OPEN, "Docs/readme.txt"},
+		{"DOCS\\README.TXT", FILE_OPEN, "Docs/readme.txt"},
+		{"docs\\ReadMe.txt", FILE_OPEN, "Docs/readme.txt"},
+		{"DOCS", FILE_OPEN, "Docs"},
+		{"docs\\New.txt", FILE_CREATE, "Docs/New.txt"},
+		{"DOCS\\NEW.TXT", FILE_OPEN, "Docs/New.txt"},
+	}
+	for _, tt := range tests {
+		if got, status := create(tt.name, tt.disposition); status != STATUS_SUCCESS || got != tt.want {
+			t.Errorf("CREATE %s = %q, %v, want %q", tt.name, got, status, tt.want)
+		}
+	}
+	if _, status := create("docs\\missing.txt", FILE_OPEN); status != STATUS_OBJECT_NAME_NOT_FOUND {
+		t.Errorf("CREATE of a missing file status = %v, want STATUS_OBJECT_NAME_NOT_FOUND", status)
+	}
+
+	share.options.CaseInsensitive = false
+	if _, status := create("DOCS\\README.TXT", FILE_OPEN); status == STATUS_SUCCESS {
+		t.Error("CREATE by another case on a case-sensitive share succeeded")
+	}
+	if got, status := create("Docs\\readme.txt", FILE_OPEN); status != STATUS_SUCCESS || got != "Docs/readme.txt" {
+		t.Errorf("CREATE by the exact name on a case-sensitive share = %q, %v", got, status)
+	}
+	if !DefaultShareOptions("test").CaseInsensitive {
+		t.Error("DefaultShareOptions() returned a case-sensitive share")
+	}
+}
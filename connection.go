@@ -2,59 +2,161 @@ package smbfs
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
 	"time"
 
-	"github.com/hirochachacha/go-smb2"
+	"github.com/absfs/smbfs/internal/smb2"
 )
 
 // connectionPool manages a pool of SMB connections.
 type connectionPool struct {
 	config  *Config
 	factory ConnectionFactory
+	dfs     *dfsResolver // DFS referral handling, nil unless enabled
 
 	mu          sync.Mutex
 	connections []*pooledConn
 	waiters     []chan *pooledConn
 	numOpen     int
 	closed      bool
+
+	healthCheckFailures int64 // Idle connections found dead on reuse
+
+	// refill wakes the goroutine that keeps MinIdle idle connections open;
+	// nil unless MinIdle is set
+	refill    chan struct{}
+	warmupErr error // Error of the last attempt to open an idle connection
+
+	// generation is bumped when the server turns out to have dropped a
+	// session; connections from earlier generations are not reused
+	generation uint64
+
+	// parent is the pool whose sessions this pool mounts its share on,
+	// for filesystems made by FileSystem.MountShare
+	parent *connectionPool
 }
 
 // pooledConn wraps an SMB connection with metadata.
 type pooledConn struct {
-	session   SMBSession
+	session   *sharedSession
 	share     SMBShare
 	createdAt time.Time
 	lastUsed  time.Time
 	inUse     bool
 	mu        sync.Mutex
+
+	generation uint64         // Pool generation the connection was made in
+	info       ConnectionInfo // How the connection was set up
+
+	// The network connection, for operation deadlines (see beginOp); nil
+	// for connections from a ConnectionFactory, which get none
+	transport *netTransport
+}
+
+// sharedSession is an authenticated session that the pooled connections
+// of several filesystems may mount their shares on. Each connection holds
+// a reference, and the session is logged off when the last one closes.
+type sharedSession struct {
+	SMBSession
+	mu   sync.Mutex
+	refs int
+}
+
+// newSharedSession returns a session with one reference, for the
+// connection that set it up.
+func newSharedSession(session SMBSession) *sharedSession {
+	return &sharedSession{SMBSession: session, refs: 1}
+}
+
+// retain takes another reference to the session. It reports false if
+// the session has already been logged off.
+func (s *sharedSession) retain() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refs == 0 {
+		return false
+	}
+	s.refs++
+	return true
+}
+
+// Logoff drops a reference to the session, logging off if it was the
+// last.
+func (s *sharedSession) Logoff() error {
+	s.mu.Lock()
+	if s.refs == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	s.refs--
+	last := s.refs == 0
+	s.mu.Unlock()
+
+	if !last {
+		return nil
+	}
+	return s.SMBSession.Logoff()
+}
+
+// netTransport is the network connection under the pooled connections of
+// a session. The operations on all of them share its deadline.
+type netTransport struct {
+	conn      net.Conn
+	opTimeout time.Duration
+	mu        sync.Mutex
+	ops       int       // Operations in progress
+	deadline  time.Time // Deadline of the operations in progress
+	timedOut  bool      // An operation overran its deadline
 }
 
 // newConnectionPool creates a new connection pool.
 func newConnectionPool(config *Config) *connectionPool {
-	return &connectionPool{
+	p := &connectionPool{
 		config:      config,
 		factory:     nil, // Uses default createConnection
 		connections: make([]*pooledConn, 0, config.MaxOpen),
 		waiters:     make([]chan *pooledConn, 0),
 	}
+	if config.EnableDFS {
+		p.dfs = newDFSResolver(config, nil)
+	}
+	return p
 }
 
 // newConnectionPoolWithFactory creates a new connection pool with a custom factory.
 // This is used for testing with mock connections.
 func newConnectionPoolWithFactory(config *Config, factory ConnectionFactory) *connectionPool {
-	return &connectionPool{
+	p := &connectionPool{
 		config:      config,
 		factory:     factory,
 		connections: make([]*pooledConn, 0, config.MaxOpen),
 		waiters:     make([]chan *pooledConn, 0),
 	}
+	if config.EnableDFS {
+		p.dfs = newDFSResolver(config, factory)
+	}
+	return p
 }
 
-// get acquires a connection from the pool.
+// get acquires a connection from the pool for an operation, which ends
+// when the connection is put back. A connection held between operations,
+// as a File holds its own, ends the first with endOp and brackets each
+// later one with beginOp and endOp.
 func (p *connectionPool) get(ctx context.Context) (*pooledConn, error) {
+	conn, err := p.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn.beginOp()
+	return conn, nil
+}
+
+// acquire takes an idle connection from the pool, creates one or waits
+// for one to be put back.
+func (p *connectionPool) acquire(ctx context.Context) (*pooledConn, error) {
 	p.mu.Lock()
 
 	if p.closed {
@@ -62,21 +164,34 @@ func (p *connectionPool) get(ctx context.Context) (*pooledConn, error) {
 		return nil, ErrConnectionClosed
 	}
 
-	// Check for idle connections
-	for i, conn := range p.connections {
-		if !conn.inUse {
-			// Check if connection is still valid and not expired
-			if time.Since(conn.lastUsed) < p.config.IdleTimeout {
-				conn.inUse = true
-				conn.lastUsed = time.Now()
-				p.mu.Unlock()
-				return conn, nil
-			}
+	// Reuse an idle connection, probing it first if it has sat long
+	// enough that the server may have dropped it
+	for {
+		conn, idleFor := p.takeIdle()
+		if conn == nil {
+			break
+		}
+		interval := p.config.HealthCheckInterval
+		if interval <= 0 || idleFor <= interval {
+			p.mu.Unlock()
+			return conn, nil
+		}
 
-			// Connection expired, close and remove it
-			p.connections = append(p.connections[:i], p.connections[i+1:]...)
-			p.numOpen--
-			go conn.close()
+		p.mu.Unlock()
+		if p.healthy(ctx, conn) {
+			return conn, nil
+		}
+		if err := ctx.Err(); err != nil {
+			// The probe was cut short, which says nothing about the connection
+			p.put(conn)
+			return nil, err
+		}
+		p.mu.Lock()
+		p.discard(conn)
+		p.healthCheckFailures++
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrConnectionClosed
 		}
 	}
 
@@ -123,12 +238,71 @@ func (p *connectionPool) get(ctx context.Context) (*pooledConn, error) {
 	}
 }
 
+// takeIdle marks an idle connection in use and returns it with how long it
+// was idle, or returns nil if there is none. Idle connections past
+// IdleTimeout or made before the pool was expired are closed along the
+// way. p.mu must be held.
+func (p *connectionPool) takeIdle() (*pooledConn, time.Duration) {
+	for i := 0; i < len(p.connections); i++ {
+		conn := p.connections[i]
+		if conn.inUse {
+			continue
+		}
+		idleFor := time.Since(conn.lastUsed)
+		if idleFor >= p.config.IdleTimeout || conn.generation != p.generation {
+			p.connections = append(p.connections[:i], p.connections[i+1:]...)
+			p.numOpen--
+			go conn.close()
+			p.replenish()
+			i--
+			continue
+		}
+		conn.inUse = true
+		conn.lastUsed = time.Now()
+		p.replenish()
+		return conn, idleFor
+	}
+	return nil, 0
+}
+
+// healthy probes a connection with a stat of the share root, which fails
+// if the server has dropped the session or the transport is gone.
+func (p *connectionPool) healthy(ctx context.Context, conn *pooledConn) bool {
+	conn.beginOp()
+	_, err := shareWithContext(conn.share, ctx).Stat("")
+	conn.endOp()
+	if err != nil && p.config.Logger != nil {
+		p.config.Logger.Printf("Discarding dead pooled connection: %v", err)
+	}
+	return err == nil
+}
+
+// discard removes a connection from the pool and closes it. p.mu must be
+// held.
+func (p *connectionPool) discard(conn *pooledConn) {
+	for i, c := range p.connections {
+		if c == conn {
+			p.connections = append(p.connections[:i], p.connections[i+1:]...)
+			p.numOpen--
+			break
+		}
+	}
+	go conn.close()
+	p.replenish()
+}
+
 // put returns a connection to the pool.
 func (p *connectionPool) put(conn *pooledConn) {
 	if conn == nil {
 		return
 	}
+	conn.endOp()
+	p.release(conn)
+}
 
+// release makes a connection that is not in an operation idle, handing
+// it to a waiter if there is one.
+func (p *connectionPool) release(conn *pooledConn) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -136,6 +310,10 @@ func (p *connectionPool) put(conn *pooledConn) {
 		go conn.close()
 		return
 	}
+	if conn.generation != p.generation || conn.broken() {
+		p.discard(conn)
+		return
+	}
 
 	conn.inUse = false
 	conn.lastUsed = time.Now()
@@ -150,14 +328,7 @@ func (p *connectionPool) put(conn *pooledConn) {
 	}
 
 	// Keep connection in the pool if under MaxIdle
-	idleCount := 0
-	for _, c := range p.connections {
-		if !c.inUse {
-			idleCount++
-		}
-	}
-
-	if idleCount >= p.config.MaxIdle {
+	if p.idleCount() >= p.config.MaxIdle {
 		// Too many idle connections, close this one
 		p.numOpen--
 		for i, c := range p.connections {
@@ -170,24 +341,135 @@ func (p *connectionPool) put(conn *pooledConn) {
 	}
 }
 
+// idleCount returns the number of idle connections, counting one just
+// released. p.mu must be held.
+func (p *connectionPool) idleCount() int {
+	n := 0
+	for _, c := range p.connections {
+		if !c.inUse {
+			n++
+		}
+	}
+	return n
+}
+
+// startWarmup starts a background goroutine that keeps MinIdle idle
+// connections open, and has it open the first of them. It must be called
+// before the pool is used.
+func (p *connectionPool) startWarmup(ctx context.Context) {
+	if p.config.MinIdle <= 0 {
+		return
+	}
+	p.refill = make(chan struct{}, 1)
+	p.replenish()
+	go func() {
+		for {
+			select {
+			case <-p.refill:
+				p.fill(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// replenish wakes the warmup goroutine, if there is one, to replace idle
+// connections that were taken or closed. It does not block, so p.mu may
+// be held.
+func (p *connectionPool) replenish() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// fill opens connections until MinIdle are idle or MaxOpen are open. A
+// failure is kept for WarmupError and ends the round, leaving the next
+// replenish to try again.
+func (p *connectionPool) fill(ctx context.Context) {
+	for {
+		p.mu.Lock()
+		if p.closed || p.idleCount() >= p.config.MinIdle || p.numOpen >= p.config.MaxOpen {
+			p.mu.Unlock()
+			return
+		}
+		p.numOpen++
+		p.mu.Unlock()
+
+		conn, err := p.createConnection(ctx)
+
+		p.mu.Lock()
+		p.warmupErr = err
+		if err != nil {
+			p.numOpen--
+			p.mu.Unlock()
+			if p.config.Logger != nil {
+				p.config.Logger.Printf("Opening idle connection: %v", err)
+			}
+			return
+		}
+		p.mu.Unlock()
+		p.release(conn)
+	}
+}
+
+// warmupError returns the error of the last attempt to open an idle
+// connection for MinIdle.
+func (p *connectionPool) warmupError() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.warmupErr
+}
+
+// expire stops the pool reusing its current connections, after a request
+// on one of them found that the server no longer knows its session. Idle
+// connections are closed now and busy ones when they are returned, so the
+// next get authenticates and connects to the share afresh.
+func (p *connectionPool) expire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.generation++
+	for i := 0; i < len(p.connections); i++ {
+		if conn := p.connections[i]; !conn.inUse {
+			p.discard(conn)
+			i--
+		}
+	}
+}
+
 // createConnection creates a new SMB connection.
 func (p *connectionPool) createConnection(ctx context.Context) (*pooledConn, error) {
+	// Mount the share on a session of the parent pool while it is open
+	if p.parent != nil {
+		conn, err := p.createMountedConnection(ctx)
+		if !errors.Is(err, ErrConnectionClosed) {
+			return conn, err
+		}
+	}
+
 	// Use factory if available (for testing)
 	if p.factory != nil {
-		session, share, err := p.factory.CreateConnection(p.config)
+		config, err := p.config.withCredentials(ctx)
+		if err != nil {
+			return nil, err
+		}
+		session, share, err := p.factory.CreateConnection(config)
 		if err != nil {
 			return nil, err
 		}
 
 		conn := &pooledConn{
-			session:   session,
-			share:     share,
+			session:   newSharedSession(session),
 			createdAt: time.Now(),
 			lastUsed:  time.Now(),
 			inUse:     true,
 		}
+		conn.share = p.wrapShare(conn.session, share)
 
 		p.mu.Lock()
+		conn.generation = p.generation
 		p.connections = append(p.connections, conn)
 		p.mu.Unlock()
 
@@ -198,20 +480,120 @@ func (p *connectionPool) createConnection(ctx context.Context) (*pooledConn, err
 	return p.createRealConnection(ctx)
 }
 
+// createMountedConnection connects to the pool's share over a session of
+// the parent pool, which authenticates only if it has no session yet.
+func (p *connectionPool) createMountedConnection(ctx context.Context) (*pooledConn, error) {
+	conn, err := p.parent.shareSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	share, err := conn.session.Mount(p.config.Share)
+	if err != nil {
+		_ = conn.session.Logoff()
+		if p.config.Logger != nil {
+			p.config.Logger.Printf("Failed to mount share %s: %v", p.config.Share, err)
+		}
+		return nil, fmt.Errorf("failed to mount share %s: %w", p.config.Share, err)
+	}
+	conn.share = p.wrapShare(conn.session, share)
+
+	p.mu.Lock()
+	conn.generation = p.generation
+	p.connections = append(p.connections, conn)
+	p.mu.Unlock()
+
+	return conn, nil
+}
+
+// shareSession returns a new connection, with no share mounted, that
+// holds a reference to a session of the pool. A session of any current
+// connection is used, busy or not, since go-smb2 sessions serve requests
+// concurrently; without one, a connection is made to authenticate.
+func (p *connectionPool) shareSession(ctx context.Context) (*pooledConn, error) {
+	share := func(from *pooledConn) *pooledConn {
+		from.mu.Lock()
+		session := from.session
+		from.mu.Unlock()
+		if session == nil || !session.retain() {
+			return nil
+		}
+		return &pooledConn{
+			session:   session,
+			createdAt: time.Now(),
+			lastUsed:  time.Now(),
+			inUse:     true,
+			transport: from.transport,
+			info:      from.info,
+		}
+	}
+
+	p.mu.Lock()
+	for _, c := range p.connections {
+		if c.generation != p.generation {
+			continue
+		}
+		if conn := share(c); conn != nil {
+			p.mu.Unlock()
+			return conn, nil
+		}
+	}
+	p.mu.Unlock()
+
+	from, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer p.put(from)
+	if conn := share(from); conn != nil {
+		return conn, nil
+	}
+	return nil, ErrConnectionClosed
+}
+
+// newInitiator returns the authentication mechanism for session setup.
+// With UseKerberos it gets a service ticket for the server first; a
+// failure is returned rather than falling back to NTLM.
+func newInitiator(config *Config) (smb2.Initiator, error) {
+	if config.UseKerberos {
+		mech, err := newKerberosMechanism(config)
+		if err != nil {
+			return nil, err
+		}
+		return &smb2.MechanismInitiator{Mechanism: mech}, nil
+	}
+	user := config.Username
+	if user == "" && config.GuestAccess {
+		// go-smb2 refuses anonymous logons; an empty password as Guest
+		// gets a guest session, which the server tells us not to sign
+		user = "Guest"
+	}
+	return &smb2.NTLMInitiator{
+		User:     user,
+		Password: config.Password,
+		Domain:   config.Domain,
+	}, nil
+}
+
 // createRealConnection creates a real SMB connection using go-smb2.
 func (p *connectionPool) createRealConnection(ctx context.Context) (*pooledConn, error) {
-	addr := fmt.Sprintf("%s:%d", p.config.Server, p.config.Port)
+	addr := p.config.address()
 
 	if p.config.Logger != nil {
 		p.config.Logger.Printf("Creating new SMB connection to %s", addr)
 	}
 
-	// Create TCP connection with timeout
-	dialer := &net.Dialer{
-		Timeout: p.config.ConnTimeout,
+	config, err := p.config.withCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	initiator, err := newInitiator(config)
+	if err != nil {
+		return nil, err
 	}
 
-	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+	// Create TCP connection with timeout
+	netConn, err := p.config.dial(ctx)
 	if err != nil {
 		if p.config.Logger != nil {
 			p.config.Logger.Printf("Failed to connect to %s: %v", addr, err)
@@ -219,16 +601,21 @@ func (p *connectionPool) createRealConnection(ctx context.Context) (*pooledConn,
 		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
 	}
 
+	// Session setup and tree connect must finish within ConnTimeout too
+	if p.config.ConnTimeout > 0 {
+		netConn.SetDeadline(time.Now().Add(p.config.ConnTimeout))
+	}
+
 	// Create SMB session
 	d := &smb2.Dialer{
-		Initiator: &smb2.NTLMInitiator{
-			User:     p.config.Username,
-			Password: p.config.Password,
-			Domain:   p.config.Domain,
+		Negotiator: smb2.Negotiator{
+			RequireMessageSigning: p.config.signingRequired(),
 		},
+		Initiator: initiator,
 	}
 
-	session, err := d.Dial(netConn)
+	recorder := &setupRecorder{Conn: netConn}
+	session, err := d.Dial(recorder)
 	if err != nil {
 		netConn.Close()
 		if p.config.Logger != nil {
@@ -248,15 +635,20 @@ func (p *connectionPool) createRealConnection(ctx context.Context) (*pooledConn,
 		return nil, fmt.Errorf("failed to mount share %s: %w", p.config.Share, err)
 	}
 
+	netConn.SetDeadline(time.Time{})
+
 	conn := &pooledConn{
-		session:   &realSMBSession{session: session},
-		share:     &realSMBShare{share: share},
+		session:   newSharedSession(&realSMBSession{session: session}),
 		createdAt: time.Now(),
 		lastUsed:  time.Now(),
 		inUse:     true,
+		transport: &netTransport{conn: netConn, opTimeout: p.config.OpTimeout},
+		info:      recorder.info(),
 	}
+	conn.share = p.wrapShare(conn.session, &realSMBShare{share: share})
 
 	p.mu.Lock()
+	conn.generation = p.generation
 	p.connections = append(p.connections, conn)
 	p.mu.Unlock()
 
@@ -267,6 +659,57 @@ func (p *connectionPool) createRealConnection(ctx context.Context) (*pooledConn,
 	return conn, nil
 }
 
+// beginOp arms the connection's deadline for an operation, so that a
+// server that stops answering fails it instead of leaving it waiting.
+// Overlapping operations share a deadline, which each new one pushes back.
+func (pc *pooledConn) beginOp() {
+	if pc == nil || pc.transport == nil || pc.transport.opTimeout <= 0 {
+		return
+	}
+	t := pc.transport
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.ops++
+	t.deadline = time.Now().Add(t.opTimeout)
+	t.conn.SetDeadline(t.deadline)
+}
+
+// endOp ends an operation begun with beginOp. The deadline is cleared when
+// the last one ends: go-smb2 is always reading the next response, and a
+// deadline left behind would kill the connection while it sat idle.
+func (pc *pooledConn) endOp() {
+	if pc == nil || pc.transport == nil || pc.transport.opTimeout <= 0 {
+		return
+	}
+	t := pc.transport
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.ops == 0 {
+		return
+	}
+	if !time.Now().Before(t.deadline) {
+		// The read waiting for the response failed, taking the
+		// connection with it
+		t.timedOut = true
+	}
+	t.ops--
+	if t.ops == 0 {
+		t.conn.SetDeadline(time.Time{})
+	}
+}
+
+// broken reports whether an operation on the connection timed out.
+func (pc *pooledConn) broken() bool {
+	if pc.transport == nil {
+		return false
+	}
+	pc.transport.mu.Lock()
+	defer pc.transport.mu.Unlock()
+	return pc.transport.timedOut
+}
+
 // close closes a pooled connection.
 func (pc *pooledConn) close() {
 	pc.mu.Lock()
@@ -308,6 +751,9 @@ func (p *connectionPool) Close() error {
 	for _, conn := range p.connections {
 		go conn.close()
 	}
+	if p.dfs != nil {
+		p.dfs.close()
+	}
 
 	p.connections = nil
 	p.numOpen = 0
@@ -331,6 +777,7 @@ func (p *connectionPool) cleanup() {
 			// Connection expired
 			p.numOpen--
 			go conn.close()
+			p.replenish()
 			continue
 		}
 		p.connections[i] = conn
@@ -362,6 +809,10 @@ type PoolStats struct {
 	IdleConnections  int
 	WaitersCount     int
 	IsClosed         bool
+
+	// HealthCheckFailures counts idle connections that failed their
+	// liveness probe and were replaced
+	HealthCheckFailures int64
 }
 
 // Stats returns current pool statistics.
@@ -385,5 +836,7 @@ func (p *connectionPool) Stats() PoolStats {
 		IdleConnections:   idle,
 		WaitersCount:      len(p.waiters),
 		IsClosed:          p.closed,
+
+		HealthCheckFailures: p.healthCheckFailures,
 	}
 }
@@ -0,0 +1,151 @@
+package smbfs
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+)
+
+// AuthMethod is the way a session authenticated to the server.
+type AuthMethod string
+
+const (
+	// AuthNTLM is a session authenticated with a username and password.
+	AuthNTLM AuthMethod = "NTLM"
+
+	// AuthGuest is a guest session, which the server grants without
+	// checking credentials.
+	AuthGuest AuthMethod = "Guest"
+
+	// AuthAnonymous is a null session, with no user at all.
+	AuthAnonymous AuthMethod = "Anonymous"
+)
+
+// ConnectionInfo describes how a connection to the server was set up: the
+// protocol settled in its NEGOTIATE exchange and the security of its
+// session and share.
+type ConnectionInfo struct {
+	Dialect    SMBDialect // Dialect the server chose
+	Signed     bool       // Messages are signed
+	Encrypted  bool       // Messages are encrypted, which also protects them in place of signing
+	ServerGUID [16]byte   // GUID the server identifies itself with
+	AuthMethod AuthMethod // How the session authenticated
+}
+
+// ConnectionInfo reports how the connection the filesystem is using was
+// set up, connecting first if it has no connection. Auditors can check it
+// for the dialect and protections they require.
+//
+// The zero ConnectionInfo is returned if no connection can be made, or if
+// connections come from a ConnectionFactory, whose setup is not seen.
+func (fsys *FileSystem) ConnectionInfo() ConnectionInfo {
+	conn, err := fsys.pool.get(fsys.ctx)
+	if err != nil {
+		return ConnectionInfo{}
+	}
+	defer fsys.pool.put(conn)
+	return conn.info
+}
+
+// setupRecorder watches the responses to a new connection's NEGOTIATE,
+// SESSION_SETUP and TREE_CONNECT requests as go-smb2 reads them, to learn
+// what was settled, which go-smb2 keeps to itself. It passes everything
+// through unchanged and stops looking once the share is connected.
+type setupRecorder struct {
+	net.Conn
+
+	mu           sync.Mutex
+	buf          []byte // Unparsed bytes of the response stream
+	done         bool
+	dialect      SMBDialect
+	serverGUID   [16]byte
+	sessionFlags uint16
+	shareFlags   uint32
+	encrypted    bool // A response was encrypted
+}
+
+func (r *setupRecorder) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	if n > 0 {
+		r.mu.Lock()
+		if !r.done {
+			r.buf = append(r.buf, p[:n]...)
+			r.parse()
+		}
+		r.mu.Unlock()
+	}
+	return n, err
+}
+
+// parse consumes the complete messages in buf.
+func (r *setupRecorder) parse() {
+	for !r.done && len(r.buf) >= 4 {
+		size := int(binary.BigEndian.Uint32(r.buf) & 0xFFFFFF)
+		if len(r.buf) < 4+size {
+			return
+		}
+		r.record(r.buf[4 : 4+size])
+		r.buf = r.buf[4+size:]
+	}
+	if r.done {
+		r.buf = nil
+	}
+}
+
+// record notes what one response settles.
+func (r *setupRecorder) record(msg []byte) {
+	if IsTransformMessage(msg) {
+		// Once traffic is encrypted nothing more can be read from it
+		r.encrypted = true
+		r.done = true
+		return
+	}
+	header, err := UnmarshalSMB2Header(msg)
+	if err != nil || header.Status != STATUS_SUCCESS {
+		return
+	}
+	payload := msg[SMB2HeaderSize:]
+
+	switch header.Command {
+	case SMB2_NEGOTIATE:
+		if len(payload) >= 24 {
+			r.dialect = SMBDialect(le.Uint16(payload[4:6]))
+			copy(r.serverGUID[:], payload[8:24])
+		}
+	case SMB2_SESSION_SETUP:
+		if len(payload) >= 4 {
+			r.sessionFlags = le.Uint16(payload[2:4])
+		}
+	case SMB2_TREE_CONNECT:
+		if len(payload) >= 8 {
+			r.shareFlags = le.Uint32(payload[4:8])
+		}
+		r.done = true
+	}
+}
+
+// info returns what the recorder saw. go-smb2 signs every message of an
+// authenticated session that it does not encrypt, and encrypts when the
+// session or the share asks for it.
+func (r *setupRecorder) info() ConnectionInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	info := ConnectionInfo{
+		Dialect:    r.dialect,
+		ServerGUID: r.serverGUID,
+		AuthMethod: AuthNTLM,
+		Encrypted: r.encrypted ||
+			r.sessionFlags&SMB2_SESSION_FLAG_ENCRYPT != 0 ||
+			r.shareFlags&SMB2_SHAREFLAG_ENCRYPT_DATA != 0,
+	}
+	switch {
+	case r.sessionFlags&SMB2_SESSION_FLAG_IS_NULL != 0:
+		info.AuthMethod = AuthAnonymous
+	case r.sessionFlags&SMB2_SESSION_FLAG_IS_GUEST != 0:
+		info.AuthMethod = AuthGuest
+	default:
+		info.Signed = !info.Encrypted
+	}
+	return info
+}
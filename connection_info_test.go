@@ -0,0 +1,94 @@
+package smbfs
+
+import (
+	"testing"
+)
+
+// TestConnectionInfo tests that ConnectionInfo reports the dialect the
+// server negotiated and whether the session is signed or encrypted
+func TestConnectionInfo(t *testing.T) {
+	tests := []struct {
+		name string
+		opts ServerOptions
+		want ConnectionInfo
+	}{
+		{
+			name: "SMB 2.1 signed",
+			opts: ServerOptions{MaxDialect: SMB2_1},
+			want: ConnectionInfo{Dialect: SMB2_1, Signed: true, AuthMethod: AuthNTLM},
+		},
+		{
+			name: "SMB 3.1.1 signed",
+			opts: ServerOptions{MaxDialect: SMB3_1_1, SigningRequired: true},
+			want: ConnectionInfo{Dialect: SMB3_1_1, Signed: true, AuthMethod: AuthNTLM},
+		},
+		{
+			name: "SMB 3.0.2 encrypted",
+			opts: ServerOptions{MaxDialect: SMB3_0_2, EncryptData: true},
+			want: ConnectionInfo{Dialect: SMB3_0_2, Encrypted: true, AuthMethod: AuthNTLM},
+		},
+		{
+			name: "SMB 3.1.1 encrypted",
+			opts: ServerOptions{MaxDialect: SMB3_1_1, EncryptData: true},
+			want: ConnectionInfo{Dialect: SMB3_1_1, Encrypted: true, AuthMethod: AuthNTLM},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, config := startLoopbackServer(t, tt.opts)
+			fsys, err := New(config)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			defer fsys.Close()
+
+			tt.want.ServerGUID = srv.options.ServerGUID
+			if got := fsys.ConnectionInfo(); got != tt.want {
+				t.Errorf("ConnectionInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestConnectionInfo_Factory tests that connections from a factory, whose
+// setup is not seen, report the zero ConnectionInfo
+func TestConnectionInfo_Factory(t *testing.T) {
+	fsys, err := NewWithFactory(&Config{
+		Server:   "test-server",
+		Share:    "test-share",
+		Username: "testuser",
+		Password: "testpass",
+	}, NewMockConnectionFactory(NewMockSMBBackend()))
+	if err != nil {
+		t.Fatalf("NewWithFactory() error = %v", err)
+	}
+	defer fsys.Close()
+
+	if got := fsys.ConnectionInfo(); got != (ConnectionInfo{}) {
+		t.Errorf("ConnectionInfo() = %+v, want the zero value", got)
+	}
+}
+
+// TestConnectionInfo_Guest tests that a guest session is reported as such,
+// and as unsigned since guest sessions have no key to sign with
+func TestConnectionInfo_Guest(t *testing.T) {
+	srv, config := startLoopbackServer(t, ServerOptions{AllowGuest: true})
+	share := srv.GetShare("data")
+	if err := srv.ReplaceShare("data", share.FileSystem(), ShareOptions{AllowGuest: true}); err != nil {
+		t.Fatalf("ReplaceShare() error = %v", err)
+	}
+
+	cfg := *config
+	cfg.Username, cfg.Password, cfg.GuestAccess = "", "", true
+	fsys, err := New(&cfg)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	want := ConnectionInfo{Dialect: SMB3_1_1, AuthMethod: AuthGuest, ServerGUID: srv.options.ServerGUID}
+	if got := fsys.ConnectionInfo(); got != want {
+		t.Errorf("ConnectionInfo() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,104 @@
+package smbfs
+
+import (
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// maxBirthtimes bounds the creation times a share remembers for a
+// filesystem without Birthtimer; it starts over when full, and paths seen
+// again are given their modification time afresh
+const maxBirthtimes = 65536
+
+// Birthtimer is implemented by filesystems that record file creation times
+// Shares backed by such a filesystem report the real creation time to clients
+type Birthtimer interface {
+	Birthtime(name string) (time.Time, error)
+}
+
+// CreationTime returns the creation time reported for name
+// If the filesystem implements Birthtimer its value is used. Otherwise the
+// share remembers the file's modification time from the first time it saw
+// the path, so the value stays stable across queries and never postdates
+// the last write
+func (s *Share) CreationTime(name string, info fs.FileInfo) time.Time {
+	if bt, ok := s.FileSystem().(Birthtimer); ok {
+		if t, err := bt.Birthtime(name); err == nil && !t.IsZero() {
+			return t
+		}
+	}
+
+	key := path.Clean("/" + name)
+
+	s.birthMu.Lock()
+	defer s.birthMu.Unlock()
+
+	if t, ok := s.birthtimes[key]; ok {
+		return t
+	}
+	t := info.ModTime()
+	s.rememberCreation(key, t)
+	return t
+}
+
+// recordCreation sets the creation time of a newly created path
+func (s *Share) recordCreation(name string, t time.Time) {
+	s.birthMu.Lock()
+	defer s.birthMu.Unlock()
+
+	s.rememberCreation(path.Clean("/"+name), t)
+}
+
+// rememberCreation records the creation time of the cleaned path key,
+// starting over if the share remembers maxBirthtimes already. The caller
+// holds birthMu
+func (s *Share) rememberCreation(key string, t time.Time) {
+	if _, ok := s.birthtimes[key]; !ok && len(s.birthtimes) >= maxBirthtimes {
+		s.birthtimes = nil
+	}
+	if s.birthtimes == nil {
+		s.birthtimes = make(map[string]time.Time)
+	}
+	s.birthtimes[key] = t
+}
+
+// forgetCreation drops remembered creation times for a deleted path and
+// anything beneath it
+func (s *Share) forgetCreation(name string) {
+	key := path.Clean("/" + name)
+
+	s.birthMu.Lock()
+	defer s.birthMu.Unlock()
+
+	for p := range s.birthtimes {
+		if p == key || strings.HasPrefix(p, key+"/") {
+			delete(s.birthtimes, p)
+		}
+	}
+}
+
+// renameCreation moves remembered creation times along with a rename
+func (s *Share) renameCreation(oldName, newName string) {
+	oldKey := path.Clean("/" + oldName)
+	newKey := path.Clean("/" + newName)
+
+	s.birthMu.Lock()
+	defer s.birthMu.Unlock()
+
+	moved := make(map[string]time.Time)
+	for p, t := range s.birthtimes {
+		if p == newKey || strings.HasPrefix(p, newKey+"/") {
+			// Replaced target
+			delete(s.birthtimes, p)
+		}
+		if p == oldKey || strings.HasPrefix(p, oldKey+"/") {
+			moved[newKey+strings.TrimPrefix(p, oldKey)] = t
+			delete(s.birthtimes, p)
+		}
+	}
+	for p, t := range moved {
+		s.birthtimes[p] = t
+	}
+}
@@ -0,0 +1,76 @@
+package smbfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// CredentialProvider supplies the credentials used to authenticate to the
+// server. It is asked each time a session is established, so credentials
+// held in a secret manager or keychain, or short-lived tokens, can rotate
+// without recreating the filesystem.
+type CredentialProvider interface {
+	Credentials(ctx context.Context) (username, password, domain string, err error)
+}
+
+// StaticCredentials is a CredentialProvider that always returns the same
+// credentials.
+type StaticCredentials struct {
+	Username string
+	Password string
+	Domain   string
+}
+
+// Credentials returns the fixed credentials.
+func (c StaticCredentials) Credentials(ctx context.Context) (string, string, string, error) {
+	return c.Username, c.Password, c.Domain, nil
+}
+
+// EnvCredentials is a CredentialProvider that reads credentials from
+// environment variables each time they are needed. Empty variable names
+// default to SMB_USERNAME, SMB_PASSWORD and SMB_DOMAIN.
+type EnvCredentials struct {
+	UsernameVar string
+	PasswordVar string
+	DomainVar   string
+}
+
+// Credentials reads the credentials from the environment. The username
+// variable must be set; the others may be empty.
+func (c EnvCredentials) Credentials(ctx context.Context) (string, string, string, error) {
+	usernameVar := envVarOr(c.UsernameVar, "SMB_USERNAME")
+	username := os.Getenv(usernameVar)
+	if username == "" {
+		return "", "", "", fmt.Errorf("environment variable %s is not set", usernameVar)
+	}
+	password := os.Getenv(envVarOr(c.PasswordVar, "SMB_PASSWORD"))
+	domain := os.Getenv(envVarOr(c.DomainVar, "SMB_DOMAIN"))
+	return username, password, domain, nil
+}
+
+// envVarOr returns name, or def if name is empty.
+func envVarOr(name, def string) string {
+	if name == "" {
+		return def
+	}
+	return name
+}
+
+// withCredentials returns the configuration to authenticate with. When a
+// CredentialProvider is set it is asked for the current credentials, which
+// are returned in a copy of c; otherwise c is returned as is.
+func (c *Config) withCredentials(ctx context.Context) (*Config, error) {
+	if c.Credentials == nil || c.GuestAccess {
+		return c, nil
+	}
+	username, password, domain, err := c.Credentials.Credentials(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get credentials: %w", err)
+	}
+	config := *c
+	config.Username = username
+	config.Password = password
+	config.Domain = domain
+	return &config, nil
+}
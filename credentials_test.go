@@ -0,0 +1,167 @@
+package smbfs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rotatingCredentials returns whatever password it currently holds
+type rotatingCredentials struct {
+	mu       sync.Mutex
+	password string
+}
+
+func (c *rotatingCredentials) Credentials(ctx context.Context) (string, string, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return "svc", c.password, "CORP", nil
+}
+
+func (c *rotatingCredentials) rotate(password string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.password = password
+}
+
+// recordingFactory records the credentials of each connection it makes
+type recordingFactory struct {
+	*MockConnectionFactory
+	mu        sync.Mutex
+	passwords []string
+}
+
+func (f *recordingFactory) CreateConnection(config *Config) (SMBSession, SMBShare, error) {
+	f.mu.Lock()
+	f.passwords = append(f.passwords, config.Domain+`\`+config.Username+":"+config.Password)
+	f.mu.Unlock()
+	return f.MockConnectionFactory.CreateConnection(config)
+}
+
+func TestCredentialProvider_RotatedOnReconnect(t *testing.T) {
+	creds := &rotatingCredentials{password: "first"}
+	factory := &recordingFactory{MockConnectionFactory: NewMockConnectionFactory(NewMockSMBBackend())}
+	config := testConfig()
+	config.Port = 445
+	config.Username = ""
+	config.Password = ""
+	config.Credentials = creds
+	config.HealthCheckInterval = time.Nanosecond
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() with a credential provider error = %v", err)
+	}
+	pool := newConnectionPoolWithFactory(config, factory)
+	defer pool.Close()
+
+	ctx := context.Background()
+	conn, err := pool.get(ctx)
+	if err != nil {
+		t.Fatalf("pool.get() error = %v", err)
+	}
+	pool.put(conn)
+
+	// The secret rotates and the server drops the old session
+	creds.rotate("second")
+	conn.share.Umount()
+	time.Sleep(time.Millisecond)
+
+	conn, err = pool.get(ctx)
+	if err != nil {
+		t.Fatalf("pool.get() after reconnect error = %v", err)
+	}
+	pool.put(conn)
+
+	want := []string{`CORP\svc:first`, `CORP\svc:second`}
+	if len(factory.passwords) != len(want) {
+		t.Fatalf("connections made with %v, want %v", factory.passwords, want)
+	}
+	for i := range want {
+		if factory.passwords[i] != want[i] {
+			t.Errorf("connection %d made with %q, want %q", i, factory.passwords[i], want[i])
+		}
+	}
+	if config.Password != "" {
+		t.Errorf("Config.Password = %q, want it left unset", config.Password)
+	}
+}
+
+func TestCredentialProvider_Error(t *testing.T) {
+	factory := NewMockConnectionFactory(NewMockSMBBackend())
+	config := testConfig()
+	config.Credentials = EnvCredentials{UsernameVar: "SMBFS_TEST_UNSET_USER"}
+	pool := newConnectionPoolWithFactory(config, factory)
+	defer pool.Close()
+
+	if _, err := pool.get(context.Background()); err == nil {
+		t.Fatal("pool.get() with failing credentials succeeded")
+	}
+	if factory.ConnectAttempts() != 0 {
+		t.Errorf("ConnectAttempts = %d, want 0", factory.ConnectAttempts())
+	}
+	if n := pool.Stats().TotalConnections; n != 0 {
+		t.Errorf("TotalConnections = %d, want 0", n)
+	}
+}
+
+func TestStaticCredentials(t *testing.T) {
+	user, pass, domain, err := StaticCredentials{Username: "u", Password: "p", Domain: "d"}.Credentials(context.Background())
+	if err != nil || user != "u" || pass != "p" || domain != "d" {
+		t.Errorf("Credentials() = %q, %q, %q, %v, want u, p, d", user, pass, domain, err)
+	}
+}
+
+func TestEnvCredentials(t *testing.T) {
+	t.Setenv("SMB_USERNAME", "jdoe")
+	t.Setenv("SMB_PASSWORD", "secret")
+	t.Setenv("SMB_DOMAIN", "CORP")
+	t.Setenv("APP_SMB_PASS", "other")
+
+	user, pass, domain, err := EnvCredentials{}.Credentials(context.Background())
+	if err != nil || user != "jdoe" || pass != "secret" || domain != "CORP" {
+		t.Errorf("Credentials() = %q, %q, %q, %v, want jdoe, secret, CORP", user, pass, domain, err)
+	}
+
+	_, pass, _, err = EnvCredentials{PasswordVar: "APP_SMB_PASS"}.Credentials(context.Background())
+	if err != nil || pass != "other" {
+		t.Errorf("Credentials() with PasswordVar password = %q, %v, want other", pass, err)
+	}
+
+	t.Setenv("SMB_USERNAME", "")
+	if _, _, _, err := (EnvCredentials{}).Credentials(context.Background()); err == nil {
+		t.Error("Credentials() with SMB_USERNAME unset succeeded")
+	}
+}
+
+func TestConfig_WithCredentials(t *testing.T) {
+	config := testConfig()
+	if got, err := config.withCredentials(context.Background()); err != nil || got != config {
+		t.Errorf("withCredentials() without a provider = %p, %v, want the config itself", got, err)
+	}
+
+	config.Credentials = StaticCredentials{Username: "other", Password: "pw"}
+	got, err := config.withCredentials(context.Background())
+	if err != nil {
+		t.Fatalf("withCredentials() error = %v", err)
+	}
+	if got.Username != "other" || got.Password != "pw" || got.Domain != "" {
+		t.Errorf("withCredentials() = %q/%q/%q, want other/pw/\"\"", got.Username, got.Password, got.Domain)
+	}
+	if config.Username != "testuser" {
+		t.Errorf("withCredentials() modified the config")
+	}
+
+	boom := errors.New("vault sealed")
+	config.Credentials = failingCredentials{boom}
+	if _, err := config.withCredentials(context.Background()); !errors.Is(err, boom) {
+		t.Errorf("withCredentials() error = %v, want %v", err, boom)
+	}
+}
+
+// failingCredentials always fails
+type failingCredentials struct{ err error }
+
+func (c failingCredentials) Credentials(ctx context.Context) (string, string, string, error) {
+	return "", "", "", c.err
+}
@@ -0,0 +1,484 @@
+package smbfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/absfs/smbfs/internal/smb2"
+)
+
+// errDFSCrossTarget is returned when a rename would move a file between
+// the shares that serve different parts of a DFS namespace.
+var errDFSCrossTarget = errors.New("rename across DFS targets")
+
+// dfsMaxReferralSize is the largest referral response accepted.
+const dfsMaxReferralSize = 64 * 1024
+
+// dfsReferral maps a DFS link in the configured share to the share that
+// serves it.
+type dfsReferral struct {
+	link    string // Link path within the configured share, backslash-separated
+	server  string // Target server
+	share   string // Target share
+	path    string // Path of the link within the target share
+	expires time.Time
+}
+
+// dfsTarget is a connection to a referral's target share.
+type dfsTarget struct {
+	session SMBSession
+	share   SMBShare
+}
+
+// dfsResolver resolves and caches DFS referrals for a connection pool and
+// holds the connections to their targets, which all pooled connections
+// share.
+type dfsResolver struct {
+	config  *Config
+	factory ConnectionFactory
+
+	// fetch requests the referral for a DFS path from the server, over
+	// session.
+	fetch func(ctx context.Context, session SMBSession, path string) (*dfsReferralResponse, error)
+
+	mu        sync.Mutex
+	referrals map[string]dfsReferral // By lowercased link
+	targets   map[string]*dfsTarget  // By lowercased server\share
+	closed    bool
+}
+
+// newDFSResolver creates a resolver that connects to targets with factory,
+// or with real SMB connections when factory is nil.
+func newDFSResolver(config *Config, factory ConnectionFactory) *dfsResolver {
+	if factory == nil {
+		factory = &RealConnectionFactory{}
+	}
+	r := &dfsResolver{
+		config:    config,
+		factory:   factory,
+		referrals: make(map[string]dfsReferral),
+		targets:   make(map[string]*dfsTarget),
+	}
+	r.fetch = r.requestReferral
+	return r
+}
+
+// requestReferral requests a referral with FSCTL_DFS_GET_REFERRALS over the
+// server's IPC$ share, mounted on session.
+func (r *dfsResolver) requestReferral(ctx context.Context, session SMBSession, path string) (*dfsReferralResponse, error) {
+	ipc, err := session.Mount("IPC$")
+	if err != nil {
+		return nil, err
+	}
+	defer ipc.Umount()
+
+	fsctl, ok := shareWithContext(ipc, ctx).(interface {
+		Ioctl(ctlCode uint32, input []byte, maxOutput uint32) ([]byte, error)
+	})
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	data, err := fsctl.Ioctl(FSCTL_DFS_GET_REFERRALS, buildDFSReferralRequest(path, 4), dfsMaxReferralSize)
+	if err != nil {
+		return nil, err
+	}
+	return parseDFSReferralResponse(data)
+}
+
+// lookup returns the cached referral covering name, a path within the
+// configured share, and the rest of name below the link.
+func (r *dfsResolver) lookup(name string) (ref dfsReferral, rest string, ok bool) {
+	lower := strings.ToLower(strings.Trim(name, "\\"))
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, candidate := range r.referrals {
+		if now.After(candidate.expires) {
+			delete(r.referrals, key)
+			continue
+		}
+		if lower != key && !strings.HasPrefix(lower, key+"\\") {
+			continue
+		}
+		if !ok || len(key) > len(ref.link) {
+			ref, ok = candidate, true
+		}
+	}
+	if ok {
+		rest = strings.Trim(strings.Trim(name, "\\")[len(ref.link):], "\\")
+	}
+	return ref, rest, ok
+}
+
+// refer requests the referral for name, a path the configured share does
+// not cover, over session and caches it.
+func (r *dfsResolver) refer(ctx context.Context, session SMBSession, name string) (dfsReferral, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if r.config.ConnTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.config.ConnTimeout)
+		defer cancel()
+	}
+
+	path := `\` + r.config.host() + `\` + r.config.Share + `\` + strings.Trim(name, "\\")
+	resp, err := r.fetch(ctx, session, path)
+	if err != nil {
+		return dfsReferral{}, fmt.Errorf("DFS referral for %s: %w", path, err)
+	}
+	if len(resp.Entries) == 0 {
+		return dfsReferral{}, fmt.Errorf("DFS referral for %s: no targets", path)
+	}
+
+	// The part of the path the referral consumed names the link
+	_, _, link, ok := splitDFSPath(utf16Prefix(path, resp.PathConsumed))
+	if !ok || link == "" {
+		return dfsReferral{}, fmt.Errorf("DFS referral for %s: %w", path, errInvalidReferral)
+	}
+	entry := resp.Entries[0]
+	server, share, targetPath, ok := splitDFSPath(entry.Target)
+	if !ok {
+		return dfsReferral{}, fmt.Errorf("DFS referral for %s: invalid target %q", path, entry.Target)
+	}
+
+	ref := dfsReferral{
+		link:    link,
+		server:  server,
+		share:   share,
+		path:    targetPath,
+		expires: time.Now().Add(time.Duration(entry.TTL) * time.Second),
+	}
+	if r.config.Logger != nil {
+		r.config.Logger.Printf("DFS referral: %s -> %s (TTL %ds)", path, entry.Target, entry.TTL)
+	}
+
+	r.mu.Lock()
+	r.referrals[strings.ToLower(link)] = ref
+	r.mu.Unlock()
+	return ref, nil
+}
+
+// target returns the share serving ref, connecting to it if needed.
+func (r *dfsResolver) target(ref dfsReferral) (SMBShare, string, error) {
+	key := strings.ToLower(ref.server + `\` + ref.share)
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil, "", ErrConnectionClosed
+	}
+	if t, ok := r.targets[key]; ok {
+		r.mu.Unlock()
+		return t.share, key, nil
+	}
+	r.mu.Unlock()
+
+	creds, err := r.config.withCredentials(context.Background())
+	if err != nil {
+		return nil, "", err
+	}
+	config := *creds
+	config.Server = ref.server
+	config.Share = ref.share
+	session, share, err := r.factory.CreateConnection(&config)
+	if err != nil {
+		return nil, "", fmt.Errorf("DFS target %s: %w", key, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t, ok := r.targets[key]; ok || r.closed {
+		// Lost a race with another connection to the target, or with Close
+		go closeDFSTarget(&dfsTarget{session: session, share: share})
+		if !ok {
+			return nil, "", ErrConnectionClosed
+		}
+		return t.share, key, nil
+	}
+	r.targets[key] = &dfsTarget{session: session, share: share}
+	return share, key, nil
+}
+
+// dropTarget forgets a target whose connection failed, so that the next
+// request reconnects.
+func (r *dfsResolver) dropTarget(key string) {
+	r.mu.Lock()
+	t, ok := r.targets[key]
+	delete(r.targets, key)
+	r.mu.Unlock()
+	if ok {
+		go closeDFSTarget(t)
+	}
+}
+
+// close closes the connections to all targets.
+func (r *dfsResolver) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	for key, t := range r.targets {
+		go closeDFSTarget(t)
+		delete(r.targets, key)
+	}
+}
+
+// closeDFSTarget unmounts a target share and logs off its session.
+func closeDFSTarget(t *dfsTarget) {
+	_ = t.share.Umount()
+	_ = t.session.Logoff()
+}
+
+// isPathNotCovered reports whether err is the server saying the path is
+// under a DFS link it does not serve.
+func isPathNotCovered(err error) bool {
+	var respErr *smb2.ResponseError
+	return errors.As(err, &respErr) && NTStatus(respErr.Code) == STATUS_PATH_NOT_COVERED
+}
+
+// wrapShare installs DFS referral handling on a pooled connection's share,
+// mounted on session, when DFS is enabled.
+func (p *connectionPool) wrapShare(session SMBSession, share SMBShare) SMBShare {
+	if p.dfs == nil {
+		return share
+	}
+	return &dfsShare{root: share, session: session, dfs: p.dfs}
+}
+
+// dfsShare serves paths under DFS links from the links' targets and the
+// rest from the configured share.
+type dfsShare struct {
+	root    SMBShare
+	session SMBSession // Session root is mounted on, for referral requests
+	dfs     *dfsResolver
+	ctx     context.Context // Context bound with WithContext, or nil
+}
+
+// resolve returns the share that serves name, name's path within it and
+// the target's key ("" for the configured share).
+func (s *dfsShare) resolve(name string) (SMBShare, string, string, error) {
+	ref, rest, ok := s.dfs.lookup(name)
+	if !ok {
+		return s.root, name, "", nil
+	}
+	share, key, err := s.dfs.target(ref)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if s.ctx != nil {
+		share = shareWithContext(share, s.ctx)
+	}
+	path := ref.path
+	if rest != "" {
+		path = strings.TrimPrefix(path+`\`+rest, `\`)
+	}
+	return share, path, key, nil
+}
+
+// do runs op on the share that serves name. When the configured share
+// reports that name is under a DFS link, the link's referral is requested
+// and op runs again on its target.
+func (s *dfsShare) do(name string, op func(share SMBShare, name string) error) error {
+	share, path, key, err := s.resolve(name)
+	if err != nil {
+		return err
+	}
+	err = op(share, path)
+	if key == "" && isPathNotCovered(err) {
+		if _, err := s.dfs.refer(s.ctx, s.session, name); err != nil {
+			return err
+		}
+		if share, path, key, err = s.resolve(name); err != nil {
+			return err
+		}
+		err = op(share, path)
+	}
+	var transportErr *smb2.TransportError
+	if key != "" && errors.As(err, &transportErr) {
+		s.dfs.dropTarget(key)
+	}
+	return err
+}
+
+// OpenFile opens a file with the specified flags and permissions.
+func (s *dfsShare) OpenFile(name string, flag int, perm fs.FileMode) (SMBFile, error) {
+	var file SMBFile
+	err := s.do(name, func(share SMBShare, name string) (err error) {
+		file, err = share.OpenFile(name, flag, perm)
+		return err
+	})
+	return file, err
+}
+
+// OpenFileShareDelete opens a file like OpenFile, letting others delete or
+// rename it while it is open.
+func (s *dfsShare) OpenFileShareDelete(name string, flag int, perm fs.FileMode) (SMBFile, error) {
+	var file SMBFile
+	err := s.do(name, func(share SMBShare, name string) (err error) {
+		file, err = openFileShareDelete(share, name, flag, perm)
+		return err
+	})
+	return file, err
+}
+
+// OpenAccess opens an existing file or directory with the given access
+// rights, for requests on its handle.
+func (s *dfsShare) OpenAccess(name string, access uint32) (SMBFile, error) {
+	var file SMBFile
+	err := s.do(name, func(share SMBShare, name string) (err error) {
+		opener, ok := share.(interface {
+			OpenAccess(name string, access uint32) (SMBFile, error)
+		})
+		if !ok {
+			return ErrNotImplemented
+		}
+		file, err = opener.OpenAccess(name, access)
+		return err
+	})
+	return file, err
+}
+
+// Stat returns file info for the specified path.
+func (s *dfsShare) Stat(name string) (fs.FileInfo, error) {
+	var info fs.FileInfo
+	err := s.do(name, func(share SMBShare, name string) (err error) {
+		info, err = share.Stat(name)
+		return err
+	})
+	return info, err
+}
+
+// Lstat returns file info for the specified path without following a
+// final symbolic link.
+func (s *dfsShare) Lstat(name string) (fs.FileInfo, error) {
+	var info fs.FileInfo
+	err := s.do(name, func(share SMBShare, name string) (err error) {
+		if lstater, ok := share.(interface {
+			Lstat(name string) (fs.FileInfo, error)
+		}); ok {
+			info, err = lstater.Lstat(name)
+		} else {
+			info, err = share.Stat(name)
+		}
+		return err
+	})
+	return info, err
+}
+
+// Readlink returns the target of a symbolic link.
+func (s *dfsShare) Readlink(name string) (string, error) {
+	var target string
+	err := s.do(name, func(share SMBShare, name string) (err error) {
+		rl, ok := share.(interface {
+			Readlink(name string) (string, error)
+		})
+		if !ok {
+			return ErrNotImplemented
+		}
+		target, err = rl.Readlink(name)
+		return err
+	})
+	return target, err
+}
+
+// Symlink creates linkpath as a symbolic link to target.
+func (s *dfsShare) Symlink(target, linkpath string) error {
+	return s.do(linkpath, func(share SMBShare, name string) error {
+		linker, ok := share.(interface {
+			Symlink(target, linkpath string) error
+		})
+		if !ok {
+			return ErrNotImplemented
+		}
+		return linker.Symlink(target, name)
+	})
+}
+
+// SetAttributes sets the Windows file attributes of a file.
+func (s *dfsShare) SetAttributes(name string, attrs uint32) error {
+	return s.do(name, func(share SMBShare, name string) error {
+		setter, ok := share.(interface {
+			SetAttributes(name string, attrs uint32) error
+		})
+		if !ok {
+			return ErrNotImplemented
+		}
+		return setter.SetAttributes(name, attrs)
+	})
+}
+
+// Statfs returns the sizes of the volume holding name.
+func (s *dfsShare) Statfs(name string) (total, free, available uint64, err error) {
+	err = s.do(name, func(share SMBShare, name string) error {
+		statfser, ok := share.(interface {
+			Statfs(name string) (total, free, available uint64, err error)
+		})
+		if !ok {
+			return ErrNotImplemented
+		}
+		total, free, available, err = statfser.Statfs(name)
+		return err
+	})
+	return total, free, available, err
+}
+
+// Mkdir creates a directory.
+func (s *dfsShare) Mkdir(name string, perm fs.FileMode) error {
+	return s.do(name, func(share SMBShare, name string) error {
+		return share.Mkdir(name, perm)
+	})
+}
+
+// Remove removes a file or empty directory.
+func (s *dfsShare) Remove(name string) error {
+	return s.do(name, func(share SMBShare, name string) error {
+		return share.Remove(name)
+	})
+}
+
+// Rename renames a file or directory. Both paths must be served by the
+// same share.
+func (s *dfsShare) Rename(oldname, newname string) error {
+	return s.do(oldname, func(share SMBShare, oldpath string) error {
+		_, newpath, newKey, err := s.resolve(newname)
+		if err != nil {
+			return err
+		}
+		if _, _, oldKey, _ := s.resolve(oldname); oldKey != newKey {
+			return errDFSCrossTarget
+		}
+		return share.Rename(oldpath, newpath)
+	})
+}
+
+// Chmod changes the mode of a file.
+func (s *dfsShare) Chmod(name string, mode fs.FileMode) error {
+	return s.do(name, func(share SMBShare, name string) error {
+		return share.Chmod(name, mode)
+	})
+}
+
+// Chtimes changes the access and modification times of a file.
+func (s *dfsShare) Chtimes(name string, atime, mtime time.Time) error {
+	return s.do(name, func(share SMBShare, name string) error {
+		return share.Chtimes(name, atime, mtime)
+	})
+}
+
+// WithContext returns the share with requests bound to ctx, on the
+// configured share and on DFS targets alike.
+func (s *dfsShare) WithContext(ctx context.Context) SMBShare {
+	return &dfsShare{root: shareWithContext(s.root, ctx), session: s.session, dfs: s.dfs, ctx: ctx}
+}
+
+// Umount unmounts the configured share. Connections to DFS targets are
+// closed with the pool.
+func (s *dfsShare) Umount() error {
+	return s.root.Umount()
+}
@@ -0,0 +1,162 @@
+package smbfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/absfs/memfs"
+	"github.com/absfs/smbfs/internal/smb2"
+)
+
+// TestFileSystem_DFS tests that paths under a DFS link are read and written
+// through the link's target share.
+func TestFileSystem_DFS(t *testing.T) {
+	srv, config := startLoopbackServer(t, ServerOptions{})
+
+	data := srv.GetShare("data").fs
+	if err := data.MkdirAll("/documents/sub", 0755); err != nil {
+		t.Fatalf("MkdirAll() error = %v", err)
+	}
+	f, _ := data.Create("/documents/sub/readme.txt")
+	f.Write([]byte("from the target"))
+	f.Close()
+
+	root, _ := memfs.NewFS()
+	f, _ = root.Create("/local.txt")
+	f.Write([]byte("from the root"))
+	f.Close()
+	err := srv.AddShare(root, ShareOptions{ShareName: "root", DFSLinks: map[string]string{
+		"docs": `\\127.0.0.1\data\documents`,
+	}})
+	if err != nil {
+		t.Fatalf("AddShare() error = %v", err)
+	}
+
+	config.Share = "root"
+	config.EnableDFS = true
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	for name, want := range map[string]string{
+		"/local.txt":           "from the root",
+		"/docs/sub/readme.txt": "from the target",
+	} {
+		f, err := fsys.Open(name)
+		if err != nil {
+			t.Fatalf("Open(%s) error = %v", name, err)
+		}
+		got, err := io.ReadAll(f)
+		f.Close()
+		if err != nil || string(got) != want {
+			t.Errorf("ReadAll(%s) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+
+	f2, err := fsys.Create("/docs/new.txt")
+	if err != nil {
+		t.Fatalf("Create() under a DFS link error = %v", err)
+	}
+	f2.Write([]byte("written"))
+	f2.Close()
+	if _, err := data.Stat("/documents/new.txt"); err != nil {
+		t.Errorf("file created through the link is missing from the target: %v", err)
+	}
+
+	entries, err := fsys.ReadDir("/docs")
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("ReadDir(/docs) returned %d entries, want 2", len(entries))
+	}
+
+	// Without DFS the link is not followed
+	config.EnableDFS = false
+	plain, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer plain.Close()
+	if _, err := plain.Stat("/docs/sub/readme.txt"); !isPathNotCovered(err) {
+		t.Errorf("Stat() without DFS error = %v, want STATUS_PATH_NOT_COVERED", err)
+	}
+}
+
+// TestDFSResolver_Cache tests that referrals are cached until their TTL
+// expires and that targets are connected to once.
+func TestDFSResolver_Cache(t *testing.T) {
+	backend := NewMockSMBBackend()
+	backend.AddShare("data")
+	factory := NewMockConnectionFactory(backend)
+	r := newDFSResolver(&Config{Server: "srv", Share: "root"}, factory)
+	defer r.close()
+
+	fetches := 0
+	ttl := uint32(60)
+	r.fetch = func(ctx context.Context, session SMBSession, path string) (*dfsReferralResponse, error) {
+		fetches++
+		if path != `\srv\root\docs\a.txt` {
+			t.Errorf("referral requested for %q", path)
+		}
+		return &dfsReferralResponse{
+			PathConsumed: len(`\srv\root\docs`),
+			Entries:      []dfsReferralEntry{{TTL: ttl, DFSPath: `\srv\root\docs`, Target: `\fs1\data\documents`}},
+		}, nil
+	}
+
+	root := &failingShare{err: &smb2.ResponseError{Code: uint32(STATUS_PATH_NOT_COVERED)}}
+	s := &dfsShare{root: root, dfs: r}
+	var gotPath string
+	op := func(share SMBShare, name string) error {
+		if share == root {
+			return root.err
+		}
+		gotPath = name
+		return nil
+	}
+
+	if err := s.do(`docs\a.txt`, op); err != nil {
+		t.Fatalf("do() error = %v", err)
+	}
+	if gotPath != `documents\a.txt` {
+		t.Errorf("target path = %q, want documents\\a.txt", gotPath)
+	}
+	if err := s.do(`DOCS\b.txt`, op); err != nil || gotPath != `documents\b.txt` {
+		t.Errorf("cached lookup = %q, %v", gotPath, err)
+	}
+	if fetches != 1 || factory.ConnectionsMade() != 1 {
+		t.Errorf("fetches = %d, connections = %d, want 1 and 1", fetches, factory.ConnectionsMade())
+	}
+
+	// An expired referral is requested again
+	r.mu.Lock()
+	ref := r.referrals["docs"]
+	ref.expires = time.Now().Add(-time.Second)
+	r.referrals["docs"] = ref
+	r.mu.Unlock()
+	if err := s.do(`docs\a.txt`, op); err != nil {
+		t.Fatalf("do() after expiry error = %v", err)
+	}
+	if fetches != 2 || factory.ConnectionsMade() != 1 {
+		t.Errorf("after expiry fetches = %d, connections = %d, want 2 and 1", fetches, factory.ConnectionsMade())
+	}
+
+	// Other errors are returned without a referral
+	root.err = errors.New("boom")
+	if err := s.do(`other.txt`, op); err != root.err || fetches != 2 {
+		t.Errorf("do() = %v with %d fetches, want the share's error", err, fetches)
+	}
+}
+
+// failingShare is an SMBShare whose operations are only used to identify
+// it; dfsShare.do passes it to the operation under test.
+type failingShare struct {
+	SMBShare
+	err error
+}
@@ -0,0 +1,41 @@
+package smbfs
+
+// Statfser is implemented by filesystems that can report their capacity.
+// Shares backed by such a filesystem report its real total and free space
+// instead of the defaults; blockSize is the allocation unit in bytes, with
+// zero meaning 4KB
+type Statfser interface {
+	Statfs() (total, free uint64, blockSize uint32, err error)
+}
+
+// Capacity reported for filesystems without Statfser
+const (
+	defaultTotalSpace     = 1 << 40 // 1TB
+	defaultFreeSpace      = 1 << 39 // 512GB
+	defaultAllocationUnit = 4096
+)
+
+// DiskSpace returns the share's total and free space in bytes and the
+// allocation unit size used to report them. The unit is always a whole
+// number of sectors, and ShareOptions.QuotaBytes caps the total, and the
+// free space at what the share's files leave of it
+func (s *Share) DiskSpace() (total, free uint64, unitSize uint32) {
+	total, free, unitSize = defaultTotalSpace, defaultFreeSpace, defaultAllocationUnit
+	if sf, ok := s.FileSystem().(Statfser); ok {
+		if t, f, bs, err := sf.Statfs(); err == nil {
+			total, free = t, min(f, t)
+			if bs != 0 {
+				unitSize = bs
+			}
+		}
+	}
+
+	if quota := s.Options().QuotaBytes; quota > 0 {
+		total = min(total, quota)
+		free = min(free, quota-min(uint64(s.usedSpace()), quota))
+	}
+
+	sector := s.BytesPerSector()
+	unitSize = (unitSize + sector - 1) / sector * sector
+	return total, free, unitSize
+}
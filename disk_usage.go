@@ -0,0 +1,51 @@
+package smbfs
+
+import (
+	"sync"
+	"time"
+)
+
+// statfsTTL is how long Statfs reuses the sizes it last fetched.
+const statfsTTL = 2 * time.Second
+
+// statfsCache holds the sizes Statfs last fetched.
+type statfsCache struct {
+	mu                     sync.Mutex
+	fetched                time.Time
+	total, free, available uint64
+}
+
+// Statfs returns the size of the share's volume and its free bytes, from
+// a QUERY_INFO FileFsFullSizeInformation on the share root. free is all
+// the free space, and available the part of it the user may fill, which a
+// quota can make smaller. The sizes are reused for a couple of seconds, so
+// checking before each of many writes costs no extra round trips.
+func (fsys *FileSystem) Statfs() (total, free, available uint64, err error) {
+	c := &fsys.statfs
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.fetched.IsZero() && time.Since(c.fetched) < statfsTTL {
+		return c.total, c.free, c.available, nil
+	}
+
+	conn, err := fsys.pool.get(fsys.ctx)
+	if err != nil {
+		return 0, 0, 0, wrapPathError("statfs", "/", err)
+	}
+	defer fsys.pool.put(conn)
+
+	statfser, ok := conn.share.(interface {
+		Statfs(name string) (total, free, available uint64, err error)
+	})
+	if !ok {
+		return 0, 0, 0, wrapPathError("statfs", "/", ErrNotImplemented)
+	}
+	total, free, available, err = statfser.Statfs("")
+	if err != nil {
+		return 0, 0, 0, wrapPathError("statfs", "/", convertError(err))
+	}
+
+	c.fetched = time.Now()
+	c.total, c.free, c.available = total, free, available
+	return total, free, available, nil
+}
@@ -0,0 +1,57 @@
+package smbfs
+
+import (
+	"testing"
+
+	"github.com/absfs/memfs"
+)
+
+// TestFileSystem_Statfs tests that Statfs decodes the sizes the in-repo
+// server advertises for a share, and reuses them for a while
+func TestFileSystem_Statfs(t *testing.T) {
+	srv, config := startLoopbackServer(t, ServerOptions{})
+	mfs, _ := memfs.NewFS()
+	f, _ := mfs.Create("/used.bin")
+	f.Write(make([]byte, 100000))
+	f.Close()
+	if err := srv.AddShare(mfs, ShareOptions{ShareName: "quota", QuotaBytes: 1 << 20}); err != nil {
+		t.Fatalf("AddShare() error = %v", err)
+	}
+	config.Share = "quota"
+
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	total, free, available, err := fsys.Statfs()
+	if err != nil {
+		t.Fatalf("Statfs() error = %v", err)
+	}
+	wantTotal, wantFree, unit := srv.GetShare("quota").DiskSpace()
+	wantTotal -= wantTotal % uint64(unit)
+	wantFree -= wantFree % uint64(unit)
+	if total != wantTotal || free != wantFree || available != wantFree {
+		t.Errorf("Statfs() = %d, %d, %d, want %d, %d, %d", total, free, available, wantTotal, wantFree, wantFree)
+	}
+	if total != 1<<20 || free >= total {
+		t.Errorf("Statfs() = %d total, %d free, want the 1MB quota less what is used", total, free)
+	}
+
+	// The sizes are reused rather than fetched again
+	more, err := fsys.Create("/more.bin")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	more.Write(make([]byte, 200000))
+	more.Close()
+	if _, again, _, err := fsys.Statfs(); err != nil || again != free {
+		t.Errorf("Statfs() right after = %d free, %v, want the cached %d", again, err, free)
+	}
+
+	fsys.statfs.fetched = fsys.statfs.fetched.Add(-statfsTTL)
+	if _, later, _, err := fsys.Statfs(); err != nil || later >= free {
+		t.Errorf("Statfs() once expired = %d free, %v, want less than %d", later, err, free)
+	}
+}
@@ -55,14 +55,13 @@
 //	    Domain:   "CORP",  // Optional for domain-joined servers
 //	}
 //
-// Kerberos Authentication:
+// Kerberos Authentication, with the ticket from kinit (or a keytab, with
+// KerberosKeytab):
 //
 //	&smbfs.Config{
 //	    Server:      "fileserver.corp.example.com",
 //	    Share:       "departments",
 //	    UseKerberos: true,
-//	    Domain:      "CORP",
-//	    Username:    "jdoe",
 //	}
 //
 // Guest Access:
@@ -1,8 +1,11 @@
 package smbfs
 
 import (
+	"context"
 	"errors"
 	"io/fs"
+
+	"github.com/absfs/smbfs/internal/smb2"
 )
 
 var (
@@ -32,8 +35,53 @@ var (
 
 	// ErrIsDirectory indicates the path is a directory.
 	ErrIsDirectory = errors.New("is a directory")
+
+	// ErrSignatureMismatch indicates a server response was unsigned or its
+	// signature did not verify while signing was required.
+	ErrSignatureMismatch = errors.New("SMB response signature mismatch")
+
+	// ErrNoXattr indicates a file has no extended attribute of the given
+	// name.
+	ErrNoXattr = errors.New("no such extended attribute")
+
+	// ErrLockNotGranted indicates a byte-range lock conflicts with one
+	// held through another open of the file.
+	ErrLockNotGranted = errors.New("lock not granted")
+
+	// ErrNotLocked indicates an unlock of a range that is not locked.
+	ErrNotLocked = errors.New("range not locked")
+
+	// ErrCircuitOpen indicates an operation was not attempted because the
+	// RetryPolicy's circuit breaker is open after repeated failures.
+	ErrCircuitOpen = errors.New("circuit breaker open")
+
+	// ErrKerberosClockSkew indicates the KDC or the server refused a
+	// Kerberos ticket because the local clock is too far from theirs.
+	ErrKerberosClockSkew = errors.New("kerberos: clock skew too great")
+
+	// ErrKerberosSPNNotFound indicates there is no service principal to
+	// get a Kerberos ticket for: the KDC does not know it, or the server
+	// was given as an IP address.
+	ErrKerberosSPNNotFound = errors.New("kerberos: service principal not found")
+
+	// ErrKerberosTicketNotFound indicates there is no valid Kerberos
+	// ticket to authenticate with: the credential cache is missing or
+	// expired, or the keytab has no key for the user.
+	ErrKerberosTicketNotFound = errors.New("kerberos: no valid ticket")
 )
 
+// contextError reports a failure caused by ctx being done as ctx.Err(); the
+// SMB layer reports cancelled requests with an error of its own.
+func contextError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
 // wrapPathError wraps an error with operation and path information.
 // Uses fs.PathError to ensure compatibility with os.IsNotExist and other stdlib checks.
 func wrapPathError(op, path string, err error) error {
@@ -41,6 +89,10 @@ func wrapPathError(op, path string, err error) error {
 		return nil
 	}
 
+	if isSignatureFailure(err) {
+		err = ErrSignatureMismatch
+	}
+
 	// If it's already a PathError for the same path, don't double-wrap
 	var pe *fs.PathError
 	if errors.As(err, &pe) && pe.Path == path {
@@ -77,11 +129,20 @@ func convertError(err error) error {
 		return fs.ErrInvalid
 	case errors.Is(err, ErrAuthenticationFailed):
 		return fs.ErrPermission
+	case isSignatureFailure(err):
+		return ErrSignatureMismatch
 	}
 
 	return err
 }
 
+// isSignatureFailure reports whether err is go-smb2 rejecting a response
+// that was unsigned or failed verification.
+func isSignatureFailure(err error) bool {
+	var sigErr *smb2.SignatureError
+	return errors.As(err, &sigErr)
+}
+
 // netError interface for network errors.
 type netError interface {
 	Timeout() bool
@@ -89,12 +150,37 @@ type netError interface {
 }
 
 // isRetryable returns true if the error indicates a transient failure
-// that might succeed if retried.
+// that might succeed if retried. Definitive answers from the server, such
+// as a missing file or denied access, are not retried: asking again gets
+// the same answer and only delays the error.
 func isRetryable(err error) bool {
 	if err == nil {
 		return false
 	}
 
+	// Permanent failures, even when wrapped in a network or transport error
+	switch {
+	case errors.Is(err, fs.ErrNotExist),
+		errors.Is(err, fs.ErrExist),
+		errors.Is(err, fs.ErrPermission),
+		errors.Is(err, fs.ErrInvalid),
+		errors.Is(err, ErrAuthenticationFailed),
+		errors.Is(err, ErrSignatureMismatch),
+		errors.Is(err, ErrKerberosClockSkew),
+		errors.Is(err, ErrKerberosSPNNotFound),
+		errors.Is(err, ErrKerberosTicketNotFound),
+		errors.Is(err, ErrCircuitOpen),
+		errors.Is(err, context.Canceled):
+		return false
+	}
+
+	// The server answered; only statuses for conditions that pass are
+	// worth asking again
+	var respErr *smb2.ResponseError
+	if errors.As(err, &respErr) {
+		return retryableStatus(NTStatus(respErr.Code))
+	}
+
 	// Network errors are generally retryable
 	var netErr netError
 	if errors.As(err, &netErr) {
@@ -108,12 +194,22 @@ func isRetryable(err error) bool {
 		}
 	}
 
+	// Transport failures (e.g. the server dropped the connection) are retryable
+	var transportErr *smb2.TransportError
+	if errors.As(err, &transportErr) {
+		return true
+	}
+
 	// Connection errors are typically retryable
 	switch {
 	case errors.Is(err, ErrConnectionClosed):
 		return true
 	case errors.Is(err, ErrPoolExhausted):
 		return true
+	case errors.Is(err, context.DeadlineExceeded):
+		// A per-operation timeout; the overall context is checked before
+		// each attempt
+		return true
 	}
 
 	// Check wrapped errors
@@ -124,3 +220,31 @@ func isRetryable(err error) bool {
 
 	return false
 }
+
+// retryableStatus reports whether a request that failed with status may
+// succeed if sent again, on the same or a fresh connection.
+func retryableStatus(status NTStatus) bool {
+	switch status {
+	case STATUS_INSUFFICIENT_RESOURCES, // Out of credits or server memory
+		STATUS_NETWORK_NAME_DELETED, // Tree disconnected under us
+		STATUS_USER_SESSION_DELETED: // Session expired or was logged off
+		return true
+	}
+	return false
+}
+
+// isSessionLost reports whether err is the server saying it no longer
+// knows the session or tree connect a request was sent on, as after a
+// session times out. Handles opened through it are gone too, so the
+// connection is useless and files have to be opened again.
+func isSessionLost(err error) bool {
+	var respErr *smb2.ResponseError
+	if !errors.As(err, &respErr) {
+		return false
+	}
+	switch NTStatus(respErr.Code) {
+	case STATUS_USER_SESSION_DELETED, STATUS_NETWORK_NAME_DELETED:
+		return true
+	}
+	return false
+}
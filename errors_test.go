@@ -1,9 +1,14 @@
 package smbfs
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"io/fs"
 	"testing"
+
+	"github.com/absfs/smbfs/internal/smb2"
 )
 
 func TestPathError(t *testing.T) {
@@ -221,6 +226,56 @@ func TestIsRetryable(t *testing.T) {
 			err:      wrapPathError("read", "/path", ErrConnectionClosed),
 			expected: true,
 		},
+		{
+			name:     "wrapped transport error is retryable",
+			err:      fmt.Errorf("SMB session setup failed: %w", &smb2.TransportError{Err: io.EOF}),
+			expected: true,
+		},
+		{
+			name:     "STATUS_INSUFFICIENT_RESOURCES is retryable",
+			err:      wrapPathError("write", "/f", &smb2.ResponseError{Code: uint32(STATUS_INSUFFICIENT_RESOURCES)}),
+			expected: true,
+		},
+		{
+			name:     "STATUS_NETWORK_NAME_DELETED is retryable",
+			err:      &smb2.ResponseError{Code: uint32(STATUS_NETWORK_NAME_DELETED)},
+			expected: true,
+		},
+		{
+			name:     "STATUS_OBJECT_NAME_NOT_FOUND is not retryable",
+			err:      wrapPathError("open", "/f", &smb2.ResponseError{Code: uint32(STATUS_OBJECT_NAME_NOT_FOUND)}),
+			expected: false,
+		},
+		{
+			name:     "STATUS_ACCESS_DENIED is not retryable",
+			err:      &smb2.ResponseError{Code: uint32(STATUS_ACCESS_DENIED)},
+			expected: false,
+		},
+		{
+			name:     "STATUS_SHARING_VIOLATION is not retryable",
+			err:      &smb2.ResponseError{Code: uint32(STATUS_SHARING_VIOLATION)},
+			expected: false,
+		},
+		{
+			name:     "STATUS_LOGON_FAILURE is not retryable",
+			err:      fmt.Errorf("SMB session setup failed: %w", &smb2.ResponseError{Code: uint32(STATUS_LOGON_FAILURE)}),
+			expected: false,
+		},
+		{
+			name:     "fs.ErrPermission is not retryable",
+			err:      wrapPathError("open", "/f", fs.ErrPermission),
+			expected: false,
+		},
+		{
+			name:     "context.DeadlineExceeded is retryable",
+			err:      fmt.Errorf("stat: %w", context.DeadlineExceeded),
+			expected: true,
+		},
+		{
+			name:     "context.Canceled is not retryable",
+			err:      context.Canceled,
+			expected: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -246,6 +301,10 @@ func TestErrorConstants(t *testing.T) {
 		ErrInvalidPath,
 		ErrNotDirectory,
 		ErrIsDirectory,
+		ErrSignatureMismatch,
+		ErrKerberosClockSkew,
+		ErrKerberosSPNNotFound,
+		ErrKerberosTicketNotFound,
 	}
 
 	// Check they're all non-nil
@@ -289,3 +348,21 @@ func TestPathError_ErrorChaining(t *testing.T) {
 		t.Errorf("PathError.Path = %q, want %q", pathErr.Path, "/server/share")
 	}
 }
+
+func TestNewInitiator(t *testing.T) {
+	if _, err := newInitiator(&Config{Server: "10.0.0.5", UseKerberos: true}); !errors.Is(err, ErrKerberosSPNNotFound) {
+		t.Errorf("newInitiator(UseKerberos) error = %v, want ErrKerberosSPNNotFound", err)
+	}
+
+	initiator, err := newInitiator(&Config{Username: "jdoe", Password: "secret", Domain: "CORP"})
+	if err != nil {
+		t.Fatalf("newInitiator() error = %v", err)
+	}
+	ntlm, ok := initiator.(*smb2.NTLMInitiator)
+	if !ok {
+		t.Fatalf("newInitiator() = %T, want *smb2.NTLMInitiator", initiator)
+	}
+	if ntlm.User != "jdoe" || ntlm.Password != "secret" || ntlm.Domain != "CORP" {
+		t.Errorf("newInitiator() = %+v", ntlm)
+	}
+}
@@ -90,11 +90,12 @@ func main() {
 	// Step 5: Configure and add a share
 	log.Printf("[INFO] Adding share '%s'...", *shareName)
 	shareOpts := smbfs.ShareOptions{
-		ShareName:  *shareName,
-		SharePath:  "/",
-		ReadOnly:   *readOnly,
-		AllowGuest: true, // Allow anonymous access
-		Comment:    "Example in-memory share",
+		ShareName:       *shareName,
+		SharePath:       "/",
+		ReadOnly:        *readOnly,
+		AllowGuest:      true, // Allow anonymous access
+		Comment:         "Example in-memory share",
+		CaseInsensitive: true, // Match names ignoring case, as Windows does
 	}
 
 	if err := server.AddShare(fs, shareOpts); err != nil {
@@ -153,7 +154,9 @@ func main() {
 
 	// Graceful shutdown
 	log.Printf("[INFO] Stopping SMB server...")
-	if err := server.Stop(); err != nil {
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer shutdownCancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
 		log.Printf("[ERROR] Error during shutdown: %v", err)
 	}
 
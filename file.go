@@ -1,9 +1,14 @@
 package smbfs
 
 import (
+	"context"
 	"io"
 	"io/fs"
+	"os"
+	"sync"
 	"time"
+
+	"github.com/absfs/smbfs/internal/smb2"
 )
 
 // File represents an open file on an SMB share.
@@ -12,9 +17,16 @@ type File struct {
 	conn     *pooledConn
 	file     SMBFile
 	path     string
+	flag     int // Flags the file was opened with, for reopening it
 	offset   int64
 	dirEntry []fs.DirEntry
 	dirPos   int
+	ctx      context.Context // Context the file was opened with, if the share can bind requests to one
+	seekMu   sync.Mutex      // Serializes ReadAt and WriteAt on files without positioned I/O
+
+	readOnly  bool       // Opened without write access, so it may read ahead
+	seqReads  int        // Reads since the file was opened or seeked
+	readAhead *readAhead // Prefetcher serving Read, if one is running
 }
 
 // Name returns the name of the file.
@@ -22,41 +34,340 @@ func (f *File) Name() string {
 	return f.path
 }
 
-// Read reads up to len(p) bytes into p.
+// Read reads up to len(p) bytes into p. If Config.ReadAhead is set and the
+// file is being read sequentially, the data comes from reads issued ahead
+// of time.
 func (f *File) Read(p []byte) (n int, err error) {
+	return f.read(nil, p, true)
+}
+
+// read reads into p with requests bound to ctx, or to the file's own
+// context if ctx is nil.
+func (f *File) read(ctx context.Context, p []byte, prefetch bool) (n int, err error) {
 	if f.file == nil {
 		return 0, fs.ErrClosed
 	}
+	f.conn.beginOp()
+	defer f.conn.endOp()
 
-	n, err = f.file.Read(p)
-	if err != nil && err != io.EOF {
-		return n, wrapPathError("read", f.path, err)
+	if prefetch && f.readAhead == nil {
+		f.startReadAhead()
+	}
+	if f.readAhead != nil {
+		n, err = f.readAhead.Read(p)
+		f.offset += int64(n)
+		if err != nil {
+			// Past the end or after a failure, read directly again
+			if stopErr := f.stopReadAhead(); err == io.EOF {
+				err = stopErr
+			}
+			if err == nil {
+				return f.read(ctx, p, false)
+			}
+			if err != io.EOF {
+				if f.reopen(err) {
+					return f.read(ctx, p, false)
+				}
+				return n, wrapPathError("read", f.path, f.requestError(ctx, err))
+			}
+		}
+		return n, err
 	}
 
+	if ctx != nil {
+		defer f.seekHandle()
+	}
+	n, err = f.handle(ctx).Read(p)
 	f.offset += int64(n)
+	if err != nil && err != io.EOF && n == 0 && f.reopen(err) {
+		n, err = f.handle(ctx).Read(p)
+		f.offset += int64(n)
+	}
+	if err != nil && err != io.EOF {
+		return n, wrapPathError("read", f.path, f.requestError(ctx, err))
+	}
+
+	f.seqReads++
 	return n, err
 }
 
-// Write writes len(p) bytes from p to the file.
+// startReadAhead starts prefetching if read-ahead is enabled and the file
+// has been read sequentially long enough.
+func (f *File) startReadAhead() {
+	window := f.fs.config.ReadAhead
+	if window <= 0 || !f.readOnly || f.seqReads < readAheadTrigger {
+		return
+	}
+	ra, ok := f.file.(io.ReaderAt)
+	if !ok {
+		return
+	}
+	f.readAhead = newReadAhead(ra, f.offset, window, f.fs.config.ReadBufferSize)
+}
+
+// stopReadAhead drops the prefetched data and moves the file's own offset,
+// which prefetching leaves behind, to where the reader got to.
+func (f *File) stopReadAhead() error {
+	if f.readAhead == nil {
+		return nil
+	}
+	f.readAhead.Close()
+	f.readAhead = nil
+	f.seqReads = 0
+
+	if _, err := f.file.Seek(f.offset, io.SeekStart); err != nil {
+		return wrapPathError("read", f.path, err)
+	}
+	return nil
+}
+
+// ReadContext is like Read, but aborts the read if ctx is done before the
+// server answers and returns ctx.Err(). It does not read ahead.
+func (f *File) ReadContext(ctx context.Context, p []byte) (n int, err error) {
+	if f.file == nil {
+		return 0, fs.ErrClosed
+	}
+	if err := f.stopReadAhead(); err != nil {
+		return 0, err
+	}
+	if f.ctx == nil {
+		if err := ctx.Err(); err != nil {
+			return 0, wrapPathError("read", f.path, err)
+		}
+		return f.read(nil, p, false)
+	}
+
+	ctx, cancel := f.requestContext(ctx)
+	defer cancel()
+	return f.read(ctx, p, false)
+}
+
+// Write writes len(p) bytes from p to the file. On a file opened with
+// os.O_APPEND, each write goes to the current end of the file.
 func (f *File) Write(p []byte) (n int, err error) {
+	return f.write(nil, p)
+}
+
+// write writes p with requests bound to ctx, or to the file's own context
+// if ctx is nil.
+func (f *File) write(ctx context.Context, p []byte) (n int, err error) {
 	if f.file == nil {
 		return 0, fs.ErrClosed
 	}
+	f.conn.beginOp()
+	defer f.conn.endOp()
+	if ctx != nil {
+		defer f.seekHandle()
+	}
 
-	n, err = f.file.Write(p)
-	if err != nil {
-		return n, wrapPathError("write", f.path, err)
+	// The end of the file may have moved since the last write, if another
+	// client appended to it
+	file := f.handle(ctx)
+	if f.flag&os.O_APPEND != 0 {
+		end, err := file.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, wrapPathError("write", f.path, f.requestError(ctx, err))
+		}
+		f.offset = end
 	}
 
+	n, err = file.Write(p)
+	n = max(n, 0) // go-smb2 reports -1 for a write that failed outright
 	f.offset += int64(n)
+	if err != nil && f.reopen(err) {
+		var m int
+		m, err = f.handle(ctx).Write(p[n:])
+		m = max(m, 0)
+		f.offset += int64(m)
+		n += m
+	}
+	if err != nil {
+		return n, wrapPathError("write", f.path, f.requestError(ctx, err))
+	}
+
 	return n, nil
 }
 
+// WriteContext is like Write, but aborts the write if ctx is done before
+// the server answers and returns ctx.Err(). Data sent before the abort may
+// have been written.
+func (f *File) WriteContext(ctx context.Context, p []byte) (n int, err error) {
+	if f.file == nil {
+		return 0, fs.ErrClosed
+	}
+	if f.ctx == nil {
+		if err := ctx.Err(); err != nil {
+			return 0, wrapPathError("write", f.path, err)
+		}
+		return f.Write(p)
+	}
+
+	ctx, cancel := f.requestContext(ctx)
+	defer cancel()
+	return f.write(ctx, p)
+}
+
+// WriteTo writes the rest of the file to w, reading Config.ReadBufferSize
+// bytes at a time, and returns the number of bytes written. It lets
+// io.Copy from a File issue reads larger than its own 32KB buffer.
+func (f *File) WriteTo(w io.Writer) (n int64, err error) {
+	if f.file == nil {
+		return 0, fs.ErrClosed
+	}
+
+	buf := make([]byte, f.fs.config.ReadBufferSize)
+	for {
+		nr, rerr := f.Read(buf)
+		if nr > 0 {
+			nw, werr := w.Write(buf[:nr])
+			n += int64(nw)
+			if werr == nil && nw < nr {
+				werr = io.ErrShortWrite
+			}
+			if werr != nil {
+				return n, werr
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// ReadFrom writes the data read from r to the file until r returns io.EOF,
+// and returns the number of bytes written. Data is gathered into writes of
+// Config.WriteBufferSize bytes, so io.Copy to a File sends full-sized
+// writes whatever the size of r's reads.
+func (f *File) ReadFrom(r io.Reader) (n int64, err error) {
+	if f.file == nil {
+		return 0, fs.ErrClosed
+	}
+
+	buf := make([]byte, f.fs.config.WriteBufferSize)
+	for {
+		nr, rerr := io.ReadFull(r, buf)
+		if nr > 0 {
+			nw, werr := f.Write(buf[:nr])
+			n += int64(nw)
+			if werr != nil {
+				return n, werr
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// requestError reports a request aborted by the file's context, or by ctx,
+// the context of the request if it is not nil, as that context's error.
+func (f *File) requestError(ctx context.Context, err error) error {
+	if ctx != nil {
+		err = contextError(ctx, err)
+	}
+	if f.ctx != nil {
+		err = contextError(f.ctx, err)
+	}
+	return err
+}
+
+// requestContext returns the context for a single request bound to ctx,
+// which is also done when the file's context is. The returned function
+// must be called once the request is over.
+func (f *File) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(f.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// handle returns the file's handle with its requests bound to ctx, or the
+// handle itself if ctx is nil. The view of the handle has its own offset,
+// so seekHandle must be called once requests through it are done.
+func (f *File) handle(ctx context.Context) SMBFile {
+	if ctx == nil {
+		return f.file
+	}
+	return fileWithContext(f.file, ctx)
+}
+
+// seekHandle moves the file's handle to the file's offset.
+func (f *File) seekHandle() {
+	_, _ = f.file.Seek(f.offset, io.SeekStart)
+}
+
+// reopen recovers the file after err, if err says the server has dropped
+// the session the file was opened through (after a session timeout, say).
+// The file is opened again on a new connection and moved back to its
+// offset, and true is returned for the caller to retry its request once.
+func (f *File) reopen(err error) bool {
+	if !isSessionLost(err) {
+		return false
+	}
+	f.fs.pool.expire()
+
+	ctx := f.fs.ctx
+	if f.ctx != nil {
+		ctx = f.ctx
+	}
+	conn, err := f.fs.pool.get(ctx)
+	if err != nil {
+		if f.fs.config.Logger != nil {
+			f.fs.config.Logger.Printf("Failed to reconnect to reopen %s: %v", f.path, err)
+		}
+		return false
+	}
+	share := conn.share
+	if f.ctx != nil {
+		share = shareWithContext(share, f.ctx)
+	}
+
+	// The file exists and must not be truncated a second time
+	flag := f.flag &^ (os.O_CREATE | os.O_EXCL | os.O_TRUNC)
+	file, err := share.OpenFile(toSMBPath(f.path), flag, 0)
+	if err == nil {
+		_, err = file.Seek(f.offset, io.SeekStart)
+		if err != nil {
+			file.Close()
+		}
+	}
+	if err != nil {
+		f.fs.pool.put(conn)
+		if f.fs.config.Logger != nil {
+			f.fs.config.Logger.Printf("Failed to reopen %s: %v", f.path, err)
+		}
+		return false
+	}
+	conn.endOp()
+
+	// The old handle went with the session; closing it just frees it
+	_ = f.file.Close()
+	f.fs.pool.put(f.conn)
+	f.file = file
+	f.conn = conn
+	if f.fs.config.Logger != nil {
+		f.fs.config.Logger.Printf("Reopened %s after the server dropped its session", f.path)
+	}
+	return true
+}
+
 // Seek sets the offset for the next Read or Write on the file.
 func (f *File) Seek(offset int64, whence int) (int64, error) {
 	if f.file == nil {
 		return 0, fs.ErrClosed
 	}
+	if err := f.stopReadAhead(); err != nil {
+		return 0, err
+	}
+	f.seqReads = 0
 
 	newOffset, err := f.file.Seek(offset, whence)
 	if err != nil {
@@ -73,7 +384,20 @@ func (f *File) Close() error {
 		return nil
 	}
 
-	err := f.file.Close()
+	// Wait for prefetches, which use the handle
+	if f.readAhead != nil {
+		f.readAhead.Close()
+		f.readAhead = nil
+	}
+
+	// Let the close go through even if the open's context is done
+	file := f.file
+	if f.ctx != nil {
+		file = fileWithContext(file, context.WithoutCancel(f.ctx))
+	}
+
+	f.conn.beginOp() // Ended by putting the connection back
+	err := file.Close()
 	f.file = nil
 
 	// Return connection to pool
@@ -94,8 +418,13 @@ func (f *File) Stat() (fs.FileInfo, error) {
 	if f.file == nil {
 		return nil, fs.ErrClosed
 	}
+	f.conn.beginOp()
+	defer f.conn.endOp()
 
 	stat, err := f.file.Stat()
+	if err != nil && f.reopen(err) {
+		stat, err = f.file.Stat()
+	}
 	if err != nil {
 		return nil, wrapPathError("stat", f.path, err)
 	}
@@ -106,122 +435,165 @@ func (f *File) Stat() (fs.FileInfo, error) {
 	}, nil
 }
 
-// Truncate changes the size of the file.
-func (f *File) Truncate(size int64) error {
+// SetAttributes sets the file's Windows attributes (hidden, system,
+// read-only, archive, ...) with an SMB2 SET_INFO FileBasicInformation
+// request. The attributes replace the current ones; use the value from
+// GetWindowsAttributes to change individual bits.
+func (f *File) SetAttributes(attrs *WindowsAttributes) error {
 	if f.file == nil {
 		return fs.ErrClosed
 	}
 
-	// Get current size
-	info, err := f.file.Stat()
-	if err != nil {
-		return wrapPathError("truncate", f.path, err)
+	setter, ok := f.file.(interface {
+		SetAttributes(attrs uint32) error
+	})
+	if !ok {
+		return wrapPathError("chattr", f.path, ErrNotImplemented)
 	}
+	f.conn.beginOp()
+	defer f.conn.endOp()
 
-	currentSize := info.Size()
-	if size == currentSize {
-		return nil
+	if err := setter.SetAttributes(attrs.Attributes()); err != nil {
+		return wrapPathError("chattr", f.path, convertError(err))
 	}
 
-	if size < currentSize {
-		// For shrinking, seek to the new size position
-		_, err := f.file.Seek(size, io.SeekStart)
-		if err != nil {
-			return wrapPathError("truncate", f.path, err)
-		}
-		// Writing a zero-length slice at this position should signal truncation
-		// The mock backend needs to handle this specially
-		_, err = f.file.Write(nil)
-		if err != nil {
-			return wrapPathError("truncate", f.path, err)
-		}
-		return nil
+	// Invalidate stat cache since metadata changed
+	f.fs.cache.invalidate(f.path)
+
+	return nil
+}
+
+// Truncate changes the size of the file with an SMB2 SET_INFO
+// FileEndOfFileInformation request. Growing the file fills it with zeros.
+// The file offset is left unchanged.
+func (f *File) Truncate(size int64) error {
+	if f.file == nil {
+		return fs.ErrClosed
+	}
+	if size < 0 {
+		return wrapPathError("truncate", f.path, fs.ErrInvalid)
 	}
 
-	// For expanding, seek to the end and write zeros
-	_, err = f.file.Seek(0, io.SeekEnd)
-	if err != nil {
-		return wrapPathError("truncate", f.path, err)
+	truncater, ok := f.file.(interface {
+		Truncate(size int64) error
+	})
+	if !ok {
+		return wrapPathError("truncate", f.path, ErrNotImplemented)
 	}
+	f.conn.beginOp()
+	defer f.conn.endOp()
 
-	// Write zeros to expand the file
-	remaining := size - currentSize
-	buf := make([]byte, 4096)
-	for remaining > 0 {
-		toWrite := remaining
-		if toWrite > int64(len(buf)) {
-			toWrite = int64(len(buf))
-		}
-		_, err := f.file.Write(buf[:toWrite])
-		if err != nil {
-			return wrapPathError("truncate", f.path, err)
-		}
-		remaining -= toWrite
+	// Prefetched data may be from past the new end
+	if err := f.stopReadAhead(); err != nil {
+		return wrapPathError("truncate", f.path, err)
 	}
+	if err := truncater.Truncate(size); err != nil {
+		return wrapPathError("truncate", f.path, convertError(err))
+	}
+
+	// Invalidate stat cache since the size changed
+	f.fs.cache.invalidate(f.path)
 
 	return nil
 }
 
 // ReadAt reads len(b) bytes from the File starting at byte offset off.
+// It does not use or move the file's offset, and may be called from
+// several goroutines at once on distinct ranges, as io.ReaderAt allows.
+// It returns io.EOF when fewer than len(b) bytes could be read.
 func (f *File) ReadAt(b []byte, off int64) (n int, err error) {
-	if f.file == nil {
+	smbFile := f.file
+	if smbFile == nil {
 		return 0, fs.ErrClosed
 	}
-
-	// Save current position
-	currentPos := f.offset
-
-	// Seek to the offset
-	_, err = f.file.Seek(off, io.SeekStart)
-	if err != nil {
-		return 0, wrapPathError("readat", f.path, err)
+	if off < 0 {
+		return 0, wrapPathError("readat", f.path, fs.ErrInvalid)
 	}
+	f.conn.beginOp()
+	defer f.conn.endOp()
 
-	// Read the data
-	n, err = f.file.Read(b)
-
-	// Restore original position
-	_, seekErr := f.file.Seek(currentPos, io.SeekStart)
-	if seekErr != nil && err == nil {
-		err = wrapPathError("readat", f.path, seekErr)
+	ra, ok := smbFile.(io.ReaderAt)
+	if !ok {
+		ra = seekReaderAt{f}
+	}
+	for n < len(b) && err == nil {
+		var m int
+		m, err = ra.ReadAt(b[n:], off+int64(n))
+		if m > 0 {
+			n += m
+		} else if err == nil {
+			err = io.EOF
+		}
 	}
 
 	if err != nil && err != io.EOF {
-		return n, wrapPathError("readat", f.path, err)
+		return n, wrapPathError("readat", f.path, f.requestError(nil, err))
 	}
-
 	return n, err
 }
 
 // WriteAt writes len(b) bytes to the File starting at byte offset off.
+// It does not use or move the file's offset, and may be called from
+// several goroutines at once on distinct ranges, as io.WriterAt allows.
+// As with os.File, it fails on a file opened with os.O_APPEND.
 func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
-	if f.file == nil {
+	smbFile := f.file
+	if smbFile == nil {
 		return 0, fs.ErrClosed
 	}
+	if off < 0 || f.flag&os.O_APPEND != 0 {
+		return 0, wrapPathError("writeat", f.path, fs.ErrInvalid)
+	}
+	f.conn.beginOp()
+	defer f.conn.endOp()
 
-	// Save current position
-	currentPos := f.offset
-
-	// Seek to the offset
-	_, err = f.file.Seek(off, io.SeekStart)
+	wa, ok := smbFile.(io.WriterAt)
+	if !ok {
+		wa = seekWriterAt{f}
+	}
+	n, err = wa.WriteAt(b, off)
+	if n < 0 {
+		n = 0
+	}
 	if err != nil {
-		return 0, wrapPathError("writeat", f.path, err)
+		return n, wrapPathError("writeat", f.path, f.requestError(nil, err))
 	}
+	return n, nil
+}
 
-	// Write the data
-	n, err = f.file.Write(b)
+// seekReaderAt reads at an offset by seeking a file that has no positioned
+// reads, restoring the file's offset afterwards. Calls are serialized.
+type seekReaderAt struct{ f *File }
 
-	// Restore original position
-	_, seekErr := f.file.Seek(currentPos, io.SeekStart)
-	if seekErr != nil && err == nil {
-		err = wrapPathError("writeat", f.path, seekErr)
-	}
+func (r seekReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	r.f.seekMu.Lock()
+	defer r.f.seekMu.Unlock()
 
-	if err != nil {
-		return n, wrapPathError("writeat", f.path, err)
+	if _, err := r.f.file.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := r.f.file.Read(b)
+	if _, seekErr := r.f.file.Seek(r.f.offset, io.SeekStart); seekErr != nil && err == nil {
+		err = seekErr
 	}
+	return n, err
+}
 
-	return n, nil
+// seekWriterAt is the writing counterpart of seekReaderAt.
+type seekWriterAt struct{ f *File }
+
+func (w seekWriterAt) WriteAt(b []byte, off int64) (int, error) {
+	w.f.seekMu.Lock()
+	defer w.f.seekMu.Unlock()
+
+	if _, err := w.f.file.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := w.f.file.Write(b)
+	if _, seekErr := w.f.file.Seek(w.f.offset, io.SeekStart); seekErr != nil && err == nil {
+		err = seekErr
+	}
+	return n, err
 }
 
 // WriteString writes a string to the file.
@@ -289,7 +661,9 @@ func (f *File) ReadDir(n int) ([]fs.DirEntry, error) {
 
 	// Read all entries on first call
 	if f.dirEntry == nil {
+		f.conn.beginOp()
 		entries, err := f.file.Readdir(-1)
+		f.conn.endOp()
 		if err != nil {
 			return nil, wrapPathError("readdir", f.path, err)
 		}
@@ -311,13 +685,11 @@ func (f *File) ReadDir(n int) ([]fs.DirEntry, error) {
 		f.dirPos = 0
 	}
 
-	// Return n entries or all remaining
+	// Return n entries or all remaining; as with os.File, reading all
+	// entries of an empty directory is not an error
 	if n <= 0 {
 		entries := f.dirEntry[f.dirPos:]
 		f.dirPos = len(f.dirEntry)
-		if len(entries) == 0 {
-			return nil, io.EOF
-		}
 		return entries, nil
 	}
 
@@ -338,8 +710,9 @@ func (f *File) ReadDir(n int) ([]fs.DirEntry, error) {
 
 // fileInfo implements fs.FileInfo for SMB files.
 type fileInfo struct {
-	stat fs.FileInfo
-	name string
+	stat       fs.FileInfo
+	name       string
+	reparseTag uint32
 }
 
 func (fi *fileInfo) Name() string {
@@ -366,15 +739,74 @@ func (fi *fileInfo) Sys() any {
 	return fi.stat.Sys()
 }
 
-// WindowsAttributes returns the Windows file attributes if available.
-// Returns nil if attributes cannot be determined.
+// WindowsAttributes returns the Windows file attributes reported by the
+// server (see RawAttributes).
 func (fi *fileInfo) WindowsAttributes() *WindowsAttributes {
-	// Try to extract Windows attributes from the underlying stat
-	// The go-smb2 library may provide attributes through Sys()
-	// This is a placeholder for actual extraction
-	// In practice, we would need to check the concrete type
-	_ = fi.stat.Sys()
-	return nil
+	return NewWindowsAttributes(fi.RawAttributes())
+}
+
+// smbStat returns the protocol-level stat behind fi, if there is one.
+func (fi *fileInfo) smbStat() *smb2.FileStat {
+	st, _ := fi.stat.Sys().(*smb2.FileStat)
+	return st
+}
+
+// RawAttributes returns the FileAttributes reported by the server.
+// Without protocol-level information it is derived from the file mode.
+func (fi *fileInfo) RawAttributes() uint32 {
+	if st := fi.smbStat(); st != nil {
+		return st.FileAttributes
+	}
+	return modeToAttributes(fi.stat.Mode())
+}
+
+// ReparseTag returns the reparse point tag, or 0 if unknown.
+func (fi *fileInfo) ReparseTag() uint32 {
+	return fi.reparseTag
+}
+
+// AllocationSize returns the allocation size reported by the server.
+// Without protocol-level information it is the file size.
+func (fi *fileInfo) AllocationSize() int64 {
+	if st := fi.smbStat(); st != nil {
+		return st.AllocationSize
+	}
+	return fi.stat.Size()
+}
+
+// CreationTime returns the creation time reported by the server.
+// Without protocol-level information it is the modification time.
+func (fi *fileInfo) CreationTime() time.Time {
+	if st := fi.smbStat(); st != nil {
+		return st.CreationTime
+	}
+	return fi.stat.ModTime()
+}
+
+// LastAccessTime returns the last access time reported by the server.
+// Without protocol-level information it is the modification time.
+func (fi *fileInfo) LastAccessTime() time.Time {
+	if st := fi.smbStat(); st != nil {
+		return st.LastAccessTime
+	}
+	return fi.stat.ModTime()
+}
+
+// LastWriteTime returns the last write time reported by the server.
+func (fi *fileInfo) LastWriteTime() time.Time {
+	if st := fi.smbStat(); st != nil {
+		return st.LastWriteTime
+	}
+	return fi.stat.ModTime()
+}
+
+// ChangeTime returns the change time reported by the server.
+// Without protocol-level information it is the modification time.
+func (fi *fileInfo) ChangeTime() time.Time {
+	if st := fi.smbStat(); st != nil {
+		return st.ChangeTime
+	}
+	return fi.stat.ModTime()
 }
 
 // dirEntry implements fs.DirEntry.
@@ -0,0 +1,80 @@
+package smbfs
+
+import (
+	"io/fs"
+)
+
+// NTFS compression formats (MS-FSCC 2.4.9)
+const (
+	COMPRESSION_FORMAT_NONE    uint16 = 0x0000
+	COMPRESSION_FORMAT_DEFAULT uint16 = 0x0001
+	COMPRESSION_FORMAT_LZNT1   uint16 = 0x0002
+)
+
+// Compressor is implemented by files the backend can store compressed.
+// When an open file implements it, FileCompressionInformation reports and
+// sets its compression format; other files are reported uncompressed and
+// only accept being set to COMPRESSION_FORMAT_NONE
+type Compressor interface {
+	CompressionFormat() (uint16, error)
+	SetCompressionFormat(format uint16) error
+}
+
+// Unit sizes reported in FileCompressionInformation, as log2 of bytes: the
+// 64KB compression units and 4KB chunks and clusters of NTFS
+const (
+	compressionUnitShift    = 16
+	compressionChunkShift   = 12
+	compressionClusterShift = 12
+)
+
+// buildFileCompressionInformation creates FileCompressionInformation
+// response
+func (h *SMBHandler) buildFileCompressionInformation(of *OpenFile, info fs.FileInfo) ([]byte, NTStatus) {
+	format := COMPRESSION_FORMAT_NONE
+	if c, ok := of.File.(Compressor); ok {
+		f, err := c.CompressionFormat()
+		if err != nil {
+			return nil, mapGoErrorToNTStatus(err)
+		}
+		format = f
+	}
+
+	w := NewByteWriter(16)
+	w.WriteUint64(uint64(info.Size()))      // CompressedFileSize
+	w.WriteUint16(format)                   // CompressionFormat
+	w.WriteOneByte(compressionUnitShift)    // CompressionUnitShift
+	w.WriteOneByte(compressionChunkShift)   // ChunkShift
+	w.WriteOneByte(compressionClusterShift) // ClusterShift
+	w.WriteBytes(make([]byte, 3))           // Reserved
+	return w.Bytes(), STATUS_SUCCESS
+}
+
+// setFileCompressionInformation handles FileCompressionInformation set
+// Without a Compressor backend, leaving a file uncompressed is all there is
+// to do
+func (h *SMBHandler) setFileCompressionInformation(of *OpenFile, buffer []byte) NTStatus {
+	if len(buffer) < 16 {
+		return STATUS_INVALID_PARAMETER
+	}
+
+	r := NewByteReader(buffer)
+	r.Skip(8) // CompressedFileSize
+	format := r.ReadUint16()
+	if format > COMPRESSION_FORMAT_LZNT1 {
+		return STATUS_INVALID_PARAMETER
+	}
+
+	c, ok := of.File.(Compressor)
+	if !ok {
+		if format == COMPRESSION_FORMAT_NONE {
+			return STATUS_SUCCESS
+		}
+		return STATUS_INVALID_DEVICE_REQUEST
+	}
+	if err := c.SetCompressionFormat(format); err != nil {
+		h.server.logger.Debug("SetCompressionFormat failed for %s: %v", of.Path, err)
+		return mapGoErrorToNTStatus(err)
+	}
+	return STATUS_SUCCESS
+}
@@ -2,6 +2,7 @@ package smbfs
 
 import (
 	"crypto/rand"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,6 +24,27 @@ type OpenFile struct {
 	TreeID       uint32           // Tree ID this handle belongs to
 	SessionID    uint64           // Session ID this handle belongs to
 	DeleteOnClose bool            // Delete file when handle is closed
+	Lease        *Lease           // Lease held by this handle, if any
+	OplockLevel  uint8            // Oplock held by this handle (guarded by FileHandleMap.mu)
+	Pipe         *namedPipe       // Named pipe instance for opens on IPC$ (File is nil)
+	Durable      bool             // Survives the loss of its session (durable handle)
+	DurableTimeout time.Duration  // How long a disconnected durable handle is kept
+
+	parentLease *leaseID        // Opener's parent directory lease (not broken by this handle's changes)
+	locks       []byteRangeLock // Byte-range locks held through this open (guarded by FileHandleMap.mu)
+	allocation  uint64          // AllocationSize set through this open (guarded by FileHandleMap.mu)
+	oplockConn  *connState      // Connection oplock breaks are sent on (guarded by FileHandleMap.mu)
+
+	// QUERY_DIRECTORY state of a directory handle. Each handle has its own
+	// lock, so enumerations on different handles never wait on each other
+	dirMu    sync.Mutex
+	dirState *dirEnumState // Guarded by dirMu
+
+	// Durable handle state (guarded by FileHandleMap.mu)
+	durableOwner   string    // domain\user allowed to reconnect the handle
+	createGUID     [16]byte  // DH2Q CreateGuid (zero for v1 durable handles)
+	clientGUID     [16]byte  // ClientGuid of the connection that opened a v2 durable handle
+	disconnectedAt time.Time // When the handle lost its session (zero while connected)
 }
 
 // FileHandleMap manages SMB FileID to OpenFile mappings
@@ -32,6 +54,7 @@ type FileHandleMap struct {
 	handles    map[FileID]*OpenFile
 	byPath     map[string][]*OpenFile // Track handles by path for sharing checks
 	nextHandle uint64
+	lockWait   chan struct{} // Closed when byte-range locks are released
 }
 
 // NewFileHandleMap creates a new file handle map
@@ -47,7 +70,24 @@ func NewFileHandleMap() *FileHandleMap {
 func (m *FileHandleMap) Allocate(file absfs.File, path string, isDir bool, access, shareAccess, disposition, options uint32, treeID uint32, sessionID uint64) *OpenFile {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	return m.allocateLocked(file, path, isDir, access, shareAccess, disposition, options, treeID, sessionID)
+}
 
+// TryAllocate is Allocate for an open that must be compatible with the
+// access and share modes of every other open of the path. It checks and
+// allocates under one lock, so of two racing opens that conflict only the
+// first succeeds; the other gets false and no handle
+func (m *FileHandleMap) TryAllocate(file absfs.File, path string, isDir bool, access, shareAccess, disposition, options uint32, treeID uint32, sessionID uint64) (*OpenFile, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.shareAccessLocked(path, access, shareAccess) {
+		return nil, false
+	}
+	return m.allocateLocked(file, path, isDir, access, shareAccess, disposition, options, treeID, sessionID), true
+}
+
+// allocateLocked creates a handle. m.mu must be held
+func (m *FileHandleMap) allocateLocked(file absfs.File, path string, isDir bool, access, shareAccess, disposition, options uint32, treeID uint32, sessionID uint64) *OpenFile {
 	// Generate a random persistent ID and use sequential volatile ID
 	var persistentID uint64
 	var randomBytes [8]byte
@@ -116,6 +156,44 @@ func (m *FileHandleMap) GetByTree(id FileID, treeID uint32, sessionID uint64) *O
 	return of
 }
 
+// getByVolatile retrieves an open file of a tree by the volatile part of its
+// FileID, which is how FileRenameInformation names its RootDirectory
+func (m *FileHandleMap) getByVolatile(volatile uint64, treeID uint32, sessionID uint64) *OpenFile {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for id, of := range m.handles {
+		if id.Volatile == volatile && of.TreeID == treeID && of.SessionID == sessionID {
+			return of
+		}
+	}
+	return nil
+}
+
+// renamePath moves the handles open at oldPath, and below it if it is a
+// directory, to the matching paths under newPath
+func (m *FileHandleMap) renamePath(oldPath, newPath string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for p, handles := range m.byPath {
+		var moved string
+		switch {
+		case p == oldPath:
+			moved = newPath
+		case strings.HasPrefix(p, strings.TrimSuffix(oldPath, "/")+"/"):
+			moved = newPath + p[len(strings.TrimSuffix(oldPath, "/")):]
+		default:
+			continue
+		}
+		for _, of := range handles {
+			of.Path = moved
+		}
+		delete(m.byPath, p)
+		m.byPath[moved] = append(m.byPath[moved], handles...)
+	}
+}
+
 // Release closes and removes a file handle
 func (m *FileHandleMap) Release(id FileID) error {
 	m.mu.Lock()
@@ -127,6 +205,12 @@ func (m *FileHandleMap) Release(id FileID) error {
 
 	delete(m.handles, id)
 
+	// Closing a handle drops its byte-range locks
+	if len(of.locks) > 0 {
+		of.locks = nil
+		m.notifyLockWaitersLocked()
+	}
+
 	// Remove from byPath tracking
 	handles := m.byPath[of.Path]
 	for i, h := range handles {
@@ -195,6 +279,18 @@ func (m *FileHandleMap) Count() int {
 	return len(m.handles)
 }
 
+// all returns every open handle
+func (m *FileHandleMap) all() []*OpenFile {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := make([]*OpenFile, 0, len(m.handles))
+	for _, of := range m.handles {
+		result = append(result, of)
+	}
+	return result
+}
+
 // GetOpenHandlesForPath returns all open handles for a given path
 func (m *FileHandleMap) GetOpenHandlesForPath(path string) []*OpenFile {
 	m.mu.RLock()
@@ -206,15 +302,39 @@ func (m *FileHandleMap) GetOpenHandlesForPath(path string) []*OpenFile {
 	return result
 }
 
+// SetAllocation records the AllocationSize set through an open. The space
+// stays reserved until the open is closed
+func (m *FileHandleMap) SetAllocation(of *OpenFile, size uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	of.allocation = size
+}
+
+// reservedAllocation returns the largest AllocationSize set through any
+// open of a path
+func (m *FileHandleMap) reservedAllocation(path string) uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var size uint64
+	for _, of := range m.byPath[path] {
+		size = max(size, of.allocation)
+	}
+	return size
+}
+
 // CheckShareAccess verifies if a new open with the given access and share mode
 // is compatible with existing opens on the same path
 func (m *FileHandleMap) CheckShareAccess(path string, desiredAccess, shareAccess uint32) bool {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
+	return m.shareAccessLocked(path, desiredAccess, shareAccess)
+}
 
-	existing := m.byPath[path]
-	for _, of := range existing {
-		// Check if the new open's share mode allows existing access
+// shareAccessLocked checks a new open against each open of the path, so
+// any one of them can refuse it. m.mu must be held
+func (m *FileHandleMap) shareAccessLocked(path string, desiredAccess, shareAccess uint32) bool {
+	for _, of := range m.byPath[path] {
 		if !checkShareCompatibility(desiredAccess, shareAccess, of.Access, of.ShareAccess) {
 			return false
 		}
@@ -222,30 +342,35 @@ func (m *FileHandleMap) CheckShareAccess(path string, desiredAccess, shareAccess
 	return true
 }
 
-// checkShareCompatibility checks if two opens are compatible
+// Access rights that share modes govern (MS-FSA 2.1.5.1.2.1): executing
+// counts as reading and appending as writing
+const (
+	shareReadAccess   = FILE_READ_DATA | FILE_EXECUTE
+	shareWriteAccess  = FILE_WRITE_DATA | FILE_APPEND_DATA
+	shareDeleteAccess = DELETE
+)
+
+// checkShareCompatibility checks if two opens are compatible: each must
+// share the access the other asks for. An open for none of that access,
+// such as one for attributes only, is compatible with anything
 func checkShareCompatibility(newAccess, newShare, existingAccess, existingShare uint32) bool {
-	// Check if new access is allowed by existing share mode
-	if newAccess&FILE_READ_DATA != 0 && existingShare&FILE_SHARE_READ == 0 {
-		return false
-	}
-	if newAccess&FILE_WRITE_DATA != 0 && existingShare&FILE_SHARE_WRITE == 0 {
-		return false
-	}
-	if newAccess&DELETE != 0 && existingShare&FILE_SHARE_DELETE == 0 {
-		return false
+	const governed = shareReadAccess | shareWriteAccess | shareDeleteAccess
+	if newAccess&governed == 0 || existingAccess&governed == 0 {
+		return true
 	}
+	return sharesAccess(existingShare, newAccess) && sharesAccess(newShare, existingAccess)
+}
 
-	// Check if existing access is allowed by new share mode
-	if existingAccess&FILE_READ_DATA != 0 && newShare&FILE_SHARE_READ == 0 {
+// sharesAccess reports whether a share mode admits an open with access
+func sharesAccess(share, access uint32) bool {
+	switch {
+	case access&shareReadAccess != 0 && share&FILE_SHARE_READ == 0:
 		return false
-	}
-	if existingAccess&FILE_WRITE_DATA != 0 && newShare&FILE_SHARE_WRITE == 0 {
+	case access&shareWriteAccess != 0 && share&FILE_SHARE_WRITE == 0:
 		return false
-	}
-	if existingAccess&DELETE != 0 && newShare&FILE_SHARE_DELETE == 0 {
+	case access&shareDeleteAccess != 0 && share&FILE_SHARE_DELETE == 0:
 		return false
 	}
-
 	return true
 }
 
@@ -0,0 +1,183 @@
+package smbfs
+
+import (
+	"path"
+	"slices"
+	"strings"
+)
+
+// File IDs: the 64-bit FileId reported by the FileId* directory classes and
+// as IndexNumber by QUERY_INFO, which clients pass back in a CREATE with
+// FILE_OPEN_BY_FILE_ID. absfs has no inode numbers, so the share numbers
+// paths in the order it first reports them and keeps the numbers across
+// renames, like the creation times in creation_time.go. The numbers are
+// kept in a tree of path components, so a rename or delete only touches
+// the paths beneath it
+
+// maxFileIDs bounds the paths a share remembers file IDs for; it starts
+// over when full, and paths seen again are given new IDs
+const maxFileIDs = 65536
+
+// fileIDNode is a path component in a share's file ID tree. Components
+// that were never numbered themselves, such as the parents of a numbered
+// path, have a zero id
+type fileIDNode struct {
+	name     string
+	parent   *fileIDNode
+	id       uint64
+	children map[string]*fileIDNode
+}
+
+// path returns the cleaned share path of n
+func (n *fileIDNode) path() string {
+	var elems []string
+	for ; n.parent != nil; n = n.parent {
+		elems = append(elems, n.name)
+	}
+	slices.Reverse(elems)
+	return "/" + strings.Join(elems, "/")
+}
+
+// fileIDNode returns the node of the cleaned path key, adding it and its
+// parents if create is set, or nil. The caller holds idMu
+func (s *Share) fileIDNode(key string, create bool) *fileIDNode {
+	if s.idRoot == nil {
+		if !create {
+			return nil
+		}
+		s.idRoot = &fileIDNode{}
+		s.idNodes = make(map[uint64]*fileIDNode)
+	}
+	n := s.idRoot
+	if key == "/" {
+		return n
+	}
+	for _, elem := range strings.Split(key[1:], "/") {
+		child, ok := n.children[elem]
+		if !ok {
+			if !create {
+				return nil
+			}
+			if n.children == nil {
+				n.children = make(map[string]*fileIDNode)
+			}
+			child = &fileIDNode{name: elem, parent: n}
+			n.children[elem] = child
+		}
+		n = child
+	}
+	return n
+}
+
+// detachFileIDNode removes n from its parent, along with parents left
+// with neither an ID nor children. The caller holds idMu
+func (s *Share) detachFileIDNode(n *fileIDNode) {
+	for n.parent != nil {
+		parent := n.parent
+		delete(parent.children, n.name)
+		n.parent = nil
+		if parent.id != 0 || len(parent.children) > 0 {
+			return
+		}
+		n = parent
+	}
+}
+
+// fileID returns the file ID of name, numbering it if it has none yet
+func (s *Share) fileID(name string) uint64 {
+	key := path.Clean("/" + name)
+
+	s.idMu.Lock()
+	defer s.idMu.Unlock()
+
+	if n := s.fileIDNode(key, false); n != nil && n.id != 0 {
+		return n.id
+	}
+	if len(s.idNodes) >= maxFileIDs {
+		s.idRoot, s.idNodes = nil, nil
+	}
+	n := s.fileIDNode(key, true)
+	s.lastFileID++
+	n.id = s.lastFileID
+	s.idNodes[n.id] = n
+	return n.id
+}
+
+// pathByFileID returns the path numbered id, or false for an id the share
+// never reported, no longer remembers or whose file was deleted
+func (s *Share) pathByFileID(id uint64) (string, bool) {
+	s.idMu.Lock()
+	defer s.idMu.Unlock()
+
+	n, ok := s.idNodes[id]
+	if !ok {
+		return "", false
+	}
+	return n.path(), true
+}
+
+// forgetFileIDs drops the IDs of a deleted path and anything beneath it
+func (s *Share) forgetFileIDs(name string) {
+	s.idMu.Lock()
+	defer s.idMu.Unlock()
+
+	s.forgetFileIDNode(path.Clean("/" + name))
+}
+
+// forgetFileIDNode drops the IDs of the cleaned path key and anything
+// beneath it. The caller holds idMu
+func (s *Share) forgetFileIDNode(key string) {
+	n := s.fileIDNode(key, false)
+	if n == nil {
+		return
+	}
+	if n.parent == nil {
+		s.idRoot, s.idNodes = nil, nil
+		return
+	}
+	s.detachFileIDNode(n)
+
+	pending := []*fileIDNode{n}
+	for len(pending) > 0 {
+		n, pending = pending[len(pending)-1], pending[:len(pending)-1]
+		delete(s.idNodes, n.id)
+		for _, child := range n.children {
+			pending = append(pending, child)
+		}
+	}
+}
+
+// renameFileIDs moves IDs along with a rename, so a file keeps its ID
+func (s *Share) renameFileIDs(oldName, newName string) {
+	oldKey := path.Clean("/" + oldName)
+	newKey := path.Clean("/" + newName)
+	if oldKey == newKey {
+		return
+	}
+
+	s.idMu.Lock()
+	defer s.idMu.Unlock()
+
+	// Replaced target
+	s.forgetFileIDNode(newKey)
+
+	n := s.fileIDNode(oldKey, false)
+	if n == nil || n.parent == nil {
+		return
+	}
+	s.detachFileIDNode(n)
+	parent := s.fileIDNode(path.Dir(newKey), true)
+	if parent.children == nil {
+		parent.children = make(map[string]*fileIDNode)
+	}
+	n.name, n.parent = path.Base(newKey), parent
+	parent.children[n.name] = n
+}
+
+// resetFileIDs drops every ID, when the share's filesystem is replaced
+func (s *Share) resetFileIDs() {
+	s.idMu.Lock()
+	s.idRoot = nil
+	s.idNodes = nil
+	s.idMu.Unlock()
+}
@@ -2,9 +2,12 @@ package smbfs
 
 import (
 	"context"
+	"errors"
 	"io"
 	"io/fs"
 	"os"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/absfs/smbfs/absfs"
@@ -16,6 +19,8 @@ type FileSystem struct {
 	pool     *connectionPool
 	pathNorm *pathNormalizer
 	cache    *metadataCache
+	handles  *handleCache // Open files kept for reuse (nil if disabled)
+	statfs   statfsCache  // Sizes last returned by Statfs
 	ctx      context.Context
 	cancel   context.CancelFunc
 }
@@ -35,21 +40,30 @@ func New(config *Config) (*FileSystem, error) {
 		return nil, err
 	}
 
+	return newFileSystem(config, newConnectionPool(config)), nil
+}
+
+// newFileSystem returns a filesystem for a validated config that connects
+// through pool, starting its background cleanup.
+func newFileSystem(config *Config, pool *connectionPool) *FileSystem {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	fs := &FileSystem{
 		config:   config,
-		pool:     newConnectionPool(config),
+		pool:     pool,
 		pathNorm: newPathNormalizer(config.CaseSensitive),
 		cache:    newMetadataCache(config.Cache),
+		handles:  newHandleCache(config),
 		ctx:      ctx,
 		cancel:   cancel,
 	}
 
 	// Start background cleanup
 	fs.pool.startCleanup(ctx)
+	fs.pool.startWarmup(ctx)
+	fs.handles.startCleanup(ctx)
 
-	return fs, nil
+	return fs
 }
 
 // Open opens a file for reading.
@@ -59,6 +73,26 @@ func (fsys *FileSystem) Open(name string) (absfs.File, error) {
 
 // OpenFile opens a file with the specified flags and mode.
 func (fsys *FileSystem) OpenFile(name string, flag int, perm fs.FileMode) (absfs.File, error) {
+	return fsys.OpenFileContext(fsys.ctx, name, flag, perm)
+}
+
+// OpenFileContext opens a file whose requests are bound to ctx.
+// Cancelling ctx aborts the open and any in-flight read or write on the
+// file, which then fail with ctx.Err(); Close still releases the handle
+// after ctx is done. Single reads and writes can be bound to a shorter
+// context with File.ReadContext and File.WriteContext.
+func (fsys *FileSystem) OpenFileContext(ctx context.Context, name string, flag int, perm fs.FileMode) (absfs.File, error) {
+	f, err := fsys.openFile(ctx, name, flag, perm, false)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// openFile opens a file as OpenFileContext does. With shareDelete set,
+// others may delete or rename the file while it is open, if the share
+// supports it.
+func (fsys *FileSystem) openFile(ctx context.Context, name string, flag int, perm fs.FileMode, shareDelete bool) (*File, error) {
 	// Validate and normalize path
 	if err := validatePath(name); err != nil {
 		return nil, wrapPathError("open", name, err)
@@ -67,14 +101,29 @@ func (fsys *FileSystem) OpenFile(name string, flag int, perm fs.FileMode) (absfs
 	name = fsys.pathNorm.normalize(name)
 	smbPath := toSMBPath(name)
 
+	// A cached handle would keep the file open under the change
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		fsys.handles.evict(name)
+	}
+
 	var resultFile *File
-	err := fsys.withRetry(fsys.ctx, func() error {
+	err := fsys.withRetry(ctx, func() error {
 		// Get a connection from the pool
-		conn, err := fsys.pool.get(fsys.ctx)
+		conn, err := fsys.pool.get(ctx)
 		if err != nil {
 			return err
 		}
 
+		// Bind the file's requests to ctx if the share supports it
+		share := conn.share
+		var fileCtx context.Context
+		if cs, ok := share.(interface {
+			WithContext(ctx context.Context) SMBShare
+		}); ok {
+			fileCtx = ctx
+			share = cs.WithContext(ctx)
+		}
+
 		// Convert flags to os flags for go-smb2
 		openFlag := flag
 		if flag&os.O_CREATE != 0 {
@@ -82,28 +131,43 @@ func (fsys *FileSystem) OpenFile(name string, flag int, perm fs.FileMode) (absfs
 		}
 
 		// Open the file
-		file, err := conn.share.OpenFile(smbPath, openFlag, perm)
+		var file SMBFile
+		if shareDelete {
+			file, err = openFileShareDelete(share, smbPath, openFlag, perm)
+		} else {
+			file, err = share.OpenFile(smbPath, openFlag, perm)
+		}
 		if err != nil {
 			fsys.pool.put(conn)
 			return convertError(err)
 		}
 
+		// The file keeps the connection and times each request itself
+		conn.endOp()
+
 		resultFile = &File{
 			fs:   fsys,
 			conn: conn,
 			file: file,
 			path: name,
+			flag: flag,
+			ctx:  fileCtx,
+
+			readOnly: flag&(os.O_WRONLY|os.O_RDWR) == 0,
 		}
 		return nil
 	})
 
 	if err != nil {
-		return nil, wrapPathError("open", name, err)
+		return nil, wrapPathError("open", name, contextError(ctx, err))
 	}
 
-	// Invalidate cache if file was created
+	// Invalidate cache if file was created; any successful open shows the
+	// file exists
 	if flag&os.O_CREATE != 0 {
 		fsys.cache.invalidate(name)
+	} else {
+		fsys.cache.forgetNotFound(name)
 	}
 
 	return resultFile, nil
@@ -116,6 +180,12 @@ func (fsys *FileSystem) Create(name string) (absfs.File, error) {
 
 // Stat returns file information.
 func (fsys *FileSystem) Stat(name string) (fs.FileInfo, error) {
+	return fsys.StatContext(fsys.ctx, name)
+}
+
+// StatContext returns file information, aborting the request to the
+// server if ctx is done. Cached information is returned without a request.
+func (fsys *FileSystem) StatContext(ctx context.Context, name string) (fs.FileInfo, error) {
 	if err := validatePath(name); err != nil {
 		return nil, wrapPathError("stat", name, err)
 	}
@@ -123,21 +193,41 @@ func (fsys *FileSystem) Stat(name string) (fs.FileInfo, error) {
 	name = fsys.pathNorm.normalize(name)
 
 	// Check cache first
+	if fsys.cache.isNotFound(name) {
+		return nil, wrapPathError("stat", name, fs.ErrNotExist)
+	}
 	if cachedInfo, ok := fsys.cache.getStatInfo(name); ok {
 		return cachedInfo, nil
 	}
+	if info, ok := fsys.statCachedHandle(name); ok {
+		return info, nil
+	}
 
+	// Serve a stale entry immediately and refresh it in the background
+	if staleInfo, ok := fsys.cache.getStaleStatInfo(name); ok {
+		fsys.cache.refreshAsync("stat:"+name, func() {
+			fsys.statRemote(fsys.ctx, name)
+		})
+		return staleInfo, nil
+	}
+
+	return fsys.statRemote(ctx, name)
+}
+
+// statRemote stats name on the server under ctx and caches the result.
+// name must already be normalized.
+func (fsys *FileSystem) statRemote(ctx context.Context, name string) (fs.FileInfo, error) {
 	smbPath := toSMBPath(name)
 
 	var info *fileInfo
-	err := fsys.withRetry(fsys.ctx, func() error {
-		conn, err := fsys.pool.get(fsys.ctx)
+	err := fsys.withRetry(ctx, func() error {
+		conn, err := fsys.pool.get(ctx)
 		if err != nil {
 			return err
 		}
 		defer fsys.pool.put(conn)
 
-		stat, err := conn.share.Stat(smbPath)
+		stat, err := shareWithContext(conn.share, ctx).Stat(smbPath)
 		if err != nil {
 			return convertError(err)
 		}
@@ -146,11 +236,15 @@ func (fsys *FileSystem) Stat(name string) (fs.FileInfo, error) {
 			stat: stat,
 			name: fsys.pathNorm.base(name),
 		}
+		info.reparseTag = reparseTagOf(conn.share, smbPath, info.RawAttributes())
 		return nil
 	})
 
 	if err != nil {
-		return nil, wrapPathError("stat", name, err)
+		if errors.Is(err, fs.ErrNotExist) {
+			fsys.cache.putNotFound(name)
+		}
+		return nil, wrapPathError("stat", name, contextError(ctx, err))
 	}
 
 	// Cache the result
@@ -159,13 +253,214 @@ func (fsys *FileSystem) Stat(name string) (fs.FileInfo, error) {
 	return info, nil
 }
 
-// Lstat returns file information (same as Stat for SMB).
+// statCachedHandle stats name through its cached handle, if it has one,
+// and caches the result. It reports false if there is no handle, or the
+// file is a reparse point, whose tag only statRemote reads.
+func (fsys *FileSystem) statCachedHandle(name string) (fs.FileInfo, bool) {
+	f, gen := fsys.handles.take(name)
+	if f == nil {
+		return nil, false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, false
+	}
+	fsys.handles.put(f, gen)
+	if info.(*fileInfo).RawAttributes()&FILE_ATTRIBUTE_REPARSE_POINT != 0 {
+		return nil, false
+	}
+	fsys.cache.putStatInfo(name, info)
+	return info, true
+}
+
+// openCached returns the cached handle of name, rewound, or opens name
+// read-only if there is none. The file goes back to the cache with
+// fsys.handles.put(f, gen) once read, or is closed if reading failed.
+func (fsys *FileSystem) openCached(name string) (f *File, gen uint64, err error) {
+	f, gen = fsys.handles.take(name)
+	if f != nil {
+		if _, err := f.Seek(0, io.SeekStart); err == nil {
+			return f, gen, nil
+		}
+		f.Close()
+	}
+	// Others may delete or rename the file while it is cached
+	f, err = fsys.openFile(fsys.ctx, name, os.O_RDONLY, 0, true)
+	if err != nil {
+		return nil, 0, err
+	}
+	return f, gen, nil
+}
+
+// openFileShareDelete opens a file on share with FILE_SHARE_DELETE, or
+// plainly if the share cannot.
+func openFileShareDelete(share SMBShare, name string, flag int, perm fs.FileMode) (SMBFile, error) {
+	if sd, ok := share.(interface {
+		OpenFileShareDelete(name string, flag int, perm fs.FileMode) (SMBFile, error)
+	}); ok {
+		return sd.OpenFileShareDelete(name, flag, perm)
+	}
+	return share.OpenFile(name, flag, perm)
+}
+
+// shareWithContext returns a view of share whose requests use ctx, or
+// share itself if it cannot bind requests to a context.
+func shareWithContext(share SMBShare, ctx context.Context) SMBShare {
+	if cs, ok := share.(interface {
+		WithContext(ctx context.Context) SMBShare
+	}); ok {
+		return cs.WithContext(ctx)
+	}
+	return share
+}
+
+// fileWithContext returns a view of file whose requests use ctx, or file
+// itself if it cannot bind requests to a context.
+func fileWithContext(file SMBFile, ctx context.Context) SMBFile {
+	if cf, ok := file.(interface {
+		WithContext(ctx context.Context) SMBFile
+	}); ok {
+		return cf.WithContext(ctx)
+	}
+	return file
+}
+
+// reparseTagOf determines the reparse tag of a reparse point.
+// Stat responses don't carry the tag, so a symlink is recognized by
+// reading its target; other reparse points report 0.
+func reparseTagOf(share SMBShare, smbPath string, attrs uint32) uint32 {
+	if attrs&FILE_ATTRIBUTE_REPARSE_POINT == 0 {
+		return 0
+	}
+
+	rl, ok := share.(interface {
+		Readlink(name string) (string, error)
+	})
+	if !ok {
+		return 0
+	}
+	if _, err := rl.Readlink(smbPath); err != nil {
+		return 0
+	}
+	return IO_REPARSE_TAG_SYMLINK
+}
+
+// Lstat returns file information without following a final symbolic link.
+// Shares that cannot open a link itself fall back to Stat.
 func (fsys *FileSystem) Lstat(name string) (fs.FileInfo, error) {
-	return fsys.Stat(name)
+	if err := validatePath(name); err != nil {
+		return nil, wrapPathError("lstat", name, err)
+	}
+
+	name = fsys.pathNorm.normalize(name)
+	smbPath := toSMBPath(name)
+
+	conn, err := fsys.pool.get(fsys.ctx)
+	if err != nil {
+		return nil, wrapPathError("lstat", name, err)
+	}
+
+	lstater, ok := conn.share.(interface {
+		Lstat(name string) (fs.FileInfo, error)
+	})
+	if !ok {
+		fsys.pool.put(conn)
+		return fsys.Stat(name)
+	}
+	defer fsys.pool.put(conn)
+
+	stat, err := lstater.Lstat(smbPath)
+	if err != nil {
+		return nil, wrapPathError("lstat", name, convertError(err))
+	}
+
+	info := &fileInfo{
+		stat: stat,
+		name: fsys.pathNorm.base(name),
+	}
+	info.reparseTag = reparseTagOf(conn.share, smbPath, info.RawAttributes())
+	return info, nil
+}
+
+// Readlink returns the target of the named symbolic link. Separators are
+// converted to forward slashes, so a link to the share's \dir\file reads
+// back as /dir/file.
+func (fsys *FileSystem) Readlink(name string) (string, error) {
+	if err := validatePath(name); err != nil {
+		return "", wrapPathError("readlink", name, err)
+	}
+
+	name = fsys.pathNorm.normalize(name)
+	smbPath := toSMBPath(name)
+
+	conn, err := fsys.pool.get(fsys.ctx)
+	if err != nil {
+		return "", wrapPathError("readlink", name, err)
+	}
+	defer fsys.pool.put(conn)
+
+	rl, ok := conn.share.(interface {
+		Readlink(name string) (string, error)
+	})
+	if !ok {
+		return "", wrapPathError("readlink", name, ErrNotImplemented)
+	}
+
+	target, err := rl.Readlink(smbPath)
+	if err != nil {
+		return "", wrapPathError("readlink", name, convertError(err))
+	}
+	return strings.ReplaceAll(target, "\\", "/"), nil
+}
+
+// Symlink creates newname as a symbolic link to oldname. The target is
+// stored as given: an absolute target is resolved from the share root and
+// a relative one from the link's directory. The target need not exist.
+// Servers may refuse absolute targets; the smbfs server accepts only
+// relative ones that stay within the share.
+func (fsys *FileSystem) Symlink(oldname, newname string) error {
+	if oldname == "" {
+		return wrapPathError("symlink", newname, fs.ErrInvalid)
+	}
+	if err := validatePath(newname); err != nil {
+		return wrapPathError("symlink", newname, err)
+	}
+
+	newname = fsys.pathNorm.normalize(newname)
+	smbPath := toSMBPath(newname)
+
+	conn, err := fsys.pool.get(fsys.ctx)
+	if err != nil {
+		return wrapPathError("symlink", newname, err)
+	}
+	defer fsys.pool.put(conn)
+
+	linker, ok := conn.share.(interface {
+		Symlink(target, linkpath string) error
+	})
+	if !ok {
+		return wrapPathError("symlink", newname, ErrNotImplemented)
+	}
+
+	if err := linker.Symlink(strings.ReplaceAll(oldname, "/", "\\"), smbPath); err != nil {
+		return wrapPathError("symlink", newname, convertError(err))
+	}
+
+	fsys.cache.invalidate(newname)
+
+	return nil
 }
 
 // ReadDir reads the directory and returns directory entries.
 func (fsys *FileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fsys.ReadDirContext(fsys.ctx, name)
+}
+
+// ReadDirContext reads the directory and returns directory entries,
+// aborting the listing if ctx is done. A cached listing is returned
+// without a request.
+func (fsys *FileSystem) ReadDirContext(ctx context.Context, name string) ([]fs.DirEntry, error) {
 	if err := validatePath(name); err != nil {
 		return nil, wrapPathError("readdir", name, err)
 	}
@@ -177,35 +472,89 @@ func (fsys *FileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
 		return cachedEntries, nil
 	}
 
-	f, err := fsys.Open(name)
+	// Serve a stale listing immediately and refresh it in the background
+	if staleEntries, ok := fsys.cache.getStaleDirEntries(name); ok {
+		fsys.cache.refreshAsync("dir:"+name, func() {
+			fsys.readDirRemote(fsys.ctx, name)
+		})
+		return staleEntries, nil
+	}
+
+	return fsys.readDirRemote(ctx, name)
+}
+
+// ReadDirInfo reads the directory and returns the file information of its
+// entries, as Readdir does. The information comes with the listing, which
+// is a single request however many entries there are, so no entry is
+// statted; and a Stat of an entry that follows a fresh listing is answered
+// from the cache.
+func (fsys *FileSystem) ReadDirInfo(name string) ([]fs.FileInfo, error) {
+	entries, err := fsys.ReadDir(name)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 
-	// Check if it's a directory
-	info, err := f.Stat()
-	if err != nil {
-		return nil, wrapPathError("readdir", name, err)
+	infos := make([]fs.FileInfo, len(entries))
+	for i, entry := range entries {
+		if infos[i], err = entry.Info(); err != nil {
+			return nil, wrapPathError("readdir", name, err)
+		}
 	}
+	return infos, nil
+}
 
-	if !info.IsDir() {
-		return nil, wrapPathError("readdir", name, ErrNotDirectory)
+// readDirRemote lists name on the server under ctx and caches the result,
+// and the information of each entry as if it had been statted. name must
+// already be normalized.
+func (fsys *FileSystem) readDirRemote(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	f, err := fsys.OpenFileContext(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
 	}
 
-	// Read directory entries
 	file := f.(*File)
-	entries, err := file.ReadDir(-1)
+	entries, err := readDirEntries(file, name)
 	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			// The close queues behind the aborted request; don't wait for it
+			go file.Close()
+			return nil, wrapPathError("readdir", name, ctxErr)
+		}
+		file.Close()
 		return nil, err
 	}
+	file.Close()
 
 	// Cache the result
 	fsys.cache.putDirEntries(name, entries)
+	for _, entry := range entries {
+		de, ok := entry.(*dirEntry)
+		// The listing has no reparse tags, which only a Stat reads
+		if !ok || de.info.RawAttributes()&FILE_ATTRIBUTE_REPARSE_POINT != 0 {
+			continue
+		}
+		fsys.cache.putStatInfo(fsys.pathNorm.normalize(path.Join(name, entry.Name())), de.info)
+	}
 
 	return entries, nil
 }
 
+// readDirEntries reads all entries of the directory open as f.
+func readDirEntries(f *File, name string) ([]fs.DirEntry, error) {
+	// Check if it's a directory
+	info, err := f.Stat()
+	if err != nil {
+		return nil, wrapPathError("readdir", name, err)
+	}
+
+	if !info.IsDir() {
+		return nil, wrapPathError("readdir", name, ErrNotDirectory)
+	}
+
+	// Read directory entries
+	return f.ReadDir(-1)
+}
+
 // Mkdir creates a directory.
 func (fsys *FileSystem) Mkdir(name string, perm fs.FileMode) error {
 	if err := validatePath(name); err != nil {
@@ -268,6 +617,7 @@ func (fsys *FileSystem) Remove(name string) error {
 
 	name = fsys.pathNorm.normalize(name)
 	smbPath := toSMBPath(name)
+	fsys.handles.evict(name)
 
 	conn, err := fsys.pool.get(fsys.ctx)
 	if err != nil {
@@ -340,6 +690,8 @@ func (fsys *FileSystem) Rename(oldname, newname string) error {
 
 	oldSMBPath := toSMBPath(oldname)
 	newSMBPath := toSMBPath(newname)
+	fsys.handles.evict(oldname)
+	fsys.handles.evict(newname)
 
 	conn, err := fsys.pool.get(fsys.ctx)
 	if err != nil {
@@ -385,6 +737,39 @@ func (fsys *FileSystem) Chmod(name string, mode fs.FileMode) error {
 	return nil
 }
 
+// Chattr sets the Windows attributes of the named file or directory.
+// See File.SetAttributes.
+func (fsys *FileSystem) Chattr(name string, attrs *WindowsAttributes) error {
+	if err := validatePath(name); err != nil {
+		return wrapPathError("chattr", name, err)
+	}
+
+	name = fsys.pathNorm.normalize(name)
+	smbPath := toSMBPath(name)
+
+	conn, err := fsys.pool.get(fsys.ctx)
+	if err != nil {
+		return wrapPathError("chattr", name, err)
+	}
+	defer fsys.pool.put(conn)
+
+	setter, ok := conn.share.(interface {
+		SetAttributes(name string, attrs uint32) error
+	})
+	if !ok {
+		return wrapPathError("chattr", name, ErrNotImplemented)
+	}
+
+	if err := setter.SetAttributes(smbPath, attrs.Attributes()); err != nil {
+		return wrapPathError("chattr", name, convertError(err))
+	}
+
+	// Invalidate stat cache since metadata changed
+	fsys.cache.invalidate(name)
+
+	return nil
+}
+
 // Chown changes the owner of a file.
 func (fsys *FileSystem) Chown(name string, uid, gid int) error {
 	// SMB doesn't directly support Unix ownership
@@ -439,25 +824,24 @@ func (fsys *FileSystem) Truncate(name string, size int64) error {
 	}
 	defer f.Close()
 
-	// Use the file's Truncate method
-	file := f.(*File)
-	err = file.Truncate(size)
-	if err != nil {
-		return wrapPathError("truncate", name, err)
-	}
-
-	// Invalidate cache since file size changed
-	fsys.cache.invalidate(name)
-
-	return nil
+	return f.(*File).Truncate(size)
 }
 
 // Close closes the filesystem and releases all resources.
 func (fsys *FileSystem) Close() error {
+	fsys.handles.Close()
 	fsys.cancel()
 	return fsys.pool.Close()
 }
 
+// WarmupError returns the error of the last attempt to open one of the
+// idle connections kept ready for Config.MinIdle, or nil if it succeeded
+// or none has been made. An authentication failure shows up here before
+// any operation is tried.
+func (fsys *FileSystem) WarmupError() error {
+	return fsys.pool.warmupError()
+}
+
 // convertFlags converts os.O_* flags to SMB access mode and create disposition.
 func convertFlags(flag int) (accessMode uint32, createDisposition uint32) {
 	// Access mode
@@ -523,19 +907,20 @@ func (fsys *FileSystem) ReadFile(name string) ([]byte, error) {
 
 	name = fsys.pathNorm.normalize(name)
 
-	f, err := fsys.Open(name)
+	f, gen, err := fsys.openCached(name)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 
 	// Get file size for efficient buffer allocation
 	info, err := f.Stat()
 	if err != nil {
+		f.Close()
 		return nil, wrapPathError("readfile", name, err)
 	}
 
 	if info.IsDir() {
+		f.Close()
 		return nil, wrapPathError("readfile", name, ErrNotDirectory)
 	}
 
@@ -544,14 +929,55 @@ func (fsys *FileSystem) ReadFile(name string) ([]byte, error) {
 	buf := make([]byte, size)
 
 	// Read entire file
-	n, err := io.ReadFull(f.(*File), buf)
+	n, err := io.ReadFull(f, buf)
 	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		f.Close()
 		return nil, wrapPathError("readfile", name, err)
 	}
 
+	fsys.handles.put(f, gen)
 	return buf[:n], nil
 }
 
+// ReadAt reads len(p) bytes from the named file starting at offset off,
+// with the same semantics as (*File).ReadAt. Each call opens its own
+// handle, so goroutines may read distinct ranges of a file concurrently.
+func (fsys *FileSystem) ReadAt(name string, p []byte, off int64) (int, error) {
+	if err := validatePath(name); err != nil {
+		return 0, wrapPathError("read", name, err)
+	}
+	f, gen, err := fsys.openCached(fsys.pathNorm.normalize(name))
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := f.ReadAt(p, off)
+	if err != nil && err != io.EOF {
+		f.Close()
+		return n, err
+	}
+	fsys.handles.put(f, gen)
+	return n, err
+}
+
+// WriteAt writes p to the named file starting at offset off, creating the
+// file if it does not exist. Each call opens its own handle, so goroutines
+// may write distinct ranges of a file concurrently, for example to upload
+// a large file in parallel chunks.
+func (fsys *FileSystem) WriteAt(name string, p []byte, off int64) (int, error) {
+	f, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := f.(*File).WriteAt(p, off)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	fsys.cache.invalidate(fsys.pathNorm.normalize(name))
+	return n, err
+}
+
 // Sub returns an fs.FS corresponding to the subtree rooted at dir.
 func (fsys *FileSystem) Sub(dir string) (fs.FS, error) {
 	if err := validatePath(dir); err != nil {
@@ -577,21 +1003,7 @@ func NewWithFactory(config *Config, factory ConnectionFactory) (*FileSystem, err
 		return nil, err
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-
-	fs := &FileSystem{
-		config:   config,
-		pool:     newConnectionPoolWithFactory(config, factory),
-		pathNorm: newPathNormalizer(config.CaseSensitive),
-		cache:    newMetadataCache(config.Cache),
-		ctx:      ctx,
-		cancel:   cancel,
-	}
-
-	// Start background cleanup
-	fs.pool.startCleanup(ctx)
-
-	return fs, nil
+	return newFileSystem(config, newConnectionPoolWithFactory(config, factory)), nil
 }
 
 // subFS represents a sub-filesystem rooted at a specific directory.
@@ -1,9 +1,14 @@
 package smbfs
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"io/fs"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -304,3 +309,299 @@ func TestFileSystem_NotImplemented(t *testing.T) {
 		}
 	})
 }
+
+// TestFileSystem_ContextCancel tests that cancelling the context of a
+// single operation aborts the request the server has not answered and
+// returns context.Canceled
+func TestFileSystem_ContextCancel(t *testing.T) {
+	const stall = 2 * time.Second
+
+	// openFile opens /hello.txt with the filesystem's context
+	openFile := func(t *testing.T, fsys *FileSystem) *File {
+		t.Helper()
+		f, err := fsys.OpenFile("/hello.txt", os.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("OpenFile() error = %v", err)
+		}
+		t.Cleanup(func() { f.Close() })
+		return f.(*File)
+	}
+
+	tests := []struct {
+		name    string
+		command uint16
+		op      func(t *testing.T, ctx context.Context, fsys *FileSystem) error
+	}{
+		{"OpenFileContext", SMB2_CREATE, func(t *testing.T, ctx context.Context, fsys *FileSystem) error {
+			_, err := fsys.OpenFileContext(ctx, "/hello.txt", os.O_RDONLY, 0)
+			return err
+		}},
+		{"StatContext", SMB2_CREATE, func(t *testing.T, ctx context.Context, fsys *FileSystem) error {
+			_, err := fsys.StatContext(ctx, "/hello.txt")
+			return err
+		}},
+		{"ReadDirContext", SMB2_QUERY_DIRECTORY, func(t *testing.T, ctx context.Context, fsys *FileSystem) error {
+			_, err := fsys.ReadDirContext(ctx, "/")
+			return err
+		}},
+		{"ReadContext", SMB2_READ, func(t *testing.T, ctx context.Context, fsys *FileSystem) error {
+			f := openFile(t, fsys)
+			_, err := f.ReadContext(ctx, make([]byte, 5))
+			return err
+		}},
+		{"WriteContext", SMB2_WRITE, func(t *testing.T, ctx context.Context, fsys *FileSystem) error {
+			f := openFile(t, fsys)
+			_, err := f.WriteContext(ctx, []byte("world"))
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, config := startLoopbackServer(t, ServerOptions{
+				EnableChaos: true,
+				Chaos: &ChaosConfig{Faults: map[uint16]ChaosFault{
+					tt.command: {Delay: stall, Count: 1},
+				}},
+			})
+			fsys, err := New(config)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			defer fsys.Close()
+
+			// Let the CREATE of a file opened for the operation through
+			if tt.command != SMB2_CREATE {
+				if _, err := fsys.Stat("/hello.txt"); err != nil {
+					t.Fatalf("Stat() error = %v", err)
+				}
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(100*time.Millisecond, cancel)
+
+			start := time.Now()
+			err = tt.op(t, ctx, fsys)
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("%s error = %v, want context.Canceled", tt.name, err)
+			}
+			if elapsed := time.Since(start); elapsed >= stall {
+				t.Errorf("%s returned after %v, not before the stalled request completed", tt.name, elapsed)
+			}
+		})
+	}
+}
+
+// TestFileSystem_ConcurrentRangedIO tests writing non-overlapping chunks of
+// a file from several goroutines, through FileSystem.WriteAt and through a
+// single File's WriteAt, and reading them back with ReadAt
+func TestFileSystem_ConcurrentRangedIO(t *testing.T) {
+	const chunks, chunkSize = 8, 100 * 1024
+
+	srv, config := startLoopbackServer(t, ServerOptions{})
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	want := make([]byte, chunks*chunkSize)
+	for i := range want {
+		want[i] = byte(i * 7 / chunkSize)
+	}
+
+	// writeChunks writes every chunk from its own goroutine with writeAt
+	writeChunks := func(writeAt func(p []byte, off int64) (int, error)) {
+		t.Helper()
+		var wg sync.WaitGroup
+		errs := make(chan error, chunks)
+		for i := chunks - 1; i >= 0; i-- {
+			wg.Add(1)
+			go func(off int) {
+				defer wg.Done()
+				n, err := writeAt(want[off:off+chunkSize], int64(off))
+				if err == nil && n != chunkSize {
+					err = fmt.Errorf("wrote %d bytes at %d, want %d", n, off, chunkSize)
+				}
+				errs <- err
+			}(i * chunkSize)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatalf("WriteAt() error = %v", err)
+			}
+		}
+	}
+
+	// checkFile reads the file on the server and back through ReadAt
+	checkFile := func(name string) {
+		t.Helper()
+		sf, err := srv.GetShare("data").fs.Open(name)
+		if err != nil {
+			t.Fatalf("server Open(%s) error = %v", name, err)
+		}
+		got, err := io.ReadAll(sf)
+		sf.Close()
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("server file %s has %d bytes (err %v), want the %d bytes written", name, len(got), err, len(want))
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < chunks; i++ {
+			wg.Add(1)
+			go func(off int) {
+				defer wg.Done()
+				buf := make([]byte, chunkSize)
+				if n, err := fsys.ReadAt(name, buf, int64(off)); err != nil || n != chunkSize || !bytes.Equal(buf, want[off:off+chunkSize]) {
+					t.Errorf("ReadAt(%d) = %d, %v, or wrong data", off, n, err)
+				}
+			}(i * chunkSize)
+		}
+		wg.Wait()
+
+		buf := make([]byte, 10)
+		if n, err := fsys.ReadAt(name, buf, int64(len(want)-4)); n != 4 || err != io.EOF {
+			t.Errorf("ReadAt() past the end = %d, %v, want 4, io.EOF", n, err)
+		}
+	}
+
+	writeChunks(func(p []byte, off int64) (int, error) {
+		return fsys.WriteAt("/chunks.bin", p, off)
+	})
+	checkFile("/chunks.bin")
+
+	f, err := fsys.Create("/shared.bin")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	writeChunks(f.(*File).WriteAt)
+	if pos, _ := f.Seek(0, io.SeekCurrent); pos != 0 {
+		t.Errorf("file offset after WriteAt = %d, want 0", pos)
+	}
+	f.Close()
+	checkFile("/shared.bin")
+}
+
+// TestFile_AppendConcurrent tests that two clients appending to one file at
+// once both land all their writes at the end, without overwriting
+func TestFile_AppendConcurrent(t *testing.T) {
+	const records = 200
+
+	_, config := startLoopbackServer(t, ServerOptions{})
+	clients := []string{"a", "b"}
+	files := make([]absfs.File, len(clients))
+	for i := range clients {
+		fsys, err := New(config)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer fsys.Close()
+		f, err := fsys.OpenFile("/log.txt", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			t.Fatalf("OpenFile() error = %v", err)
+		}
+		defer f.Close()
+		files[i] = f
+
+		if _, err := f.(*File).WriteAt([]byte("x"), 0); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("WriteAt() on an append-only file error = %v, want fs.ErrInvalid", err)
+		}
+	}
+
+	// Both files were opened at offset 0 and write at the same time
+	var wg sync.WaitGroup
+	for i, client := range clients {
+		wg.Add(1)
+		go func(f absfs.File) {
+			defer wg.Done()
+			for i := 0; i < records; i++ {
+				if _, err := f.WriteString(fmt.Sprintf("%s%03d\n", client, i)); err != nil {
+					t.Errorf("WriteString() error = %v", err)
+					return
+				}
+			}
+		}(files[i])
+	}
+	wg.Wait()
+
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+	got, err := fsys.ReadFile("/log.txt")
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if len(got) != 2*records*5 {
+		t.Fatalf("file has %d bytes, want %d", len(got), 2*records*5)
+	}
+	seen := make(map[string]bool)
+	for _, line := range bytes.Split(bytes.TrimSuffix(got, []byte("\n")), []byte("\n")) {
+		if len(line) != 4 || seen[string(line)] {
+			t.Fatalf("unexpected or repeated line %q", line)
+		}
+		seen[string(line)] = true
+	}
+}
+
+// TestFileSystem_Truncate tests that truncating a file on the server shrinks
+// it or grows it with zeros, by name and through an open file
+func TestFileSystem_Truncate(t *testing.T) {
+	srv, config := startLoopbackServer(t, ServerOptions{})
+	config.Cache = CacheConfig{EnableCache: true, StatCacheTTL: time.Hour, MaxCacheEntries: 100}
+	writeShareFile(t, srv, "/data.bin", []byte("hello world"))
+
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	check := func(what string, want []byte) {
+		t.Helper()
+		if info, err := fsys.Stat("/data.bin"); err != nil || info.Size() != int64(len(want)) {
+			t.Errorf("Stat() after %s = %v, %v, want size %d", what, info, err, len(want))
+		}
+		if got, err := fsys.ReadFile("/data.bin"); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("contents after %s = %q, %v, want %q", what, got, err, want)
+		}
+	}
+	check("nothing", []byte("hello world"))
+
+	if err := fsys.Truncate("/data.bin", 5); err != nil {
+		t.Fatalf("Truncate() shrinking error = %v", err)
+	}
+	check("shrinking", []byte("hello"))
+
+	if err := fsys.Truncate("/data.bin", 8); err != nil {
+		t.Fatalf("Truncate() growing error = %v", err)
+	}
+	check("growing", []byte("hello\x00\x00\x00"))
+
+	// Through an open file, whose offset stays where it was
+	f, err := fsys.OpenFile("/data.bin", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	defer f.Close()
+	if err := f.Truncate(2); err != nil {
+		t.Fatalf("File.Truncate() error = %v", err)
+	}
+	if _, err := f.Write([]byte("y")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := f.Truncate(3); err != nil {
+		t.Fatalf("File.Truncate() growing error = %v", err)
+	}
+	check("File.Truncate", []byte("ye\x00"))
+
+	if err := f.Truncate(-1); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("File.Truncate(-1) error = %v, want fs.ErrInvalid", err)
+	}
+	if err := fsys.Truncate("/missing.bin", 0); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Truncate() of a missing file error = %v, want fs.ErrNotExist", err)
+	}
+}
@@ -6,12 +6,19 @@ require (
 	github.com/absfs/absfs v0.9.1
 	github.com/absfs/fstesting v0.9.1
 	github.com/absfs/memfs v0.9.1
-	github.com/hirochachacha/go-smb2 v1.1.0
+	github.com/geoffgarside/ber v1.1.0
+	github.com/jcmturner/gofork v1.7.6
+	github.com/jcmturner/gokrb5/v8 v8.4.4
 	golang.org/x/crypto v0.28.0
 )
 
 require (
 	github.com/absfs/fstools v0.9.1 // indirect
 	github.com/absfs/inode v0.9.1 // indirect
-	github.com/geoffgarside/ber v1.1.0 // indirect
+	github.com/hashicorp/go-uuid v1.0.3 // indirect
+	github.com/jcmturner/aescts/v2 v2.0.0 // indirect
+	github.com/jcmturner/dnsutils/v2 v2.0.0 // indirect
+	github.com/jcmturner/goidentity/v6 v6.0.1 // indirect
+	github.com/jcmturner/rpc/v2 v2.0.3 // indirect
+	golang.org/x/net v0.21.0 // indirect
 )
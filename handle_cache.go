@@ -0,0 +1,164 @@
+package smbfs
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// handleCache keeps files that ReadFile and ReadAt opened read-only open
+// after use, so reading the same file again, or statting it, needs no
+// CREATE and CLOSE. A handle serves one caller at a time: take removes it
+// from the cache and put returns it. Handles are closed when they are the
+// least recently used of more than Config.HandleCacheSize, when unused for
+// Config.HandleCacheTTL, and before their path is written, removed or
+// renamed. Each handle, idle or not, keeps its pooled connection. A nil
+// *handleCache caches nothing.
+type handleCache struct {
+	size int
+	ttl  time.Duration
+
+	mu     sync.Mutex
+	idle   map[string]*list.Element // By normalized path
+	lru    *list.List               // Of *cachedHandle, most recently used first
+	gen    uint64                   // Bumped by evict, so handles taken before are not kept
+	closed bool
+}
+
+// cachedHandle is an idle handle in a handleCache.
+type cachedHandle struct {
+	file     *File
+	lastUsed time.Time
+}
+
+// newHandleCache returns the handle cache config asks for, or nil.
+func newHandleCache(config *Config) *handleCache {
+	if config.HandleCacheSize <= 0 {
+		return nil
+	}
+	return &handleCache{
+		size: config.HandleCacheSize,
+		ttl:  config.HandleCacheTTL,
+		idle: make(map[string]*list.Element),
+		lru:  list.New(),
+	}
+}
+
+// take removes the idle handle of name from the cache and returns it, or
+// nil if there is none. The generation it returns is passed back to put.
+func (c *handleCache) take(name string) (*File, uint64) {
+	if c == nil {
+		return nil, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.idle[name]
+	if !ok {
+		return nil, c.gen
+	}
+	c.removeLocked(e)
+	return e.Value.(*cachedHandle).file, c.gen
+}
+
+// put returns f, taken from the cache or opened after take found none, to
+// the cache. f is closed instead if its path changed since take, or if the
+// cache already has a handle for it.
+func (c *handleCache) put(f *File, gen uint64) {
+	if c == nil {
+		f.Close()
+		return
+	}
+	c.mu.Lock()
+	if _, dup := c.idle[f.path]; c.closed || dup || gen != c.gen {
+		c.mu.Unlock()
+		f.Close()
+		return
+	}
+	c.idle[f.path] = c.lru.PushFront(&cachedHandle{file: f, lastUsed: time.Now()})
+	var evicted []*File
+	for c.lru.Len() > c.size {
+		evicted = append(evicted, c.removeLocked(c.lru.Back()))
+	}
+	c.mu.Unlock()
+	closeFiles(evicted)
+}
+
+// evict closes the idle handles of name and of anything under it, and keeps
+// handles in use from being cached again, before name is changed.
+func (c *handleCache) evict(name string) {
+	if c == nil {
+		return
+	}
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	c.mu.Lock()
+	c.gen++
+	var evicted []*File
+	for path, e := range c.idle {
+		if path == name || strings.HasPrefix(path, prefix) {
+			evicted = append(evicted, c.removeLocked(e))
+		}
+	}
+	c.mu.Unlock()
+	closeFiles(evicted)
+}
+
+// expire closes the handles unused for the TTL.
+func (c *handleCache) expire(now time.Time) {
+	c.mu.Lock()
+	var evicted []*File
+	for e := c.lru.Back(); e != nil && now.Sub(e.Value.(*cachedHandle).lastUsed) >= c.ttl; e = c.lru.Back() {
+		evicted = append(evicted, c.removeLocked(e))
+	}
+	c.mu.Unlock()
+	closeFiles(evicted)
+}
+
+// startCleanup expires idle handles until ctx is done.
+func (c *handleCache) startCleanup(ctx context.Context) {
+	if c == nil {
+		return
+	}
+	ticker := time.NewTicker(c.ttl / 2)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				c.expire(now)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Close closes every idle handle, and any returned later.
+func (c *handleCache) Close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.closed = true
+	var evicted []*File
+	for c.lru.Len() > 0 {
+		evicted = append(evicted, c.removeLocked(c.lru.Back()))
+	}
+	c.mu.Unlock()
+	closeFiles(evicted)
+}
+
+// removeLocked removes e from the cache and returns its file. c.mu must be
+// held.
+func (c *handleCache) removeLocked(e *list.Element) *File {
+	h := c.lru.Remove(e).(*cachedHandle)
+	delete(c.idle, h.file.path)
+	return h.file
+}
+
+func closeFiles(files []*File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
@@ -0,0 +1,192 @@
+package smbfs
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupHandleCacheFS(t *testing.T, size int) (*FileSystem, *MockSMBBackend) {
+	t.Helper()
+	backend := NewMockSMBBackend()
+	config := testConfig()
+	config.HandleCacheSize = size
+	fsys, err := NewWithFactory(config, NewMockConnectionFactory(backend))
+	if err != nil {
+		t.Fatalf("NewWithFactory() error = %v", err)
+	}
+	t.Cleanup(func() { fsys.Close() })
+	return fsys, backend
+}
+
+// countOps counts the backend operations of the given kind.
+func countOps(backend *MockSMBBackend, op string) int {
+	n := 0
+	for _, o := range backend.GetOperations() {
+		if o.Op == op {
+			n++
+		}
+	}
+	return n
+}
+
+func TestHandleCache_ReusesHandle(t *testing.T) {
+	fsys, backend := setupHandleCacheFS(t, 4)
+	backend.AddFile("/config.json", []byte(`{"a":1}`), 0644)
+
+	backend.ClearOperations()
+	for i := 0; i < 3; i++ {
+		data, err := fsys.ReadFile("/config.json")
+		if err != nil || string(data) != `{"a":1}` {
+			t.Fatalf("ReadFile() #%d = %q, %v", i+1, data, err)
+		}
+	}
+	buf := make([]byte, 3)
+	if n, err := fsys.ReadAt("/config.json", buf, 2); err != nil || string(buf[:n]) != `a":` {
+		t.Fatalf("ReadAt() = %q, %v", buf[:n], err)
+	}
+	fsys.cache.invalidate("/config.json")
+	if info, err := fsys.Stat("/config.json"); err != nil || info.Size() != 7 {
+		t.Fatalf("Stat() = %v, %v, want size 7", info, err)
+	}
+	if got := countOps(backend, "open"); got != 1 {
+		t.Errorf("backend open calls = %d, want 1", got)
+	}
+	if got := countOps(backend, "close"); got != 0 {
+		t.Errorf("backend close calls = %d, want 0", got)
+	}
+	if got := countOps(backend, "stat"); got != 0 {
+		t.Errorf("backend stat calls = %d, want 0", got)
+	}
+}
+
+func TestHandleCache_EvictsBeforeChanges(t *testing.T) {
+	fsys, backend := setupHandleCacheFS(t, 4)
+	backend.AddFile("/a.txt", []byte("old"), 0644)
+
+	tests := []struct {
+		op     string
+		name   string
+		change func() error
+	}{
+		{"write", "/a.txt", func() error {
+			f, err := fsys.OpenFile("/a.txt", os.O_WRONLY|os.O_TRUNC, 0)
+			if err != nil {
+				return err
+			}
+			f.Write([]byte("new"))
+			return f.Close()
+		}},
+		{"rename", "/a.txt", func() error { return fsys.Rename("/a.txt", "/b.txt") }},
+		{"remove", "/b.txt", func() error { return fsys.Remove("/b.txt") }},
+	}
+	for _, tt := range tests {
+		if _, err := fsys.ReadFile(tt.name); err != nil {
+			t.Fatalf("ReadFile(%s) before %s error = %v", tt.name, tt.op, err)
+		}
+		backend.ClearOperations()
+		if err := tt.change(); err != nil {
+			t.Fatalf("%s error = %v", tt.op, err)
+		}
+		// The cached handle is closed before the change reaches the server
+		ops := backend.GetOperations()
+		if len(ops) == 0 || ops[0].Op != "close" || ops[0].Path != tt.name {
+			t.Errorf("first operation of %s = %v, want close of %s", tt.op, ops, tt.name)
+		}
+	}
+
+	backend.AddFile("/a.txt", []byte("again"), 0644)
+	if data, err := fsys.ReadFile("/a.txt"); err != nil || string(data) != "again" {
+		t.Errorf("ReadFile() after changes = %q, %v, want again", data, err)
+	}
+}
+
+func TestHandleCache_Eviction(t *testing.T) {
+	fsys, backend := setupHandleCacheFS(t, 2)
+	for _, name := range []string{"/1", "/2", "/3"} {
+		backend.AddFile(name, []byte(name), 0644)
+	}
+
+	// The least recently used handle goes when the cache is full
+	backend.ClearOperations()
+	for _, name := range []string{"/1", "/2", "/1", "/3"} {
+		if _, err := fsys.ReadFile(name); err != nil {
+			t.Fatalf("ReadFile(%s) error = %v", name, err)
+		}
+	}
+	var closed []string
+	for _, op := range backend.GetOperations() {
+		if op.Op == "close" {
+			closed = append(closed, op.Path)
+		}
+	}
+	if strings.Join(closed, ",") != "/2" {
+		t.Errorf("closed handles = %v, want [/2]", closed)
+	}
+
+	// Expiry closes handles left unused for the TTL
+	fsys.handles.expire(time.Now().Add(fsys.config.HandleCacheTTL))
+	if got := countOps(backend, "close"); got != 3 {
+		t.Errorf("backend close calls after expiry = %d, want 3", got)
+	}
+
+	// Closing the filesystem closes cached handles
+	fsys.ReadFile("/1")
+	backend.ClearOperations()
+	fsys.Close()
+	if got := countOps(backend, "close"); got != 1 {
+		t.Errorf("backend close calls on Close = %d, want 1", got)
+	}
+}
+
+func TestHandleCache_SizeLimit(t *testing.T) {
+	config := testConfig()
+	config.setDefaults()
+	config.HandleCacheSize = config.MaxOpen
+	if err := config.Validate(); err == nil {
+		t.Error("Validate() with HandleCacheSize = MaxOpen error = nil, want error")
+	}
+	config.HandleCacheSize = config.MaxOpen - 1
+	if err := config.Validate(); err != nil {
+		t.Errorf("Validate() with HandleCacheSize < MaxOpen error = %v", err)
+	}
+}
+
+// TestHandleCache_OthersMayDelete tests that cached handles do not keep
+// other clients from removing or renaming their files.
+func TestHandleCache_OthersMayDelete(t *testing.T) {
+	_, config := startLoopbackServer(t, ServerOptions{})
+	cachedConfig := *config
+	cachedConfig.HandleCacheSize = 2
+
+	reader, err := New(&cachedConfig)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer reader.Close()
+	other, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer other.Close()
+
+	for _, name := range []string{"/a.txt", "/b.txt"} {
+		f, err := other.Create(name)
+		if err != nil {
+			t.Fatalf("Create(%s) error = %v", name, err)
+		}
+		f.Write([]byte("data"))
+		f.Close()
+		if _, err := reader.ReadFile(name); err != nil {
+			t.Fatalf("ReadFile(%s) error = %v", name, err)
+		}
+	}
+
+	if err := other.Remove("/a.txt"); err != nil {
+		t.Errorf("Remove() of a cached file error = %v", err)
+	}
+	if err := other.Rename("/b.txt", "/c.txt"); err != nil {
+		t.Errorf("Rename() of a cached file error = %v", err)
+	}
+}
@@ -0,0 +1,24 @@
+package smb2
+
+// struct based implementation; for encoding requests
+type Encoder interface {
+	Size() int
+	Encode(b []byte)
+}
+
+// bytes based implementation; for decoding responses
+type Decoder interface {
+	IsInvalid() bool
+	// Decode() Encoder
+}
+
+// Bytes is an Encoder of an already encoded buffer
+type Bytes []byte
+
+func (b Bytes) Size() int {
+	return len(b)
+}
+
+func (b Bytes) Encode(p []byte) {
+	copy(p, b)
+}
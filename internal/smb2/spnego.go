@@ -0,0 +1,110 @@
+package smb2
+
+import (
+	"encoding/asn1"
+	"errors"
+
+	"github.com/absfs/smbfs/internal/smb2/internal/spnego"
+)
+
+type spnegoClient struct {
+	mechs        []Initiator
+	mechTypes    []asn1.ObjectIdentifier
+	selectedMech Initiator
+}
+
+func newSpnegoClient(mechs []Initiator) *spnegoClient {
+	mechTypes := make([]asn1.ObjectIdentifier, len(mechs))
+	for i, mech := range mechs {
+		mechTypes[i] = mech.oid()
+	}
+	return &spnegoClient{
+		mechs:     mechs,
+		mechTypes: mechTypes,
+	}
+}
+
+func (c *spnegoClient) oid() asn1.ObjectIdentifier {
+	return spnego.SpnegoOid
+}
+
+func (c *spnegoClient) initSecContext() (negTokenInitBytes []byte, err error) {
+	mechToken, err := c.mechs[0].initSecContext()
+	if err != nil {
+		return nil, err
+	}
+	negTokenInitBytes, err = spnego.EncodeNegTokenInit(c.mechTypes, mechToken)
+	if err != nil {
+		return nil, err
+	}
+	return negTokenInitBytes, nil
+}
+
+func (c *spnegoClient) acceptSecContext(negTokenRespBytes []byte) (negTokenRespBytes1 []byte, err error) {
+	negTokenResp, err := spnego.DecodeNegTokenResp(negTokenRespBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, mechType := range c.mechTypes {
+		if mechType.Equal(negTokenResp.SupportedMech) {
+			c.selectedMech = c.mechs[i]
+			break
+		}
+	}
+
+	responseToken, err := c.selectedMech.acceptSecContext(negTokenResp.ResponseToken)
+	if err != nil {
+		return nil, err
+	}
+
+	ms, err := asn1.Marshal(c.mechTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	mechListMIC := c.selectedMech.sum(ms)
+
+	negTokenRespBytes1, err = spnego.EncodeNegTokenResp(1, nil, responseToken, mechListMIC)
+	if err != nil {
+		return nil, err
+	}
+
+	return negTokenRespBytes1, nil
+}
+
+func (c *spnegoClient) sum(bs []byte) []byte {
+	return c.selectedMech.sum(bs)
+}
+
+func (c *spnegoClient) sessionKey() []byte {
+	return c.selectedMech.sessionKey()
+}
+
+// finishSecContext completes a context the server accepted in its first
+// response, passing the selected mechanism the server's final token.
+func (c *spnegoClient) finishSecContext(negTokenRespBytes []byte) error {
+	negTokenResp, err := spnego.DecodeNegTokenResp(negTokenRespBytes)
+	if err != nil {
+		return err
+	}
+
+	if negTokenResp.NegState == spnegoReject {
+		return errors.New("security context rejected")
+	}
+
+	c.selectedMech = c.mechs[0]
+	for i, mechType := range c.mechTypes {
+		if mechType.Equal(negTokenResp.SupportedMech) {
+			c.selectedMech = c.mechs[i]
+			break
+		}
+	}
+
+	_, err = c.selectedMech.acceptSecContext(negTokenResp.ResponseToken)
+	return err
+}
+
+// spnegoReject is the negState of a NegTokenResp refusing the context
+// (RFC 4178 4.2.2).
+const spnegoReject = 2
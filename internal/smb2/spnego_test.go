@@ -0,0 +1,93 @@
+package smb2
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"errors"
+	"testing"
+
+	"github.com/absfs/smbfs/internal/smb2/internal/spnego"
+)
+
+var testKrb5Oid = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
+
+// fakeMechanism hands out a fixed token and records the token the server
+// answers with
+type fakeMechanism struct {
+	token     []byte
+	accepted  []byte
+	acceptErr error
+}
+
+func (m *fakeMechanism) OID() asn1.ObjectIdentifier { return testKrb5Oid }
+
+func (m *fakeMechanism) InitSecContext() ([]byte, error) { return m.token, nil }
+
+func (m *fakeMechanism) AcceptSecContext(sc []byte) ([]byte, error) {
+	m.accepted = sc
+	return nil, m.acceptErr
+}
+
+func (m *fakeMechanism) Sum(bs []byte) []byte { return nil }
+
+func (m *fakeMechanism) SessionKey() []byte { return []byte("0123456789abcdef") }
+
+func TestSpnegoClient_Mechanism(t *testing.T) {
+	mech := &fakeMechanism{token: []byte("ap-req")}
+	c := newSpnegoClient([]Initiator{&MechanismInitiator{Mechanism: mech}})
+
+	b, err := c.initSecContext()
+	if err != nil {
+		t.Fatalf("initSecContext() error = %v", err)
+	}
+	init, err := spnego.DecodeNegTokenInit(b)
+	if err != nil {
+		t.Fatalf("DecodeNegTokenInit() error = %v", err)
+	}
+	if len(init.MechTypes) != 1 || !init.MechTypes[0].Equal(testKrb5Oid) {
+		t.Errorf("NegTokenInit mechTypes = %v, want [%v]", init.MechTypes, testKrb5Oid)
+	}
+	if !bytes.Equal(init.MechToken, mech.token) {
+		t.Errorf("NegTokenInit mechToken = %q, want %q", init.MechToken, mech.token)
+	}
+
+	resp, err := spnego.EncodeNegTokenResp(0, testKrb5Oid, []byte("ap-rep"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.finishSecContext(resp); err != nil {
+		t.Fatalf("finishSecContext() error = %v", err)
+	}
+	if string(mech.accepted) != "ap-rep" {
+		t.Errorf("mechanism accepted %q, want %q", mech.accepted, "ap-rep")
+	}
+	if !bytes.Equal(c.sessionKey(), mech.SessionKey()) {
+		t.Errorf("sessionKey() = %x, want the mechanism's", c.sessionKey())
+	}
+}
+
+func TestSpnegoClient_FinishRejected(t *testing.T) {
+	mech := &fakeMechanism{}
+	c := newSpnegoClient([]Initiator{&MechanismInitiator{Mechanism: mech}})
+	resp, err := spnego.EncodeNegTokenResp(spnegoReject, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.finishSecContext(resp); err == nil {
+		t.Error("finishSecContext() accepted a rejected context")
+	}
+	if mech.accepted != nil {
+		t.Error("mechanism was handed a token from a rejected context")
+	}
+}
+
+func TestMechanismError(t *testing.T) {
+	errSkew := errors.New("clock skew")
+	if err := mechanismError(&MechanismInitiator{Mechanism: &fakeMechanism{}}, errSkew); err != errSkew {
+		t.Errorf("mechanismError(MechanismInitiator) = %v, want the mechanism's error", err)
+	}
+	var invalid *InvalidResponseError
+	if err := mechanismError(&NTLMInitiator{}, errSkew); !errors.As(err, &invalid) {
+		t.Errorf("mechanismError(NTLMInitiator) = %T, want *InvalidResponseError", err)
+	}
+}
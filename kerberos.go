@@ -0,0 +1,351 @@
+package smbfs
+
+import (
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/absfs/smbfs/internal/smb2"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// krb5OID is the object identifier of the Kerberos V5 GSS-API mechanism
+// (RFC 1964).
+var krb5OID = asn1.ObjectIdentifier(gssapi.OIDKRB5.OID())
+
+// krb5TokenAPReq is the token ID of an AP-REQ in a Kerberos GSS-API
+// token (RFC 4121 section 4.1).
+var krb5TokenAPReq = []byte{0x01, 0x00}
+
+// kerberosMechanism authenticates one session with a Kerberos service
+// ticket, as the GSS-API initiator of RFC 4121. It implements
+// smb2.Mechanism; session setup wraps its tokens in SPNEGO.
+type kerberosMechanism struct {
+	ticket messages.Ticket
+	key    types.EncryptionKey // Session key of the ticket
+	realm  string
+	cname  types.PrincipalName
+
+	auth       types.Authenticator // Authenticator of the AP-REQ sent
+	sessionKey []byte
+}
+
+var _ smb2.Mechanism = (*kerberosMechanism)(nil)
+
+// newKerberosMechanism gets a service ticket for the server named by
+// config and returns a mechanism that presents it.
+func newKerberosMechanism(config *Config) (*kerberosMechanism, error) {
+	spn, err := config.kerberosSPN()
+	if err != nil {
+		return nil, err
+	}
+	cl, err := config.kerberosClient()
+	if err != nil {
+		return nil, err
+	}
+	defer cl.Destroy()
+
+	tkt, key, err := cl.GetServiceTicket(spn)
+	if err != nil {
+		return nil, kerberosError(err, spn)
+	}
+	return &kerberosMechanism{
+		ticket: tkt,
+		key:    key,
+		realm:  cl.Credentials.Domain(),
+		cname:  cl.Credentials.CName(),
+	}, nil
+}
+
+// OID returns the Kerberos V5 mechanism OID.
+func (m *kerberosMechanism) OID() asn1.ObjectIdentifier {
+	return krb5OID
+}
+
+// InitSecContext returns a GSS-API token holding an AP-REQ for the
+// service ticket. Mutual authentication is required, so the server must
+// answer with an AP-REP.
+func (m *kerberosMechanism) InitSecContext() ([]byte, error) {
+	auth, err := types.NewAuthenticator(m.realm, m.cname)
+	if err != nil {
+		return nil, fmt.Errorf("kerberos: %w", err)
+	}
+	et, err := crypto.GetEtype(m.key.KeyType)
+	if err != nil {
+		return nil, fmt.Errorf("kerberos: %w", err)
+	}
+	if err := auth.GenerateSeqNumberAndSubKey(m.key.KeyType, et.GetKeyByteSize()); err != nil {
+		return nil, fmt.Errorf("kerberos: %w", err)
+	}
+	auth.Cksum = types.Checksum{
+		CksumType: chksumtype.GSSAPI,
+		Checksum:  gssChecksum(gssapi.ContextFlagMutual | gssapi.ContextFlagInteg | gssapi.ContextFlagConf),
+	}
+
+	apReq, err := messages.NewAPReq(m.ticket, m.key, auth)
+	if err != nil {
+		return nil, fmt.Errorf("kerberos: %w", err)
+	}
+	types.SetFlag(&apReq.APOptions, flags.APOptionMutualRequired)
+	b, err := apReq.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("kerberos: %w", err)
+	}
+	m.auth = auth
+	return krb5Token(krb5TokenAPReq, b), nil
+}
+
+// AcceptSecContext checks the server's answer to the AP-REQ: an AP-REP
+// proving the server could read the ticket, or a KRB-ERROR refusing it.
+func (m *kerberosMechanism) AcceptSecContext(sc []byte) ([]byte, error) {
+	if len(sc) == 0 {
+		return nil, fmt.Errorf("kerberos: server did not return an AP-REP: %w", ErrAuthenticationFailed)
+	}
+	var tok spnego.KRB5Token
+	if err := tok.Unmarshal(sc); err != nil {
+		return nil, fmt.Errorf("kerberos: %w", err)
+	}
+	switch {
+	case tok.IsKRBError():
+		return nil, kerberosError(tok.KRBError, "")
+	case tok.IsAPRep():
+		return nil, m.acceptAPRep(tok.APRep)
+	}
+	return nil, fmt.Errorf("kerberos: unexpected token from server: %w", ErrAuthenticationFailed)
+}
+
+// acceptAPRep verifies that rep answers the authenticator sent and takes
+// the session key from it.
+func (m *kerberosMechanism) acceptAPRep(rep messages.APRep) error {
+	b, err := crypto.DecryptEncPart(rep.EncPart, m.key, keyusage.AP_REP_ENCPART)
+	if err != nil {
+		return fmt.Errorf("kerberos: AP-REP does not decrypt: %w", ErrAuthenticationFailed)
+	}
+	var part messages.EncAPRepPart
+	if err := part.Unmarshal(b); err != nil {
+		return fmt.Errorf("kerberos: %w", err)
+	}
+	if part.CTime.Unix() != m.auth.CTime.Unix() || part.Cusec != m.auth.Cusec {
+		return fmt.Errorf("kerberos: AP-REP does not answer the authenticator: %w", ErrAuthenticationFailed)
+	}
+
+	// The SMB session key is the GSS-API context key: the acceptor's
+	// subkey, else ours, else the ticket's (MS-SMB2 3.2.5.3.1)
+	key := m.key.KeyValue
+	if len(part.Subkey.KeyValue) > 0 {
+		key = part.Subkey.KeyValue
+	} else if len(m.auth.SubKey.KeyValue) > 0 {
+		key = m.auth.SubKey.KeyValue
+	}
+	m.sessionKey = make([]byte, 16)
+	copy(m.sessionKey, key)
+	return nil
+}
+
+// Sum returns no MIC. Kerberos is the only mechanism offered, so SPNEGO
+// does not need the mechanism list protected (RFC 4178 section 5).
+func (m *kerberosMechanism) Sum(bs []byte) []byte {
+	return nil
+}
+
+// SessionKey returns the 16-byte SMB session key, once the AP-REP is
+// accepted.
+func (m *kerberosMechanism) SessionKey() []byte {
+	return m.sessionKey
+}
+
+// krb5Token frames a Kerberos message as a GSS-API token (RFC 2743
+// section 3.1).
+func krb5Token(tokID, msg []byte) []byte {
+	oid, _ := asn1.Marshal(krb5OID)
+	b := append(oid, tokID...)
+	b = append(b, msg...)
+	return asn1tools.AddASNAppTag(b, 0)
+}
+
+// gssChecksum returns the authenticator checksum carrying the GSS-API
+// context flags, without channel bindings (RFC 4121 section 4.1.1).
+func gssChecksum(contextFlags uint32) []byte {
+	b := make([]byte, 24)
+	binary.LittleEndian.PutUint32(b[0:4], 16)
+	binary.LittleEndian.PutUint32(b[20:24], contextFlags)
+	return b
+}
+
+// kerberosSPN returns the service principal of the server.
+func (c *Config) kerberosSPN() (string, error) {
+	if c.KerberosSPN != "" {
+		return c.KerberosSPN, nil
+	}
+	host := c.host()
+	if _, err := netip.ParseAddr(host); err == nil {
+		return "", fmt.Errorf("%w: server %s is an IP address; set Server to its hostname or set KerberosSPN", ErrKerberosSPNNotFound, host)
+	}
+	return "cifs/" + host, nil
+}
+
+// kerberosClient returns a Kerberos client holding a ticket-granting
+// ticket, from KerberosKeytab if set and otherwise from the credential
+// cache.
+func (c *Config) kerberosClient() (*client.Client, error) {
+	domain, user := splitDomainUser(c.Username)
+	if domain == "" {
+		domain = c.Domain
+	}
+	krbConf, err := c.kerberosConfig(strings.ToUpper(domain))
+	if err != nil {
+		return nil, err
+	}
+
+	if c.KerberosKeytab != "" {
+		kt, err := keytab.Load(c.KerberosKeytab)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%w: no keytab at %s", ErrKerberosTicketNotFound, c.KerberosKeytab)
+		} else if err != nil {
+			return nil, fmt.Errorf("kerberos: failed to load keytab %s: %w", c.KerberosKeytab, err)
+		}
+		realm := strings.ToUpper(domain)
+		if realm == "" {
+			realm = krbConf.LibDefaults.DefaultRealm
+		}
+		if !keytabHasPrincipal(kt, user, realm) {
+			return nil, fmt.Errorf("%w: no key for %s@%s in keytab %s", ErrKerberosTicketNotFound, user, realm, c.KerberosKeytab)
+		}
+		cl := client.NewWithKeytab(user, realm, kt, krbConf, client.DisablePAFXFAST(true))
+		if err := cl.Login(); err != nil {
+			return nil, kerberosError(err, "")
+		}
+		return cl, nil
+	}
+
+	path, err := c.kerberosCCachePath()
+	if err != nil {
+		return nil, err
+	}
+	ccache, err := credentials.LoadCCache(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: no credential cache at %s; run kinit", ErrKerberosTicketNotFound, path)
+	} else if err != nil {
+		return nil, fmt.Errorf("kerberos: failed to load credential cache %s: %w", path, err)
+	}
+	if !hasValidTGT(ccache, time.Now()) {
+		return nil, fmt.Errorf("%w: no valid ticket-granting ticket for %s in %s; run kinit",
+			ErrKerberosTicketNotFound, ccache.DefaultPrincipal.PrincipalName.PrincipalNameString(), path)
+	}
+	cl, err := client.NewFromCCache(ccache, krbConf, client.DisablePAFXFAST(true))
+	if err != nil {
+		return nil, fmt.Errorf("kerberos: %w", err)
+	}
+	return cl, nil
+}
+
+// kerberosConfig loads the krb5.conf to use. When none is configured and
+// the default is missing, the KDCs of realm are looked up in DNS.
+func (c *Config) kerberosConfig(realm string) (*config.Config, error) {
+	path := c.KerberosConfig
+	if path == "" {
+		path = os.Getenv("KRB5_CONFIG")
+	}
+	if path == "" {
+		path = "/etc/krb5.conf"
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			krbConf := config.New()
+			krbConf.LibDefaults.DefaultRealm = realm
+			krbConf.LibDefaults.DNSLookupKDC = true
+			return krbConf, nil
+		}
+	}
+	krbConf, err := config.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("kerberos: %w", err)
+	}
+	return krbConf, nil
+}
+
+// kerberosCCachePath returns the path of the credential cache to use.
+// Only FILE caches can be read.
+func (c *Config) kerberosCCachePath() (string, error) {
+	if c.KerberosCCache != "" {
+		return c.KerberosCCache, nil
+	}
+	name := os.Getenv("KRB5CCNAME")
+	if name == "" {
+		return fmt.Sprintf("/tmp/krb5cc_%d", os.Getuid()), nil
+	}
+	if kind, path, ok := strings.Cut(name, ":"); ok {
+		if kind != "FILE" {
+			return "", fmt.Errorf("kerberos: credential cache %s is not supported; set KerberosCCache to a FILE cache", name)
+		}
+		return path, nil
+	}
+	return name, nil
+}
+
+// hasValidTGT reports whether ccache holds a ticket-granting ticket for
+// its default principal's realm that has not expired at now.
+func hasValidTGT(ccache *credentials.CCache, now time.Time) bool {
+	realm := ccache.DefaultPrincipal.Realm
+	tgs := types.PrincipalName{
+		NameType:   nametype.KRB_NT_SRV_INST,
+		NameString: []string{"krbtgt", realm},
+	}
+	cred, ok := ccache.GetEntry(tgs)
+	return ok && now.Before(cred.EndTime)
+}
+
+// keytabHasPrincipal reports whether kt holds a key for user@realm.
+func keytabHasPrincipal(kt *keytab.Keytab, user, realm string) bool {
+	for _, e := range kt.Entries {
+		if e.Principal.Realm == realm && strings.Join(e.Principal.Components, "/") == user {
+			return true
+		}
+	}
+	return false
+}
+
+// kerberosError classifies a failure to get or present a ticket. gokrb5
+// flattens KDC errors into text, so they are recognized by the error
+// code's name when err is not a KRBError itself.
+func kerberosError(err error, spn string) error {
+	switch {
+	case kdcErrorIs(err, errorcode.KRB_AP_ERR_SKEW):
+		return fmt.Errorf("%w: %v", ErrKerberosClockSkew, err)
+	case kdcErrorIs(err, errorcode.KDC_ERR_S_PRINCIPAL_UNKNOWN):
+		return fmt.Errorf("%w: %s: %v", ErrKerberosSPNNotFound, spn, err)
+	case kdcErrorIs(err, errorcode.KRB_AP_ERR_TKT_EXPIRED):
+		return fmt.Errorf("%w: %v", ErrKerberosTicketNotFound, err)
+	case kdcErrorIs(err, errorcode.KDC_ERR_C_PRINCIPAL_UNKNOWN),
+		kdcErrorIs(err, errorcode.KDC_ERR_PREAUTH_FAILED):
+		return fmt.Errorf("%w: %v", ErrAuthenticationFailed, err)
+	}
+	return fmt.Errorf("kerberos: %w", err)
+}
+
+// kdcErrorIs reports whether err is, or reports, a KRB-ERROR with code.
+func kdcErrorIs(err error, code int32) bool {
+	var krbErr messages.KRBError
+	if errors.As(err, &krbErr) {
+		return krbErr.ErrorCode == code
+	}
+	return strings.Contains(err.Error(), "KRB Error: "+errorcode.Lookup(code))
+}
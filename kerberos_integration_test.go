@@ -0,0 +1,133 @@
+//go:build kerberos
+// +build kerberos
+
+package smbfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+// Kerberos integration tests need an SMB server joined to a realm, such as
+// a Samba AD DC, and a ticket for a user of the realm. They read:
+//
+//	SMB_KRB5_SERVER  hostname of the server, which has a cifs/ principal
+//	SMB_KRB5_SHARE   share to mount (default: testshare)
+//	SMB_KRB5_CCACHE  credential cache (default: $KRB5CCNAME)
+//	SMB_KRB5_KEYTAB  keytab to use instead of a credential cache
+//	SMB_USERNAME     user of the keytab
+//	SMB_DOMAIN       realm of the keytab's user
+//
+// Run them with: kinit user@REALM && go test -tags kerberos -run Kerberos ./...
+
+// getKerberosTestConfig returns a Kerberos configuration for the server
+// named by the environment, skipping the test when there is none.
+func getKerberosTestConfig(t *testing.T) *Config {
+	t.Helper()
+
+	server := os.Getenv("SMB_KRB5_SERVER")
+	if server == "" {
+		t.Skip("SMB_KRB5_SERVER not set")
+	}
+	share := os.Getenv("SMB_KRB5_SHARE")
+	if share == "" {
+		share = "testshare"
+	}
+
+	return &Config{
+		Server:         server,
+		Share:          share,
+		UseKerberos:    true,
+		Username:       os.Getenv("SMB_USERNAME"),
+		Domain:         os.Getenv("SMB_DOMAIN"),
+		KerberosCCache: os.Getenv("SMB_KRB5_CCACHE"),
+		KerberosKeytab: os.Getenv("SMB_KRB5_KEYTAB"),
+	}
+}
+
+func TestKerberos_ReadWrite(t *testing.T) {
+	config := getKerberosTestConfig(t)
+	config.RequireSigning = true
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	const name = "/kerberos_test.txt"
+	content := []byte("written over a Kerberos session")
+	f, err := fsys.Create(name)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if _, err := f.Write(content); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	f.Close()
+	defer fsys.Remove(name)
+
+	f, err = fsys.Open(name)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer f.Close()
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if string(got) != string(content) {
+		t.Errorf("read %q, want %q", got, content)
+	}
+}
+
+func TestKerberos_IPC(t *testing.T) {
+	config := getKerberosTestConfig(t)
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	shares, err := fsys.ListShares(context.Background())
+	if err != nil {
+		t.Fatalf("ListShares() error = %v", err)
+	}
+	for _, s := range shares {
+		if s.Name == config.Share {
+			return
+		}
+	}
+	t.Errorf("ListShares() = %v, missing %s", shares, config.Share)
+}
+
+func TestKerberos_SPNNotFound(t *testing.T) {
+	config := getKerberosTestConfig(t)
+	config.KerberosSPN = "cifs/no-such-host.invalid"
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	if _, err := fsys.Stat("/"); !errors.Is(err, ErrKerberosSPNNotFound) {
+		t.Errorf("Stat() error = %v, want ErrKerberosSPNNotFound", err)
+	}
+}
+
+func TestKerberos_TicketNotFound(t *testing.T) {
+	config := getKerberosTestConfig(t)
+	config.KerberosKeytab = ""
+	config.KerberosCCache = t.TempDir() + "/krb5cc_none"
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	if _, err := fsys.Stat("/"); !errors.Is(err, ErrKerberosTicketNotFound) {
+		t.Errorf("Stat() error = %v, want ErrKerberosTicketNotFound", err)
+	}
+}
@@ -0,0 +1,306 @@
+package smbfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	krbasn1 "github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/krberror"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+const (
+	testKerberosRealm = "EXAMPLE.COM"
+	testKerberosSPN   = "cifs/fs.example.com"
+)
+
+// testKerberosMechanism returns a mechanism holding a ticket for
+// testKerberosSPN, and the service's keytab for the test to play the
+// server with
+func testKerberosMechanism(t *testing.T) (*kerberosMechanism, *keytab.Keytab) {
+	t.Helper()
+	kt := keytab.New()
+	if err := kt.AddEntry(testKerberosSPN, testKerberosRealm, "service-secret", time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96); err != nil {
+		t.Fatalf("AddEntry() error = %v", err)
+	}
+	cname := types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, "jdoe")
+	sname := types.NewPrincipalName(nametype.KRB_NT_SRV_INST, testKerberosSPN)
+	now := time.Now().UTC()
+	tkt, key, err := messages.NewTicket(cname, testKerberosRealm, sname, testKerberosRealm, types.NewKrbFlags(),
+		kt, etypeID.AES256_CTS_HMAC_SHA1_96, 1, now, now, now.Add(time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("NewTicket() error = %v", err)
+	}
+	return &kerberosMechanism{ticket: tkt, key: key, realm: testKerberosRealm, cname: cname}, kt
+}
+
+// testAPRep returns the GSS-API token of an AP-REP, encrypted with the
+// ticket's session key as the server would
+func testAPRep(t *testing.T, mech *kerberosMechanism, ctime time.Time, cusec int, subkey types.EncryptionKey) []byte {
+	t.Helper()
+	b, err := krbasn1.Marshal(messages.EncAPRepPart{CTime: ctime, Cusec: cusec, Subkey: subkey})
+	if err != nil {
+		t.Fatalf("Marshal(EncAPRepPart) error = %v", err)
+	}
+	b = asn1tools.AddASNAppTag(b, asnAppTag.EncAPRepPart)
+	encPart, err := crypto.GetEncryptedData(b, mech.key, keyusage.AP_REP_ENCPART, 0)
+	if err != nil {
+		t.Fatalf("GetEncryptedData() error = %v", err)
+	}
+	b, err = krbasn1.Marshal(messages.APRep{PVNO: iana.PVNO, MsgType: msgtype.KRB_AP_REP, EncPart: encPart})
+	if err != nil {
+		t.Fatalf("Marshal(APRep) error = %v", err)
+	}
+	return krb5Token([]byte{0x02, 0x00}, asn1tools.AddASNAppTag(b, asnAppTag.APREP))
+}
+
+// testKRBError returns the GSS-API token of a KRB-ERROR with code
+func testKRBError(t *testing.T, code int32) []byte {
+	t.Helper()
+	krbErr := messages.NewKRBError(types.NewPrincipalName(nametype.KRB_NT_SRV_INST, testKerberosSPN), testKerberosRealm, code, "")
+	b, err := krbErr.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal(KRBError) error = %v", err)
+	}
+	return krb5Token([]byte{0x03, 0x00}, b)
+}
+
+func TestKerberosMechanism_InitSecContext(t *testing.T) {
+	mech, kt := testKerberosMechanism(t)
+	if !mech.OID().Equal(krb5OID) {
+		t.Errorf("OID() = %v, want %v", mech.OID(), krb5OID)
+	}
+
+	token, err := mech.InitSecContext()
+	if err != nil {
+		t.Fatalf("InitSecContext() error = %v", err)
+	}
+	var tok spnego.KRB5Token
+	if err := tok.Unmarshal(token); err != nil {
+		t.Fatalf("token does not parse as a KRB5 GSS-API token: %v", err)
+	}
+	if !tok.IsAPReq() {
+		t.Fatal("token does not hold an AP-REQ")
+	}
+
+	apReq := tok.APReq
+	if !types.IsFlagSet(&apReq.APOptions, flags.APOptionMutualRequired) {
+		t.Error("AP-REQ does not require mutual authentication")
+	}
+	if err := apReq.Ticket.DecryptEncPart(kt, nil); err != nil {
+		t.Fatalf("service cannot decrypt the ticket: %v", err)
+	}
+	if err := apReq.DecryptAuthenticator(apReq.Ticket.DecryptedEncPart.Key); err != nil {
+		t.Fatalf("service cannot decrypt the authenticator: %v", err)
+	}
+	auth := apReq.Authenticator
+	if got := auth.CName.PrincipalNameString(); got != "jdoe" || auth.CRealm != testKerberosRealm {
+		t.Errorf("authenticator client = %s@%s, want jdoe@%s", got, auth.CRealm, testKerberosRealm)
+	}
+	if auth.Cksum.CksumType != chksumtype.GSSAPI || len(auth.Cksum.Checksum) != 24 {
+		t.Fatalf("authenticator checksum = type %d, %d bytes; want GSS-API checksum of 24 bytes",
+			auth.Cksum.CksumType, len(auth.Cksum.Checksum))
+	}
+	if binary.LittleEndian.Uint32(auth.Cksum.Checksum[20:24])&gssapi.ContextFlagMutual == 0 {
+		t.Error("GSS-API checksum does not request mutual authentication")
+	}
+	if len(auth.SubKey.KeyValue) == 0 {
+		t.Error("authenticator has no subkey")
+	}
+}
+
+func TestKerberosMechanism_AcceptSecContext(t *testing.T) {
+	acceptorKey := types.EncryptionKey{KeyType: etypeID.AES256_CTS_HMAC_SHA1_96, KeyValue: bytes.Repeat([]byte{0xA5}, 32)}
+
+	t.Run("acceptor subkey", func(t *testing.T) {
+		mech, _ := testKerberosMechanism(t)
+		if _, err := mech.InitSecContext(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mech.AcceptSecContext(testAPRep(t, mech, mech.auth.CTime, mech.auth.Cusec, acceptorKey)); err != nil {
+			t.Fatalf("AcceptSecContext() error = %v", err)
+		}
+		if got, want := mech.SessionKey(), acceptorKey.KeyValue[:16]; !bytes.Equal(got, want) {
+			t.Errorf("SessionKey() = %x, want the acceptor subkey %x", got, want)
+		}
+	})
+
+	t.Run("initiator subkey", func(t *testing.T) {
+		mech, _ := testKerberosMechanism(t)
+		if _, err := mech.InitSecContext(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mech.AcceptSecContext(testAPRep(t, mech, mech.auth.CTime, mech.auth.Cusec, types.EncryptionKey{})); err != nil {
+			t.Fatalf("AcceptSecContext() error = %v", err)
+		}
+		if got, want := mech.SessionKey(), mech.auth.SubKey.KeyValue[:16]; !bytes.Equal(got, want) {
+			t.Errorf("SessionKey() = %x, want the initiator subkey %x", got, want)
+		}
+	})
+
+	t.Run("replayed AP-REP", func(t *testing.T) {
+		mech, _ := testKerberosMechanism(t)
+		if _, err := mech.InitSecContext(); err != nil {
+			t.Fatal(err)
+		}
+		token := testAPRep(t, mech, mech.auth.CTime.Add(-time.Minute), mech.auth.Cusec, acceptorKey)
+		if _, err := mech.AcceptSecContext(token); !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("AcceptSecContext() error = %v, want ErrAuthenticationFailed", err)
+		}
+		if mech.SessionKey() != nil {
+			t.Error("SessionKey() set from an AP-REP that was refused")
+		}
+	})
+
+	t.Run("clock skew", func(t *testing.T) {
+		mech, _ := testKerberosMechanism(t)
+		if _, err := mech.InitSecContext(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mech.AcceptSecContext(testKRBError(t, errorcode.KRB_AP_ERR_SKEW)); !errors.Is(err, ErrKerberosClockSkew) {
+			t.Errorf("AcceptSecContext() error = %v, want ErrKerberosClockSkew", err)
+		}
+	})
+
+	t.Run("no token", func(t *testing.T) {
+		mech, _ := testKerberosMechanism(t)
+		if _, err := mech.AcceptSecContext(nil); !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("AcceptSecContext(nil) error = %v, want ErrAuthenticationFailed", err)
+		}
+	})
+}
+
+// TestKerberosError pins the text match on KDC errors gokrb5 returns
+// flattened into a krberror.Krberror
+func TestKerberosError(t *testing.T) {
+	sname := types.NewPrincipalName(nametype.KRB_NT_SRV_INST, testKerberosSPN)
+	flattened := func(code int32) error {
+		return krberror.Errorf(messages.NewKRBError(sname, testKerberosRealm, code, ""), krberror.KDCError, "TGS Exchange Error")
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"skew from KDC", flattened(errorcode.KRB_AP_ERR_SKEW), ErrKerberosClockSkew},
+		{"skew from server", messages.NewKRBError(sname, testKerberosRealm, errorcode.KRB_AP_ERR_SKEW, ""), ErrKerberosClockSkew},
+		{"unknown service", flattened(errorcode.KDC_ERR_S_PRINCIPAL_UNKNOWN), ErrKerberosSPNNotFound},
+		{"wrapped unknown service", fmt.Errorf("exchange: %w", messages.NewKRBError(sname, testKerberosRealm, errorcode.KDC_ERR_S_PRINCIPAL_UNKNOWN, "")), ErrKerberosSPNNotFound},
+		{"expired ticket", flattened(errorcode.KRB_AP_ERR_TKT_EXPIRED), ErrKerberosTicketNotFound},
+		{"unknown client", flattened(errorcode.KDC_ERR_C_PRINCIPAL_UNKNOWN), ErrAuthenticationFailed},
+		{"wrong key", flattened(errorcode.KDC_ERR_PREAUTH_FAILED), ErrAuthenticationFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := kerberosError(tt.err, testKerberosSPN); !errors.Is(err, tt.want) {
+				t.Errorf("kerberosError(%v) = %v, want %v", tt.err, err, tt.want)
+			}
+		})
+	}
+
+	other := errors.New("connection refused")
+	if err := kerberosError(other, testKerberosSPN); !errors.Is(err, other) {
+		t.Errorf("kerberosError() = %v, want the error kept", err)
+	}
+}
+
+func TestConfig_KerberosSPN(t *testing.T) {
+	tests := []struct {
+		config  Config
+		want    string
+		wantErr error
+	}{
+		{Config{Server: "fs.example.com"}, "cifs/fs.example.com", nil},
+		{Config{Server: "10.0.0.5", KerberosSPN: "cifs/fs.example.com"}, "cifs/fs.example.com", nil},
+		{Config{Server: "10.0.0.5"}, "", ErrKerberosSPNNotFound},
+		{Config{Server: "[fe80::1]"}, "", ErrKerberosSPNNotFound},
+	}
+	for _, tt := range tests {
+		got, err := tt.config.kerberosSPN()
+		if got != tt.want || !errors.Is(err, tt.wantErr) {
+			t.Errorf("kerberosSPN(%q) = %q, %v; want %q, %v", tt.config.Server, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestConfig_KerberosCCachePath(t *testing.T) {
+	t.Setenv("KRB5CCNAME", "FILE:/tmp/krb5cc_test")
+	if got, err := (&Config{}).kerberosCCachePath(); got != "/tmp/krb5cc_test" || err != nil {
+		t.Errorf("kerberosCCachePath() with FILE: = %q, %v", got, err)
+	}
+	if got, err := (&Config{KerberosCCache: "/var/cc"}).kerberosCCachePath(); got != "/var/cc" || err != nil {
+		t.Errorf("kerberosCCachePath() with KerberosCCache = %q, %v", got, err)
+	}
+
+	t.Setenv("KRB5CCNAME", "KEYRING:persistent:1000")
+	if _, err := (&Config{}).kerberosCCachePath(); err == nil {
+		t.Error("kerberosCCachePath() accepted a KEYRING cache")
+	}
+
+	t.Setenv("KRB5CCNAME", "")
+	if got, _ := (&Config{}).kerberosCCachePath(); got != fmt.Sprintf("/tmp/krb5cc_%d", os.Getuid()) {
+		t.Errorf("kerberosCCachePath() default = %q", got)
+	}
+}
+
+func TestConfig_KerberosTicketNotFound(t *testing.T) {
+	dir := t.TempDir()
+	krb5conf := filepath.Join(dir, "krb5.conf")
+	if err := os.WriteFile(krb5conf, []byte("[libdefaults]\n  default_realm = "+testKerberosRealm+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	kt := keytab.New()
+	if err := kt.AddEntry("someone-else", testKerberosRealm, "secret", time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96); err != nil {
+		t.Fatal(err)
+	}
+	b, err := kt.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ktPath := filepath.Join(dir, "user.keytab")
+	if err := os.WriteFile(ktPath, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{"missing credential cache", Config{KerberosCCache: filepath.Join(dir, "krb5cc_none")}},
+		{"missing keytab", Config{Username: "jdoe", KerberosKeytab: filepath.Join(dir, "none.keytab")}},
+		{"no key for user", Config{Username: "jdoe", Domain: "example.com", KerberosKeytab: ktPath}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			config.Server = "fs.example.com"
+			config.UseKerberos = true
+			config.KerberosConfig = krb5conf
+			if _, err := newInitiator(&config); !errors.Is(err, ErrKerberosTicketNotFound) {
+				t.Errorf("newInitiator() error = %v, want ErrKerberosTicketNotFound", err)
+			}
+		})
+	}
+}
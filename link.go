@@ -0,0 +1,69 @@
+package smbfs
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/absfs/smbfs/internal/smb2"
+)
+
+// Linker is implemented by filesystems that can give a file another name
+// for the same content, as os.Link does. Shares backed by such a filesystem
+// create hard links for FileLinkInformation requests
+type Linker interface {
+	Link(oldname, newname string) error
+}
+
+// Link creates newname as a hard link to the file oldname, as os.Link does.
+// newname must not exist. Servers whose filesystem has no hard links
+// report ErrNotImplemented.
+func (fsys *FileSystem) Link(oldname, newname string) error {
+	if err := validatePath(oldname); err != nil {
+		return wrapPathError("link", oldname, err)
+	}
+	if err := validatePath(newname); err != nil {
+		return wrapPathError("link", newname, err)
+	}
+	oldname = fsys.pathNorm.normalize(oldname)
+	newname = fsys.pathNorm.normalize(newname)
+
+	// Whatever the server's handling of a bare name, one with a leading
+	// separator is a path from the share root
+	target := toSMBPath(newname)
+	if !strings.Contains(target, "\\") {
+		target = "\\" + target
+	}
+
+	err := fsys.withRawHandle("link", oldname, FILE_WRITE_ATTRIBUTES, func(f infoFile) error {
+		return f.SetInfo(FileLinkInformation, encodeLinkInformation(target, false))
+	})
+	var respErr *smb2.ResponseError
+	if errors.As(err, &respErr) && NTStatus(respErr.Code) == STATUS_NOT_SUPPORTED {
+		err = wrapPathError("link", oldname, ErrNotImplemented)
+	}
+	if err != nil {
+		return err
+	}
+
+	fsys.cache.invalidate(oldname)
+	fsys.cache.invalidate(newname)
+	return nil
+}
+
+// encodeLinkInformation builds a FILE_LINK_INFORMATION buffer (MS-FSCC
+// 2.4.21.2) for the SMB2 form, which has a 64-bit RootDirectory that must
+// be zero.
+func encodeLinkInformation(name string, replaceIfExists bool) []byte {
+	encoded := EncodeStringToUTF16LE(name)
+	w := NewByteWriter(20 + len(encoded))
+	if replaceIfExists {
+		w.WriteOneByte(1)
+	} else {
+		w.WriteOneByte(0)
+	}
+	w.WriteBytes(make([]byte, 7)) // Reserved
+	w.WriteUint64(0)              // RootDirectory
+	w.WriteUint32(uint32(len(encoded)))
+	w.WriteBytes(encoded)
+	return w.Bytes()
+}
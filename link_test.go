@@ -0,0 +1,219 @@
+package smbfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+// linkFS gives a filesystem hard links by resolving each extra name of a
+// file to the name it was linked from
+type linkFS struct {
+	absfs.FileSystem
+	mu    sync.Mutex
+	links map[string]string
+}
+
+func newLinkFS(fsys absfs.FileSystem) *linkFS {
+	return &linkFS{FileSystem: fsys, links: make(map[string]string)}
+}
+
+func (l *linkFS) resolve(name string) string {
+	name = path.Clean("/" + name)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if target, ok := l.links[name]; ok {
+		return target
+	}
+	return name
+}
+
+func (l *linkFS) Link(oldname, newname string) error {
+	target := l.resolve(oldname)
+	if _, err := l.FileSystem.Stat(target); err != nil {
+		return err
+	}
+	if _, err := l.Stat(newname); err == nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: fs.ErrExist}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.links[path.Clean("/"+newname)] = target
+	return nil
+}
+
+func (l *linkFS) Open(name string) (absfs.File, error) {
+	return l.FileSystem.Open(l.resolve(name))
+}
+
+func (l *linkFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	return l.FileSystem.OpenFile(l.resolve(name), flag, perm)
+}
+
+func (l *linkFS) Stat(name string) (os.FileInfo, error) {
+	return l.FileSystem.Stat(l.resolve(name))
+}
+
+func (l *linkFS) Remove(name string) error {
+	name = path.Clean("/" + name)
+	l.mu.Lock()
+	_, isLink := l.links[name]
+	delete(l.links, name)
+	l.mu.Unlock()
+	if isLink {
+		return nil
+	}
+	return l.FileSystem.Remove(name)
+}
+
+// TestSetInfo_FileLinkInformation tests creating hard links with SET_INFO,
+// with and without ReplaceIfExists, and on a filesystem without links
+func TestSetInfo_FileLinkInformation(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	share := tree.Share
+	share.fs.Mkdir("/dir", 0755)
+	for _, name := range []string{"/doc.txt", "/other.txt"} {
+		f, _ := share.fs.Create(name)
+		f.Write([]byte(name))
+		f.Close()
+	}
+
+	// Handles have the share-relative paths CREATE gives them
+	open := func(name string, isDir bool) *OpenFile {
+		t.Helper()
+		file, err := share.fs.Open("/" + name)
+		if err != nil {
+			t.Fatalf("Open(%s) error = %v", name, err)
+		}
+		of := share.fileHandles.Allocate(file, name, isDir, FILE_READ_DATA|FILE_WRITE_ATTRIBUTES,
+			FILE_SHARE_READ|FILE_SHARE_WRITE|FILE_SHARE_DELETE, FILE_OPEN, 0, tree.ID, session.ID)
+		t.Cleanup(func() { share.fileHandles.Release(of.ID) })
+		return of
+	}
+	link := func(of *OpenFile, name string, replace bool) NTStatus {
+		t.Helper()
+		_, status := srv.handler.handleSetInfo(nil, testRequest(session, tree, SMB2_SET_INFO,
+			buildSetInfoRequest(of.ID, SMB2_0_INFO_FILE, FileLinkInformation, encodeLinkInformation(name, replace))))
+		return status
+	}
+	readFile := func(name string) string {
+		t.Helper()
+		f, err := share.fs.Open(name)
+		if err != nil {
+			t.Fatalf("Open(%s) error = %v", name, err)
+		}
+		defer f.Close()
+		data, _ := io.ReadAll(f)
+		return string(data)
+	}
+	of := open("doc.txt", false)
+
+	if status := link(of, "copy.txt", false); status != STATUS_NOT_SUPPORTED {
+		t.Errorf("SET_INFO FileLinkInformation without Linker status = %v, want STATUS_NOT_SUPPORTED", status)
+	}
+
+	share.fs = newLinkFS(share.fs)
+	if status := link(of, "dir\\copy.txt", false); status != STATUS_SUCCESS {
+		t.Fatalf("SET_INFO FileLinkInformation status = %v, want STATUS_SUCCESS", status)
+	}
+	if data := readFile("/dir/copy.txt"); data != "/doc.txt" {
+		t.Errorf("contents of the link = %q, want /doc.txt", data)
+	}
+
+	tests := []struct {
+		name    string
+		of      *OpenFile
+		target  string
+		replace bool
+		want    NTStatus
+	}{
+		{"existing name", of, "other.txt", false, STATUS_OBJECT_NAME_COLLISION},
+		{"missing directory", of, "missing\\copy.txt", false, STATUS_OBJECT_PATH_NOT_FOUND},
+		{"over a directory", of, "dir", true, STATUS_ACCESS_DENIED},
+		{"of a directory", open("dir", true), "dir2", false, STATUS_FILE_IS_A_DIRECTORY},
+	}
+	for _, tt := range tests {
+		if status := link(tt.of, tt.target, tt.replace); status != tt.want {
+			t.Errorf("SET_INFO FileLinkInformation %s status = %v, want %v", tt.name, status, tt.want)
+		}
+	}
+
+	// ReplaceIfExists replaces a file that is not open
+	if status := link(of, "other.txt", true); status != STATUS_SUCCESS {
+		t.Fatalf("SET_INFO FileLinkInformation replacing status = %v, want STATUS_SUCCESS", status)
+	}
+	if data := readFile("/other.txt"); data != "/doc.txt" {
+		t.Errorf("contents of the replaced name = %q, want /doc.txt", data)
+	}
+	open("other.txt", false)
+	if status := link(open("dir/copy.txt", false), "\\other.txt", true); status != STATUS_ACCESS_DENIED {
+		t.Errorf("SET_INFO FileLinkInformation replacing an open file status = %v, want STATUS_ACCESS_DENIED", status)
+	}
+}
+
+// TestFileSystem_Link tests that a hard link made by the client names the
+// same file as the original
+func TestFileSystem_Link(t *testing.T) {
+	srv, config := startLoopbackServer(t, ServerOptions{})
+	share := srv.GetShare("data")
+
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	if err := fsys.Link("/hello.txt", "/hello2.txt"); !errors.Is(err, ErrNotImplemented) {
+		t.Errorf("Link() without Linker error = %v, want ErrNotImplemented", err)
+	}
+
+	share.fs = newLinkFS(share.fs)
+	if err := fsys.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("Mkdir() error = %v", err)
+	}
+	if err := fsys.Link("/hello.txt", "/dir/hello.txt"); err != nil {
+		t.Fatalf("Link() error = %v", err)
+	}
+	if err := fsys.Link("/dir/hello.txt", "/again.txt"); err != nil {
+		t.Fatalf("Link() to the share root error = %v", err)
+	}
+
+	// A write through one name is seen through the others
+	f, err := fsys.OpenFile("/dir/hello.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	if _, err := f.Write([]byte(", world")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	f.Close()
+	for _, name := range []string{"/hello.txt", "/dir/hello.txt", "/again.txt"} {
+		info, err := fsys.Stat(name)
+		if err != nil || info.Size() != 12 {
+			t.Errorf("Stat(%s) = %v, %v, want size 12", name, info, err)
+			continue
+		}
+		f, err := fsys.Open(name)
+		if err != nil {
+			t.Fatalf("Open(%s) error = %v", name, err)
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil || string(data) != "hello, world" {
+			t.Errorf("contents of %s = %q, %v, want hello, world", name, data, err)
+		}
+	}
+
+	if err := fsys.Link("/hello.txt", "/again.txt"); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Link() to an existing name error = %v, want fs.ErrExist", err)
+	}
+	if err := fsys.Link("/missing.txt", "/new.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Link() of a missing file error = %v, want fs.ErrNotExist", err)
+	}
+}
@@ -0,0 +1,60 @@
+package smbfs
+
+import (
+	"errors"
+	"io/fs"
+
+	"github.com/absfs/smbfs/internal/smb2"
+)
+
+// Lock takes a lock on length bytes of the file from offset, exclusive or
+// shared. Exclusive locks conflict with any other lock on an overlapping
+// range, shared locks only with exclusive ones. Lock does not wait: a range
+// locked through another open fails with ErrLockNotGranted. Locks are held
+// by the file's handle until Unlock or Close. Servers that enforce them, as
+// Windows does, refuse reads of an exclusively locked range through other
+// handles, and writes of a locked range except through the exclusive
+// holder.
+func (f *File) Lock(offset, length int64, exclusive bool) error {
+	flags := SMB2_LOCKFLAG_SHARED_LOCK | SMB2_LOCKFLAG_FAIL_IMMEDIATELY
+	if exclusive {
+		flags = SMB2_LOCKFLAG_EXCLUSIVE_LOCK | SMB2_LOCKFLAG_FAIL_IMMEDIATELY
+	}
+	return f.lockRange("lock", offset, length, flags)
+}
+
+// Unlock releases a lock taken with Lock. offset and length must be those
+// the lock was taken with.
+func (f *File) Unlock(offset, length int64) error {
+	return f.lockRange("unlock", offset, length, SMB2_LOCKFLAG_UNLOCK)
+}
+
+func (f *File) lockRange(op string, offset, length int64, flags uint32) error {
+	if f.file == nil {
+		return fs.ErrClosed
+	}
+	if offset < 0 || length < 0 {
+		return wrapPathError(op, f.path, fs.ErrInvalid)
+	}
+	locker, ok := f.file.(interface {
+		Lock(offset, length uint64, flags uint32) error
+	})
+	if !ok {
+		return wrapPathError(op, f.path, ErrNotImplemented)
+	}
+
+	f.conn.beginOp()
+	defer f.conn.endOp()
+
+	err := locker.Lock(uint64(offset), uint64(length), flags)
+	var respErr *smb2.ResponseError
+	if errors.As(err, &respErr) {
+		switch NTStatus(respErr.Code) {
+		case STATUS_LOCK_NOT_GRANTED:
+			err = ErrLockNotGranted
+		case STATUS_RANGE_NOT_LOCKED:
+			err = ErrNotLocked
+		}
+	}
+	return wrapPathError(op, f.path, err)
+}
@@ -10,6 +10,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/absfs/smbfs/internal/smb2"
 )
 
 // MockSMBBackend provides an in-memory SMB server simulation for testing.
@@ -40,6 +42,9 @@ type mockFileData struct {
 	mode    fs.FileMode
 	modTime time.Time
 	isDir   bool
+
+	// attributes overrides the Windows attributes derived from mode
+	attributes uint32
 }
 
 // MockOperation records an operation performed on the mock backend.
@@ -122,6 +127,15 @@ func (m *MockSMBBackend) AddDir(path string, mode fs.FileMode) {
 	m.ensureParentDirs(path)
 }
 
+// SetAttributes sets the Windows file attributes reported for a path.
+func (m *MockSMBBackend) SetAttributes(path string, attrs uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, ok := m.files[normalizeMockPath(path)]; ok {
+		f.attributes = attrs
+	}
+}
+
 // SetError sets an error to return for a specific path.
 func (m *MockSMBBackend) SetError(path string, err error) {
 	m.mu.Lock()
@@ -576,6 +590,38 @@ func (sh *MockSMBShare) Chmod(name string, mode fs.FileMode) error {
 	return nil
 }
 
+// SetAttributes sets the Windows attributes of the named file. Zero leaves
+// them unchanged, as in an SMB2 SET_INFO FileBasicInformation request.
+func (sh *MockSMBShare) SetAttributes(name string, attrs uint32) error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if sh.unmounted {
+		return errors.New("share unmounted")
+	}
+
+	sh.backend.mu.Lock()
+	defer sh.backend.mu.Unlock()
+
+	name = normalizeMockPath(name)
+
+	if err := sh.backend.checkError("chattr", name); err != nil {
+		return err
+	}
+
+	sh.backend.recordOp("chattr", name, attrs)
+
+	data, exists := sh.backend.files[name]
+	if !exists {
+		return fs.ErrNotExist
+	}
+
+	if attrs != 0 {
+		data.attributes = attrs
+	}
+	return nil
+}
+
 // Chtimes changes the access and modification times of a file.
 func (sh *MockSMBShare) Chtimes(name string, atime, mtime time.Time) error {
 	sh.mu.Lock()
@@ -691,13 +737,7 @@ func (f *MockSMBFile) Write(p []byte) (n int, err error) {
 		return 0, errors.New("is a directory")
 	}
 
-	// Special case: zero-length write at an offset truncates the file
 	if len(p) == 0 {
-		if f.offset < int64(len(f.data.content)) {
-			// Truncate to current offset
-			f.data.content = f.data.content[:f.offset]
-			f.data.modTime = time.Now()
-		}
 		return 0, nil
 	}
 
@@ -784,6 +824,57 @@ func (f *MockSMBFile) Stat() (fs.FileInfo, error) {
 	return &mockFileInfo{data: f.data}, nil
 }
 
+// SetAttributes sets the file's Windows attributes. Zero leaves them
+// unchanged, as in an SMB2 SET_INFO FileBasicInformation request.
+func (f *MockSMBFile) SetAttributes(attrs uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return fs.ErrClosed
+	}
+
+	f.backend.mu.Lock()
+	defer f.backend.mu.Unlock()
+
+	if err := f.backend.checkError("chattr", f.path); err != nil {
+		return err
+	}
+
+	f.backend.recordOp("chattr", f.path, attrs)
+	if attrs != 0 {
+		f.data.attributes = attrs
+	}
+	return nil
+}
+
+// Truncate changes the size of the file, zero-filling any growth.
+func (f *MockSMBFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return fs.ErrClosed
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return errors.New("file not opened for writing")
+	}
+
+	f.backend.mu.Lock()
+	defer f.backend.mu.Unlock()
+
+	if err := f.backend.checkError("truncate", f.path); err != nil {
+		return err
+	}
+
+	f.backend.recordOp("truncate", f.path, size)
+	content := make([]byte, size)
+	copy(content, f.data.content)
+	f.data.content = content
+	f.data.modTime = time.Now()
+	return nil
+}
+
 // Readdir reads the directory contents.
 func (f *MockSMBFile) Readdir(n int) ([]fs.FileInfo, error) {
 	f.mu.Lock()
@@ -855,7 +946,24 @@ func (fi *mockFileInfo) Size() int64        { return int64(len(fi.data.content))
 func (fi *mockFileInfo) Mode() fs.FileMode  { return fi.data.mode }
 func (fi *mockFileInfo) ModTime() time.Time { return fi.data.modTime }
 func (fi *mockFileInfo) IsDir() bool        { return fi.data.isDir }
-func (fi *mockFileInfo) Sys() interface{}   { return nil }
+
+// Sys returns the file's metadata the way go-smb2 reports it.
+func (fi *mockFileInfo) Sys() interface{} {
+	attrs := fi.data.attributes
+	if attrs == 0 {
+		attrs = modeToAttributes(fi.data.mode)
+	}
+	return &smb2.FileStat{
+		CreationTime:   fi.data.modTime,
+		LastAccessTime: fi.data.modTime,
+		LastWriteTime:  fi.data.modTime,
+		ChangeTime:     fi.data.modTime,
+		EndOfFile:      fi.Size(),
+		AllocationSize: fi.Size(),
+		FileAttributes: attrs,
+		FileName:       fi.data.name,
+	}
+}
 
 // MockConnectionFactory implements ConnectionFactory for testing.
 type MockConnectionFactory struct {
@@ -262,6 +262,82 @@ func TestConnectionPool_Cleanup(t *testing.T) {
 	}
 }
 
+func TestConnectionPool_HealthCheck(t *testing.T) {
+	backend := NewMockSMBBackend()
+	factory := NewMockConnectionFactory(backend)
+	config := testConfig()
+	config.HealthCheckInterval = 20 * time.Millisecond
+	pool := newConnectionPoolWithFactory(config, factory)
+	defer pool.Close()
+
+	ctx := context.Background()
+
+	conn1, err := pool.get(ctx)
+	if err != nil {
+		t.Fatalf("pool.get() error = %v", err)
+	}
+	pool.put(conn1)
+
+	// A connection idle for less than the interval is reused unprobed
+	conn2, _ := pool.get(ctx)
+	if conn2 != conn1 {
+		t.Fatal("Connection not reused from pool")
+	}
+	pool.put(conn2)
+
+	// The server drops the connection while it sits idle
+	conn1.share.Umount()
+	time.Sleep(50 * time.Millisecond)
+
+	conn3, err := pool.get(ctx)
+	if err != nil {
+		t.Fatalf("pool.get() after the connection died error = %v", err)
+	}
+	defer pool.put(conn3)
+	if conn3 == conn1 {
+		t.Error("pool.get() returned the dead connection")
+	}
+	if _, err := conn3.share.Stat(""); err != nil {
+		t.Errorf("Stat() on the replacement connection error = %v", err)
+	}
+
+	if factory.ConnectionsMade() != 2 {
+		t.Errorf("ConnectionsMade = %d, want 2", factory.ConnectionsMade())
+	}
+	stats := pool.Stats()
+	if stats.HealthCheckFailures != 1 {
+		t.Errorf("HealthCheckFailures = %d, want 1", stats.HealthCheckFailures)
+	}
+	if stats.TotalConnections != 1 {
+		t.Errorf("TotalConnections = %d, want 1", stats.TotalConnections)
+	}
+}
+
+func TestConnectionPool_HealthCheckDisabled(t *testing.T) {
+	backend := NewMockSMBBackend()
+	factory := NewMockConnectionFactory(backend)
+	config := testConfig()
+	config.HealthCheckInterval = -1
+	pool := newConnectionPoolWithFactory(config, factory)
+	defer pool.Close()
+
+	ctx := context.Background()
+
+	conn1, _ := pool.get(ctx)
+	pool.put(conn1)
+	backend.SetOperationError("stat", errors.New("connection reset"))
+	time.Sleep(10 * time.Millisecond)
+
+	conn2, _ := pool.get(ctx)
+	pool.put(conn2)
+	if conn2 != conn1 {
+		t.Error("Connection not reused with health checks disabled")
+	}
+	if n := pool.Stats().HealthCheckFailures; n != 0 {
+		t.Errorf("HealthCheckFailures = %d, want 0", n)
+	}
+}
+
 func TestConnectionPool_ConcurrentAccess(t *testing.T) {
 	backend := NewMockSMBBackend()
 	factory := NewMockConnectionFactory(backend)
@@ -623,6 +699,119 @@ func TestFileSystem_Stat_Directory(t *testing.T) {
 	}
 }
 
+func TestFileSystem_Stat_WindowsAttributes(t *testing.T) {
+	fsys, backend, _ := setupMockFS(t)
+	defer fsys.Close()
+
+	backend.AddDir("/attrs", 0755)
+	backend.AddFile("/attrs/hidden.txt", []byte("h"), 0644)
+	backend.AddFile("/attrs/plain.txt", []byte("p"), 0644)
+	backend.SetAttributes("/attrs/hidden.txt",
+		FILE_ATTRIBUTE_HIDDEN|FILE_ATTRIBUTE_SYSTEM|FILE_ATTRIBUTE_READONLY|FILE_ATTRIBUTE_ARCHIVE)
+
+	check := func(t *testing.T, info fs.FileInfo, special bool) {
+		t.Helper()
+		attrs := GetWindowsAttributes(info)
+		if attrs == nil {
+			t.Fatalf("%s: no Windows attributes", info.Name())
+		}
+		if attrs.IsHidden() != special || attrs.IsSystem() != special || attrs.IsReadOnly() != special {
+			t.Errorf("%s: attributes = %s", info.Name(), attrs)
+		}
+		if !attrs.IsArchive() {
+			t.Errorf("%s: IsArchive() = false", info.Name())
+		}
+	}
+
+	for name, special := range map[string]bool{"hidden.txt": true, "plain.txt": false} {
+		info, err := fsys.Stat("/attrs/" + name)
+		if err != nil {
+			t.Fatalf("Stat(%s) error = %v", name, err)
+		}
+		check(t, info, special)
+		if special && GetWindowsAttributes(info).String() != "ReadOnly, Hidden, System, Archive" {
+			t.Errorf("String() = %q", GetWindowsAttributes(info))
+		}
+	}
+
+	entries, err := fsys.ReadDir("/attrs")
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatalf("Info(%s) error = %v", entry.Name(), err)
+		}
+		check(t, info, entry.Name() == "hidden.txt")
+	}
+}
+
+func TestFileSystem_Chattr(t *testing.T) {
+	fsys, backend, _ := setupMockFS(t)
+	defer fsys.Close()
+
+	backend.AddFile("/app.conf", []byte("x"), 0644)
+
+	// Prime the stat cache so a stale entry would be noticed
+	info, err := fsys.Stat("/app.conf")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	attrs := GetWindowsAttributes(info)
+	if attrs.IsHidden() {
+		t.Fatal("file hidden before Chattr")
+	}
+
+	attrs.SetHidden(true)
+	if err := fsys.Chattr("/app.conf", attrs); err != nil {
+		t.Fatalf("Chattr() error = %v", err)
+	}
+
+	info, err = fsys.Stat("/app.conf")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if got := GetWindowsAttributes(info); !got.IsHidden() || !got.IsArchive() {
+		t.Errorf("attributes after Chattr = %s, want Hidden and Archive", got)
+	}
+
+	if err := fsys.Chattr("/missing", attrs); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Chattr(missing) error = %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestFile_SetAttributes(t *testing.T) {
+	fsys, backend, _ := setupMockFS(t)
+	defer fsys.Close()
+
+	backend.AddFile("/sys.dat", []byte("x"), 0644)
+	if _, err := fsys.Stat("/sys.dat"); err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+
+	f, err := fsys.OpenFile("/sys.dat", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	if err := f.(*File).SetAttributes(NewWindowsAttributes(FILE_ATTRIBUTE_HIDDEN | FILE_ATTRIBUTE_SYSTEM)); err != nil {
+		t.Fatalf("SetAttributes() error = %v", err)
+	}
+	f.Close()
+
+	info, err := fsys.Stat("/sys.dat")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if got := GetWindowsAttributes(info); got.String() != "Hidden, System" {
+		t.Errorf("attributes after SetAttributes = %s, want Hidden, System", got)
+	}
+
+	if err := f.(*File).SetAttributes(NewWindowsAttributes(FILE_ATTRIBUTE_HIDDEN)); err != fs.ErrClosed {
+		t.Errorf("SetAttributes() after Close error = %v, want fs.ErrClosed", err)
+	}
+}
+
 func TestFileSystem_Chmod(t *testing.T) {
 	fsys, backend, _ := setupMockFS(t)
 	defer fsys.Close()
@@ -721,6 +910,76 @@ func TestConnectionPool_ConnectError(t *testing.T) {
 	}
 }
 
+func TestConnectionPool_MinIdle(t *testing.T) {
+	backend := NewMockSMBBackend()
+	factory := NewMockConnectionFactory(backend)
+	config := testConfig()
+	config.MinIdle = 3
+	config.MaxOpen = 4
+	fsys, err := NewWithFactory(config, factory)
+	if err != nil {
+		t.Fatalf("NewWithFactory() error = %v", err)
+	}
+	defer fsys.Close()
+
+	// waitIdle waits for the pool to have want idle connections
+	waitIdle := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for fsys.pool.Stats().IdleConnections != want && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if stats := fsys.pool.Stats(); stats.IdleConnections != want {
+			t.Fatalf("IdleConnections = %d, want %d (%+v)", stats.IdleConnections, want, stats)
+		}
+	}
+
+	waitIdle(3)
+	if n := factory.ConnectionsMade(); n != 3 {
+		t.Errorf("connections made by warmup = %d, want 3", n)
+	}
+	if err := fsys.WarmupError(); err != nil {
+		t.Errorf("WarmupError() = %v", err)
+	}
+
+	// Taking idle connections has them replaced, up to MaxOpen
+	ctx := context.Background()
+	first, _ := fsys.pool.get(ctx)
+	second, _ := fsys.pool.get(ctx)
+	waitIdle(2)
+	if stats := fsys.pool.Stats(); stats.TotalConnections != 4 {
+		t.Errorf("TotalConnections = %d, want MaxOpen 4", stats.TotalConnections)
+	}
+
+	fsys.pool.put(first)
+	fsys.pool.put(second)
+	waitIdle(4)
+}
+
+func TestConnectionPool_WarmupError(t *testing.T) {
+	backend := NewMockSMBBackend()
+	factory := NewMockConnectionFactory(backend)
+	factory.ConnectError = errors.New("logon failure")
+	config := testConfig()
+	config.MinIdle = 2
+	fsys, err := NewWithFactory(config, factory)
+	if err != nil {
+		t.Fatalf("NewWithFactory() error = %v, want construction not to wait for connections", err)
+	}
+	defer fsys.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for fsys.WarmupError() == nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := fsys.WarmupError(); err == nil || err.Error() != "logon failure" {
+		t.Errorf("WarmupError() = %v, want logon failure", err)
+	}
+	if stats := fsys.pool.Stats(); stats.TotalConnections != 0 {
+		t.Errorf("TotalConnections = %d, want 0", stats.TotalConnections)
+	}
+}
+
 // =============================================================================
 // Cache Interaction Tests
 // =============================================================================
@@ -766,6 +1025,57 @@ func TestFileSystem_CacheHit(t *testing.T) {
 	}
 }
 
+func TestFileSystem_CacheStats(t *testing.T) {
+	backend := NewMockSMBBackend()
+	factory := NewMockConnectionFactory(backend)
+	config := testConfig()
+	config.Cache = CacheConfig{
+		EnableCache:     true,
+		DirCacheTTL:     1 * time.Hour,
+		StatCacheTTL:    1 * time.Hour,
+		MaxCacheEntries: 2,
+	}
+
+	fsys, err := NewWithFactory(config, factory)
+	if err != nil {
+		t.Fatalf("NewWithFactory() error = %v", err)
+	}
+	defer fsys.Close()
+
+	for _, name := range []string{"/one.txt", "/two.txt", "/three.txt"} {
+		backend.AddFile(name, []byte("x"), 0644)
+		if _, err := fsys.Stat(name); err != nil {
+			t.Fatalf("Stat(%s) error = %v", name, err)
+		}
+	}
+
+	// /one.txt was evicted; the other two are still cached
+	backend.ClearOperations()
+	for _, name := range []string{"/two.txt", "/three.txt", "/one.txt"} {
+		if _, err := fsys.Stat(name); err != nil {
+			t.Fatalf("Stat(%s) error = %v", name, err)
+		}
+	}
+	ops := backend.GetOperations()
+	if len(ops) != 1 || ops[0].Op != "stat" || ops[0].Path != "/one.txt" {
+		t.Errorf("backend operations = %+v, want a single stat of /one.txt", ops)
+	}
+
+	stats := fsys.CacheStats()
+	if stats.Hits != 2 {
+		t.Errorf("Hits = %d, want 2", stats.Hits)
+	}
+	if stats.Misses != 4 {
+		t.Errorf("Misses = %d, want 4", stats.Misses)
+	}
+	if stats.Evictions != 2 {
+		t.Errorf("Evictions = %d, want 2", stats.Evictions)
+	}
+	if stats.TotalEntries != 2 || stats.MaxEntries != 2 {
+		t.Errorf("TotalEntries = %d, MaxEntries = %d, want 2 and 2", stats.TotalEntries, stats.MaxEntries)
+	}
+}
+
 func TestFileSystem_CacheInvalidation(t *testing.T) {
 	backend := NewMockSMBBackend()
 	factory := NewMockConnectionFactory(backend)
@@ -808,6 +1118,180 @@ func TestFileSystem_CacheInvalidation(t *testing.T) {
 	}
 }
 
+func TestFileSystem_CacheStaleWhileRevalidate(t *testing.T) {
+	backend := NewMockSMBBackend()
+	factory := NewMockConnectionFactory(backend)
+	config := testConfig()
+	config.Cache = CacheConfig{
+		EnableCache:          true,
+		DirCacheTTL:          50 * time.Millisecond,
+		StatCacheTTL:         50 * time.Millisecond,
+		MaxCacheEntries:      100,
+		StaleWhileRevalidate: true,
+		StaleGrace:           1 * time.Hour,
+	}
+
+	fsys, err := NewWithFactory(config, factory)
+	if err != nil {
+		t.Fatalf("NewWithFactory() error = %v", err)
+	}
+	defer fsys.Close()
+
+	backend.AddFile("/swr.txt", []byte("old"), 0644)
+
+	// Populate cache
+	if _, err := fsys.Stat("/swr.txt"); err != nil {
+		t.Fatalf("First Stat() error = %v", err)
+	}
+
+	// Change the file behind the cache's back and let the entry expire
+	backend.AddFile("/swr.txt", []byte("new content"), 0644)
+	time.Sleep(100 * time.Millisecond)
+
+	// Stale value is returned synchronously
+	info, err := fsys.Stat("/swr.txt")
+	if err != nil {
+		t.Fatalf("Stale Stat() error = %v", err)
+	}
+	if info.Size() != 3 {
+		t.Errorf("Stale Stat() size = %d, want 3", info.Size())
+	}
+
+	// Background refresh updates the cached entry shortly after
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if cached, ok := fsys.cache.getStatInfo("/swr.txt"); ok && cached.Size() == int64(len("new content")) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("background refresh did not update the cache entry")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFileSystem_CacheNegative(t *testing.T) {
+	backend := NewMockSMBBackend()
+	factory := NewMockConnectionFactory(backend)
+	config := testConfig()
+	config.Cache = CacheConfig{
+		EnableCache:      true,
+		StatCacheTTL:     1 * time.Hour,
+		NegativeCacheTTL: 1 * time.Hour,
+		MaxCacheEntries:  100,
+	}
+
+	fsys, err := NewWithFactory(config, factory)
+	if err != nil {
+		t.Fatalf("NewWithFactory() error = %v", err)
+	}
+	defer fsys.Close()
+
+	statCalls := func() int {
+		n := 0
+		for _, op := range backend.GetOperations() {
+			if op.Op == "stat" {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Two probes for a missing file make one round trip
+	backend.ClearOperations()
+	for i := 0; i < 2; i++ {
+		if _, err := fsys.Stat("/missing.h"); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("Stat() #%d error = %v, want fs.ErrNotExist", i+1, err)
+		}
+	}
+	if got := statCalls(); got != 1 {
+		t.Errorf("backend stat calls = %d, want 1", got)
+	}
+
+	// Creating the file drops the negative entry
+	f, err := fsys.Create("/missing.h")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if _, err := f.Write([]byte("#pragma once\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	f.Close()
+	if _, err := fsys.Stat("/missing.h"); err != nil {
+		t.Errorf("Stat() after Create error = %v", err)
+	}
+
+	// Renaming a file into a missing path drops its entry
+	backend.AddFile("/src.h", []byte("x"), 0644)
+	if _, err := fsys.Stat("/dst.h"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Stat() error = %v, want fs.ErrNotExist", err)
+	}
+	if err := fsys.Rename("/src.h", "/dst.h"); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+	if _, err := fsys.Stat("/dst.h"); err != nil {
+		t.Errorf("Stat() after Rename error = %v", err)
+	}
+
+	// Renaming a directory into place drops entries beneath it
+	backend.AddDir("/build", 0755)
+	backend.AddFile("/build/gen.h", []byte("x"), 0644)
+	if _, err := fsys.Stat("/include/gen.h"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Stat() error = %v, want fs.ErrNotExist", err)
+	}
+	if err := fsys.Rename("/build", "/include"); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+	if _, err := fsys.Stat("/include/gen.h"); err != nil {
+		t.Errorf("Stat() of child after directory Rename error = %v", err)
+	}
+
+	// A file created behind the cache's back shows up once it is opened
+	if _, err := fsys.Stat("/other.h"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Stat() error = %v, want fs.ErrNotExist", err)
+	}
+	backend.AddFile("/other.h", []byte("x"), 0644)
+	f, err = fsys.Open("/other.h")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	f.Close()
+	if _, err := fsys.Stat("/other.h"); err != nil {
+		t.Errorf("Stat() after Open error = %v", err)
+	}
+}
+
+func TestFileSystem_CacheNegativeDisabled(t *testing.T) {
+	backend := NewMockSMBBackend()
+	factory := NewMockConnectionFactory(backend)
+	config := testConfig()
+	config.Cache = CacheConfig{
+		EnableCache:     true,
+		StatCacheTTL:    1 * time.Hour,
+		MaxCacheEntries: 100,
+	}
+
+	fsys, err := NewWithFactory(config, factory)
+	if err != nil {
+		t.Fatalf("NewWithFactory() error = %v", err)
+	}
+	defer fsys.Close()
+
+	backend.ClearOperations()
+	_, _ = fsys.Stat("/missing.h")
+	_, _ = fsys.Stat("/missing.h")
+
+	statCalls := 0
+	for _, op := range backend.GetOperations() {
+		if op.Op == "stat" {
+			statCalls++
+		}
+	}
+	if statCalls != 2 {
+		t.Errorf("backend stat calls = %d, want 2 without NegativeCacheTTL", statCalls)
+	}
+}
+
 // =============================================================================
 // Concurrent File Operations Tests
 // =============================================================================
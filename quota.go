@@ -0,0 +1,103 @@
+package smbfs
+
+import (
+	"path"
+	"sync"
+
+	"github.com/absfs/absfs"
+)
+
+// shareUsage is the space taken by the files of a share with a quota. It
+// is counted from the filesystem when first needed, then kept up to date
+// by the share's own writes and size changes. Anything harder to follow,
+// such as a delete or a replacing rename, makes it count again
+type shareUsage struct {
+	mu    sync.Mutex
+	known bool
+	bytes int64
+}
+
+// limitsSize reports whether the share limits the size of files or of the
+// share, so writes must be checked against the limits
+func (s *Share) limitsSize() bool {
+	opts := s.Options()
+	return opts.MaxFileSize > 0 || opts.QuotaBytes > 0
+}
+
+// reserveSpace checks that a file may grow or shrink from oldSize to
+// newSize bytes and counts the change in the share's usage. Growth past
+// MaxFileSize or past QuotaBytes for the share fails with STATUS_DISK_FULL
+func (s *Share) reserveSpace(oldSize, newSize int64) NTStatus {
+	return s.fitSpace(oldSize, newSize, true)
+}
+
+// checkSpace is reserveSpace for space that will not be counted as used,
+// such as allocation reserved beyond the end of a file
+func (s *Share) checkSpace(oldSize, newSize int64) NTStatus {
+	return s.fitSpace(oldSize, newSize, false)
+}
+
+func (s *Share) fitSpace(oldSize, newSize int64, count bool) NTStatus {
+	opts := s.Options()
+	if newSize > oldSize && opts.MaxFileSize > 0 && newSize > opts.MaxFileSize {
+		return STATUS_DISK_FULL
+	}
+	if opts.QuotaBytes == 0 {
+		return STATUS_SUCCESS
+	}
+
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+	used := s.usedLocked()
+	if newSize > oldSize && uint64(used+newSize-oldSize) > opts.QuotaBytes {
+		return STATUS_DISK_FULL
+	}
+	if count {
+		s.usage.bytes = max(used+newSize-oldSize, 0)
+	}
+	return STATUS_SUCCESS
+}
+
+// forgetUsage makes the share count its usage again when next needed
+func (s *Share) forgetUsage() {
+	s.usage.mu.Lock()
+	s.usage.known = false
+	s.usage.mu.Unlock()
+}
+
+// usedSpace returns the bytes taken by the share's files
+func (s *Share) usedSpace() int64 {
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+	return s.usedLocked()
+}
+
+// usedLocked returns the share's usage, counting it if it is not known.
+// s.usage.mu must be held
+func (s *Share) usedLocked() int64 {
+	if !s.usage.known {
+		s.usage.bytes = treeSize(s.FileSystem(), "/")
+		s.usage.known = true
+	}
+	return s.usage.bytes
+}
+
+// treeSize sums the sizes of the files under dir. Entries that cannot be
+// read are left out
+func treeSize(fsys absfs.FileSystem, dir string) int64 {
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	var total int64
+	for _, e := range entries {
+		if e.IsDir() {
+			total += treeSize(fsys, path.Join(dir, e.Name()))
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			total += info.Size()
+		}
+	}
+	return total
+}
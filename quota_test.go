@@ -0,0 +1,76 @@
+package smbfs
+
+import (
+	"os"
+	"testing"
+)
+
+// TestShare_SizeLimits tests that writes and size changes that would take a
+// file past MaxFileSize, or the share past QuotaBytes, fail with
+// STATUS_DISK_FULL, and that those up to the limits succeed
+func TestShare_SizeLimits(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	share := tree.Share
+	f, _ := share.fs.Create("/existing.bin")
+	f.Write(make([]byte, 600))
+	f.Close()
+
+	open := func(name string) *OpenFile {
+		t.Helper()
+		file, err := share.fs.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			t.Fatalf("OpenFile(%s) error = %v", name, err)
+		}
+		of := share.fileHandles.Allocate(file, name, false, FILE_READ_DATA|FILE_WRITE_DATA|FILE_APPEND_DATA,
+			FILE_SHARE_READ|FILE_SHARE_WRITE, FILE_OPEN_IF, 0, tree.ID, session.ID)
+		t.Cleanup(func() { share.fileHandles.Release(of.ID) })
+		return of
+	}
+	write := func(of *OpenFile, offset uint64, n int) NTStatus {
+		t.Helper()
+		_, status := srv.handler.handleWrite(nil, testRequest(session, tree, SMB2_WRITE,
+			buildWriteRequest(of.ID, offset, make([]byte, n))))
+		return status
+	}
+	setSize := func(of *OpenFile, class uint8, size uint64) NTStatus {
+		t.Helper()
+		buf := make([]byte, 8)
+		le.PutUint64(buf, size)
+		_, status := srv.handler.handleSetInfo(nil, testRequest(session, tree, SMB2_SET_INFO,
+			buildSetInfoRequest(of.ID, SMB2_0_INFO_FILE, class, buf)))
+		return status
+	}
+	check := func(what string, got, want NTStatus) {
+		t.Helper()
+		if got != want {
+			t.Errorf("%s status = %v, want %v", what, got, want)
+		}
+	}
+
+	share.options.MaxFileSize = 100
+	small := open("/small.bin")
+	check("WRITE up to MaxFileSize", write(small, 0, 100), STATUS_SUCCESS)
+	check("WRITE past MaxFileSize", write(small, 100, 1), STATUS_DISK_FULL)
+	check("WRITE appending past MaxFileSize", write(small, writeToEndOfFile, 1), STATUS_DISK_FULL)
+	check("WRITE within the file", write(small, 50, 50), STATUS_SUCCESS)
+	check("EndOfFile past MaxFileSize", setSize(small, FileEndOfFileInformation, 101), STATUS_DISK_FULL)
+	check("AllocationSize past MaxFileSize", setSize(small, FileAllocationInformation, 101), STATUS_DISK_FULL)
+	if info, _ := share.fs.Stat("/small.bin"); info.Size() != 100 {
+		t.Errorf("size after refused growth = %d, want 100", info.Size())
+	}
+
+	// The quota counts the files already on the share
+	share.options.MaxFileSize = 0
+	share.options.QuotaBytes = 1000
+	check("WRITE up to QuotaBytes", write(open("/big.bin"), 0, 300), STATUS_SUCCESS)
+	check("WRITE past QuotaBytes", write(open("/more.bin"), 0, 1), STATUS_DISK_FULL)
+	if total, free, _ := share.DiskSpace(); total != 1000 || free != 0 {
+		t.Errorf("DiskSpace() = %d total, %d free, want 1000, 0", total, free)
+	}
+
+	// Shrinking a file frees space for others
+	existing := open("/existing.bin")
+	check("EndOfFile shrinking", setSize(existing, FileEndOfFileInformation, 100), STATUS_SUCCESS)
+	check("WRITE into freed space", write(open("/more.bin"), 0, 500), STATUS_SUCCESS)
+	check("EndOfFile past QuotaBytes", setSize(existing, FileEndOfFileInformation, 101), STATUS_DISK_FULL)
+}
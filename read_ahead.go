@@ -0,0 +1,110 @@
+package smbfs
+
+import (
+	"io"
+)
+
+// readAheadTrigger is the number of back-to-back sequential reads after
+// which a file starts reading ahead.
+const readAheadTrigger = 2
+
+// readAhead prefetches the chunks following a sequential reader's offset
+// with overlapping positioned reads, so the next chunk is usually on the
+// wire or already buffered while the caller consumes the current one.
+type readAhead struct {
+	ra     io.ReaderAt
+	chunk  int               // Size of each read
+	depth  int               // Chunks buffered or in flight, including the one being consumed
+	next   int64             // Offset of the next chunk to request
+	queue  []*readAheadChunk // Chunks in offset order; queue[0] is being consumed
+	pos    int               // Bytes of queue[0] already returned
+	last   bool              // A chunk reached EOF or failed; request no more
+	closed bool
+}
+
+// readAheadChunk is one prefetched read.
+type readAheadChunk struct {
+	buf  []byte
+	n    int
+	err  error
+	done chan struct{}
+}
+
+// newReadAhead starts reading ahead of off, buffering at most window bytes
+// in chunks of chunk bytes.
+func newReadAhead(ra io.ReaderAt, off int64, window, chunk int) *readAhead {
+	r := &readAhead{
+		ra:    ra,
+		chunk: chunk,
+		depth: max(window/chunk, 1),
+		next:  off,
+	}
+	r.fill()
+	return r
+}
+
+// fill requests chunks until the window is full.
+func (r *readAhead) fill() {
+	for !r.last && len(r.queue) < r.depth {
+		c := &readAheadChunk{buf: make([]byte, r.chunk), done: make(chan struct{})}
+		go c.read(r.ra, r.next)
+		r.queue = append(r.queue, c)
+		r.next += int64(r.chunk)
+	}
+}
+
+// read fills the chunk from off, stopping early only at EOF or an error.
+func (c *readAheadChunk) read(ra io.ReaderAt, off int64) {
+	defer close(c.done)
+	for c.n < len(c.buf) && c.err == nil {
+		var m int
+		m, c.err = ra.ReadAt(c.buf[c.n:], off+int64(c.n))
+		if m > 0 {
+			c.n += m
+		} else if c.err == nil {
+			c.err = io.EOF
+		}
+	}
+}
+
+// Read returns buffered data, waiting for the chunk at the reader's offset
+// if it has not arrived yet. A short chunk's error, io.EOF included, is
+// returned once its data has been consumed.
+func (r *readAhead) Read(p []byte) (int, error) {
+	for {
+		if len(r.queue) == 0 {
+			return 0, io.EOF
+		}
+		c := r.queue[0]
+		<-c.done
+		if c.err != nil {
+			r.last = true
+		}
+		if r.pos < c.n {
+			n := copy(p, c.buf[r.pos:c.n])
+			r.pos += n
+			return n, nil
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+
+		r.queue[0] = nil
+		r.queue = r.queue[1:]
+		r.pos = 0
+		r.fill()
+	}
+}
+
+// Close waits for the reads in flight, so that none outlives the read-ahead
+// and the file can be seeked or closed.
+func (r *readAhead) Close() {
+	if r.closed {
+		return
+	}
+	r.closed = true
+	for _, c := range r.queue {
+		<-c.done
+	}
+	r.queue = nil
+}
@@ -0,0 +1,154 @@
+package smbfs
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// writeShareFile stores data as name on a loopback server's share
+func writeShareFile(tb testing.TB, srv *Server, name string, data []byte) {
+	tb.Helper()
+	f, err := srv.GetShare("data").fs.Create(name)
+	if err != nil {
+		tb.Fatalf("Create() error = %v", err)
+	}
+	f.Write(data)
+	f.Close()
+}
+
+// TestFile_ReadAhead tests that reading with read-ahead returns the same
+// data as plain reads, across seeks and the end of the file
+func TestFile_ReadAhead(t *testing.T) {
+	srv, config := startLoopbackServer(t, ServerOptions{})
+	data := make([]byte, 1<<20+12345)
+	rand.New(rand.NewSource(1)).Read(data)
+	writeShareFile(t, srv, "/big.bin", data)
+
+	readAll := func(readAhead int) []byte {
+		t.Helper()
+		cfg := *config
+		cfg.ReadAhead = readAhead
+		cfg.ReadBufferSize = 16 * 1024
+		fsys, err := New(&cfg)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer fsys.Close()
+		f, err := fsys.Open("/big.bin")
+		if err != nil {
+			t.Fatalf("Open() error = %v", err)
+		}
+		defer f.Close()
+		got, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("ReadAll() error = %v", err)
+		}
+		if prefetching := f.(*File).readAhead != nil; prefetching {
+			t.Error("read-ahead still running at EOF")
+		}
+		return got
+	}
+
+	plain := readAll(0)
+	if !bytes.Equal(plain, data) {
+		t.Fatalf("plain read returned %d bytes, want the %d written", len(plain), len(data))
+	}
+	if got := readAll(128 * 1024); !bytes.Equal(got, plain) {
+		t.Fatalf("read-ahead returned %d bytes differing from the %d of a plain read", len(got), len(plain))
+	}
+
+	// Seeking drops the prefetched data and reads from the new offset
+	cfg := *config
+	cfg.ReadAhead = 64 * 1024
+	cfg.ReadBufferSize = 8 * 1024
+	fsys, err := New(&cfg)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+	af, err := fsys.OpenFile("/big.bin", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	defer af.Close()
+	f := af.(*File)
+
+	buf := make([]byte, 5000)
+	for i := 0; i < 4; i++ {
+		if _, err := io.ReadFull(f, buf); err != nil {
+			t.Fatalf("ReadFull() error = %v", err)
+		}
+	}
+	if f.readAhead == nil {
+		t.Fatal("sequential reads did not start read-ahead")
+	}
+	if pos, err := f.Seek(-1000, io.SeekCurrent); err != nil || pos != 19000 {
+		t.Fatalf("Seek() = %d, %v, want 19000", pos, err)
+	}
+	if f.readAhead != nil {
+		t.Error("Seek() did not stop read-ahead")
+	}
+	rest, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll() after Seek error = %v", err)
+	}
+	if !bytes.Equal(rest, data[19000:]) {
+		t.Errorf("read after Seek returned %d bytes, want data[19000:]", len(rest))
+	}
+
+	// Files open for writing never read ahead
+	wf, err := fsys.OpenFile("/big.bin", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile(O_RDWR) error = %v", err)
+	}
+	defer wf.Close()
+	for i := 0; i < 4; i++ {
+		wf.Read(buf)
+	}
+	if wf.(*File).readAhead != nil {
+		t.Error("file open for writing started read-ahead")
+	}
+}
+
+// BenchmarkFile_ReadAhead measures sequential io.Copy throughput with and
+// without read-ahead
+func BenchmarkFile_ReadAhead(b *testing.B) {
+	srv, config := startLoopbackServer(b, ServerOptions{})
+	data := make([]byte, 8<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	writeShareFile(b, srv, "/big.bin", data)
+
+	for _, bench := range []struct {
+		name      string
+		readAhead int
+	}{
+		{"Off", 0},
+		{"1MiB", 1 << 20},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			cfg := *config
+			cfg.ReadAhead = bench.readAhead
+			fsys, err := New(&cfg)
+			if err != nil {
+				b.Fatalf("New() error = %v", err)
+			}
+			defer fsys.Close()
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f, err := fsys.Open("/big.bin")
+				if err != nil {
+					b.Fatalf("Open() error = %v", err)
+				}
+				if _, err := io.Copy(io.Discard, f); err != nil {
+					b.Fatalf("Copy() error = %v", err)
+				}
+				f.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package smbfs
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// expireSessions makes every session on srv idle past its timeout and runs
+// the server's session cleanup, as the cleanup loop would once it ticked
+func expireSessions(t *testing.T, srv *Server) {
+	t.Helper()
+	srv.sessions.mu.Lock()
+	for _, session := range srv.sessions.sessions {
+		session.mu.Lock()
+		session.LastActivity = time.Time{}
+		session.mu.Unlock()
+	}
+	srv.sessions.mu.Unlock()
+
+	srv.cleanupExpiredSessions()
+	if n := srv.sessions.SessionCount(); n != 0 {
+		t.Fatalf("%d sessions left after cleanup, want 0", n)
+	}
+}
+
+// TestReconnect_OpenFileSurvivesSessionExpiry tests that a file being read
+// when the server expires its session is reopened on a new connection and
+// read on from where it left off
+func TestReconnect_OpenFileSurvivesSessionExpiry(t *testing.T) {
+	srv, config := startLoopbackServer(t, ServerOptions{})
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	writeShareFile(t, srv, "/big.bin", data)
+
+	cfg := *config
+	cfg.ReadBufferSize = 16 * 1024
+	fsys, err := New(&cfg)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	f, err := fsys.Open("/big.bin")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer f.Close()
+
+	got := make([]byte, 100000)
+	if _, err := io.ReadFull(f, got); err != nil {
+		t.Fatalf("ReadFull() error = %v", err)
+	}
+	oldConn := f.(*File).conn
+
+	expireSessions(t, srv)
+
+	rest, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll() after session expiry error = %v", err)
+	}
+	if got = append(got, rest...); !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes differing from the %d written", len(got), len(data))
+	}
+	if f.(*File).conn == oldConn {
+		t.Error("file still uses the connection whose session expired")
+	}
+
+	// Writes and stats on a file recover the same way
+	w, err := fsys.Create("/out.bin")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	defer w.Close()
+	if _, err := w.Write(data[:1000]); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	expireSessions(t, srv)
+	if _, err := w.Write(data[1000:2000]); err != nil {
+		t.Fatalf("Write() after session expiry error = %v", err)
+	}
+	expireSessions(t, srv)
+	info, err := w.Stat()
+	if err != nil {
+		t.Fatalf("Stat() after session expiry error = %v", err)
+	}
+	if info.Size() != 2000 {
+		t.Errorf("Size() = %d, want 2000", info.Size())
+	}
+}
+
+// TestReconnect_FileSystemOperations tests that operations that get their
+// connection from the pool reconnect when the pooled session has expired
+func TestReconnect_FileSystemOperations(t *testing.T) {
+	srv, config := startLoopbackServer(t, ServerOptions{})
+
+	cfg := *config
+	cfg.RetryPolicy = &RetryPolicy{MaxAttempts: 2, InitialDelay: time.Hour}
+	fsys, err := New(&cfg)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	if _, err := fsys.Stat("/hello.txt"); err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	expireSessions(t, srv)
+
+	// The retry reconnects at once rather than after InitialDelay
+	start := time.Now()
+	info, err := fsys.Stat("/hello.txt")
+	if err != nil {
+		t.Fatalf("Stat() after session expiry error = %v", err)
+	}
+	if info.Size() != 5 {
+		t.Errorf("Size() = %d, want 5", info.Size())
+	}
+	if elapsed := time.Since(start); elapsed > time.Minute {
+		t.Errorf("Stat() took %v, waiting out the retry delay", elapsed)
+	}
+}
@@ -2,6 +2,8 @@ package smbfs
 
 import (
 	"context"
+	"math/rand/v2"
+	"sync"
 	"time"
 )
 
@@ -11,6 +13,108 @@ type RetryPolicy struct {
 	InitialDelay time.Duration // Initial delay between retries (default: 100ms)
 	MaxDelay     time.Duration // Maximum delay between retries (default: 5s)
 	Multiplier   float64       // Backoff multiplier (default: 2.0)
+
+	// Jitter spreads out the retries of clients that failed together by
+	// scaling each delay by a random factor between 1-Jitter and 1+Jitter.
+	// It is clamped to [0, 1]; zero waits exactly the backoff delay.
+	Jitter float64
+
+	// Retryable decides which errors are worth another attempt. The
+	// default retries only transient failures: dropped connections,
+	// timeouts, pool exhaustion and servers short of resources.
+	Retryable func(error) bool
+
+	// CircuitBreaker, if set, fails operations with ErrCircuitOpen while
+	// the server keeps failing, instead of adding to its load.
+	CircuitBreaker *CircuitBreaker
+}
+
+// jittered returns delay scaled by the policy's random jitter factor.
+func (p *RetryPolicy) jittered(delay time.Duration) time.Duration {
+	jitter := min(max(p.Jitter, 0), 1)
+	if jitter == 0 {
+		return delay
+	}
+	return time.Duration(float64(delay) * (1 - jitter + 2*jitter*rand.Float64()))
+}
+
+// CircuitBreaker opens after Failures consecutive transient failures, each
+// within Window of the first, and then fails operations at once with
+// ErrCircuitOpen. After Cooldown it lets a single operation through: its
+// success closes the breaker again and its failure reopens it for another
+// Cooldown. The state is shared by every FileSystem whose RetryPolicy
+// points to the breaker. Errors the policy would not retry, such as a
+// missing file, do not count as failures.
+type CircuitBreaker struct {
+	Failures int           // Consecutive failures that open the breaker (default: 5)
+	Window   time.Duration // Time the failures must fall within (default: 0, any)
+	Cooldown time.Duration // Time the breaker stays open (default: 30s)
+
+	mu        sync.Mutex
+	failures  int       // Consecutive failures so far
+	firstFail time.Time // Time of the first of them
+	openedAt  time.Time // Zero while closed
+	probing   bool      // The operation let through after Cooldown is running
+}
+
+// allow reports ErrCircuitOpen if an operation may not run now.
+func (b *CircuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openedAt.IsZero() {
+		return nil
+	}
+	cooldown := b.Cooldown
+	if cooldown <= 0 {
+		cooldown = 30 * time.Second
+	}
+	if b.probing || time.Since(b.openedAt) < cooldown {
+		return ErrCircuitOpen
+	}
+	b.probing = true
+	return nil
+}
+
+// record counts the outcome of an operation allow let through.
+func (b *CircuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if !failed {
+		b.failures = 0
+		b.openedAt = time.Time{}
+		b.probing = false
+		return
+	}
+	if b.probing {
+		b.probing = false
+		b.openedAt = now
+		return
+	}
+
+	if b.failures == 0 || (b.Window > 0 && now.Sub(b.firstFail) > b.Window) {
+		b.failures = 0
+		b.firstFail = now
+	}
+	b.failures++
+	threshold := b.Failures
+	if threshold <= 0 {
+		threshold = 5
+	}
+	if b.failures >= threshold {
+		b.failures = 0
+		b.openedAt = now
+	}
+}
+
+// retryable reports whether err is worth another attempt under the policy.
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return isRetryable(err)
 }
 
 // defaultRetryPolicy is the default retry policy.
@@ -28,6 +132,19 @@ func (fsys *FileSystem) withRetry(ctx context.Context, operation func() error) e
 		policy = defaultRetryPolicy
 	}
 
+	// Operations pass through the circuit breaker, if there is one
+	if breaker := policy.CircuitBreaker; breaker != nil {
+		attempt := operation
+		operation = func() error {
+			if err := breaker.allow(); err != nil {
+				return err
+			}
+			err := attempt()
+			breaker.record(err != nil && policy.retryable(err))
+			return err
+		}
+	}
+
 	// If MaxAttempts is 0 or 1, don't retry
 	if policy.MaxAttempts <= 1 {
 		return operation()
@@ -35,6 +152,7 @@ func (fsys *FileSystem) withRetry(ctx context.Context, operation func() error) e
 
 	var lastErr error
 	delay := policy.InitialDelay
+	reconnected := false
 
 	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
 		// Check context cancellation
@@ -51,15 +169,32 @@ func (fsys *FileSystem) withRetry(ctx context.Context, operation func() error) e
 		lastErr = err
 
 		// Don't retry if error is not retryable
-		if !isRetryable(err) {
+		if !policy.retryable(err) {
 			return err
 		}
 
+		// The server dropped the session the connection was using, so
+		// the pool's connections are dead
+		sessionLost := isSessionLost(err)
+		if sessionLost {
+			fsys.pool.expire()
+		}
+
 		// Don't retry on last attempt
 		if attempt == policy.MaxAttempts {
 			break
 		}
 
+		// The first time, retry at once on a new connection
+		if sessionLost && !reconnected {
+			reconnected = true
+			if fsys.config.Logger != nil {
+				fsys.config.Logger.Printf("Session lost (attempt %d/%d), reconnecting: %v",
+					attempt, policy.MaxAttempts, err)
+			}
+			continue
+		}
+
 		// Log retry attempt if logger is configured
 		if fsys.config.Logger != nil {
 			fsys.config.Logger.Printf("Operation failed (attempt %d/%d), retrying in %v: %v",
@@ -70,7 +205,7 @@ func (fsys *FileSystem) withRetry(ctx context.Context, operation func() error) e
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case <-time.After(delay):
+		case <-time.After(policy.jittered(delay)):
 		}
 
 		// Calculate next delay
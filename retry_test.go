@@ -3,8 +3,11 @@ package smbfs
 import (
 	"context"
 	"errors"
+	"io/fs"
 	"testing"
 	"time"
+
+	"github.com/absfs/smbfs/internal/smb2"
 )
 
 // mockNetError implements netError interface for testing.
@@ -277,3 +280,185 @@ func TestWithRetry_ExponentialBackoff(t *testing.T) {
 		t.Errorf("Third delay = %v, want ~200ms", delay3)
 	}
 }
+
+// retryTestFS returns a FileSystem whose retry policy allows three quick
+// attempts
+func retryTestFS(t *testing.T, retryable func(error) bool) *FileSystem {
+	t.Helper()
+	config := &Config{
+		Server:   "test",
+		Share:    "test",
+		Username: "test",
+		Password: "test",
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts:  3,
+			InitialDelay: time.Millisecond,
+			MaxDelay:     5 * time.Millisecond,
+			Multiplier:   2.0,
+			Retryable:    retryable,
+		},
+	}
+	config.setDefaults()
+	return &FileSystem{config: config, ctx: context.Background()}
+}
+
+func TestWithRetry_Classification(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantCalls int
+	}{
+		{"not found fails fast", wrapPathError("stat", "/missing", fs.ErrNotExist), 1},
+		{"access denied fails fast", &smb2.ResponseError{Code: uint32(STATUS_ACCESS_DENIED)}, 1},
+		{"sharing violation fails fast", &smb2.ResponseError{Code: uint32(STATUS_SHARING_VIOLATION)}, 1},
+		{"timeout retries", &mockNetError{error: errors.New("i/o timeout"), timeout: true}, 3},
+		{"insufficient resources retries", &smb2.ResponseError{Code: uint32(STATUS_INSUFFICIENT_RESOURCES)}, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := retryTestFS(t, nil)
+			calls := 0
+			err := fsys.withRetry(context.Background(), func() error {
+				calls++
+				return tt.err
+			})
+			if err != tt.err {
+				t.Errorf("withRetry() error = %v, want %v", err, tt.err)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("operation called %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestWithRetry_CustomRetryable(t *testing.T) {
+	// Retry sharing violations, which another client's handle may clear
+	fsys := retryTestFS(t, func(err error) bool {
+		var respErr *smb2.ResponseError
+		return errors.As(err, &respErr) && NTStatus(respErr.Code) == STATUS_SHARING_VIOLATION
+	})
+
+	calls := 0
+	err := fsys.withRetry(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return &smb2.ResponseError{Code: uint32(STATUS_SHARING_VIOLATION)}
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("withRetry() = %v after %d calls, want success after 3", err, calls)
+	}
+
+	// The override replaces the default classification entirely
+	calls = 0
+	fsys.withRetry(context.Background(), func() error {
+		calls++
+		return ErrConnectionClosed
+	})
+	if calls != 1 {
+		t.Errorf("operation called %d times for an error the override rejects, want 1", calls)
+	}
+}
+
+func TestRetryPolicy_Jitter(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	tests := []struct {
+		jitter   float64
+		min, max time.Duration
+	}{
+		{0, delay, delay},
+		{0.25, 75 * time.Millisecond, 125 * time.Millisecond},
+		{1, 0, 2 * delay},
+		{2, 0, 2 * delay}, // Clamped to 1
+		{-1, delay, delay},
+	}
+	for _, tt := range tests {
+		p := &RetryPolicy{Jitter: tt.jitter}
+		seen := make(map[time.Duration]bool)
+		for i := 0; i < 1000; i++ {
+			d := p.jittered(delay)
+			if d < tt.min || d > tt.max {
+				t.Fatalf("jittered(%v) with Jitter %v = %v, want within [%v, %v]", delay, tt.jitter, d, tt.min, tt.max)
+			}
+			seen[d] = true
+		}
+		if tt.min != tt.max && len(seen) < 10 {
+			t.Errorf("jittered(%v) with Jitter %v gave only %d distinct delays", delay, tt.jitter, len(seen))
+		}
+	}
+}
+
+func TestWithRetry_CircuitBreaker(t *testing.T) {
+	breaker := &CircuitBreaker{Failures: 3, Cooldown: 50 * time.Millisecond}
+	fsys := retryTestFS(t, nil)
+	fsys.config.RetryPolicy.MaxAttempts = 1
+	fsys.config.RetryPolicy.CircuitBreaker = breaker
+
+	calls := 0
+	transient := func() error {
+		calls++
+		return &mockNetError{error: errors.New("temp error"), temporary: true}
+	}
+	succeed := func() error {
+		calls++
+		return nil
+	}
+
+	// Errors the policy would not retry do not count
+	for i := 0; i < 5; i++ {
+		fsys.withRetry(context.Background(), func() error { return fs.ErrNotExist })
+	}
+	for i := 0; i < 3; i++ {
+		if err := fsys.withRetry(context.Background(), transient); errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("failure %d error = %v, want the operation's error", i+1, err)
+		}
+	}
+
+	// Open: operations are not attempted
+	calls = 0
+	if err := fsys.withRetry(context.Background(), succeed); !errors.Is(err, ErrCircuitOpen) || calls != 0 {
+		t.Fatalf("withRetry() on an open breaker = %v with %d calls, want ErrCircuitOpen and none", err, calls)
+	}
+
+	// Half-open after the cooldown: a failing probe reopens the breaker
+	time.Sleep(60 * time.Millisecond)
+	if err := fsys.withRetry(context.Background(), transient); errors.Is(err, ErrCircuitOpen) || calls != 1 {
+		t.Fatalf("probe after cooldown = %v with %d calls, want the operation's error", err, calls)
+	}
+	if err := fsys.withRetry(context.Background(), succeed); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("withRetry() after a failed probe error = %v, want ErrCircuitOpen", err)
+	}
+
+	// A successful probe closes it
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if err := fsys.withRetry(context.Background(), succeed); err != nil {
+			t.Fatalf("withRetry() #%d after a successful probe error = %v", i+1, err)
+		}
+	}
+}
+
+func TestCircuitBreaker_Window(t *testing.T) {
+	breaker := &CircuitBreaker{Failures: 2, Window: 20 * time.Millisecond, Cooldown: time.Hour}
+
+	// Failures further apart than the window never add up
+	for i := 0; i < 3; i++ {
+		breaker.record(true)
+		time.Sleep(30 * time.Millisecond)
+	}
+	if err := breaker.allow(); err != nil {
+		t.Fatalf("allow() after spread out failures = %v, want nil", err)
+	}
+
+	breaker.record(true)
+	if err := breaker.allow(); err != nil {
+		t.Fatalf("allow() after one failure = %v, want nil", err)
+	}
+	breaker.record(true)
+	if err := breaker.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("allow() after failures within the window = %v, want ErrCircuitOpen", err)
+	}
+}
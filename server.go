@@ -3,12 +3,16 @@ package smbfs
 import (
 	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/absfs/absfs"
@@ -20,9 +24,9 @@ type Server struct {
 	shares   map[string]*Share
 	sharesMu sync.RWMutex
 
-	listener net.Listener
-	handler  *SMBHandler
-	sessions *SessionManager
+	listeners []net.Listener
+	handler   *SMBHandler
+	sessions  *SessionManager
 
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -32,7 +36,29 @@ type Server struct {
 	connMu     sync.Mutex
 	conns      map[net.Conn]*connState
 	connCount  int
+	connsPerIP map[string]int // Open connections by remote host
 	shutdownCh chan struct{}
+	drainCh    chan struct{} // Closed when Shutdown starts draining
+	drainOnce  sync.Once
+	stopOnce   sync.Once
+
+	// Directory leases
+	leases *LeaseTable
+
+	// CHANGE_NOTIFY watches
+	notify *notifyManager
+
+	// Requests answered with STATUS_PENDING
+	async *asyncTable
+
+	// Fault injection (nil unless EnableChaos)
+	chaos *chaosInjector
+
+	// Activity counters (see server_metrics.go)
+	counters serverCounters
+
+	// Set while every share is read-only (see SetGlobalReadOnly)
+	readOnly atomic.Bool
 
 	logger ServerLogger
 }
@@ -46,6 +72,27 @@ type connState struct {
 	dialect         SMBDialect // Negotiated dialect
 	signingRequired bool       // Whether signing is required for this connection
 	preauthHash     []byte     // SMB 3.1.1 preauth integrity hash (for key derivation)
+	clientGUID      [16]byte   // ClientGuid from NEGOTIATE (scopes lease keys)
+	cipherID        uint16     // Cipher the client can use (0 if it cannot encrypt)
+	compressionAlg  uint16     // Compression algorithm negotiated (SMB2_COMPRESSION_NONE if none)
+	writeMu         sync.Mutex // Serializes responses and unsolicited notifications
+	creditsGranted  uint64     // Credits granted in responses (see smb2_credits.go)
+	creditsCharged  uint64     // Credits spent by requests
+
+	// Request rate limiting (see server_limits.go)
+	rateTokens  float64
+	rateUpdated time.Time
+
+	// Request draining (see server_shutdown.go)
+	drainMu  sync.Mutex
+	inFlight int  // Requests being handled
+	closing  bool // Shutdown has closed the connection
+
+	// Reported by Server.Connections (see server_connections.go). These,
+	// and writes of dialect, are guarded by Server.connMu
+	connectedAt time.Time
+	username    string              // User of the latest session
+	sessionIDs  map[uint64]struct{} // Sessions set up on the connection
 }
 
 // NewServer creates a new SMB server
@@ -54,8 +101,14 @@ func NewServer(options ServerOptions) (*Server, error) {
 	if options.Port == 0 {
 		options.Port = 445
 	}
+	if options.Network == "" {
+		options.Network = "tcp"
+	}
 	if options.Hostname == "" {
 		options.Hostname = "0.0.0.0"
+		if options.Network == "tcp6" {
+			options.Hostname = "::"
+		}
 	}
 	if options.MinDialect == 0 {
 		options.MinDialect = SMB2_0_2
@@ -78,6 +131,15 @@ func NewServer(options ServerOptions) (*Server, error) {
 	if options.MaxWriteSize == 0 {
 		options.MaxWriteSize = MaxWriteSize
 	}
+	if options.MaxCredits == 0 {
+		options.MaxCredits = defaultMaxCredits
+	}
+	if options.ChangeNotifyInterval == 0 {
+		options.ChangeNotifyInterval = 2 * time.Second
+	}
+	if options.DurableHandleTimeout == 0 {
+		options.DurableHandleTimeout = defaultDurableHandleTimeout
+	}
 
 	// Generate server GUID if not provided
 	if options.ServerGUID == [16]byte{} {
@@ -101,11 +163,26 @@ func NewServer(options ServerOptions) (*Server, error) {
 		ctx:        ctx,
 		cancel:     cancel,
 		conns:      make(map[net.Conn]*connState),
+		connsPerIP: make(map[string]int),
 		shutdownCh: make(chan struct{}),
+		drainCh:    make(chan struct{}),
+		leases:     NewLeaseTable(),
 		logger:     logger,
 	}
 
+	s.readOnly.Store(options.GlobalReadOnly)
 	s.handler = NewSMBHandler(s)
+	s.notify = newNotifyManager(s)
+	s.async = newAsyncTable()
+
+	if options.Chaos != nil {
+		if options.EnableChaos {
+			s.chaos = newChaosInjector(options.Chaos)
+			logger.Warn("Fault injection enabled; this server will misbehave deliberately")
+		} else {
+			logger.Warn("Chaos configuration ignored: EnableChaos is not set")
+		}
+	}
 
 	// Automatically add IPC$ share (required by Windows)
 	s.addIPCShare()
@@ -131,8 +208,8 @@ func (s *Server) addIPCShare() {
 
 // AddShare registers a new share backed by an absfs.FileSystem
 func (s *Server) AddShare(fs absfs.FileSystem, options ShareOptions) error {
-	if options.ShareName == "" {
-		return errors.New("share name is required")
+	if err := validateShareOptions(options); err != nil {
+		return err
 	}
 
 	// Normalize share name to uppercase (SMB convention)
@@ -154,6 +231,102 @@ func (s *Server) AddShare(fs absfs.FileSystem, options ShareOptions) error {
 	return nil
 }
 
+// validateShareOptions checks the options of a share being added or
+// replaced
+func validateShareOptions(options ShareOptions) error {
+	if options.ShareName == "" {
+		return errors.New("share name is required")
+	}
+	if options.MaxFileSize < 0 {
+		return fmt.Errorf("invalid maximum file size %d", options.MaxFileSize)
+	}
+	switch options.CachingMode {
+	case CachingModeManual, CachingModeAuto, CachingModeVDO, CachingModeNone:
+	default:
+		return fmt.Errorf("invalid caching mode 0x%x", uint32(options.CachingMode))
+	}
+	if options.MaxBytesPerSecPerSession < 0 {
+		return fmt.Errorf("invalid bandwidth limit %d", options.MaxBytesPerSecPerSession)
+	}
+	if align := options.AlignmentRequirement; align > FILE_512_BYTE_ALIGNMENT || align&(align+1) != 0 {
+		return fmt.Errorf("invalid alignment requirement 0x%x", align)
+	}
+	for link, target := range options.DFSLinks {
+		if _, _, _, ok := splitDFSPath(target); !ok || strings.Trim(link, "/\\") == "" {
+			return fmt.Errorf("invalid DFS link %q -> %q", link, target)
+		}
+	}
+	return nil
+}
+
+// ReplaceShare swaps the filesystem and options of a share, for example to
+// point it at a new snapshot, leaving the sessions and tree connects using
+// it in place. Opens from then on use fs. Handles already open keep using
+// the old filesystem until they are closed, unless
+// options.CloseOpenFilesOnReplace is set: then they are closed, and
+// requests on them fail with STATUS_FILE_CLOSED
+func (s *Server) ReplaceShare(shareName string, fs absfs.FileSystem, options ShareOptions) error {
+	if options.ShareName == "" {
+		options.ShareName = shareName
+	}
+	if options.ShareName != shareName {
+		return fmt.Errorf("share options name %q does not match share %q", options.ShareName, shareName)
+	}
+	if err := validateShareOptions(options); err != nil {
+		return err
+	}
+
+	s.sharesMu.Lock()
+	share, exists := s.shares[shareName]
+	if !exists {
+		s.sharesMu.Unlock()
+		return fmt.Errorf("share %q not found", shareName)
+	}
+	if share.GetShareType() == SMBShareTypePipe {
+		s.sharesMu.Unlock()
+		return fmt.Errorf("share %q has no filesystem to replace", shareName)
+	}
+	share.mu.Lock()
+	share.fs = fs
+	share.options = options
+	share.mu.Unlock()
+	s.sharesMu.Unlock()
+
+	// Remembered creation times belong to the old filesystem's files
+	share.birthMu.Lock()
+	share.birthtimes = nil
+	share.birthMu.Unlock()
+	share.archive.mu.Lock()
+	share.archive.cleared = nil
+	share.archive.mu.Unlock()
+	share.resetFileIDs()
+	share.forgetCaseNames()
+	share.forgetUsage()
+
+	s.logger.Info("Replaced share: %s (path: %s, readonly: %v, guest: %v)",
+		shareName, options.SharePath, options.ReadOnly, options.AllowGuest)
+
+	if options.CloseOpenFilesOnReplace {
+		s.closeShareHandles(share)
+	}
+	return nil
+}
+
+// closeShareHandles closes every handle open on a share, as CLOSE would
+// but without deleting delete-on-close files
+func (s *Server) closeShareHandles(share *Share) {
+	for _, of := range share.fileHandles.all() {
+		if of.IsDir {
+			s.handler.clearDirState(of)
+		}
+		s.leases.Release(of.Lease)
+		s.notify.closeHandle(share, of.ID)
+		if err := share.fileHandles.Release(of.ID); err != nil {
+			s.logger.Warn("Failed to close %s on share %s: %v", of.Path, share.Options().ShareName, err)
+		}
+	}
+}
+
 // RemoveShare removes a share
 func (s *Server) RemoveShare(shareName string) error {
 	s.sharesMu.Lock()
@@ -182,36 +355,82 @@ func (s *Server) ListShares() []string {
 
 	names := make([]string, 0, len(s.shares))
 	for name, share := range s.shares {
-		if !share.options.Hidden {
+		if !share.Options().Hidden {
 			names = append(names, name)
 		}
 	}
 	return names
 }
 
-// Listen starts the server and begins accepting connections
-func (s *Server) Listen() error {
-	addr := fmt.Sprintf("%s:%d", s.options.Hostname, s.options.Port)
+// shareList returns all shares, including hidden ones and IPC$
+func (s *Server) shareList() []*Share {
+	s.sharesMu.RLock()
+	defer s.sharesMu.RUnlock()
 
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	shares := make([]*Share, 0, len(s.shares))
+	for _, share := range s.shares {
+		shares = append(shares, share)
 	}
+	return shares
+}
 
-	s.listener = listener
-	s.logger.Info("SMB server listening on %s", addr)
+// Listen starts the server and begins accepting connections on each of its
+// listeners. If any of them cannot be opened, none are
+func (s *Server) Listen() error {
+	configs := s.options.Listeners
+	if len(configs) == 0 {
+		configs = []ListenerConfig{{
+			Network: s.options.Network,
+			Address: net.JoinHostPort(unbracketHost(s.options.Hostname), strconv.Itoa(s.options.Port)),
+		}}
+	}
+
+	listeners := make([]net.Listener, 0, len(configs))
+	for _, lc := range configs {
+		listener, err := lc.listen()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, listener)
+		s.logger.Info("SMB server listening on %s", listener.Addr())
+	}
+	s.listeners = listeners
 
 	// Start session cleanup goroutine
 	s.wg.Add(1)
 	go s.sessionCleanupLoop()
 
 	// Accept connections
-	s.wg.Add(1)
-	go s.acceptLoop()
+	for _, listener := range listeners {
+		s.wg.Add(1)
+		go s.acceptLoop(listener)
+	}
 
 	return nil
 }
 
+// listen opens the listener lc describes
+func (lc ListenerConfig) listen() (net.Listener, error) {
+	network := lc.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if !isTCPNetwork(network) {
+		return nil, fmt.Errorf("invalid network %q (expected tcp, tcp4 or tcp6)", network)
+	}
+	listener, err := net.Listen(network, lc.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", lc.Address, err)
+	}
+	if lc.TLSConfig != nil {
+		listener = tls.NewListener(listener, lc.TLSConfig)
+	}
+	return listener, nil
+}
+
 // ListenAndServe starts the server and blocks until shutdown
 func (s *Server) ListenAndServe() error {
 	if err := s.Listen(); err != nil {
@@ -221,26 +440,69 @@ func (s *Server) ListenAndServe() error {
 	return nil
 }
 
-// Addr returns the server's listening address
+// ListenAndServeContext is ListenAndServe tied to ctx, for running the
+// server alongside other work, as in an errgroup. When ctx ends the server
+// shuts down gracefully, giving requests in flight contextShutdownTimeout
+// to be answered, and the result of Shutdown is returned: nil unless that
+// ran out. It returns nil at once if the server is stopped some other way
+func (s *Server) ListenAndServeContext(ctx context.Context) error {
+	if err := s.Listen(); err != nil {
+		return err
+	}
+
+	select {
+	case <-s.ctx.Done():
+		return nil
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), contextShutdownTimeout)
+	defer cancel()
+	return s.Shutdown(shutdownCtx)
+}
+
+// Addr returns the server's listening address, the first one if it has
+// several
 func (s *Server) Addr() net.Addr {
-	if s.listener != nil {
-		return s.listener.Addr()
+	if len(s.listeners) > 0 {
+		return s.listeners[0].Addr()
 	}
 	return nil
 }
 
-// Stop gracefully shuts down the server
+// Addrs returns the addresses of all the server's listeners, in the order
+// of ServerOptions.Listeners
+func (s *Server) Addrs() []net.Addr {
+	addrs := make([]net.Addr, len(s.listeners))
+	for i, listener := range s.listeners {
+		addrs[i] = listener.Addr()
+	}
+	return addrs
+}
+
+// closeListeners stops accepting connections
+func (s *Server) closeListeners() {
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+}
+
+// Stop shuts down the server immediately, closing connections whether or not
+// they have requests in flight. Use Shutdown to drain them first
 func (s *Server) Stop() error {
+	s.stopOnce.Do(s.stop)
+	return nil
+}
+
+func (s *Server) stop() {
 	s.logger.Info("Shutting down SMB server...")
 
 	// Signal shutdown
 	s.cancel()
 	close(s.shutdownCh)
 
-	// Close listener
-	if s.listener != nil {
-		s.listener.Close()
-	}
+	// Close listeners
+	s.closeListeners()
 
 	// Close all connections
 	s.connMu.Lock()
@@ -253,37 +515,30 @@ func (s *Server) Stop() error {
 	s.wg.Wait()
 
 	s.logger.Info("SMB server stopped")
-	return nil
 }
 
-// acceptLoop accepts new connections
-func (s *Server) acceptLoop() {
+// acceptLoop accepts new connections from listener
+func (s *Server) acceptLoop(listener net.Listener) {
 	defer s.wg.Done()
 
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			select {
 			case <-s.ctx.Done():
 				return
+			case <-s.drainCh:
+				return
 			default:
 				s.logger.Error("Accept error: %v", err)
 				continue
 			}
 		}
 
-		// Check connection limit
-		if s.options.MaxConnections > 0 {
-			s.connMu.Lock()
-			if s.connCount >= s.options.MaxConnections {
-				s.connMu.Unlock()
-				s.logger.Warn("Connection limit reached, rejecting connection from %s",
-					conn.RemoteAddr())
-				conn.Close()
-				continue
-			}
-			s.connCount++
-			s.connMu.Unlock()
+		// Check connection limits
+		if !s.admitConnection(remoteHost(conn.RemoteAddr())) {
+			conn.Close()
+			continue
 		}
 
 		// Handle connection
@@ -295,32 +550,47 @@ func (s *Server) acceptLoop() {
 // handleConnection processes SMB messages from a connection
 func (s *Server) handleConnection(conn net.Conn) {
 	defer s.wg.Done()
-	defer func() {
-		conn.Close()
-		s.connMu.Lock()
-		delete(s.conns, conn)
-		s.connCount--
-		s.connMu.Unlock()
-	}()
 
 	remoteAddr := conn.RemoteAddr().String()
 	s.logger.Debug("New connection from %s", remoteAddr)
 
-	// Track connection
+	// Track connection, counting its traffic for Connections
+	conn = &countingConn{Conn: conn}
 	state := &connState{
-		conn:       conn,
-		lastActive: time.Now(),
-		remoteAddr: remoteAddr,
+		conn:        conn,
+		lastActive:  time.Now(),
+		remoteAddr:  remoteAddr,
+		connectedAt: time.Now(),
 	}
+	defer func() {
+		conn.Close()
+		if state.session != nil {
+			s.disconnectDurableHandles(state.session.ID)
+		}
+		s.leases.ReleaseConn(state)
+		s.notify.releaseConn(state)
+		s.async.releaseConn(state)
+		s.connMu.Lock()
+		delete(s.conns, conn)
+		s.releaseConnectionLocked(remoteHost(conn.RemoteAddr()))
+		s.connMu.Unlock()
+	}()
 	s.connMu.Lock()
 	s.conns[conn] = state
 	s.connMu.Unlock()
 
+	if s.chaos.dropConnection() {
+		s.logger.Debug("Chaos: dropping connection from %s", remoteAddr)
+		return
+	}
+
 	// Message processing loop
 	for {
 		select {
 		case <-s.ctx.Done():
 			return
+		case <-s.drainCh:
+			return
 		default:
 		}
 
@@ -334,52 +604,91 @@ func (s *Server) handleConnection(conn net.Conn) {
 				s.logger.Debug("Connection closed: %s", remoteAddr)
 			} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				s.logger.Debug("Connection timeout: %s", remoteAddr)
+			} else if errors.Is(err, ErrSMB1Rejected) {
+				s.logger.Warn("Rejected SMB1 client %s", remoteAddr)
 			} else {
 				s.logger.Error("Read error from %s: %v", remoteAddr, err)
 			}
 			return
 		}
 
-		// Update activity
-		state.lastActive = time.Now()
+		// Requests already being handled finish before Shutdown closes the
+		// connection, but no new ones are started
+		if !state.beginRequest() {
+			return
+		}
+		ok := s.processMessage(state, msg)
+		state.endRequest()
+		if !ok {
+			return
+		}
+	}
+}
 
-		// For SMB 3.1.1, update preauth hash with request (NEGOTIATE or SESSION_SETUP before auth complete)
-		if state.dialect >= SMB3_1_1 || msg.Header.Command == SMB2_NEGOTIATE {
-			if msg.Header.Command == SMB2_NEGOTIATE ||
-				(msg.Header.Command == SMB2_SESSION_SETUP && (state.session == nil || state.session.State != SessionStateValid)) {
-				state.preauthHash = UpdatePreauthHash(state.preauthHash, msg.RawBytes)
-			}
+// processMessage handles one request and sends its response, reporting
+// whether the connection should stay open
+func (s *Server) processMessage(state *connState, msg *SMB2Message) bool {
+	remoteAddr := state.remoteAddr
+
+	// Update activity
+	state.lastActive = time.Now()
+
+	// For SMB 3.1.1, update preauth hash with request (NEGOTIATE or SESSION_SETUP before auth complete)
+	if state.dialect >= SMB3_1_1 || msg.Header.Command == SMB2_NEGOTIATE {
+		if msg.Header.Command == SMB2_NEGOTIATE ||
+			(msg.Header.Command == SMB2_SESSION_SETUP && (state.session == nil || state.session.State != SessionStateValid)) {
+			state.preauthHash = UpdatePreauthHash(state.preauthHash, msg.RawBytes)
 		}
+	}
 
-		// Handle message
-		response, err := s.handler.HandleMessage(state, msg)
+	// Compound requests are answered with one compound response
+	if msg.Header.NextCommand != 0 {
+		msgs, err := splitCompound(msg)
+		if err != nil {
+			s.logger.Error("Invalid compound request from %s: %v", remoteAddr, err)
+			return false
+		}
+		responses, err := s.handler.handleCompound(state, msgs)
 		if err != nil {
 			s.logger.Error("Handle error from %s: %v", remoteAddr, err)
-			// Send error response if possible
-			if response != nil {
-				_, _ = s.writeMessage(conn, response)
+		}
+		if len(responses) > 0 {
+			if _, err := s.sendCompound(state, responses); err != nil {
+				s.logger.Error("Write error to %s: %v", remoteAddr, err)
+				return false
 			}
-			continue
 		}
+		return true
+	}
 
-		// Send response
+	// Handle message
+	response, err := s.handler.HandleMessage(state, msg)
+	if err != nil {
+		s.logger.Error("Handle error from %s: %v", remoteAddr, err)
+		// Send error response if possible
 		if response != nil {
-			conn.SetWriteDeadline(time.Now().Add(s.options.WriteTimeout))
-			responseBytes, err := s.writeMessage(conn, response)
-			if err != nil {
-				s.logger.Error("Write error to %s: %v", remoteAddr, err)
-				return
-			}
+			_, _ = s.sendMessage(state, response)
+		}
+		return true
+	}
 
-			// For SMB 3.1.1, update preauth hash with response (NEGOTIATE or SESSION_SETUP before auth complete)
-			if state.dialect >= SMB3_1_1 {
-				if response.Header.Command == SMB2_NEGOTIATE ||
-					(response.Header.Command == SMB2_SESSION_SETUP && response.Header.Status != STATUS_SUCCESS) {
-					state.preauthHash = UpdatePreauthHash(state.preauthHash, responseBytes)
-				}
+	// Send response
+	if response != nil {
+		responseBytes, err := s.sendMessage(state, response)
+		if err != nil {
+			s.logger.Error("Write error to %s: %v", remoteAddr, err)
+			return false
+		}
+
+		// For SMB 3.1.1, update preauth hash with response (NEGOTIATE or SESSION_SETUP before auth complete)
+		if state.dialect >= SMB3_1_1 {
+			if response.Header.Command == SMB2_NEGOTIATE ||
+				(response.Header.Command == SMB2_SESSION_SETUP && response.Header.Status != STATUS_SUCCESS) {
+				state.preauthHash = UpdatePreauthHash(state.preauthHash, responseBytes)
 			}
 		}
 	}
+	return true
 }
 
 // readMessage reads an SMB2 message from the connection
@@ -405,10 +714,46 @@ func (s *Server) readMessage(conn net.Conn) (*SMB2Message, error) {
 		return nil, err
 	}
 
+	// Unwrap encrypted messages with the keys of the session they name
+	encrypted := IsTransformMessage(msgData)
+	if encrypted {
+		th, err := UnmarshalTransformHeader(msgData)
+		if err != nil {
+			return nil, err
+		}
+		session := s.sessions.GetSession(th.SessionID)
+		if session == nil || session.DecryptionKey == nil {
+			return nil, ErrDecryptionFailed
+		}
+		if msgData, err = DecryptMessage(msgData, session.DecryptionKey, session.CipherID); err != nil {
+			return nil, err
+		}
+		if len(msgData) < SMB2HeaderSize {
+			return nil, ErrInvalidMessage
+		}
+	}
+
+	// Decompress compressed messages, which may also have been encrypted
+	if IsCompressedMessage(msgData) {
+		if !s.options.EnableCompression {
+			return nil, ErrInvalidMessage
+		}
+		var err error
+		if msgData, err = DecompressMessage(msgData, MaxTransactSize+int(s.options.MaxWriteSize)); err != nil {
+			return nil, err
+		}
+		if len(msgData) < SMB2HeaderSize {
+			return nil, ErrInvalidMessage
+		}
+	}
+
 	// Verify protocol signature
 	if string(msgData[0:4]) != SMB2ProtocolID {
 		// Check for SMB1 NEGOTIATE (0xFF 'S' 'M' 'B')
 		if msgData[0] == 0xFF && string(msgData[1:4]) == "SMB" {
+			if s.options.SMB1Policy == SMB1Reject {
+				return nil, s.rejectSMB1(conn, msgData)
+			}
 			return s.handleSMB1Negotiate(msgData)
 		}
 		return nil, ErrInvalidMessage
@@ -424,9 +769,10 @@ func (s *Server) readMessage(conn net.Conn) (*SMB2Message, error) {
 	payload := msgData[SMB2HeaderSize:]
 
 	return &SMB2Message{
-		Header:   header,
-		Payload:  payload,
-		RawBytes: msgData, // Store raw bytes for preauth hash computation
+		Header:    header,
+		Payload:   payload,
+		RawBytes:  msgData, // Store raw bytes for preauth hash computation
+		Encrypted: encrypted,
 	}, nil
 }
 
@@ -448,37 +794,53 @@ func (s *Server) handleSMB1Negotiate(data []byte) (*SMB2Message, error) {
 	}, nil
 }
 
-// writeMessage writes an SMB2 message to the connection
-// Returns the raw SMB2 message bytes (without NetBIOS header) for preauth hash computation
-func (s *Server) writeMessage(conn net.Conn, msg *SMB2Message) ([]byte, error) {
-	// Marshal the message
-	headerBytes := msg.Header.Marshal()
-	msgLen := len(headerBytes) + len(msg.Payload)
+// SMB1 header size and the NEGOTIATE command code (MS-CIFS 2.2.3.1)
+const (
+	smb1HeaderSize   = 32
+	smb1ComNegotiate = 0x72
+)
 
-	// Build NetBIOS header + SMB2 message
-	buf := make([]byte, 4+msgLen)
-	buf[0] = 0x00 // NetBIOS session message
-	buf[1] = byte(msgLen >> 16)
-	buf[2] = byte(msgLen >> 8)
-	buf[3] = byte(msgLen)
-	copy(buf[4:], headerBytes)
-	copy(buf[4+SMB2HeaderSize:], msg.Payload)
+// rejectSMB1 turns away an SMB1 client under SMB1Reject. A NEGOTIATE gets
+// a response with DialectIndex 0xFFFF, which tells the client none of its
+// dialects is supported, so it gives up rather than retrying
+func (s *Server) rejectSMB1(conn net.Conn, data []byte) error {
+	s.counters.smb1Rejected.Add(1)
+	if data[4] != smb1ComNegotiate {
+		return ErrSMB1Rejected
+	}
+
+	// The request header with the reply flag set and a success status,
+	// then WordCount 1, DialectIndex 0xFFFF and ByteCount 0
+	resp := make([]byte, 4+smb1HeaderSize+5)
+	size := len(resp) - 4
+	resp[1], resp[2], resp[3] = byte(size>>16), byte(size>>8), byte(size)
+	hdr := resp[4 : 4+smb1HeaderSize]
+	copy(hdr, data[:smb1HeaderSize])
+	clear(hdr[5:9]) // Status
+	hdr[9] |= 0x80  // SMB_FLAGS_REPLY
+	body := resp[4+smb1HeaderSize:]
+	body[0] = 1
+	binary.LittleEndian.PutUint16(body[1:], 0xFFFF)
+
+	conn.SetWriteDeadline(time.Now().Add(s.options.WriteTimeout))
+	conn.Write(resp)
+	return ErrSMB1Rejected
+}
 
-	// Apply message signing if signing key is set
-	if msg.SigningKey != nil && len(msg.SigningKey) > 0 {
-		// Sign the SMB2 message (everything after NetBIOS header)
-		smb2Message := buf[4:]
-		signature := SignMessage(smb2Message, msg.SigningKey, msg.Dialect)
-		if signature != nil {
-			// Apply signature to the buffer
-			ApplySignature(smb2Message, signature)
-			s.logger.Debug("Applied message signature (dialect=%s)", msg.Dialect.String())
-		}
-	}
+// sendMessage writes a message to a connection, serializing it with any
+// other writer (such as a lease break notification) on the same connection
+func (s *Server) sendMessage(state *connState, msg *SMB2Message) ([]byte, error) {
+	state.writeMu.Lock()
+	defer state.writeMu.Unlock()
 
-	_, err := conn.Write(buf)
-	// Return SMB2 message bytes (without NetBIOS header) for preauth hash
-	return buf[4:], err
+	state.conn.SetWriteDeadline(time.Now().Add(s.options.WriteTimeout))
+	return s.writeMessage(state.conn, msg)
+}
+
+// writeMessage writes an SMB2 message to the connection
+// Returns the raw SMB2 message bytes (without NetBIOS header) for preauth hash computation
+func (s *Server) writeMessage(conn net.Conn, msg *SMB2Message) ([]byte, error) {
+	return s.writeCompound(conn, []*SMB2Message{msg})
 }
 
 // sessionCleanupLoop periodically cleans up expired sessions
@@ -493,16 +855,40 @@ func (s *Server) sessionCleanupLoop() {
 		case <-s.ctx.Done():
 			return
 		case <-ticker.C:
-			expired := s.sessions.CleanupExpired()
-			for _, session := range expired {
-				s.logger.Debug("Cleaned up expired session: %d", session.ID)
-				// Clean up file handles for this session
-				for _, share := range s.shares {
-					share.fileHandles.ReleaseBySession(session.ID)
-				}
-			}
+			s.cleanupExpiredSessions()
+		}
+	}
+}
+
+// cleanupExpiredSessions removes idle sessions and the handles opened
+// through them
+func (s *Server) cleanupExpiredSessions() {
+	expired := s.sessions.CleanupExpired()
+	for _, session := range expired {
+		s.logger.Debug("Cleaned up expired session: %d", session.ID)
+		s.notify.releaseSession(session.ID)
+		// Clean up file handles for this session, keeping durable ones
+		s.disconnectDurableHandles(session.ID)
+		for _, share := range s.shareList() {
+			share.fileHandles.ReleaseBySession(session.ID)
 		}
 	}
+	s.closeExpiredDurableHandles(time.Now())
+}
+
+// SetGlobalReadOnly makes every share read-only, or lifts that, while the
+// server runs. Open handles are affected too: while the server is
+// read-only, writes through handles opened before fail, and files marked
+// for deletion when closed are kept
+func (s *Server) SetGlobalReadOnly(readOnly bool) {
+	if s.readOnly.Swap(readOnly) != readOnly {
+		s.logger.Info("Server read-only: %v", readOnly)
+	}
+}
+
+// GlobalReadOnly reports whether every share is read-only
+func (s *Server) GlobalReadOnly() bool {
+	return s.readOnly.Load()
 }
 
 // Options returns the server options
@@ -536,6 +922,7 @@ func (s *Server) SessionCount() int {
 var (
 	ErrInvalidMessage = errors.New("invalid SMB message")
 	ErrServerClosed   = errors.New("server closed")
+	ErrSMB1Rejected   = errors.New("SMB1 client rejected")
 )
 
 // generateMessageID generates a random message ID
@@ -0,0 +1,86 @@
+package smbfs
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ChaosConfig injects faults into the server so client retry, timeout and
+// reconnect handling can be exercised against a flaky peer
+// It is for tests only and has no effect unless ServerOptions.EnableChaos is set
+type ChaosConfig struct {
+	Faults   map[uint16]ChaosFault // Faults keyed by SMB2 command (e.g. SMB2_CREATE)
+	DropRate float64               // Fraction of new connections closed immediately (0.0-1.0)
+	Seed     int64                 // Seed for DropRate decisions (0 = time-based)
+}
+
+// ChaosFault describes the fault injected for one SMB2 command
+type ChaosFault struct {
+	Delay  time.Duration // Delay before the command is handled
+	Status NTStatus      // Status returned instead of handling the command (0 = handle normally)
+	Drop   bool          // Close the connection instead of responding
+	Count  int           // Number of requests affected (0 = every request)
+}
+
+// chaosInjector applies a ChaosConfig to incoming connections and requests
+type chaosInjector struct {
+	mu       sync.Mutex
+	faults   map[uint16]ChaosFault
+	fired    map[uint16]int
+	dropRate float64
+	rng      *rand.Rand
+}
+
+// newChaosInjector creates an injector for config
+func newChaosInjector(config *ChaosConfig) *chaosInjector {
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	faults := make(map[uint16]ChaosFault, len(config.Faults))
+	for cmd, fault := range config.Faults {
+		faults[cmd] = fault
+	}
+
+	return &chaosInjector{
+		faults:   faults,
+		fired:    make(map[uint16]int),
+		dropRate: config.DropRate,
+		rng:      rand.New(rand.NewSource(seed)),
+	}
+}
+
+// dropConnection reports whether a newly accepted connection should be closed
+func (c *chaosInjector) dropConnection() bool {
+	if c == nil || c.dropRate <= 0 {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rng.Float64() < c.dropRate
+}
+
+// faultFor returns the fault to inject for a request, if any
+func (c *chaosInjector) faultFor(cmd uint16) (ChaosFault, bool) {
+	if c == nil {
+		return ChaosFault{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fault, ok := c.faults[cmd]
+	if !ok {
+		return ChaosFault{}, false
+	}
+	if fault.Count > 0 {
+		if c.fired[cmd] >= fault.Count {
+			return ChaosFault{}, false
+		}
+		c.fired[cmd]++
+	}
+	return fault, true
+}
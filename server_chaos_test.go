@@ -0,0 +1,195 @@
+package smbfs
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/absfs/memfs"
+)
+
+// startLoopbackServer starts a server on a free localhost port exporting a
+// memfs share "data" that contains /hello.txt, and returns a client config for it
+func startLoopbackServer(t testing.TB, opts ServerOptions) (*Server, *Config) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to reserve port: %v", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	opts.Hostname = "127.0.0.1"
+	opts.Port = port
+	opts.Users = map[string]string{"tester": "secret"}
+	if opts.Logger == nil {
+		opts.Logger = &NullLogger{}
+	}
+
+	srv, err := NewServer(opts)
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+	f, err := mfs.Create("/hello.txt")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	f.Write([]byte("hello"))
+	f.Close()
+
+	if err := srv.AddShare(mfs, ShareOptions{ShareName: "data"}); err != nil {
+		t.Fatalf("AddShare() error = %v", err)
+	}
+	if err := srv.Listen(); err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { srv.Stop() })
+
+	return srv, &Config{
+		Server:   "127.0.0.1",
+		Port:     port,
+		Share:    "data",
+		Username: "tester",
+		Password: "secret",
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts:  5,
+			InitialDelay: time.Millisecond,
+			MaxDelay:     10 * time.Millisecond,
+			Multiplier:   2.0,
+		},
+	}
+}
+
+// TestChaos_RequiresEnableChaos tests that a chaos configuration alone has no effect
+func TestChaos_RequiresEnableChaos(t *testing.T) {
+	srv, err := NewServer(ServerOptions{
+		Logger: &NullLogger{},
+		Chaos:  &ChaosConfig{DropRate: 1.0},
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	if srv.chaos != nil {
+		t.Error("Chaos enabled without EnableChaos")
+	}
+	if srv.chaos.dropConnection() {
+		t.Error("dropConnection() = true with chaos disabled")
+	}
+}
+
+// TestChaos_InjectedStatus tests that injected errors replace handling for Count requests
+func TestChaos_InjectedStatus(t *testing.T) {
+	srv, err := NewServer(ServerOptions{
+		Logger:      &NullLogger{},
+		EnableChaos: true,
+		Chaos: &ChaosConfig{Faults: map[uint16]ChaosFault{
+			SMB2_ECHO: {Status: STATUS_INSUFFICIENT_RESOURCES, Count: 2},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	echo := func() NTStatus {
+		t.Helper()
+		msg := &SMB2Message{
+			Header:  &SMB2Header{Command: SMB2_ECHO},
+			Payload: []byte{4, 0, 0, 0},
+		}
+		resp, err := srv.handler.HandleMessage(&connState{}, msg)
+		if err != nil {
+			t.Fatalf("HandleMessage() error = %v", err)
+		}
+		return resp.Header.Status
+	}
+
+	for i := 0; i < 2; i++ {
+		if got := echo(); got != STATUS_INSUFFICIENT_RESOURCES {
+			t.Errorf("ECHO %d status = %v, want STATUS_INSUFFICIENT_RESOURCES", i+1, got)
+		}
+	}
+	if got := echo(); got != STATUS_SUCCESS {
+		t.Errorf("ECHO after fault exhausted status = %v, want STATUS_SUCCESS", got)
+	}
+}
+
+// TestChaos_ClientRecoversFromDroppedSessionSetup tests that the client
+// retries when the server drops the connection during session setup
+func TestChaos_ClientRecoversFromDroppedSessionSetup(t *testing.T) {
+	srv, config := startLoopbackServer(t, ServerOptions{
+		EnableChaos: true,
+		Chaos: &ChaosConfig{Faults: map[uint16]ChaosFault{
+			SMB2_SESSION_SETUP: {Drop: true, Count: 2},
+		}},
+	})
+
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	info, err := fsys.Stat("/hello.txt")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if info.Size() != 5 {
+		t.Errorf("Size() = %d, want 5", info.Size())
+	}
+	if got := srv.chaos.fired[SMB2_SESSION_SETUP]; got != 2 {
+		t.Errorf("SESSION_SETUP faults fired = %d, want 2", got)
+	}
+}
+
+// TestChaos_ClientRecoversFromDroppedConnections tests that the client
+// retries when a fraction of new connections is refused
+func TestChaos_ClientRecoversFromDroppedConnections(t *testing.T) {
+	_, config := startLoopbackServer(t, ServerOptions{
+		EnableChaos: true,
+		Chaos:       &ChaosConfig{DropRate: 0.5, Seed: 1},
+	})
+	config.RetryPolicy.MaxAttempts = 20
+
+	for i := 0; i < 5; i++ {
+		fsys, err := New(config)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		if _, err := fsys.Stat("/hello.txt"); err != nil {
+			t.Errorf("Stat() attempt %d error = %v", i+1, err)
+		}
+		fsys.Close()
+	}
+}
+
+// TestChaos_ClientToleratesDelay tests that a slow response is still delivered
+func TestChaos_ClientToleratesDelay(t *testing.T) {
+	const delay = 50 * time.Millisecond
+
+	_, config := startLoopbackServer(t, ServerOptions{
+		EnableChaos: true,
+		Chaos: &ChaosConfig{Faults: map[uint16]ChaosFault{
+			SMB2_CREATE: {Delay: delay},
+		}},
+	})
+
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	start := time.Now()
+	if _, err := fsys.Stat("/hello.txt"); err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("Stat() took %v, want at least the injected %v", elapsed, delay)
+	}
+}
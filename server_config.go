@@ -1,29 +1,72 @@
 package smbfs
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"hash/fnv"
 	"log"
+	"log/slog"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/absfs/absfs"
 )
 
+// ListenerConfig is one address a server listens on
+type ListenerConfig struct {
+	Network string // "tcp", "tcp4" or "tcp6" (default: "tcp")
+	Address string // host:port to bind, as for net.Listen, e.g. ":445" or "[::1]:4450"
+
+	// TLSConfig, if set, makes the listener accept SMB inside TLS, for
+	// clients that can only reach the server through ports such as 443.
+	// It must have a certificate. The SMB framing within the TLS stream
+	// is the same as on a plain connection
+	TLSConfig *tls.Config
+}
+
 // ServerOptions defines server-level configuration
 type ServerOptions struct {
 	// Network settings
 	Port     int    // Listen port (default: 445)
-	Hostname string // Bind hostname (default: "0.0.0.0")
+	Hostname string // Bind hostname; IPv6 literals may be bracketed (default: "0.0.0.0", or "::" for tcp6)
+	Network  string // "tcp", or "tcp4" or "tcp6" to listen on one address family (default: "tcp")
+
+	// Listeners, if set, are the addresses the server accepts connections
+	// on, in place of the single one given by Port, Hostname and Network
+	Listeners []ListenerConfig
 
 	// Protocol settings
 	MinDialect      SMBDialect // Minimum SMB dialect to accept (default: SMB2_0_2)
 	MaxDialect      SMBDialect // Maximum SMB dialect to offer (default: SMB3_1_1)
 	SigningRequired bool       // Require message signing (default: false)
 
+	// SMB1Policy decides what happens to clients that open with an SMB1
+	// NEGOTIATE (default: SMB1Upgrade)
+	SMB1Policy SMB1Policy
+
 	// Connection settings
 	MaxConnections int           // Maximum concurrent connections (0 = unlimited)
 	IdleTimeout    time.Duration // Connection idle timeout (default: 15m)
 	ReadTimeout    time.Duration // Read timeout per message (default: 30s)
 	WriteTimeout   time.Duration // Write timeout per message (default: 30s)
 
+	// MaxConnectionsPerIP caps the concurrent connections from one remote
+	// address, so a single client cannot use up MaxConnections. Excess
+	// connections are closed before the handshake (0 = unlimited)
+	MaxConnectionsPerIP int
+
+	// RequestRateLimit is the requests per second each connection may
+	// send, with bursts of up to one second's worth. Requests beyond it
+	// fail with STATUS_INSUFFICIENT_RESOURCES (0 = unlimited)
+	RequestRateLimit int
+
+	// MaxBytesPerSecPerSession caps the bytes each session may READ or
+	// WRITE per second, with bursts of up to one second's worth. Transfers
+	// beyond it are slowed rather than refused (0 = unlimited)
+	MaxBytesPerSecPerSession int64
+
 	// Server identity
 	ServerGUID [16]byte // Server GUID (generated if zero)
 	ServerName string   // NetBIOS name (optional)
@@ -32,13 +75,73 @@ type ServerOptions struct {
 	Users      map[string]string // Server-level users: username -> password
 	AllowGuest bool              // Allow guest/anonymous access (default: true)
 
+	// UserStore, if set, supplies the NT hashes of users in place of the
+	// plaintext Users, so passwords need not be kept. NTHashUsers is a
+	// ready-made store
+	UserStore UserStore
+
+	// AllowWeakNTLM accepts NTLM responses that fail NTProofStr verification
+	// (legacy, insecure: any password is accepted for a known user). Default: false
+	AllowWeakNTLM bool
+
+	// GlobalReadOnly makes every share read-only, whatever its own
+	// ReadOnly, as for maintenance. Requests that would change a file fail
+	// with STATUS_ACCESS_DENIED. Server.SetGlobalReadOnly changes it while
+	// the server runs. Default: false
+	GlobalReadOnly bool
+
+	// EncryptData requires every session to encrypt its traffic (SMB 3.0+).
+	// Clients that cannot encrypt are refused at SESSION_SETUP. Default: false
+	EncryptData bool
+
+	// EnableCompression offers LZ77 compression to SMB 3.1.1 clients that
+	// ask for it. READ responses of 4KB or more are then sent compressed
+	// when that makes them smaller, and compressed requests are accepted.
+	// Default: false
+	EnableCompression bool
+
 	// Logging
 	Logger ServerLogger // Logger interface (optional)
 	Debug  bool         // Enable debug logging
 
+	// LogSecrets includes NTLM hashes, proofs and session keys in debug
+	// logging, which otherwise redacts them. Only for debugging
+	// authentication: anyone who reads such a log can attack the logged
+	// passwords. Default: false
+	LogSecrets bool
+
 	// Performance
 	MaxReadSize  uint32 // Maximum read size (default: 8MB)
 	MaxWriteSize uint32 // Maximum write size (default: 8MB)
+
+	// AsyncThreshold is how long a READ, WRITE or IOCTL may take before
+	// the client is sent an interim STATUS_PENDING response, so that slow
+	// backends do not trip its request timeout. The final response follows
+	// when the operation completes, and requests on the same open wait for
+	// it until then; a CANCEL ends bandwidth throttling and server-side
+	// copies early (0 = never)
+	AsyncThreshold time.Duration
+
+	// MaxCredits is the most credits a client may hold, which bounds how
+	// many requests it can have outstanding (default: 512)
+	MaxCredits uint16
+
+	// ChangeNotifyInterval is how often directories are rescanned to answer
+	// CHANGE_NOTIFY on filesystems without native watching (default: 2s)
+	ChangeNotifyInterval time.Duration
+
+	// DurableHandleTimeout is how long the durable handles of a lost session
+	// are kept for the client to reconnect them, and the longest timeout
+	// granted to a DH2Q request (default: 1m; negative disables durable handles)
+	DurableHandleTimeout time.Duration
+
+	// MetricsObserver, if set, is called with every completed request
+	MetricsObserver MetricsObserver
+
+	// Fault injection for testing client resilience. Chaos is ignored
+	// unless EnableChaos is also set; never enable it in production
+	EnableChaos bool
+	Chaos       *ChaosConfig
 }
 
 // DefaultServerOptions returns sensible default server options
@@ -46,6 +149,7 @@ func DefaultServerOptions() ServerOptions {
 	return ServerOptions{
 		Port:           445,
 		Hostname:       "0.0.0.0",
+		Network:        "tcp",
 		MinDialect:     SMB2_0_2,
 		MaxDialect:     SMB3_1_1,
 		MaxConnections: 100,
@@ -54,6 +158,7 @@ func DefaultServerOptions() ServerOptions {
 		WriteTimeout:   30 * time.Second,
 		MaxReadSize:    MaxReadSize,
 		MaxWriteSize:   MaxWriteSize,
+		MaxCredits:     defaultMaxCredits,
 		AllowGuest:     true, // Allow guest by default for easy testing
 	}
 }
@@ -77,10 +182,93 @@ type ShareOptions struct {
 	MaxUsers     int    // Maximum concurrent users (0 = unlimited)
 	Hidden       bool   // Hide from share enumeration
 
-	// Cache settings
-	CachingMode CachingMode // Client-side caching mode
+	// VolumeLabel and VolumeSerial identify the share's volume to clients
+	// in FileFsVolumeInformation. The label defaults to the share name and
+	// the serial to a hash of it, so each share looks like its own volume
+	VolumeLabel  string
+	VolumeSerial uint32
+
+	// CaseInsensitive makes a path that does not exist as given open the
+	// file whose name matches it ignoring case, as Windows clients expect.
+	// DefaultShareOptions sets it; without it the share looks up paths
+	// exactly as clients give them
+	CaseInsensitive bool
+
+	// CachingMode is the offline caching policy TREE_CONNECT advertises
+	// for the share, which clients apply to its files
+	CachingMode CachingMode
+
+	// DisableOplocks stops the share from granting oplocks and leases, so
+	// clients never cache file data, handles or directory listings locally
+	DisableOplocks bool
+
+	// AlignmentRequirement is the buffer alignment reported in
+	// FileAlignmentInformation (one of the FILE_*_ALIGNMENT values).
+	// Unbuffered I/O on the share must be aligned to it. Default: byte-aligned
+	AlignmentRequirement uint32
+
+	// EncryptData requires traffic to this share to be encrypted (SMB 3.0+).
+	// Sessions that cannot encrypt are refused at TREE_CONNECT
+	EncryptData bool
+
+	// QuotaBytes caps the space the share's files may take. Writes and size
+	// changes that would take more fail with STATUS_DISK_FULL, and clients
+	// are shown it as the total space, with what is left of it as the most
+	// free space. Zero means no cap
+	QuotaBytes uint64
+
+	// MaxFileSize is the largest a file may grow to, by writes or size
+	// changes; growing past it fails with STATUS_DISK_FULL. Zero means no
+	// limit
+	MaxFileSize int64
+
+	// MaxBytesPerSecPerSession caps the bytes each session may READ or
+	// WRITE per second on this share, in place of the server's
+	// MaxBytesPerSecPerSession. Zero means the server's applies
+	MaxBytesPerSecPerSession int64
+
+	// DFSLinks makes the share a DFS namespace root. It maps link paths
+	// within the share ("docs" or "projects/2024") to the UNC path of their
+	// targets (\\server\share[\path]). Opens at or under a link fail with
+	// STATUS_PATH_NOT_COVERED and clients resolve the link with a referral
+	DFSLinks map[string]string
+
+	// AccessBasedEnumeration hides directory entries the user has no read
+	// access to, as decided by AccessChecker. Clients are told the share
+	// enumerates by access; without a checker nothing is hidden
+	AccessBasedEnumeration bool
+	AccessChecker          ShareAccessChecker
+
+	// CloseOpenFilesOnReplace makes ReplaceShare close the handles open on
+	// the share, which would otherwise go on using the filesystem being
+	// replaced until clients close them
+	CloseOpenFilesOnReplace bool
+
+	// AuditHook, if set, is called with every open, read, write, rename and
+	// delete on the share once the request's response is built, in the
+	// order requests are handled. It runs on the connection's goroutine,
+	// so a slow hook holds up the client, unless AuditBuffer is set
+	AuditHook func(AuditEvent)
+
+	// AuditBuffer makes AuditHook run on a goroutine of its own, with up to
+	// this many events waiting for it. Events beyond that are dropped and
+	// logged rather than held up
+	AuditBuffer int
 }
 
+// SMB1Policy is how the server treats clients that negotiate with SMB1
+type SMB1Policy int
+
+const (
+	// SMB1Upgrade answers an SMB1 NEGOTIATE with an SMB2 one, so clients
+	// that support both carry on over SMB2
+	SMB1Upgrade SMB1Policy = iota
+
+	// SMB1Reject answers an SMB1 NEGOTIATE with no common dialect and
+	// closes the connection, counting it in ServerMetrics.SMB1Rejected
+	SMB1Reject
+)
+
 // SMBShareType represents the type of SMB share (different from ShareType in shares.go)
 type SMBShareType uint8
 
@@ -103,18 +291,50 @@ const (
 // DefaultShareOptions returns sensible default share options
 func DefaultShareOptions(shareName string) ShareOptions {
 	return ShareOptions{
-		ShareName:   shareName,
-		SharePath:   "/",
-		AllowGuest:  true, // Start with guest access for simplicity
-		CachingMode: CachingModeManual,
+		ShareName:       shareName,
+		SharePath:       "/",
+		AllowGuest:      true, // Start with guest access for simplicity
+		CachingMode:     CachingModeManual,
+		CaseInsensitive: true,
 	}
 }
 
 // Share represents an SMB share backed by an absfs.FileSystem
 type Share struct {
+	mu          sync.RWMutex // Guards fs and options, which ReplaceShare swaps
 	fs          absfs.FileSystem
 	options     ShareOptions
 	fileHandles *FileHandleMap
+
+	// Activity counters (see server_metrics.go)
+	counters shareCounters
+
+	// First-seen creation times for filesystems without Birthtimer
+	birthMu    sync.Mutex
+	birthtimes map[string]time.Time
+
+	// File IDs by path and paths by file ID (see file_id.go)
+	idMu       sync.Mutex
+	idRoot     *fileIDNode
+	idNodes    map[uint64]*fileIDNode
+	lastFileID uint64
+
+	// Serializes writes to end of file, so appenders cannot overwrite
+	// each other between finding the end and writing there
+	appendMu sync.Mutex
+
+	// Space taken by the share's files, for QuotaBytes (see quota.go)
+	usage shareUsage
+
+	// Queue for AuditHook when AuditBuffer is set (see audit.go)
+	audit shareAudit
+
+	// Files whose archive bit is cleared (see archive.go)
+	archive shareArchive
+
+	// Paths resolved ignoring case, by lowercased path (see case_fold.go)
+	caseMu    sync.Mutex
+	caseNames map[string]string
 }
 
 // NewShare creates a new share
@@ -128,11 +348,15 @@ func NewShare(fs absfs.FileSystem, options ShareOptions) *Share {
 
 // FileSystem returns the underlying filesystem
 func (s *Share) FileSystem() absfs.FileSystem {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.fs
 }
 
 // Options returns the share options
 func (s *Share) Options() ShareOptions {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.options
 }
 
@@ -143,36 +367,82 @@ func (s *Share) FileHandles() *FileHandleMap {
 
 // IsReadOnly returns true if the share is read-only
 func (s *Share) IsReadOnly() bool {
-	return s.options.ReadOnly
+	return s.Options().ReadOnly
 }
 
 // GetShareType returns the SMB share type (disk, pipe, print)
 func (s *Share) GetShareType() SMBShareType {
-	if s.options.ShareType == 0 {
+	shareType := s.Options().ShareType
+	if shareType == 0 {
 		return SMBShareTypeDisk // Default to disk
 	}
-	return s.options.ShareType
+	return shareType
+}
+
+// AlignmentRequirement returns the FILE_*_ALIGNMENT value reported for the share
+func (s *Share) AlignmentRequirement() uint32 {
+	return s.Options().AlignmentRequirement
+}
+
+// BytesPerSector returns the logical sector size reported for the share
+// It is never smaller than the alignment requirement so that sector-aligned
+// unbuffered I/O always satisfies the reported alignment
+func (s *Share) BytesPerSector() uint32 {
+	const defaultSectorSize = 512
+	if align := s.Options().AlignmentRequirement + 1; align > defaultSectorSize {
+		return align
+	}
+	return defaultSectorSize
+}
+
+// isAlignedIO reports whether an unbuffered transfer at offset/length
+// satisfies the share's alignment requirement
+func (s *Share) isAlignedIO(offset uint64, length uint32) bool {
+	mask := uint64(s.Options().AlignmentRequirement)
+	return offset&mask == 0 && uint64(length)&mask == 0
+}
+
+// VolumeLabel returns the volume label reported for the share
+func (s *Share) VolumeLabel() string {
+	opts := s.Options()
+	if opts.VolumeLabel != "" {
+		return opts.VolumeLabel
+	}
+	return opts.ShareName
+}
+
+// VolumeSerial returns the volume serial number reported for the share
+func (s *Share) VolumeSerial() uint32 {
+	opts := s.Options()
+	if opts.VolumeSerial != 0 {
+		return opts.VolumeSerial
+	}
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToUpper(opts.ShareName)))
+	return h.Sum32()
 }
 
 // AllowsGuest returns true if guest access is allowed
 func (s *Share) AllowsGuest() bool {
-	return s.options.AllowGuest
+	return s.Options().AllowGuest
 }
 
 // CheckUserAccess verifies if a user is allowed to access this share
 func (s *Share) CheckUserAccess(username string, isGuest bool) bool {
+	opts := s.Options()
+
 	// Guest check
 	if isGuest {
-		return s.options.AllowGuest
+		return opts.AllowGuest
 	}
 
 	// If no user restrictions, allow all authenticated users
-	if len(s.options.AllowedUsers) == 0 {
+	if len(opts.AllowedUsers) == 0 {
 		return true
 	}
 
 	// Check if user is in allowed list
-	for _, allowed := range s.options.AllowedUsers {
+	for _, allowed := range opts.AllowedUsers {
 		if allowed == username {
 			return true
 		}
@@ -182,12 +452,13 @@ func (s *Share) CheckUserAccess(username string, isGuest bool) bool {
 
 // ValidateCredentials checks username/password against configured users
 func (s *Share) ValidateCredentials(username, password string) bool {
-	if len(s.options.Users) == 0 {
+	users := s.Options().Users
+	if len(users) == 0 {
 		// No users configured, rely on external authentication
 		return true
 	}
 
-	storedPassword, ok := s.options.Users[username]
+	storedPassword, ok := users[username]
 	if !ok {
 		return false
 	}
@@ -237,3 +508,28 @@ func (l *NullLogger) Debug(msg string, args ...interface{}) {}
 func (l *NullLogger) Info(msg string, args ...interface{})  {}
 func (l *NullLogger) Warn(msg string, args ...interface{})  {}
 func (l *NullLogger) Error(msg string, args ...interface{}) {}
+
+// SlogLogger sends server logging to a log/slog handler, at the level of
+// each message
+type SlogLogger struct {
+	handler slog.Handler
+}
+
+// NewSlogLogger creates a logger writing to handler
+func NewSlogLogger(handler slog.Handler) *SlogLogger {
+	return &SlogLogger{handler: handler}
+}
+
+func (l *SlogLogger) Debug(msg string, args ...interface{}) { l.log(slog.LevelDebug, msg, args) }
+func (l *SlogLogger) Info(msg string, args ...interface{})  { l.log(slog.LevelInfo, msg, args) }
+func (l *SlogLogger) Warn(msg string, args ...interface{})  { l.log(slog.LevelWarn, msg, args) }
+func (l *SlogLogger) Error(msg string, args ...interface{}) { l.log(slog.LevelError, msg, args) }
+
+// log formats a message only if the handler takes its level
+func (l *SlogLogger) log(level slog.Level, msg string, args []interface{}) {
+	ctx := context.Background()
+	if !l.handler.Enabled(ctx, level) {
+		return
+	}
+	l.handler.Handle(ctx, slog.NewRecord(time.Now(), level, fmt.Sprintf(msg, args...), 0))
+}
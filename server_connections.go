@@ -0,0 +1,105 @@
+package smbfs
+
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ServerConnectionInfo describes one client connection to the server, as
+// reported by Server.Connections. It is the server's view, unlike the
+// ConnectionInfo a client FileSystem reports
+type ServerConnectionInfo struct {
+	RemoteAddr    string
+	Dialect       SMBDialect // Negotiated dialect (0 before NEGOTIATE)
+	Username      string     // User of the latest session set up ("" without one)
+	Sessions      int        // Sessions set up on the connection that are still open
+	BytesReceived uint64     // Bytes read from the client, NetBIOS framing included
+	BytesSent     uint64     // Bytes written to the client
+	ConnectedAt   time.Time
+}
+
+// countingConn counts the bytes read from and written to a connection
+type countingConn struct {
+	net.Conn
+	read    atomic.Uint64
+	written atomic.Uint64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(uint64(n))
+	return n, err
+}
+
+// Connections returns a snapshot of the server's live connections, oldest
+// first, for admin tools that show who is connected
+func (s *Server) Connections() []ServerConnectionInfo {
+	s.connMu.Lock()
+	conns := make([]ServerConnectionInfo, 0, len(s.conns))
+	sessions := make([][]uint64, 0, len(s.conns))
+	for conn, state := range s.conns {
+		info := ServerConnectionInfo{
+			RemoteAddr:  state.remoteAddr,
+			Dialect:     state.dialect,
+			Username:    state.username,
+			ConnectedAt: state.connectedAt,
+		}
+		if counted, ok := conn.(*countingConn); ok {
+			info.BytesReceived = counted.read.Load()
+			info.BytesSent = counted.written.Load()
+		}
+		ids := make([]uint64, 0, len(state.sessionIDs))
+		for id := range state.sessionIDs {
+			ids = append(ids, id)
+		}
+		conns = append(conns, info)
+		sessions = append(sessions, ids)
+	}
+	s.connMu.Unlock()
+
+	// Sessions may have expired or been taken over by a reconnecting
+	// client since they were set up here
+	for i, ids := range sessions {
+		for _, id := range ids {
+			if s.sessions.GetSession(id) != nil {
+				conns[i].Sessions++
+			}
+		}
+	}
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ConnectedAt.Before(conns[j].ConnectedAt) })
+	return conns
+}
+
+// trackDialect records the dialect a connection negotiated, for Connections
+func (s *Server) trackDialect(state *connState, dialect SMBDialect) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	state.dialect = dialect
+	state.username = ""
+}
+
+// trackSession records a session set up on a connection, or logged off
+// from it, for Connections
+func (s *Server) trackSession(state *connState, session *Session, open bool) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if !open {
+		delete(state.sessionIDs, session.ID)
+		state.username = ""
+		return
+	}
+	if state.sessionIDs == nil {
+		state.sessionIDs = make(map[uint64]struct{})
+	}
+	state.sessionIDs[session.ID] = struct{}{}
+	state.username = session.Username
+}
@@ -0,0 +1,67 @@
+package smbfs
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestServer_Connections tests that the snapshot of live connections shows
+// each client's address, dialect, user and traffic
+func TestServer_Connections(t *testing.T) {
+	srv, config := startLoopbackServer(t, ServerOptions{})
+
+	for i := 0; i < 2; i++ {
+		fsys, err := New(config)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer fsys.Close()
+		if _, err := fsys.Stat("/hello.txt"); err != nil {
+			t.Fatalf("Stat() error = %v", err)
+		}
+	}
+
+	// A client that has only negotiated SMB 2.1
+	w := NewByteWriter(38)
+	w.WriteUint16(36)             // StructureSize
+	w.WriteUint16(1)              // DialectCount
+	w.WriteUint16(0)              // SecurityMode
+	w.WriteUint16(0)              // Reserved
+	w.WriteUint32(0)              // Capabilities
+	w.WriteGUID([16]byte{2})      // ClientGuid
+	w.WriteUint64(0)              // ClientStartTime
+	w.WriteUint16(uint16(SMB2_1)) // Dialects
+	conn := serveTestConn(t, srv)
+	conn.Write(frameRequests(false, &SMB2Message{Header: &SMB2Header{Command: SMB2_NEGOTIATE}, Payload: w.Bytes()}))
+	if resp := readTestResponse(t, conn); NTStatus(resp.Header.Status) != STATUS_SUCCESS {
+		t.Fatalf("NEGOTIATE status = %v", NTStatus(resp.Header.Status))
+	}
+
+	conns := srv.Connections()
+	if len(conns) != 3 {
+		t.Fatalf("Connections() = %d connections, want 3", len(conns))
+	}
+	for i, c := range conns[:2] {
+		if !strings.HasPrefix(c.RemoteAddr, "127.0.0.1:") {
+			t.Errorf("connection %d RemoteAddr = %q, want a loopback address", i, c.RemoteAddr)
+		}
+		if c.Dialect < SMB2_0_2 || c.Username != "tester" || c.Sessions != 1 {
+			t.Errorf("connection %d = dialect %v, user %q, %d sessions, want a dialect, tester and 1 session",
+				i, c.Dialect, c.Username, c.Sessions)
+		}
+		if c.BytesReceived == 0 || c.BytesSent == 0 {
+			t.Errorf("connection %d traffic = %d received, %d sent, want both counted", i, c.BytesReceived, c.BytesSent)
+		}
+		if c.ConnectedAt.IsZero() || time.Since(c.ConnectedAt) > time.Minute {
+			t.Errorf("connection %d ConnectedAt = %v", i, c.ConnectedAt)
+		}
+	}
+	if last := conns[2]; last.Dialect != SMB2_1 || last.Username != "" || last.Sessions != 0 {
+		t.Errorf("negotiated-only connection = dialect %v, user %q, %d sessions, want SMB 2.1 and no session",
+			last.Dialect, last.Username, last.Sessions)
+	}
+	if conns[0].ConnectedAt.After(conns[1].ConnectedAt) {
+		t.Error("Connections() not ordered oldest first")
+	}
+}
@@ -0,0 +1,133 @@
+package smbfs
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// remoteHost returns the host part of a connection's remote address, which
+// MaxConnectionsPerIP counts connections by
+func remoteHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// admitConnection counts a new connection from host, or reports false if
+// it would exceed MaxConnections or MaxConnectionsPerIP
+func (s *Server) admitConnection(host string) bool {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	if s.options.MaxConnections > 0 && s.connCount >= s.options.MaxConnections {
+		s.logger.Warn("Connection limit reached, rejecting connection from %s", host)
+		return false
+	}
+	if s.options.MaxConnectionsPerIP > 0 && s.connsPerIP[host] >= s.options.MaxConnectionsPerIP {
+		s.logger.Warn("Connection limit for %s reached, rejecting connection", host)
+		return false
+	}
+	s.connCount++
+	s.connsPerIP[host]++
+	return true
+}
+
+// releaseConnectionLocked uncounts a closed connection from host. The
+// caller holds connMu
+func (s *Server) releaseConnectionLocked(host string) {
+	s.connCount--
+	if s.connsPerIP[host] <= 1 {
+		delete(s.connsPerIP, host)
+	} else {
+		s.connsPerIP[host]--
+	}
+}
+
+// allowRequest takes a token from the connection's request bucket, which
+// refills at limit tokens per second and holds at most one second's worth.
+// It reports false if the bucket is empty. A limit of 0 allows everything.
+// Only the connection's goroutine calls it
+func (state *connState) allowRequest(limit int) bool {
+	if limit <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	if state.rateUpdated.IsZero() {
+		state.rateTokens = float64(limit)
+	} else {
+		state.rateTokens += now.Sub(state.rateUpdated).Seconds() * float64(limit)
+		state.rateTokens = min(state.rateTokens, float64(limit))
+	}
+	state.rateUpdated = now
+
+	if state.rateTokens < 1 {
+		return false
+	}
+	state.rateTokens--
+	return true
+}
+
+// byteBucket paces transfers to a rate in bytes per second. Transfers are
+// never refused: one that overdraws the bucket leaves it in debt, which
+// the transfer waits out
+type byteBucket struct {
+	mu      sync.Mutex
+	tokens  float64
+	updated time.Time
+}
+
+// reserve takes n bytes from the bucket, which refills at rate bytes per
+// second and holds at most one second's worth, and returns how long the
+// caller must wait before the transfer is within the rate
+func (b *byteBucket) reserve(n int, rate int64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.updated.IsZero() {
+		b.tokens = float64(rate)
+	} else {
+		b.tokens += now.Sub(b.updated).Seconds() * float64(rate)
+		b.tokens = min(b.tokens, float64(rate))
+	}
+	b.updated = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(rate) * float64(time.Second))
+}
+
+// throttle paces a READ or WRITE of n bytes on tree to the share's
+// MaxBytesPerSecPerSession, or else the server's, by sleeping while the
+// session is over it. The caller must hold no locks, as other requests
+// on the connection wait meanwhile. It reports false if ctx was done
+// first, as when the request is cancelled or the server stops
+func (h *SMBHandler) throttle(ctx context.Context, session *Session, tree *TreeConnection, n int) bool {
+	bucket, rate := &session.bandwidth, h.server.options.MaxBytesPerSecPerSession
+	if shareRate := tree.Share.Options().MaxBytesPerSecPerSession; shareRate > 0 {
+		bucket, rate = tree.bandwidth, shareRate
+	}
+	if rate <= 0 || n == 0 {
+		return true
+	}
+
+	wait := bucket.reserve(n, rate)
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,178 @@
+package smbfs
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// dialFrom connects to the server from the local address ip
+func dialFrom(t *testing.T, srv *Server, ip string) net.Conn {
+	t.Helper()
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}, Timeout: time.Second}
+	conn, err := d.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() from %s error = %v", ip, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// rejected reports whether the server closed conn without waiting for a
+// request
+func rejected(t *testing.T, conn net.Conn) bool {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+		t.Logf("Read() on a rejected connection error = %v", err)
+	}
+	return true
+}
+
+// TestServer_MaxConnectionsPerIP tests that connections beyond the per-IP
+// cap are closed while another address can still connect
+func TestServer_MaxConnectionsPerIP(t *testing.T) {
+	srv, _ := startLoopbackServer(t, ServerOptions{MaxConnectionsPerIP: 2})
+
+	first := dialFrom(t, srv, "127.0.0.1")
+	second := dialFrom(t, srv, "127.0.0.1")
+	third := dialFrom(t, srv, "127.0.0.1")
+	if rejected(t, first) || rejected(t, second) {
+		t.Fatal("connections within the per-IP cap were closed")
+	}
+	if !rejected(t, third) {
+		t.Error("connection beyond the per-IP cap was not closed")
+	}
+
+	other := dialFrom(t, srv, "127.0.0.2")
+	if rejected(t, other) {
+		t.Error("connection from another address was closed")
+	}
+
+	// Closing a connection frees its slot
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.ConnectionCount() != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rejected(t, dialFrom(t, srv, "127.0.0.1")) {
+		t.Error("connection after one closed was rejected")
+	}
+}
+
+// TestServer_RequestRateLimit tests that a connection's requests beyond the
+// rate limit fail with STATUS_INSUFFICIENT_RESOURCES until the bucket
+// refills
+func TestServer_RequestRateLimit(t *testing.T) {
+	srv := setupTestServer(t)
+	srv.options.RequestRateLimit = 5
+	state := &connState{}
+
+	echo := func() NTStatus {
+		t.Helper()
+		header := &SMB2Header{Command: SMB2_ECHO, CreditRequest: 1}
+		copy(header.ProtocolID[:], SMB2ProtocolID)
+		payload := []byte{4, 0, 0, 0}
+		resp, err := srv.handler.HandleMessage(state, &SMB2Message{Header: header, Payload: payload})
+		if err != nil || resp == nil {
+			t.Fatalf("HandleMessage() = %v, %v", resp, err)
+		}
+		return resp.Header.Status
+	}
+
+	for i := 0; i < 5; i++ {
+		if status := echo(); status != STATUS_SUCCESS {
+			t.Fatalf("ECHO %d status = %v, want STATUS_SUCCESS", i+1, status)
+		}
+	}
+	if status := echo(); status != STATUS_INSUFFICIENT_RESOURCES {
+		t.Errorf("ECHO over the limit status = %v, want STATUS_INSUFFICIENT_RESOURCES", status)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if status := echo(); status != STATUS_SUCCESS {
+		t.Errorf("ECHO after the bucket refilled status = %v, want STATUS_SUCCESS", status)
+	}
+
+	// Other connections have buckets of their own
+	if !(&connState{}).allowRequest(5) {
+		t.Error("a new connection was rate limited")
+	}
+}
+
+// TestServer_MaxBytesPerSecPerSession tests that READ and WRITE are slowed
+// to the session's bandwidth limit, the share's where it sets one, rather
+// than failed
+func TestServer_MaxBytesPerSecPerSession(t *testing.T) {
+	const rate = 50000
+	const chunk = 10000
+
+	// Transferring twice the rate takes the one-second burst and about
+	// a second more
+	transfer := func(t *testing.T, name string, do func() NTStatus) {
+		t.Helper()
+		start := time.Now()
+		for sent := 0; sent < 2*rate; sent += chunk {
+			if status := do(); status != STATUS_SUCCESS {
+				t.Fatalf("%s status = %v, want STATUS_SUCCESS", name, status)
+			}
+		}
+		if elapsed := time.Since(start); elapsed < 800*time.Millisecond || elapsed > 3*time.Second {
+			t.Errorf("%s of %d bytes at %d bytes/s took %v, want about 1s", name, 2*rate, rate, elapsed)
+		}
+	}
+
+	t.Run("server", func(t *testing.T) {
+		srv, session, tree := setupTestTree(t)
+		srv.options.MaxBytesPerSecPerSession = rate
+		f, _ := tree.Share.fs.Create("/data.bin")
+		f.Write(make([]byte, chunk))
+		f.Close()
+
+		file, err := tree.Share.fs.OpenFile("/data.bin", os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("OpenFile() error = %v", err)
+		}
+		of := tree.Share.fileHandles.Allocate(file, "/data.bin", false, FILE_READ_DATA,
+			FILE_SHARE_READ, FILE_OPEN, 0, tree.ID, session.ID)
+		defer tree.Share.fileHandles.Release(of.ID)
+
+		transfer(t, "READ", func() NTStatus {
+			resp, status := srv.handler.handleRead(nil, testRequest(session, tree, SMB2_READ, buildReadRequest(of.ID, chunk)))
+			if status == STATUS_SUCCESS && len(readData(t, resp)) != chunk {
+				t.Fatalf("READ returned %d bytes, want %d", len(readData(t, resp)), chunk)
+			}
+			return status
+		})
+	})
+
+	t.Run("share", func(t *testing.T) {
+		srv, session, tree := setupTestTree(t)
+		tree.Share.options.MaxBytesPerSecPerSession = rate
+		file, err := tree.Share.fs.Create("/data.bin")
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+		of := tree.Share.fileHandles.Allocate(file, "/data.bin", false, FILE_WRITE_DATA,
+			0, FILE_CREATE, 0, tree.ID, session.ID)
+		defer tree.Share.fileHandles.Release(of.ID)
+
+		offset := uint64(0)
+		transfer(t, "WRITE", func() NTStatus {
+			_, status := srv.handler.handleWrite(nil, testRequest(session, tree, SMB2_WRITE,
+				buildWriteRequest(of.ID, offset, make([]byte, chunk))))
+			offset += chunk
+			return status
+		})
+		if info, err := tree.Share.fs.Stat("/data.bin"); err != nil || info.Size() != 2*rate {
+			t.Errorf("Stat() = %v, %v, want all %d bytes written", info, err, 2*rate)
+		}
+	})
+}
@@ -0,0 +1,167 @@
+package smbfs
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ServerMetrics is a snapshot of a server's activity since it was created
+type ServerMetrics struct {
+	Requests     uint64              // Requests handled
+	BytesRead    uint64              // File data returned by READ
+	BytesWritten uint64              // File data accepted by WRITE
+	Commands     map[uint16]uint64   // Requests by command (see CommandName)
+	Errors       map[NTStatus]uint64 // Error responses by status
+	SMB1Rejected uint64              // Connections closed by SMB1Reject
+
+	ActiveSessions int
+	ActiveHandles  int
+
+	Shares map[string]ShareMetrics // Activity by share name
+}
+
+// ShareMetrics is a snapshot of the activity on one share
+type ShareMetrics struct {
+	Requests      uint64 // Requests on trees connected to the share
+	Errors        uint64 // Requests on the share that failed
+	BytesRead     uint64
+	BytesWritten  uint64
+	ActiveHandles int
+}
+
+// RequestMetrics describes one completed request, for a MetricsObserver
+type RequestMetrics struct {
+	Command      uint16
+	Status       NTStatus
+	Share        string // Share of the request's tree, or "" for none
+	BytesRead    uint64
+	BytesWritten uint64
+	Duration     time.Duration // Time spent handling the request
+}
+
+// MetricsObserver receives every completed request, for exporters that push
+// metrics rather than poll Server.Metrics. It is called on the connection's
+// goroutine, so it must be quick and safe for concurrent use
+type MetricsObserver interface {
+	ObserveRequest(RequestMetrics)
+}
+
+// serverCounters holds a server's running totals
+type serverCounters struct {
+	requests     atomic.Uint64
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+	commands     [SMB2_OPLOCK_BREAK + 1]atomic.Uint64
+	smb1Rejected atomic.Uint64
+
+	errorsMu sync.Mutex
+	errors   map[NTStatus]uint64
+}
+
+// shareCounters holds a share's running totals
+type shareCounters struct {
+	requests     atomic.Uint64
+	errors       atomic.Uint64
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+}
+
+// transferredBytes returns the file data moved by a successful READ or
+// WRITE, which both responses carry as a 32-bit count at offset 4
+func transferredBytes(cmd uint16, status NTStatus, payload []byte) (read, written uint64) {
+	if status.IsError() || len(payload) < 8 {
+		return 0, 0
+	}
+	switch cmd {
+	case SMB2_READ:
+		return uint64(le.Uint32(payload[4:8])), 0
+	case SMB2_WRITE:
+		return 0, uint64(le.Uint32(payload[4:8]))
+	}
+	return 0, 0
+}
+
+// recordRequest counts a handled request against the server and share and
+// passes it to the MetricsObserver
+func (s *Server) recordRequest(share *Share, cmd uint16, status NTStatus, payload []byte, started time.Time) {
+	read, written := transferredBytes(cmd, status, payload)
+
+	c := &s.counters
+	c.requests.Add(1)
+	if int(cmd) < len(c.commands) {
+		c.commands[cmd].Add(1)
+	}
+	c.bytesRead.Add(read)
+	c.bytesWritten.Add(written)
+	if status.IsError() {
+		c.errorsMu.Lock()
+		if c.errors == nil {
+			c.errors = make(map[NTStatus]uint64)
+		}
+		c.errors[status]++
+		c.errorsMu.Unlock()
+	}
+
+	shareName := ""
+	if share != nil {
+		shareName = share.Options().ShareName
+		share.counters.requests.Add(1)
+		share.counters.bytesRead.Add(read)
+		share.counters.bytesWritten.Add(written)
+		if status.IsError() {
+			share.counters.errors.Add(1)
+		}
+	}
+
+	if observer := s.options.MetricsObserver; observer != nil {
+		observer.ObserveRequest(RequestMetrics{
+			Command:      cmd,
+			Status:       status,
+			Share:        shareName,
+			BytesRead:    read,
+			BytesWritten: written,
+			Duration:     time.Since(started),
+		})
+	}
+}
+
+// Metrics returns a snapshot of the server's activity counters
+func (s *Server) Metrics() ServerMetrics {
+	c := &s.counters
+	m := ServerMetrics{
+		Requests:       c.requests.Load(),
+		BytesRead:      c.bytesRead.Load(),
+		BytesWritten:   c.bytesWritten.Load(),
+		Commands:       make(map[uint16]uint64),
+		Errors:         make(map[NTStatus]uint64),
+		SMB1Rejected:   c.smb1Rejected.Load(),
+		ActiveSessions: s.sessions.SessionCount(),
+		Shares:         make(map[string]ShareMetrics),
+	}
+	for cmd := range c.commands {
+		if n := c.commands[cmd].Load(); n > 0 {
+			m.Commands[uint16(cmd)] = n
+		}
+	}
+	c.errorsMu.Lock()
+	for status, n := range c.errors {
+		m.Errors[status] = n
+	}
+	c.errorsMu.Unlock()
+
+	s.sharesMu.RLock()
+	defer s.sharesMu.RUnlock()
+	for name, share := range s.shares {
+		handles := share.fileHandles.Count()
+		m.ActiveHandles += handles
+		m.Shares[name] = ShareMetrics{
+			Requests:      share.counters.requests.Load(),
+			Errors:        share.counters.errors.Load(),
+			BytesRead:     share.counters.bytesRead.Load(),
+			BytesWritten:  share.counters.bytesWritten.Load(),
+			ActiveHandles: handles,
+		}
+	}
+	return m
+}
@@ -0,0 +1,105 @@
+package smbfs
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+// recordingObserver keeps the requests it observes
+type recordingObserver struct {
+	mu       sync.Mutex
+	requests []RequestMetrics
+}
+
+func (o *recordingObserver) ObserveRequest(m RequestMetrics) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.requests = append(o.requests, m)
+}
+
+// TestServer_Metrics tests that reads, writes and failures through a client
+// show up in the server and share counters and reach the observer
+func TestServer_Metrics(t *testing.T) {
+	observer := &recordingObserver{}
+	srv, config := startLoopbackServer(t, ServerOptions{MetricsObserver: observer})
+
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	data := bytes.Repeat([]byte("metrics!"), 1000)
+	w, err := fsys.Create("/metrics.bin")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	w.Close()
+	got, err := fsys.ReadFile("/metrics.bin")
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("ReadFile() = %d bytes, %v, want %d bytes", len(got), err, len(data))
+	}
+	if _, err := fsys.Stat("/missing"); err == nil {
+		t.Fatal("Stat() of a missing file succeeded")
+	}
+
+	m := srv.Metrics()
+	if m.BytesWritten != uint64(len(data)) || m.BytesRead != uint64(len(data)) {
+		t.Errorf("BytesWritten, BytesRead = %d, %d, want %d, %d", m.BytesWritten, m.BytesRead, len(data), len(data))
+	}
+	if m.Commands[SMB2_WRITE] == 0 || m.Commands[SMB2_READ] == 0 || m.Commands[SMB2_CREATE] < 3 {
+		t.Errorf("Commands = %v, want READ, WRITE and at least 3 CREATEs", m.Commands)
+	}
+	if m.Errors[STATUS_OBJECT_NAME_NOT_FOUND] == 0 {
+		t.Errorf("Errors = %v, want STATUS_OBJECT_NAME_NOT_FOUND counted", m.Errors)
+	}
+	if m.ActiveSessions != 1 {
+		t.Errorf("ActiveSessions = %d, want 1", m.ActiveSessions)
+	}
+	var total uint64
+	for _, n := range m.Commands {
+		total += n
+	}
+	if m.Requests != total {
+		t.Errorf("Requests = %d, want the %d counted by command", m.Requests, total)
+	}
+
+	share := m.Shares["data"]
+	if share.BytesWritten != uint64(len(data)) || share.BytesRead != uint64(len(data)) {
+		t.Errorf("share BytesWritten, BytesRead = %d, %d, want %d, %d",
+			share.BytesWritten, share.BytesRead, len(data), len(data))
+	}
+	if share.Errors == 0 || share.Requests == 0 || share.Requests >= m.Requests {
+		t.Errorf("share Requests, Errors = %d, %d, want some of the server's %d", share.Requests, share.Errors, m.Requests)
+	}
+
+	// Open a handle and see it counted
+	f, err := fsys.Open("/metrics.bin")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if n := srv.Metrics().Shares["data"].ActiveHandles; n == 0 {
+		t.Error("ActiveHandles = 0 with a file open")
+	}
+	f.Close()
+
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	var observedWritten uint64
+	for _, r := range observer.requests {
+		observedWritten += r.BytesWritten
+		if r.Command == SMB2_WRITE && r.Share != "data" {
+			t.Errorf("observed WRITE on share %q, want data", r.Share)
+		}
+	}
+	if observedWritten != uint64(len(data)) {
+		t.Errorf("observed %d bytes written, want %d", observedWritten, len(data))
+	}
+	if uint64(len(observer.requests)) < m.Requests {
+		t.Errorf("observer saw %d requests, want at least %d", len(observer.requests), m.Requests)
+	}
+}
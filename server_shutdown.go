@@ -0,0 +1,106 @@
+package smbfs
+
+import (
+	"context"
+	"time"
+)
+
+// shutdownPollInterval is how often Shutdown looks for connections that
+// have finished their requests
+const shutdownPollInterval = 10 * time.Millisecond
+
+// contextShutdownTimeout is how long ListenAndServeContext waits for
+// requests in flight once its context ends
+const contextShutdownTimeout = 30 * time.Second
+
+// beginRequest marks a request as being handled, or reports false if
+// Shutdown has already closed the connection
+func (c *connState) beginRequest() bool {
+	c.drainMu.Lock()
+	defer c.drainMu.Unlock()
+	if c.closing {
+		return false
+	}
+	c.inFlight++
+	return true
+}
+
+// endRequest marks a request as answered
+func (c *connState) endRequest() {
+	c.drainMu.Lock()
+	c.inFlight--
+	c.drainMu.Unlock()
+}
+
+// closeIfIdle closes the connection unless it is handling a request,
+// reporting whether it did
+func (c *connState) closeIfIdle() bool {
+	c.drainMu.Lock()
+	defer c.drainMu.Unlock()
+	if c.inFlight > 0 {
+		return false
+	}
+	if !c.closing {
+		c.closing = true
+		c.conn.Close()
+	}
+	return true
+}
+
+// Shutdown stops the server gracefully. It stops accepting connections and
+// requests, waits for requests already being handled to be answered, closes
+// each connection once it is idle, then flushes and closes every open file
+// before stopping the server.
+//
+// If ctx ends first, the remaining connections are closed as by Stop and
+// the context's error is returned
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.logger.Info("Draining SMB server...")
+	s.drainOnce.Do(func() { close(s.drainCh) })
+	s.closeListeners()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for s.closeIdleConns() > 0 {
+		select {
+		case <-ctx.Done():
+			s.logger.Warn("Shutdown: deadline reached with requests in flight, closing connections")
+			s.Stop()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	s.closeOpenFiles()
+	return s.Stop()
+}
+
+// closeIdleConns closes the connections not handling a request and returns
+// how many connections remain open
+func (s *Server) closeIdleConns() int {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	for _, state := range s.conns {
+		state.closeIfIdle()
+	}
+	return len(s.conns)
+}
+
+// closeOpenFiles flushes and closes every handle still open on the server's
+// shares, including durable handles kept for reconnect
+func (s *Server) closeOpenFiles() {
+	type syncer interface {
+		Sync() error
+	}
+
+	for _, share := range s.shareList() {
+		for _, of := range share.fileHandles.all() {
+			if f, ok := of.File.(syncer); ok {
+				if err := f.Sync(); err != nil {
+					s.logger.Warn("Shutdown: failed to sync %s: %v", of.Path, err)
+				}
+			}
+			s.handler.closeOpenFile(share, of)
+		}
+	}
+}
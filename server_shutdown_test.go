@@ -0,0 +1,205 @@
+package smbfs
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// slowWriteFS delays every write to its files
+type slowWriteFS struct {
+	absfs.FileSystem
+	delay   time.Duration
+	started chan struct{} // Receives when a write begins
+}
+
+func (s *slowWriteFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := s.FileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &slowWriteFile{File: f, fs: s}, nil
+}
+
+type slowWriteFile struct {
+	absfs.File
+	fs *slowWriteFS
+}
+
+func (f *slowWriteFile) Write(p []byte) (int, error) {
+	select {
+	case f.fs.started <- struct{}{}:
+	default:
+	}
+	time.Sleep(f.fs.delay)
+	return f.File.Write(p)
+}
+
+func (f *slowWriteFile) WriteAt(p []byte, off int64) (int, error) {
+	select {
+	case f.fs.started <- struct{}{}:
+	default:
+	}
+	time.Sleep(f.fs.delay)
+	return f.File.WriteAt(p, off)
+}
+
+// TestServer_ShutdownDrainsRequests tests that Shutdown lets a write in
+// flight finish and closes its handle before closing the connection
+func TestServer_ShutdownDrainsRequests(t *testing.T) {
+	srv, config := startLoopbackServer(t, ServerOptions{})
+	share := srv.GetShare("data")
+	backing := share.fs
+	share.fs = &slowWriteFS{FileSystem: backing, delay: 200 * time.Millisecond, started: make(chan struct{}, 1)}
+	slow := share.fs.(*slowWriteFS)
+
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	f, err := fsys.Create("/out.txt")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := f.Write([]byte("drained"))
+		written <- err
+	}()
+	select {
+	case <-slow.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write never reached the server")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Errorf("Write() during Shutdown error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write() did not return after Shutdown")
+	}
+
+	if n := share.fileHandles.Count(); n != 0 {
+		t.Errorf("open handles after Shutdown = %d, want 0", n)
+	}
+	if n := srv.ConnectionCount(); n != 0 {
+		t.Errorf("ConnectionCount() after Shutdown = %d, want 0", n)
+	}
+	out, err := backing.Open("/out.txt")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer out.Close()
+	if data, _ := io.ReadAll(out); string(data) != "drained" {
+		t.Errorf("file contents = %q, want %q", data, "drained")
+	}
+
+	if conn, err := net.DialTimeout("tcp", srv.Addr().String(), time.Second); err == nil {
+		conn.Close()
+		t.Error("server accepted a connection after Shutdown")
+	}
+
+	// Stop after Shutdown is harmless
+	if err := srv.Stop(); err != nil {
+		t.Errorf("Stop() after Shutdown error = %v", err)
+	}
+}
+
+// TestServer_ShutdownDeadline tests that Shutdown gives up on requests that
+// outlast its context
+func TestServer_ShutdownDeadline(t *testing.T) {
+	srv, config := startLoopbackServer(t, ServerOptions{})
+	share := srv.GetShare("data")
+	slow := &slowWriteFS{FileSystem: share.fs, delay: 500 * time.Millisecond, started: make(chan struct{}, 1)}
+	share.fs = slow
+
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	f, err := fsys.Create("/out.txt")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	go f.Write([]byte("late"))
+	<-slow.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// TestServer_ListenAndServeContext tests that cancelling the context shuts
+// the server down and returns nil, and that ending it twice is harmless
+func TestServer_ListenAndServeContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to reserve port: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	srv, err := NewServer(ServerOptions{
+		Logger:    &NullLogger{},
+		Listeners: []ListenerConfig{{Address: addr}},
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.ListenAndServeContext(ctx) }()
+
+	var conn net.Conn
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("ListenAndServeContext() = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServeContext() did not return after the context was cancelled")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() on a connection after shutdown = %v, want EOF", err)
+	}
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Error("Dial() after shutdown succeeded")
+	}
+
+	cancel()
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown() after ListenAndServeContext returned = %v", err)
+	}
+	srv.Stop()
+}
@@ -1,10 +1,27 @@
 package smbfs
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/absfs/absfs"
 	"github.com/absfs/memfs"
 )
 
@@ -226,6 +243,108 @@ func TestServer_RemoveShare(t *testing.T) {
 	})
 }
 
+// TestServer_ReplaceShare tests swapping the filesystem of a share that a
+// client is connected to
+func TestServer_ReplaceShare(t *testing.T) {
+	srv, config := startLoopbackServer(t, ServerOptions{})
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	snapshot := func(content string) absfs.FileSystem {
+		t.Helper()
+		mfs, err := memfs.NewFS()
+		if err != nil {
+			t.Fatalf("Failed to create memfs: %v", err)
+		}
+		f, err := mfs.Create("/hello.txt")
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+		f.Write([]byte(content))
+		f.Close()
+		return mfs
+	}
+	readHello := func() string {
+		t.Helper()
+		f, err := fsys.Open("/hello.txt")
+		if err != nil {
+			t.Fatalf("Open() error = %v", err)
+		}
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("ReadAll() error = %v", err)
+		}
+		return string(data)
+	}
+
+	old, err := fsys.Open("/hello.txt")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer old.Close()
+
+	// New opens see the new filesystem; the open handle keeps the old one
+	if err := srv.ReplaceShare("data", snapshot("second"), ShareOptions{Comment: "v2"}); err != nil {
+		t.Fatalf("ReplaceShare() error = %v", err)
+	}
+	if got := readHello(); got != "second" {
+		t.Errorf("read %q after ReplaceShare, want %q", got, "second")
+	}
+	if data, err := io.ReadAll(old); err != nil || string(data) != "hello" {
+		t.Errorf("handle opened before ReplaceShare read %q, %v; want %q", data, err, "hello")
+	}
+	if opts := srv.GetShare("data").Options(); opts.ShareName != "data" || opts.Comment != "v2" {
+		t.Errorf("Options() = %+v, want the replacement options named data", opts)
+	}
+
+	// With CloseOpenFilesOnReplace, handles on the old filesystem are closed
+	if _, err := old.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek() error = %v", err)
+	}
+	if err := srv.ReplaceShare("data", snapshot("third"), ShareOptions{CloseOpenFilesOnReplace: true}); err != nil {
+		t.Fatalf("ReplaceShare() error = %v", err)
+	}
+	if n := srv.GetShare("data").fileHandles.Count(); n != 0 {
+		t.Errorf("%d handles open after ReplaceShare closed them", n)
+	}
+	if _, err := old.Read(make([]byte, 5)); err == nil {
+		t.Error("Read() on a handle closed by ReplaceShare succeeded")
+	}
+	if got := readHello(); got != "third" {
+		t.Errorf("read %q after ReplaceShare, want %q", got, "third")
+	}
+
+	// Replacing while requests are in flight is safe
+	next := snapshot("fourth")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			srv.ReplaceShare("data", next, ShareOptions{})
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if _, err := fsys.Stat("/hello.txt"); err != nil {
+			t.Errorf("Stat() during ReplaceShare error = %v", err)
+		}
+	}
+	<-done
+
+	if err := srv.ReplaceShare("missing", snapshot(""), ShareOptions{}); err == nil {
+		t.Error("ReplaceShare() of a missing share should fail")
+	}
+	if err := srv.ReplaceShare("data", snapshot(""), ShareOptions{ShareName: "other"}); err == nil {
+		t.Error("ReplaceShare() with options naming another share should fail")
+	}
+	if err := srv.ReplaceShare("IPC$", snapshot(""), ShareOptions{}); err == nil {
+		t.Error("ReplaceShare() of IPC$ should fail")
+	}
+}
+
 // TestServer_GetShare tests share retrieval
 func TestServer_GetShare(t *testing.T) {
 	srv := setupTestServer(t)
@@ -655,6 +774,30 @@ func TestFileHandleMap_CheckShareAccess(t *testing.T) {
 			newShare:         FILE_SHARE_DELETE,
 			expectCompatible: false,
 		},
+		{
+			name:             "append without write share denied",
+			existingAccess:   FILE_READ_DATA,
+			existingShare:    FILE_SHARE_READ,
+			newAccess:        FILE_APPEND_DATA,
+			newShare:         FILE_SHARE_READ | FILE_SHARE_WRITE,
+			expectCompatible: false,
+		},
+		{
+			name:             "execute without read share denied",
+			existingAccess:   FILE_WRITE_DATA,
+			existingShare:    FILE_SHARE_WRITE,
+			newAccess:        FILE_EXECUTE,
+			newShare:         FILE_SHARE_READ | FILE_SHARE_WRITE,
+			expectCompatible: false,
+		},
+		{
+			name:             "attributes only ignore share mode",
+			existingAccess:   FILE_READ_DATA | FILE_WRITE_DATA | DELETE,
+			existingShare:    0,
+			newAccess:        FILE_READ_ATTRIBUTES | FILE_WRITE_ATTRIBUTES,
+			newShare:         0,
+			expectCompatible: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -678,6 +821,33 @@ func TestFileHandleMap_CheckShareAccess(t *testing.T) {
 	}
 }
 
+// TestFileHandleMap_TryAllocate tests that of racing opens that exclude
+// each other exactly one gets a handle
+func TestFileHandleMap_TryAllocate(t *testing.T) {
+	const openers = 16
+
+	m := NewFileHandleMap()
+	var wg sync.WaitGroup
+	var granted atomic.Int32
+	for i := 0; i < openers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := m.TryAllocate(nil, "/test.txt", false, FILE_WRITE_DATA, FILE_SHARE_READ, FILE_OPEN, 0, 1, 100); ok {
+				granted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := granted.Load(); n != 1 {
+		t.Errorf("TryAllocate() granted %d of %d exclusive opens, want 1", n, openers)
+	}
+	if n := m.Count(); n != 1 {
+		t.Errorf("Count() = %d, want 1", n)
+	}
+}
+
 // TestSMB2Header_Marshal tests SMB2 header marshaling
 func TestSMB2Header_Marshal(t *testing.T) {
 	header := &SMB2Header{
@@ -1153,7 +1323,7 @@ func TestShare_CheckUserAccess(t *testing.T) {
 }
 
 // setupTestServer creates a test server with null logger
-func setupTestServer(t *testing.T) *Server {
+func setupTestServer(t testing.TB) *Server {
 	t.Helper()
 
 	opts := ServerOptions{
@@ -1282,3 +1452,1706 @@ func BenchmarkSessionManager_CreateSession(b *testing.B) {
 		_ = mgr.CreateSession(SMB3_1_1, guid, "192.168.1.100")
 	}
 }
+
+// TestQueryFileInfo_Alignment tests that standalone and embedded alignment info match the share configuration
+func TestQueryFileInfo_Alignment(t *testing.T) {
+	srv := setupTestServer(t)
+
+	fs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+
+	for _, align := range []uint32{FILE_BYTE_ALIGNMENT, FILE_QUAD_ALIGNMENT, FILE_512_BYTE_ALIGNMENT} {
+		f, err := fs.Create("/data.bin")
+		if err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+
+		share := NewShare(fs, ShareOptions{ShareName: "test", AlignmentRequirement: align})
+		of := share.fileHandles.Allocate(f, "/data.bin", false, GENERIC_READ, FILE_SHARE_READ, FILE_OPEN, 0, 1, 1)
+
+		buf, status := srv.handler.queryFileInfo(share, of, FileAlignmentInformation)
+		if status != STATUS_SUCCESS {
+			t.Fatalf("FileAlignmentInformation status = %v", status)
+		}
+		if got := le.Uint32(buf); got != align {
+			t.Errorf("FileAlignmentInformation = 0x%x, want 0x%x", got, align)
+		}
+
+		buf, status = srv.handler.queryFileInfo(share, of, FileAllInformation)
+		if status != STATUS_SUCCESS {
+			t.Fatalf("FileAllInformation status = %v", status)
+		}
+		// Basic(40) + Standard(24) + Internal(8) + Ea(4) + Access(4) + Position(8) + Mode(4)
+		if got := le.Uint32(buf[92:96]); got != align {
+			t.Errorf("FileAllInformation AlignmentRequirement = 0x%x, want 0x%x", got, align)
+		}
+
+		if share.BytesPerSector() < align+1 {
+			t.Errorf("BytesPerSector() = %d, smaller than alignment %d", share.BytesPerSector(), align+1)
+		}
+
+		share.fileHandles.Release(of.ID)
+	}
+}
+
+// TestServer_AddShare_InvalidAlignment tests that malformed alignment requirements are rejected
+func TestServer_AddShare_InvalidAlignment(t *testing.T) {
+	srv := setupTestServer(t)
+
+	fs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+
+	if err := srv.AddShare(fs, ShareOptions{ShareName: "bad", AlignmentRequirement: 6}); err == nil {
+		t.Error("AddShare() with non power-of-two alignment should fail")
+	}
+	if err := srv.AddShare(fs, ShareOptions{ShareName: "big", AlignmentRequirement: 0x3ff}); err == nil {
+		t.Error("AddShare() with alignment above 512 bytes should fail")
+	}
+}
+
+// setupTestTree creates a test server with a memfs share and an authenticated
+// session connected to it
+func setupTestTree(t testing.TB) (*Server, *Session, *TreeConnection) {
+	t.Helper()
+
+	srv := setupTestServer(t)
+
+	fs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+	if err := srv.AddShare(fs, ShareOptions{ShareName: "test"}); err != nil {
+		t.Fatalf("AddShare() error = %v", err)
+	}
+
+	session := srv.sessions.CreateSession(SMB3_1_1, [16]byte{}, "127.0.0.1")
+	session.SetValid("testuser", "", false, nil)
+	tree := session.AddTreeConnection("test", srv.GetShare("test"), false)
+
+	return srv, session, tree
+}
+
+// testRequest builds a request message addressed to the given tree
+func testRequest(session *Session, tree *TreeConnection, cmd uint16, payload []byte) *SMB2Message {
+	return &SMB2Message{
+		Header: &SMB2Header{
+			Command:   cmd,
+			SessionID: session.ID,
+			TreeID:    tree.ID,
+		},
+		Payload: payload,
+	}
+}
+
+// buildQueryDirectoryRequest builds a QUERY_DIRECTORY request payload
+func buildQueryDirectoryRequest(fileID FileID, infoClass, flags uint8, pattern string) []byte {
+	patternBytes := EncodeStringToUTF16LE(pattern)
+
+	w := NewByteWriter(32 + len(patternBytes))
+	w.WriteUint16(33)                          // StructureSize
+	w.WriteOneByte(infoClass)                  // FileInformationClass
+	w.WriteOneByte(flags)                      // Flags
+	w.WriteUint32(0)                           // FileIndex
+	w.WriteFileID(fileID)                      // FileId
+	w.WriteUint16(uint16(SMB2HeaderSize + 32)) // FileNameOffset
+	w.WriteUint16(uint16(len(patternBytes)))   // FileNameLength
+	w.WriteUint32(65536)                       // OutputBufferLength
+	w.WriteBytes(patternBytes)                 // Buffer
+	return w.Bytes()
+}
+
+// buildCloseRequest builds a CLOSE request payload
+func buildCloseRequest(fileID FileID) []byte {
+	w := NewByteWriter(24)
+	w.WriteUint16(24) // StructureSize
+	w.WriteUint16(0)  // Flags
+	w.WriteUint32(0)  // Reserved
+	w.WriteFileID(fileID)
+	return w.Bytes()
+}
+
+// TestHandleClose_ClearsDirState tests that closing a directory handle drops its enumeration state
+func TestHandleClose_ClearsDirState(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	share := tree.Share
+
+	if err := share.fs.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("Mkdir() error = %v", err)
+	}
+	f, err := share.fs.Create("/dir/file.txt")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	f.Close()
+
+	dir, err := share.fs.Open("/dir")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	of := share.fileHandles.Allocate(dir, "/dir", true, GENERIC_READ, FILE_SHARE_READ, FILE_OPEN, FILE_DIRECTORY_FILE, tree.ID, session.ID)
+
+	_, status := srv.handler.handleQueryDirectory(nil,
+		testRequest(session, tree, SMB2_QUERY_DIRECTORY, buildQueryDirectoryRequest(of.ID, FileDirectoryInformation, 0, "*")))
+	if status != STATUS_SUCCESS {
+		t.Fatalf("QUERY_DIRECTORY status = %v, want STATUS_SUCCESS", status)
+	}
+	if of.dirState == nil {
+		t.Fatal("Expected directory state after enumeration")
+	}
+
+	_, status = srv.handler.handleClose(nil, testRequest(session, tree, SMB2_CLOSE, buildCloseRequest(of.ID)))
+	if status != STATUS_SUCCESS {
+		t.Fatalf("CLOSE status = %v, want STATUS_SUCCESS", status)
+	}
+
+	if of.dirState != nil {
+		t.Error("Directory state still present after CLOSE")
+	}
+}
+
+// TestQueryDirectory_FileIdFullDirectoryInformation tests the layout of
+// FileIdFullDirectoryInformation entries
+func TestQueryDirectory_FileIdFullDirectoryInformation(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	share := tree.Share
+
+	if err := share.fs.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("Mkdir() error = %v", err)
+	}
+	if err := share.fs.Mkdir("/dir/sub", 0755); err != nil {
+		t.Fatalf("Mkdir() error = %v", err)
+	}
+	f, err := share.fs.Create("/dir/a.txt")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	f.Write([]byte("hello"))
+	f.Close()
+
+	dir, err := share.fs.Open("/dir")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	of := share.fileHandles.Allocate(dir, "/dir", true, GENERIC_READ, FILE_SHARE_READ, FILE_OPEN, FILE_DIRECTORY_FILE, tree.ID, session.ID)
+
+	resp, status := srv.handler.handleQueryDirectory(nil,
+		testRequest(session, tree, SMB2_QUERY_DIRECTORY, buildQueryDirectoryRequest(of.ID, FileIdFullDirectoryInformation, 0, "*")))
+	if status != STATUS_SUCCESS {
+		t.Fatalf("QUERY_DIRECTORY status = %v, want STATUS_SUCCESS", status)
+	}
+
+	type entry struct {
+		attrs  uint32
+		size   uint64
+		fileID uint64
+	}
+	got := make(map[string]entry)
+	buf := resp[8 : 8+le.Uint32(resp[4:8])]
+	for {
+		nameLen := int(le.Uint32(buf[60:64]))
+		if 80+nameLen > len(buf) {
+			t.Fatalf("entry with FileNameLength %d overruns the %d bytes left", nameLen, len(buf))
+		}
+		name := DecodeUTF16LEToString(buf[80 : 80+nameLen])
+		got[name] = entry{attrs: le.Uint32(buf[56:60]), size: le.Uint64(buf[40:48]), fileID: le.Uint64(buf[72:80])}
+		if fileID, want := le.Uint64(buf[72:80]), share.fileID(path.Join("/dir", name)); fileID != want {
+			t.Errorf("%s FileId = %d, want the share's ID %d", name, fileID, want)
+		}
+
+		next := int(le.Uint32(buf[0:4]))
+		if next == 0 {
+			break
+		}
+		if next%8 != 0 || next != AlignTo8(80+nameLen) {
+			t.Errorf("%s NextEntryOffset = %d, want %d", name, next, AlignTo8(80+nameLen))
+		}
+		buf = buf[next:]
+	}
+
+	if got["a.txt"].fileID == got["sub"].fileID {
+		t.Errorf("a.txt and sub share FileId %d", got["sub"].fileID)
+	}
+	if e, ok := got["a.txt"]; !ok || e.attrs&FILE_ATTRIBUTE_DIRECTORY != 0 || e.size != 5 {
+		t.Errorf("a.txt entry = %+v, %v, want a 5 byte file", e, ok)
+	}
+	if e, ok := got["sub"]; !ok || e.attrs&FILE_ATTRIBUTE_DIRECTORY == 0 {
+		t.Errorf("sub entry = %+v, %v, want a directory", e, ok)
+	}
+}
+
+// TestCreate_OpenByFileID tests that a FileId from a directory listing
+// opens its file with FILE_OPEN_BY_FILE_ID, also after a rename, and that
+// QUERY_INFO reports the same ID
+func TestCreate_OpenByFileID(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	share := tree.Share
+	share.fs.Mkdir("/dir", 0755)
+	f, _ := share.fs.Create("/dir/a.txt")
+	f.Write([]byte("hello"))
+	f.Close()
+
+	dir, _ := share.fs.Open("/dir")
+	of := share.fileHandles.Allocate(dir, "dir", true, GENERIC_READ, FILE_SHARE_READ, FILE_OPEN, FILE_DIRECTORY_FILE, tree.ID, session.ID)
+	defer share.fileHandles.Release(of.ID)
+	resp, status := srv.handler.handleQueryDirectory(nil,
+		testRequest(session, tree, SMB2_QUERY_DIRECTORY, buildQueryDirectoryRequest(of.ID, FileIdBothDirectoryInformation, 0, "a.txt")))
+	if status != STATUS_SUCCESS {
+		t.Fatalf("QUERY_DIRECTORY status = %v, want STATUS_SUCCESS", status)
+	}
+	fileID := le.Uint64(resp[8+96 : 8+104])
+
+	openByID := func(id uint64, nameLen int) ([]byte, NTStatus) {
+		t.Helper()
+		req := buildCreateRequest(strings.Repeat("x", nameLen/2), FILE_OPEN, FILE_OPEN_BY_FILE_ID, nil)
+		if nameLen == 8 {
+			le.PutUint64(req[56:64], id)
+		}
+		return srv.handler.handleCreate(nil, testRequest(session, tree, SMB2_CREATE, req), nil)
+	}
+	readByID := func(id uint64) string {
+		t.Helper()
+		resp, status := openByID(id, 8)
+		if status != STATUS_SUCCESS {
+			t.Fatalf("CREATE by FileId %d status = %v, want STATUS_SUCCESS", id, status)
+		}
+		opened := share.fileHandles.Get(UnmarshalFileID(resp[64:80]))
+		defer share.fileHandles.Release(opened.ID)
+		data, _ := io.ReadAll(opened.File)
+
+		resp, status = srv.handler.handleQueryInfo(nil, testRequest(session, tree, SMB2_QUERY_INFO,
+			buildQueryInfoRequest(opened.ID, SMB2_0_INFO_FILE, FileInternalInformation, 0, 8)))
+		if status != STATUS_SUCCESS {
+			t.Fatalf("QUERY_INFO FileInternalInformation status = %v", status)
+		}
+		if index := le.Uint64(resp[8:16]); index != id {
+			t.Errorf("IndexNumber of %s = %d, want the FileId %d", opened.Path, index, id)
+		}
+		return string(data)
+	}
+
+	if data := readByID(fileID); data != "hello" {
+		t.Errorf("contents opened by FileId = %q, want hello", data)
+	}
+	share.fs.Rename("/dir/a.txt", "/dir/b.txt")
+	share.renameFileIDs("/dir/a.txt", "/dir/b.txt")
+	if data := readByID(fileID); data != "hello" {
+		t.Errorf("contents opened by FileId after rename = %q, want hello", data)
+	}
+
+	if _, status := openByID(fileID+100, 8); status != STATUS_INVALID_PARAMETER {
+		t.Errorf("CREATE by unknown FileId status = %v, want STATUS_INVALID_PARAMETER", status)
+	}
+	if _, status := openByID(fileID, 4); status != STATUS_INVALID_PARAMETER {
+		t.Errorf("CREATE by a 4-byte FileId status = %v, want STATUS_INVALID_PARAMETER", status)
+	}
+}
+
+// TestShare_FileIDRenameDelete tests that file IDs follow a directory
+// rename to everything beneath it, and that deleting it drops them
+func TestShare_FileIDRenameDelete(t *testing.T) {
+	_, _, tree := setupTestTree(t)
+	share := tree.Share
+
+	ids := make(map[string]uint64)
+	for _, name := range []string{"/dir", "/dir/a.txt", "/dir/sub/b.txt", "/other.txt", "/new/x.txt"} {
+		ids[name] = share.fileID(name)
+	}
+
+	share.renameFileIDs("/dir", "/new")
+	for old, renamed := range map[string]string{"/dir": "/new", "/dir/a.txt": "/new/a.txt", "/dir/sub/b.txt": "/new/sub/b.txt"} {
+		if p, ok := share.pathByFileID(ids[old]); !ok || p != renamed {
+			t.Errorf("pathByFileID(%s's ID) = %q, %v, want %s", old, p, ok, renamed)
+		}
+		if id := share.fileID(renamed); id != ids[old] {
+			t.Errorf("fileID(%s) = %d, want %s's %d", renamed, id, old, ids[old])
+		}
+	}
+	if _, ok := share.pathByFileID(ids["/new/x.txt"]); ok {
+		t.Error("ID of a file under the replaced target survived the rename")
+	}
+	if id := share.fileID("/dir/a.txt"); id == ids["/dir/a.txt"] {
+		t.Error("old path kept its ID after the rename")
+	}
+
+	share.forgetFileIDs("/new")
+	for _, name := range []string{"/dir", "/dir/a.txt", "/dir/sub/b.txt"} {
+		if p, ok := share.pathByFileID(ids[name]); ok {
+			t.Errorf("ID of %s still names %s after the delete", name, p)
+		}
+	}
+	if p, ok := share.pathByFileID(ids["/other.txt"]); !ok || p != "/other.txt" {
+		t.Errorf("pathByFileID(/other.txt's ID) = %q, %v after an unrelated delete", p, ok)
+	}
+}
+
+// TestShare_FileIDBound tests that the file IDs a share remembers stay
+// within maxFileIDs, and that IDs are not reused when it starts over
+func TestShare_FileIDBound(t *testing.T) {
+	_, _, tree := setupTestTree(t)
+	share := tree.Share
+
+	first := share.fileID("/first.txt")
+	for i := 0; i < maxFileIDs+10; i++ {
+		share.fileID(fmt.Sprintf("/dir%d/file%d.txt", i%100, i))
+	}
+
+	share.idMu.Lock()
+	remembered := len(share.idNodes)
+	share.idMu.Unlock()
+	if remembered > maxFileIDs || remembered == 0 {
+		t.Errorf("share remembers %d file IDs, want 1 to %d", remembered, maxFileIDs)
+	}
+	if id := share.fileID("/first.txt"); id == first {
+		t.Error("forgotten path numbered with its old ID")
+	}
+	if _, ok := share.pathByFileID(first); ok {
+		t.Error("forgotten ID still names a path")
+	}
+}
+
+// buildCreateRequest builds a CREATE request payload, optionally carrying a
+// v2 lease request context for leaseKey
+func buildCreateRequest(name string, disposition, options uint32, leaseKey *[16]byte) []byte {
+	nameBytes := EncodeStringToUTF16LE(name)
+
+	oplockLevel := SMB2_OPLOCK_LEVEL_NONE
+	var contexts []byte
+	if leaseKey != nil {
+		oplockLevel = SMB2_OPLOCK_LEVEL_LEASE
+		lw := NewByteWriter(leaseContextV2Size)
+		lw.WriteBytes(leaseKey[:])                                          // LeaseKey
+		lw.WriteUint32(SMB2_LEASE_READ_CACHING | SMB2_LEASE_HANDLE_CACHING) // LeaseState
+		lw.WriteZeros(leaseContextV2Size - 20)                              // Flags, Duration, ParentLeaseKey, Epoch
+		contexts = buildCreateContexts([]CreateContext{{Name: SMB2_CREATE_REQUEST_LEASE, Data: lw.Bytes()}})
+	}
+
+	w := NewByteWriter(56 + len(nameBytes) + len(contexts))
+	w.WriteUint16(57)                                                     // StructureSize
+	w.WriteOneByte(0)                                                     // SecurityFlags
+	w.WriteOneByte(oplockLevel)                                           // RequestedOplockLevel
+	w.WriteUint32(2)                                                      // ImpersonationLevel
+	w.WriteUint64(0)                                                      // SmbCreateFlags
+	w.WriteUint64(0)                                                      // Reserved
+	w.WriteUint32(GENERIC_READ | GENERIC_WRITE)                           // DesiredAccess
+	w.WriteUint32(0)                                                      // FileAttributes
+	w.WriteUint32(FILE_SHARE_READ | FILE_SHARE_WRITE | FILE_SHARE_DELETE) // ShareAccess
+	w.WriteUint32(disposition)                                            // CreateDisposition
+	w.WriteUint32(options)                                                // CreateOptions
+	w.WriteUint16(uint16(SMB2HeaderSize + 56))                            // NameOffset
+	w.WriteUint16(uint16(len(nameBytes)))                                 // NameLength
+	w.WriteUint32(0)                                                      // CreateContextsOffset
+	w.WriteUint32(0)                                                      // CreateContextsLength
+	w.WriteBytes(nameBytes)                                               // Buffer
+	if len(contexts) > 0 {
+		w.WritePadTo8()
+		w.SetUint32At(48, uint32(SMB2HeaderSize+w.Len()))
+		w.SetUint32At(52, uint32(len(contexts)))
+		w.WriteBytes(contexts)
+	}
+	return w.Bytes()
+}
+
+// TestDirectoryLease_BreakOnCreate tests that a create by another client
+// breaks a directory lease and that re-opens with the same key share the lease
+func TestDirectoryLease_BreakOnCreate(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	if err := tree.Share.fs.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("Mkdir() error = %v", err)
+	}
+
+	// The lease holder's breaks arrive on the client end of the pipe
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	owner := &connState{conn: serverConn, remoteAddr: "owner", clientGUID: [16]byte{1}}
+	other := &connState{remoteAddr: "other", clientGUID: [16]byte{2}}
+
+	leaseKey := [16]byte{0xAA, 0xBB, 0xCC}
+	openDir := func() FileID {
+		t.Helper()
+		resp, status := srv.handler.handleCreate(owner,
+			testRequest(session, tree, SMB2_CREATE, buildCreateRequest("dir", FILE_OPEN, FILE_DIRECTORY_FILE, &leaseKey)), nil)
+		if status != STATUS_SUCCESS {
+			t.Fatalf("CREATE status = %v, want STATUS_SUCCESS", status)
+		}
+		if resp[2] != SMB2_OPLOCK_LEVEL_LEASE {
+			t.Fatalf("OplockLevel = 0x%02x, want 0x%02x", resp[2], SMB2_OPLOCK_LEVEL_LEASE)
+		}
+		if le.Uint32(resp[84:88]) == 0 {
+			t.Fatal("CREATE response has no lease context")
+		}
+		return UnmarshalFileID(resp[64:80])
+	}
+
+	first := openDir()
+	second := openDir()
+
+	if got := srv.leases.Count(); got != 1 {
+		t.Fatalf("lease count = %d, want 1 (re-open should reuse the lease)", got)
+	}
+	lease := srv.leases.Lookup(owner.clientGUID, leaseKey)
+	if lease == nil || lease.handles != 2 {
+		t.Fatalf("lease = %+v, want 2 handles", lease)
+	}
+
+	// Another client creates a file inside the leased directory
+	_, status := srv.handler.handleCreate(other,
+		testRequest(session, tree, SMB2_CREATE, buildCreateRequest("dir\\new.txt", FILE_CREATE, FILE_NON_DIRECTORY_FILE, nil)), nil)
+	if status != STATUS_SUCCESS {
+		t.Fatalf("CREATE new.txt status = %v, want STATUS_SUCCESS", status)
+	}
+
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	nbHeader := make([]byte, 4)
+	if _, err := io.ReadFull(clientConn, nbHeader); err != nil {
+		t.Fatalf("Failed to read lease break: %v", err)
+	}
+	msgLen := int(nbHeader[1])<<16 | int(nbHeader[2])<<8 | int(nbHeader[3])
+	raw := make([]byte, msgLen)
+	if _, err := io.ReadFull(clientConn, raw); err != nil {
+		t.Fatalf("Failed to read lease break: %v", err)
+	}
+
+	header, err := UnmarshalSMB2Header(raw)
+	if err != nil {
+		t.Fatalf("UnmarshalSMB2Header() error = %v", err)
+	}
+	if header.Command != SMB2_OPLOCK_BREAK {
+		t.Fatalf("Command = %s, want OPLOCK_BREAK", CommandName(header.Command))
+	}
+	if header.MessageID != 0xFFFFFFFFFFFFFFFF {
+		t.Errorf("MessageID = 0x%x, want 0xFFFFFFFFFFFFFFFF", header.MessageID)
+	}
+	payload := raw[SMB2HeaderSize:]
+	var gotKey [16]byte
+	copy(gotKey[:], payload[8:24])
+	if gotKey != leaseKey {
+		t.Errorf("LeaseKey = %x, want %x", gotKey, leaseKey)
+	}
+	if le.Uint32(payload[4:8])&SMB2_NOTIFY_BREAK_LEASE_FLAG_ACK_REQUIRED == 0 {
+		t.Error("Break of a handle-caching lease should require acknowledgment")
+	}
+	if got := le.Uint32(payload[28:32]); got != SMB2_LEASE_NONE {
+		t.Errorf("NewLeaseState = 0x%x, want 0", got)
+	}
+
+	// Acknowledge the break
+	ack := NewByteWriter(36)
+	ack.WriteUint16(36) // StructureSize
+	ack.WriteUint16(0)  // Reserved
+	ack.WriteUint32(0)  // Flags
+	ack.WriteBytes(leaseKey[:])
+	ack.WriteUint32(SMB2_LEASE_NONE) // LeaseState
+	ack.WriteUint64(0)               // LeaseDuration
+	if _, status := srv.handler.handleOplockBreak(owner, testRequest(session, tree, SMB2_OPLOCK_BREAK, ack.Bytes())); status != STATUS_SUCCESS {
+		t.Fatalf("OPLOCK_BREAK status = %v, want STATUS_SUCCESS", status)
+	}
+	if lease.State != SMB2_LEASE_NONE {
+		t.Errorf("lease state after ack = 0x%x, want 0", lease.State)
+	}
+
+	// The lease goes away once every handle sharing it is closed
+	for _, id := range []FileID{first, second} {
+		if _, status := srv.handler.handleClose(owner, testRequest(session, tree, SMB2_CLOSE, buildCloseRequest(id))); status != STATUS_SUCCESS {
+			t.Fatalf("CLOSE status = %v, want STATUS_SUCCESS", status)
+		}
+	}
+	if got := srv.leases.Count(); got != 0 {
+		t.Errorf("lease count after close = %d, want 0", got)
+	}
+}
+
+// birthtimeFS is a filesystem that reports a fixed creation time
+type birthtimeFS struct {
+	*memfs.FileSystem
+	birth time.Time
+}
+
+func (b *birthtimeFS) Birthtime(name string) (time.Time, error) {
+	return b.birth, nil
+}
+
+// TestShare_CreationTimeStable tests that creation time survives repeated
+// queries and writes when the filesystem does not track it
+func TestShare_CreationTimeStable(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	share := tree.Share
+
+	f, err := share.fs.Create("/file.txt")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	of := share.fileHandles.Allocate(f, "/file.txt", false, GENERIC_READ|GENERIC_WRITE, FILE_SHARE_READ, FILE_OPEN, 0, tree.ID, session.ID)
+	defer share.fileHandles.Release(of.ID)
+
+	queryTimes := func() (created, written uint64) {
+		t.Helper()
+		buf, status := srv.handler.queryFileInfo(share, of, FileBasicInformation)
+		if status != STATUS_SUCCESS {
+			t.Fatalf("FileBasicInformation status = %v", status)
+		}
+		return le.Uint64(buf[0:8]), le.Uint64(buf[16:24])
+	}
+
+	created, written := queryTimes()
+	if created > written {
+		t.Errorf("CreationTime %d is after LastWriteTime %d", created, written)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if _, err := f.Write([]byte("more data")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		again, _ := queryTimes()
+		if again != created {
+			t.Fatalf("CreationTime changed from %d to %d on query %d", created, again, i+1)
+		}
+	}
+
+	buf, status := srv.handler.queryFileInfo(share, of, FileNetworkOpenInformation)
+	if status != STATUS_SUCCESS {
+		t.Fatalf("FileNetworkOpenInformation status = %v", status)
+	}
+	if got := le.Uint64(buf[0:8]); got != created {
+		t.Errorf("FileNetworkOpenInformation CreationTime = %d, want %d", got, created)
+	}
+}
+
+// TestShare_CreationTimeBound tests that the creation times remembered for
+// a filesystem without Birthtimer stay within maxBirthtimes
+func TestShare_CreationTimeBound(t *testing.T) {
+	_, _, tree := setupTestTree(t)
+	share := tree.Share
+
+	info, err := share.fs.Stat("/")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	for i := 0; i < maxBirthtimes+10; i++ {
+		share.CreationTime(fmt.Sprintf("/file%d.txt", i), info)
+	}
+	share.recordCreation("/new.txt", time.Now())
+
+	share.birthMu.Lock()
+	remembered := len(share.birthtimes)
+	share.birthMu.Unlock()
+	if remembered > maxBirthtimes {
+		t.Errorf("share remembers %d creation times, want at most %d", remembered, maxBirthtimes)
+	}
+	if remembered == 0 {
+		t.Error("share remembers no creation times")
+	}
+}
+
+// TestShare_CreationTimeBirthtimer tests that a Birthtimer filesystem supplies creation times
+func TestShare_CreationTimeBirthtimer(t *testing.T) {
+	srv := setupTestServer(t)
+
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+	birth := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := srv.AddShare(&birthtimeFS{FileSystem: mfs, birth: birth}, ShareOptions{ShareName: "test"}); err != nil {
+		t.Fatalf("AddShare() error = %v", err)
+	}
+	session := srv.sessions.CreateSession(SMB3_1_1, [16]byte{}, "127.0.0.1")
+	session.SetValid("testuser", "", false, nil)
+	tree := session.AddTreeConnection("test", srv.GetShare("test"), false)
+
+	f, err := mfs.Create("/file.txt")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	f.Close()
+
+	dir, err := mfs.Open("/")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	of := tree.Share.fileHandles.Allocate(dir, "/", true, GENERIC_READ, FILE_SHARE_READ, FILE_OPEN, FILE_DIRECTORY_FILE, tree.ID, session.ID)
+	defer tree.Share.fileHandles.Release(of.ID)
+
+	resp, status := srv.handler.handleQueryDirectory(nil,
+		testRequest(session, tree, SMB2_QUERY_DIRECTORY, buildQueryDirectoryRequest(of.ID, FileDirectoryInformation, 0, "file.txt")))
+	if status != STATUS_SUCCESS {
+		t.Fatalf("QUERY_DIRECTORY status = %v, want STATUS_SUCCESS", status)
+	}
+	// Response header (8) + NextEntryOffset (4) + FileIndex (4)
+	if got := le.Uint64(resp[16:24]); got != TimeToFiletime(birth) {
+		t.Errorf("directory entry CreationTime = %d, want %d", got, TimeToFiletime(birth))
+	}
+
+	buf, status := srv.handler.queryFileInfo(tree.Share, of, FileBasicInformation)
+	if status != STATUS_SUCCESS {
+		t.Fatalf("FileBasicInformation status = %v", status)
+	}
+	if got := le.Uint64(buf[0:8]); got != TimeToFiletime(birth) {
+		t.Errorf("FileBasicInformation CreationTime = %d, want %d", got, TimeToFiletime(birth))
+	}
+}
+
+// statfsFS is a filesystem that reports a fixed capacity
+type statfsFS struct {
+	*memfs.FileSystem
+	total, free uint64
+	blockSize   uint32
+	err         error
+}
+
+func (s *statfsFS) Statfs() (total, free uint64, blockSize uint32, err error) {
+	return s.total, s.free, s.blockSize, s.err
+}
+
+// TestQueryFilesystemInfo_DiskSpace tests the capacity reported in
+// FileFsFullSizeInformation and FileFsSizeInformation
+func TestQueryFilesystemInfo_DiskSpace(t *testing.T) {
+	srv := setupTestServer(t)
+
+	tests := []struct {
+		name          string
+		statfs        *statfsFS // nil for a plain memfs
+		quota         uint64
+		wantTotal     uint64 // allocation units
+		wantFree      uint64
+		wantSectors   uint32 // per allocation unit
+		wantSectorLen uint32
+	}{
+		{
+			name:          "defaults",
+			wantTotal:     1 << 28,
+			wantFree:      1 << 27,
+			wantSectors:   8,
+			wantSectorLen: 512,
+		},
+		{
+			name:          "statfs",
+			statfs:        &statfsFS{total: 100 << 20, free: 40 << 20, blockSize: 8192},
+			wantTotal:     12800,
+			wantFree:      5120,
+			wantSectors:   16,
+			wantSectorLen: 512,
+		},
+		{
+			name:          "default block size",
+			statfs:        &statfsFS{total: 1 << 30, free: 1 << 29},
+			wantTotal:     1 << 18,
+			wantFree:      1 << 17,
+			wantSectors:   8,
+			wantSectorLen: 512,
+		},
+		{
+			name:          "free capped at total",
+			statfs:        &statfsFS{total: 1 << 20, free: 1 << 30, blockSize: 4096},
+			wantTotal:     256,
+			wantFree:      256,
+			wantSectors:   8,
+			wantSectorLen: 512,
+		},
+		{
+			name:          "quota caps total",
+			statfs:        &statfsFS{total: 1 << 30, free: 1 << 29, blockSize: 4096},
+			quota:         10 << 20,
+			wantTotal:     2560,
+			wantFree:      2560,
+			wantSectors:   8,
+			wantSectorLen: 512,
+		},
+		{
+			name:          "quota above free",
+			statfs:        &statfsFS{total: 1 << 30, free: 1 << 20, blockSize: 4096},
+			quota:         10 << 20,
+			wantTotal:     2560,
+			wantFree:      256,
+			wantSectors:   8,
+			wantSectorLen: 512,
+		},
+		{
+			name:          "quota without statfs",
+			quota:         1 << 30,
+			wantTotal:     1 << 18,
+			wantFree:      1 << 18,
+			wantSectors:   8,
+			wantSectorLen: 512,
+		},
+		{
+			name:          "statfs error keeps defaults",
+			statfs:        &statfsFS{total: 1 << 20, free: 1 << 19, err: errors.New("statfs failed")},
+			wantTotal:     1 << 28,
+			wantFree:      1 << 27,
+			wantSectors:   8,
+			wantSectorLen: 512,
+		},
+		{
+			name:          "block rounded up to sector",
+			statfs:        &statfsFS{total: 1 << 30, free: 1 << 29, blockSize: 256},
+			wantTotal:     1 << 21,
+			wantFree:      1 << 20,
+			wantSectors:   1,
+			wantSectorLen: 512,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mfs, err := memfs.NewFS()
+			if err != nil {
+				t.Fatalf("Failed to create memfs: %v", err)
+			}
+			var fs absfs.FileSystem = mfs
+			if tt.statfs != nil {
+				tt.statfs.FileSystem = mfs
+				fs = tt.statfs
+			}
+			share := NewShare(fs, ShareOptions{ShareName: "test", QuotaBytes: tt.quota})
+
+			buf, status := srv.handler.queryFilesystemInfo(share, FileFsFullSizeInformation)
+			if status != STATUS_SUCCESS {
+				t.Fatalf("FileFsFullSizeInformation status = %v", status)
+			}
+			if len(buf) != 32 {
+				t.Fatalf("FileFsFullSizeInformation length = %d, want 32", len(buf))
+			}
+			if got := le.Uint64(buf[0:8]); got != tt.wantTotal {
+				t.Errorf("TotalAllocationUnits = %d, want %d", got, tt.wantTotal)
+			}
+			if got := le.Uint64(buf[8:16]); got != tt.wantFree {
+				t.Errorf("CallerAvailableAllocationUnits = %d, want %d", got, tt.wantFree)
+			}
+			if got := le.Uint64(buf[16:24]); got != tt.wantFree {
+				t.Errorf("ActualAvailableAllocationUnits = %d, want %d", got, tt.wantFree)
+			}
+			if got := le.Uint32(buf[24:28]); got != tt.wantSectors {
+				t.Errorf("SectorsPerAllocationUnit = %d, want %d", got, tt.wantSectors)
+			}
+			if got := le.Uint32(buf[28:32]); got != tt.wantSectorLen {
+				t.Errorf("BytesPerSector = %d, want %d", got, tt.wantSectorLen)
+			}
+
+			buf, status = srv.handler.queryFilesystemInfo(share, FileFsSizeInformation)
+			if status != STATUS_SUCCESS {
+				t.Fatalf("FileFsSizeInformation status = %v", status)
+			}
+			if got := le.Uint64(buf[0:8]); got != tt.wantTotal {
+				t.Errorf("FileFsSizeInformation TotalAllocationUnits = %d, want %d", got, tt.wantTotal)
+			}
+			if got := le.Uint64(buf[8:16]); got != tt.wantFree {
+				t.Errorf("FileFsSizeInformation AvailableAllocationUnits = %d, want %d", got, tt.wantFree)
+			}
+		})
+	}
+}
+
+// fixedAuthenticator accepts any security blob as the given user
+type fixedAuthenticator struct {
+	username string
+}
+
+func (a *fixedAuthenticator) Authenticate(securityBlob []byte) (*AuthResult, error) {
+	return &AuthResult{Success: true, Username: a.username}, nil
+}
+
+// buildSessionSetupRequest builds a SESSION_SETUP request payload with an
+// empty security buffer
+func buildSessionSetupRequest(previousSessionID uint64) []byte {
+	w := NewByteWriter(25)
+	w.WriteUint16(25)                // StructureSize
+	w.WriteOneByte(0)                // Flags
+	w.WriteOneByte(0)                // SecurityMode
+	w.WriteUint32(0)                 // Capabilities
+	w.WriteUint32(0)                 // Channel
+	w.WriteUint16(0)                 // SecurityBufferOffset
+	w.WriteUint16(0)                 // SecurityBufferLength
+	w.WriteUint64(previousSessionID) // PreviousSessionId
+	w.WriteOneByte(0)                // Buffer
+	return w.Bytes()
+}
+
+// TestSessionSetup_PreviousSessionID tests that reconnecting with a
+// PreviousSessionId tears down the old session of the same user only
+func TestSessionSetup_PreviousSessionID(t *testing.T) {
+	srv, old, tree := setupTestTree(t)
+	old.SetValid("alice", "", false, nil)
+	of := tree.Share.fileHandles.Allocate(nil, "/f.txt", false, FILE_READ_DATA, FILE_SHARE_READ, FILE_OPEN, 0, tree.ID, old.ID)
+
+	setup := func(username string, previousSessionID uint64) *Session {
+		t.Helper()
+		session := srv.sessions.CreateSession(SMB3_1_1, [16]byte{}, "127.0.0.1")
+		session.Authenticator = &fixedAuthenticator{username: username}
+		msg := &SMB2Message{
+			Header:  &SMB2Header{Command: SMB2_SESSION_SETUP, SessionID: session.ID},
+			Payload: buildSessionSetupRequest(previousSessionID),
+		}
+		if _, status := srv.handler.handleSessionSetup(&connState{}, msg, &SMB2Header{}); status != STATUS_SUCCESS {
+			t.Fatalf("SESSION_SETUP status = %v, want STATUS_SUCCESS", status)
+		}
+		return session
+	}
+
+	// Another user cannot tear down the session
+	setup("mallory", old.ID)
+	if srv.sessions.GetSession(old.ID) == nil {
+		t.Fatal("Previous session destroyed by a different user")
+	}
+	if tree.Share.fileHandles.Get(of.ID) == nil {
+		t.Fatal("Previous session's handle released by a different user")
+	}
+
+	// The same user reconnecting replaces it
+	session := setup("ALICE", old.ID)
+	if srv.sessions.GetSession(old.ID) != nil {
+		t.Error("Previous session still exists after reconnect")
+	}
+	if tree.Share.fileHandles.Get(of.ID) != nil {
+		t.Error("Previous session's handle still open after reconnect")
+	}
+	if srv.sessions.GetSession(session.ID) == nil {
+		t.Error("New session missing after reconnect")
+	}
+}
+
+// TestLogoff_ClosesSessionState tests that LOGOFF closes the session's
+// opens, with their locks and delete-on-close, and removes the session and
+// its tree connections, leaving other sessions alone
+func TestLogoff_ClosesSessionState(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	share := tree.Share
+	handles := share.fileHandles
+
+	other := srv.sessions.CreateSession(SMB3_1_1, [16]byte{}, "127.0.0.1")
+	other.SetValid("otheruser", "", false, nil)
+	otherTree := other.AddTreeConnection("test", share, false)
+
+	locked := handles.Allocate(nil, "/f.txt", false, FILE_WRITE_DATA, FILE_SHARE_WRITE, FILE_OPEN, 0, tree.ID, session.ID)
+	if _, status := srv.handler.handleLock(nil, testRequest(session, tree, SMB2_LOCK, buildLockRequest(locked.ID, exclusiveLock(0, 10))), nil); status != STATUS_SUCCESS {
+		t.Fatalf("LOCK status = %v, want STATUS_SUCCESS", status)
+	}
+	f, _ := share.fs.Create("/scratch.tmp")
+	temp := handles.Allocate(f, "scratch.tmp", false, FILE_WRITE_DATA|DELETE, FILE_SHARE_DELETE, FILE_OPEN, 0, tree.ID, session.ID)
+	handles.SetDeleteOnClose(temp.ID, true)
+	kept := handles.Allocate(nil, "/f.txt", false, FILE_WRITE_DATA, FILE_SHARE_WRITE, FILE_OPEN, 0, otherTree.ID, other.ID)
+
+	state := &connState{session: session}
+	msg := &SMB2Message{
+		Header:  &SMB2Header{Command: SMB2_LOGOFF, SessionID: session.ID},
+		Payload: []byte{4, 0, 0, 0},
+	}
+	resp, status := srv.handler.handleLogoff(state, msg)
+	if status != STATUS_SUCCESS || len(resp) != 4 {
+		t.Fatalf("LOGOFF = %d bytes, %v, want 4 bytes, STATUS_SUCCESS", len(resp), status)
+	}
+
+	for _, of := range handles.all() {
+		if of.SessionID == session.ID {
+			t.Errorf("handle for %s still open after LOGOFF", of.Path)
+		}
+	}
+	if handles.Get(kept.ID) == nil {
+		t.Error("another session's handle closed by LOGOFF")
+	}
+	if _, status := srv.handler.handleLock(nil, testRequest(other, otherTree, SMB2_LOCK, buildLockRequest(kept.ID, exclusiveLock(0, 10))), nil); status != STATUS_SUCCESS {
+		t.Errorf("LOCK of the logged-off session's range = %v, want STATUS_SUCCESS", status)
+	}
+	if _, err := share.fs.Stat("/scratch.tmp"); !os.IsNotExist(err) {
+		t.Errorf("Stat() of delete-on-close file after LOGOFF error = %v, want not exist", err)
+	}
+
+	if srv.sessions.GetSession(session.ID) != nil {
+		t.Error("session still exists after LOGOFF")
+	}
+	if n := session.TreeCount(); n != 0 {
+		t.Errorf("session has %d tree connections after LOGOFF, want 0", n)
+	}
+	if state.session != nil {
+		t.Error("connection still bound to the session after LOGOFF")
+	}
+}
+
+// shortWriteFile is a file whose writes store at most chunk bytes per call
+// and stop making progress once limit bytes have been written
+type shortWriteFile struct {
+	absfs.File
+	chunk   int
+	limit   int
+	written int
+	err     error // returned instead of a zero-byte write at the limit
+}
+
+func (f *shortWriteFile) Write(p []byte) (int, error) {
+	n := len(p)
+	if n > f.chunk {
+		n = f.chunk
+	}
+	if n > f.limit-f.written {
+		n = f.limit - f.written
+	}
+	if n == 0 && f.err != nil {
+		return 0, f.err
+	}
+	n, err := f.File.Write(p[:n])
+	f.written += n
+	return n, err
+}
+
+// buildWriteRequest builds a WRITE request payload
+func buildWriteRequest(fileID FileID, offset uint64, data []byte) []byte {
+	w := NewByteWriter(48 + len(data))
+	w.WriteUint16(49)                  // StructureSize
+	w.WriteUint16(SMB2HeaderSize + 48) // DataOffset
+	w.WriteUint32(uint32(len(data)))   // Length
+	w.WriteUint64(offset)              // Offset
+	w.WriteFileID(fileID)
+	w.WriteUint32(0) // Channel
+	w.WriteUint32(0) // RemainingBytes
+	w.WriteUint16(0) // WriteChannelInfoOffset
+	w.WriteUint16(0) // WriteChannelInfoLength
+	w.WriteUint32(0) // Flags
+	w.WriteBytes(data)
+	return w.Bytes()
+}
+
+// TestHandleWrite_ShortWrites tests that short backend writes are completed
+// or failed, never reported as a short Count
+func TestHandleWrite_ShortWrites(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+
+	tests := []struct {
+		name  string
+		limit int
+		err   error
+		want  NTStatus
+	}{
+		{"completes in chunks", 1 << 20, nil, STATUS_SUCCESS},
+		{"no progress", 7, nil, STATUS_DISK_FULL},
+		{"short write error", 7, io.ErrShortWrite, STATUS_DISK_FULL},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, session, tree := setupTestTree(t)
+			share := tree.Share
+
+			f, err := share.fs.Create("/file.txt")
+			if err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+			sf := &shortWriteFile{File: f, chunk: 3, limit: tt.limit, err: tt.err}
+			of := share.fileHandles.Allocate(sf, "/file.txt", false, GENERIC_WRITE, 0, FILE_OPEN, 0, tree.ID, session.ID)
+			defer share.fileHandles.Release(of.ID)
+
+			resp, status := srv.handler.handleWrite(nil, testRequest(session, tree, SMB2_WRITE, buildWriteRequest(of.ID, 0, data)))
+			if status != tt.want {
+				t.Fatalf("WRITE status = %v, want %v", status, tt.want)
+			}
+			if status != STATUS_SUCCESS {
+				return
+			}
+
+			if count := le.Uint32(resp[4:8]); count != uint32(len(data)) {
+				t.Errorf("WRITE Count = %d, want %d", count, len(data))
+			}
+			if sf.written != len(data) {
+				t.Errorf("backend received %d bytes, want %d", sf.written, len(data))
+			}
+		})
+	}
+}
+
+// TestHandleCreate_DesiredAccess tests that CREATE refuses access the tree
+// or the file cannot grant, instead of deferring the failure to WRITE
+func TestHandleCreate_DesiredAccess(t *testing.T) {
+	tests := []struct {
+		name        string
+		readOnly    bool
+		fileMode    os.FileMode
+		access      uint32
+		disposition uint32
+		options     uint32
+		want        NTStatus
+		wantAccess  uint32
+	}{
+		{"read on read-only tree", true, 0644, GENERIC_READ, FILE_OPEN, 0, STATUS_SUCCESS,
+			FILE_READ_DATA | FILE_READ_ATTRIBUTES | FILE_READ_EA | READ_CONTROL | SYNCHRONIZE},
+		{"write on read-only tree", true, 0644, GENERIC_WRITE, FILE_OPEN, 0, STATUS_ACCESS_DENIED, 0},
+		{"append on read-only tree", true, 0644, FILE_APPEND_DATA, FILE_OPEN, 0, STATUS_ACCESS_DENIED, 0},
+		{"write attributes on read-only tree", true, 0644, FILE_WRITE_ATTRIBUTES, FILE_OPEN, 0, STATUS_ACCESS_DENIED, 0},
+		{"delete on read-only tree", true, 0644, DELETE, FILE_OPEN, 0, STATUS_ACCESS_DENIED, 0},
+		{"delete on close on read-only tree", true, 0644, FILE_READ_DATA, FILE_OPEN, FILE_DELETE_ON_CLOSE, STATUS_ACCESS_DENIED, 0},
+		{"maximum allowed on read-only tree", true, 0644, MAXIMUM_ALLOWED, FILE_OPEN, 0, STATUS_SUCCESS,
+			maximalAccess(true)},
+		{"write on read-only file", false, 0444, FILE_WRITE_DATA, FILE_OPEN, 0, STATUS_ACCESS_DENIED, 0},
+		{"overwrite read-only file", false, 0444, FILE_READ_DATA, FILE_OVERWRITE, 0, STATUS_ACCESS_DENIED, 0},
+		{"delete read-only file", false, 0444, DELETE, FILE_OPEN, 0, STATUS_CANNOT_DELETE, 0},
+		{"attributes of read-only file", false, 0444, FILE_WRITE_ATTRIBUTES, FILE_OPEN, 0, STATUS_SUCCESS,
+			FILE_WRITE_ATTRIBUTES},
+		{"maximum allowed on read-only file", false, 0444, MAXIMUM_ALLOWED, FILE_OPEN, 0, STATUS_SUCCESS,
+			maximalAccess(false) &^ (FILE_WRITE_DATA | FILE_APPEND_DATA | DELETE)},
+		{"generic write", false, 0644, GENERIC_WRITE, FILE_OPEN, 0, STATUS_SUCCESS,
+			FILE_WRITE_DATA | FILE_APPEND_DATA | FILE_WRITE_ATTRIBUTES | FILE_WRITE_EA | SYNCHRONIZE},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, session, tree := setupTestTree(t)
+			f, err := tree.Share.fs.Create("/file.txt")
+			if err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+			f.Close()
+			if err := tree.Share.fs.Chmod("/file.txt", tt.fileMode); err != nil {
+				t.Fatalf("Chmod() error = %v", err)
+			}
+			tree.IsReadOnly = tt.readOnly
+
+			req := buildCreateRequest("file.txt", tt.disposition, tt.options, nil)
+			le.PutUint32(req[24:28], tt.access) // DesiredAccess
+			resp, status := srv.handler.handleCreate(nil, testRequest(session, tree, SMB2_CREATE, req), nil)
+			if status != tt.want {
+				t.Fatalf("CREATE status = %v, want %v", status, tt.want)
+			}
+			if status != STATUS_SUCCESS {
+				if n := tree.Share.fileHandles.Count(); n != 0 {
+					t.Errorf("%d handles open after refused CREATE", n)
+				}
+				return
+			}
+
+			of := tree.Share.fileHandles.Get(UnmarshalFileID(resp[64:80]))
+			if of.Access != tt.wantAccess {
+				t.Errorf("granted access = 0x%x, want 0x%x", of.Access, tt.wantAccess)
+			}
+		})
+	}
+}
+
+// TestHandleCreate_ShareAccess tests that every open of a file can refuse a
+// later one its share mode does not allow, until that open is closed
+func TestHandleCreate_ShareAccess(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	f, err := tree.Share.fs.Create("/file.txt")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	f.Close()
+
+	create := func(access, shareAccess uint32) ([]byte, NTStatus) {
+		req := buildCreateRequest("file.txt", FILE_OPEN, 0, nil)
+		le.PutUint32(req[24:28], access)      // DesiredAccess
+		le.PutUint32(req[32:36], shareAccess) // ShareAccess
+		return srv.handler.handleCreate(nil, testRequest(session, tree, SMB2_CREATE, req), nil)
+	}
+
+	// A reader that shares everything, then one that shares only reading
+	if _, status := create(FILE_READ_DATA, FILE_SHARE_READ|FILE_SHARE_WRITE|FILE_SHARE_DELETE); status != STATUS_SUCCESS {
+		t.Fatalf("first CREATE status = %v", status)
+	}
+	second, status := create(FILE_READ_DATA, FILE_SHARE_READ)
+	if status != STATUS_SUCCESS {
+		t.Fatalf("second CREATE status = %v", status)
+	}
+
+	// The second open refuses writers though the first would allow them
+	for _, access := range []uint32{FILE_WRITE_DATA, FILE_APPEND_DATA, GENERIC_WRITE} {
+		if _, status := create(access, FILE_SHARE_READ|FILE_SHARE_WRITE|FILE_SHARE_DELETE); status != STATUS_SHARING_VIOLATION {
+			t.Errorf("CREATE for access 0x%x status = %v, want STATUS_SHARING_VIOLATION", access, status)
+		}
+	}
+	if n := tree.Share.fileHandles.Count(); n != 2 {
+		t.Errorf("%d handles open after refused CREATEs, want 2", n)
+	}
+
+	// Closing it lets writers in, as far as the first open shares
+	if _, status := srv.handler.handleClose(nil, testRequest(session, tree, SMB2_CLOSE, buildCloseRequest(UnmarshalFileID(second[64:80])))); status != STATUS_SUCCESS {
+		t.Fatalf("CLOSE status = %v", status)
+	}
+	if _, status := create(FILE_WRITE_DATA, FILE_SHARE_READ|FILE_SHARE_WRITE|FILE_SHARE_DELETE); status != STATUS_SUCCESS {
+		t.Errorf("CREATE for writing after CLOSE status = %v, want success", status)
+	}
+	if _, status := create(FILE_WRITE_DATA, FILE_SHARE_WRITE); status != STATUS_SHARING_VIOLATION {
+		t.Errorf("CREATE not sharing reading with a reader status = %v, want STATUS_SHARING_VIOLATION", status)
+	}
+}
+
+// signedRequest builds an ECHO request on a session, signed with key unless
+// key is nil, with RawBytes set as readMessage would
+func signedRequest(session *Session, key []byte, dialect SMBDialect) *SMB2Message {
+	header := &SMB2Header{StructureSize: SMB2HeaderSize, Command: SMB2_ECHO, SessionID: session.ID, MessageID: 5}
+	copy(header.ProtocolID[:], SMB2ProtocolID)
+	if key != nil {
+		header.Flags |= SMB2_FLAGS_SIGNED
+	}
+
+	raw := append(header.Marshal(), 4, 0, 0, 0)
+	if key != nil {
+		ApplySignature(raw, SignMessage(raw, key, dialect))
+	}
+	parsed, _ := UnmarshalSMB2Header(raw)
+	return &SMB2Message{Header: parsed, Payload: raw[SMB2HeaderSize:], RawBytes: raw}
+}
+
+// TestHandleMessage_VerifiesSignature tests that signed requests are
+// verified, tampered ones drop the connection, and unsigned ones are
+// rejected when signing is required
+func TestHandleMessage_VerifiesSignature(t *testing.T) {
+	for _, dialect := range []SMBDialect{SMB2_1, SMB3_1_1} {
+		t.Run(dialect.String(), func(t *testing.T) {
+			srv := setupTestServer(t)
+			key := []byte("0123456789abcdef")
+			session := srv.sessions.CreateSession(dialect, [16]byte{}, "127.0.0.1")
+			session.SetValid("testuser", "", false, key)
+
+			handle := func(msg *SMB2Message) (*SMB2Message, net.Conn) {
+				t.Helper()
+				server, client := net.Pipe()
+				t.Cleanup(func() { client.Close() })
+				state := &connState{conn: server, session: session, dialect: dialect, signingRequired: true}
+				resp, err := srv.handler.HandleMessage(state, msg)
+				if err != nil {
+					t.Fatalf("HandleMessage() error = %v", err)
+				}
+				return resp, client
+			}
+
+			resp, _ := handle(signedRequest(session, key, dialect))
+			if resp == nil || resp.Header.Status != STATUS_SUCCESS {
+				t.Fatalf("signed ECHO response = %+v, want STATUS_SUCCESS", resp)
+			}
+			if resp.SigningKey == nil {
+				t.Error("response to signed ECHO is not signed")
+			}
+
+			resp, _ = handle(signedRequest(session, nil, dialect))
+			if resp == nil || resp.Header.Status != STATUS_ACCESS_DENIED {
+				t.Errorf("unsigned ECHO response = %+v, want STATUS_ACCESS_DENIED", resp)
+			}
+
+			tampered := signedRequest(session, key, dialect)
+			tampered.RawBytes[len(tampered.RawBytes)-1] ^= 0x01
+			resp, client := handle(tampered)
+			if resp != nil {
+				t.Errorf("tampered ECHO got response status %v, want dropped connection", resp.Header.Status)
+			}
+			if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+				t.Errorf("connection after tampered ECHO: Read() error = %v, want io.EOF", err)
+			}
+
+			forged := signedRequest(session, []byte("fedcba9876543210"), dialect)
+			if resp, _ := handle(forged); resp != nil {
+				t.Errorf("ECHO signed with wrong key got response status %v", resp.Header.Status)
+			}
+		})
+	}
+}
+
+// TestServer_IPv6Loopback tests serving and connecting over IPv6 with
+// bracketed and bare address literals
+func TestServer_IPv6Loopback(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	srv, err := NewServer(ServerOptions{
+		Hostname: "[::1]",
+		Port:     port,
+		Network:  "tcp6",
+		Users:    map[string]string{"tester": "secret"},
+		Logger:   &NullLogger{},
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+	if err := srv.AddShare(mfs, ShareOptions{ShareName: "data"}); err != nil {
+		t.Fatalf("AddShare() error = %v", err)
+	}
+	if err := srv.Listen(); err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { srv.Stop() })
+
+	if addr := srv.Addr().(*net.TCPAddr); !addr.IP.Equal(net.IPv6loopback) {
+		t.Errorf("Addr() = %v, want ::1", addr)
+	}
+
+	for _, server := range []string{"::1", "[::1]"} {
+		fsys, err := New(&Config{
+			Server:   server,
+			Port:     port,
+			Network:  "tcp6",
+			Share:    "data",
+			Username: "tester",
+			Password: "secret",
+		})
+		if err != nil {
+			t.Fatalf("New() with server %s error = %v", server, err)
+		}
+		f, err := fsys.Create("/v6.txt")
+		if err != nil {
+			t.Fatalf("Create() over %s error = %v", server, err)
+		}
+		f.Write([]byte("over IPv6"))
+		f.Close()
+		if data, err := fsys.ReadFile("/v6.txt"); err != nil || string(data) != "over IPv6" {
+			t.Errorf("ReadFile() over %s = %q, %v, want %q", server, data, err, "over IPv6")
+		}
+		fsys.Close()
+	}
+
+	// An IPv4-only client cannot reach an IPv6 literal
+	fsys, err := New(&Config{Server: "::1", Port: port, Network: "tcp4", Share: "data", Username: "tester", Password: "secret"})
+	if err == nil {
+		if _, err = fsys.Stat("/v6.txt"); err == nil {
+			t.Error("Stat() over tcp4 to ::1 succeeded")
+		}
+		fsys.Close()
+	}
+}
+
+// TestServer_MultipleListeners tests that a server with several listeners
+// serves the same shares on each, and stops accepting on all of them
+func TestServer_MultipleListeners(t *testing.T) {
+	srv, err := NewServer(ServerOptions{
+		Listeners: []ListenerConfig{
+			{Address: "127.0.0.1:0"},
+			{Network: "tcp4", Address: "127.0.0.1:0"},
+		},
+		Users:  map[string]string{"tester": "secret"},
+		Logger: &NullLogger{},
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+	if err := srv.AddShare(mfs, ShareOptions{ShareName: "data"}); err != nil {
+		t.Fatalf("AddShare() error = %v", err)
+	}
+	if err := srv.Listen(); err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { srv.Stop() })
+
+	addrs := srv.Addrs()
+	if len(addrs) != 2 || addrs[0].String() == addrs[1].String() {
+		t.Fatalf("Addrs() = %v, want two different addresses", addrs)
+	}
+	if srv.Addr() != addrs[0] {
+		t.Errorf("Addr() = %v, want %v", srv.Addr(), addrs[0])
+	}
+
+	for i, addr := range addrs {
+		fsys, err := New(&Config{
+			Server:   "127.0.0.1",
+			Port:     addr.(*net.TCPAddr).Port,
+			Share:    "data",
+			Username: "tester",
+			Password: "secret",
+		})
+		if err != nil {
+			t.Fatalf("New() on %v error = %v", addr, err)
+		}
+		name := []string{"/first.txt", "/second.txt"}[i]
+		f, err := fsys.Create(name)
+		if err != nil {
+			t.Fatalf("Create() on %v error = %v", addr, err)
+		}
+		f.Close()
+		fsys.Close()
+		if _, err := mfs.Stat(name); err != nil {
+			t.Errorf("file written on %v not in the share: %v", addr, err)
+		}
+	}
+
+	srv.Stop()
+	for _, addr := range addrs {
+		if conn, err := net.DialTimeout("tcp", addr.String(), time.Second); err == nil {
+			conn.Close()
+			t.Errorf("Dial(%v) after Stop() succeeded", addr)
+		}
+	}
+
+	// A listener that cannot be opened fails Listen without leaving the
+	// others open
+	bad, err := NewServer(ServerOptions{
+		Listeners: []ListenerConfig{{Address: "127.0.0.1:0"}, {Network: "udp", Address: "127.0.0.1:0"}},
+		Logger:    &NullLogger{},
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	if err := bad.Listen(); err == nil {
+		bad.Stop()
+		t.Error("Listen() with a udp listener succeeded")
+	}
+}
+
+// selfSignedTLS returns a server TLS configuration with a certificate for
+// 127.0.0.1, and a client configuration that trusts it
+func selfSignedTLS(t *testing.T) (server, client *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "smbfs test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate() error = %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}},
+		&tls.Config{RootCAs: roots}
+}
+
+// TestServer_TLSListener tests reading and writing a file over SMB inside
+// TLS, next to a plain listener on the same server
+func TestServer_TLSListener(t *testing.T) {
+	serverTLS, clientTLS := selfSignedTLS(t)
+	srv, err := NewServer(ServerOptions{
+		Listeners: []ListenerConfig{
+			{Address: "127.0.0.1:0"},
+			{Address: "127.0.0.1:0", TLSConfig: serverTLS},
+		},
+		Users:  map[string]string{"tester": "secret"},
+		Logger: &NullLogger{},
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+	if err := srv.AddShare(mfs, ShareOptions{ShareName: "data"}); err != nil {
+		t.Fatalf("AddShare() error = %v", err)
+	}
+	if err := srv.Listen(); err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { srv.Stop() })
+	plainPort := srv.Addrs()[0].(*net.TCPAddr).Port
+	tlsPort := srv.Addrs()[1].(*net.TCPAddr).Port
+
+	fsys, err := New(&Config{
+		Server:    "127.0.0.1",
+		Port:      tlsPort,
+		Share:     "data",
+		Username:  "tester",
+		Password:  "secret",
+		TLSConfig: clientTLS,
+	})
+	if err != nil {
+		t.Fatalf("New() over TLS error = %v", err)
+	}
+	defer fsys.Close()
+
+	data := bytes.Repeat([]byte("over TLS "), 10000)
+	f, err := fsys.Create("/tls.txt")
+	if err != nil {
+		t.Fatalf("Create() over TLS error = %v", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("Write() over TLS error = %v", err)
+	}
+	f.Close()
+	f, err = fsys.Open("/tls.txt")
+	if err != nil {
+		t.Fatalf("Open() over TLS error = %v", err)
+	}
+	got, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read back %d bytes over TLS, %v, want %d bytes", len(got), err, len(data))
+	}
+
+	// A TLS client is refused by the plain listener, and a client that does
+	// not trust the certificate by the TLS one
+	for _, cfg := range []*Config{
+		{Port: plainPort, TLSConfig: clientTLS},
+		{Port: tlsPort, TLSConfig: &tls.Config{}},
+	} {
+		cfg.Server, cfg.Share, cfg.Username, cfg.Password = "127.0.0.1", "data", "tester", "secret"
+		cfg.ConnTimeout = 500 * time.Millisecond
+		cfg.RetryPolicy = &RetryPolicy{MaxAttempts: 1}
+		other, err := New(cfg)
+		if err == nil {
+			_, err = other.Stat("/tls.txt")
+			other.Close()
+		}
+		if err == nil {
+			t.Errorf("Stat() on port %d with TLS config %p succeeded", cfg.Port, cfg.TLSConfig)
+		}
+	}
+}
+
+// TestServer_FileAttributes tests that CREATE, QUERY_INFO and
+// QUERY_DIRECTORY report the same attributes for a file
+func TestServer_FileAttributes(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	share := tree.Share
+	share.fs.Mkdir("/dir", 0755)
+	share.fs.Mkdir("/dir/.git", 0755)
+	for _, name := range []string{"/dir/.profile", "/dir/ro.txt", "/dir/plain.txt"} {
+		f, _ := share.fs.Create(name)
+		f.Close()
+	}
+	share.fs.Chmod("/dir/ro.txt", 0444)
+
+	want := map[string]uint32{
+		".git":      FILE_ATTRIBUTE_DIRECTORY | FILE_ATTRIBUTE_HIDDEN,
+		".profile":  FILE_ATTRIBUTE_ARCHIVE | FILE_ATTRIBUTE_HIDDEN,
+		"ro.txt":    FILE_ATTRIBUTE_ARCHIVE | FILE_ATTRIBUTE_READONLY,
+		"plain.txt": FILE_ATTRIBUTE_ARCHIVE,
+	}
+	for name, attrs := range want {
+		req := buildCreateRequest("dir\\"+name, FILE_OPEN, 0, nil)
+		le.PutUint32(req[24:28], FILE_READ_ATTRIBUTES)
+		resp, status := srv.handler.handleCreate(nil, testRequest(session, tree, SMB2_CREATE, req), nil)
+		if status != STATUS_SUCCESS {
+			t.Fatalf("CREATE %s status = %v", name, status)
+		}
+		if got := le.Uint32(resp[56:60]); got != attrs {
+			t.Errorf("CREATE %s FileAttributes = %#x, want %#x", name, got, attrs)
+		}
+		fileID := UnmarshalFileID(resp[64:80])
+
+		resp, status = srv.handler.handleQueryInfo(nil, testRequest(session, tree, SMB2_QUERY_INFO,
+			buildQueryInfoRequest(fileID, SMB2_0_INFO_FILE, FileBasicInformation, 0, 4096)))
+		if status != STATUS_SUCCESS {
+			t.Fatalf("QUERY_INFO %s status = %v", name, status)
+		}
+		if got := le.Uint32(resp[40:44]); got != attrs {
+			t.Errorf("QUERY_INFO %s FileAttributes = %#x, want %#x", name, got, attrs)
+		}
+		srv.handler.handleClose(nil, testRequest(session, tree, SMB2_CLOSE, buildCloseRequest(fileID)))
+	}
+
+	dir, err := share.fs.Open("/dir")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	of := share.fileHandles.Allocate(dir, "dir", true, GENERIC_READ, FILE_SHARE_READ, FILE_OPEN, FILE_DIRECTORY_FILE, tree.ID, session.ID)
+	defer share.fileHandles.Release(of.ID)
+	resp, status := srv.handler.handleQueryDirectory(nil,
+		testRequest(session, tree, SMB2_QUERY_DIRECTORY, buildQueryDirectoryRequest(of.ID, FileIdFullDirectoryInformation, 0, "*")))
+	if status != STATUS_SUCCESS {
+		t.Fatalf("QUERY_DIRECTORY status = %v, want STATUS_SUCCESS", status)
+	}
+	buf := resp[8 : 8+le.Uint32(resp[4:8])]
+	for seen := 0; ; seen++ {
+		name := DecodeUTF16LEToString(buf[80 : 80+le.Uint32(buf[60:64])])
+		if got := le.Uint32(buf[56:60]); got != want[name] {
+			t.Errorf("QUERY_DIRECTORY %s FileAttributes = %#x, want %#x", name, got, want[name])
+		}
+		next := le.Uint32(buf[0:4])
+		if next == 0 {
+			if seen+1 != len(want) {
+				t.Errorf("QUERY_DIRECTORY returned %d entries, want %d", seen+1, len(want))
+			}
+			break
+		}
+		buf = buf[next:]
+	}
+}
+
+// TestServer_GlobalReadOnly tests that making the server read-only mid
+// session refuses every change, including through handles already open,
+// while reads go on, and that lifting it allows changes again
+func TestServer_GlobalReadOnly(t *testing.T) {
+	srv, config := startLoopbackServer(t, ServerOptions{})
+	config.RetryPolicy = &RetryPolicy{MaxAttempts: 1}
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	if err := fsys.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("Mkdir() error = %v", err)
+	}
+	f, err := fsys.OpenFile("/open.txt", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("before")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	srv.SetGlobalReadOnly(true)
+	if !srv.GlobalReadOnly() {
+		t.Fatal("GlobalReadOnly() = false after SetGlobalReadOnly(true)")
+	}
+	if _, err := f.Write([]byte("during")); err == nil {
+		t.Error("Write() through an open handle succeeded on a read-only server")
+	}
+	changes := map[string]func() error{
+		"Create": func() error {
+			f, err := fsys.Create("/new.txt")
+			if err == nil {
+				f.Close()
+			}
+			return err
+		},
+		"Mkdir":           func() error { return fsys.Mkdir("/newdir", 0755) },
+		"Remove file":     func() error { return fsys.Remove("/hello.txt") },
+		"Remove dir":      func() error { return fsys.Remove("/dir") },
+		"Rename":          func() error { return fsys.Rename("/hello.txt", "/renamed.txt") },
+		"Chtimes":         func() error { return fsys.Chtimes("/hello.txt", time.Now(), time.Now()) },
+		"File.Truncate":   func() error { return f.Truncate(1) },
+		"OpenFile O_RDWR": func() error { _, err := fsys.OpenFile("/hello.txt", os.O_RDWR|os.O_TRUNC, 0); return err },
+	}
+	for name, change := range changes {
+		if err := change(); err == nil {
+			t.Errorf("%s succeeded on a read-only server", name)
+		}
+	}
+
+	// Reads go on
+	r, err := fsys.Open("/hello.txt")
+	if err != nil {
+		t.Fatalf("Open() on a read-only server error = %v", err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != "hello" {
+		t.Errorf("read on a read-only server = %q, %v, want hello", data, err)
+	}
+	if _, err := fsys.ReadDir("/"); err != nil {
+		t.Errorf("ReadDir() on a read-only server error = %v", err)
+	}
+
+	srv.SetGlobalReadOnly(false)
+	if _, err := f.Write([]byte(" after")); err != nil {
+		t.Errorf("Write() after lifting read-only error = %v", err)
+	}
+	if err := fsys.Rename("/hello.txt", "/renamed.txt"); err != nil {
+		t.Errorf("Rename() after lifting read-only error = %v", err)
+	}
+}
+
+// TestHandleMessage_UnknownCommand tests that a command code the server
+// does not know gets a well-formed STATUS_NOT_IMPLEMENTED response and the
+// connection stays usable
+func TestHandleMessage_UnknownCommand(t *testing.T) {
+	srv := setupTestServer(t)
+	conn := serveTestConn(t, srv)
+
+	conn.Write(frameRequests(false, &SMB2Message{
+		Header:  &SMB2Header{StructureSize: SMB2HeaderSize, Command: 0x0055, MessageID: 0, CreditRequest: 1},
+		Payload: []byte{2, 0},
+	}))
+	resp := readTestResponse(t, conn)
+	if resp.Header.Status != STATUS_NOT_IMPLEMENTED {
+		t.Errorf("status = %v, want STATUS_NOT_IMPLEMENTED", resp.Header.Status)
+	}
+	if resp.Header.Command != 0x0055 || resp.Header.MessageID != 0 || resp.Header.Flags&SMB2_FLAGS_SERVER_TO_REDIR == 0 {
+		t.Errorf("response header = command 0x%04x, message %d, flags 0x%x, want a response to 0x0055, message 0",
+			resp.Header.Command, resp.Header.MessageID, resp.Header.Flags)
+	}
+	if len(resp.Payload) != 9 || le.Uint16(resp.Payload) != 9 {
+		t.Errorf("error response payload = % x, want an SMB2 ERROR response", resp.Payload)
+	}
+
+	conn.Write(frameRequests(false, &SMB2Message{
+		Header:  &SMB2Header{StructureSize: SMB2HeaderSize, Command: SMB2_ECHO, MessageID: 1, CreditRequest: 1},
+		Payload: []byte{4, 0, 0, 0},
+	}))
+	if resp := readTestResponse(t, conn); resp.Header.Command != SMB2_ECHO || resp.Header.Status != STATUS_SUCCESS {
+		t.Errorf("ECHO after the unknown command = %s %v, want ECHO STATUS_SUCCESS",
+			CommandName(resp.Header.Command), resp.Header.Status)
+	}
+}
+
+// buildSMB1Negotiate builds a NetBIOS-framed SMB1 NEGOTIATE offering the
+// dialects of a client that also speaks SMB2
+func buildSMB1Negotiate() []byte {
+	var dialects []byte
+	for _, d := range []string{"PC NETWORK PROGRAM 1.0", "NT LM 0.12", "SMB 2.002", "SMB 2.???"} {
+		dialects = append(dialects, 0x02)
+		dialects = append(dialects, d...)
+		dialects = append(dialects, 0)
+	}
+	msg := make([]byte, smb1HeaderSize, smb1HeaderSize+3+len(dialects))
+	copy(msg, "\xffSMB")
+	msg[4] = smb1ComNegotiate
+	le.PutUint16(msg[30:], 7) // MID
+	msg = append(msg, 0)      // WordCount
+	msg = le.AppendUint16(msg, uint16(len(dialects)))
+	msg = append(msg, dialects...)
+	return append([]byte{0, 0, byte(len(msg) >> 8), byte(len(msg))}, msg...)
+}
+
+// TestServer_SMB1Policy tests that an SMB1 NEGOTIATE is upgraded to SMB2 by
+// default, and refused with no common dialect under SMB1Reject
+func TestServer_SMB1Policy(t *testing.T) {
+	t.Run("upgrade", func(t *testing.T) {
+		srv := setupTestServer(t)
+		conn := serveTestConn(t, srv)
+		conn.Write(buildSMB1Negotiate())
+
+		resp := readTestResponse(t, conn)
+		if resp.Header.Command != SMB2_NEGOTIATE || NTStatus(resp.Header.Status) != STATUS_SUCCESS {
+			t.Errorf("response = command %d, status %v, want a successful SMB2 NEGOTIATE",
+				resp.Header.Command, NTStatus(resp.Header.Status))
+		}
+		if n := srv.Metrics().SMB1Rejected; n != 0 {
+			t.Errorf("SMB1Rejected = %d, want 0", n)
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		srv, err := NewServer(ServerOptions{Logger: &NullLogger{}, SMB1Policy: SMB1Reject})
+		if err != nil {
+			t.Fatalf("NewServer() error = %v", err)
+		}
+		conn := serveTestConn(t, srv)
+		conn.Write(buildSMB1Negotiate())
+
+		raw := readTestFrame(t, conn)
+		if len(raw) != smb1HeaderSize+5 || string(raw[:4]) != "\xffSMB" || raw[4] != smb1ComNegotiate {
+			t.Fatalf("response = %x, want an SMB1 NEGOTIATE response", raw)
+		}
+		if raw[9]&0x80 == 0 || le.Uint16(raw[30:]) != 7 {
+			t.Errorf("response flags %#x, MID %d, want a reply to MID 7", raw[9], le.Uint16(raw[30:]))
+		}
+		if index := le.Uint16(raw[smb1HeaderSize+1:]); index != 0xFFFF {
+			t.Errorf("DialectIndex = %#x, want 0xFFFF", index)
+		}
+
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("Read() after the response = %v, want EOF", err)
+		}
+		srv.wg.Wait()
+		if n := srv.Metrics().SMB1Rejected; n != 1 {
+			t.Errorf("SMB1Rejected = %d, want 1", n)
+		}
+	})
+}
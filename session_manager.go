@@ -27,6 +27,12 @@ type Session struct {
 	CreatedAt    time.Time
 	LastActivity time.Time
 
+	// Encryption state (SMB 3.x), set when the client supports encryption
+	EncryptionKey []byte // Server-to-client cipher key
+	DecryptionKey []byte // Client-to-server cipher key
+	CipherID      uint16 // Negotiated SMB2_ENCRYPTION_* cipher
+	EncryptData   bool   // All requests on the session must be encrypted
+
 	// Connection info
 	ClientGUID [16]byte
 	ClientIP   string
@@ -34,6 +40,9 @@ type Session struct {
 	// Authentication state (for multi-step auth like NTLM)
 	Authenticator Authenticator
 
+	// Paces READ and WRITE to ServerOptions.MaxBytesPerSecPerSession
+	bandwidth byteBucket
+
 	// Tree connections for this session
 	mu     sync.RWMutex
 	trees  map[uint32]*TreeConnection
@@ -47,7 +56,8 @@ type TreeConnection struct {
 	Share      *Share
 	Session    *Session
 	CreatedAt  time.Time
-	IsReadOnly bool // Effective read-only status (share or session)
+	IsReadOnly bool        // Effective read-only status (share or session)
+	bandwidth  *byteBucket // Paces READ and WRITE to the share's MaxBytesPerSecPerSession
 }
 
 // SessionManager tracks active sessions
@@ -163,6 +173,12 @@ func (m *SessionManager) DestroySession(id uint64) *Session {
 		}
 	}
 	m.mu.Unlock()
+
+	if session != nil {
+		session.mu.Lock()
+		clear(session.trees)
+		session.mu.Unlock()
+	}
 	return session
 }
 
@@ -227,6 +243,7 @@ func (s *Session) AddTreeConnection(shareName string, share *Share, readOnly boo
 		Session:    s,
 		CreatedAt:  time.Now(),
 		IsReadOnly: readOnly,
+		bandwidth:  &byteBucket{},
 	}
 
 	s.trees[treeID] = tree
@@ -3,6 +3,7 @@ package smbfs
 import (
 	"context"
 	"fmt"
+	"os"
 )
 
 // ShareType represents the type of SMB share.
@@ -57,8 +58,9 @@ type ShareInfo struct {
 
 // ListShares returns a list of available shares on the SMB server.
 //
-// This method connects to the IPC$ share to enumerate available shares.
-// The connection uses the same credentials as the main filesystem.
+// This method connects to the IPC$ share and calls NetrShareEnum (MS-SRVS)
+// over the srvsvc named pipe. The connection uses the same credentials as the
+// main filesystem. Servers do not list hidden shares.
 //
 // Note: Some servers may restrict share enumeration. If the operation fails,
 // it may be due to insufficient permissions or server configuration.
@@ -73,39 +75,105 @@ type ShareInfo struct {
 //	    fmt.Printf("%s: %s (%s)\n", share.Name, share.Comment, share.Type)
 //	}
 func (fsys *FileSystem) ListShares(ctx context.Context) ([]ShareInfo, error) {
-	// For share enumeration, we need to connect to IPC$ share
-	// and use the NetShareEnum RPC call. However, go-smb2 doesn't
-	// directly expose this functionality.
-	//
-	// As a workaround, we return information about the current share
-	// and note that full share enumeration requires additional RPC support.
-
-	// This is a basic implementation that returns the current share
-	// A full implementation would use MS-SRVS NetShareEnum RPC call
-
-	if fsys.config.Logger != nil {
-		fsys.config.Logger.Printf("Share enumeration requested (limited implementation)")
+	conn, err := fsys.pool.get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list shares: %w", err)
 	}
+	defer fsys.pool.put(conn)
 
-	// Return the current share as a known share
-	shares := []ShareInfo{
-		{
-			Name:    fsys.config.Share,
-			Type:    ShareTypeDisk, // Assume disk share
-			Comment: "Current share",
-		},
+	ipc, err := conn.session.Mount("IPC$")
+	if err != nil {
+		return nil, fmt.Errorf("list shares: mount IPC$: %w", convertError(err))
 	}
+	defer ipc.Umount()
 
+	// Bind the pipe's requests to ctx if the share supports it
+	pipe, err := shareWithContext(ipc, ctx).OpenFile("srvsvc", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("list shares: open srvsvc pipe: %w", convertError(err))
+	}
+	// Let the close go through even if ctx is done
+	defer fileWithContext(pipe, context.WithoutCancel(ctx)).Close()
+
+	entries, err := netrShareEnum(pipe, fsys.config.host())
+	if err != nil {
+		return nil, fmt.Errorf("list shares: %w", err)
+	}
+
+	shares := make([]ShareInfo, len(entries))
+	for i, e := range entries {
+		shares[i] = ShareInfo{Name: e.name, Type: ShareType(e.shareType), Comment: e.comment}
+	}
 	return shares, nil
 }
 
-// Note: Full share enumeration requires implementing MS-SRVS protocol
-// which involves:
-// 1. Connecting to IPC$ share
-// 2. Opening \PIPE\srvsvc named pipe
-// 3. Making NetShareEnum RPC call
-// 4. Parsing the response
+// MountShare returns a filesystem for another share on the same server.
+// Its connections mount the share on the authenticated sessions of fsys,
+// so no new logon is made while fsys has one. It has its own cache and
+// open handles but otherwise the Config of fsys. Either filesystem may be
+// closed first; a session is logged off once neither uses it.
 //
-// This is complex and beyond the scope of the go-smb2 library's current
-// capabilities. The above implementation provides basic functionality.
-// For full implementation, see: https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-srvs/
+// The share is connected to before MountShare returns, so a share that
+// does not exist or cannot be accessed fails here.
+func (fsys *FileSystem) MountShare(shareName string) (*FileSystem, error) {
+	config := *fsys.config
+	config.Share = shareName
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	pool := newConnectionPoolWithFactory(&config, fsys.pool.factory)
+	pool.parent = fsys.pool
+	sub := newFileSystem(&config, pool)
+
+	conn, err := pool.get(fsys.ctx)
+	if err != nil {
+		sub.Close()
+		return nil, fmt.Errorf("mount share %s: %w", shareName, convertError(err))
+	}
+	pool.put(conn)
+	return sub, nil
+}
+
+// netrShareEnum binds to the srvsvc interface on an open srvsvc pipe and
+// enumerates the server's shares at level 1.
+func netrShareEnum(pipe SMBFile, serverName string) ([]srvsvcShare, error) {
+	const bindCallID, enumCallID = 1, 2
+
+	// Each read returns one reply fragment, which is at most rpcMaxFragSize
+	// bytes; the larger buffer leaves room for servers that ignore the limit.
+	buf := make([]byte, 64<<10)
+
+	if _, err := pipe.Write(buildRPCBind(bindCallID)); err != nil {
+		return nil, err
+	}
+	n, err := pipe.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	if err := parseRPCBindAck(buf[:n], bindCallID); err != nil {
+		return nil, err
+	}
+
+	req := buildRPCRequest(enumCallID, srvsvcOpNetrShareEnum, buildNetrShareEnumRequest(serverName))
+	if _, err := pipe.Write(req); err != nil {
+		return nil, err
+	}
+
+	var stub []byte
+	for {
+		n, err := pipe.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		frag, last, err := parseRPCResponse(buf[:n], enumCallID)
+		if err != nil {
+			return nil, err
+		}
+		stub = append(stub, frag...)
+		if last {
+			break
+		}
+	}
+	return parseNetrShareEnumResponse(stub)
+}
@@ -0,0 +1,99 @@
+package smbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/absfs/memfs"
+)
+
+// TestFileSystem_MountShare tests that a mounted share connects over the
+// session of the filesystem it came from, which stays logged on until
+// both are closed
+func TestFileSystem_MountShare(t *testing.T) {
+	fsys, backend, factory := setupMockFS(t)
+	backend.AddShare("other")
+	backend.AddFile("/hello.txt", []byte("hello"), 0644)
+
+	if _, err := fsys.Stat("/hello.txt"); err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	other, err := fsys.MountShare("other")
+	if err != nil {
+		t.Fatalf("MountShare() error = %v", err)
+	}
+	if data, err := other.ReadFile("/hello.txt"); err != nil || string(data) != "hello" {
+		t.Errorf("ReadFile() on the mounted share = %q, %v", data, err)
+	}
+	if n := factory.ConnectionsMade(); n != 1 {
+		t.Errorf("connections made = %d, want 1", n)
+	}
+	if n := countOps(backend, "mount"); n != 2 {
+		t.Errorf("shares mounted = %d, want 2", n)
+	}
+
+	if _, err := fsys.MountShare("missing"); err == nil {
+		t.Error("MountShare() of a missing share succeeded")
+	}
+
+	// Closing the first filesystem leaves the session to the second
+	fsys.Close()
+	time.Sleep(50 * time.Millisecond)
+	if n := countOps(backend, "logoff"); n != 0 {
+		t.Errorf("logoffs after closing the first filesystem = %d, want 0", n)
+	}
+	if _, err := other.Stat("/hello.txt"); err != nil {
+		t.Errorf("Stat() on the mounted share after closing the first = %v", err)
+	}
+
+	other.Close()
+	deadline := time.Now().Add(time.Second)
+	for countOps(backend, "logoff") != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := countOps(backend, "logoff"); n != 1 {
+		t.Errorf("logoffs after closing both = %d, want 1", n)
+	}
+}
+
+// TestFileSystem_MountShare_Loopback tests that a second share of the
+// in-repo server is used without a second logon
+func TestFileSystem_MountShare_Loopback(t *testing.T) {
+	srv, config := startLoopbackServer(t, ServerOptions{})
+	mfs, _ := memfs.NewFS()
+	f, _ := mfs.Create("/other.txt")
+	f.Write([]byte("other"))
+	f.Close()
+	if err := srv.AddShare(mfs, ShareOptions{ShareName: "other"}); err != nil {
+		t.Fatalf("AddShare() error = %v", err)
+	}
+
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+	other, err := fsys.MountShare("other")
+	if err != nil {
+		t.Fatalf("MountShare() error = %v", err)
+	}
+	defer other.Close()
+
+	if data, err := fsys.ReadFile("/hello.txt"); err != nil || string(data) != "hello" {
+		t.Errorf("ReadFile() on data = %q, %v", data, err)
+	}
+	if data, err := other.ReadFile("/other.txt"); err != nil || string(data) != "other" {
+		t.Errorf("ReadFile() on other = %q, %v", data, err)
+	}
+
+	srv.sessions.mu.RLock()
+	defer srv.sessions.mu.RUnlock()
+	if n := len(srv.sessions.sessions); n != 1 {
+		t.Fatalf("server sessions = %d, want 1", n)
+	}
+	for _, session := range srv.sessions.sessions {
+		if n := len(session.GetAllTreeConnections()); n != 2 {
+			t.Errorf("tree connections = %d, want 2", n)
+		}
+	}
+}
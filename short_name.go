@@ -0,0 +1,127 @@
+package smbfs
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 8.3 short names, for FileAlternateNameInformation and the ShortName of
+// FileBothDirectoryInformation entries. They are derived from the long
+// names in the directory each time they are asked for, rather than stored:
+// names that are already 8.3 keep their own name, uppercased, and the rest
+// are given the first free BASE~N.EXT in sorted order of the long names
+
+// shortNameSpecial are the characters besides letters and digits that 8.3
+// names may contain
+const shortNameSpecial = "!#$%&'()-@^_`{}~"
+
+// isShortName reports whether name is valid as an 8.3 name, ignoring case
+func isShortName(name string) bool {
+	base, ext, _ := strings.Cut(name, ".")
+	if base == "" || len(base) > 8 || len(ext) > 3 || strings.Contains(ext, ".") {
+		return false
+	}
+	if strings.HasSuffix(name, ".") {
+		return false
+	}
+	return shortNameClean(base) == strings.ToUpper(base) && shortNameClean(ext) == strings.ToUpper(ext)
+}
+
+// shortNameClean uppercases s for an 8.3 name, dropping spaces and dots and
+// replacing characters 8.3 names cannot contain with underscores
+func shortNameClean(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(s) {
+		switch {
+		case r == ' ' || r == '.':
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune(shortNameSpecial, r):
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// shortNameParts returns the base and extension the short name of a long
+// name is made from. The extension is what follows the last dot, leading
+// dots aside, cut to three characters
+func shortNameParts(name string) (base, ext string) {
+	name = strings.TrimLeft(name, ".")
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		base, ext = shortNameClean(name[:i]), shortNameClean(name[i+1:])
+	} else {
+		base = shortNameClean(name)
+	}
+	if len(ext) > 3 {
+		ext = ext[:3]
+	}
+	if base == "" {
+		base = "_"
+	}
+	return base, ext
+}
+
+// shortNames returns the 8.3 names of the entries of a directory, by long
+// name. "." and ".." have none
+func shortNames(names []string) map[string]string {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+
+	short := make(map[string]string, len(sorted))
+	taken := make(map[string]bool, len(sorted))
+	var generate []string
+	for _, name := range sorted {
+		if name == "." || name == ".." {
+			continue
+		}
+		if upper := strings.ToUpper(name); isShortName(name) && !taken[upper] {
+			short[name] = upper
+			taken[upper] = true
+		} else {
+			generate = append(generate, name)
+		}
+	}
+
+	for _, name := range generate {
+		base, ext := shortNameParts(name)
+		for n := 1; ; n++ {
+			tail := "~" + strconv.Itoa(n)
+			candidate := base
+			if len(candidate) > 8-len(tail) {
+				candidate = candidate[:8-len(tail)]
+			}
+			candidate += tail
+			if ext != "" {
+				candidate += "." + ext
+			}
+			if !taken[candidate] {
+				short[name] = candidate
+				taken[candidate] = true
+				break
+			}
+		}
+	}
+	return short
+}
+
+// shortName returns the 8.3 name of the file name, from the listing of its
+// directory. It returns "" for the share root or if the directory cannot
+// be read
+func (s *Share) shortName(name string) string {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return ""
+	}
+	entries, err := s.FileSystem().ReadDir(path.Dir(name))
+	if err != nil {
+		return ""
+	}
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+	return shortNames(names)[path.Base(name)]
+}
@@ -0,0 +1,114 @@
+package smbfs
+
+import (
+	"testing"
+)
+
+func TestShortNames(t *testing.T) {
+	names := []string{
+		"README.TXT",
+		"notes.md",
+		"My Document.docx",
+		"Program Files",
+		"verylongfilename.txt",
+		"verylongfilename2.txt",
+		"verylongfile.text",
+		"archive.tar.gz",
+		".bashrc",
+		"a+b=c.txt",
+		"readme.txt",
+		".",
+		"..",
+	}
+	want := map[string]string{
+		"README.TXT":            "README.TXT",
+		"notes.md":              "NOTES.MD",
+		"My Document.docx":      "MYDOCU~1.DOC",
+		"Program Files":         "PROGRA~1",
+		"verylongfile.text":     "VERYLO~1.TEX",
+		"verylongfilename.txt":  "VERYLO~1.TXT",
+		"verylongfilename2.txt": "VERYLO~2.TXT",
+		"archive.tar.gz":        "ARCHIV~1.GZ",
+		".bashrc":               "BASHRC~1",
+		"a+b=c.txt":             "A_B_C~1.TXT",
+		"readme.txt":            "README~1.TXT", // README.TXT is taken
+	}
+
+	got := shortNames(names)
+	if len(got) != len(want) {
+		t.Errorf("shortNames() gave %d names, want %d: %v", len(got), len(want), got)
+	}
+	for name, short := range want {
+		if got[name] != short {
+			t.Errorf("short name of %q = %q, want %q", name, got[name], short)
+		}
+	}
+
+	// Past ~9 the base gives way to the longer tail
+	var many []string
+	for i := 0; i < 12; i++ {
+		many = append(many, "collision"+string(rune('a'+i))+".txt")
+	}
+	got = shortNames(many)
+	if got["collisiona.txt"] != "COLLIS~1.TXT" || got["collisioni.txt"] != "COLLIS~9.TXT" ||
+		got["collisionj.txt"] != "COLLI~10.TXT" || got["collisionl.txt"] != "COLLI~12.TXT" {
+		t.Errorf("short names of colliding names = %v", got)
+	}
+}
+
+// TestQueryInfo_FileAlternateNameInformation tests that QUERY_INFO and
+// FileBothDirectoryInformation listings report the same short names
+func TestQueryInfo_FileAlternateNameInformation(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	share := tree.Share
+	share.fs.Mkdir("/dir", 0755)
+	for _, name := range []string{"/dir/Long File Name.txt", "/dir/Long File Name 2.txt", "/dir/short.txt"} {
+		f, _ := share.fs.Create(name)
+		f.Close()
+	}
+
+	dir, _ := share.fs.Open("/dir")
+	of := share.fileHandles.Allocate(dir, "dir", true, GENERIC_READ, FILE_SHARE_READ, FILE_OPEN, FILE_DIRECTORY_FILE, tree.ID, session.ID)
+	defer share.fileHandles.Release(of.ID)
+	resp, status := srv.handler.handleQueryDirectory(nil,
+		testRequest(session, tree, SMB2_QUERY_DIRECTORY, buildQueryDirectoryRequest(of.ID, FileBothDirectoryInformation, 0, "*")))
+	if status != STATUS_SUCCESS {
+		t.Fatalf("QUERY_DIRECTORY status = %v, want STATUS_SUCCESS", status)
+	}
+	listed := make(map[string]string)
+	buf := resp[8 : 8+le.Uint32(resp[4:8])]
+	for {
+		nameLen := int(le.Uint32(buf[60:64]))
+		name := DecodeUTF16LEToString(buf[94 : 94+nameLen])
+		listed[name] = DecodeUTF16LEToString(buf[70 : 70+int(buf[68])])
+		next := le.Uint32(buf[0:4])
+		if next == 0 {
+			break
+		}
+		buf = buf[next:]
+	}
+
+	want := map[string]string{
+		"Long File Name.txt":   "LONGFI~2.TXT",
+		"Long File Name 2.txt": "LONGFI~1.TXT",
+		"short.txt":            "SHORT.TXT",
+	}
+	for name, short := range want {
+		if listed[name] != short {
+			t.Errorf("listed short name of %q = %q, want %q", name, listed[name], short)
+		}
+
+		file, _ := share.fs.Open("/dir/" + name)
+		fof := share.fileHandles.Allocate(file, "dir/"+name, false, GENERIC_READ, FILE_SHARE_READ, FILE_OPEN, 0, tree.ID, session.ID)
+		resp, status := srv.handler.handleQueryInfo(nil, testRequest(session, tree, SMB2_QUERY_INFO,
+			buildQueryInfoRequest(fof.ID, SMB2_0_INFO_FILE, FileAlternateNameInformation, 0, 256)))
+		share.fileHandles.Release(fof.ID)
+		if status != STATUS_SUCCESS {
+			t.Errorf("QUERY_INFO FileAlternateNameInformation of %q status = %v", name, status)
+			continue
+		}
+		if got := DecodeUTF16LEToString(resp[12 : 12+le.Uint32(resp[8:12])]); got != short {
+			t.Errorf("FileAlternateNameInformation of %q = %q, want %q", name, got, short)
+		}
+	}
+}
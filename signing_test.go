@@ -0,0 +1,226 @@
+package smbfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/absfs/smbfs/internal/smb2"
+)
+
+// TestRequireSigning_Loopback tests a client requiring signatures against
+// the in-repo server requiring them too, for HMAC-SHA256 and AES-CMAC
+func TestRequireSigning_Loopback(t *testing.T) {
+	for _, dialect := range []SMBDialect{SMB2_1, SMB3_0_2, SMB3_1_1} {
+		t.Run(dialect.String(), func(t *testing.T) {
+			_, config := startLoopbackServer(t, ServerOptions{
+				MaxDialect:      dialect,
+				SigningRequired: true,
+			})
+			config.RequireSigning = true
+
+			fsys, err := New(config)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			defer fsys.Close()
+
+			data, err := fsys.ReadFile("/hello.txt")
+			if err != nil {
+				t.Fatalf("ReadFile() error = %v", err)
+			}
+			if string(data) != "hello" {
+				t.Errorf("ReadFile() = %q, want %q", data, "hello")
+			}
+		})
+	}
+}
+
+// corruptingProxy forwards connections to target, flipping a byte in the
+// payload of every signed READ response
+func corruptingProxy(t *testing.T, target string) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			client, err := l.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", target)
+			if err != nil {
+				client.Close()
+				return
+			}
+			go func() {
+				io.Copy(server, client)
+				server.Close()
+			}()
+			go func() {
+				defer client.Close()
+				for {
+					frame := make([]byte, 4)
+					if _, err := io.ReadFull(server, frame); err != nil {
+						return
+					}
+					size := int(frame[1])<<16 | int(frame[2])<<8 | int(frame[3])
+					msg := make([]byte, size)
+					if _, err := io.ReadFull(server, msg); err != nil {
+						return
+					}
+					if size > SMB2HeaderSize && string(msg[0:4]) == SMB2ProtocolID &&
+						binary.LittleEndian.Uint16(msg[12:14]) == SMB2_READ &&
+						binary.LittleEndian.Uint32(msg[16:20])&SMB2_FLAGS_SIGNED != 0 {
+						msg[size-1] ^= 0xFF
+					}
+					if _, err := client.Write(append(frame, msg...)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// TestRequireSigning_Mismatch tests that a response altered in transit
+// fails the operation with ErrSignatureMismatch
+func TestRequireSigning_Mismatch(t *testing.T) {
+	_, config := startLoopbackServer(t, ServerOptions{SigningRequired: true})
+
+	host, port, _ := net.SplitHostPort(corruptingProxy(t, net.JoinHostPort(config.Server, strconv.Itoa(config.Port))))
+	config.Server = host
+	config.Port, _ = strconv.Atoi(port)
+	config.RequireSigning = true
+
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	f, err := fsys.Open("/hello.txt")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer f.Close()
+
+	_, err = f.Read(make([]byte, 16))
+	if !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("Read() error = %v, want ErrSignatureMismatch", err)
+	}
+}
+
+// TestConvertError_SignatureFailure tests mapping of go-smb2 verification errors
+func TestConvertError_SignatureFailure(t *testing.T) {
+	for _, msg := range []string{"unverified packet returned", "signing required"} {
+		err := wrapPathError("read", "/f", &smb2.SignatureError{Message: msg})
+		if !errors.Is(err, ErrSignatureMismatch) {
+			t.Errorf("wrapPathError(%q) = %v, want ErrSignatureMismatch", msg, err)
+		}
+		if got := convertError(&smb2.SignatureError{Message: msg}); got != ErrSignatureMismatch {
+			t.Errorf("convertError(%q) = %v, want ErrSignatureMismatch", msg, got)
+		}
+	}
+
+	// The message does not matter, only the type
+	for _, msg := range []string{"unverified packet returned", "signing required", "broken read response format"} {
+		other := &smb2.InvalidResponseError{Message: msg}
+		if errors.Is(convertError(other), ErrSignatureMismatch) {
+			t.Errorf("convertError(%q) mapped an invalid response to ErrSignatureMismatch", msg)
+		}
+	}
+}
+
+// TestGuestSession_SigningNegotiated tests a guest logon to a server that
+// requires signing: the session is flagged as guest, the client does not
+// sign, and its unsigned requests are served
+func TestGuestSession_SigningNegotiated(t *testing.T) {
+	for _, dialect := range []SMBDialect{SMB2_1, SMB3_1_1} {
+		t.Run(dialect.String(), func(t *testing.T) {
+			srv, config := startLoopbackServer(t, ServerOptions{
+				MaxDialect:      dialect,
+				SigningRequired: true,
+				AllowGuest:      true,
+			})
+			if err := srv.AddShare(srv.GetShare("data").fs, ShareOptions{ShareName: "public", AllowGuest: true}); err != nil {
+				t.Fatalf("AddShare() error = %v", err)
+			}
+			config.Share = "public"
+			config.Username = ""
+			config.Password = ""
+			config.GuestAccess = true
+
+			fsys, err := New(config)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			defer fsys.Close()
+
+			data, err := fsys.ReadFile("/hello.txt")
+			if err != nil {
+				t.Fatalf("ReadFile() error = %v", err)
+			}
+			if string(data) != "hello" {
+				t.Errorf("ReadFile() = %q, want %q", data, "hello")
+			}
+		})
+	}
+}
+
+// TestGuestSession_NotSigned tests that a guest session is neither verified
+// nor signed, even with signing required on the connection
+func TestGuestSession_NotSigned(t *testing.T) {
+	srv := setupTestServer(t)
+	session := srv.sessions.CreateSession(SMB3_1_1, [16]byte{}, "127.0.0.1")
+	// A guest session never holds a signing key; give it one to make sure
+	// it goes unused
+	session.SetValid("Guest", "", true, make([]byte, 16))
+	state := &connState{session: session, signingRequired: true, dialect: SMB3_1_1}
+
+	echo := func(flags uint32) *SMB2Message {
+		header := &SMB2Header{Command: SMB2_ECHO, SessionID: session.ID, Flags: flags, CreditRequest: 1}
+		copy(header.ProtocolID[:], SMB2ProtocolID)
+		payload := []byte{4, 0, 0, 0}
+		return &SMB2Message{Header: header, Payload: payload, RawBytes: append(header.Marshal(), payload...)}
+	}
+
+	for _, flags := range []uint32{0, SMB2_FLAGS_SIGNED} {
+		resp, err := srv.handler.HandleMessage(state, echo(flags))
+		if err != nil {
+			t.Fatalf("HandleMessage(flags 0x%x) error = %v", flags, err)
+		}
+		if resp == nil || resp.Header.Status != STATUS_SUCCESS {
+			t.Fatalf("ECHO (flags 0x%x) on a guest session = %+v, want STATUS_SUCCESS", flags, resp)
+		}
+		if resp.SigningKey != nil || resp.Header.Flags&SMB2_FLAGS_SIGNED != 0 {
+			t.Errorf("ECHO (flags 0x%x) response on a guest session is signed", flags)
+		}
+	}
+}
+
+// TestNTLM_AnonymousSession tests that an anonymous NTLM logon yields a null
+// session with no session key
+func TestNTLM_AnonymousSession(t *testing.T) {
+	auth := NewNTLMAuthenticator("SERVER", nil, true)
+	blob := make([]byte, 72)
+	copy(blob, ntlmSignature)
+	binary.LittleEndian.PutUint32(blob[8:12], ntlmAuthenticateMessage)
+	result, err := auth.Authenticate(blob)
+	if err != nil {
+		t.Fatalf("Authenticate() error = %v", err)
+	}
+	if !result.Success || !result.IsNull || result.SessionKey != nil {
+		t.Errorf("anonymous Authenticate() = %+v, want a successful null session without a key", result)
+	}
+}
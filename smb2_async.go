@@ -0,0 +1,363 @@
+package smbfs
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Asynchronous commands (MS-SMB2 3.3.4.2)
+//
+// A request that would block, such as a LOCK waiting for a conflicting lock
+// to go away, is answered at once with an interim STATUS_PENDING response
+// carrying an AsyncId. The connection goes on processing other requests and
+// the final response, sent when the operation completes, names the same
+// MessageId and AsyncId
+
+// asyncRequest is a request answered with STATUS_PENDING whose final
+// response is still to be sent
+type asyncRequest struct {
+	conn      *connState
+	command   uint16
+	messageID uint64
+	asyncID   uint64
+	sessionID uint64
+
+	// Final responses are signed or encrypted like the response to the
+	// request would have been
+	signingKey    []byte
+	dialect       SMBDialect
+	encryptionKey []byte
+	cipherID      uint16
+
+	// Operations started by goAsync are cancelled when the connection
+	// closes or the server stops
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Requests that outran AsyncThreshold are still running their handler,
+	// on the open fileID names; running is closed once they are done
+	fileID  FileID
+	running chan struct{}
+}
+
+// asyncTable tracks the async operations of a server
+type asyncTable struct {
+	mu     sync.Mutex
+	nextID uint64
+	ops    map[uint64]*asyncRequest
+}
+
+// newAsyncTable creates an empty async table
+func newAsyncTable() *asyncTable {
+	return &asyncTable{ops: make(map[uint64]*asyncRequest)}
+}
+
+// newID allocates an AsyncId
+func (t *asyncTable) newID() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextID++
+	return t.nextID
+}
+
+// add registers an operation that runs until remove is called
+func (t *asyncTable) add(req *asyncRequest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ops[req.asyncID] = req
+}
+
+// remove unregisters a finished operation
+func (t *asyncTable) remove(req *asyncRequest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.ops, req.asyncID)
+	req.cancel()
+}
+
+// releaseConn cancels the operations of a closed connection
+func (t *asyncTable) releaseConn(state *connState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, req := range t.ops {
+		if req.conn == state {
+			req.cancel()
+		}
+	}
+}
+
+// releaseSession cancels the operations of a session that logged off
+func (t *asyncTable) releaseSession(sessionID uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, req := range t.ops {
+		if req.sessionID == sessionID {
+			req.cancel()
+		}
+	}
+}
+
+// requestFileID returns the FileId a request names, if its command has one
+func requestFileID(msg *SMB2Message) (FileID, bool) {
+	off, ok := compoundFileIDOffsets[msg.Header.Command]
+	if !ok || len(msg.Payload) < off+16 {
+		return FileID{}, false
+	}
+	return UnmarshalFileID(msg.Payload[off:]), true
+}
+
+// changesSessions reports whether cmd ends or changes the sessions, trees
+// and opens of a connection
+func changesSessions(cmd uint16) bool {
+	switch cmd {
+	case SMB2_NEGOTIATE, SMB2_SESSION_SETUP, SMB2_LOGOFF, SMB2_TREE_DISCONNECT:
+		return true
+	}
+	return false
+}
+
+// waitRunning blocks until no request that outran AsyncThreshold on the
+// connection is still running on what msg uses: the open it names, or
+// anything at all if it changes the connection's sessions. Operations
+// waiting on something else, such as blocking locks, are not waited for
+func (t *asyncTable) waitRunning(state *connState, msg *SMB2Message) {
+	all := changesSessions(msg.Header.Command)
+	fileID, hasFileID := requestFileID(msg)
+	if !all && !hasFileID {
+		return
+	}
+
+	// Only the connection's read loop starts such requests, so none start
+	// while it waits here
+	for {
+		var running chan struct{}
+		t.mu.Lock()
+		for _, req := range t.ops {
+			if req.conn == state && req.running != nil && (all || req.fileID == fileID) {
+				running = req.running
+				break
+			}
+		}
+		t.mu.Unlock()
+		if running == nil {
+			return
+		}
+		<-running
+	}
+}
+
+// cancel aborts the operation a CANCEL request names, by AsyncId if the
+// CANCEL is async and otherwise by the MessageId of the original request.
+// Only operations started on the same connection match. The operation
+// completes with STATUS_CANCELLED
+func (t *asyncTable) cancel(state *connState, header *SMB2Header) bool {
+	async := header.Flags&SMB2_FLAGS_ASYNC_COMMAND != 0
+	asyncID := uint64(header.Reserved) | uint64(header.TreeID)<<32
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, req := range t.ops {
+		if req.conn != state {
+			continue
+		}
+		if (async && req.asyncID == asyncID) || (!async && req.messageID == header.MessageID) {
+			req.cancel()
+			return true
+		}
+	}
+	return false
+}
+
+// handleCancel processes an SMB2 CANCEL request (MS-SMB2 3.3.5.16). CANCEL
+// has no response of its own; the cancelled request completes instead
+func (h *SMBHandler) handleCancel(state *connState, msg *SMB2Message) {
+	if h.server.notify.cancelRequest(state, msg.Header) || h.server.async.cancel(state, msg.Header) {
+		h.server.logger.Debug("CANCEL: cancelled MsgID %d", msg.Header.MessageID)
+		return
+	}
+	h.server.logger.Debug("CANCEL: no pending request matches MsgID %d", msg.Header.MessageID)
+}
+
+// newAsyncRequest prepares to answer msg asynchronously, allocating its
+// AsyncId and capturing how its final response must be protected
+func (h *SMBHandler) newAsyncRequest(state *connState, msg *SMB2Message, session *Session) *asyncRequest {
+	req := &asyncRequest{
+		conn:      state,
+		command:   msg.Header.Command,
+		messageID: msg.Header.MessageID,
+		asyncID:   h.server.async.newID(),
+		sessionID: session.ID,
+	}
+	if msg.Encrypted && session.EncryptionKey != nil {
+		req.encryptionKey = session.EncryptionKey
+		req.cipherID = session.CipherID
+	} else if state.session != nil && state.session.SigningKey != nil && !state.session.IsGuest &&
+		(state.signingRequired || msg.Header.Flags&SMB2_FLAGS_SIGNED != 0) {
+		req.signingKey = state.session.SigningKey
+		req.dialect = state.dialect
+	}
+	return req
+}
+
+// setAsyncID stores an AsyncId in a header, which occupies the Reserved and
+// TreeId fields of async messages
+func setAsyncID(h *SMB2Header, asyncID uint64) {
+	h.Reserved = uint32(asyncID)
+	h.TreeID = uint32(asyncID >> 32)
+}
+
+// sendInterim sends the interim STATUS_PENDING response for an async
+// request. respHeader is the header the response would have had, which
+// carries the credits granted for the request. state.writeMu must be held
+func (h *SMBHandler) sendInterim(req *asyncRequest, respHeader *SMB2Header) {
+	interim := *respHeader
+	interim.Status = STATUS_PENDING
+	interim.Flags |= SMB2_FLAGS_ASYNC_COMMAND
+	setAsyncID(&interim, req.asyncID)
+
+	req.conn.conn.SetWriteDeadline(time.Now().Add(h.server.options.WriteTimeout))
+	msg := &SMB2Message{
+		Header:        &interim,
+		Payload:       h.buildErrorResponse(),
+		EncryptionKey: req.encryptionKey,
+		CipherID:      req.cipherID,
+	}
+	if _, err := h.server.writeMessage(req.conn.conn, msg); err != nil {
+		h.server.logger.Debug("%s: failed to send interim response: %v", CommandName(req.command), err)
+	}
+}
+
+// completeAsync sends the final response for an async request
+func (s *Server) completeAsync(req *asyncRequest, payload []byte, status NTStatus) {
+	header := &SMB2Header{
+		StructureSize: SMB2HeaderSize,
+		Status:        status,
+		Command:       req.command,
+		Flags:         SMB2_FLAGS_SERVER_TO_REDIR | SMB2_FLAGS_ASYNC_COMMAND,
+		MessageID:     req.messageID,
+		SessionID:     req.sessionID,
+	}
+	copy(header.ProtocolID[:], SMB2ProtocolID)
+	setAsyncID(header, req.asyncID)
+
+	msg := &SMB2Message{Header: header, Payload: payload}
+	if req.conn != nil {
+		msg.CompressionAlg = responseCompression(req.conn, req.command, status, payload)
+	}
+	if req.signingKey != nil {
+		header.Flags |= SMB2_FLAGS_SIGNED
+		msg.SigningKey = req.signingKey
+		msg.Dialect = req.dialect
+	}
+	msg.EncryptionKey = req.encryptionKey
+	msg.CipherID = req.cipherID
+
+	if req.conn == nil {
+		return
+	}
+	if _, err := s.sendMessage(req.conn, msg); err != nil {
+		s.logger.Debug("%s: failed to complete request %d: %v", CommandName(req.command), req.messageID, err)
+	}
+}
+
+// goAsync answers a request with an interim STATUS_PENDING response and
+// runs op on its own goroutine, sending its result as the final response.
+// The returned nil payload tells HandleMessage not to respond again
+func (h *SMBHandler) goAsync(state *connState, msg *SMB2Message, respHeader *SMB2Header, session *Session,
+	op func(ctx context.Context) ([]byte, NTStatus)) ([]byte, NTStatus) {
+	req := h.newAsyncRequest(state, msg, session)
+	req.ctx, req.cancel = context.WithCancel(h.server.ctx)
+	h.server.async.add(req)
+
+	h.server.logger.Debug("%s: going async (MsgID: %d, AsyncID: %d)",
+		CommandName(req.command), req.messageID, req.asyncID)
+
+	// The interim response must go out before the final one
+	state.writeMu.Lock()
+	h.sendInterim(req, respHeader)
+	state.writeMu.Unlock()
+
+	go func() {
+		payload, status := op(req.ctx)
+		h.server.async.remove(req)
+		h.server.completeAsync(req, payload, status)
+	}()
+	return nil, STATUS_PENDING
+}
+
+// mayOutrunThreshold reports whether cmd is answered asynchronously when it
+// takes longer than AsyncThreshold
+func mayOutrunThreshold(cmd uint16) bool {
+	return cmd == SMB2_READ || cmd == SMB2_WRITE || cmd == SMB2_IOCTL
+}
+
+// requestContext returns the context a handler stops waiting at: the
+// request's own once it outran AsyncThreshold, or else the server's
+func (h *SMBHandler) requestContext(msg *SMB2Message) context.Context {
+	if msg.ctx != nil {
+		return msg.ctx
+	}
+	return h.server.ctx
+}
+
+// dispatchWithThreshold dispatches a request, answering it with an interim
+// STATUS_PENDING response if it is not done within AsyncThreshold. The
+// handler carries on, on its own goroutine, and its result is sent as the
+// final response. A CANCEL cancels the context requestContext returns for
+// it, ending the handler's waits early, and requests on the same open wait
+// for it to finish (see waitRunning). The request is then recorded and
+// audited as HandleMessage would have
+func (h *SMBHandler) dispatchWithThreshold(state *connState, msg *SMB2Message, respHeader *SMB2Header,
+	share *Share, started time.Time) ([]byte, NTStatus) {
+	type result struct {
+		payload []byte
+		status  NTStatus
+	}
+	ctx, cancel := context.WithCancel(h.server.ctx)
+	msg.ctx = ctx
+	done := make(chan result, 1)
+	go func() {
+		payload, status := h.dispatch(state, msg, respHeader)
+		done <- result{payload, status}
+	}()
+
+	timer := time.NewTimer(h.server.options.AsyncThreshold)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		cancel()
+		return r.payload, r.status
+	case <-timer.C:
+	}
+
+	session := h.server.sessions.GetSession(msg.Header.SessionID)
+	if session == nil {
+		r := <-done
+		cancel()
+		return r.payload, r.status
+	}
+	req := h.newAsyncRequest(state, msg, session)
+	req.ctx, req.cancel = ctx, cancel
+	req.fileID, _ = requestFileID(msg)
+	req.running = make(chan struct{})
+	h.server.async.add(req)
+
+	h.server.logger.Debug("%s: exceeded %v, going async (MsgID: %d, AsyncID: %d)",
+		CommandName(req.command), h.server.options.AsyncThreshold, req.messageID, req.asyncID)
+
+	state.writeMu.Lock()
+	h.sendInterim(req, respHeader)
+	state.writeMu.Unlock()
+
+	msg.deferred = true
+	go func() {
+		// Requests waiting on the open are answered after this one
+		r := <-done
+		h.server.finishRequest(share, msg, r.status, r.payload, started)
+		h.server.completeAsync(req, r.payload, r.status)
+		h.server.async.remove(req)
+		close(req.running)
+	}()
+	return nil, STATUS_PENDING
+}
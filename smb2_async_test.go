@@ -0,0 +1,388 @@
+package smbfs
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// readTestResponse reads one response from a client connection
+func readTestResponse(t *testing.T, conn net.Conn) *SMB2Message {
+	t.Helper()
+	raw := readTestFrame(t, conn)
+	header, err := UnmarshalSMB2Header(raw)
+	if err != nil {
+		t.Fatalf("UnmarshalSMB2Header() error = %v", err)
+	}
+	return &SMB2Message{Header: header, Payload: raw[SMB2HeaderSize:]}
+}
+
+// TestAsync_BlockingLock tests that a blocking lock goes async, that a stat
+// on the same connection is answered while it waits, and that the final
+// response matches the interim one
+func TestAsync_BlockingLock(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	share := tree.Share
+	f, _ := share.fs.Create("/f.txt")
+	f.Write([]byte("0123456789"))
+	f.Close()
+
+	open := func() *OpenFile {
+		t.Helper()
+		file, err := share.fs.OpenFile("/f.txt", os.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("OpenFile() error = %v", err)
+		}
+		return share.fileHandles.Allocate(file, "/f.txt", false, FILE_READ_DATA|FILE_WRITE_DATA,
+			FILE_SHARE_READ|FILE_SHARE_WRITE, FILE_OPEN, 0, tree.ID, session.ID)
+	}
+	holder, waiter := open(), open()
+
+	if _, status := srv.handler.handleLock(nil, testRequest(session, tree, SMB2_LOCK, buildLockRequest(holder.ID, exclusiveLock(0, 10))), nil); status != STATUS_SUCCESS {
+		t.Fatalf("LOCK status = %v, want STATUS_SUCCESS", status)
+	}
+
+	conn := serveTestConn(t, srv)
+	send := func(messageID uint64, msg *SMB2Message) {
+		t.Helper()
+		msg.Header.MessageID = messageID
+		msg.Header.CreditRequest = 8
+		if _, err := conn.Write(frameRequests(false, msg)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+
+	send(1, testRequest(session, tree, SMB2_LOCK,
+		buildLockRequest(waiter.ID, lockElement{0, 10, SMB2_LOCKFLAG_EXCLUSIVE_LOCK})))
+	interim := readTestResponse(t, conn).Header
+	if interim.Status != STATUS_PENDING || interim.Flags&SMB2_FLAGS_ASYNC_COMMAND == 0 || interim.MessageID != 1 {
+		t.Fatalf("interim response = %v (flags 0x%x, MessageID %d), want async STATUS_PENDING for 1",
+			interim.Status, interim.Flags, interim.MessageID)
+	}
+	if interim.CreditRequest == 0 {
+		t.Error("interim response granted no credits")
+	}
+
+	// The connection is not held up by the waiting lock
+	send(2, testRequest(session, tree, SMB2_QUERY_INFO,
+		buildQueryInfoRequest(waiter.ID, SMB2_0_INFO_FILE, FileStandardInformation, 0, 1024)))
+	stat := readTestResponse(t, conn).Header
+	if stat.MessageID != 2 || stat.Status != STATUS_SUCCESS {
+		t.Fatalf("response while LOCK pending = %d %v, want QUERY_INFO 2 STATUS_SUCCESS", stat.MessageID, stat.Status)
+	}
+
+	if _, status := srv.handler.handleLock(nil, testRequest(session, tree, SMB2_LOCK, buildLockRequest(holder.ID, unlockRange(0, 10))), nil); status != STATUS_SUCCESS {
+		t.Fatalf("UNLOCK status = %v, want STATUS_SUCCESS", status)
+	}
+	final := readTestResponse(t, conn).Header
+	if final.Status != STATUS_SUCCESS || final.MessageID != 1 || final.Flags&SMB2_FLAGS_ASYNC_COMMAND == 0 {
+		t.Errorf("final LOCK response = %v (MessageID %d, flags 0x%x), want async STATUS_SUCCESS for 1",
+			final.Status, final.MessageID, final.Flags)
+	}
+	if final.Reserved != interim.Reserved || final.TreeID != interim.TreeID {
+		t.Errorf("final AsyncId differs from the interim one")
+	}
+}
+
+// TestAsync_CancelledOnDisconnect tests that async operations end when
+// their connection closes
+func TestAsync_CancelledOnDisconnect(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	handles := tree.Share.fileHandles
+	holder := handles.Allocate(nil, "/f.txt", false, FILE_WRITE_DATA, FILE_SHARE_WRITE, FILE_OPEN, 0, tree.ID, session.ID)
+	waiter := handles.Allocate(nil, "/f.txt", false, FILE_WRITE_DATA, FILE_SHARE_WRITE, FILE_OPEN, 0, tree.ID, session.ID)
+	if _, status := srv.handler.handleLock(nil, testRequest(session, tree, SMB2_LOCK, buildLockRequest(holder.ID, exclusiveLock(0, 10))), nil); status != STATUS_SUCCESS {
+		t.Fatalf("LOCK status = %v, want STATUS_SUCCESS", status)
+	}
+
+	conn := serveTestConn(t, srv)
+	conn.Write(frameRequests(false, testRequest(session, tree, SMB2_LOCK,
+		buildLockRequest(waiter.ID, lockElement{0, 10, SMB2_LOCKFLAG_EXCLUSIVE_LOCK}))))
+	if interim := readTestResponse(t, conn); interim.Header.Status != STATUS_PENDING {
+		t.Fatalf("blocking LOCK status = %v, want STATUS_PENDING", interim.Header.Status)
+	}
+	conn.Close()
+
+	deadline := time.Now().Add(blockingLockWait / 2)
+	for {
+		srv.async.mu.Lock()
+		n := len(srv.async.ops)
+		srv.async.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("async LOCK still running after its connection closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestAsync_CancelBlockingLock tests that CANCEL, by AsyncId or by the
+// MessageId of the original request, ends a blocking lock with
+// STATUS_CANCELLED
+func TestAsync_CancelBlockingLock(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	handles := tree.Share.fileHandles
+	holder := handles.Allocate(nil, "/f.txt", false, FILE_WRITE_DATA, FILE_SHARE_WRITE, FILE_OPEN, 0, tree.ID, session.ID)
+	waiter := handles.Allocate(nil, "/f.txt", false, FILE_WRITE_DATA, FILE_SHARE_WRITE, FILE_OPEN, 0, tree.ID, session.ID)
+	if _, status := srv.handler.handleLock(nil, testRequest(session, tree, SMB2_LOCK, buildLockRequest(holder.ID, exclusiveLock(0, 10))), nil); status != STATUS_SUCCESS {
+		t.Fatalf("LOCK status = %v, want STATUS_SUCCESS", status)
+	}
+
+	conn := serveTestConn(t, srv)
+	send := func(msg *SMB2Message) {
+		t.Helper()
+		msg.Header.CreditRequest = 8
+		if _, err := conn.Write(frameRequests(false, msg)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	lock := func(messageID uint64) *SMB2Header {
+		t.Helper()
+		msg := testRequest(session, tree, SMB2_LOCK,
+			buildLockRequest(waiter.ID, lockElement{0, 10, SMB2_LOCKFLAG_EXCLUSIVE_LOCK}))
+		msg.Header.MessageID = messageID
+		send(msg)
+		interim := readTestResponse(t, conn).Header
+		if interim.Status != STATUS_PENDING {
+			t.Fatalf("blocking LOCK status = %v, want STATUS_PENDING", interim.Status)
+		}
+		return interim
+	}
+	expectCancelled := func(messageID uint64) {
+		t.Helper()
+		final := readTestResponse(t, conn).Header
+		if final.Status != STATUS_CANCELLED || final.MessageID != messageID || final.Command != SMB2_LOCK {
+			t.Errorf("response after CANCEL = %s %v (MessageID %d), want LOCK STATUS_CANCELLED for %d",
+				CommandName(final.Command), final.Status, final.MessageID, messageID)
+		}
+	}
+
+	// By AsyncId, as sent after the interim response
+	interim := lock(1)
+	send(&SMB2Message{Header: &SMB2Header{
+		Command:   SMB2_CANCEL,
+		Flags:     SMB2_FLAGS_ASYNC_COMMAND,
+		MessageID: 1,
+		SessionID: session.ID,
+		Reserved:  interim.Reserved,
+		TreeID:    interim.TreeID,
+	}, Payload: []byte{4, 0, 0, 0}})
+	expectCancelled(1)
+
+	// By MessageId, as sent before the interim response arrives
+	lock(2)
+	send(&SMB2Message{Header: &SMB2Header{
+		Command:   SMB2_CANCEL,
+		MessageID: 2,
+		SessionID: session.ID,
+		TreeID:    tree.ID,
+	}, Payload: []byte{4, 0, 0, 0}})
+	expectCancelled(2)
+
+	// A CANCEL naming nothing pending is ignored, and the lock still works
+	send(&SMB2Message{Header: &SMB2Header{
+		Command:   SMB2_CANCEL,
+		MessageID: 9,
+		SessionID: session.ID,
+	}, Payload: []byte{4, 0, 0, 0}})
+	if _, status := srv.handler.handleLock(nil, testRequest(session, tree, SMB2_LOCK, buildLockRequest(holder.ID, unlockRange(0, 10))), nil); status != STATUS_SUCCESS {
+		t.Fatalf("UNLOCK status = %v, want STATUS_SUCCESS", status)
+	}
+	msg := testRequest(session, tree, SMB2_LOCK, buildLockRequest(waiter.ID, exclusiveLock(0, 10)))
+	msg.Header.MessageID = 3
+	send(msg)
+	if resp := readTestResponse(t, conn).Header; resp.MessageID != 3 || resp.Status != STATUS_SUCCESS {
+		t.Errorf("LOCK after CANCEL = %d %v, want 3 STATUS_SUCCESS", resp.MessageID, resp.Status)
+	}
+}
+
+// TestAsync_SlowWrite tests that a WRITE outrunning AsyncThreshold gets an
+// interim STATUS_PENDING response followed by its real one, that the
+// connection serves other requests meanwhile, and that fast writes are
+// answered directly
+func TestAsync_SlowWrite(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	srv.options.AsyncThreshold = 50 * time.Millisecond
+	share := tree.Share
+	slow := &slowWriteFS{FileSystem: share.fs, delay: 300 * time.Millisecond, started: make(chan struct{}, 1)}
+
+	file, err := slow.OpenFile("/slow.txt", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	of := share.fileHandles.Allocate(file, "slow.txt", false, FILE_READ_DATA|FILE_WRITE_DATA,
+		FILE_SHARE_READ, FILE_OPEN_IF, 0, tree.ID, session.ID)
+	defer share.fileHandles.Release(of.ID)
+
+	conn := serveTestConn(t, srv)
+	send := func(messageID uint64, msg *SMB2Message) {
+		t.Helper()
+		msg.Header.MessageID = messageID
+		msg.Header.CreditRequest = 8
+		if _, err := conn.Write(frameRequests(false, msg)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+
+	send(1, testRequest(session, tree, SMB2_WRITE, buildWriteRequest(of.ID, 0, []byte("slow data"))))
+	interim := readTestResponse(t, conn).Header
+	if interim.Status != STATUS_PENDING || interim.Flags&SMB2_FLAGS_ASYNC_COMMAND == 0 ||
+		interim.MessageID != 1 || interim.Command != SMB2_WRITE {
+		t.Fatalf("interim response = %s %v (flags 0x%x, MessageID %d), want async WRITE STATUS_PENDING for 1",
+			CommandName(interim.Command), interim.Status, interim.Flags, interim.MessageID)
+	}
+	if interim.CreditRequest == 0 {
+		t.Error("interim response granted no credits")
+	}
+
+	send(2, &SMB2Message{Header: &SMB2Header{Command: SMB2_ECHO, SessionID: session.ID}, Payload: []byte{4, 0, 0, 0}})
+	if echo := readTestResponse(t, conn).Header; echo.MessageID != 2 || echo.Status != STATUS_SUCCESS {
+		t.Fatalf("response while WRITE pending = %d %v, want ECHO 2 STATUS_SUCCESS", echo.MessageID, echo.Status)
+	}
+
+	final := readTestResponse(t, conn)
+	if h := final.Header; h.Status != STATUS_SUCCESS || h.MessageID != 1 || h.Command != SMB2_WRITE ||
+		h.Flags&SMB2_FLAGS_ASYNC_COMMAND == 0 {
+		t.Fatalf("final response = %s %v (MessageID %d, flags 0x%x), want async WRITE STATUS_SUCCESS for 1",
+			CommandName(h.Command), h.Status, h.MessageID, h.Flags)
+	}
+	if final.Header.Reserved != interim.Reserved || final.Header.TreeID != interim.TreeID {
+		t.Error("final AsyncId differs from the interim one")
+	}
+	if n := le.Uint32(final.Payload[4:8]); n != 9 {
+		t.Errorf("final WRITE Count = %d, want 9", n)
+	}
+
+	// Written bytes are counted once the write completes
+	m := srv.Metrics()
+	if m.Commands[SMB2_WRITE] != 1 || m.BytesWritten != 9 {
+		t.Errorf("metrics WRITE requests = %d, bytes = %d, want 1 and 9", m.Commands[SMB2_WRITE], m.BytesWritten)
+	}
+
+	// Writes within the threshold are answered directly
+	slow.delay = 0
+	send(3, testRequest(session, tree, SMB2_WRITE, buildWriteRequest(of.ID, 0, []byte("fast"))))
+	if h := readTestResponse(t, conn).Header; h.Status != STATUS_SUCCESS || h.MessageID != 3 || h.Flags&SMB2_FLAGS_ASYNC_COMMAND != 0 {
+		t.Errorf("fast WRITE response = %v (MessageID %d, flags 0x%x), want sync STATUS_SUCCESS for 3",
+			h.Status, h.MessageID, h.Flags)
+	}
+}
+
+// TestAsync_SlowWriteHoldsOpen tests that a request on an open waits for a
+// WRITE on it that outran AsyncThreshold, rather than running alongside it
+func TestAsync_SlowWriteHoldsOpen(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	srv.options.AsyncThreshold = 50 * time.Millisecond
+	share := tree.Share
+	slow := &slowWriteFS{FileSystem: share.fs, delay: 300 * time.Millisecond, started: make(chan struct{}, 1)}
+
+	file, err := slow.OpenFile("/slow.txt", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	of := share.fileHandles.Allocate(file, "slow.txt", false, FILE_READ_DATA|FILE_WRITE_DATA,
+		FILE_SHARE_READ, FILE_OPEN_IF, 0, tree.ID, session.ID)
+	defer share.fileHandles.Release(of.ID)
+
+	conn := serveTestConn(t, srv)
+	send := func(messageID uint64, msg *SMB2Message) {
+		t.Helper()
+		msg.Header.MessageID = messageID
+		msg.Header.CreditRequest = 8
+		if _, err := conn.Write(frameRequests(false, msg)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+
+	send(1, testRequest(session, tree, SMB2_WRITE, buildWriteRequest(of.ID, 0, []byte("slow data"))))
+	if interim := readTestResponse(t, conn).Header; interim.Status != STATUS_PENDING {
+		t.Fatalf("WRITE status = %v, want STATUS_PENDING", interim.Status)
+	}
+	send(2, testRequest(session, tree, SMB2_READ, buildReadRequest(of.ID, 9)))
+
+	if h := readTestResponse(t, conn).Header; h.MessageID != 1 || h.Status != STATUS_SUCCESS {
+		t.Fatalf("first response = %s %v for %d, want WRITE STATUS_SUCCESS for 1", CommandName(h.Command), h.Status, h.MessageID)
+	}
+	read := readTestResponse(t, conn)
+	if read.Header.MessageID != 2 || read.Header.Status != STATUS_SUCCESS {
+		t.Fatalf("second response = %s %v for %d, want READ STATUS_SUCCESS for 2",
+			CommandName(read.Header.Command), read.Header.Status, read.Header.MessageID)
+	}
+	if data := read.Payload[16:]; string(data) != "slow data" {
+		t.Errorf("READ after pending WRITE = %q, want the written data", data)
+	}
+}
+
+// TestAsync_ThrottledRead tests that a READ held back by the bandwidth
+// limit past AsyncThreshold is answered compressed when it completes, and
+// with STATUS_CANCELLED when a CANCEL names it first
+func TestAsync_ThrottledRead(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	srv.options.AsyncThreshold = 50 * time.Millisecond
+	srv.options.EnableCompression = true
+	srv.options.MaxBytesPerSecPerSession = 40000
+
+	f, _ := tree.Share.fs.Create("/data.txt")
+	data := bytes.Repeat([]byte("compressible "), 5000)
+	f.Write(data)
+	of := tree.Share.fileHandles.Allocate(f, "data.txt", false, GENERIC_READ, FILE_SHARE_READ, FILE_OPEN, 0, tree.ID, session.ID)
+	defer tree.Share.fileHandles.Release(of.ID)
+
+	conn := serveTestConn(t, srv)
+	conn.Write(frameRequests(false, &SMB2Message{
+		Header:  &SMB2Header{Command: SMB2_NEGOTIATE},
+		Payload: buildNegotiateRequest(SMB2_COMPRESSION_LZ77),
+	}))
+	readTestFrame(t, conn)
+	read := func(messageID uint64) *SMB2Header {
+		t.Helper()
+		msg := testRequest(session, tree, SMB2_READ, buildReadRequest(of.ID, uint32(len(data))))
+		msg.Header.MessageID = messageID
+		msg.Header.CreditRequest = 8
+		conn.Write(frameRequests(false, msg))
+		interim := readTestResponse(t, conn).Header
+		if interim.Status != STATUS_PENDING {
+			t.Fatalf("throttled READ status = %v, want STATUS_PENDING", interim.Status)
+		}
+		return interim
+	}
+
+	// The first read overdraws the bucket by a second's worth and completes
+	read(1)
+	raw := readTestFrame(t, conn)
+	if !IsCompressedMessage(raw) {
+		t.Fatal("final READ response not compressed")
+	}
+	raw, err := DecompressMessage(raw, MaxTransactSize)
+	if err != nil {
+		t.Fatalf("DecompressMessage() error = %v", err)
+	}
+	if h, _ := UnmarshalSMB2Header(raw); h.MessageID != 1 || h.Status != STATUS_SUCCESS || h.Flags&SMB2_FLAGS_ASYNC_COMMAND == 0 {
+		t.Errorf("final READ response = %v for %d (flags 0x%x), want async STATUS_SUCCESS for 1", h.Status, h.MessageID, h.Flags)
+	}
+	if got := raw[SMB2HeaderSize+16:]; !bytes.Equal(got, data) {
+		t.Errorf("READ returned %d bytes, want the %d written", len(got), len(data))
+	}
+
+	// The second would wait longer still, but is cancelled
+	interim := read(2)
+	started := time.Now()
+	conn.Write(frameRequests(false, &SMB2Message{Header: &SMB2Header{
+		Command:   SMB2_CANCEL,
+		Flags:     SMB2_FLAGS_ASYNC_COMMAND,
+		MessageID: 2,
+		SessionID: session.ID,
+		Reserved:  interim.Reserved,
+		TreeID:    interim.TreeID,
+	}, Payload: []byte{4, 0, 0, 0}}))
+	if h := readTestResponse(t, conn).Header; h.MessageID != 2 || h.Status != STATUS_CANCELLED {
+		t.Errorf("READ after CANCEL = %v for %d, want STATUS_CANCELLED for 2", h.Status, h.MessageID)
+	}
+	if waited := time.Since(started); waited > time.Second {
+		t.Errorf("cancelled READ took %v to complete", waited)
+	}
+}
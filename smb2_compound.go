@@ -0,0 +1,217 @@
+package smbfs
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// Compound requests (MS-SMB2 3.2.4.1.4, 3.3.5.2.7)
+//
+// A client may chain several commands into one message, each starting at
+// the previous one's NextCommand offset. Commands flagged as related
+// inherit the session, tree and file of the command before them, so a
+// client can CREATE, use and CLOSE a file in one round trip without knowing
+// its FileId in advance
+
+// createResponseFileIDOffset is where a CREATE response carries the FileId
+const createResponseFileIDOffset = 64
+
+// compoundFileIDOffsets gives where the FileId sits in the payload of
+// requests that carry one
+var compoundFileIDOffsets = map[uint16]int{
+	SMB2_CLOSE:           8,
+	SMB2_FLUSH:           8,
+	SMB2_READ:            16,
+	SMB2_WRITE:           16,
+	SMB2_LOCK:            8,
+	SMB2_IOCTL:           8,
+	SMB2_QUERY_DIRECTORY: 8,
+	SMB2_CHANGE_NOTIFY:   8,
+	SMB2_QUERY_INFO:      24,
+	SMB2_SET_INFO:        16,
+	SMB2_OPLOCK_BREAK:    8,
+}
+
+// relatedFileID is the placeholder FileId of related compound requests
+var relatedFileID = FileID{Persistent: 0xFFFFFFFFFFFFFFFF, Volatile: 0xFFFFFFFFFFFFFFFF}
+
+// splitCompound splits a compound request into its commands
+func splitCompound(msg *SMB2Message) ([]*SMB2Message, error) {
+	var msgs []*SMB2Message
+	data := msg.RawBytes
+	for {
+		if len(data) < SMB2HeaderSize || string(data[0:4]) != SMB2ProtocolID {
+			return nil, ErrInvalidMessage
+		}
+		header, err := UnmarshalSMB2Header(data)
+		if err != nil {
+			return nil, err
+		}
+
+		end := len(data)
+		if next := header.NextCommand; next != 0 {
+			// Each command starts on an 8-byte boundary within the message
+			if next%8 != 0 || next < SMB2HeaderSize || int(next) >= len(data) {
+				return nil, ErrInvalidMessage
+			}
+			end = int(next)
+		}
+
+		msgs = append(msgs, &SMB2Message{
+			Header:    header,
+			Payload:   data[SMB2HeaderSize:end],
+			RawBytes:  data[:end], // Each command is signed on its own
+			Encrypted: msg.Encrypted,
+		})
+		if end == len(data) {
+			return msgs, nil
+		}
+		data = data[end:]
+	}
+}
+
+// compoundState is what a related request inherits from the one before it
+type compoundState struct {
+	sessionID  uint64
+	treeID     uint32
+	fileID     FileID
+	haveFileID bool
+	status     NTStatus
+}
+
+// relate fills in a related request's session, tree and file from the
+// previous request. A request following a failed one fails the same way
+func (c *compoundState) relate(msg *SMB2Message) {
+	msg.Header.SessionID = c.sessionID
+	msg.Header.TreeID = c.treeID
+	if c.status.IsError() {
+		msg.relatedStatus = c.status
+		return
+	}
+
+	off, ok := compoundFileIDOffsets[msg.Header.Command]
+	if !ok || len(msg.Payload) < off+16 || UnmarshalFileID(msg.Payload[off:]) != relatedFileID {
+		return
+	}
+	if !c.haveFileID {
+		msg.relatedStatus = STATUS_INVALID_PARAMETER
+		return
+	}
+	// Copy rather than patch in place: the raw bytes are still needed to
+	// verify the signature
+	payload := append([]byte(nil), msg.Payload...)
+	copy(payload[off:], c.fileID.Marshal())
+	msg.Payload = payload
+}
+
+// update records a request and its response for the requests after it
+func (c *compoundState) update(msg, resp *SMB2Message) {
+	if resp == nil {
+		return
+	}
+	c.sessionID = resp.Header.SessionID
+	c.treeID = resp.Header.TreeID
+	c.status = resp.Header.Status
+
+	if msg.Header.Command == SMB2_CREATE {
+		if resp.Header.Status == STATUS_SUCCESS && len(resp.Payload) >= createResponseFileIDOffset+16 {
+			c.fileID = UnmarshalFileID(resp.Payload[createResponseFileIDOffset:])
+			c.haveFileID = true
+		}
+		return
+	}
+	if off, ok := compoundFileIDOffsets[msg.Header.Command]; ok && len(msg.Payload) >= off+16 {
+		c.fileID = UnmarshalFileID(msg.Payload[off:])
+		c.haveFileID = true
+	}
+}
+
+// handleCompound processes the commands of a compound request in order and
+// returns their responses, to be sent back as one compound response
+func (h *SMBHandler) handleCompound(state *connState, msgs []*SMB2Message) ([]*SMB2Message, error) {
+	var responses []*SMB2Message
+	var c compoundState
+	for i, msg := range msgs {
+		related := msg.Header.Flags&SMB2_FLAGS_RELATED_OPERATIONS != 0
+		if related && i > 0 {
+			c.relate(msg)
+		}
+
+		resp, err := h.HandleMessage(state, msg)
+		if err != nil {
+			return responses, err
+		}
+		c.update(msg, resp)
+		if resp == nil {
+			// Went async or dropped the connection
+			continue
+		}
+		if related {
+			resp.Header.Flags |= SMB2_FLAGS_RELATED_OPERATIONS
+		}
+		responses = append(responses, resp)
+	}
+	return responses, nil
+}
+
+// sendCompound writes responses to a connection as one compound response
+func (s *Server) sendCompound(state *connState, msgs []*SMB2Message) ([]byte, error) {
+	state.writeMu.Lock()
+	defer state.writeMu.Unlock()
+
+	state.conn.SetWriteDeadline(time.Now().Add(s.options.WriteTimeout))
+	return s.writeCompound(state.conn, msgs)
+}
+
+// writeCompound writes messages chained into one SMB2 message. Each is
+// padded to an 8-byte boundary and signed on its own; when the first is
+// encrypted, the whole chain is encrypted with its key
+// Returns the raw SMB2 message bytes (without NetBIOS header)
+func (s *Server) writeCompound(conn net.Conn, msgs []*SMB2Message) ([]byte, error) {
+	buf := make([]byte, 4, 4+len(msgs)*(SMB2HeaderSize+8))
+	for i, msg := range msgs {
+		start := len(buf)
+		size := SMB2HeaderSize + len(msg.Payload)
+		msg.Header.NextCommand = 0
+		if i < len(msgs)-1 {
+			size = (size + 7) &^ 7
+			msg.Header.NextCommand = uint32(size)
+		}
+		buf = append(buf, msg.Header.Marshal()...)
+		buf = append(buf, msg.Payload...)
+		buf = append(buf, make([]byte, start+size-len(buf))...)
+
+		// Apply message signing if signing key is set
+		if len(msg.SigningKey) > 0 {
+			smb2Message := buf[start:]
+			if signature := SignMessage(smb2Message, msg.SigningKey, msg.Dialect); signature != nil {
+				ApplySignature(smb2Message, signature)
+				s.logger.Debug("Applied message signature (dialect=%s)", msg.Dialect.String())
+			}
+		}
+	}
+
+	// Compress a lone message that asks for it, leaving its header as is,
+	// then encrypt into a transform header if an encryption key is set
+	smb2Message := buf[4:]
+	wire := smb2Message
+	if len(msgs) == 1 && msgs[0].CompressionAlg != SMB2_COMPRESSION_NONE {
+		if compressed, ok := CompressMessage(smb2Message, msgs[0].CompressionAlg, SMB2HeaderSize); ok {
+			wire = compressed
+			buf = append(make([]byte, 4, 4+len(compressed)), compressed...)
+		}
+	}
+	if first := msgs[0]; first.EncryptionKey != nil {
+		sealed, err := EncryptMessage(wire, first.EncryptionKey, first.CipherID, first.Header.SessionID)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(make([]byte, 4, 4+len(sealed)), sealed...)
+	}
+
+	// NetBIOS session message header: 0x00 + 3-byte length
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(buf)-4))
+	_, err := conn.Write(buf)
+	return smb2Message, err
+}
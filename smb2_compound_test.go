@@ -0,0 +1,171 @@
+package smbfs
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// buildCompound chains requests into one NetBIOS-framed compound message,
+// numbering them from MessageId 0. Every request after the first is marked
+// related when related is set
+func buildCompound(related bool, msgs ...*SMB2Message) []byte {
+	for i, msg := range msgs {
+		msg.Header.MessageID = uint64(i)
+	}
+	return frameRequests(related, msgs...)
+}
+
+// frameRequests chains requests into one NetBIOS-framed message
+func frameRequests(related bool, msgs ...*SMB2Message) []byte {
+	var data []byte
+	for i, msg := range msgs {
+		size := SMB2HeaderSize + len(msg.Payload)
+		msg.Header.NextCommand = 0
+		if i < len(msgs)-1 {
+			size = (size + 7) &^ 7
+			msg.Header.NextCommand = uint32(size)
+		}
+		if related && i > 0 {
+			msg.Header.Flags |= SMB2_FLAGS_RELATED_OPERATIONS
+		}
+		copy(msg.Header.ProtocolID[:], SMB2ProtocolID)
+		cmd := append(msg.Header.Marshal(), msg.Payload...)
+		data = append(data, cmd...)
+		data = append(data, make([]byte, size-len(cmd))...)
+	}
+	return append([]byte{0, byte(len(data) >> 16), byte(len(data) >> 8), byte(len(data))}, data...)
+}
+
+// compoundRoundTrip sends a compound request over a connection served by
+// srv and returns the commands of the response
+func compoundRoundTrip(t *testing.T, srv *Server, request []byte) []*SMB2Message {
+	t.Helper()
+	conn := serveTestConn(t, srv)
+	if _, err := conn.Write(request); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	responses, err := splitCompound(&SMB2Message{RawBytes: readTestFrame(t, conn)})
+	if err != nil {
+		t.Fatalf("splitCompound() of the response error = %v", err)
+	}
+	return responses
+}
+
+// serveTestConn serves a connection to srv over a pipe and returns the
+// client end
+func serveTestConn(t *testing.T, srv *Server) net.Conn {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+	srv.wg.Add(1)
+	go srv.handleConnection(serverConn)
+	clientConn.SetDeadline(time.Now().Add(10 * time.Second))
+	return clientConn
+}
+
+// readTestFrame reads one NetBIOS-framed SMB2 message from a client
+// connection
+func readTestFrame(t *testing.T, conn net.Conn) []byte {
+	t.Helper()
+	nbHeader := make([]byte, 4)
+	if _, err := io.ReadFull(conn, nbHeader); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	raw := make([]byte, int(nbHeader[1])<<16|int(nbHeader[2])<<8|int(nbHeader[3]))
+	if _, err := io.ReadFull(conn, raw); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	return raw
+}
+
+// TestCompound_CreateQueryInfoClose tests a related CREATE, QUERY_INFO and
+// CLOSE chain, in which the later requests use the FileId of the CREATE
+func TestCompound_CreateQueryInfoClose(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	f, _ := tree.Share.fs.Create("/report.txt")
+	f.Write([]byte("twelve bytes"))
+	f.Close()
+
+	responses := compoundRoundTrip(t, srv, buildCompound(true,
+		testRequest(session, tree, SMB2_CREATE, buildCreateRequest("report.txt", FILE_OPEN, 0, nil)),
+		testRequest(session, tree, SMB2_QUERY_INFO, buildQueryInfoRequest(relatedFileID, SMB2_0_INFO_FILE, FileStandardInformation, 0, 1024)),
+		testRequest(session, tree, SMB2_CLOSE, buildCloseRequest(relatedFileID)),
+	))
+
+	wantCmds := []uint16{SMB2_CREATE, SMB2_QUERY_INFO, SMB2_CLOSE}
+	if len(responses) != len(wantCmds) {
+		t.Fatalf("got %d responses, want %d", len(responses), len(wantCmds))
+	}
+	for i, resp := range responses {
+		h := resp.Header
+		if h.Command != wantCmds[i] || h.Status != STATUS_SUCCESS || h.MessageID != uint64(i) {
+			t.Errorf("response %d = %s %v (MessageID %d), want %s STATUS_SUCCESS",
+				i, CommandName(h.Command), h.Status, h.MessageID, CommandName(wantCmds[i]))
+		}
+		if related := h.Flags&SMB2_FLAGS_RELATED_OPERATIONS != 0; related != (i > 0) {
+			t.Errorf("response %d related flag = %v, want %v", i, related, i > 0)
+		}
+		if i < len(responses)-1 && h.NextCommand%8 != 0 {
+			t.Errorf("response %d NextCommand = %d, want 8-byte aligned", i, h.NextCommand)
+		}
+	}
+
+	// FileStandardInformation: AllocationSize, then EndOfFile
+	r := NewByteReader(responses[1].Payload[8:])
+	r.ReadUint64()
+	if size := r.ReadUint64(); size != 12 {
+		t.Errorf("QUERY_INFO EndOfFile = %d, want 12", size)
+	}
+	if n := tree.Share.fileHandles.Count(); n != 0 {
+		t.Errorf("%d handles open after the compound CLOSE, want 0", n)
+	}
+}
+
+// TestCompound_FailedCreate tests that related requests after a failed
+// CREATE fail with its status, and that unrelated ones still run
+func TestCompound_FailedCreate(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+
+	responses := compoundRoundTrip(t, srv, buildCompound(true,
+		testRequest(session, tree, SMB2_CREATE, buildCreateRequest("missing.txt", FILE_OPEN, 0, nil)),
+		testRequest(session, tree, SMB2_QUERY_INFO, buildQueryInfoRequest(relatedFileID, SMB2_0_INFO_FILE, FileStandardInformation, 0, 1024)),
+		testRequest(session, tree, SMB2_CLOSE, buildCloseRequest(relatedFileID)),
+	))
+	if len(responses) != 3 {
+		t.Fatalf("got %d responses, want 3", len(responses))
+	}
+	for i, resp := range responses {
+		if resp.Header.Status != STATUS_OBJECT_NAME_NOT_FOUND {
+			t.Errorf("response %d status = %v, want STATUS_OBJECT_NAME_NOT_FOUND", i, resp.Header.Status)
+		}
+	}
+
+	responses = compoundRoundTrip(t, srv, buildCompound(false,
+		testRequest(session, tree, SMB2_CREATE, buildCreateRequest("missing.txt", FILE_OPEN, 0, nil)),
+		&SMB2Message{Header: &SMB2Header{Command: SMB2_ECHO}, Payload: []byte{4, 0, 0, 0}},
+	))
+	if len(responses) != 2 || responses[1].Header.Status != STATUS_SUCCESS {
+		t.Errorf("unrelated ECHO after a failed CREATE = %+v, want STATUS_SUCCESS", responses[len(responses)-1].Header)
+	}
+}
+
+// TestSplitCompound_Invalid tests that malformed chains are rejected
+func TestSplitCompound_Invalid(t *testing.T) {
+	echo := func() *SMB2Message {
+		return &SMB2Message{Header: &SMB2Header{Command: SMB2_ECHO}, Payload: []byte{4, 0, 0, 0}}
+	}
+	valid := buildCompound(false, echo(), echo())[4:]
+	if msgs, err := splitCompound(&SMB2Message{RawBytes: valid}); err != nil || len(msgs) != 2 {
+		t.Fatalf("splitCompound() = %d commands, %v, want 2", len(msgs), err)
+	}
+
+	for _, next := range []uint32{12, 70, 72 + 64, 32} {
+		raw := append([]byte(nil), valid...)
+		le.PutUint32(raw[20:24], next)
+		if _, err := splitCompound(&SMB2Message{RawBytes: raw}); err == nil {
+			t.Errorf("splitCompound() with NextCommand %d succeeded", next)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package smbfs
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// SMB2 COMPRESSION_TRANSFORM_HEADER (MS-SMB2 2.2.42), unchained form only
+const (
+	SMB2CompressionProtocolID          = "\xFCSMB"
+	SMB2CompressionTransformHeaderSize = 16
+)
+
+// SMB 3.1.1 compression algorithms (MS-SMB2 2.2.3.1.3)
+const (
+	SMB2_COMPRESSION_NONE         uint16 = 0x0000
+	SMB2_COMPRESSION_LZNT1        uint16 = 0x0001
+	SMB2_COMPRESSION_LZ77         uint16 = 0x0002
+	SMB2_COMPRESSION_LZ77_HUFFMAN uint16 = 0x0003
+	SMB2_COMPRESSION_PATTERN_V1   uint16 = 0x0004
+)
+
+// compressionMinSize is the smallest response payload worth compressing
+const compressionMinSize = 4096
+
+// responseCompression returns the algorithm a response is compressed with:
+// large reads are, on connections that negotiated compression
+func responseCompression(state *connState, cmd uint16, status NTStatus, payload []byte) uint16 {
+	if cmd == SMB2_READ && status == STATUS_SUCCESS && len(payload) >= compressionMinSize {
+		return state.compressionAlg
+	}
+	return SMB2_COMPRESSION_NONE
+}
+
+// ErrDecompressionFailed is returned for compressed messages that cannot
+// be decompressed
+var ErrDecompressionFailed = errors.New("SMB2 message decompression failed")
+
+// IsCompressedMessage reports whether data starts with a compression
+// transform header
+func IsCompressedMessage(data []byte) bool {
+	return len(data) >= SMB2CompressionTransformHeaderSize && string(data[0:4]) == SMB2CompressionProtocolID
+}
+
+// CompressMessage wraps an SMB2 message in a compression transform header,
+// leaving its first offset bytes uncompressed. It reports false if the
+// algorithm is not supported or compressing would not make the message
+// smaller
+func CompressMessage(message []byte, algorithm uint16, offset int) ([]byte, bool) {
+	if algorithm != SMB2_COMPRESSION_LZ77 || offset > len(message) {
+		return nil, false
+	}
+	compressed := lz77Compress(message[offset:])
+	if SMB2CompressionTransformHeaderSize+offset+len(compressed) >= len(message) {
+		return nil, false
+	}
+
+	out := make([]byte, SMB2CompressionTransformHeaderSize, SMB2CompressionTransformHeaderSize+offset+len(compressed))
+	copy(out[0:4], SMB2CompressionProtocolID)
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(message)-offset)) // OriginalCompressedSegmentSize
+	binary.LittleEndian.PutUint16(out[8:10], algorithm)                  // CompressionAlgorithm
+	// Flags (2) at 10:12: SMB2_COMPRESSION_FLAG_NONE
+	binary.LittleEndian.PutUint32(out[12:16], uint32(offset)) // Offset
+	out = append(out, message[:offset]...)
+	return append(out, compressed...), true
+}
+
+// DecompressMessage unwraps a compressed SMB2 message, refusing ones that
+// would decompress to more than maxSize bytes
+func DecompressMessage(data []byte, maxSize int) ([]byte, error) {
+	if !IsCompressedMessage(data) {
+		return nil, ErrInvalidMessage
+	}
+	size := int(binary.LittleEndian.Uint32(data[4:8]))
+	algorithm := binary.LittleEndian.Uint16(data[8:10])
+	flags := binary.LittleEndian.Uint16(data[10:12])
+	offset := int(binary.LittleEndian.Uint32(data[12:16]))
+
+	body := data[SMB2CompressionTransformHeaderSize:]
+	if flags != 0 || algorithm != SMB2_COMPRESSION_LZ77 ||
+		offset > len(body) || size > maxSize-offset {
+		return nil, ErrDecompressionFailed
+	}
+	segment, err := lz77Decompress(body[offset:], size)
+	if err != nil {
+		return nil, err
+	}
+	return append(body[:offset:offset], segment...), nil
+}
+
+// lz77Compress compresses src with the Plain LZ77 algorithm of MS-XCA
+// 2.3. Each group of 32 literals and matches is preceded by a 32-bit word
+// of flags, one bit per item from the top, set for matches; the bits after
+// the last item are set. A match is a 16-bit word of the offset back
+// (1-8192) in its top 13 bits and the length, less 3, in its low 3; longer
+// lengths continue in a nibble shared by two matches, then a byte, then a
+// 16- or 32-bit word
+func lz77Compress(src []byte) []byte {
+	const (
+		window   = 8192
+		hashBits = 15
+		maxChain = 32
+	)
+
+	// Chains of earlier positions with the same next three bytes
+	head := make([]int32, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, len(src))
+	hash := func(i int) uint32 {
+		return (uint32(src[i]) | uint32(src[i+1])<<8 | uint32(src[i+2])<<16) * 2654435761 >> (32 - hashBits)
+	}
+	insert := func(i int) {
+		if i+3 <= len(src) {
+			h := hash(i)
+			prev[i] = head[h]
+			head[h] = int32(i)
+		}
+	}
+
+	out := make([]byte, 4, len(src)/2+8)
+	var flags uint32
+	flagCount, flagPos := 0, 0
+	nibblePos := -1
+	putFlag := func(bit uint32) {
+		flags = flags<<1 | bit
+		if flagCount++; flagCount == 32 {
+			binary.LittleEndian.PutUint32(out[flagPos:], flags)
+			flags, flagCount, flagPos = 0, 0, len(out)
+			out = append(out, 0, 0, 0, 0)
+		}
+	}
+
+	for i := 0; i < len(src); {
+		bestLen, bestOffset := 0, 0
+		if i+3 <= len(src) {
+			for j, n := head[hash(i)], 0; j >= 0 && i-int(j) <= window && n < maxChain; j, n = prev[j], n+1 {
+				l := 0
+				for i+l < len(src) && src[int(j)+l] == src[i+l] {
+					l++
+				}
+				if l > bestLen {
+					bestLen, bestOffset = l, i-int(j)
+				}
+			}
+		}
+
+		if bestLen < 3 {
+			out = append(out, src[i])
+			putFlag(0)
+			insert(i)
+			i++
+			continue
+		}
+
+		length := bestLen - 3
+		token := uint16(bestOffset-1) << 3
+		if length < 7 {
+			out = binary.LittleEndian.AppendUint16(out, token|uint16(length))
+		} else {
+			out = binary.LittleEndian.AppendUint16(out, token|7)
+			nibble := byte(min(length-7, 15))
+			if nibblePos < 0 {
+				nibblePos = len(out)
+				out = append(out, nibble)
+			} else {
+				out[nibblePos] |= nibble << 4
+				nibblePos = -1
+			}
+			switch {
+			case length < 15+7:
+			case length < 255+15+7:
+				out = append(out, byte(length-(15+7)))
+			case length < 1<<16:
+				out = append(out, 255)
+				out = binary.LittleEndian.AppendUint16(out, uint16(length))
+			default:
+				out = append(out, 255, 0, 0)
+				out = binary.LittleEndian.AppendUint32(out, uint32(length))
+			}
+		}
+		putFlag(1)
+		for end := i + bestLen; i < end; i++ {
+			insert(i)
+		}
+	}
+
+	flags = flags<<(32-flagCount) | (uint32(1)<<(32-flagCount) - 1)
+	binary.LittleEndian.PutUint32(out[flagPos:], flags)
+	return out
+}
+
+// lz77Decompress decompresses Plain LZ77 data (MS-XCA 2.4) that must
+// decompress to exactly size bytes
+func lz77Decompress(src []byte, size int) ([]byte, error) {
+	out := make([]byte, 0, size)
+	var flags uint32
+	flagCount := 0
+	nibblePos := -1
+	in := 0
+	for in < len(src) {
+		if flagCount == 0 {
+			if in+4 > len(src) {
+				return nil, ErrDecompressionFailed
+			}
+			flags = binary.LittleEndian.Uint32(src[in:])
+			in += 4
+			flagCount = 32
+		}
+		flagCount--
+
+		if flags&(1<<flagCount) == 0 {
+			if in >= len(src) || len(out) >= size {
+				return nil, ErrDecompressionFailed
+			}
+			out = append(out, src[in])
+			in++
+			continue
+		}
+
+		// A set flag with no input left ends the data
+		if in == len(src) {
+			break
+		}
+		if in+2 > len(src) {
+			return nil, ErrDecompressionFailed
+		}
+		token := binary.LittleEndian.Uint16(src[in:])
+		in += 2
+		length := int(token & 7)
+		offset := int(token>>3) + 1
+		if length == 7 {
+			if nibblePos < 0 {
+				if in >= len(src) {
+					return nil, ErrDecompressionFailed
+				}
+				length = int(src[in] & 15)
+				nibblePos = in
+				in++
+			} else {
+				length = int(src[nibblePos] >> 4)
+				nibblePos = -1
+			}
+			if length == 15 {
+				if in >= len(src) {
+					return nil, ErrDecompressionFailed
+				}
+				length = int(src[in])
+				in++
+				if length == 255 {
+					if in+2 > len(src) {
+						return nil, ErrDecompressionFailed
+					}
+					length = int(binary.LittleEndian.Uint16(src[in:]))
+					in += 2
+					if length == 0 {
+						if in+4 > len(src) {
+							return nil, ErrDecompressionFailed
+						}
+						length = int(binary.LittleEndian.Uint32(src[in:]))
+						in += 4
+					}
+					if length < 15+7 {
+						return nil, ErrDecompressionFailed
+					}
+					length -= 15 + 7
+				}
+				length += 15
+			}
+			length += 7
+		}
+		length += 3
+
+		if offset > len(out) || length > size-len(out) {
+			return nil, ErrDecompressionFailed
+		}
+		for ; length > 0; length-- {
+			out = append(out, out[len(out)-offset])
+		}
+	}
+
+	if len(out) != size {
+		return nil, ErrDecompressionFailed
+	}
+	return out, nil
+}
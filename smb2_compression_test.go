@@ -0,0 +1,209 @@
+package smbfs
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// TestLZ77_RoundTrip tests that Plain LZ77 data decompresses to what was
+// compressed, across flag words and every match length encoding
+func TestLZ77_RoundTrip(t *testing.T) {
+	random := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	inputs := map[string][]byte{
+		"empty":      nil,
+		"one byte":   []byte("a"),
+		"literals":   []byte("the quick brown fox jumps over the lazy dog"),
+		"text":       bytes.Repeat([]byte("SMB2 compression test line\n"), 500),
+		"random":     random,
+		"short runs": bytes.Repeat([]byte("aaaaaaaaaaaaaaaaaaaaxyz"), 300), // nibble lengths
+		"long run":   make([]byte, 1000),                                   // byte length
+		"huge run":   make([]byte, 200000),                                 // 32-bit length
+	}
+	for name, src := range inputs {
+		compressed := lz77Compress(src)
+		got, err := lz77Decompress(compressed, len(src))
+		if err != nil {
+			t.Errorf("%s: lz77Decompress() error = %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got, src) {
+			t.Errorf("%s: round trip changed the data", name)
+		}
+		if _, err := lz77Decompress(compressed, len(src)+1); err == nil {
+			t.Errorf("%s: lz77Decompress() accepted the wrong size", name)
+		}
+	}
+
+	if n := len(lz77Compress(inputs["text"])); n > len(inputs["text"])/10 {
+		t.Errorf("repeated text compressed to %d bytes of %d", n, len(inputs["text"]))
+	}
+}
+
+// TestLZ77_MSXCAExample tests against the example of MS-XCA 3.1
+func TestLZ77_MSXCAExample(t *testing.T) {
+	src := bytes.Repeat([]byte("abc"), 100)
+	want := []byte{0xff, 0xff, 0xff, 0x1f, 0x61, 0x62, 0x63, 0x17, 0x00, 0x0f, 0xff, 0x26, 0x01}
+
+	if got := lz77Compress(src); !bytes.Equal(got, want) {
+		t.Errorf("lz77Compress() = % x, want % x", got, want)
+	}
+	got, err := lz77Decompress(want, len(src))
+	if err != nil || !bytes.Equal(got, src) {
+		t.Errorf("lz77Decompress() = %q, %v, want %q", got, err, src)
+	}
+}
+
+// TestCompressMessage_RoundTrip tests the compression transform header
+func TestCompressMessage_RoundTrip(t *testing.T) {
+	message := append(plainHeader(SMB2_READ, 7), bytes.Repeat([]byte("payload "), 1024)...)
+
+	compressed, ok := CompressMessage(message, SMB2_COMPRESSION_LZ77, SMB2HeaderSize)
+	if !ok {
+		t.Fatal("CompressMessage() did not compress a repetitive message")
+	}
+	if !IsCompressedMessage(compressed) || IsCompressedMessage(message) {
+		t.Error("IsCompressedMessage() does not tell compressed messages apart")
+	}
+	header := compressed[SMB2CompressionTransformHeaderSize : SMB2CompressionTransformHeaderSize+SMB2HeaderSize]
+	if !bytes.Equal(header, message[:SMB2HeaderSize]) {
+		t.Error("CompressMessage() changed the uncompressed header")
+	}
+
+	got, err := DecompressMessage(compressed, len(message))
+	if err != nil {
+		t.Fatalf("DecompressMessage() error = %v", err)
+	}
+	if !bytes.Equal(got, message) {
+		t.Error("DecompressMessage() did not return the original message")
+	}
+	if _, err := DecompressMessage(compressed, len(message)-1); err == nil {
+		t.Error("DecompressMessage() exceeded its size limit")
+	}
+
+	random := make([]byte, 8192)
+	rand.New(rand.NewSource(1)).Read(random)
+	if _, ok := CompressMessage(append(plainHeader(SMB2_READ, 7), random...), SMB2_COMPRESSION_LZ77, SMB2HeaderSize); ok {
+		t.Error("CompressMessage() compressed a message it could not shrink")
+	}
+	if _, ok := CompressMessage(message, SMB2_COMPRESSION_LZNT1, SMB2HeaderSize); ok {
+		t.Error("CompressMessage() compressed with an unsupported algorithm")
+	}
+}
+
+// buildNegotiateRequest builds an SMB 3.1.1 NEGOTIATE request payload that
+// offers the given compression algorithms
+func buildNegotiateRequest(compression ...uint16) []byte {
+	const contextOffset = SMB2HeaderSize + 40 // Fixed part and dialect, padded
+
+	w := NewByteWriter(128)
+	w.WriteUint16(36)                             // StructureSize
+	w.WriteUint16(1)                              // DialectCount
+	w.WriteUint16(SMB2_NEGOTIATE_SIGNING_ENABLED) // SecurityMode
+	w.WriteUint16(0)                              // Reserved
+	w.WriteUint32(0)                              // Capabilities
+	w.WriteGUID([16]byte{1})                      // ClientGuid
+	w.WriteUint32(contextOffset)                  // NegotiateContextOffset
+	w.WriteUint16(2)                              // NegotiateContextCount
+	w.WriteUint16(0)                              // Reserved2
+	w.WriteUint16(uint16(SMB3_1_1))               // Dialects
+	w.WriteBytes(make([]byte, 2))                 // Padding
+
+	w.WriteUint16(SMB2_PREAUTH_INTEGRITY_CAPABILITIES)
+	w.WriteUint16(6)
+	w.WriteUint32(0)
+	w.WriteUint16(1) // HashAlgorithmCount
+	w.WriteUint16(0) // SaltLength
+	w.WriteUint16(SMB2_PREAUTH_INTEGRITY_SHA512)
+	w.WriteBytes(make([]byte, 2))
+
+	w.WriteUint16(SMB2_COMPRESSION_CAPABILITIES)
+	w.WriteUint16(uint16(8 + 2*len(compression)))
+	w.WriteUint32(0)
+	w.WriteUint16(uint16(len(compression))) // CompressionAlgorithmCount
+	w.WriteUint16(0)                        // Padding
+	w.WriteUint32(0)                        // Flags
+	for _, alg := range compression {
+		w.WriteUint16(alg)
+	}
+	return w.Bytes()
+}
+
+// negotiatedCompression returns the algorithms of the compression context
+// of a NEGOTIATE response, or nil if it has none
+func negotiatedCompression(t *testing.T, raw []byte) []uint16 {
+	t.Helper()
+	count := int(le.Uint16(raw[SMB2HeaderSize+6:]))
+	pos := int(le.Uint32(raw[SMB2HeaderSize+60:]))
+	for i := 0; i < count; i++ {
+		ctxType, dataLen := le.Uint16(raw[pos:]), int(le.Uint16(raw[pos+2:]))
+		data := raw[pos+8 : pos+8+dataLen]
+		if ctxType == SMB2_COMPRESSION_CAPABILITIES {
+			var algs []uint16
+			for n := int(le.Uint16(data)); n > 0; n-- {
+				algs = append(algs, le.Uint16(data[8+2*len(algs):]))
+			}
+			return algs
+		}
+		pos += (8 + dataLen + 7) &^ 7
+	}
+	return nil
+}
+
+// TestCompression_Loopback tests that compression is negotiated only when
+// enabled, and that compressed writes are accepted and large reads are
+// answered compressed once it is
+func TestCompression_Loopback(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	negotiate := &SMB2Message{
+		Header:  &SMB2Header{Command: SMB2_NEGOTIATE},
+		Payload: buildNegotiateRequest(SMB2_COMPRESSION_LZNT1, SMB2_COMPRESSION_LZ77),
+	}
+
+	conn := serveTestConn(t, srv)
+	conn.Write(frameRequests(false, negotiate))
+	if algs := negotiatedCompression(t, readTestFrame(t, conn)); algs != nil {
+		t.Errorf("compression negotiated while disabled: %v", algs)
+	}
+
+	srv.options.EnableCompression = true
+	conn = serveTestConn(t, srv)
+	conn.Write(frameRequests(false, negotiate))
+	if algs := negotiatedCompression(t, readTestFrame(t, conn)); len(algs) != 1 || algs[0] != SMB2_COMPRESSION_LZ77 {
+		t.Fatalf("negotiated compression = %v, want [LZ77]", algs)
+	}
+
+	f, _ := tree.Share.fs.Create("/data.txt")
+	of := tree.Share.fileHandles.Allocate(f, "data.txt", false, GENERIC_READ|GENERIC_WRITE, FILE_SHARE_READ, FILE_OPEN, 0, tree.ID, session.ID)
+	defer tree.Share.fileHandles.Release(of.ID)
+	data := bytes.Repeat([]byte("compressible "), 5000)
+
+	frame := frameRequests(false, testRequest(session, tree, SMB2_WRITE, buildWriteRequest(of.ID, 0, data)))
+	compressed, ok := CompressMessage(frame[4:], SMB2_COMPRESSION_LZ77, SMB2HeaderSize)
+	if !ok {
+		t.Fatal("CompressMessage() did not compress the WRITE")
+	}
+	conn.Write(append([]byte{0, byte(len(compressed) >> 16), byte(len(compressed) >> 8), byte(len(compressed))}, compressed...))
+	resp, err := UnmarshalSMB2Header(readTestFrame(t, conn))
+	if err != nil || resp.Status != STATUS_SUCCESS {
+		t.Fatalf("compressed WRITE response = %v, %v, want STATUS_SUCCESS", resp, err)
+	}
+
+	conn.Write(frameRequests(false, testRequest(session, tree, SMB2_READ, buildReadRequest(of.ID, uint32(len(data))))))
+	raw := readTestFrame(t, conn)
+	if !IsCompressedMessage(raw) {
+		t.Fatal("READ response not compressed")
+	}
+	if len(raw) > len(data)/10 {
+		t.Errorf("compressed READ response is %d bytes for %d of data", len(raw), len(data))
+	}
+	raw, err = DecompressMessage(raw, MaxTransactSize)
+	if err != nil {
+		t.Fatalf("DecompressMessage() error = %v", err)
+	}
+	if got := raw[SMB2HeaderSize+16:]; !bytes.Equal(got, data) {
+		t.Errorf("READ returned %d bytes, want the %d written", len(got), len(data))
+	}
+}
@@ -0,0 +1,106 @@
+package smbfs
+
+// SMB2 Create Context names (MS-SMB2 2.2.13.2)
+const (
+	SMB2_CREATE_REQUEST_LEASE               = "RqLs" // Lease request (v1 or v2)
+	SMB2_CREATE_DURABLE_HANDLE_REQUEST      = "DHnQ" // Durable handle request
+	SMB2_CREATE_DURABLE_HANDLE_RECONNECT    = "DHnC" // Durable handle reconnect
+	SMB2_CREATE_DURABLE_HANDLE_REQUEST_V2   = "DH2Q" // Durable handle request (SMB 3.x)
+	SMB2_CREATE_DURABLE_HANDLE_RECONNECT_V2 = "DH2C" // Durable handle reconnect (SMB 3.x)
+)
+
+// CreateContext is a single SMB2_CREATE_CONTEXT entry from a CREATE request
+// or to be returned in a CREATE response
+type CreateContext struct {
+	Name string
+	Data []byte
+}
+
+// parseCreateContexts parses the chain of create contexts in a CREATE request
+// offset is relative to the start of the SMB2 header, as on the wire
+func parseCreateContexts(payload []byte, offset, length uint32) ([]CreateContext, NTStatus) {
+	if length == 0 {
+		return nil, STATUS_SUCCESS
+	}
+
+	start := int(offset) - SMB2HeaderSize
+	if start < 0 || start+int(length) > len(payload) {
+		return nil, STATUS_INVALID_PARAMETER
+	}
+	buf := payload[start : start+int(length)]
+
+	var contexts []CreateContext
+	pos := 0
+	for {
+		// Each context starts with a 16-byte fixed header
+		if pos+16 > len(buf) {
+			return nil, STATUS_INVALID_PARAMETER
+		}
+		r := NewByteReader(buf[pos:])
+		next := r.ReadUint32()       // Next
+		nameOffset := r.ReadUint16() // NameOffset
+		nameLength := r.ReadUint16() // NameLength
+		_ = r.ReadUint16()           // Reserved
+		dataOffset := r.ReadUint16() // DataOffset
+		dataLength := r.ReadUint32() // DataLength
+
+		nameStart := pos + int(nameOffset)
+		if nameStart+int(nameLength) > len(buf) {
+			return nil, STATUS_INVALID_PARAMETER
+		}
+		ctx := CreateContext{Name: string(buf[nameStart : nameStart+int(nameLength)])}
+
+		if dataLength > 0 {
+			dataStart := pos + int(dataOffset)
+			if dataStart+int(dataLength) > len(buf) {
+				return nil, STATUS_INVALID_PARAMETER
+			}
+			ctx.Data = buf[dataStart : dataStart+int(dataLength)]
+		}
+		contexts = append(contexts, ctx)
+
+		if next == 0 {
+			break
+		}
+		pos += int(next)
+	}
+
+	return contexts, STATUS_SUCCESS
+}
+
+// findCreateContext returns the data of the named create context, if present
+func findCreateContext(contexts []CreateContext, name string) ([]byte, bool) {
+	for _, ctx := range contexts {
+		if ctx.Name == name {
+			return ctx.Data, true
+		}
+	}
+	return nil, false
+}
+
+// buildCreateContexts serializes create contexts for a CREATE response
+// Each context is 8-byte aligned and chained through its Next field
+func buildCreateContexts(contexts []CreateContext) []byte {
+	w := NewByteWriter(64)
+	for i, ctx := range contexts {
+		start := w.Len()
+		nameOffset := 16
+		dataOffset := AlignTo8(nameOffset + len(ctx.Name))
+
+		w.WriteUint32(0)                              // Next (patched below)
+		w.WriteUint16(uint16(nameOffset))             // NameOffset
+		w.WriteUint16(uint16(len(ctx.Name)))          // NameLength
+		w.WriteUint16(0)                              // Reserved
+		w.WriteUint16(uint16(dataOffset))             // DataOffset
+		w.WriteUint32(uint32(len(ctx.Data)))          // DataLength
+		w.WriteBytes([]byte(ctx.Name))                // Buffer: Name
+		w.WriteZeros(dataOffset - 16 - len(ctx.Name)) // Padding
+		w.WriteBytes(ctx.Data)                        // Buffer: Data
+
+		if i < len(contexts)-1 {
+			w.WritePadTo8()
+			w.SetUint32At(start, uint32(w.Len()-start))
+		}
+	}
+	return w.Bytes()
+}
@@ -0,0 +1,96 @@
+package smbfs
+
+// SMB2 credit accounting (MS-SMB2 3.3.1.2, 3.3.5.2.3)
+//
+// A client may only have as many requests outstanding as it holds credits.
+// It starts with one, each request spends its CreditCharge, and each
+// response grants some back. The server never lets the window grow past
+// ServerOptions.MaxCredits and refuses requests the client cannot pay for
+
+// defaultMaxCredits is the default ServerOptions.MaxCredits
+const defaultMaxCredits = 512
+
+// creditCharge returns the credits a request spends. SMB 2.0.2 clients
+// leave CreditCharge zero and every request costs one credit
+func creditCharge(h *SMB2Header) uint64 {
+	if h.CreditCharge == 0 {
+		return 1
+	}
+	return uint64(h.CreditCharge)
+}
+
+// singleCreditMaxSize is the most data one credit covers, and the largest
+// read, write or transaction on an SMB 2.0.2 connection
+const singleCreditMaxSize = 65536
+
+// multiCredit reports whether the connection's dialect charges requests
+// by size (SMB 2.1 and later)
+func (state *connState) multiCredit() bool {
+	return state != nil && state.dialect >= SMB2_1
+}
+
+// requiredCreditCharge returns the least CreditCharge a request must carry:
+// one credit for each 64KB of the larger of the data it sends and the data
+// it asks for (MS-SMB2 3.3.5.2.5). Only READ, WRITE, IOCTL and
+// QUERY_DIRECTORY are sized this way; other requests cost one credit
+func requiredCreditCharge(cmd uint16, payload []byte) uint64 {
+	r := NewByteReader(payload)
+	var size uint64
+	switch cmd {
+	case SMB2_READ, SMB2_WRITE:
+		r.Seek(4) // Length
+		size = uint64(r.ReadUint32())
+	case SMB2_IOCTL:
+		r.Seek(28) // InputCount
+		size = uint64(r.ReadUint32())
+		r.Seek(44) // MaxOutputResponse
+		size = max(size, uint64(r.ReadUint32()))
+	case SMB2_QUERY_DIRECTORY:
+		r.Seek(28) // OutputBufferLength
+		size = uint64(r.ReadUint32())
+	}
+	if size == 0 {
+		return 1
+	}
+	return (size-1)/singleCreditMaxSize + 1
+}
+
+// availableCredits returns the credits the client holds and has not spent
+func (state *connState) availableCredits() uint64 {
+	spendable := 1 + state.creditsGranted // Connections start with one credit
+	if state.creditsCharged >= spendable {
+		return 0
+	}
+	return spendable - state.creditsCharged
+}
+
+// chargeCredits spends a request's credits. It reports false, charging
+// nothing, when the client has not been granted enough of them
+func (state *connState) chargeCredits(h *SMB2Header) bool {
+	charge := creditCharge(h)
+	if charge > state.availableCredits() {
+		return false
+	}
+	state.creditsCharged += charge
+	return true
+}
+
+// grantCredits returns the credits to grant in a response to a request
+// that asked for requested. The grant is capped so the client never holds
+// more than limit, but is at least one while the client holds none so that
+// it is never left unable to send
+func (state *connState) grantCredits(requested, limit uint16) uint16 {
+	available := state.availableCredits()
+	grant := uint64(requested)
+	if grant == 0 {
+		grant = 1
+	}
+	if room := uint64(limit) - min(available, uint64(limit)); grant > room {
+		grant = room
+	}
+	if grant == 0 && available == 0 {
+		grant = 1
+	}
+	state.creditsGranted += grant
+	return uint16(grant)
+}
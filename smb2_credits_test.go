@@ -0,0 +1,209 @@
+package smbfs
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestHandleMessage_Credits tests credits spent and granted across a
+// sequence of requests on one connection
+func TestHandleMessage_Credits(t *testing.T) {
+	opts := DefaultServerOptions()
+	opts.MaxCredits = 8
+	srv, err := NewServer(opts)
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	state := &connState{}
+
+	steps := []struct {
+		name      string
+		cmd       uint16
+		charge    uint16
+		request   uint16
+		status    NTStatus
+		granted   uint16
+		available uint64
+	}{
+		// The connection starts with one credit
+		{"first request", SMB2_ECHO, 0, 4, STATUS_SUCCESS, 4, 4},
+		{"multi-credit", SMB2_ECHO, 3, 0, STATUS_SUCCESS, 1, 2},
+		{"overdrawn", SMB2_ECHO, 3, 2, STATUS_INSUFFICIENT_RESOURCES, 0, 2},
+		{"capped at MaxCredits", SMB2_ECHO, 1, 100, STATUS_SUCCESS, 7, 8},
+		{"full window", SMB2_ECHO, 1, 10, STATUS_SUCCESS, 1, 8},
+		{"spend everything", SMB2_ECHO, 8, 0, STATUS_SUCCESS, 1, 1},
+	}
+	for _, step := range steps {
+		msg := &SMB2Message{
+			Header:  &SMB2Header{Command: step.cmd, CreditCharge: step.charge, CreditRequest: step.request},
+			Payload: []byte{4, 0, 0, 0},
+		}
+		resp, err := srv.handler.HandleMessage(state, msg)
+		if err != nil {
+			t.Fatalf("%s: HandleMessage() error = %v", step.name, err)
+		}
+		if resp.Header.Status != step.status || resp.Header.CreditRequest != step.granted {
+			t.Errorf("%s: status = %v, granted %d, want %v, granted %d",
+				step.name, resp.Header.Status, resp.Header.CreditRequest, step.status, step.granted)
+		}
+		if got := state.availableCredits(); got != step.available {
+			t.Errorf("%s: available credits = %d, want %d", step.name, got, step.available)
+		}
+	}
+
+	// CANCEL neither spends nor earns credits
+	cancel := &SMB2Message{Header: &SMB2Header{Command: SMB2_CANCEL, CreditRequest: 5}}
+	if resp, err := srv.handler.HandleMessage(state, cancel); err != nil || resp != nil {
+		t.Fatalf("HandleMessage(CANCEL) = (%v, %v), want no response", resp, err)
+	}
+	if got := state.availableCredits(); got != 1 {
+		t.Errorf("available credits after CANCEL = %d, want 1", got)
+	}
+}
+
+// TestGrantCredits tests that a client without credits is always granted
+// one, even when MaxCredits leaves no room
+func TestGrantCredits(t *testing.T) {
+	state := &connState{}
+	if !state.chargeCredits(&SMB2Header{CreditCharge: 1}) {
+		t.Fatal("chargeCredits() refused the initial credit")
+	}
+	if state.chargeCredits(&SMB2Header{}) {
+		t.Error("chargeCredits() succeeded with no credits left")
+	}
+	if got := state.grantCredits(0, 0); got != 1 {
+		t.Errorf("grantCredits() with no credits = %d, want 1", got)
+	}
+	if got := state.grantCredits(3, 1); got != 0 {
+		t.Errorf("grantCredits() with a full window = %d, want 0", got)
+	}
+}
+
+// TestRequiredCreditCharge tests the credit charge required by the size of
+// READ, WRITE, IOCTL and QUERY_DIRECTORY requests
+func TestRequiredCreditCharge(t *testing.T) {
+	// sized returns a payload of n bytes with v at offset off
+	sized := func(n, off int, v uint32) []byte {
+		p := make([]byte, n)
+		le.PutUint32(p[off:], v)
+		return p
+	}
+
+	tests := []struct {
+		name    string
+		cmd     uint16
+		payload []byte
+		want    uint64
+	}{
+		{"empty read", SMB2_READ, sized(49, 4, 0), 1},
+		{"64KB read", SMB2_READ, sized(49, 4, 65536), 1},
+		{"64KB+1 read", SMB2_READ, sized(49, 4, 65537), 2},
+		{"1MB write", SMB2_WRITE, sized(49, 4, 1<<20), 16},
+		{"ioctl input", SMB2_IOCTL, sized(57, 28, 200000), 4},
+		{"ioctl output", SMB2_IOCTL, sized(57, 44, 131072), 2},
+		{"query directory", SMB2_QUERY_DIRECTORY, sized(33, 28, 65537), 2},
+		{"short payload", SMB2_READ, []byte{49, 0}, 1},
+		{"unsized command", SMB2_ECHO, sized(49, 4, 1<<20), 1},
+	}
+	for _, tt := range tests {
+		if got := requiredCreditCharge(tt.cmd, tt.payload); got != tt.want {
+			t.Errorf("%s: requiredCreditCharge() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestHandleMessage_CreditChargeTooSmall tests that a request whose credit
+// charge does not cover its size fails with STATUS_INVALID_PARAMETER on an
+// SMB 2.1+ connection, and that SMB 2.0.2, which has no multi-credit
+// requests, is not charged by size
+func TestHandleMessage_CreditChargeTooSmall(t *testing.T) {
+	srv, err := NewServer(DefaultServerOptions())
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	read := make([]byte, 49)
+	le.PutUint16(read, 49)
+	le.PutUint32(read[4:], 128*1024)
+	for _, tt := range []struct {
+		dialect SMBDialect
+		charge  uint16
+		invalid bool
+	}{
+		{SMB3_1_1, 0, true},
+		{SMB3_1_1, 1, true},
+		{SMB3_1_1, 2, false},
+		{SMB2_1, 1, true},
+		{SMB2_0_2, 0, false},
+	} {
+		state := &connState{dialect: tt.dialect, creditsGranted: 16}
+		msg := &SMB2Message{
+			Header:  &SMB2Header{Command: SMB2_READ, CreditCharge: tt.charge, CreditRequest: 1},
+			Payload: read,
+		}
+		resp, err := srv.handler.HandleMessage(state, msg)
+		if err != nil {
+			t.Fatalf("HandleMessage() error = %v", err)
+		}
+		if invalid := resp.Header.Status == STATUS_INVALID_PARAMETER; invalid != tt.invalid {
+			t.Errorf("%v: 128KB READ with credit charge %d: status = %v, want invalid %v",
+				tt.dialect, tt.charge, resp.Header.Status, tt.invalid)
+		}
+	}
+}
+
+// TestNegotiate_SingleCreditSizes tests that SMB 2.0.2 is offered neither
+// LARGE_MTU nor sizes above 64KB, and SMB 2.1 is offered both
+func TestNegotiate_SingleCreditSizes(t *testing.T) {
+	srv, err := NewServer(DefaultServerOptions())
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	for _, tt := range []struct {
+		dialect  SMBDialect
+		largeMTU bool
+		maxRead  uint32
+	}{
+		{SMB2_0_2, false, singleCreditMaxSize},
+		{SMB2_1, true, MaxReadSize},
+	} {
+		resp := srv.handler.buildNegotiateResponse(tt.dialect, [16]byte{}, 0, 0, SMB2_COMPRESSION_NONE)
+		capabilities := le.Uint32(resp[24:])
+		if largeMTU := capabilities&SMB2_GLOBAL_CAP_LARGE_MTU != 0; largeMTU != tt.largeMTU {
+			t.Errorf("%v: LARGE_MTU = %v, want %v", tt.dialect, largeMTU, tt.largeMTU)
+		}
+		for i, name := range []string{"MaxTransactSize", "MaxReadSize", "MaxWriteSize"} {
+			got := le.Uint32(resp[28+4*i:])
+			if tt.dialect == SMB2_0_2 && got > singleCreditMaxSize {
+				t.Errorf("%v: %s = %d, want at most %d", tt.dialect, name, got, singleCreditMaxSize)
+			}
+		}
+		if got := le.Uint32(resp[32:]); got != tt.maxRead {
+			t.Errorf("%v: MaxReadSize = %d, want %d", tt.dialect, got, tt.maxRead)
+		}
+	}
+}
+
+// TestLoopback_SMB202LargeIO tests that an SMB 2.0.2 client can write and
+// read a file larger than 64KB
+func TestLoopback_SMB202LargeIO(t *testing.T) {
+	_, config := startLoopbackServer(t, ServerOptions{MaxDialect: SMB2_0_2})
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	want := bytes.Repeat([]byte("0123456789abcdef"), 200*1024/16)
+	if _, err := fsys.Upload(bytes.NewReader(want), "/large.bin", TransferOptions{}); err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+	var got bytes.Buffer
+	if _, err := fsys.Download("/large.bin", &got, TransferOptions{}); err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("Download() returned %d bytes, want the %d written", got.Len(), len(want))
+	}
+}
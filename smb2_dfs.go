@@ -0,0 +1,270 @@
+package smbfs
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf16"
+)
+
+// DFS referral constants (MS-DFSC 2.2.5)
+const (
+	DFS_SERVER_TYPE_LINK uint16 = 0x0000 // Referral to a link target
+	DFS_SERVER_TYPE_ROOT uint16 = 0x0001 // Referral to a namespace root
+
+	DFS_REFERRAL_HEADER_REFERRAL_SERVERS uint32 = 0x00000001 // Targets serve referrals (roots)
+	DFS_REFERRAL_HEADER_STORAGE_SERVERS  uint32 = 0x00000002 // Targets hold the data
+
+	DFS_REFERRAL_ENTRY_NAME_LIST uint16 = 0x0002 // Domain or DC referral, not a path referral
+)
+
+// Sizes of the referral structures
+const (
+	dfsReferralHeaderSize = 8  // RESP_GET_DFS_REFERRAL before the entries
+	dfsReferralV2Size     = 22 // DFS_REFERRAL_V2 fixed part
+	dfsReferralV3Size     = 34 // DFS_REFERRAL_V3/V4 fixed part, with ServiceSiteGuid
+)
+
+// defaultDFSReferralTTL is the TTL in seconds of the referrals the server hands out
+const defaultDFSReferralTTL = 300
+
+// dfsReferralEntry is one target of a DFS referral
+type dfsReferralEntry struct {
+	ServerType    uint16 // DFS_SERVER_TYPE_*
+	Flags         uint16 // ReferralEntryFlags
+	TTL           uint32 // Seconds the referral may be cached
+	DFSPath       string // DFS path the referral covers (\server\share\link)
+	AlternatePath string // 8.3 form of DFSPath
+	Target        string // Target path (\server\share[\path])
+}
+
+// dfsReferralResponse is a RESP_GET_DFS_REFERRAL (MS-DFSC 2.2.4)
+type dfsReferralResponse struct {
+	PathConsumed int    // UTF-16 code units of the request path the referral covers
+	HeaderFlags  uint32 // DFS_REFERRAL_HEADER_*
+	Entries      []dfsReferralEntry
+}
+
+// errInvalidReferral reports a malformed referral request or response
+var errInvalidReferral = errors.New("invalid DFS referral")
+
+// buildDFSReferralRequest builds a REQ_GET_DFS_REFERRAL (MS-DFSC 2.2.2) for path
+func buildDFSReferralRequest(path string, maxLevel uint16) []byte {
+	w := NewByteWriter(2 + 2*len(path) + 2)
+	w.WriteUint16(maxLevel)
+	w.WriteUTF16String(path)
+	w.WriteUint16(0) // Null terminator
+	return w.Bytes()
+}
+
+// parseDFSReferralRequest parses a REQ_GET_DFS_REFERRAL
+func parseDFSReferralRequest(data []byte) (maxLevel uint16, path string, err error) {
+	if len(data) < 4 || len(data)%2 != 0 {
+		return 0, "", errInvalidReferral
+	}
+	name := data[2:]
+	for i := 0; i+1 < len(name); i += 2 {
+		if name[i] == 0 && name[i+1] == 0 {
+			name = name[:i]
+			break
+		}
+	}
+	return le.Uint16(data[0:2]), DecodeUTF16LEToString(name), nil
+}
+
+// marshal encodes the response with version 3 referral entries
+func (r *dfsReferralResponse) marshal() []byte {
+	// Strings follow the fixed parts of all entries; offsets are relative to
+	// the start of the entry that refers to them
+	fixedEnd := dfsReferralHeaderSize + len(r.Entries)*dfsReferralV3Size
+	strs := NewByteWriter(256)
+	w := NewByteWriter(fixedEnd + 256)
+	w.WriteUint16(uint16(2 * r.PathConsumed)) // PathConsumed, in bytes
+	w.WriteUint16(uint16(len(r.Entries)))     // NumberOfReferrals
+	w.WriteUint32(r.HeaderFlags)              // ReferralHeaderFlags
+
+	writeString := func(entryStart int, s string) uint16 {
+		offset := fixedEnd + strs.Len() - entryStart
+		strs.WriteUTF16String(s)
+		strs.WriteUint16(0)
+		return uint16(offset)
+	}
+	for i, e := range r.Entries {
+		start := dfsReferralHeaderSize + i*dfsReferralV3Size
+		w.WriteUint16(3)                 // VersionNumber
+		w.WriteUint16(dfsReferralV3Size) // Size
+		w.WriteUint16(e.ServerType)
+		w.WriteUint16(e.Flags)
+		w.WriteUint32(e.TTL)
+		w.WriteUint16(writeString(start, e.DFSPath))
+		w.WriteUint16(writeString(start, e.AlternatePath))
+		w.WriteUint16(writeString(start, e.Target))
+		w.WriteZeros(16) // ServiceSiteGuid
+	}
+	w.WriteBytes(strs.Bytes())
+	return w.Bytes()
+}
+
+// parseDFSReferralResponse parses a RESP_GET_DFS_REFERRAL with version 2,
+// 3 or 4 entries. Name list entries (domain and DC referrals) are skipped
+func parseDFSReferralResponse(data []byte) (*dfsReferralResponse, error) {
+	if len(data) < dfsReferralHeaderSize {
+		return nil, errInvalidReferral
+	}
+	resp := &dfsReferralResponse{
+		PathConsumed: int(le.Uint16(data[0:2])) / 2,
+		HeaderFlags:  le.Uint32(data[4:8]),
+	}
+	count := int(le.Uint16(data[2:4]))
+
+	pos := dfsReferralHeaderSize
+	for i := 0; i < count; i++ {
+		if pos+8 > len(data) {
+			return nil, errInvalidReferral
+		}
+		version := le.Uint16(data[pos : pos+2])
+		size := int(le.Uint16(data[pos+2 : pos+4]))
+		if size < 8 || pos+size > len(data) {
+			return nil, errInvalidReferral
+		}
+		e := dfsReferralEntry{
+			ServerType: le.Uint16(data[pos+4 : pos+6]),
+			Flags:      le.Uint16(data[pos+6 : pos+8]),
+		}
+
+		var offsets int // Position of DFSPathOffset
+		switch version {
+		case 2:
+			if size < dfsReferralV2Size {
+				return nil, errInvalidReferral
+			}
+			e.TTL = le.Uint32(data[pos+12 : pos+16])
+			offsets = pos + 16
+		case 3, 4:
+			if size < 18 {
+				return nil, errInvalidReferral
+			}
+			e.TTL = le.Uint32(data[pos+8 : pos+12])
+			offsets = pos + 12
+		default:
+			return nil, errInvalidReferral
+		}
+
+		if e.Flags&DFS_REFERRAL_ENTRY_NAME_LIST == 0 {
+			var strs [3]string
+			for j := range strs {
+				off := int(le.Uint16(data[offsets+2*j:]))
+				s, ok := readUTF16Z(data, pos+off)
+				if !ok {
+					return nil, errInvalidReferral
+				}
+				strs[j] = s
+			}
+			e.DFSPath, e.AlternatePath, e.Target = strs[0], strs[1], strs[2]
+			resp.Entries = append(resp.Entries, e)
+		}
+		pos += size
+	}
+	return resp, nil
+}
+
+// readUTF16Z reads a null-terminated UTF-16LE string at pos
+func readUTF16Z(data []byte, pos int) (string, bool) {
+	if pos < 0 || pos > len(data) {
+		return "", false
+	}
+	for i := pos; i+1 < len(data); i += 2 {
+		if data[i] == 0 && data[i+1] == 0 {
+			return DecodeUTF16LEToString(data[pos:i]), true
+		}
+	}
+	return "", false
+}
+
+// utf16Prefix returns the first n UTF-16 code units of s
+func utf16Prefix(s string, n int) string {
+	units := utf16.Encode([]rune(s))
+	if n > len(units) {
+		n = len(units)
+	}
+	return string(utf16.Decode(units[:n]))
+}
+
+// splitDFSPath splits a DFS path (\server\share\path, with one or two
+// leading backslashes) into its server, share and remaining path
+func splitDFSPath(p string) (server, share, rest string, ok bool) {
+	p = strings.TrimLeft(strings.ReplaceAll(p, "/", "\\"), "\\")
+	parts := strings.SplitN(p, "\\", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", "", false
+	}
+	if len(parts) == 3 {
+		rest = strings.Trim(parts[2], "\\")
+	}
+	return parts[0], parts[1], rest, true
+}
+
+// dfsLink returns the DFS link covering path (slash-separated, relative to
+// the share root), if the share is a DFS root and one does
+func (s *Share) dfsLink(path string) (link, target string, ok bool) {
+	if len(s.Options().DFSLinks) == 0 {
+		return "", "", false
+	}
+	path = strings.ToLower(strings.Trim(strings.ReplaceAll(path, "\\", "/"), "/"))
+	for l, t := range s.Options().DFSLinks {
+		key := strings.ToLower(strings.Trim(strings.ReplaceAll(l, "\\", "/"), "/"))
+		if key == "" || (path != key && !strings.HasPrefix(path, key+"/")) {
+			continue
+		}
+		// The longest matching link wins
+		if !ok || len(key) > len(link) {
+			link, target, ok = key, t, true
+		}
+	}
+	return link, target, ok
+}
+
+// handleDFSReferral handles FSCTL_DFS_GET_REFERRALS. A request for a DFS
+// root share gets a root referral to the share itself; a request for a
+// path under one of its links gets a referral to the link's target
+func (h *SMBHandler) handleDFSReferral(ctlCode uint32, fileID FileID, input []byte, maxOutput uint32) ([]byte, NTStatus) {
+	_, reqPath, err := parseDFSReferralRequest(input)
+	if err != nil {
+		return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+	}
+	server, shareName, rest, ok := splitDFSPath(reqPath)
+	if !ok {
+		return h.buildErrorResponse(), STATUS_NOT_FOUND
+	}
+	share := h.server.GetShare(shareName)
+	if share == nil || len(share.Options().DFSLinks) == 0 {
+		return h.buildErrorResponse(), STATUS_NOT_FOUND
+	}
+
+	root := "\\" + server + "\\" + shareName
+	resp := &dfsReferralResponse{}
+	entry := dfsReferralEntry{TTL: defaultDFSReferralTTL}
+	if rest == "" {
+		resp.HeaderFlags = DFS_REFERRAL_HEADER_REFERRAL_SERVERS | DFS_REFERRAL_HEADER_STORAGE_SERVERS
+		entry.ServerType = DFS_SERVER_TYPE_ROOT
+		entry.DFSPath, entry.Target = root, root
+	} else {
+		link, target, ok := share.dfsLink(rest)
+		if !ok {
+			return h.buildErrorResponse(), STATUS_NOT_FOUND
+		}
+		resp.HeaderFlags = DFS_REFERRAL_HEADER_STORAGE_SERVERS
+		entry.DFSPath = root + "\\" + strings.Join(strings.Split(rest, "\\")[:strings.Count(link, "/")+1], "\\")
+		entry.Target = "\\" + strings.TrimLeft(target, "\\")
+	}
+	entry.AlternatePath = entry.DFSPath
+	resp.PathConsumed = len(utf16.Encode([]rune(entry.DFSPath)))
+	resp.Entries = []dfsReferralEntry{entry}
+
+	h.server.logger.Debug("IOCTL: DFS referral for %s -> %s", reqPath, entry.Target)
+
+	data := resp.marshal()
+	if uint32(len(data)) > maxOutput {
+		return h.buildErrorResponse(), STATUS_BUFFER_TOO_SMALL
+	}
+	return h.buildIOCTLResponse(ctlCode, fileID, data), STATUS_SUCCESS
+}
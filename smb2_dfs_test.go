@@ -0,0 +1,202 @@
+package smbfs
+
+import (
+	"testing"
+
+	"github.com/absfs/memfs"
+)
+
+// TestDFSReferralRequest_RoundTrip tests REQ_GET_DFS_REFERRAL encoding
+func TestDFSReferralRequest_RoundTrip(t *testing.T) {
+	data := buildDFSReferralRequest(`\server\root\docs\a.txt`, 4)
+	level, path, err := parseDFSReferralRequest(data)
+	if err != nil {
+		t.Fatalf("parseDFSReferralRequest() error = %v", err)
+	}
+	if level != 4 || path != `\server\root\docs\a.txt` {
+		t.Errorf("parseDFSReferralRequest() = %d, %q", level, path)
+	}
+	if _, _, err := parseDFSReferralRequest(data[:3]); err == nil {
+		t.Error("parseDFSReferralRequest() of a truncated request succeeded")
+	}
+}
+
+// TestDFSReferralResponse_RoundTrip tests that marshaled referrals parse
+// back, and that version 2 entries and name list entries are handled
+func TestDFSReferralResponse_RoundTrip(t *testing.T) {
+	resp := &dfsReferralResponse{
+		PathConsumed: len(`\server\root\docs`),
+		HeaderFlags:  DFS_REFERRAL_HEADER_STORAGE_SERVERS,
+		Entries: []dfsReferralEntry{
+			{TTL: 600, DFSPath: `\server\root\docs`, AlternatePath: `\server\root\docs`, Target: `\fs1\data\documents`},
+			{TTL: 300, DFSPath: `\server\root\docs`, AlternatePath: `\server\root\docs`, Target: `\fs2\backup`},
+		},
+	}
+	got, err := parseDFSReferralResponse(resp.marshal())
+	if err != nil {
+		t.Fatalf("parseDFSReferralResponse() error = %v", err)
+	}
+	if got.PathConsumed != resp.PathConsumed || got.HeaderFlags != resp.HeaderFlags {
+		t.Errorf("header = %d, 0x%x, want %d, 0x%x", got.PathConsumed, got.HeaderFlags, resp.PathConsumed, resp.HeaderFlags)
+	}
+	if len(got.Entries) != len(resp.Entries) {
+		t.Fatalf("got %d entries, want %d", len(got.Entries), len(resp.Entries))
+	}
+	for i, e := range got.Entries {
+		if e != resp.Entries[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, e, resp.Entries[i])
+		}
+	}
+
+	// A version 2 entry followed by a domain referral (name list) entry
+	w := NewByteWriter(128)
+	w.WriteUint16(2 * 14) // PathConsumed
+	w.WriteUint16(2)      // NumberOfReferrals
+	w.WriteUint32(DFS_REFERRAL_HEADER_STORAGE_SERVERS)
+	w.WriteUint16(2)  // VersionNumber
+	w.WriteUint16(22) // Size
+	w.WriteUint16(DFS_SERVER_TYPE_LINK)
+	w.WriteUint16(0)            // ReferralEntryFlags
+	w.WriteUint32(0)            // Proximity
+	w.WriteUint32(120)          // TimeToLive
+	w.WriteUint16(22 + 18)      // DFSPathOffset
+	w.WriteUint16(22 + 18)      // DFSAlternatePathOffset
+	w.WriteUint16(22 + 18 + 30) // NetworkAddressOffset
+	w.WriteUint16(3)            // VersionNumber
+	w.WriteUint16(18)           // Size
+	w.WriteUint16(DFS_SERVER_TYPE_ROOT)
+	w.WriteUint16(DFS_REFERRAL_ENTRY_NAME_LIST)
+	w.WriteUint32(60)
+	w.WriteZeros(6)
+	w.WriteUTF16String(`\srv\root\docs`)
+	w.WriteUint16(0)
+	w.WriteUTF16String(`\fs3\share`)
+	w.WriteUint16(0)
+	got, err = parseDFSReferralResponse(w.Bytes())
+	if err != nil {
+		t.Fatalf("parseDFSReferralResponse() of version 2 error = %v", err)
+	}
+	want := dfsReferralEntry{TTL: 120, DFSPath: `\srv\root\docs`, AlternatePath: `\srv\root\docs`, Target: `\fs3\share`}
+	if len(got.Entries) != 1 || got.Entries[0] != want || got.PathConsumed != 14 {
+		t.Errorf("version 2 response = %+v, want one entry %+v", got, want)
+	}
+
+	for _, corrupt := range [][]byte{nil, w.Bytes()[:20], append([]byte{8, 0, 1, 0, 0, 0, 0, 0, 9, 0, 8, 0}, make([]byte, 8)...)} {
+		if _, err := parseDFSReferralResponse(corrupt); err == nil {
+			t.Errorf("parseDFSReferralResponse(% x) succeeded", corrupt)
+		}
+	}
+}
+
+// setupDFSTree adds a DFS root share with a link to another share and
+// returns a tree connection to it
+func setupDFSTree(t *testing.T) (*Server, *Session, *TreeConnection) {
+	t.Helper()
+	srv, session, _ := setupTestTree(t)
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+	err = srv.AddShare(mfs, ShareOptions{ShareName: "root", DFSLinks: map[string]string{
+		"docs":          `\\fs1\data\documents`,
+		"projects/2024": `\\fs2\archive`,
+	}})
+	if err != nil {
+		t.Fatalf("AddShare() error = %v", err)
+	}
+	return srv, session, session.AddTreeConnection("root", srv.GetShare("root"), false)
+}
+
+// TestHandleCreate_DFSLink tests that opens under a DFS link are refused
+// with STATUS_PATH_NOT_COVERED
+func TestHandleCreate_DFSLink(t *testing.T) {
+	srv, session, tree := setupDFSTree(t)
+
+	tests := []struct {
+		name string
+		dfs  bool // Full DFS path with SMB2_FLAGS_DFS_OPERATIONS
+		want NTStatus
+	}{
+		{"docs", false, STATUS_PATH_NOT_COVERED},
+		{`DOCS\readme.txt`, false, STATUS_PATH_NOT_COVERED},
+		{`projects\2024\plan.txt`, false, STATUS_PATH_NOT_COVERED},
+		{`projects`, false, STATUS_SUCCESS},
+		{`docsets`, false, STATUS_SUCCESS},
+		{`server\root\docs\readme.txt`, true, STATUS_PATH_NOT_COVERED},
+		{`server\root\local.txt`, true, STATUS_SUCCESS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := testRequest(session, tree, SMB2_CREATE, buildCreateRequest(tt.name, FILE_OPEN_IF, 0, nil))
+			if tt.dfs {
+				msg.Header.Flags |= SMB2_FLAGS_DFS_OPERATIONS
+			}
+			_, status := srv.handler.handleCreate(nil, msg, nil)
+			if status != tt.want {
+				t.Errorf("CREATE status = %v, want %v", status, tt.want)
+			}
+		})
+	}
+}
+
+// TestHandleIOCTL_DFSReferral tests referrals for a DFS root and its links
+func TestHandleIOCTL_DFSReferral(t *testing.T) {
+	srv, session, tree := setupDFSTree(t)
+	noFile := FileID{Persistent: 0xFFFFFFFFFFFFFFFF, Volatile: 0xFFFFFFFFFFFFFFFF}
+
+	tests := []struct {
+		path       string
+		want       NTStatus
+		serverType uint16
+		dfsPath    string
+		target     string
+	}{
+		{`\srv\root`, STATUS_SUCCESS, DFS_SERVER_TYPE_ROOT, `\srv\root`, `\srv\root`},
+		{`\srv\root\docs\sub\a.txt`, STATUS_SUCCESS, DFS_SERVER_TYPE_LINK, `\srv\root\docs`, `\fs1\data\documents`},
+		{`\srv\root\Projects\2024`, STATUS_SUCCESS, DFS_SERVER_TYPE_LINK, `\srv\root\Projects\2024`, `\fs2\archive`},
+		{`\srv\root\local.txt`, STATUS_NOT_FOUND, 0, "", ""},
+		{`\srv\test\docs`, STATUS_NOT_FOUND, 0, "", ""},
+		{`\srv`, STATUS_NOT_FOUND, 0, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, status := srv.handler.handleIOCTL(nil, testRequest(session, tree, SMB2_IOCTL,
+				buildIOCTLRequest(FSCTL_DFS_GET_REFERRALS, noFile, buildDFSReferralRequest(tt.path, 4), 4096)))
+			if status != tt.want {
+				t.Fatalf("IOCTL status = %v, want %v", status, tt.want)
+			}
+			if status != STATUS_SUCCESS {
+				return
+			}
+			ref, err := parseDFSReferralResponse(ioctlOutput(t, resp))
+			if err != nil {
+				t.Fatalf("parseDFSReferralResponse() error = %v", err)
+			}
+			if len(ref.Entries) != 1 {
+				t.Fatalf("got %d entries, want 1", len(ref.Entries))
+			}
+			e := ref.Entries[0]
+			if e.ServerType != tt.serverType || e.DFSPath != tt.dfsPath || e.Target != tt.target {
+				t.Errorf("entry = %+v, want type %d, %s -> %s", e, tt.serverType, tt.dfsPath, tt.target)
+			}
+			if ref.PathConsumed != len(tt.dfsPath) || e.TTL != defaultDFSReferralTTL {
+				t.Errorf("PathConsumed = %d, TTL = %d", ref.PathConsumed, e.TTL)
+			}
+		})
+	}
+}
+
+// TestAddShare_DFSLinks tests validation of DFS link targets
+func TestAddShare_DFSLinks(t *testing.T) {
+	srv := setupTestServer(t)
+	for _, links := range []map[string]string{
+		{"docs": `\\server`},
+		{"docs": ""},
+		{"/": `\\server\share`},
+	} {
+		mfs, _ := memfs.NewFS()
+		if err := srv.AddShare(mfs, ShareOptions{ShareName: "bad", DFSLinks: links}); err == nil {
+			t.Errorf("AddShare() with DFS links %v succeeded", links)
+		}
+	}
+}
@@ -3,9 +3,11 @@ package smbfs
 import (
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
-	"sync"
+	"time"
 )
 
 // SMB2 QUERY_DIRECTORY flags
@@ -17,11 +19,14 @@ const (
 )
 
 // Directory enumeration state stored per file handle
+// The directory is read afresh for each request and enumeration resumes
+// after the name last returned, in name order, so entries created or
+// removed between requests neither repeat nor displace others
 type dirEnumState struct {
-	entries   []os.FileInfo // Cached directory entries
-	position  int           // Current position in entries
-	pattern   string        // Search pattern
-	exhausted bool          // True when no more entries
+	pattern   string   // Search pattern
+	after     string   // Name to resume after, "" to start from the first
+	returned  []string // Names returned so far, indexed by their FileIndex
+	exhausted bool     // True when no more entries
 }
 
 // handleQueryDirectory implements SMB2 QUERY_DIRECTORY command
@@ -77,56 +82,75 @@ func (h *SMBHandler) handleQueryDirectory(state *connState, msg *SMB2Message) ([
 	h.server.logger.Debug("QUERY_DIRECTORY: path=%s, pattern=%s, class=%d, flags=0x%02x",
 		of.Path, pattern, infoClass, flags)
 
-	// Get or create directory enumeration state
-	dirState := h.getDirState(of)
-	if dirState == nil {
-		dirState = &dirEnumState{pattern: pattern}
+	// Get or create directory enumeration state. Requests on the same
+	// handle take turns with it
+	of.dirMu.Lock()
+	defer of.dirMu.Unlock()
+	dirState := of.dirState
+
+	// With SMB2_INDEX_SPECIFIED, a name without wildcards is the entry to
+	// resume after rather than a new pattern
+	var resumeName string
+	if flags&SMB2_INDEX_SPECIFIED != 0 && fileNameLength > 0 && !hasWildcards(pattern) {
+		resumeName = pattern
+		pattern = "*"
+		if dirState != nil {
+			pattern = dirState.pattern
+		}
 	}
 
-	// Handle restart flag
-	if flags&SMB2_RESTART_SCANS != 0 {
-		dirState.position = 0
-		dirState.exhausted = false
-		dirState.pattern = pattern
-		dirState.entries = nil
+	if dirState == nil {
+		dirState = &dirEnumState{pattern: pattern}
+		of.dirState = dirState
 	}
 
-	// Handle pattern change
-	if dirState.pattern != pattern {
-		dirState.pattern = pattern
-		dirState.position = 0
-		dirState.exhausted = false
-		dirState.entries = nil
+	// Handle restart flag and pattern change
+	if flags&SMB2_RESTART_SCANS != 0 || dirState.pattern != pattern {
+		*dirState = dirEnumState{pattern: pattern}
 	}
 
-	// Handle index specified
+	// Handle index specified: resume at the entry given that FileIndex, or
+	// after the named entry
 	if flags&SMB2_INDEX_SPECIFIED != 0 {
-		dirState.position = int(fileIndex)
+		switch {
+		case resumeName != "":
+			dirState.after = resumeName
+		case int(fileIndex) <= len(dirState.returned):
+			dirState.returned = dirState.returned[:fileIndex]
+			dirState.after = ""
+			if fileIndex > 0 {
+				dirState.after = dirState.returned[fileIndex-1]
+			}
+		default:
+			return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+		}
 		dirState.exhausted = false
 	}
 
 	// If directory is exhausted, return NO_MORE_FILES
 	if dirState.exhausted {
-		h.storeDirState(of, dirState)
 		return h.buildErrorResponse(), STATUS_NO_MORE_FILES
 	}
 
-	// Read directory entries if not cached
-	if dirState.entries == nil {
-		entries, err := h.readDirEntries(of, tree)
-		if err != nil {
-			h.server.logger.Error("Failed to read directory %s: %v", of.Path, err)
-			return h.buildErrorResponse(), STATUS_ACCESS_DENIED
-		}
-		dirState.entries = entries
-		dirState.position = 0
+	// Read the directory and skip to the entries after the resume point
+	entries, err := h.readDirEntries(of, tree)
+	if err != nil {
+		h.server.logger.Error("Failed to read directory %s: %v", of.Path, err)
+		return h.buildErrorResponse(), STATUS_ACCESS_DENIED
+	}
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
 	}
+	entryShortNames := shortNames(names)
+	entries = tree.Share.visibleEntries(session, of.Path, entries)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	start := sort.Search(len(entries), func(i int) bool { return entries[i].Name() > dirState.after })
 
 	// Filter entries by pattern
-	matchedEntries := h.filterEntries(dirState.entries[dirState.position:], dirState.pattern)
+	matchedEntries := h.filterEntries(entries[start:], dirState.pattern)
 	if len(matchedEntries) == 0 {
 		dirState.exhausted = true
-		h.storeDirState(of, dirState)
 		return h.buildErrorResponse(), STATUS_NO_MORE_FILES
 	}
 
@@ -138,10 +162,13 @@ func (h *SMBHandler) handleQueryDirectory(state *connState, msg *SMB2Message) ([
 
 	for _, entry := range matchedEntries {
 		// Format entry based on information class
-		entryData := h.formatDirEntry(entry, infoClass, uint32(dirState.position+entryCount))
+		entryPath := path.Join(of.Path, entry.Name())
+		created := tree.Share.CreationTime(entryPath, entry)
+		entryData := h.formatDirEntry(entry, created, tree.Share.fileAttributes(entryPath, entry),
+			tree.Share.allocationSize(entryPath, entry), infoClass, uint32(len(dirState.returned)),
+			tree.Share.fileID(entryPath), entryShortNames[entry.Name()])
 		if entryData == nil {
 			// Unsupported info class
-			h.storeDirState(of, dirState)
 			return h.buildErrorResponse(), STATUS_NOT_SUPPORTED
 		}
 
@@ -153,7 +180,6 @@ func (h *SMBHandler) handleQueryDirectory(state *connState, msg *SMB2Message) ([
 			// Buffer would overflow
 			if entryCount == 0 {
 				// Can't fit even one entry
-				h.storeDirState(of, dirState)
 				return h.buildErrorResponse(), STATUS_BUFFER_OVERFLOW
 			}
 			// Return what we have so far
@@ -173,7 +199,8 @@ func (h *SMBHandler) handleQueryDirectory(state *connState, msg *SMB2Message) ([
 
 		w.WriteBytes(entryData)
 		entryCount++
-		dirState.position++
+		dirState.returned = append(dirState.returned, entry.Name())
+		dirState.after = entry.Name()
 
 		// Align to 8-byte boundary for next entry
 		w.WritePadTo8()
@@ -187,13 +214,10 @@ func (h *SMBHandler) handleQueryDirectory(state *connState, msg *SMB2Message) ([
 	// No need to patch - formatDirEntry sets it to 0
 
 	// Check if directory is exhausted
-	if dirState.position >= len(dirState.entries) {
+	if entryCount == len(matchedEntries) {
 		dirState.exhausted = true
 	}
 
-	// Store updated state
-	h.storeDirState(of, dirState)
-
 	// Build response
 	resp := NewByteWriter(9 + w.Len())
 	resp.WriteUint16(9)                  // StructureSize
@@ -207,8 +231,16 @@ func (h *SMBHandler) handleQueryDirectory(state *connState, msg *SMB2Message) ([
 
 // readDirEntries reads all entries from a directory
 func (h *SMBHandler) readDirEntries(of *OpenFile, tree *TreeConnection) ([]os.FileInfo, error) {
+	// Read through a fresh open of the directory, as reads of the handle
+	// itself go on from where the previous one ended
+	dir := of.File
+	if f, err := tree.Share.FileSystem().Open(of.Path); err == nil {
+		defer f.Close()
+		dir = f
+	}
+
 	// Read all directory entries
-	dirEntries, err := of.File.ReadDir(-1)
+	dirEntries, err := dir.ReadDir(-1)
 	if err != nil && err != io.EOF {
 		return nil, err
 	}
@@ -244,24 +276,27 @@ func (h *SMBHandler) filterEntries(entries []os.FileInfo, pattern string) []os.F
 }
 
 // formatDirEntry formats a directory entry according to the information class
-func (h *SMBHandler) formatDirEntry(info os.FileInfo, infoClass uint8, fileIndex uint32) []byte {
+func (h *SMBHandler) formatDirEntry(info os.FileInfo, created time.Time, attrs uint32, allocSize uint64, infoClass uint8, fileIndex uint32, fileID uint64, shortName string) []byte {
 	name := info.Name()
 	nameUTF16 := EncodeStringToUTF16LE(name)
 	nameLen := len(nameUTF16)
 
-	// Get file attributes
-	attrs := modeToAttributes(info.Mode())
+	// ShortName is a fixed 24-byte field
+	shortUTF16 := make([]byte, 24)
+	shortLen := copy(shortUTF16, EncodeStringToUTF16LE(shortName))
+
+	// Reparse points report their tag in place of EaSize
+	eaSize := reparseTag(attrs)
 
 	// Get timestamps
 	modTime := info.ModTime()
-	createTime := TimeToFiletime(modTime)
+	createTime := TimeToFiletime(created)
 	lastAccess := TimeToFiletime(modTime)
 	lastWrite := TimeToFiletime(modTime)
 	changeTime := TimeToFiletime(modTime)
 
 	// Get file size
 	fileSize := uint64(info.Size())
-	allocSize := (fileSize + 4095) &^ 4095 // Round up to 4KB boundary
 
 	// If directory, size is 0
 	if info.IsDir() {
@@ -299,10 +334,29 @@ func (h *SMBHandler) formatDirEntry(info os.FileInfo, infoClass uint8, fileIndex
 		w.WriteUint64(allocSize)       // AllocationSize
 		w.WriteUint32(attrs)           // FileAttributes
 		w.WriteUint32(uint32(nameLen)) // FileNameLength
-		w.WriteUint32(0)               // EaSize (Extended Attributes)
+		w.WriteUint32(eaSize)          // EaSize
 		w.WriteBytes(nameUTF16)        // FileName
 		return w.Bytes()
 
+	case FileIdFullDirectoryInformation:
+		// FileIdFullDirectoryInformation: adds FileId, without ShortName
+		w := NewByteWriter(80 + nameLen)
+		w.WriteUint32(0)                 // NextEntryOffset (backpatched later)
+		w.WriteUint32(fileIndex)         // FileIndex
+		w.WriteUint64(createTime)        // CreationTime
+		w.WriteUint64(lastAccess)        // LastAccessTime
+		w.WriteUint64(lastWrite)         // LastWriteTime
+		w.WriteUint64(changeTime)        // ChangeTime
+		w.WriteUint64(fileSize)          // EndOfFile
+		w.WriteUint64(allocSize)         // AllocationSize
+		w.WriteUint32(attrs)             // FileAttributes
+		w.WriteUint32(uint32(nameLen))   // FileNameLength
+		w.WriteUint32(eaSize)            // EaSize
+		w.WriteUint32(0)                 // Reserved
+		w.WriteUint64(fileID)            // FileId
+		w.WriteBytes(nameUTF16)          // FileName
+		return w.Bytes()
+
 	case FileBothDirectoryInformation:
 		// FileBothDirectoryInformation: adds ShortName
 		w := NewByteWriter(94 + nameLen)
@@ -316,10 +370,10 @@ func (h *SMBHandler) formatDirEntry(info os.FileInfo, infoClass uint8, fileIndex
 		w.WriteUint64(allocSize)       // AllocationSize
 		w.WriteUint32(attrs)           // FileAttributes
 		w.WriteUint32(uint32(nameLen)) // FileNameLength
-		w.WriteUint32(0)               // EaSize
-		w.WriteOneByte(0)                 // ShortNameLength (8.3 name)
-		w.WriteOneByte(0)                 // Reserved
-		w.WriteZeros(24)               // ShortName (12 UTF-16 chars)
+		w.WriteUint32(eaSize)          // EaSize
+		w.WriteOneByte(uint8(shortLen)) // ShortNameLength (8.3 name)
+		w.WriteOneByte(0)               // Reserved
+		w.WriteBytes(shortUTF16)        // ShortName (12 UTF-16 chars)
 		w.WriteBytes(nameUTF16)        // FileName
 		return w.Bytes()
 
@@ -345,12 +399,12 @@ func (h *SMBHandler) formatDirEntry(info os.FileInfo, infoClass uint8, fileIndex
 		w.WriteUint64(allocSize)         // AllocationSize
 		w.WriteUint32(attrs)             // FileAttributes
 		w.WriteUint32(uint32(nameLen))   // FileNameLength
-		w.WriteUint32(0)                 // EaSize
-		w.WriteOneByte(0)                   // ShortNameLength
-		w.WriteOneByte(0)                   // Reserved1
-		w.WriteZeros(24)                 // ShortName (12 UTF-16 chars)
+		w.WriteUint32(eaSize)            // EaSize
+		w.WriteOneByte(uint8(shortLen)) // ShortNameLength
+		w.WriteOneByte(0)               // Reserved1
+		w.WriteBytes(shortUTF16)        // ShortName (12 UTF-16 chars)
 		w.WriteUint16(0)                 // Reserved2
-		w.WriteUint64(uint64(fileIndex)) // FileId
+		w.WriteUint64(fileID)            // FileId
 		w.WriteBytes(nameUTF16)          // FileName
 		return w.Bytes()
 
@@ -360,6 +414,12 @@ func (h *SMBHandler) formatDirEntry(info os.FileInfo, infoClass uint8, fileIndex
 	}
 }
 
+// hasWildcards reports whether a QUERY_DIRECTORY file name is a pattern
+// rather than a plain name, including the DOS wildcards of MS-FSA 2.1.4.4
+func hasWildcards(name string) bool {
+	return strings.ContainsAny(name, `*?<>"`)
+}
+
 // matchPattern performs simple glob matching (*, ? wildcards)
 func matchPattern(name, pattern string) bool {
 	// Case-insensitive matching (Windows convention)
@@ -374,23 +434,9 @@ func matchPattern(name, pattern string) bool {
 	return matched
 }
 
-// Directory state management (stored per file handle)
-// In a real implementation, this would be a map[FileID]*dirEnumState
-// For now, we use a simple in-memory map
-
-var (
-	dirStates   = make(map[FileID]*dirEnumState)
-	dirStatesMu sync.Mutex
-)
-
-func (h *SMBHandler) getDirState(of *OpenFile) *dirEnumState {
-	dirStatesMu.Lock()
-	defer dirStatesMu.Unlock()
-	return dirStates[of.ID]
-}
-
-func (h *SMBHandler) storeDirState(of *OpenFile, state *dirEnumState) {
-	dirStatesMu.Lock()
-	defer dirStatesMu.Unlock()
-	dirStates[of.ID] = state
+// clearDirState discards any directory enumeration state held for of
+func (h *SMBHandler) clearDirState(of *OpenFile) {
+	of.dirMu.Lock()
+	defer of.dirMu.Unlock()
+	of.dirState = nil
 }
@@ -0,0 +1,224 @@
+package smbfs
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// buildQueryDirectoryRequestAt builds a QUERY_DIRECTORY request payload
+// with a FileIndex and an output buffer of the given size
+func buildQueryDirectoryRequestAt(fileID FileID, flags uint8, fileIndex uint32, name string, outputLength uint32) []byte {
+	payload := buildQueryDirectoryRequest(fileID, FileNamesInformation, flags, name)
+	le.PutUint32(payload[4:], fileIndex)     // FileIndex
+	le.PutUint32(payload[28:], outputLength) // OutputBufferLength
+	return payload
+}
+
+// dirNames returns the FileIndex and name of each FileNamesInformation
+// entry of a QUERY_DIRECTORY response
+func dirNames(t *testing.T, resp []byte) ([]uint32, []string) {
+	t.Helper()
+	buf := resp[8:]
+	var indexes []uint32
+	var names []string
+	for {
+		nameLen := int(le.Uint32(buf[8:]))
+		indexes = append(indexes, le.Uint32(buf[4:]))
+		names = append(names, DecodeUTF16LEToString(buf[12:12+nameLen]))
+		next := le.Uint32(buf)
+		if next == 0 {
+			return indexes, names
+		}
+		buf = buf[next:]
+	}
+}
+
+// TestQueryDirectory_ResumeAfterChanges tests that an enumeration spread
+// over small buffers resumes after the last name it returned, so files
+// created and removed along the way neither repeat nor hide others
+func TestQueryDirectory_ResumeAfterChanges(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	share := tree.Share
+	share.fs.Mkdir("/dir", 0755)
+	for i := 0; i < 20; i++ {
+		f, _ := share.fs.Create(fmt.Sprintf("/dir/f%02d", i))
+		f.Close()
+	}
+	dir, err := share.fs.Open("/dir")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	of := share.fileHandles.Allocate(dir, "/dir", true, GENERIC_READ, FILE_SHARE_READ, FILE_OPEN, FILE_DIRECTORY_FILE, tree.ID, session.ID)
+	defer share.fileHandles.Release(of.ID)
+
+	query := func(flags uint8, fileIndex uint32, name string) ([]byte, NTStatus) {
+		return srv.handler.handleQueryDirectory(nil, testRequest(session, tree, SMB2_QUERY_DIRECTORY,
+			buildQueryDirectoryRequestAt(of.ID, flags, fileIndex, name, 72))) // Three entries
+	}
+
+	var got []string
+	for round := 0; ; round++ {
+		resp, status := query(0, 0, "*")
+		if status == STATUS_NO_MORE_FILES {
+			break
+		}
+		if status != STATUS_SUCCESS {
+			t.Fatalf("QUERY_DIRECTORY status = %v, want STATUS_SUCCESS", status)
+		}
+		indexes, names := dirNames(t, resp)
+		if len(names) != 3 && len(got)+len(names) != 20 {
+			t.Errorf("round %d returned %d entries, want 3", round, len(names))
+		}
+		for i, index := range indexes {
+			if int(index) != len(got)+i {
+				t.Errorf("FileIndex of %s = %d, want %d", names[i], index, len(got)+i)
+			}
+		}
+		got = append(got, names...)
+
+		if round == 1 {
+			// Past f05: one file ahead, one behind and one removed ahead
+			for _, name := range []string{"/dir/f10a", "/dir/a00"} {
+				f, _ := share.fs.Create(name)
+				f.Close()
+			}
+			share.fs.Remove("/dir/f15")
+		}
+	}
+
+	var want []string
+	for i := 0; i < 20; i++ {
+		if i != 15 {
+			want = append(want, fmt.Sprintf("f%02d", i))
+		}
+		if i == 10 {
+			want = append(want, "f10a")
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("enumerated %v, want %v", got, want)
+	}
+
+	// SMB2_INDEX_SPECIFIED resumes at a FileIndex, or after a name
+	resp, status := query(SMB2_INDEX_SPECIFIED, 4, "*")
+	if status != STATUS_SUCCESS {
+		t.Fatalf("QUERY_DIRECTORY at FileIndex 4 status = %v", status)
+	}
+	if indexes, names := dirNames(t, resp); names[0] != "f04" || indexes[0] != 4 {
+		t.Errorf("QUERY_DIRECTORY at FileIndex 4 started with %s (%d), want f04 (4)", names[0], indexes[0])
+	}
+
+	resp, status = query(SMB2_INDEX_SPECIFIED, 0, "f17")
+	if status != STATUS_SUCCESS {
+		t.Fatalf("QUERY_DIRECTORY after f17 status = %v", status)
+	}
+	if _, names := dirNames(t, resp); !slices.Equal(names, []string{"f18", "f19"}) {
+		t.Errorf("QUERY_DIRECTORY after f17 = %v, want [f18 f19]", names)
+	}
+
+	if _, status := query(SMB2_INDEX_SPECIFIED, 1000, "*"); status != STATUS_INVALID_PARAMETER {
+		t.Errorf("QUERY_DIRECTORY at an unknown FileIndex status = %v, want STATUS_INVALID_PARAMETER", status)
+	}
+
+	// A restart sees the whole directory again
+	resp, status = query(SMB2_RESTART_SCANS, 0, "*")
+	if status != STATUS_SUCCESS {
+		t.Fatalf("restarted QUERY_DIRECTORY status = %v", status)
+	}
+	if _, names := dirNames(t, resp); names[0] != "a00" {
+		t.Errorf("restarted QUERY_DIRECTORY started with %s, want a00", names[0])
+	}
+}
+
+// openTestDir opens a handle on a directory of the tree's share
+func openTestDir(t testing.TB, session *Session, tree *TreeConnection, name string) *OpenFile {
+	t.Helper()
+	share := tree.Share
+	dir, err := share.fs.Open(name)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	of := share.fileHandles.Allocate(dir, name, true, GENERIC_READ, FILE_SHARE_READ, FILE_OPEN, FILE_DIRECTORY_FILE, tree.ID, session.ID)
+	t.Cleanup(func() { share.fileHandles.Release(of.ID) })
+	return of
+}
+
+// TestQueryDirectory_ConcurrentHandles tests that enumerations on two
+// handles of one directory, interleaved on different goroutines, each
+// return every name once and in order
+func TestQueryDirectory_ConcurrentHandles(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	share := tree.Share
+	share.fs.Mkdir("/dir", 0755)
+	var want []string
+	for i := 0; i < 30; i++ {
+		name := fmt.Sprintf("f%02d", i)
+		f, _ := share.fs.Create("/dir/" + name)
+		f.Close()
+		want = append(want, name)
+	}
+
+	enumerate := func(of *OpenFile) ([]string, error) {
+		var got []string
+		for {
+			resp, status := srv.handler.handleQueryDirectory(nil, testRequest(session, tree, SMB2_QUERY_DIRECTORY,
+				buildQueryDirectoryRequestAt(of.ID, 0, 0, "*", 48))) // Two entries
+			if status == STATUS_NO_MORE_FILES {
+				return got, nil
+			}
+			if status != STATUS_SUCCESS {
+				return got, fmt.Errorf("QUERY_DIRECTORY status = %v", status)
+			}
+			_, names := dirNames(t, resp)
+			got = append(got, names...)
+		}
+	}
+
+	handles := []*OpenFile{openTestDir(t, session, tree, "/dir"), openTestDir(t, session, tree, "/dir")}
+	results := make([][]string, len(handles))
+	errs := make([]error, len(handles))
+	var wg sync.WaitGroup
+	for i, of := range handles {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = enumerate(of)
+		}()
+	}
+	wg.Wait()
+
+	for i := range handles {
+		if errs[i] != nil {
+			t.Errorf("handle %d: %v", i, errs[i])
+		}
+		if !slices.Equal(results[i], want) {
+			t.Errorf("handle %d enumerated %v, want %v", i, results[i], want)
+		}
+	}
+}
+
+// BenchmarkQueryDirectory_Parallel measures QUERY_DIRECTORY on one share
+// from many goroutines, each enumerating through its own handle
+func BenchmarkQueryDirectory_Parallel(b *testing.B) {
+	srv, session, tree := setupTestTree(b)
+	share := tree.Share
+	share.fs.Mkdir("/dir", 0755)
+	for i := 0; i < 50; i++ {
+		f, _ := share.fs.Create(fmt.Sprintf("/dir/f%02d", i))
+		f.Close()
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		of := openTestDir(b, session, tree, "/dir")
+		req := buildQueryDirectoryRequestAt(of.ID, SMB2_RESTART_SCANS, 0, "*", 64*1024)
+		for pb.Next() {
+			if _, status := srv.handler.handleQueryDirectory(nil, testRequest(session, tree, SMB2_QUERY_DIRECTORY, req)); status != STATUS_SUCCESS {
+				b.Errorf("QUERY_DIRECTORY status = %v", status)
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,255 @@
+package smbfs
+
+import (
+	"strings"
+	"time"
+)
+
+// SMB2_DHANDLE_FLAG_PERSISTENT requests a persistent handle in DH2Q
+// (MS-SMB2 2.2.13.2.11). Persistent handles are never granted; requests for
+// one get a durable handle instead
+const SMB2_DHANDLE_FLAG_PERSISTENT uint32 = 0x00000002
+
+// defaultDurableHandleTimeout is used when ServerOptions.DurableHandleTimeout is zero
+const defaultDurableHandleTimeout = time.Minute
+
+// durableRequest is a parsed DHnQ or DH2Q create context
+type durableRequest struct {
+	v2         bool
+	timeout    time.Duration // Requested timeout (DH2Q only; zero means the server's)
+	createGUID [16]byte      // DH2Q CreateGuid
+}
+
+// durableReconnect is a parsed DHnC or DH2C create context, together with
+// the identity of the client asking to reclaim the handle
+type durableReconnect struct {
+	fileID     FileID
+	v2         bool
+	createGUID [16]byte // DH2C CreateGuid
+	clientGUID [16]byte // ClientGuid of the reconnecting connection
+	owner      string   // domain\user of the reconnecting session
+	path       string   // Name in the CREATE request
+}
+
+// parseDurableRequest returns the durable handle request of a CREATE, if any
+func parseDurableRequest(contexts []CreateContext) (*durableRequest, NTStatus) {
+	v1, hasV1 := findCreateContext(contexts, SMB2_CREATE_DURABLE_HANDLE_REQUEST)
+	v2, hasV2 := findCreateContext(contexts, SMB2_CREATE_DURABLE_HANDLE_REQUEST_V2)
+
+	switch {
+	case hasV1 && hasV2:
+		return nil, STATUS_INVALID_PARAMETER
+	case hasV1:
+		if len(v1) < 16 {
+			return nil, STATUS_INVALID_PARAMETER
+		}
+		return &durableRequest{}, STATUS_SUCCESS
+	case hasV2:
+		if len(v2) < 32 {
+			return nil, STATUS_INVALID_PARAMETER
+		}
+		r := NewByteReader(v2)
+		req := &durableRequest{v2: true}
+		req.timeout = time.Duration(r.ReadUint32()) * time.Millisecond // Timeout
+		_ = r.ReadUint32()                                             // Flags
+		_ = r.ReadUint64()                                             // Reserved
+		req.createGUID = r.ReadGUID()                                  // CreateGuid
+		return req, STATUS_SUCCESS
+	}
+	return nil, STATUS_SUCCESS
+}
+
+// parseDurableReconnect returns the durable handle reconnect of a CREATE, if any
+func parseDurableReconnect(contexts []CreateContext) (*durableReconnect, NTStatus) {
+	if data, ok := findCreateContext(contexts, SMB2_CREATE_DURABLE_HANDLE_RECONNECT_V2); ok {
+		if len(data) < 36 {
+			return nil, STATUS_INVALID_PARAMETER
+		}
+		r := NewByteReader(data)
+		req := &durableReconnect{v2: true}
+		req.fileID = r.ReadFileID()   // FileId
+		req.createGUID = r.ReadGUID() // CreateGuid
+		return req, STATUS_SUCCESS
+	}
+	if data, ok := findCreateContext(contexts, SMB2_CREATE_DURABLE_HANDLE_RECONNECT); ok {
+		if len(data) < 16 {
+			return nil, STATUS_INVALID_PARAMETER
+		}
+		return &durableReconnect{fileID: NewByteReader(data).ReadFileID()}, STATUS_SUCCESS
+	}
+	return nil, STATUS_SUCCESS
+}
+
+// durableOwner identifies the user allowed to reconnect a session's durable handles
+func durableOwner(session *Session) string {
+	return session.Domain + `\` + session.Username
+}
+
+// grantDurableHandle makes of durable if the server allows it, returning the
+// create context for the response. Guest sessions never get durable handles,
+// since anyone could reconnect them
+func (h *SMBHandler) grantDurableHandle(state *connState, session *Session, share *Share, of *OpenFile, req *durableRequest) (CreateContext, bool) {
+	maxTimeout := h.server.options.DurableHandleTimeout
+	if maxTimeout <= 0 || session.IsGuest {
+		return CreateContext{}, false
+	}
+
+	timeout := maxTimeout
+	if req.v2 && req.timeout > 0 && req.timeout < maxTimeout {
+		timeout = req.timeout
+	}
+	share.fileHandles.makeDurable(of, timeout, durableOwner(session), req.createGUID, state.clientGUID, req.v2)
+
+	h.server.logger.Debug("CREATE: durable handle for %s (timeout=%v)", of.Path, timeout)
+
+	if !req.v2 {
+		return CreateContext{Name: SMB2_CREATE_DURABLE_HANDLE_REQUEST, Data: make([]byte, 8)}, true
+	}
+	w := NewByteWriter(8)
+	w.WriteUint32(uint32(timeout / time.Millisecond)) // Timeout
+	w.WriteUint32(0)                                  // Flags
+	return CreateContext{Name: SMB2_CREATE_DURABLE_HANDLE_REQUEST_V2, Data: w.Bytes()}, true
+}
+
+// cachesHandle reports whether of holds a batch oplock or a lease with
+// handle caching, which an open must have to be made durable (MS-SMB2
+// 3.3.5.9.6, 3.3.5.9.10)
+func cachesHandle(share *Share, of *OpenFile) bool {
+	if of.Lease != nil {
+		return of.Lease.State&SMB2_LEASE_HANDLE_CACHING != 0
+	}
+	return share.fileHandles.oplockLevel(of) == SMB2_OPLOCK_LEVEL_BATCH
+}
+
+// reconnectDurableHandle handles a CREATE carrying DHnC or DH2C, binding a
+// disconnected durable handle to the caller's tree. The handle keeps its
+// FileID, file position, locks and delete-on-close state
+func (h *SMBHandler) reconnectDurableHandle(state *connState, session *Session, tree *TreeConnection, req *durableReconnect, oplockLevel uint8, leaseReq *leaseRequest) ([]byte, NTStatus) {
+	req.clientGUID = state.clientGUID
+	req.owner = durableOwner(session)
+
+	of, status := tree.Share.fileHandles.Reconnect(req, tree.ID, session.ID, time.Now())
+	if status != STATUS_SUCCESS {
+		h.server.logger.Debug("CREATE: durable reconnect of %s (FileID=%d/%d) failed: %v",
+			req.path, req.fileID.Persistent, req.fileID.Volatile, status)
+		return h.buildErrorResponse(), status
+	}
+
+	info, err := of.File.Stat()
+	if err != nil {
+		return h.buildErrorResponse(), mapGoErrorToNTStatus(err)
+	}
+
+	h.grantCaching(state, tree.Share, of, oplockLevel, leaseReq)
+
+	h.server.logger.Info("File reconnected: %s (FileID=%d/%d, Session=%d)",
+		of.Path, of.ID.Persistent, of.ID.Volatile, session.ID)
+
+	var respContexts []CreateContext
+	if of.Lease != nil {
+		respContexts = append(respContexts, CreateContext{Name: SMB2_CREATE_REQUEST_LEASE, Data: buildLeaseResponseContext(of.Lease)})
+	}
+	return h.buildCreateResponse(tree.Share, of, info, FILE_OPENED, respContexts), STATUS_SUCCESS
+}
+
+// makeDurable marks a handle durable
+func (m *FileHandleMap) makeDurable(of *OpenFile, timeout time.Duration, owner string, createGUID, clientGUID [16]byte, v2 bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	of.Durable = true
+	of.DurableTimeout = timeout
+	of.durableOwner = owner
+	if v2 {
+		of.createGUID = createGUID
+		of.clientGUID = clientGUID
+	}
+}
+
+// DisconnectBySession detaches the durable handles of a session that is
+// going away so they outlive it; they belong to no tree or session until
+// reconnected or until their timeout passes. Returns the number detached
+func (m *FileHandleMap) DisconnectBySession(sessionID uint64, now time.Time) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for _, of := range m.handles {
+		if of.Durable && of.SessionID == sessionID && of.disconnectedAt.IsZero() {
+			of.TreeID = 0
+			of.SessionID = 0
+			of.disconnectedAt = now
+			// Oplocks and leases are scoped to the connection and go with it
+			of.Lease = nil
+			of.OplockLevel = SMB2_OPLOCK_LEVEL_NONE
+			of.oplockConn = nil
+			n++
+		}
+	}
+	return n
+}
+
+// Reconnect binds a disconnected durable handle to a new tree and session.
+// The handle must not have timed out, must have been opened by the same
+// user under the same name, and for v2 handles by the same client with the
+// same CreateGuid
+func (m *FileHandleMap) Reconnect(req *durableReconnect, treeID uint32, sessionID uint64, now time.Time) (*OpenFile, NTStatus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	of := m.handles[req.fileID]
+	if of == nil || !of.Durable || of.disconnectedAt.IsZero() ||
+		now.Sub(of.disconnectedAt) > of.DurableTimeout || of.Path != req.path {
+		return nil, STATUS_OBJECT_NAME_NOT_FOUND
+	}
+	if req.v2 && (of.createGUID != req.createGUID || of.clientGUID != req.clientGUID) ||
+		!req.v2 && of.createGUID != [16]byte{} {
+		return nil, STATUS_OBJECT_NAME_NOT_FOUND
+	}
+	if !strings.EqualFold(of.durableOwner, req.owner) {
+		return nil, STATUS_ACCESS_DENIED
+	}
+
+	of.TreeID = treeID
+	of.SessionID = sessionID
+	of.disconnectedAt = time.Time{}
+	of.LastAccess = now
+	return of, STATUS_SUCCESS
+}
+
+// expiredDurable returns the disconnected durable handles whose timeout has passed
+func (m *FileHandleMap) expiredDurable(now time.Time) []*OpenFile {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var expired []*OpenFile
+	for _, of := range m.handles {
+		if !of.disconnectedAt.IsZero() && now.Sub(of.disconnectedAt) > of.DurableTimeout {
+			expired = append(expired, of)
+		}
+	}
+	return expired
+}
+
+// disconnectDurableHandles detaches the durable handles of a session whose
+// connection was lost or which is being torn down
+func (s *Server) disconnectDurableHandles(sessionID uint64) {
+	now := time.Now()
+	for _, share := range s.shareList() {
+		if n := share.fileHandles.DisconnectBySession(sessionID, now); n > 0 {
+			s.logger.Debug("Kept %d durable handle(s) of session %d on %s for reconnect",
+				n, sessionID, share.Options().ShareName)
+		}
+	}
+}
+
+// closeExpiredDurableHandles closes durable handles that were not reconnected
+// in time, as if the client had closed them
+func (s *Server) closeExpiredDurableHandles(now time.Time) {
+	for _, share := range s.shareList() {
+		for _, of := range share.fileHandles.expiredDurable(now) {
+			s.logger.Debug("Durable handle expired: %s (FileID=%d/%d)", of.Path, of.ID.Persistent, of.ID.Volatile)
+			s.handler.closeOpenFile(share, of)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package smbfs
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+)
+
+// withCreateContexts appends create contexts to a CREATE request built
+// without any
+func withCreateContexts(req []byte, contexts ...CreateContext) []byte {
+	w := NewByteWriter(len(req) + 64)
+	w.WriteBytes(req)
+	w.WritePadTo8()
+	w.SetUint32At(48, uint32(SMB2HeaderSize+w.Len())) // CreateContextsOffset
+	data := buildCreateContexts(contexts)
+	w.SetUint32At(52, uint32(len(data))) // CreateContextsLength
+	w.WriteBytes(data)
+	return w.Bytes()
+}
+
+// durableRequestV1 builds a DHnQ create context
+func durableRequestV1() CreateContext {
+	return CreateContext{Name: SMB2_CREATE_DURABLE_HANDLE_REQUEST, Data: make([]byte, 16)}
+}
+
+// durableRequestV2 builds a DH2Q create context
+func durableRequestV2(timeout time.Duration, createGUID [16]byte) CreateContext {
+	w := NewByteWriter(32)
+	w.WriteUint32(uint32(timeout / time.Millisecond)) // Timeout
+	w.WriteUint32(0)                                  // Flags
+	w.WriteUint64(0)                                  // Reserved
+	w.WriteBytes(createGUID[:])                       // CreateGuid
+	return CreateContext{Name: SMB2_CREATE_DURABLE_HANDLE_REQUEST_V2, Data: w.Bytes()}
+}
+
+// durableReconnectV1 builds a DHnC create context
+func durableReconnectV1(fileID FileID) CreateContext {
+	w := NewByteWriter(16)
+	w.WriteFileID(fileID)
+	return CreateContext{Name: SMB2_CREATE_DURABLE_HANDLE_RECONNECT, Data: w.Bytes()}
+}
+
+// durableReconnectV2 builds a DH2C create context
+func durableReconnectV2(fileID FileID, createGUID [16]byte) CreateContext {
+	w := NewByteWriter(36)
+	w.WriteFileID(fileID)       // FileId
+	w.WriteBytes(createGUID[:]) // CreateGuid
+	w.WriteUint32(0)            // Flags
+	return CreateContext{Name: SMB2_CREATE_DURABLE_HANDLE_RECONNECT_V2, Data: w.Bytes()}
+}
+
+// durableLeaseKey is the key of the lease durable opens are made with
+var durableLeaseKey = [16]byte{7}
+
+// durableLease is the lease state durable opens request; without handle
+// caching no durable handle is granted
+const durableLease = SMB2_LEASE_READ_CACHING | SMB2_LEASE_HANDLE_CACHING
+
+// durableCreateRequest builds a CREATE request for the directory name with
+// the durable context and a lease requesting leaseState
+func durableCreateRequest(name string, options, leaseState uint32, durable CreateContext) []byte {
+	lw := NewByteWriter(leaseContextV2Size)
+	lw.WriteBytes(durableLeaseKey[:])      // LeaseKey
+	lw.WriteUint32(leaseState)             // LeaseState
+	lw.WriteZeros(leaseContextV2Size - 20) // Flags, Duration, ParentLeaseKey, Epoch
+	lease := CreateContext{Name: SMB2_CREATE_REQUEST_LEASE, Data: lw.Bytes()}
+
+	req := withCreateContexts(buildCreateRequest(name, FILE_OPEN, FILE_DIRECTORY_FILE|options, nil), lease, durable)
+	req[3] = SMB2_OPLOCK_LEVEL_LEASE // RequestedOplockLevel
+	return req
+}
+
+// createResponseContexts returns the create contexts of a CREATE response
+func createResponseContexts(t *testing.T, resp []byte) []CreateContext {
+	t.Helper()
+	contexts, status := parseCreateContexts(resp, le.Uint32(resp[80:84]), le.Uint32(resp[84:88]))
+	if status != STATUS_SUCCESS {
+		t.Fatalf("parseCreateContexts() status = %v", status)
+	}
+	return contexts
+}
+
+// newTestSession creates an authenticated session for username with a tree
+// connected to the "test" share
+func newTestSession(t *testing.T, srv *Server, username string) (*Session, *TreeConnection) {
+	t.Helper()
+	session := srv.sessions.CreateSession(SMB3_1_1, [16]byte{}, "127.0.0.1")
+	session.SetValid(username, "", false, nil)
+	return session, session.AddTreeConnection("test", srv.GetShare("test"), false)
+}
+
+// TestDurableHandle_Reconnect tests that a durable handle outlives its
+// session and is reclaimed with its file position and delete-on-close state
+func TestDurableHandle_Reconnect(t *testing.T) {
+	createGUID := [16]byte{1, 2, 3, 4}
+	tests := []struct {
+		name      string
+		request   CreateContext
+		reconnect func(FileID) CreateContext
+		timeout   uint32 // Expected timeout in a DH2Q response
+	}{
+		{
+			name:      "v1",
+			request:   durableRequestV1(),
+			reconnect: durableReconnectV1,
+		},
+		{
+			name:      "v2",
+			request:   durableRequestV2(0, createGUID),
+			reconnect: func(id FileID) CreateContext { return durableReconnectV2(id, createGUID) },
+			timeout:   uint32(defaultDurableHandleTimeout / time.Millisecond),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, session, tree := setupTestTree(t)
+			tree.Share.fs.Mkdir("/durable", 0755)
+
+			state := &connState{clientGUID: [16]byte{9}}
+			resp, status := srv.handler.handleCreate(state, testRequest(session, tree, SMB2_CREATE,
+				durableCreateRequest("durable", FILE_DELETE_ON_CLOSE, durableLease, tt.request)), &SMB2Header{})
+			if status != STATUS_SUCCESS {
+				t.Fatalf("CREATE status = %v, want STATUS_SUCCESS", status)
+			}
+			contexts := createResponseContexts(t, resp)
+			data, ok := findCreateContext(contexts, tt.request.Name)
+			if !ok {
+				t.Fatalf("CREATE response has no %s context", tt.request.Name)
+			}
+			if tt.timeout != 0 && le.Uint32(data[0:4]) != tt.timeout {
+				t.Errorf("granted timeout = %d, want %d", le.Uint32(data[0:4]), tt.timeout)
+			}
+			fileID := UnmarshalFileID(resp[64:80])
+
+			// The client reconnects and replaces its lost session
+			session2, tree2 := newTestSession(t, srv, "testuser")
+			srv.handler.destroyPreviousSession(session.ID, session2)
+
+			resp, status = srv.handler.handleCreate(state, testRequest(session2, tree2, SMB2_CREATE,
+				withCreateContexts(buildCreateRequest("durable", FILE_OPEN, 0, nil), tt.reconnect(fileID))), &SMB2Header{})
+			if status != STATUS_SUCCESS {
+				t.Fatalf("reconnect CREATE status = %v, want STATUS_SUCCESS", status)
+			}
+			if got := UnmarshalFileID(resp[64:80]); got != fileID {
+				t.Errorf("reconnect FileID = %v, want %v", got, fileID)
+			}
+			if action := le.Uint32(resp[4:8]); action != FILE_OPENED {
+				t.Errorf("reconnect CreateAction = %d, want FILE_OPENED", action)
+			}
+
+			of := tree2.Share.fileHandles.GetByTree(fileID, tree2.ID, session2.ID)
+			if of == nil {
+				t.Fatal("reconnected handle not bound to the new tree")
+			}
+			if !of.DeleteOnClose {
+				t.Error("delete-on-close lost across reconnect")
+			}
+
+			if _, status := srv.handler.handleClose(state, testRequest(session2, tree2, SMB2_CLOSE, buildCloseRequest(fileID))); status != STATUS_SUCCESS {
+				t.Fatalf("CLOSE status = %v", status)
+			}
+			if _, err := tree.Share.fs.Stat("/durable"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Stat() after close error = %v, want ErrNotExist", err)
+			}
+		})
+	}
+}
+
+// TestDurableHandle_ReconnectRejected tests the checks made before a
+// durable handle is reattached
+func TestDurableHandle_ReconnectRejected(t *testing.T) {
+	createGUID := [16]byte{1, 2, 3, 4}
+	tests := []struct {
+		name       string
+		timeout    time.Duration // ServerOptions.DurableHandleTimeout
+		keep       bool          // Leave the handle connected
+		user       string
+		file       string
+		createGUID [16]byte
+		want       NTStatus
+	}{
+		{"still connected", 0, true, "testuser", "d", createGUID, STATUS_OBJECT_NAME_NOT_FOUND},
+		{"other user", 0, false, "mallory", "d", createGUID, STATUS_ACCESS_DENIED},
+		{"other name", 0, false, "testuser", "e", createGUID, STATUS_OBJECT_NAME_NOT_FOUND},
+		{"other CreateGuid", 0, false, "testuser", "d", [16]byte{5}, STATUS_OBJECT_NAME_NOT_FOUND},
+		{"timed out", time.Millisecond, false, "testuser", "d", createGUID, STATUS_OBJECT_NAME_NOT_FOUND},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, session, tree := setupTestTree(t)
+			if tt.timeout != 0 {
+				srv.options.DurableHandleTimeout = tt.timeout
+			}
+			tree.Share.fs.Mkdir("/d", 0755)
+			tree.Share.fs.Mkdir("/e", 0755)
+
+			state := &connState{}
+			resp, status := srv.handler.handleCreate(state, testRequest(session, tree, SMB2_CREATE,
+				durableCreateRequest("d", 0, durableLease, durableRequestV2(0, createGUID))), &SMB2Header{})
+			if status != STATUS_SUCCESS {
+				t.Fatalf("CREATE status = %v, want STATUS_SUCCESS", status)
+			}
+			fileID := UnmarshalFileID(resp[64:80])
+
+			if !tt.keep {
+				srv.disconnectDurableHandles(session.ID)
+			}
+			time.Sleep(2 * tt.timeout)
+
+			session2, tree2 := newTestSession(t, srv, tt.user)
+			_, status = srv.handler.handleCreate(state, testRequest(session2, tree2, SMB2_CREATE,
+				withCreateContexts(buildCreateRequest(tt.file, FILE_OPEN, 0, nil), durableReconnectV2(fileID, tt.createGUID))), &SMB2Header{})
+			if status != tt.want {
+				t.Errorf("reconnect CREATE status = %v, want %v", status, tt.want)
+			}
+		})
+	}
+}
+
+// TestDurableHandle_Expiry tests that disconnected durable handles are
+// closed once their timeout passes, honoring delete-on-close
+func TestDurableHandle_Expiry(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	tree.Share.fs.Mkdir("/tmp", 0755)
+
+	resp, status := srv.handler.handleCreate(&connState{}, testRequest(session, tree, SMB2_CREATE,
+		durableCreateRequest("tmp", FILE_DELETE_ON_CLOSE, durableLease, durableRequestV1())), &SMB2Header{})
+	if status != STATUS_SUCCESS {
+		t.Fatalf("CREATE status = %v, want STATUS_SUCCESS", status)
+	}
+	fileID := UnmarshalFileID(resp[64:80])
+
+	srv.disconnectDurableHandles(session.ID)
+	if of := tree.Share.fileHandles.GetByTree(fileID, tree.ID, session.ID); of != nil {
+		t.Error("disconnected handle still usable from its old session")
+	}
+
+	srv.closeExpiredDurableHandles(time.Now())
+	if tree.Share.fileHandles.Get(fileID) == nil {
+		t.Fatal("durable handle closed before its timeout")
+	}
+
+	srv.closeExpiredDurableHandles(time.Now().Add(defaultDurableHandleTimeout + time.Second))
+	if tree.Share.fileHandles.Get(fileID) != nil {
+		t.Error("durable handle kept after its timeout")
+	}
+	if _, err := tree.Share.fs.Stat("/tmp"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat() after expiry error = %v, want ErrNotExist", err)
+	}
+}
+
+// TestDurableHandle_NotGranted tests opens that get no durable handle
+func TestDurableHandle_NotGranted(t *testing.T) {
+	fileRequest := withCreateContexts(buildCreateRequest("new.txt", FILE_CREATE, 0, nil), durableRequestV1())
+	tests := []struct {
+		name    string
+		guest   bool
+		timeout time.Duration
+		request []byte
+	}{
+		{"guest session", true, 0, durableCreateRequest("dir", 0, durableLease, durableRequestV1())},
+		{"disabled", false, -1, durableCreateRequest("dir", 0, durableLease, durableRequestV1())},
+		{"no oplock or lease", false, 0, fileRequest},
+		{"read lease", false, 0, durableCreateRequest("dir", 0, SMB2_LEASE_READ_CACHING, durableRequestV1())},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, session, tree := setupTestTree(t)
+			tree.Share.fs.Mkdir("/dir", 0755)
+			if tt.timeout != 0 {
+				srv.options.DurableHandleTimeout = tt.timeout
+			}
+			if tt.guest {
+				session.SetValid("", "", true, nil)
+			}
+
+			resp, status := srv.handler.handleCreate(&connState{}, testRequest(session, tree, SMB2_CREATE, tt.request), &SMB2Header{})
+			if status != STATUS_SUCCESS {
+				t.Fatalf("CREATE status = %v, want STATUS_SUCCESS", status)
+			}
+			if _, ok := findCreateContext(createResponseContexts(t, resp), SMB2_CREATE_DURABLE_HANDLE_REQUEST); ok {
+				t.Error("CREATE response has a durable handle context")
+			}
+
+			srv.disconnectDurableHandles(session.ID)
+			if tree.Share.fileHandles.GetByTree(UnmarshalFileID(resp[64:80]), tree.ID, session.ID) == nil {
+				t.Error("non-durable handle detached from its session")
+			}
+		})
+	}
+}
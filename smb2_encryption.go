@@ -0,0 +1,311 @@
+package smbfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// SMB2 TRANSFORM_HEADER (MS-SMB2 2.2.41)
+const (
+	SMB2TransformProtocolID = "\xFDSMB"
+	SMB2TransformHeaderSize = 52
+
+	// Flags (SMB 3.1.1) / EncryptionAlgorithm (SMB 3.0.x); both use 0x0001
+	SMB2_TRANSFORM_HEADER_FLAG_ENCRYPTED uint16 = 0x0001
+)
+
+// Encryption errors
+var (
+	ErrDecryptionFailed  = errors.New("SMB2 message decryption failed")
+	ErrUnsupportedCipher = errors.New("unsupported SMB2 cipher")
+)
+
+// TransformHeader is the header of an encrypted SMB2 message
+type TransformHeader struct {
+	Signature           [16]byte // AEAD authentication tag
+	Nonce               [16]byte // 11 bytes (CCM) or 12 bytes (GCM), rest zero
+	OriginalMessageSize uint32   // Size of the plaintext SMB2 message
+	Flags               uint16   // SMB2_TRANSFORM_HEADER_FLAG_ENCRYPTED
+	SessionID           uint64   // Session whose keys protect the message
+}
+
+// Marshal serializes the transform header to bytes
+func (h *TransformHeader) Marshal() []byte {
+	buf := make([]byte, SMB2TransformHeaderSize)
+	copy(buf[0:4], SMB2TransformProtocolID)
+	copy(buf[4:20], h.Signature[:])
+	copy(buf[20:36], h.Nonce[:])
+	binary.LittleEndian.PutUint32(buf[36:40], h.OriginalMessageSize)
+	// Reserved (2) at 40:42
+	binary.LittleEndian.PutUint16(buf[42:44], h.Flags)
+	binary.LittleEndian.PutUint64(buf[44:52], h.SessionID)
+	return buf
+}
+
+// UnmarshalTransformHeader parses a transform header from bytes
+func UnmarshalTransformHeader(data []byte) (*TransformHeader, error) {
+	if !IsTransformMessage(data) {
+		return nil, ErrInvalidMessage
+	}
+
+	h := &TransformHeader{
+		OriginalMessageSize: binary.LittleEndian.Uint32(data[36:40]),
+		Flags:               binary.LittleEndian.Uint16(data[42:44]),
+		SessionID:           binary.LittleEndian.Uint64(data[44:52]),
+	}
+	copy(h.Signature[:], data[4:20])
+	copy(h.Nonce[:], data[20:36])
+	return h, nil
+}
+
+// IsTransformMessage reports whether data starts with a transform header
+func IsTransformMessage(data []byte) bool {
+	return len(data) >= SMB2TransformHeaderSize && string(data[0:4]) == SMB2TransformProtocolID
+}
+
+// DeriveEncryptionKeys derives the session's cipher keys using SP800-108 KDF
+// encryptionKey protects server-to-client messages, decryptionKey
+// client-to-server ones
+// For SMB 3.0/3.0.2: KDF(SessionKey, "SMB2AESCCM\0", "ServerOut\0" / "ServerIn \0")
+// For SMB 3.1.1: KDF(SessionKey, "SMBS2CCipherKey\0" / "SMBC2SCipherKey\0", PreauthIntegrityHash)
+func DeriveEncryptionKeys(sessionKey []byte, dialect SMBDialect, preauthHash []byte) (encryptionKey, decryptionKey []byte) {
+	if dialect >= SMB3_1_1 && len(preauthHash) > 0 {
+		encryptionKey = kdfSP800108(sessionKey, []byte("SMBS2CCipherKey\x00"), preauthHash, 16)
+		decryptionKey = kdfSP800108(sessionKey, []byte("SMBC2SCipherKey\x00"), preauthHash, 16)
+		return encryptionKey, decryptionKey
+	}
+
+	label := []byte("SMB2AESCCM\x00")
+	encryptionKey = kdfSP800108(sessionKey, label, []byte("ServerOut\x00"), 16)
+	decryptionKey = kdfSP800108(sessionKey, label, []byte("ServerIn \x00"), 16)
+	return encryptionKey, decryptionKey
+}
+
+// newSMB2AEAD returns the AEAD for a negotiated cipher
+func newSMB2AEAD(cipherID uint16, key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cipherID {
+	case SMB2_ENCRYPTION_AES128_GCM:
+		return cipher.NewGCM(block)
+	case SMB2_ENCRYPTION_AES128_CCM:
+		return newCCM(block, 11, 16)
+	default:
+		return nil, ErrUnsupportedCipher
+	}
+}
+
+// EncryptMessage wraps an SMB2 message in a transform header
+func EncryptMessage(message []byte, key []byte, cipherID uint16, sessionID uint64) ([]byte, error) {
+	aead, err := newSMB2AEAD(cipherID, key)
+	if err != nil {
+		return nil, err
+	}
+
+	th := &TransformHeader{
+		OriginalMessageSize: uint32(len(message)),
+		Flags:               SMB2_TRANSFORM_HEADER_FLAG_ENCRYPTED,
+		SessionID:           sessionID,
+	}
+	nonce := th.Nonce[:aead.NonceSize()]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	// The authenticated data is the transform header after the signature
+	header := th.Marshal()
+	sealed := aead.Seal(nil, nonce, message, header[20:])
+
+	tagStart := len(sealed) - aead.Overhead()
+	copy(header[4:20], sealed[tagStart:])
+
+	out := make([]byte, 0, len(header)+tagStart)
+	out = append(out, header...)
+	return append(out, sealed[:tagStart]...), nil
+}
+
+// DecryptMessage unwraps an encrypted SMB2 message
+func DecryptMessage(data []byte, key []byte, cipherID uint16) ([]byte, error) {
+	th, err := UnmarshalTransformHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := data[SMB2TransformHeaderSize:]
+	if th.Flags != SMB2_TRANSFORM_HEADER_FLAG_ENCRYPTED || int(th.OriginalMessageSize) != len(ciphertext) {
+		return nil, ErrDecryptionFailed
+	}
+
+	aead, err := newSMB2AEAD(cipherID, key)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, 0, len(ciphertext)+aead.Overhead())
+	sealed = append(sealed, ciphertext...)
+	sealed = append(sealed, th.Signature[:aead.Overhead()]...)
+
+	message, err := aead.Open(nil, th.Nonce[:aead.NonceSize()], sealed, data[20:SMB2TransformHeaderSize])
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return message, nil
+}
+
+// ccm implements AES-CCM (RFC 3610, NIST SP 800-38C) as a cipher.AEAD
+// The standard library only provides GCM; SMB 3.0/3.0.2 require CCM
+type ccm struct {
+	block     cipher.Block
+	nonceSize int
+	tagSize   int
+}
+
+// newCCM returns a CCM AEAD with the given nonce and tag sizes
+func newCCM(block cipher.Block, nonceSize, tagSize int) (cipher.AEAD, error) {
+	if block.BlockSize() != 16 || nonceSize < 7 || nonceSize > 13 ||
+		tagSize < 4 || tagSize > 16 || tagSize%2 != 0 {
+		return nil, errors.New("ccm: invalid parameters")
+	}
+	return &ccm{block: block, nonceSize: nonceSize, tagSize: tagSize}, nil
+}
+
+func (c *ccm) NonceSize() int { return c.nonceSize }
+func (c *ccm) Overhead() int  { return c.tagSize }
+
+// counterBlock returns the CTR block A_i
+func (c *ccm) counterBlock(nonce []byte, i uint64) []byte {
+	l := 15 - c.nonceSize
+	a := make([]byte, 16)
+	a[0] = byte(l - 1)
+	copy(a[1:], nonce)
+	for j := 15; j > c.nonceSize; j-- {
+		a[j] = byte(i)
+		i >>= 8
+	}
+	return a
+}
+
+// mac computes the unencrypted CBC-MAC tag T
+func (c *ccm) mac(nonce, plaintext, additionalData []byte) []byte {
+	l := 15 - c.nonceSize
+
+	// B_0 = Flags || Nonce || l(m)
+	b0 := make([]byte, 16)
+	b0[0] = byte((c.tagSize-2)/2<<3 | (l - 1))
+	if len(additionalData) > 0 {
+		b0[0] |= 0x40
+	}
+	copy(b0[1:], nonce)
+	size := uint64(len(plaintext))
+	for j := 15; j > c.nonceSize; j-- {
+		b0[j] = byte(size)
+		size >>= 8
+	}
+
+	x := make([]byte, 16)
+	c.block.Encrypt(x, b0)
+
+	cbc := func(data []byte) {
+		for len(data) > 0 {
+			n := len(data)
+			if n > 16 {
+				n = 16
+			}
+			xorBytes(x, data[:n])
+			c.block.Encrypt(x, x)
+			data = data[n:]
+		}
+	}
+
+	if len(additionalData) > 0 {
+		var aad []byte
+		if len(additionalData) < 0xFF00 {
+			aad = binary.BigEndian.AppendUint16(nil, uint16(len(additionalData)))
+		} else {
+			aad = append([]byte{0xFF, 0xFE}, binary.BigEndian.AppendUint32(nil, uint32(len(additionalData)))...)
+		}
+		aad = append(aad, additionalData...)
+		cbc(aad)
+	}
+	cbc(plaintext)
+
+	return x[:c.tagSize]
+}
+
+// ctr applies the CCM keystream (starting at counter 1) to src
+func (c *ccm) ctr(dst, src, nonce []byte) {
+	s := make([]byte, 16)
+	for i := 0; i < len(src); i += 16 {
+		c.block.Encrypt(s, c.counterBlock(nonce, uint64(i/16+1)))
+		end := i + 16
+		if end > len(src) {
+			end = len(src)
+		}
+		for j := i; j < end; j++ {
+			dst[j] = src[j] ^ s[j-i]
+		}
+	}
+}
+
+// tagMask returns S_0, which encrypts the tag
+func (c *ccm) tagMask(nonce []byte) []byte {
+	s0 := make([]byte, 16)
+	c.block.Encrypt(s0, c.counterBlock(nonce, 0))
+	return s0[:c.tagSize]
+}
+
+func (c *ccm) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != c.nonceSize {
+		panic("ccm: incorrect nonce length")
+	}
+
+	tag := c.mac(nonce, plaintext, additionalData)
+	xorBytes(tag, c.tagMask(nonce))
+
+	out := make([]byte, len(plaintext)+c.tagSize)
+	c.ctr(out, plaintext, nonce)
+	copy(out[len(plaintext):], tag)
+	return append(dst, out...)
+}
+
+func (c *ccm) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != c.nonceSize {
+		return nil, errors.New("ccm: incorrect nonce length")
+	}
+	if len(ciphertext) < c.tagSize {
+		return nil, errors.New("ccm: message authentication failed")
+	}
+
+	body := ciphertext[:len(ciphertext)-c.tagSize]
+	plaintext := make([]byte, len(body))
+	c.ctr(plaintext, body, nonce)
+
+	tag := c.mac(nonce, plaintext, additionalData)
+	xorBytes(tag, c.tagMask(nonce))
+	if subtle.ConstantTimeCompare(tag, ciphertext[len(body):]) != 1 {
+		return nil, errors.New("ccm: message authentication failed")
+	}
+	return append(dst, plaintext...), nil
+}
+
+// encryptionRequired reports whether a request must arrive encrypted because
+// its session or the share it addresses requires encryption
+// NEGOTIATE and SESSION_SETUP are exempt since they establish the keys
+func (h *SMBHandler) encryptionRequired(session *Session, header *SMB2Header) bool {
+	if session == nil || header.Command == SMB2_NEGOTIATE || header.Command == SMB2_SESSION_SETUP {
+		return false
+	}
+	if session.EncryptData {
+		return true
+	}
+	if tree := session.GetTreeConnection(header.TreeID); tree != nil && tree.Share != nil {
+		return tree.Share.Options().EncryptData
+	}
+	return false
+}
@@ -0,0 +1,204 @@
+package smbfs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+// plainHeader returns a marshaled SMB2 request header
+func plainHeader(cmd uint16, messageID uint64) []byte {
+	h := &SMB2Header{StructureSize: SMB2HeaderSize, Command: cmd, MessageID: messageID}
+	copy(h.ProtocolID[:], SMB2ProtocolID)
+	return h.Marshal()
+}
+
+// TestTransformHeader_RoundTrip tests transform header marshaling
+func TestTransformHeader_RoundTrip(t *testing.T) {
+	h := &TransformHeader{
+		OriginalMessageSize: 1234,
+		Flags:               SMB2_TRANSFORM_HEADER_FLAG_ENCRYPTED,
+		SessionID:           0x1122334455667788,
+	}
+	for i := range h.Signature {
+		h.Signature[i] = byte(i)
+		h.Nonce[i] = byte(0xF0 - i)
+	}
+
+	data := h.Marshal()
+	if len(data) != SMB2TransformHeaderSize {
+		t.Fatalf("Marshal() length = %d, want %d", len(data), SMB2TransformHeaderSize)
+	}
+	if !IsTransformMessage(data) {
+		t.Fatal("IsTransformMessage() = false for marshaled header")
+	}
+
+	got, err := UnmarshalTransformHeader(data)
+	if err != nil {
+		t.Fatalf("UnmarshalTransformHeader() error = %v", err)
+	}
+	if *got != *h {
+		t.Errorf("UnmarshalTransformHeader() = %+v, want %+v", got, h)
+	}
+
+	if _, err := UnmarshalTransformHeader(data[:SMB2TransformHeaderSize-1]); err == nil {
+		t.Error("UnmarshalTransformHeader() accepted a short header")
+	}
+	if IsTransformMessage(plainHeader(SMB2_ECHO, 0)) {
+		t.Error("IsTransformMessage() = true for a plain SMB2 header")
+	}
+}
+
+// TestEncryptMessage_RoundTrip tests that decrypting an encrypted message
+// returns the original and that tampering is detected
+func TestEncryptMessage_RoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 16)
+	message := append(plainHeader(SMB2_READ, 7), []byte("payload bytes of odd length")...)
+
+	for _, cipherID := range []uint16{SMB2_ENCRYPTION_AES128_GCM, SMB2_ENCRYPTION_AES128_CCM} {
+		sealed, err := EncryptMessage(message, key, cipherID, 99)
+		if err != nil {
+			t.Fatalf("EncryptMessage(cipher %d) error = %v", cipherID, err)
+		}
+		if len(sealed) != SMB2TransformHeaderSize+len(message) {
+			t.Errorf("cipher %d: sealed length = %d, want %d", cipherID, len(sealed), SMB2TransformHeaderSize+len(message))
+		}
+		if bytes.Contains(sealed, message[SMB2HeaderSize:]) {
+			t.Errorf("cipher %d: plaintext visible in encrypted message", cipherID)
+		}
+
+		th, _ := UnmarshalTransformHeader(sealed)
+		if th.SessionID != 99 || int(th.OriginalMessageSize) != len(message) {
+			t.Errorf("cipher %d: transform header = %+v", cipherID, th)
+		}
+
+		got, err := DecryptMessage(sealed, key, cipherID)
+		if err != nil {
+			t.Fatalf("DecryptMessage(cipher %d) error = %v", cipherID, err)
+		}
+		if !bytes.Equal(got, message) {
+			t.Errorf("cipher %d: DecryptMessage() = %x, want %x", cipherID, got, message)
+		}
+
+		// Ciphertext and authenticated header fields are both protected
+		for _, pos := range []int{SMB2TransformHeaderSize + 3, 44} {
+			tampered := append([]byte(nil), sealed...)
+			tampered[pos] ^= 0x01
+			if _, err := DecryptMessage(tampered, key, cipherID); err == nil {
+				t.Errorf("cipher %d: DecryptMessage() accepted message modified at byte %d", cipherID, pos)
+			}
+		}
+
+		wrongKey := bytes.Repeat([]byte{0x43}, 16)
+		if _, err := DecryptMessage(sealed, wrongKey, cipherID); err == nil {
+			t.Errorf("cipher %d: DecryptMessage() succeeded with the wrong key", cipherID)
+		}
+	}
+
+	if _, err := EncryptMessage(message, key, 0x7777, 1); err != ErrUnsupportedCipher {
+		t.Errorf("EncryptMessage(unknown cipher) error = %v, want ErrUnsupportedCipher", err)
+	}
+}
+
+// TestCCM_RFC3610 tests the CCM implementation against RFC 3610 packet vector #1
+func TestCCM_RFC3610(t *testing.T) {
+	key, _ := hex.DecodeString("C0C1C2C3C4C5C6C7C8C9CACBCCCDCECF")
+	nonce, _ := hex.DecodeString("00000003020100A0A1A2A3A4A5")
+	aad, _ := hex.DecodeString("0001020304050607")
+	plaintext, _ := hex.DecodeString("08090A0B0C0D0E0F101112131415161718191A1B1C1D1E")
+	want, _ := hex.DecodeString("588C979A61C663D2F066D0C2C0F989806D5F6B61DAC38417E8D12CFDF926E0")
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := newCCM(block, 13, 8)
+	if err != nil {
+		t.Fatalf("newCCM() error = %v", err)
+	}
+
+	got := aead.Seal(nil, nonce, plaintext, aad)
+	if !bytes.Equal(got, want) {
+		t.Errorf("Seal() = %X, want %X", got, want)
+	}
+
+	opened, err := aead.Open(nil, nonce, want, aad)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Errorf("Open() = %X, want %X", opened, plaintext)
+	}
+}
+
+// TestDeriveEncryptionKeys tests that the two directions get distinct keys
+// and that SMB 3.1.1 keys depend on the preauth hash
+func TestDeriveEncryptionKeys(t *testing.T) {
+	sessionKey := bytes.Repeat([]byte{0x11}, 16)
+	hashA := bytes.Repeat([]byte{0xAA}, 64)
+	hashB := bytes.Repeat([]byte{0xBB}, 64)
+
+	enc30, dec30 := DeriveEncryptionKeys(sessionKey, SMB3_0, nil)
+	encA, decA := DeriveEncryptionKeys(sessionKey, SMB3_1_1, hashA)
+	encB, _ := DeriveEncryptionKeys(sessionKey, SMB3_1_1, hashB)
+
+	for _, k := range [][]byte{enc30, dec30, encA, decA} {
+		if len(k) != 16 {
+			t.Fatalf("derived key length = %d, want 16", len(k))
+		}
+	}
+	if bytes.Equal(enc30, dec30) || bytes.Equal(encA, decA) {
+		t.Error("encryption and decryption keys are equal")
+	}
+	if bytes.Equal(enc30, encA) {
+		t.Error("SMB 3.0 and 3.1.1 derive the same key")
+	}
+	if bytes.Equal(encA, encB) {
+		t.Error("SMB 3.1.1 key does not depend on the preauth hash")
+	}
+}
+
+// TestEncryption_Loopback tests a client session against a server that
+// requires encryption, for both the GCM (3.1.1) and CCM (3.0.2) ciphers
+func TestEncryption_Loopback(t *testing.T) {
+	for _, dialect := range []SMBDialect{SMB3_1_1, SMB3_0_2} {
+		t.Run(dialect.String(), func(t *testing.T) {
+			srv, config := startLoopbackServer(t, ServerOptions{
+				MaxDialect:  dialect,
+				EncryptData: true,
+			})
+
+			fsys, err := New(config)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			defer fsys.Close()
+
+			f, err := fsys.Open("/hello.txt")
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+			data, err := io.ReadAll(f)
+			f.Close()
+			if err != nil {
+				t.Fatalf("ReadAll() error = %v", err)
+			}
+			if string(data) != "hello" {
+				t.Errorf("ReadAll() = %q, want %q", data, "hello")
+			}
+
+			srv.sessions.mu.RLock()
+			defer srv.sessions.mu.RUnlock()
+			if len(srv.sessions.sessions) == 0 {
+				t.Fatal("no sessions on server")
+			}
+			for id, session := range srv.sessions.sessions {
+				if !session.EncryptData || session.EncryptionKey == nil {
+					t.Errorf("session %d not encrypting", id)
+				}
+			}
+		})
+	}
+}
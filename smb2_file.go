@@ -6,6 +6,7 @@ import (
 	"io/fs"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/absfs/absfs"
 )
@@ -42,8 +43,8 @@ func (h *SMBHandler) handleCreate(state *connState, msg *SMB2Message, respHeader
 	createOptions := r.ReadUint32()
 	nameOffset := r.ReadUint16()
 	nameLength := r.ReadUint16()
-	_ = r.ReadUint32() // CreateContextsOffset
-	_ = r.ReadUint32() // CreateContextsLength
+	createContextsOffset := r.ReadUint32()
+	createContextsLength := r.ReadUint32()
 
 	// Extract filename from UTF-16LE buffer
 	// nameOffset is relative to the start of the SMB2 header
@@ -51,7 +52,43 @@ func (h *SMBHandler) handleCreate(state *connState, msg *SMB2Message, respHeader
 	if nameStart < 0 || nameStart+int(nameLength) > len(msg.Payload) {
 		return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
 	}
-	filename := DecodeUTF16LEToString(msg.Payload[nameStart : nameStart+int(nameLength)])
+	var filename string
+	if createOptions&FILE_OPEN_BY_FILE_ID != 0 {
+		// The name buffer holds the 8-byte FileId the share reported
+		if nameLength != 8 {
+			return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+		}
+		p, ok := tree.Share.pathByFileID(le.Uint64(msg.Payload[nameStart:]))
+		if !ok {
+			return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+		}
+		filename = p
+	} else {
+		filename = DecodeUTF16LEToString(msg.Payload[nameStart : nameStart+int(nameLength)])
+	}
+
+	contexts, status := parseCreateContexts(msg.Payload, createContextsOffset, createContextsLength)
+	if status != STATUS_SUCCESS {
+		return h.buildErrorResponse(), status
+	}
+
+	// Lease request, if the client asked for one
+	var leaseReq *leaseRequest
+	if oplockLevel == SMB2_OPLOCK_LEVEL_LEASE {
+		if data, ok := findCreateContext(contexts, SMB2_CREATE_REQUEST_LEASE); ok {
+			if leaseReq, ok = parseLeaseRequest(data); !ok {
+				return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+			}
+		}
+	}
+
+	// DFS-aware clients name files in DFS shares by their full DFS path
+	// (server\share\path); only the path is relative to the share
+	if msg.Header.Flags&SMB2_FLAGS_DFS_OPERATIONS != 0 && len(tree.Share.Options().DFSLinks) > 0 {
+		if _, _, rest, ok := splitDFSPath(filename); ok {
+			filename = rest
+		}
+	}
 
 	// Convert backslashes to forward slashes
 	filename = strings.ReplaceAll(filename, "\\", "/")
@@ -61,13 +98,35 @@ func (h *SMBHandler) handleCreate(state *connState, msg *SMB2Message, respHeader
 	if filename == "" {
 		filename = "/"
 	}
+	filename = tree.Share.resolveCase(filename)
 
 	h.server.logger.Debug("CREATE: path=%s, disposition=0x%x, access=0x%x, share=0x%x, options=0x%x",
 		filename, createDisposition, desiredAccess, shareAccess, createOptions)
+	h.auditRequest(msg, session, tree, AuditOpen, filename)
+
+	// Paths under a DFS link live elsewhere; the client must get a referral
+	if link, _, ok := tree.Share.dfsLink(filename); ok {
+		h.server.logger.Debug("CREATE: %s is under DFS link %s", filename, link)
+		return h.buildErrorResponse(), STATUS_PATH_NOT_COVERED
+	}
+
+	// A durable handle reconnect reclaims an existing open; the rest of the
+	// request does not apply to it
+	reconnect, status := parseDurableReconnect(contexts)
+	if status != STATUS_SUCCESS {
+		return h.buildErrorResponse(), status
+	}
+	if reconnect != nil {
+		reconnect.path = filename
+		return h.reconnectDurableHandle(state, session, tree, reconnect, oplockLevel, leaseReq)
+	}
+	durableReq, status := parseDurableRequest(contexts)
+	if status != STATUS_SUCCESS {
+		return h.buildErrorResponse(), status
+	}
 
 	// Suppress unused variable warnings
 	_ = securityFlags
-	_ = oplockLevel
 	_ = impersonationLevel
 	_ = createFlags
 	_ = fileAttributes
@@ -77,12 +136,6 @@ func (h *SMBHandler) handleCreate(state *connState, msg *SMB2Message, respHeader
 	wantFile := createOptions&FILE_NON_DIRECTORY_FILE != 0
 	deleteOnClose := createOptions&FILE_DELETE_ON_CLOSE != 0
 
-	// Check share access compatibility with existing opens
-	if !tree.Share.fileHandles.CheckShareAccess(filename, desiredAccess, shareAccess) {
-		h.server.logger.Debug("CREATE: sharing violation for %s", filename)
-		return h.buildErrorResponse(), STATUS_SHARING_VIOLATION
-	}
-
 	// Determine open mode based on create disposition
 	var file absfs.File
 	var err error
@@ -90,9 +143,35 @@ func (h *SMBHandler) handleCreate(state *connState, msg *SMB2Message, respHeader
 	var existed bool
 
 	// First, check if file exists
-	info, statErr := tree.Share.fs.Stat(filename)
+	info, statErr := tree.Share.FileSystem().Stat(filename)
 	existed = statErr == nil
 
+	// FILE_OPEN_REPARSE_POINT opens a symbolic link itself rather than its
+	// target, which need not exist
+	var linkInfo os.FileInfo
+	if createOptions&FILE_OPEN_REPARSE_POINT != 0 {
+		if li, ok := tree.Share.lstatLink(filename); ok {
+			info, linkInfo, existed = li, li, true
+		}
+	}
+
+	// Refuse access the tree or the file cannot give before opening anything
+	var existing os.FileInfo
+	if existed {
+		existing = info
+	}
+	grantedAccess, status := grantAccess(tree, existing, desiredAccess, createDisposition, createOptions)
+	if status != STATUS_SUCCESS {
+		h.server.logger.Debug("CREATE: access 0x%x to %s denied: %v", desiredAccess, filename, status)
+		return h.buildErrorResponse(), status
+	}
+
+	// Check share access compatibility with existing opens
+	if !tree.Share.fileHandles.CheckShareAccess(filename, grantedAccess, shareAccess) {
+		h.server.logger.Debug("CREATE: sharing violation for %s", filename)
+		return h.buildErrorResponse(), STATUS_SHARING_VIOLATION
+	}
+
 	// Handle create dispositions
 	switch createDisposition {
 	case FILE_OPEN:
@@ -107,10 +186,14 @@ func (h *SMBHandler) handleCreate(state *connState, msg *SMB2Message, respHeader
 		if wantFile && info.IsDir() {
 			return h.buildErrorResponse(), STATUS_FILE_IS_A_DIRECTORY
 		}
-		file, err = tree.Share.fs.OpenFile(filename, os.O_RDWR, 0)
-		if err != nil {
-			// Try read-only if write fails
-			file, err = tree.Share.fs.OpenFile(filename, os.O_RDONLY, 0)
+		if linkInfo != nil {
+			file = &symlinkFile{name: filename, info: linkInfo}
+		} else {
+			file, err = tree.Share.FileSystem().OpenFile(filename, os.O_RDWR, 0)
+			if err != nil {
+				// Try read-only if write fails
+				file, err = tree.Share.FileSystem().OpenFile(filename, os.O_RDONLY, 0)
+			}
 		}
 		createAction = FILE_OPENED
 
@@ -124,13 +207,13 @@ func (h *SMBHandler) handleCreate(state *connState, msg *SMB2Message, respHeader
 		}
 		if wantDir {
 			// Create directory
-			err = tree.Share.fs.Mkdir(filename, 0755)
+			err = tree.Share.FileSystem().Mkdir(filename, 0755)
 			if err == nil {
-				file, err = tree.Share.fs.OpenFile(filename, os.O_RDONLY, 0)
+				file, err = tree.Share.FileSystem().OpenFile(filename, os.O_RDONLY, 0)
 			}
 		} else {
 			// Create file
-			file, err = tree.Share.fs.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
+			file, err = tree.Share.FileSystem().OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
 		}
 		createAction = FILE_CREATED
 
@@ -144,9 +227,13 @@ func (h *SMBHandler) handleCreate(state *connState, msg *SMB2Message, respHeader
 			if wantFile && info.IsDir() {
 				return h.buildErrorResponse(), STATUS_FILE_IS_A_DIRECTORY
 			}
-			file, err = tree.Share.fs.OpenFile(filename, os.O_RDWR, 0)
-			if err != nil {
-				file, err = tree.Share.fs.OpenFile(filename, os.O_RDONLY, 0)
+			if linkInfo != nil {
+				file = &symlinkFile{name: filename, info: linkInfo}
+			} else {
+				file, err = tree.Share.FileSystem().OpenFile(filename, os.O_RDWR, 0)
+				if err != nil {
+					file, err = tree.Share.FileSystem().OpenFile(filename, os.O_RDONLY, 0)
+				}
 			}
 			createAction = FILE_OPENED
 		} else {
@@ -154,12 +241,12 @@ func (h *SMBHandler) handleCreate(state *connState, msg *SMB2Message, respHeader
 				return h.buildErrorResponse(), STATUS_ACCESS_DENIED
 			}
 			if wantDir {
-				err = tree.Share.fs.Mkdir(filename, 0755)
+				err = tree.Share.FileSystem().Mkdir(filename, 0755)
 				if err == nil {
-					file, err = tree.Share.fs.OpenFile(filename, os.O_RDONLY, 0)
+					file, err = tree.Share.FileSystem().OpenFile(filename, os.O_RDONLY, 0)
 				}
 			} else {
-				file, err = tree.Share.fs.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
+				file, err = tree.Share.FileSystem().OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
 			}
 			createAction = FILE_CREATED
 		}
@@ -175,7 +262,7 @@ func (h *SMBHandler) handleCreate(state *connState, msg *SMB2Message, respHeader
 		if info.IsDir() {
 			return h.buildErrorResponse(), STATUS_FILE_IS_A_DIRECTORY
 		}
-		file, err = tree.Share.fs.OpenFile(filename, os.O_RDWR|os.O_TRUNC, 0644)
+		file, err = tree.Share.FileSystem().OpenFile(filename, os.O_RDWR|os.O_TRUNC, 0644)
 		createAction = FILE_OVERWRITTEN
 
 	case FILE_OVERWRITE_IF:
@@ -186,7 +273,7 @@ func (h *SMBHandler) handleCreate(state *connState, msg *SMB2Message, respHeader
 		if existed && info.IsDir() {
 			return h.buildErrorResponse(), STATUS_FILE_IS_A_DIRECTORY
 		}
-		file, err = tree.Share.fs.OpenFile(filename, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+		file, err = tree.Share.FileSystem().OpenFile(filename, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
 		if existed {
 			createAction = FILE_OVERWRITTEN
 		} else {
@@ -201,7 +288,7 @@ func (h *SMBHandler) handleCreate(state *connState, msg *SMB2Message, respHeader
 		if existed && info.IsDir() {
 			return h.buildErrorResponse(), STATUS_FILE_IS_A_DIRECTORY
 		}
-		file, err = tree.Share.fs.OpenFile(filename, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+		file, err = tree.Share.FileSystem().OpenFile(filename, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
 		if existed {
 			createAction = FILE_SUPERSEDED
 		} else {
@@ -225,62 +312,107 @@ func (h *SMBHandler) handleCreate(state *connState, msg *SMB2Message, respHeader
 		return h.buildErrorResponse(), mapGoErrorToNTStatus(err)
 	}
 
-	// Allocate file handle
-	of := tree.Share.fileHandles.Allocate(
+	// Truncating an existing file frees its space
+	if createAction == FILE_OVERWRITTEN || createAction == FILE_SUPERSEDED {
+		tree.Share.reserveSpace(existing.Size(), 0)
+		tree.Share.setArchive(filename, true)
+	}
+
+	// Allocate file handle, checking share access again since another open
+	// of the path may have been allocated while this one was opening
+	of, ok := tree.Share.fileHandles.TryAllocate(
 		file,
 		filename,
 		info.IsDir(),
-		desiredAccess,
+		grantedAccess,
 		shareAccess,
 		createDisposition,
 		createOptions,
 		tree.ID,
 		session.ID,
 	)
+	if !ok {
+		file.Close()
+		h.server.logger.Debug("CREATE: sharing violation for %s", filename)
+		return h.buildErrorResponse(), STATUS_SHARING_VIOLATION
+	}
 
 	// Set delete on close flag if requested
 	if deleteOnClose {
 		of.DeleteOnClose = true
 	}
 
+	// An open that can change the file invalidates what others have cached
+	of.parentLease = parentLeaseID(state, leaseReq)
+	if !of.IsDir && conflictsWithCaching(grantedAccess, createAction) {
+		h.breakFileCaching(state, tree.Share, of, leaseReq)
+	}
+	h.grantCaching(state, tree.Share, of, oplockLevel, leaseReq)
+
+	// A new entry changes the parent directory's contents
+	if createAction == FILE_CREATED {
+		tree.Share.recordCreation(filename, info.ModTime())
+		h.breakParentDirectoryLease(tree.Share, filename, of.parentLease)
+	}
+
 	h.server.logger.Info("File opened: %s (FileID=%d/%d, Action=%d, Size=%d)",
 		filename, of.ID.Persistent, of.ID.Volatile, createAction, info.Size())
 
+	var respContexts []CreateContext
+	if of.Lease != nil {
+		respContexts = append(respContexts, CreateContext{Name: SMB2_CREATE_REQUEST_LEASE, Data: buildLeaseResponseContext(of.Lease)})
+	}
+	if durableReq != nil && cachesHandle(tree.Share, of) {
+		if ctx, ok := h.grantDurableHandle(state, session, tree.Share, of, durableReq); ok {
+			respContexts = append(respContexts, ctx)
+		}
+	}
+
+	return h.buildCreateResponse(tree.Share, of, info, createAction, respContexts), STATUS_SUCCESS
+}
+
+// buildCreateResponse builds a CREATE response for an open handle
+func (h *SMBHandler) buildCreateResponse(share *Share, of *OpenFile, info os.FileInfo, createAction uint32, contexts []CreateContext) []byte {
 	// Build response (structure size 89)
 	w := NewByteWriter(256)
 	w.WriteUint16(89) // StructureSize
-	w.WriteOneByte(0)    // OplockLevel (none)
+	if of.Lease != nil {
+		w.WriteOneByte(SMB2_OPLOCK_LEVEL_LEASE) // OplockLevel
+	} else {
+		w.WriteOneByte(share.fileHandles.oplockLevel(of)) // OplockLevel
+	}
 	w.WriteOneByte(0)    // Flags (reserved)
 	w.WriteUint32(createAction)
 
 	// File times
-	w.WriteUint64(TimeToFiletime(info.ModTime())) // CreationTime
+	created := share.CreationTime(of.Path, info)
+	w.WriteUint64(TimeToFiletime(created))        // CreationTime
 	w.WriteUint64(TimeToFiletime(info.ModTime())) // LastAccessTime
 	w.WriteUint64(TimeToFiletime(info.ModTime())) // LastWriteTime
 	w.WriteUint64(TimeToFiletime(info.ModTime())) // ChangeTime
 
 	// File size and attributes
-	size := info.Size()
-	allocationSize := (size + 4095) &^ 4095 // Round up to 4KB
-	w.WriteUint64(uint64(allocationSize))   // AllocationSize
-	w.WriteUint64(uint64(size))             // EndOfFile
+	w.WriteUint64(share.allocationSize(of.Path, info)) // AllocationSize
+	w.WriteUint64(uint64(info.Size()))                 // EndOfFile
 
 	// File attributes
-	attrs := uint32(FILE_ATTRIBUTE_NORMAL)
-	if info.IsDir() {
-		attrs = FILE_ATTRIBUTE_DIRECTORY
-	}
-	if strings.HasPrefix(info.Name(), ".") {
-		attrs |= FILE_ATTRIBUTE_HIDDEN
-	}
-	w.WriteUint32(attrs)
+	w.WriteUint32(share.fileAttributes(of.Path, info))
 
 	w.WriteUint32(0) // Reserved2
 	w.WriteFileID(of.ID)
-	w.WriteUint32(0) // CreateContextsOffset
-	w.WriteUint32(0) // CreateContextsLength
 
-	return w.Bytes(), STATUS_SUCCESS
+	if len(contexts) == 0 {
+		w.WriteUint32(0) // CreateContextsOffset
+		w.WriteUint32(0) // CreateContextsLength
+		return w.Bytes()
+	}
+
+	respContexts := buildCreateContexts(contexts)
+	w.WriteUint32(uint32(SMB2HeaderSize + w.Len() + 8)) // CreateContextsOffset
+	w.WriteUint32(uint32(len(respContexts)))            // CreateContextsLength
+	w.WriteBytes(respContexts)
+
+	return w.Bytes()
 }
 
 // handleClose processes an SMB2 CLOSE request
@@ -317,31 +449,18 @@ func (h *SMBHandler) handleClose(state *connState, msg *SMB2Message) ([]byte, NT
 
 	// Get file info before closing (if requested)
 	var info fs.FileInfo
+	var created time.Time
 	var err error
 	if flags&0x0001 != 0 { // SMB2_CLOSE_FLAG_POSTQUERY_ATTRIB
 		info, err = of.File.Stat()
+		if err == nil {
+			created = tree.Share.CreationTime(of.Path, info)
+		}
 	}
 
-	// Handle delete on close
-	deleteOnClose := of.DeleteOnClose
 	path := of.Path
-
-	// Release the file handle (this closes the underlying file)
-	if err := tree.Share.fileHandles.Release(fileID); err != nil {
-		h.server.logger.Warn("CLOSE: failed to close file: %v", err)
-	}
-
-	// Delete file if requested
-	if deleteOnClose {
-		h.server.logger.Debug("CLOSE: deleting file on close: %s", path)
-		if of.IsDir {
-			err = tree.Share.fs.Remove(path)
-		} else {
-			err = tree.Share.fs.Remove(path)
-		}
-		if err != nil {
-			h.server.logger.Warn("CLOSE: failed to delete file %s: %v", path, err)
-		}
+	if !h.closeOpenFile(tree.Share, of) {
+		info = nil
 	}
 
 	h.server.logger.Info("File closed: %s", path)
@@ -354,21 +473,15 @@ func (h *SMBHandler) handleClose(state *connState, msg *SMB2Message) ([]byte, NT
 
 	// If info was requested and available, return it
 	if info != nil && err == nil {
-		w.WriteUint64(TimeToFiletime(info.ModTime())) // CreationTime
+		w.WriteUint64(TimeToFiletime(created))        // CreationTime
 		w.WriteUint64(TimeToFiletime(info.ModTime())) // LastAccessTime
 		w.WriteUint64(TimeToFiletime(info.ModTime())) // LastWriteTime
 		w.WriteUint64(TimeToFiletime(info.ModTime())) // ChangeTime
 
-		size := info.Size()
-		allocationSize := (size + 4095) &^ 4095
-		w.WriteUint64(uint64(allocationSize)) // AllocationSize
-		w.WriteUint64(uint64(size))           // EndOfFile
+		w.WriteUint64(tree.Share.allocationSize(path, info)) // AllocationSize
+		w.WriteUint64(uint64(info.Size()))                   // EndOfFile
 
-		attrs := uint32(FILE_ATTRIBUTE_NORMAL)
-		if info.IsDir() {
-			attrs = FILE_ATTRIBUTE_DIRECTORY
-		}
-		w.WriteUint32(attrs)
+		w.WriteUint32(tree.Share.fileAttributes(path, info)) // FileAttributes
 	} else {
 		// Return zeros if no info requested (times, sizes, attributes)
 		// 4 times (4*8=32) + 2 sizes (2*8=16) + 1 attrs (4) = 52 bytes
@@ -378,6 +491,41 @@ func (h *SMBHandler) handleClose(state *connState, msg *SMB2Message) ([]byte, NT
 	return w.Bytes(), STATUS_SUCCESS
 }
 
+// closeOpenFile drops a handle's server-side state and releases it, which
+// closes the underlying file, then deletes the file if it was marked
+// delete-on-close. It reports false if that delete failed
+func (h *SMBHandler) closeOpenFile(share *Share, of *OpenFile) bool {
+	if of.IsDir {
+		h.clearDirState(of)
+	}
+	h.server.leases.Release(of.Lease)
+	h.server.notify.closeHandle(share, of.ID)
+	if err := share.fileHandles.Release(of.ID); err != nil {
+		h.server.logger.Warn("CLOSE: failed to close file: %v", err)
+	}
+
+	if !of.DeleteOnClose {
+		return true
+	}
+	if h.server.GlobalReadOnly() {
+		h.server.logger.Debug("CLOSE: server is read-only, keeping %s", of.Path)
+		return false
+	}
+	h.server.logger.Debug("CLOSE: deleting file on close: %s", of.Path)
+	err := share.FileSystem().Remove(of.Path)
+	h.auditDelete(share, of, err)
+	if err != nil {
+		h.server.logger.Warn("CLOSE: failed to delete file %s: %v", of.Path, err)
+		return false
+	}
+	share.forgetCreation(of.Path)
+	share.forgetArchive(of.Path)
+	share.forgetFileIDs(of.Path)
+	share.forgetUsage()
+	h.breakParentDirectoryLease(share, of.Path, of.parentLease)
+	return true
+}
+
 // handleRead processes an SMB2 READ request
 func (h *SMBHandler) handleRead(state *connState, msg *SMB2Message) ([]byte, NTStatus) {
 	// Validate session and tree
@@ -418,14 +566,32 @@ func (h *SMBHandler) handleRead(state *connState, msg *SMB2Message) ([]byte, NTS
 	if of == nil {
 		return h.buildErrorResponse(), STATUS_FILE_CLOSED
 	}
+	h.auditRequest(msg, session, tree, AuditRead, of.Path)
 
 	// Update last access time
 	tree.Share.fileHandles.UpdateLastAccess(fileID)
 
-	// Limit read size to configured maximum
+	if offset == useFilePosition {
+		offset = uint64(filePosition(of))
+	}
+
+	// Unbuffered reads must honor the alignment reported in FileAlignmentInformation
+	if of.Options&FILE_NO_INTERMEDIATE_BUFFERING != 0 && !tree.Share.isAlignedIO(offset, length) {
+		return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+	}
+
+	// Limit read size to configured maximum, and to what one credit
+	// covers on connections without multi-credit requests
 	if length > h.server.options.MaxReadSize {
 		length = h.server.options.MaxReadSize
 	}
+	if !state.multiCredit() && length > singleCreditMaxSize {
+		length = singleCreditMaxSize
+	}
+
+	if tree.Share.fileHandles.IOConflict(of, offset, uint64(length), false) {
+		return h.buildErrorResponse(), STATUS_FILE_LOCK_CONFLICT
+	}
 
 	h.server.logger.Debug("READ: %s offset=%d length=%d", of.Path, offset, length)
 
@@ -448,26 +614,36 @@ func (h *SMBHandler) handleRead(state *connState, msg *SMB2Message) ([]byte, NTS
 
 	h.server.logger.Debug("READ: read %d bytes from %s", n, of.Path)
 
+	// Hold the data back while the session is over its bandwidth limit
+	if !h.throttle(h.requestContext(msg), session, tree, n) {
+		return h.buildErrorResponse(), STATUS_CANCELLED
+	}
+
 	// If we read 0 bytes and got EOF, return end of file status
 	if n == 0 && (err == io.EOF || err == nil) {
 		return h.buildErrorResponse(), STATUS_END_OF_FILE
 	}
 
+	return buildReadResponse(buf), STATUS_SUCCESS
+}
+
+// buildReadResponse builds a READ response carrying data
+func buildReadResponse(data []byte) []byte {
 	// Build response (structure size 17)
 	// Data starts at: SMB2 header (64) + response fields (16) = offset 80
 	// The DataOffset field is 1 byte telling client where data starts from header
 	dataOffset := uint8(SMB2HeaderSize + 16)
 
-	w := NewByteWriter(17 + n)
-	w.WriteUint16(17)          // StructureSize (bytes 0-1)
-	w.WriteOneByte(dataOffset) // DataOffset (byte 2)
-	w.WriteOneByte(0)          // Reserved (byte 3)
-	w.WriteUint32(uint32(n))   // DataLength (bytes 4-7)
-	w.WriteUint32(0)           // DataRemaining (bytes 8-11)
-	w.WriteUint32(0)           // Reserved2 (bytes 12-15)
-	w.WriteBytes(buf)          // Data (bytes 16+)
+	w := NewByteWriter(17 + len(data))
+	w.WriteUint16(17)                // StructureSize (bytes 0-1)
+	w.WriteOneByte(dataOffset)       // DataOffset (byte 2)
+	w.WriteOneByte(0)                // Reserved (byte 3)
+	w.WriteUint32(uint32(len(data))) // DataLength (bytes 4-7)
+	w.WriteUint32(0)                 // DataRemaining (bytes 8-11)
+	w.WriteUint32(0)                 // Reserved2 (bytes 12-15)
+	w.WriteBytes(data)               // Data (bytes 16+)
 
-	return w.Bytes(), STATUS_SUCCESS
+	return w.Bytes()
 }
 
 // handleWrite processes an SMB2 WRITE request
@@ -507,6 +683,7 @@ func (h *SMBHandler) handleWrite(state *connState, msg *SMB2Message) ([]byte, NT
 	if of == nil {
 		return h.buildErrorResponse(), STATUS_FILE_CLOSED
 	}
+	h.auditRequest(msg, session, tree, AuditWrite, of.Path)
 
 	// Check if tree/file is read-only
 	if tree.IsReadOnly {
@@ -520,6 +697,20 @@ func (h *SMBHandler) handleWrite(state *connState, msg *SMB2Message) ([]byte, NT
 		return h.buildErrorResponse(), STATUS_ACCESS_DENIED
 	}
 
+	if offset == useFilePosition {
+		offset = uint64(filePosition(of))
+	}
+
+	// A handle opened for appending only writes at end of file whatever
+	// the offset, as does the offset 0xFFFFFFFFFFFFFFFF on any handle
+	appending := offset == writeToEndOfFile ||
+		access&FILE_APPEND_DATA != 0 && access&FILE_WRITE_DATA == 0
+
+	// Unbuffered writes must honor the alignment reported in FileAlignmentInformation
+	if !appending && of.Options&FILE_NO_INTERMEDIATE_BUFFERING != 0 && !tree.Share.isAlignedIO(offset, length) {
+		return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+	}
+
 	// Update last access time
 	tree.Share.fileHandles.UpdateLastAccess(fileID)
 
@@ -531,35 +722,97 @@ func (h *SMBHandler) handleWrite(state *connState, msg *SMB2Message) ([]byte, NT
 	}
 	data := msg.Payload[dataStart : dataStart+int(length)]
 
-	h.server.logger.Debug("WRITE: %s offset=%d length=%d", of.Path, offset, length)
+	h.server.logger.Debug("WRITE: %s offset=%d length=%d append=%v", of.Path, offset, length, appending)
+
+	// Accept the data no faster than the session's bandwidth limit, before
+	// taking the share's append lock
+	if !h.throttle(h.requestContext(msg), session, tree, len(data)) {
+		return h.buildErrorResponse(), STATUS_CANCELLED
+	}
 
 	// Seek to offset
 	if seeker, ok := of.File.(io.Seeker); ok {
-		_, err := seeker.Seek(int64(offset), io.SeekStart)
+		var err error
+		if appending {
+			tree.Share.appendMu.Lock()
+			defer tree.Share.appendMu.Unlock()
+			var end int64
+			end, err = seeker.Seek(0, io.SeekEnd)
+			offset = uint64(end)
+		} else {
+			_, err = seeker.Seek(int64(offset), io.SeekStart)
+		}
 		if err != nil {
 			return h.buildErrorResponse(), mapGoErrorToNTStatus(err)
 		}
 	}
 
-	// Write data
-	n, err := of.File.Write(data)
-	if err != nil {
-		h.server.logger.Debug("WRITE: failed to write to %s: %v", of.Path, err)
-		return h.buildErrorResponse(), mapGoErrorToNTStatus(err)
+	if tree.Share.fileHandles.IOConflict(of, offset, uint64(len(data)), true) {
+		return h.buildErrorResponse(), STATUS_FILE_LOCK_CONFLICT
 	}
 
+	// Refuse to grow the file past the share's limits before writing any of
+	// the data
+	if tree.Share.limitsSize() {
+		info, err := of.File.Stat()
+		if err != nil {
+			return h.buildErrorResponse(), mapGoErrorToNTStatus(err)
+		}
+		end := int64(offset) + int64(len(data))
+		if appending {
+			end = info.Size() + int64(len(data))
+		}
+		if status := tree.Share.reserveSpace(info.Size(), max(end, info.Size())); status != STATUS_SUCCESS {
+			h.server.logger.Debug("WRITE: %s would grow to %d bytes, past the share's limits", of.Path, end)
+			return h.buildErrorResponse(), status
+		}
+	}
+
+	// Write data, continuing after short writes; clients treat a Count
+	// below the requested length as a failure, so never report one
+	n := 0
+	for n < len(data) {
+		written, err := of.File.Write(data[n:])
+		n += written
+		if err != nil {
+			h.server.logger.Debug("WRITE: failed to write to %s after %d of %d bytes: %v", of.Path, n, len(data), err)
+			tree.Share.forgetUsage() // The growth counted may not have happened
+			return h.buildErrorResponse(), mapGoErrorToNTStatus(err)
+		}
+		if written == 0 {
+			h.server.logger.Warn("WRITE: no progress writing to %s after %d of %d bytes", of.Path, n, len(data))
+			tree.Share.forgetUsage()
+			return h.buildErrorResponse(), STATUS_DISK_FULL
+		}
+	}
+
+	tree.Share.setArchive(of.Path, true)
+
 	h.server.logger.Debug("WRITE: wrote %d bytes to %s", n, of.Path)
 
+	return buildWriteResponse(uint32(n)), STATUS_SUCCESS
+}
+
+// writeToEndOfFile is the WRITE offset that appends to the file
+const writeToEndOfFile = ^uint64(0)
+
+// useFilePosition is the READ or WRITE offset that continues from the
+// handle's current position (FILE_USE_FILE_POINTER_POSITION), which is
+// where the last read or write ended unless FilePositionInformation moved it
+const useFilePosition = ^uint64(1)
+
+// buildWriteResponse builds a WRITE response reporting count bytes written
+func buildWriteResponse(count uint32) []byte {
 	// Build response (structure size 17)
 	w := NewByteWriter(17)
-	w.WriteUint16(17)          // StructureSize
-	w.WriteUint16(0)           // Reserved
-	w.WriteUint32(uint32(n))   // Count
-	w.WriteUint32(0)           // Remaining
-	w.WriteUint16(0)           // WriteChannelInfoOffset
-	w.WriteUint16(0)           // WriteChannelInfoLength
-
-	return w.Bytes(), STATUS_SUCCESS
+	w.WriteUint16(17)    // StructureSize
+	w.WriteUint16(0)     // Reserved
+	w.WriteUint32(count) // Count
+	w.WriteUint32(0)     // Remaining
+	w.WriteUint16(0)     // WriteChannelInfoOffset
+	w.WriteUint16(0)     // WriteChannelInfoLength
+
+	return w.Bytes()
 }
 
 // handleFlush processes an SMB2 FLUSH request
@@ -645,6 +898,53 @@ func mapGenericAccess(access uint32) uint32 {
 	return result
 }
 
+// Access rights that change a file's data, attributes or name
+const fileModifyAccess = FILE_WRITE_DATA | FILE_APPEND_DATA | FILE_WRITE_EA |
+	FILE_WRITE_ATTRIBUTES | FILE_DELETE_CHILD | DELETE
+
+// maximalAccess returns the specific access rights available on a share
+func maximalAccess(readOnly bool) uint32 {
+	if readOnly {
+		return FILE_READ_DATA | FILE_READ_ATTRIBUTES | FILE_READ_EA | READ_CONTROL | SYNCHRONIZE
+	}
+	return FILE_READ_DATA | FILE_WRITE_DATA | FILE_APPEND_DATA |
+		FILE_READ_EA | FILE_WRITE_EA |
+		FILE_EXECUTE | FILE_DELETE_CHILD |
+		FILE_READ_ATTRIBUTES | FILE_WRITE_ATTRIBUTES |
+		DELETE | READ_CONTROL | WRITE_DAC | WRITE_OWNER | SYNCHRONIZE
+}
+
+// grantAccess checks the access a CREATE asks for against the tree and, when
+// the file exists (info != nil), its read-only attribute. Returns the
+// specific rights granted, with generic rights and MAXIMUM_ALLOWED resolved
+func grantAccess(tree *TreeConnection, info os.FileInfo, desiredAccess, createDisposition, createOptions uint32) (uint32, NTStatus) {
+	granted := mapGenericAccess(desiredAccess) &^
+		(GENERIC_READ | GENERIC_WRITE | GENERIC_EXECUTE | GENERIC_ALL | MAXIMUM_ALLOWED)
+
+	// The read-only attribute protects a file's data, not its attributes
+	readOnlyFile := info != nil && !info.IsDir() && info.Mode().Perm()&0222 == 0
+	if desiredAccess&MAXIMUM_ALLOWED != 0 {
+		available := maximalAccess(tree.IsReadOnly)
+		if readOnlyFile {
+			available &^= FILE_WRITE_DATA | FILE_APPEND_DATA | DELETE
+		}
+		granted |= available
+	}
+
+	wantDelete := granted&DELETE != 0 || createOptions&FILE_DELETE_ON_CLOSE != 0
+	overwrite := createDisposition == FILE_OVERWRITE || createDisposition == FILE_OVERWRITE_IF ||
+		createDisposition == FILE_SUPERSEDE
+	switch {
+	case tree.IsReadOnly && (granted&fileModifyAccess != 0 || wantDelete):
+		return 0, STATUS_ACCESS_DENIED
+	case readOnlyFile && wantDelete:
+		return 0, STATUS_CANNOT_DELETE
+	case readOnlyFile && (granted&(FILE_WRITE_DATA|FILE_APPEND_DATA) != 0 || overwrite):
+		return 0, STATUS_ACCESS_DENIED
+	}
+	return granted, STATUS_SUCCESS
+}
+
 // mapGoErrorToNTStatus maps Go errors to NT status codes
 func mapGoErrorToNTStatus(err error) NTStatus {
 	if err == nil {
@@ -665,6 +965,8 @@ func mapGoErrorToNTStatus(err error) NTStatus {
 		return STATUS_FILE_CLOSED
 	case errors.Is(err, io.EOF):
 		return STATUS_END_OF_FILE
+	case errors.Is(err, io.ErrShortWrite):
+		return STATUS_DISK_FULL
 	}
 
 	// Check for os-specific errors
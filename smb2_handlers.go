@@ -21,17 +21,24 @@ func NewSMBHandler(server *Server) *SMBHandler {
 func (h *SMBHandler) HandleMessage(state *connState, msg *SMB2Message) (*SMB2Message, error) {
 	header := msg.Header
 	cmd := header.Command
+	started := time.Now()
 
 	h.server.logger.Debug("Received %s (MsgID: %d, SessID: %d, TreeID: %d)",
 		CommandName(cmd), header.MessageID, header.SessionID, header.TreeID)
 
-	// Calculate credits to grant (be generous to avoid client stalls)
-	creditsToGrant := header.CreditRequest
-	if creditsToGrant < 1 {
-		creditsToGrant = 1
-	}
-	if creditsToGrant < 10 {
-		creditsToGrant = 10 // Always grant at least 10 credits
+	// Requests spend credits granted by earlier responses. CANCEL is free
+	// and gets no response, so it neither spends nor earns any
+	overdrawn := false
+	var creditsToGrant uint16
+	if cmd != SMB2_CANCEL {
+		overdrawn = !state.chargeCredits(header)
+		if overdrawn {
+			// A client spending credits it was not granted earns none back,
+			// beyond the one it needs to go on sending
+			creditsToGrant = state.grantCredits(0, 0)
+		} else {
+			creditsToGrant = state.grantCredits(header.CreditRequest, h.server.options.MaxCredits)
+		}
 	}
 
 	// Build response header
@@ -42,7 +49,7 @@ func (h *SMBHandler) HandleMessage(state *connState, msg *SMB2Message) (*SMB2Mes
 		MessageID:     header.MessageID,
 		SessionID:     header.SessionID,
 		TreeID:        header.TreeID,
-		CreditRequest: creditsToGrant, // Grant generous credits
+		CreditRequest: creditsToGrant,
 	}
 	copy(respHeader.ProtocolID[:], SMB2ProtocolID)
 
@@ -53,6 +60,182 @@ func (h *SMBHandler) HandleMessage(state *connState, msg *SMB2Message) (*SMB2Mes
 	h.server.logger.Debug("Received command: %s (0x%04x), MsgID=%d, SessionID=%d, TreeID=%d",
 		CommandName(cmd), cmd, header.MessageID, header.SessionID, header.TreeID)
 
+	// Requests on a signing session must carry a valid signature; a forged
+	// or tampered one ends the connection
+	session := h.server.sessions.GetSession(header.SessionID)
+	handled := false
+	if sigStatus, drop := h.verifyRequestSignature(state, session, msg); drop {
+		h.server.logger.Warn("Dropping connection %s: invalid signature on %s (session %d)",
+			state.remoteAddr, CommandName(cmd), header.SessionID)
+		state.conn.Close()
+		return nil, nil
+	} else if sigStatus != STATUS_SUCCESS {
+		h.server.logger.Warn("Rejecting unsigned %s on session %d", CommandName(cmd), header.SessionID)
+		payload, status = h.buildErrorResponse(), sigStatus
+		handled = true
+	}
+
+	if overdrawn && !handled {
+		h.server.logger.Warn("Rejecting %s from %s: credit charge %d exceeds the client's credits",
+			CommandName(cmd), state.remoteAddr, creditCharge(header))
+		payload, status = h.buildErrorResponse(), STATUS_INSUFFICIENT_RESOURCES
+		handled = true
+	}
+
+	if cmd != SMB2_CANCEL && !handled && state.multiCredit() &&
+		creditCharge(header) < requiredCreditCharge(cmd, msg.Payload) {
+		h.server.logger.Warn("Rejecting %s from %s: credit charge %d is too small for its payload",
+			CommandName(cmd), state.remoteAddr, creditCharge(header))
+		payload, status = h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+		handled = true
+	}
+
+	if cmd != SMB2_CANCEL && !handled && !state.allowRequest(h.server.options.RequestRateLimit) {
+		h.server.logger.Warn("Rejecting %s from %s: request rate limit exceeded", CommandName(cmd), state.remoteAddr)
+		payload, status = h.buildErrorResponse(), STATUS_INSUFFICIENT_RESOURCES
+		handled = true
+	}
+
+	if msg.relatedStatus != STATUS_SUCCESS && !handled {
+		payload, status = h.buildErrorResponse(), msg.relatedStatus
+		handled = true
+	}
+
+	// Injected faults replace normal handling (test servers only)
+	if fault, ok := h.server.chaos.faultFor(cmd); ok && !handled {
+		if fault.Delay > 0 {
+			h.server.logger.Debug("Chaos: delaying %s by %v", CommandName(cmd), fault.Delay)
+			select {
+			case <-time.After(fault.Delay):
+			case <-h.server.ctx.Done():
+			}
+		}
+		if fault.Drop {
+			h.server.logger.Debug("Chaos: dropping connection on %s", CommandName(cmd))
+			state.conn.Close()
+			return nil, nil
+		}
+		if fault.Status != STATUS_SUCCESS {
+			h.server.logger.Debug("Chaos: failing %s with %s", CommandName(cmd), fault.Status.String())
+			payload, status = h.buildErrorResponse(), fault.Status
+			handled = true
+		}
+	}
+
+	// Sessions and shares that require encryption refuse plaintext requests
+	if !handled && !msg.Encrypted && h.encryptionRequired(session, header) {
+		h.server.logger.Warn("Rejecting unencrypted %s on session %d", CommandName(cmd), header.SessionID)
+		payload, status = h.buildErrorResponse(), STATUS_ACCESS_DENIED
+		handled = true
+	}
+
+	// The share is looked up first, as TREE_DISCONNECT removes the tree
+	var share *Share
+	if session != nil {
+		if tree := session.GetTreeConnection(header.TreeID); tree != nil {
+			share = tree.Share
+		}
+	}
+
+	if !handled {
+		// Handlers never share an open or a session with a request still
+		// running past AsyncThreshold
+		h.server.async.waitRunning(state, msg)
+
+		if h.server.options.AsyncThreshold > 0 && mayOutrunThreshold(cmd) {
+			payload, status = h.dispatchWithThreshold(state, msg, respHeader, share, started)
+		} else {
+			payload, status = h.dispatch(state, msg, respHeader)
+		}
+		if payload == nil {
+			// No response for this command (CANCEL, or async CHANGE_NOTIFY);
+			// requests that outran AsyncThreshold are recorded once complete
+			if !msg.deferred {
+				h.server.recordRequest(share, cmd, status, nil, started)
+			}
+			return nil, nil
+		}
+	}
+
+	respHeader.Status = status
+	h.server.finishRequest(share, msg, status, payload, started)
+
+	response := &SMB2Message{
+		Header:  respHeader,
+		Payload: payload,
+	}
+
+	// Check if message should be signed
+	// Sign if: session is valid AND has signing key AND (signing required OR request was signed)
+	shouldSign := false
+	var signingKey []byte
+
+	if state.session != nil && state.session.SigningKey != nil && !state.session.IsGuest {
+		signingKey = state.session.SigningKey
+		// Sign if signing is required, or if the incoming message was signed
+		requestSigned := header.Flags&SMB2_FLAGS_SIGNED != 0
+		shouldSign = state.signingRequired || requestSigned
+
+		// Don't sign certain messages
+		// SESSION_SETUP success with STATUS_SUCCESS should be signed (not MORE_PROCESSING_REQUIRED)
+		if cmd == SMB2_SESSION_SETUP && status != STATUS_SUCCESS {
+			shouldSign = false
+		}
+		// NEGOTIATE is never signed
+		if cmd == SMB2_NEGOTIATE {
+			shouldSign = false
+		}
+	}
+
+	// Encrypted requests get encrypted responses, which are never also signed
+	encrypt := msg.Encrypted && session != nil && session.EncryptionKey != nil
+	if encrypt {
+		response.EncryptionKey = session.EncryptionKey
+		response.CipherID = session.CipherID
+		shouldSign = false
+	}
+
+	response.CompressionAlg = responseCompression(state, cmd, status, payload)
+
+	if shouldSign {
+		// Set the signed flag in the response header
+		respHeader.Flags |= SMB2_FLAGS_SIGNED
+		// Signature will be applied when marshaling in writeMessage
+		response.SigningKey = signingKey
+		response.Dialect = state.dialect
+		h.server.logger.Debug("Response will be signed (cmd=%s, dialect=%s)",
+			CommandName(cmd), state.dialect.String())
+	}
+
+	h.server.logger.Debug("Responding %s status=%s (%d bytes, signed=%v, encrypted=%v)",
+		CommandName(cmd), status.String(), len(payload), shouldSign, encrypt)
+
+	return response, nil
+}
+
+// finishRequest counts a handled request in the metrics and reports its
+// audit event, if it has one
+func (s *Server) finishRequest(share *Share, msg *SMB2Message, status NTStatus, payload []byte, started time.Time) {
+	cmd := msg.Header.Command
+	s.recordRequest(share, cmd, status, payload, started)
+	if msg.audit != nil && share != nil {
+		read, written := transferredBytes(cmd, status, payload)
+		msg.audit.Bytes = read + written
+		msg.audit.Status = status
+		s.audit(share, *msg.audit)
+	}
+}
+
+// dispatch routes a request to its command handler
+// A nil payload means no response is sent
+func (h *SMBHandler) dispatch(state *connState, msg *SMB2Message, respHeader *SMB2Header) (payload []byte, status NTStatus) {
+	cmd := msg.Header.Command
+
+	// Opens on IPC$ are named pipes, not files
+	if isPipeFileCommand(cmd) && h.onPipeTree(msg.Header) {
+		return h.dispatchPipe(msg)
+	}
+
 	switch cmd {
 	case SMB2_NEGOTIATE:
 		payload, status = h.handleNegotiate(state, msg)
@@ -84,6 +267,9 @@ func (h *SMBHandler) HandleMessage(state *connState, msg *SMB2Message) (*SMB2Mes
 	case SMB2_FLUSH:
 		payload, status = h.handleFlush(state, msg)
 
+	case SMB2_LOCK:
+		payload, status = h.handleLock(state, msg, respHeader)
+
 	case SMB2_QUERY_DIRECTORY:
 		payload, status = h.handleQueryDirectory(state, msg)
 
@@ -97,61 +283,28 @@ func (h *SMBHandler) HandleMessage(state *connState, msg *SMB2Message) (*SMB2Mes
 		payload, status = h.handleEcho(state, msg)
 
 	case SMB2_CANCEL:
-		// CANCEL doesn't get a response
-		return nil, nil
+		// CANCEL doesn't get a response; the cancelled request completes instead
+		h.handleCancel(state, msg)
+		return nil, STATUS_SUCCESS
 
 	case SMB2_IOCTL:
 		payload, status = h.handleIOCTL(state, msg)
 
+	case SMB2_OPLOCK_BREAK:
+		payload, status = h.handleOplockBreak(state, msg)
+
+	case SMB2_CHANGE_NOTIFY:
+		payload, status = h.handleChangeNotify(state, msg, respHeader)
+
 	default:
+		// Commands this server does not know get an error response, and
+		// the connection carries on
 		h.server.logger.Warn("Unsupported command: %s (0x%04x)", CommandName(cmd), cmd)
-		status = STATUS_NOT_SUPPORTED
+		status = STATUS_NOT_IMPLEMENTED
 		payload = h.buildErrorResponse()
 	}
 
-	respHeader.Status = status
-
-	response := &SMB2Message{
-		Header:  respHeader,
-		Payload: payload,
-	}
-
-	// Check if message should be signed
-	// Sign if: session is valid AND has signing key AND (signing required OR request was signed)
-	shouldSign := false
-	var signingKey []byte
-
-	if state.session != nil && state.session.SigningKey != nil {
-		signingKey = state.session.SigningKey
-		// Sign if signing is required, or if the incoming message was signed
-		requestSigned := header.Flags&SMB2_FLAGS_SIGNED != 0
-		shouldSign = state.signingRequired || requestSigned
-
-		// Don't sign certain messages
-		// SESSION_SETUP success with STATUS_SUCCESS should be signed (not MORE_PROCESSING_REQUIRED)
-		if cmd == SMB2_SESSION_SETUP && status != STATUS_SUCCESS {
-			shouldSign = false
-		}
-		// NEGOTIATE is never signed
-		if cmd == SMB2_NEGOTIATE {
-			shouldSign = false
-		}
-	}
-
-	if shouldSign {
-		// Set the signed flag in the response header
-		respHeader.Flags |= SMB2_FLAGS_SIGNED
-		// Signature will be applied when marshaling in writeMessage
-		response.SigningKey = signingKey
-		response.Dialect = state.dialect
-		h.server.logger.Debug("Response will be signed (cmd=%s, dialect=%s)",
-			CommandName(cmd), state.dialect.String())
-	}
-
-	h.server.logger.Debug("Responding %s status=%s (%d bytes, signed=%v)",
-		CommandName(cmd), status.String(), len(payload), shouldSign)
-
-	return response, nil
+	return payload, status
 }
 
 // validateSession validates the session for commands that require it
@@ -175,9 +328,44 @@ func (h *SMBHandler) validateTree(header *SMB2Header) (*Session, *TreeConnection
 		return nil, nil, status
 	}
 
+	// While the server is read-only so is every tree, and the handlers'
+	// read-only checks refuse whatever would change a file
+	if !tree.IsReadOnly && h.server.GlobalReadOnly() && tree.Share.GetShareType() != SMBShareTypePipe {
+		readOnly := *tree
+		readOnly.IsReadOnly = true
+		tree = &readOnly
+	}
+
 	return session, tree, STATUS_SUCCESS
 }
 
+// verifyRequestSignature checks the signature of a request on an
+// authenticated session (MS-SMB2 3.3.5.2.4). NEGOTIATE, the SESSION_SETUP
+// exchange before the session is valid, encrypted requests and requests on
+// guest sessions, which are never signed, are exempt.
+// An unsigned request where signing is required yields STATUS_ACCESS_DENIED;
+// drop is set when the signature does not verify
+func (h *SMBHandler) verifyRequestSignature(state *connState, session *Session, msg *SMB2Message) (status NTStatus, drop bool) {
+	header := msg.Header
+	if session == nil || session.SigningKey == nil || session.IsGuest || msg.Encrypted ||
+		header.Command == SMB2_NEGOTIATE ||
+		(header.Command == SMB2_SESSION_SETUP && session.State != SessionStateValid) {
+		return STATUS_SUCCESS, false
+	}
+
+	if header.Flags&SMB2_FLAGS_SIGNED == 0 {
+		if state.signingRequired {
+			return STATUS_ACCESS_DENIED, false
+		}
+		return STATUS_SUCCESS, false
+	}
+
+	if !VerifySignature(msg.RawBytes, session.SigningKey, state.dialect) {
+		return STATUS_ACCESS_DENIED, true
+	}
+	return STATUS_SUCCESS, false
+}
+
 // buildErrorResponse creates an empty error response payload
 func (h *SMBHandler) buildErrorResponse() []byte {
 	w := NewByteWriter(9)
@@ -189,6 +377,18 @@ func (h *SMBHandler) buildErrorResponse() []byte {
 	return w.Bytes()
 }
 
+// buildErrorDataResponse builds an error response carrying ErrorData, such
+// as the buffer size a client needs after STATUS_BUFFER_TOO_SMALL
+func (h *SMBHandler) buildErrorDataResponse(data []byte) []byte {
+	w := NewByteWriter(8 + len(data))
+	w.WriteUint16(9)                 // StructureSize
+	w.WriteOneByte(0)                // ErrorContextCount
+	w.WriteOneByte(0)                // Reserved
+	w.WriteUint32(uint32(len(data))) // ByteCount
+	w.WriteBytes(data)               // ErrorData
+	return w.Bytes()
+}
+
 // Handler forwarders - route to implementations in separate files
 
 func (h *SMBHandler) handleNegotiate(state *connState, msg *SMB2Message) ([]byte, NTStatus) {
@@ -1,12 +1,13 @@
 package smbfs
 
 import (
+	"io"
 	"io/fs"
+	"math"
 	"os"
 	"path"
+	"strings"
 	"time"
-
-	"github.com/absfs/absfs"
 )
 
 // handleQueryInfo handles SMB2 QUERY_INFO requests
@@ -39,9 +40,6 @@ func (h *SMBHandler) handleQueryInfo(state *connState, msg *SMB2Message) ([]byte
 	fileID := r.ReadFileID()
 
 	// Suppress unused variable warnings
-	_ = inputBufferOffset
-	_ = inputBufferLength
-	_ = additionalInfo
 	_ = flags
 
 	h.server.logger.Debug("QUERY_INFO: type=%d class=%d outputLen=%d fileID=%v",
@@ -56,16 +54,36 @@ func (h *SMBHandler) handleQueryInfo(state *connState, msg *SMB2Message) ([]byte
 	// Update last access time
 	tree.Share.fileHandles.UpdateLastAccess(fileID)
 
+	// Input buffer (the EA names for FileFullEaInformation)
+	var input []byte
+	if inputBufferLength > 0 {
+		inputStart := int(inputBufferOffset) - SMB2HeaderSize
+		if inputStart < 40 || inputStart+int(inputBufferLength) > len(msg.Payload) {
+			return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+		}
+		input = msg.Payload[inputStart : inputStart+int(inputBufferLength)]
+	}
+
 	var buffer []byte
 
 	switch infoType {
 	case SMB2_0_INFO_FILE:
-		buffer, status = h.queryFileInfo(of, fileInfoClass)
+		if fileInfoClass == FileFullEaInformation {
+			buffer, status = h.queryFileFullEaInformation(tree.Share, of, input)
+			break
+		}
+		buffer, status = h.queryFileInfo(tree.Share, of, fileInfoClass)
 	case SMB2_0_INFO_FILESYSTEM:
-		buffer, status = h.queryFilesystemInfo(tree.Share.fs, fileInfoClass)
+		buffer, status = h.queryFilesystemInfo(tree.Share, fileInfoClass)
 	case SMB2_0_INFO_SECURITY:
-		// Security info not supported yet
-		return h.buildErrorResponse(), STATUS_NOT_SUPPORTED
+		buffer, status = h.querySecurityInfo(session, tree, of, additionalInfo)
+		// A security descriptor is never truncated; the client retries
+		// with the size it is told it needs
+		if status == STATUS_SUCCESS && uint32(len(buffer)) > outputBufferLength {
+			needed := make([]byte, 4)
+			le.PutUint32(needed, uint32(len(buffer)))
+			return h.buildErrorDataResponse(needed), STATUS_BUFFER_TOO_SMALL
+		}
 	case SMB2_0_INFO_QUOTA:
 		// Quota info not supported
 		return h.buildErrorResponse(), STATUS_NOT_SUPPORTED
@@ -94,7 +112,7 @@ func (h *SMBHandler) handleQueryInfo(state *connState, msg *SMB2Message) ([]byte
 }
 
 // queryFileInfo handles file information queries
-func (h *SMBHandler) queryFileInfo(of *OpenFile, fileInfoClass uint8) ([]byte, NTStatus) {
+func (h *SMBHandler) queryFileInfo(share *Share, of *OpenFile, fileInfoClass uint8) ([]byte, NTStatus) {
 	// Get file info
 	info, err := of.File.Stat()
 	if err != nil {
@@ -102,22 +120,22 @@ func (h *SMBHandler) queryFileInfo(of *OpenFile, fileInfoClass uint8) ([]byte, N
 		return nil, STATUS_NO_SUCH_FILE
 	}
 
-	attrs := modeToAttributes(info.Mode())
+	attrs := share.fileAttributes(of.Path, info)
+	created := share.CreationTime(of.Path, info)
 
 	switch fileInfoClass {
 	case FileBasicInformation:
-		return h.buildFileBasicInformation(info, attrs), STATUS_SUCCESS
+		return h.buildFileBasicInformation(created, info, attrs), STATUS_SUCCESS
 
 	case FileStandardInformation:
-		return h.buildFileStandardInformation(info), STATUS_SUCCESS
+		return h.buildFileStandardInformation(info, share.allocationSize(of.Path, info)), STATUS_SUCCESS
 
 	case FileInternalInformation:
-		return h.buildFileInternalInformation(of), STATUS_SUCCESS
+		return h.buildFileInternalInformation(share, of), STATUS_SUCCESS
 
 	case FileEaInformation:
-		// EA size - return 0 (no extended attributes)
 		w := NewByteWriter(4)
-		w.WriteUint32(0) // EaSize
+		w.WriteUint32(share.eaSize(of.Path)) // EaSize
 		return w.Bytes(), STATUS_SUCCESS
 
 	case FileAccessInformation:
@@ -126,25 +144,42 @@ func (h *SMBHandler) queryFileInfo(of *OpenFile, fileInfoClass uint8) ([]byte, N
 		return w.Bytes(), STATUS_SUCCESS
 
 	case FilePositionInformation:
-		// Current file position
-		pos := int64(0)
-		if seeker, ok := of.File.(interface{ Seek(int64, int) (int64, error) }); ok {
-			pos, _ = seeker.Seek(0, 1) // SEEK_CUR
-		}
 		w := NewByteWriter(8)
-		w.WriteUint64(uint64(pos)) // CurrentByteOffset
+		w.WriteUint64(uint64(filePosition(of))) // CurrentByteOffset
+		return w.Bytes(), STATUS_SUCCESS
+
+	case FileAlignmentInformation:
+		w := NewByteWriter(4)
+		w.WriteUint32(share.AlignmentRequirement()) // AlignmentRequirement
 		return w.Bytes(), STATUS_SUCCESS
 
 	case FileAllInformation:
-		return h.buildFileAllInformation(of, info, attrs), STATUS_SUCCESS
+		return h.buildFileAllInformation(share, of, created, info, attrs), STATUS_SUCCESS
 
 	case FileNetworkOpenInformation:
-		return h.buildFileNetworkOpenInformation(info, attrs), STATUS_SUCCESS
+		return h.buildFileNetworkOpenInformation(created, info, attrs, share.allocationSize(of.Path, info)), STATUS_SUCCESS
+
+	case FileStreamInformation:
+		return share.buildFileStreamInformation(of.Path, info), STATUS_SUCCESS
+
+	case FileCompressionInformation:
+		return h.buildFileCompressionInformation(of, info)
+
+	case FileAlternateNameInformation:
+		shortName := share.shortName(of.Path)
+		if shortName == "" {
+			return nil, STATUS_OBJECT_NAME_NOT_FOUND
+		}
+		encoded := EncodeStringToUTF16LE(shortName)
+		w := NewByteWriter(4 + len(encoded))
+		w.WriteUint32(uint32(len(encoded))) // FileNameLength
+		w.WriteBytes(encoded)               // FileName
+		return w.Bytes(), STATUS_SUCCESS
 
 	case FileAttributeTagInformation:
 		w := NewByteWriter(8)
-		w.WriteUint32(attrs)       // FileAttributes
-		w.WriteUint32(0)           // ReparseTag (0 if not a reparse point)
+		w.WriteUint32(attrs)             // FileAttributes
+		w.WriteUint32(reparseTag(attrs)) // ReparseTag
 		return w.Bytes(), STATUS_SUCCESS
 
 	default:
@@ -154,9 +189,9 @@ func (h *SMBHandler) queryFileInfo(of *OpenFile, fileInfoClass uint8) ([]byte, N
 }
 
 // buildFileBasicInformation creates FileBasicInformation response
-func (h *SMBHandler) buildFileBasicInformation(info fs.FileInfo, attrs uint32) []byte {
+func (h *SMBHandler) buildFileBasicInformation(created time.Time, info fs.FileInfo, attrs uint32) []byte {
 	w := NewByteWriter(40)
-	w.WriteUint64(TimeToFiletime(time.Now()))    // CreationTime (use current time)
+	w.WriteUint64(TimeToFiletime(created))        // CreationTime
 	w.WriteUint64(TimeToFiletime(info.ModTime())) // LastAccessTime
 	w.WriteUint64(TimeToFiletime(info.ModTime())) // LastWriteTime
 	w.WriteUint64(TimeToFiletime(info.ModTime())) // ChangeTime
@@ -166,13 +201,8 @@ func (h *SMBHandler) buildFileBasicInformation(info fs.FileInfo, attrs uint32) [
 }
 
 // buildFileStandardInformation creates FileStandardInformation response
-func (h *SMBHandler) buildFileStandardInformation(info fs.FileInfo) []byte {
+func (h *SMBHandler) buildFileStandardInformation(info fs.FileInfo, allocationSize uint64) []byte {
 	w := NewByteWriter(24)
-	allocationSize := uint64(info.Size())
-	if allocationSize > 0 {
-		// Round up to 4KB allocation units
-		allocationSize = ((allocationSize + 4095) / 4096) * 4096
-	}
 	w.WriteUint64(allocationSize)   // AllocationSize
 	w.WriteUint64(uint64(info.Size())) // EndOfFile
 	w.WriteUint32(1)                   // NumberOfLinks
@@ -187,19 +217,18 @@ func (h *SMBHandler) buildFileStandardInformation(info fs.FileInfo) []byte {
 }
 
 // buildFileInternalInformation creates FileInternalInformation response
-func (h *SMBHandler) buildFileInternalInformation(of *OpenFile) []byte {
+func (h *SMBHandler) buildFileInternalInformation(share *Share, of *OpenFile) []byte {
 	w := NewByteWriter(8)
-	// Use volatile file ID as the index number
-	w.WriteUint64(of.ID.Volatile) // IndexNumber
+	w.WriteUint64(share.fileID(of.Path)) // IndexNumber
 	return w.Bytes()
 }
 
 // buildFileAllInformation creates FileAllInformation response
-func (h *SMBHandler) buildFileAllInformation(of *OpenFile, info fs.FileInfo, attrs uint32) []byte {
+func (h *SMBHandler) buildFileAllInformation(share *Share, of *OpenFile, created time.Time, info fs.FileInfo, attrs uint32) []byte {
 	w := NewByteWriter(256)
 
 	// BasicInformation
-	w.WriteUint64(TimeToFiletime(time.Now()))    // CreationTime
+	w.WriteUint64(TimeToFiletime(created))        // CreationTime
 	w.WriteUint64(TimeToFiletime(info.ModTime())) // LastAccessTime
 	w.WriteUint64(TimeToFiletime(info.ModTime())) // LastWriteTime
 	w.WriteUint64(TimeToFiletime(info.ModTime())) // ChangeTime
@@ -207,10 +236,7 @@ func (h *SMBHandler) buildFileAllInformation(of *OpenFile, info fs.FileInfo, att
 	w.WriteUint32(0)                              // Reserved
 
 	// StandardInformation
-	allocationSize := uint64(info.Size())
-	if allocationSize > 0 {
-		allocationSize = ((allocationSize + 4095) / 4096) * 4096
-	}
+	allocationSize := share.allocationSize(of.Path, info)
 	w.WriteUint64(allocationSize)   // AllocationSize
 	w.WriteUint64(uint64(info.Size())) // EndOfFile
 	w.WriteUint32(1)                   // NumberOfLinks
@@ -223,26 +249,22 @@ func (h *SMBHandler) buildFileAllInformation(of *OpenFile, info fs.FileInfo, att
 	w.WriteUint16(0)                   // Reserved
 
 	// InternalInformation
-	w.WriteUint64(of.ID.Volatile) // IndexNumber
+	w.WriteUint64(share.fileID(of.Path)) // IndexNumber
 
 	// EaInformation
-	w.WriteUint32(0) // EaSize
+	w.WriteUint32(share.eaSize(of.Path)) // EaSize
 
 	// AccessInformation
 	w.WriteUint32(of.Access) // AccessFlags
 
 	// PositionInformation
-	pos := int64(0)
-	if seeker, ok := of.File.(interface{ Seek(int64, int) (int64, error) }); ok {
-		pos, _ = seeker.Seek(0, 1) // SEEK_CUR
-	}
-	w.WriteUint64(uint64(pos)) // CurrentByteOffset
+	w.WriteUint64(uint64(filePosition(of))) // CurrentByteOffset
 
 	// ModeInformation
 	w.WriteUint32(0) // Mode
 
 	// AlignmentInformation
-	w.WriteUint32(0) // AlignmentRequirement
+	w.WriteUint32(share.AlignmentRequirement()) // AlignmentRequirement
 
 	// NameInformation
 	name := path.Base(of.Path)
@@ -254,13 +276,9 @@ func (h *SMBHandler) buildFileAllInformation(of *OpenFile, info fs.FileInfo, att
 }
 
 // buildFileNetworkOpenInformation creates FileNetworkOpenInformation response
-func (h *SMBHandler) buildFileNetworkOpenInformation(info fs.FileInfo, attrs uint32) []byte {
+func (h *SMBHandler) buildFileNetworkOpenInformation(created time.Time, info fs.FileInfo, attrs uint32, allocationSize uint64) []byte {
 	w := NewByteWriter(56)
-	allocationSize := uint64(info.Size())
-	if allocationSize > 0 {
-		allocationSize = ((allocationSize + 4095) / 4096) * 4096
-	}
-	w.WriteUint64(TimeToFiletime(time.Now()))    // CreationTime
+	w.WriteUint64(TimeToFiletime(created))        // CreationTime
 	w.WriteUint64(TimeToFiletime(info.ModTime())) // LastAccessTime
 	w.WriteUint64(TimeToFiletime(info.ModTime())) // LastWriteTime
 	w.WriteUint64(TimeToFiletime(info.ModTime())) // ChangeTime
@@ -272,19 +290,28 @@ func (h *SMBHandler) buildFileNetworkOpenInformation(info fs.FileInfo, attrs uin
 }
 
 // queryFilesystemInfo handles filesystem information queries
-func (h *SMBHandler) queryFilesystemInfo(filesystem absfs.FileSystem, fileInfoClass uint8) ([]byte, NTStatus) {
+func (h *SMBHandler) queryFilesystemInfo(share *Share, fileInfoClass uint8) ([]byte, NTStatus) {
 	switch fileInfoClass {
 	case FileFsVolumeInformation:
-		return h.buildFileFsVolumeInformation(), STATUS_SUCCESS
+		return h.buildFileFsVolumeInformation(share), STATUS_SUCCESS
 
 	case FileFsSizeInformation:
-		return h.buildFileFsSizeInformation(), STATUS_SUCCESS
+		return h.buildFileFsSizeInformation(share), STATUS_SUCCESS
+
+	case FileFsDeviceInformation:
+		return h.buildFileFsDeviceInformation(share), STATUS_SUCCESS
 
 	case FileFsAttributeInformation:
-		return h.buildFileFsAttributeInformation(), STATUS_SUCCESS
+		return h.buildFileFsAttributeInformation(share), STATUS_SUCCESS
+
+	case FileFsControlInformation:
+		return h.buildFileFsControlInformation(), STATUS_SUCCESS
 
 	case FileFsFullSizeInformation:
-		return h.buildFileFsFullSizeInformation(), STATUS_SUCCESS
+		return h.buildFileFsFullSizeInformation(share), STATUS_SUCCESS
+
+	case FileFsSectorSizeInformation:
+		return h.buildFileFsSectorSizeInformation(share), STATUS_SUCCESS
 
 	default:
 		h.server.logger.Debug("Unsupported filesystem info class: %d", fileInfoClass)
@@ -293,13 +320,12 @@ func (h *SMBHandler) queryFilesystemInfo(filesystem absfs.FileSystem, fileInfoCl
 }
 
 // buildFileFsVolumeInformation creates FileFsVolumeInformation response
-func (h *SMBHandler) buildFileFsVolumeInformation() []byte {
-	volumeLabel := "SMB Share"
-	labelBytes := EncodeStringToUTF16LE(volumeLabel)
+func (h *SMBHandler) buildFileFsVolumeInformation(share *Share) []byte {
+	labelBytes := EncodeStringToUTF16LE(share.VolumeLabel())
 
 	w := NewByteWriter(64)
 	w.WriteUint64(TimeToFiletime(time.Now())) // VolumeCreationTime
-	w.WriteUint32(0x12345678)                 // VolumeSerialNumber (arbitrary)
+	w.WriteUint32(share.VolumeSerial())       // VolumeSerialNumber
 	w.WriteUint32(uint32(len(labelBytes)))    // VolumeLabelLength
 	w.WriteOneByte(0)                            // SupportsObjects
 	w.WriteOneByte(0)                            // Reserved
@@ -308,20 +334,42 @@ func (h *SMBHandler) buildFileFsVolumeInformation() []byte {
 }
 
 // buildFileFsSizeInformation creates FileFsSizeInformation response
-func (h *SMBHandler) buildFileFsSizeInformation() []byte {
+func (h *SMBHandler) buildFileFsSizeInformation(share *Share) []byte {
+	total, free, unitSize := share.DiskSpace()
+	bytesPerSector := share.BytesPerSector()
+
 	w := NewByteWriter(24)
-	// Report 1TB total, 500GB available as defaults
-	totalUnits := uint64(1024 * 1024 * 256)    // 1TB in 4KB units
-	availableUnits := uint64(1024 * 1024 * 128) // 500GB in 4KB units
-	w.WriteUint64(totalUnits)      // TotalAllocationUnits
-	w.WriteUint64(availableUnits)  // AvailableAllocationUnits
-	w.WriteUint32(8)               // SectorsPerAllocationUnit (4KB = 8 * 512)
-	w.WriteUint32(512)             // BytesPerSector
+	w.WriteUint64(total / uint64(unitSize))  // TotalAllocationUnits
+	w.WriteUint64(free / uint64(unitSize))   // AvailableAllocationUnits
+	w.WriteUint32(unitSize / bytesPerSector) // SectorsPerAllocationUnit
+	w.WriteUint32(bytesPerSector)            // BytesPerSector
+	return w.Bytes()
+}
+
+// buildFileFsDeviceInformation creates FileFsDeviceInformation response
+// (MS-FSCC 2.5.10). Shares are remote disks
+func (h *SMBHandler) buildFileFsDeviceInformation(share *Share) []byte {
+	const (
+		FILE_DEVICE_DISK = 0x00000007
+
+		FILE_READ_ONLY_DEVICE  = 0x00000002
+		FILE_REMOTE_DEVICE     = 0x00000010
+		FILE_DEVICE_IS_MOUNTED = 0x00000020
+	)
+
+	characteristics := uint32(FILE_REMOTE_DEVICE | FILE_DEVICE_IS_MOUNTED)
+	if share.IsReadOnly() {
+		characteristics |= FILE_READ_ONLY_DEVICE
+	}
+
+	w := NewByteWriter(8)
+	w.WriteUint32(FILE_DEVICE_DISK) // DeviceType
+	w.WriteUint32(characteristics)  // Characteristics
 	return w.Bytes()
 }
 
 // buildFileFsAttributeInformation creates FileFsAttributeInformation response
-func (h *SMBHandler) buildFileFsAttributeInformation() []byte {
+func (h *SMBHandler) buildFileFsAttributeInformation(share *Share) []byte {
 	fsName := "SMBFS"
 	fsNameBytes := EncodeStringToUTF16LE(fsName)
 
@@ -341,11 +389,21 @@ func (h *SMBHandler) buildFileFsAttributeInformation() []byte {
 		FILE_SUPPORTS_ENCRYPTION          = 0x00020000
 		FILE_NAMED_STREAMS                = 0x00040000
 		FILE_READ_ONLY_VOLUME             = 0x00080000
+		FILE_SUPPORTS_EXTENDED_ATTRIBUTES = 0x00800000
 	)
 
 	attrs := uint32(FILE_CASE_PRESERVED_NAMES |
 		FILE_UNICODE_ON_DISK |
 		FILE_PERSISTENT_ACLS)
+	if _, ok := share.FileSystem().(SymlinkFS); ok {
+		attrs |= FILE_SUPPORTS_REPARSE_POINTS
+	}
+	if _, ok := share.FileSystem().(XattrFS); ok {
+		attrs |= FILE_SUPPORTS_EXTENDED_ATTRIBUTES
+	}
+	if share.IsReadOnly() {
+		attrs |= FILE_READ_ONLY_VOLUME
+	}
 
 	w := NewByteWriter(64)
 	w.WriteUint32(attrs)                   // FileSystemAttributes
@@ -355,17 +413,49 @@ func (h *SMBHandler) buildFileFsAttributeInformation() []byte {
 	return w.Bytes()
 }
 
+// buildFileFsControlInformation creates FileFsControlInformation response
+// (MS-FSCC 2.5.2). Shares have no quotas or content indexing filters, which
+// is reported as no free space thresholds and unlimited default quotas
+func (h *SMBHandler) buildFileFsControlInformation() []byte {
+	const noQuotaLimit = ^uint64(0)
+
+	w := NewByteWriter(48)
+	w.WriteUint64(0)            // FreeSpaceStartFiltering
+	w.WriteUint64(0)            // FreeSpaceThreshold
+	w.WriteUint64(0)            // FreeSpaceStopFiltering
+	w.WriteUint64(noQuotaLimit) // DefaultQuotaThreshold
+	w.WriteUint64(noQuotaLimit) // DefaultQuotaLimit
+	w.WriteUint32(0)            // FileSystemControlFlags (quotas not tracked or enforced)
+	w.WriteUint32(0)            // Padding
+	return w.Bytes()
+}
+
 // buildFileFsFullSizeInformation creates FileFsFullSizeInformation response
-func (h *SMBHandler) buildFileFsFullSizeInformation() []byte {
+func (h *SMBHandler) buildFileFsFullSizeInformation(share *Share) []byte {
+	total, free, unitSize := share.DiskSpace()
+	bytesPerSector := share.BytesPerSector()
+
 	w := NewByteWriter(32)
-	// Report 1TB total, 500GB available as defaults
-	totalUnits := uint64(1024 * 1024 * 256)    // 1TB in 4KB units
-	availableUnits := uint64(1024 * 1024 * 128) // 500GB in 4KB units
-	w.WriteUint64(totalUnits)       // TotalAllocationUnits
-	w.WriteUint64(availableUnits)   // CallerAvailableAllocationUnits
-	w.WriteUint64(availableUnits)   // ActualAvailableAllocationUnits
-	w.WriteUint32(8)                // SectorsPerAllocationUnit (4KB = 8 * 512)
-	w.WriteUint32(512)              // BytesPerSector
+	w.WriteUint64(total / uint64(unitSize))  // TotalAllocationUnits
+	w.WriteUint64(free / uint64(unitSize))   // CallerAvailableAllocationUnits
+	w.WriteUint64(free / uint64(unitSize))   // ActualAvailableAllocationUnits
+	w.WriteUint32(unitSize / bytesPerSector) // SectorsPerAllocationUnit
+	w.WriteUint32(bytesPerSector)            // BytesPerSector
+	return w.Bytes()
+}
+
+// buildFileFsSectorSizeInformation creates FileFsSectorSizeInformation response
+func (h *SMBHandler) buildFileFsSectorSizeInformation(share *Share) []byte {
+	bytesPerSector := share.BytesPerSector()
+
+	w := NewByteWriter(28)
+	w.WriteUint32(bytesPerSector) // LogicalBytesPerSector
+	w.WriteUint32(bytesPerSector) // PhysicalBytesPerSectorForAtomicity
+	w.WriteUint32(bytesPerSector) // PhysicalBytesPerSectorForPerformance
+	w.WriteUint32(bytesPerSector) // FileSystemEffectivePhysicalBytesPerSectorForAtomicity
+	w.WriteUint32(0)              // Flags
+	w.WriteUint32(0)              // ByteOffsetForSectorAlignment
+	w.WriteUint32(0)              // ByteOffsetForPartitionAlignment
 	return w.Bytes()
 }
 
@@ -425,7 +515,14 @@ func (h *SMBHandler) handleSetInfo(state *connState, msg *SMB2Message) ([]byte,
 
 	switch infoType {
 	case SMB2_0_INFO_FILE:
+		var audit *AuditEvent
+		if fileInfoClass == FileRenameInformation {
+			audit = h.auditRequest(msg, session, tree, AuditRename, of.Path)
+		}
 		status = h.setFileInfo(tree.Share, of, fileInfoClass, buffer)
+		if audit != nil && status == STATUS_SUCCESS {
+			audit.NewPath = of.Path
+		}
 	case SMB2_0_INFO_FILESYSTEM:
 		// Filesystem info is read-only
 		return h.buildErrorResponse(), STATUS_NOT_SUPPORTED
@@ -454,7 +551,7 @@ func (h *SMBHandler) handleSetInfo(state *connState, msg *SMB2Message) ([]byte,
 func (h *SMBHandler) setFileInfo(share *Share, of *OpenFile, fileInfoClass uint8, buffer []byte) NTStatus {
 	switch fileInfoClass {
 	case FileBasicInformation:
-		return h.setFileBasicInformation(of, buffer)
+		return h.setFileBasicInformation(share, of, buffer)
 
 	case FileDispositionInformation:
 		return h.setFileDispositionInformation(share, of, buffer)
@@ -462,8 +559,26 @@ func (h *SMBHandler) setFileInfo(share *Share, of *OpenFile, fileInfoClass uint8
 	case FileRenameInformation:
 		return h.setFileRenameInformation(share, of, buffer)
 
+	case FileLinkInformation:
+		return h.setFileLinkInformation(share, of, buffer)
+
 	case FileEndOfFileInformation:
-		return h.setFileEndOfFileInformation(of, buffer)
+		return h.setFileEndOfFileInformation(share, of, buffer)
+
+	case FileAllocationInformation:
+		return h.setFileAllocationInformation(share, of, buffer)
+
+	case FileValidDataLengthInformation:
+		return h.setFileValidDataLengthInformation(of, buffer)
+
+	case FileFullEaInformation:
+		return h.setFileFullEaInformation(share, of, buffer)
+
+	case FileCompressionInformation:
+		return h.setFileCompressionInformation(of, buffer)
+
+	case FilePositionInformation:
+		return h.setFilePositionInformation(share, of, buffer)
 
 	default:
 		h.server.logger.Debug("Unsupported set file info class: %d", fileInfoClass)
@@ -472,7 +587,7 @@ func (h *SMBHandler) setFileInfo(share *Share, of *OpenFile, fileInfoClass uint8
 }
 
 // setFileBasicInformation handles FileBasicInformation set
-func (h *SMBHandler) setFileBasicInformation(of *OpenFile, buffer []byte) NTStatus {
+func (h *SMBHandler) setFileBasicInformation(share *Share, of *OpenFile, buffer []byte) NTStatus {
 	if len(buffer) < 40 {
 		return STATUS_INVALID_PARAMETER
 	}
@@ -509,6 +624,9 @@ func (h *SMBHandler) setFileBasicInformation(of *OpenFile, buffer []byte) NTStat
 				// Don't fail on chmod errors as not all filesystems support it
 			}
 		}
+		if !of.IsDir {
+			share.setArchive(of.Path, fileAttributes&FILE_ATTRIBUTE_ARCHIVE != 0)
+		}
 	}
 
 	return STATUS_SUCCESS
@@ -522,6 +640,19 @@ func (h *SMBHandler) setFileDispositionInformation(share *Share, of *OpenFile, b
 
 	deleteOnClose := buffer[0] != 0
 
+	// A directory can only be deleted once empty, and the client must learn
+	// that now: a failed delete at CLOSE cannot be reported
+	if deleteOnClose && of.IsDir {
+		entries, err := share.FileSystem().ReadDir(of.Path)
+		if err != nil {
+			return mapGoErrorToNTStatus(err)
+		}
+		if len(entries) > 0 {
+			h.server.logger.Debug("Refusing DeleteOnClose for non-empty directory %s", of.Path)
+			return STATUS_DIRECTORY_NOT_EMPTY
+		}
+	}
+
 	h.server.logger.Debug("Setting DeleteOnClose=%v for %s", deleteOnClose, of.Path)
 
 	// Set the delete on close flag
@@ -530,39 +661,78 @@ func (h *SMBHandler) setFileDispositionInformation(share *Share, of *OpenFile, b
 	return STATUS_SUCCESS
 }
 
-// setFileRenameInformation handles FileRenameInformation set
-func (h *SMBHandler) setFileRenameInformation(share *Share, of *OpenFile, buffer []byte) NTStatus {
+// parseTargetName parses the FILE_RENAME_INFORMATION layout that
+// FileRenameInformation and FileLinkInformation share into the path it
+// names and its ReplaceIfExists flag. The name is relative to the
+// RootDirectory handle if one is given; otherwise a name containing
+// separators is a path from the share root, and a bare name is in the
+// directory of the file. The directories of a path are found ignoring
+// case unless the share is case-sensitive
+func parseTargetName(share *Share, of *OpenFile, buffer []byte) (string, bool, NTStatus) {
 	if len(buffer) < 20 {
-		return STATUS_INVALID_PARAMETER
+		return "", false, STATUS_INVALID_PARAMETER
 	}
 
 	r := NewByteReader(buffer)
-	replaceIfExists := r.ReadOneByte()
+	replaceIfExists := r.ReadOneByte() != 0
 	_ = r.ReadBytes(7) // Reserved
-	_ = r.ReadUint64() // RootDirectory (not used)
+	rootDirectory := r.ReadUint64()
 	fileNameLength := r.ReadUint32()
 
 	if r.Remaining() < int(fileNameLength) {
-		return STATUS_INVALID_PARAMETER
+		return "", false, STATUS_INVALID_PARAMETER
+	}
+
+	newName := strings.ReplaceAll(r.ReadUTF16String(int(fileNameLength)), "\\", "/")
+	if strings.Trim(newName, "/") == "" {
+		return "", false, STATUS_INVALID_PARAMETER
 	}
 
-	newName := r.ReadUTF16String(int(fileNameLength))
+	var target string
+	switch {
+	case rootDirectory != 0:
+		dir := share.fileHandles.getByVolatile(rootDirectory, of.TreeID, of.SessionID)
+		if dir == nil || !dir.IsDir {
+			return "", false, STATUS_INVALID_PARAMETER
+		}
+		target = shareRelativePath(path.Join(dir.Path, newName))
+	case strings.Contains(newName, "/"):
+		target = shareRelativePath(newName)
+	default:
+		return path.Join(path.Dir(of.Path), newName), replaceIfExists, STATUS_SUCCESS
+	}
+	return share.resolveParentCase(target), replaceIfExists, STATUS_SUCCESS
+}
 
-	h.server.logger.Debug("Renaming %s to %s (replace=%v)", of.Path, newName, replaceIfExists)
+// setFileRenameInformation handles FileRenameInformation set
+func (h *SMBHandler) setFileRenameInformation(share *Share, of *OpenFile, buffer []byte) NTStatus {
+	newPath, replaceIfExists, status := parseTargetName(share, of, buffer)
+	if status != STATUS_SUCCESS {
+		return status
+	}
+
+	h.server.logger.Debug("Renaming %s to %s (replace=%v)", of.Path, newPath, replaceIfExists)
+
+	if newPath == of.Path {
+		return STATUS_SUCCESS
+	}
 
-	// Convert to filesystem path
-	newPath := path.Join(path.Dir(of.Path), newName)
+	// The target directory must exist
+	if info, err := share.FileSystem().Stat(path.Join("/", path.Dir(newPath))); err != nil || !info.IsDir() {
+		return STATUS_OBJECT_PATH_NOT_FOUND
+	}
 
 	// Check if target exists
-	if _, err := share.fs.Stat(newPath); err == nil {
-		if replaceIfExists == 0 {
+	if _, err := share.FileSystem().Stat(newPath); err == nil {
+		if !replaceIfExists {
 			return STATUS_OBJECT_NAME_COLLISION
 		}
 	}
 
 	// Perform rename
-	if renamer, ok := share.fs.(interface{ Rename(oldname, newname string) error }); ok {
-		if err := renamer.Rename(of.Path, newPath); err != nil {
+	if renamer, ok := share.FileSystem().(interface{ Rename(oldname, newname string) error }); ok {
+		oldPath := of.Path
+		if err := renamer.Rename(oldPath, newPath); err != nil {
 			h.server.logger.Debug("Rename failed: %v", err)
 			if os.IsNotExist(err) {
 				return STATUS_OBJECT_NAME_NOT_FOUND
@@ -570,8 +740,19 @@ func (h *SMBHandler) setFileRenameInformation(share *Share, of *OpenFile, buffer
 			return STATUS_ACCESS_DENIED
 		}
 
-		// Update the file handle path
-		of.Path = newPath
+		share.renameCreation(oldPath, newPath)
+		share.renameArchive(oldPath, newPath)
+		share.renameFileIDs(oldPath, newPath)
+		share.forgetUsage() // A replaced target freed its space
+
+		// Both the old and new parent directories changed
+		h.breakParentDirectoryLease(share, oldPath, of.parentLease)
+		if path.Dir(newPath) != path.Dir(oldPath) {
+			h.breakParentDirectoryLease(share, newPath, of.parentLease)
+		}
+
+		// Move this handle, and any open below a renamed directory
+		share.fileHandles.renamePath(oldPath, newPath)
 
 		return STATUS_SUCCESS
 	}
@@ -579,25 +760,220 @@ func (h *SMBHandler) setFileRenameInformation(share *Share, of *OpenFile, buffer
 	return STATUS_NOT_SUPPORTED
 }
 
+// setFileLinkInformation handles FileLinkInformation set, which gives a
+// file another name on a filesystem that implements Linker. A name already
+// in use is replaced only if ReplaceIfExists is set, and never when it
+// names a directory or a file that is open
+func (h *SMBHandler) setFileLinkInformation(share *Share, of *OpenFile, buffer []byte) NTStatus {
+	fsys := share.FileSystem()
+	linker, ok := fsys.(Linker)
+	if !ok {
+		return STATUS_NOT_SUPPORTED
+	}
+	if of.IsDir {
+		return STATUS_FILE_IS_A_DIRECTORY
+	}
+
+	newPath, replaceIfExists, status := parseTargetName(share, of, buffer)
+	if status != STATUS_SUCCESS {
+		return status
+	}
+
+	h.server.logger.Debug("Linking %s to %s (replace=%v)", newPath, of.Path, replaceIfExists)
+
+	if newPath == of.Path {
+		return STATUS_SUCCESS
+	}
+
+	// The target directory must exist
+	if info, err := fsys.Stat(path.Join("/", path.Dir(newPath))); err != nil || !info.IsDir() {
+		return STATUS_OBJECT_PATH_NOT_FOUND
+	}
+
+	if info, err := fsys.Stat(newPath); err == nil {
+		switch {
+		case !replaceIfExists:
+			return STATUS_OBJECT_NAME_COLLISION
+		case info.IsDir() || len(share.fileHandles.GetOpenHandlesForPath(newPath)) > 0:
+			return STATUS_ACCESS_DENIED
+		}
+		if err := fsys.Remove(newPath); err != nil {
+			h.server.logger.Debug("Removing link target failed: %v", err)
+			return mapGoErrorToNTStatus(err)
+		}
+		share.forgetArchive(newPath)
+		share.forgetUsage()
+	}
+
+	if err := linker.Link(of.Path, newPath); err != nil {
+		h.server.logger.Debug("Link failed: %v", err)
+		return mapGoErrorToNTStatus(err)
+	}
+
+	h.breakParentDirectoryLease(share, newPath, of.parentLease)
+	return STATUS_SUCCESS
+}
+
+// shareRelativePath cleans a path from the share root into the form CREATE
+// gives handle paths: no leading slash, and "/" for the root. ".." cannot
+// climb above the root
+func shareRelativePath(p string) string {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return "/"
+	}
+	return p
+}
+
 // setFileEndOfFileInformation handles FileEndOfFileInformation set
-func (h *SMBHandler) setFileEndOfFileInformation(of *OpenFile, buffer []byte) NTStatus {
+func (h *SMBHandler) setFileEndOfFileInformation(share *Share, of *OpenFile, buffer []byte) NTStatus {
 	if len(buffer) < 8 {
 		return STATUS_INVALID_PARAMETER
 	}
 
 	r := NewByteReader(buffer)
 	endOfFile := r.ReadUint64()
+	if endOfFile > 1<<62 {
+		return STATUS_INVALID_PARAMETER
+	}
 
 	h.server.logger.Debug("Truncating %s to size %d", of.Path, endOfFile)
 
 	// Truncate the file
 	if truncater, ok := of.File.(interface{ Truncate(size int64) error }); ok {
+		if share.limitsSize() {
+			info, err := of.File.Stat()
+			if err != nil {
+				return mapGoErrorToNTStatus(err)
+			}
+			if status := share.reserveSpace(info.Size(), int64(endOfFile)); status != STATUS_SUCCESS {
+				return status
+			}
+		}
 		if err := truncater.Truncate(int64(endOfFile)); err != nil {
 			h.server.logger.Debug("Truncate failed: %v", err)
+			share.forgetUsage()
 			return STATUS_ACCESS_DENIED
 		}
+		share.setArchive(of.Path, true)
 		return STATUS_SUCCESS
 	}
 
 	return STATUS_NOT_SUPPORTED
 }
+
+// setFileAllocationInformation handles FileAllocationInformation set
+// Shrinking the allocation below the file's size truncates the file; growing
+// it reserves space, on the backend if the file is a Fallocater, without
+// changing the file's size
+func (h *SMBHandler) setFileAllocationInformation(share *Share, of *OpenFile, buffer []byte) NTStatus {
+	if len(buffer) < 8 {
+		return STATUS_INVALID_PARAMETER
+	}
+	if of.IsDir {
+		return STATUS_INVALID_PARAMETER
+	}
+
+	r := NewByteReader(buffer)
+	allocationSize := r.ReadUint64()
+	if allocationSize > 1<<62 {
+		return STATUS_INVALID_PARAMETER
+	}
+
+	info, err := of.File.Stat()
+	if err != nil {
+		return mapGoErrorToNTStatus(err)
+	}
+
+	h.server.logger.Debug("Setting allocation of %s to %d (size %d)", of.Path, allocationSize, info.Size())
+
+	// Space reserved beyond the end of the file must fit the share's limits,
+	// though only the file's size counts as used
+	if status := share.checkSpace(info.Size(), int64(allocationSize)); status != STATUS_SUCCESS {
+		return status
+	}
+
+	if allocationSize < uint64(info.Size()) {
+		truncater, ok := of.File.(interface{ Truncate(size int64) error })
+		if !ok {
+			return STATUS_NOT_SUPPORTED
+		}
+		if err := truncater.Truncate(int64(allocationSize)); err != nil {
+			h.server.logger.Debug("Truncate failed: %v", err)
+			return STATUS_ACCESS_DENIED
+		}
+		share.reserveSpace(info.Size(), int64(allocationSize))
+		share.setArchive(of.Path, true)
+	} else if fa, ok := of.File.(Fallocater); ok && allocationSize > uint64(info.Size()) {
+		if err := fa.Fallocate(int64(allocationSize)); err != nil {
+			h.server.logger.Debug("Fallocate failed: %v", err)
+			return mapGoErrorToNTStatus(err)
+		}
+	}
+
+	share.fileHandles.SetAllocation(of, roundAllocation(allocationSize))
+	return STATUS_SUCCESS
+}
+
+// setFileValidDataLengthInformation handles FileValidDataLengthInformation
+// set. Backends do not track valid data, so a length within the file is
+// accepted without further effect
+func (h *SMBHandler) setFileValidDataLengthInformation(of *OpenFile, buffer []byte) NTStatus {
+	if len(buffer) < 8 {
+		return STATUS_INVALID_PARAMETER
+	}
+	if of.IsDir {
+		return STATUS_INVALID_PARAMETER
+	}
+
+	r := NewByteReader(buffer)
+	validDataLength := r.ReadUint64()
+
+	info, err := of.File.Stat()
+	if err != nil {
+		return mapGoErrorToNTStatus(err)
+	}
+	if validDataLength > uint64(info.Size()) {
+		return STATUS_INVALID_PARAMETER
+	}
+	return STATUS_SUCCESS
+}
+
+// filePosition returns the current position of an open file, or 0 if the
+// file cannot seek
+func filePosition(of *OpenFile) int64 {
+	seeker, ok := of.File.(io.Seeker)
+	if !ok {
+		return 0
+	}
+	pos, _ := seeker.Seek(0, io.SeekCurrent)
+	return pos
+}
+
+// setFilePositionInformation handles FilePositionInformation set, moving
+// the position READ and WRITE use at FILE_USE_FILE_POINTER_POSITION
+func (h *SMBHandler) setFilePositionInformation(share *Share, of *OpenFile, buffer []byte) NTStatus {
+	if len(buffer) < 8 {
+		return STATUS_INVALID_PARAMETER
+	}
+
+	r := NewByteReader(buffer)
+	offset := r.ReadUint64() // CurrentByteOffset
+	if offset > math.MaxInt64 {
+		return STATUS_INVALID_PARAMETER
+	}
+	// Unbuffered handles may only be placed on an alignment boundary
+	if of.Options&FILE_NO_INTERMEDIATE_BUFFERING != 0 && !share.isAlignedIO(offset, 0) {
+		return STATUS_INVALID_PARAMETER
+	}
+
+	seeker, ok := of.File.(io.Seeker)
+	if !ok {
+		return STATUS_NOT_SUPPORTED
+	}
+	if _, err := seeker.Seek(int64(offset), io.SeekStart); err != nil {
+		h.server.logger.Debug("Seek failed for %s: %v", of.Path, err)
+		return mapGoErrorToNTStatus(err)
+	}
+	return STATUS_SUCCESS
+}
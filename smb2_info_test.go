@@ -0,0 +1,783 @@
+package smbfs
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+// buildSetInfoRequest builds a SET_INFO request payload
+func buildSetInfoRequest(fileID FileID, infoType, infoClass uint8, buffer []byte) []byte {
+	w := NewByteWriter(32 + len(buffer))
+	w.WriteUint16(33)                          // StructureSize
+	w.WriteOneByte(infoType)                   // InfoType
+	w.WriteOneByte(infoClass)                  // FileInfoClass
+	w.WriteUint32(uint32(len(buffer)))         // BufferLength
+	w.WriteUint16(uint16(SMB2HeaderSize + 32)) // BufferOffset
+	w.WriteUint16(0)                           // Reserved
+	w.WriteUint32(0)                           // AdditionalInformation
+	w.WriteFileID(fileID)                      // FileId
+	w.WriteBytes(buffer)                       // Buffer
+	return w.Bytes()
+}
+
+// fallocateFile records the sizes an absfs.File is asked to preallocate
+type fallocateFile struct {
+	absfs.File
+	sizes []int64
+}
+
+func (f *fallocateFile) Fallocate(size int64) error {
+	f.sizes = append(f.sizes, size)
+	return nil
+}
+
+// TestSetInfo_Allocation tests preallocating space with
+// FileAllocationInformation and setting FileValidDataLengthInformation
+func TestSetInfo_Allocation(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	share := tree.Share
+	f, _ := share.fs.Create("/db.bin")
+	f.Write(make([]byte, 100))
+	f.Close()
+
+	file, err := share.fs.OpenFile("/db.bin", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	backend := &fallocateFile{File: file}
+	of := share.fileHandles.Allocate(backend, "/db.bin", false, FILE_READ_DATA|FILE_WRITE_DATA,
+		FILE_SHARE_READ|FILE_SHARE_WRITE, FILE_OPEN, 0, tree.ID, session.ID)
+
+	setInfo := func(class uint8, value uint64) NTStatus {
+		t.Helper()
+		buf := make([]byte, 8)
+		le.PutUint64(buf, value)
+		_, status := srv.handler.handleSetInfo(nil, testRequest(session, tree, SMB2_SET_INFO,
+			buildSetInfoRequest(of.ID, SMB2_0_INFO_FILE, class, buf)))
+		return status
+	}
+	// standardInfo returns the AllocationSize and EndOfFile of the file
+	standardInfo := func() (uint64, uint64) {
+		t.Helper()
+		resp, status := srv.handler.handleQueryInfo(nil, testRequest(session, tree, SMB2_QUERY_INFO,
+			buildQueryInfoRequest(of.ID, SMB2_0_INFO_FILE, FileStandardInformation, 0, 1024)))
+		if status != STATUS_SUCCESS {
+			t.Fatalf("QUERY_INFO status = %v, want STATUS_SUCCESS", status)
+		}
+		r := NewByteReader(resp[8:])
+		return r.ReadUint64(), r.ReadUint64()
+	}
+
+	if alloc, size := standardInfo(); alloc != 4096 || size != 100 {
+		t.Fatalf("before preallocation AllocationSize, EndOfFile = %d, %d, want 4096, 100", alloc, size)
+	}
+
+	if status := setInfo(FileAllocationInformation, 1<<20); status != STATUS_SUCCESS {
+		t.Fatalf("SET_INFO FileAllocationInformation status = %v, want STATUS_SUCCESS", status)
+	}
+	if alloc, size := standardInfo(); alloc != 1<<20 || size != 100 {
+		t.Errorf("after preallocation AllocationSize, EndOfFile = %d, %d, want %d, 100", alloc, size, 1<<20)
+	}
+	if len(backend.sizes) != 1 || backend.sizes[0] != 1<<20 {
+		t.Errorf("Fallocate() calls = %v, want [%d]", backend.sizes, 1<<20)
+	}
+
+	// Valid data length must lie within the file
+	if status := setInfo(FileValidDataLengthInformation, 50); status != STATUS_SUCCESS {
+		t.Errorf("SET_INFO FileValidDataLengthInformation(50) status = %v, want STATUS_SUCCESS", status)
+	}
+	if status := setInfo(FileValidDataLengthInformation, 200); status != STATUS_INVALID_PARAMETER {
+		t.Errorf("SET_INFO FileValidDataLengthInformation(200) status = %v, want STATUS_INVALID_PARAMETER", status)
+	}
+
+	// An allocation below the size truncates the file
+	if status := setInfo(FileAllocationInformation, 10); status != STATUS_SUCCESS {
+		t.Fatalf("SET_INFO FileAllocationInformation(10) status = %v, want STATUS_SUCCESS", status)
+	}
+	if alloc, size := standardInfo(); alloc != 4096 || size != 10 {
+		t.Errorf("after shrinking AllocationSize, EndOfFile = %d, %d, want 4096, 10", alloc, size)
+	}
+
+	// The reservation goes away with the open
+	if status := setInfo(FileAllocationInformation, 1<<16); status != STATUS_SUCCESS {
+		t.Fatalf("SET_INFO FileAllocationInformation status = %v, want STATUS_SUCCESS", status)
+	}
+	share.fileHandles.Release(of.ID)
+	info, _ := share.fs.Stat("/db.bin")
+	if alloc := share.allocationSize("/db.bin", info); alloc != 4096 {
+		t.Errorf("AllocationSize after close = %d, want 4096", alloc)
+	}
+}
+
+// compressFile keeps the compression format an absfs.File is set to
+type compressFile struct {
+	absfs.File
+	format uint16
+}
+
+func (f *compressFile) CompressionFormat() (uint16, error) { return f.format, nil }
+
+func (f *compressFile) SetCompressionFormat(format uint16) error {
+	f.format = format
+	return nil
+}
+
+// TestFileCompressionInformation tests that files are reported
+// uncompressed, and that setting compression is accepted as far as the
+// backend supports it
+func TestFileCompressionInformation(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	share := tree.Share
+	f, _ := share.fs.Create("/plain.txt")
+	f.Write(make([]byte, 5000))
+	f.Close()
+
+	file, err := share.fs.OpenFile("/plain.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	of := share.fileHandles.Allocate(file, "/plain.txt", false, FILE_READ_DATA|FILE_WRITE_DATA,
+		FILE_SHARE_READ|FILE_SHARE_WRITE, FILE_OPEN, 0, tree.ID, session.ID)
+	defer share.fileHandles.Release(of.ID)
+
+	query := func() []byte {
+		t.Helper()
+		resp, status := srv.handler.handleQueryInfo(nil, testRequest(session, tree, SMB2_QUERY_INFO,
+			buildQueryInfoRequest(of.ID, SMB2_0_INFO_FILE, FileCompressionInformation, 0, 1024)))
+		if status != STATUS_SUCCESS {
+			t.Fatalf("QUERY_INFO status = %v, want STATUS_SUCCESS", status)
+		}
+		return resp[8:]
+	}
+	setFormat := func(format uint16) NTStatus {
+		t.Helper()
+		buf := make([]byte, 16)
+		le.PutUint16(buf[8:], format)
+		_, status := srv.handler.handleSetInfo(nil, testRequest(session, tree, SMB2_SET_INFO,
+			buildSetInfoRequest(of.ID, SMB2_0_INFO_FILE, FileCompressionInformation, buf)))
+		return status
+	}
+
+	info := query()
+	if len(info) != 16 {
+		t.Fatalf("FileCompressionInformation is %d bytes, want 16", len(info))
+	}
+	r := NewByteReader(info)
+	if size := r.ReadUint64(); size != 5000 {
+		t.Errorf("CompressedFileSize = %d, want 5000", size)
+	}
+	if format := r.ReadUint16(); format != COMPRESSION_FORMAT_NONE {
+		t.Errorf("CompressionFormat = %d, want COMPRESSION_FORMAT_NONE", format)
+	}
+	if unit, chunk, cluster := r.ReadOneByte(), r.ReadOneByte(), r.ReadOneByte(); unit != 16 || chunk != 12 || cluster != 12 {
+		t.Errorf("CompressionUnitShift, ChunkShift, ClusterShift = %d, %d, %d, want 16, 12, 12", unit, chunk, cluster)
+	}
+
+	if status := setFormat(COMPRESSION_FORMAT_NONE); status != STATUS_SUCCESS {
+		t.Errorf("SET_INFO COMPRESSION_FORMAT_NONE status = %v, want STATUS_SUCCESS", status)
+	}
+	if status := setFormat(COMPRESSION_FORMAT_LZNT1); status != STATUS_INVALID_DEVICE_REQUEST {
+		t.Errorf("SET_INFO COMPRESSION_FORMAT_LZNT1 status = %v, want STATUS_INVALID_DEVICE_REQUEST", status)
+	}
+
+	// A Compressor backend takes the format
+	backend := &compressFile{File: file}
+	of.File = backend
+	if status := setFormat(COMPRESSION_FORMAT_LZNT1); status != STATUS_SUCCESS {
+		t.Fatalf("SET_INFO COMPRESSION_FORMAT_LZNT1 status = %v, want STATUS_SUCCESS", status)
+	}
+	if backend.format != COMPRESSION_FORMAT_LZNT1 {
+		t.Errorf("backend format = %d, want COMPRESSION_FORMAT_LZNT1", backend.format)
+	}
+	if format := le.Uint16(query()[8:]); format != COMPRESSION_FORMAT_LZNT1 {
+		t.Errorf("CompressionFormat = %d, want COMPRESSION_FORMAT_LZNT1", format)
+	}
+	if status := setFormat(0x7); status != STATUS_INVALID_PARAMETER {
+		t.Errorf("SET_INFO of an unknown format status = %v, want STATUS_INVALID_PARAMETER", status)
+	}
+}
+
+// streamFS gives files of a filesystem named streams
+type streamFS struct {
+	absfs.FileSystem
+	streams map[string][]StreamInfo
+}
+
+func (s *streamFS) Streams(name string) ([]StreamInfo, error) {
+	return s.streams[name], nil
+}
+
+// TestQueryInfo_FileStreamInformation tests that a file lists its unnamed
+// data stream, followed by any named streams, and a directory none
+func TestQueryInfo_FileStreamInformation(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	share := tree.Share
+	share.fs.Mkdir("/dir", 0755)
+	f, _ := share.fs.Create("/doc.txt")
+	f.Write(make([]byte, 100))
+	f.Close()
+
+	type stream struct {
+		name             string
+		size, allocation uint64
+	}
+	queryStreams := func(name string, isDir bool) []stream {
+		t.Helper()
+		file, err := share.fs.Open(name)
+		if err != nil {
+			t.Fatalf("Open(%s) error = %v", name, err)
+		}
+		of := share.fileHandles.Allocate(file, name, isDir, FILE_READ_ATTRIBUTES,
+			FILE_SHARE_READ, FILE_OPEN, 0, tree.ID, session.ID)
+		defer share.fileHandles.Release(of.ID)
+
+		resp, status := srv.handler.handleQueryInfo(nil, testRequest(session, tree, SMB2_QUERY_INFO,
+			buildQueryInfoRequest(of.ID, SMB2_0_INFO_FILE, FileStreamInformation, 0, 1024)))
+		if status != STATUS_SUCCESS {
+			t.Fatalf("QUERY_INFO FileStreamInformation of %s status = %v, want STATUS_SUCCESS", name, status)
+		}
+		buf := resp[8 : 8+le.Uint32(resp[4:8])]
+
+		var streams []stream
+		for len(buf) > 0 {
+			r := NewByteReader(buf)
+			next := r.ReadUint32()
+			nameLen := r.ReadUint32()
+			st := stream{size: r.ReadUint64(), allocation: r.ReadUint64()}
+			st.name = DecodeUTF16LEToString(buf[24 : 24+nameLen])
+			streams = append(streams, st)
+			if next == 0 {
+				break
+			}
+			if next%8 != 0 {
+				t.Errorf("NextEntryOffset = %d, want 8-byte aligned", next)
+			}
+			buf = buf[next:]
+		}
+		return streams
+	}
+
+	got := queryStreams("/doc.txt", false)
+	if len(got) != 1 || got[0] != (stream{"::$DATA", 100, 4096}) {
+		t.Errorf("streams of a file = %+v, want [::$DATA 100 4096]", got)
+	}
+	if got := queryStreams("/dir", true); len(got) != 0 {
+		t.Errorf("streams of a directory = %+v, want none", got)
+	}
+
+	share.fs = &streamFS{FileSystem: share.fs, streams: map[string][]StreamInfo{
+		"/doc.txt": {{Name: "Zone.Identifier", Size: 26}, {Name: "thumb", Size: 5000}},
+	}}
+	want := []stream{{"::$DATA", 100, 4096}, {":Zone.Identifier:$DATA", 26, 4096}, {":thumb:$DATA", 5000, 8192}}
+	got = queryStreams("/doc.txt", false)
+	if len(got) != len(want) {
+		t.Fatalf("streams with StreamFS = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("stream %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+// buildRenameInformation builds a FILE_RENAME_INFORMATION buffer
+func buildRenameInformation(name string, replace bool, rootDirectory uint64) []byte {
+	encoded := EncodeStringToUTF16LE(name)
+	w := NewByteWriter(20 + len(encoded))
+	if replace {
+		w.WriteOneByte(1) // ReplaceIfExists
+	} else {
+		w.WriteOneByte(0)
+	}
+	w.WriteZeros(7)                     // Reserved
+	w.WriteUint64(rootDirectory)        // RootDirectory
+	w.WriteUint32(uint32(len(encoded))) // FileNameLength
+	w.WriteBytes(encoded)               // FileName
+	return w.Bytes()
+}
+
+// TestSetInfo_RenameAcrossDirectories tests FileRenameInformation with
+// target paths from the share root and relative to a RootDirectory handle
+func TestSetInfo_RenameAcrossDirectories(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	share := tree.Share
+	for _, dir := range []string{"/a", "/b", "/c"} {
+		if err := share.fs.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("Mkdir(%s) error = %v", dir, err)
+		}
+	}
+	f, _ := share.fs.Create("/a/x.txt")
+	f.Write([]byte("moved"))
+	f.Close()
+
+	file, err := share.fs.OpenFile("a/x.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	of := share.fileHandles.Allocate(file, "a/x.txt", false, FILE_READ_DATA|DELETE,
+		FILE_SHARE_READ, FILE_OPEN, 0, tree.ID, session.ID)
+	rename := func(name string, replace bool, root uint64) NTStatus {
+		t.Helper()
+		_, status := srv.handler.handleSetInfo(nil, testRequest(session, tree, SMB2_SET_INFO,
+			buildSetInfoRequest(of.ID, SMB2_0_INFO_FILE, FileRenameInformation, buildRenameInformation(name, replace, root))))
+		return status
+	}
+
+	if status := rename(`b\x.txt`, false, 0); status != STATUS_SUCCESS {
+		t.Fatalf("rename to b\\x.txt status = %v, want STATUS_SUCCESS", status)
+	}
+	if _, err := share.fs.Stat("/b/x.txt"); err != nil {
+		t.Errorf("Stat(/b/x.txt) error = %v", err)
+	}
+	if _, err := share.fs.Stat("/a/x.txt"); !os.IsNotExist(err) {
+		t.Errorf("Stat(/a/x.txt) after rename error = %v, want not exist", err)
+	}
+	if of.Path != "b/x.txt" {
+		t.Errorf("handle path = %q, want b/x.txt", of.Path)
+	}
+	if got := share.fileHandles.GetOpenHandlesForPath("b/x.txt"); len(got) != 1 || got[0] != of {
+		t.Errorf("handles at b/x.txt = %v, want the renamed handle", got)
+	}
+	if got := share.fileHandles.GetOpenHandlesForPath("a/x.txt"); len(got) != 0 {
+		t.Errorf("handles at a/x.txt = %d, want 0", len(got))
+	}
+
+	// A bare name still renames within the current directory
+	if status := rename("y.txt", false, 0); status != STATUS_SUCCESS || of.Path != "b/y.txt" {
+		t.Errorf("rename to y.txt = %v, %q, want STATUS_SUCCESS, b/y.txt", status, of.Path)
+	}
+
+	// RootDirectory names the directory the target is relative to
+	dir, err := share.fs.Open("c")
+	if err != nil {
+		t.Fatalf("Open(c) error = %v", err)
+	}
+	dirHandle := share.fileHandles.Allocate(dir, "c", true, FILE_READ_DATA,
+		FILE_SHARE_READ|FILE_SHARE_WRITE|FILE_SHARE_DELETE, FILE_OPEN, FILE_DIRECTORY_FILE, tree.ID, session.ID)
+	if status := rename("z.txt", false, dirHandle.ID.Volatile); status != STATUS_SUCCESS || of.Path != "c/z.txt" {
+		t.Errorf("rename relative to RootDirectory = %v, %q, want STATUS_SUCCESS, c/z.txt", status, of.Path)
+	}
+	if status := rename("z.txt", false, of.ID.Volatile); status != STATUS_INVALID_PARAMETER {
+		t.Errorf("rename relative to a file handle status = %v, want STATUS_INVALID_PARAMETER", status)
+	}
+
+	// Targets stay inside the share, and their directory must exist
+	if status := rename(`..\..\escaped.txt`, false, 0); status != STATUS_SUCCESS || of.Path != "escaped.txt" {
+		t.Errorf("rename above the root = %v, %q, want STATUS_SUCCESS, escaped.txt", status, of.Path)
+	}
+	if status := rename(`missing\x.txt`, false, 0); status != STATUS_OBJECT_PATH_NOT_FOUND {
+		t.Errorf("rename into a missing directory status = %v, want STATUS_OBJECT_PATH_NOT_FOUND", status)
+	}
+}
+
+// TestSetInfo_DispositionNonEmptyDirectory tests that marking a directory
+// for deletion fails while it has entries and succeeds once it is empty
+func TestSetInfo_DispositionNonEmptyDirectory(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	share := tree.Share
+	for _, dir := range []string{"/full", "/empty"} {
+		if err := share.fs.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("Mkdir(%s) error = %v", dir, err)
+		}
+	}
+	f, _ := share.fs.Create("/full/x.txt")
+	f.Close()
+
+	openDir := func(path string) *OpenFile {
+		t.Helper()
+		dir, err := share.fs.Open(path)
+		if err != nil {
+			t.Fatalf("Open(%s) error = %v", path, err)
+		}
+		return share.fileHandles.Allocate(dir, path, true, FILE_READ_DATA|DELETE,
+			FILE_SHARE_READ|FILE_SHARE_WRITE|FILE_SHARE_DELETE, FILE_OPEN, FILE_DIRECTORY_FILE, tree.ID, session.ID)
+	}
+	setDisposition := func(of *OpenFile) NTStatus {
+		t.Helper()
+		_, status := srv.handler.handleSetInfo(nil, testRequest(session, tree, SMB2_SET_INFO,
+			buildSetInfoRequest(of.ID, SMB2_0_INFO_FILE, FileDispositionInformation, []byte{1})))
+		return status
+	}
+
+	full := openDir("full")
+	if status := setDisposition(full); status != STATUS_DIRECTORY_NOT_EMPTY {
+		t.Errorf("disposition of a non-empty directory status = %v, want STATUS_DIRECTORY_NOT_EMPTY", status)
+	}
+	if share.fileHandles.GetDeleteOnClose(full.ID) {
+		t.Error("non-empty directory marked for deletion")
+	}
+
+	empty := openDir("empty")
+	if status := setDisposition(empty); status != STATUS_SUCCESS {
+		t.Errorf("disposition of an empty directory status = %v, want STATUS_SUCCESS", status)
+	}
+	if !share.fileHandles.GetDeleteOnClose(empty.ID) {
+		t.Error("empty directory not marked for deletion")
+	}
+
+	// Once emptied, the other directory can be marked too
+	if err := share.fs.Remove("/full/x.txt"); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if status := setDisposition(full); status != STATUS_SUCCESS {
+		t.Errorf("disposition of an emptied directory status = %v, want STATUS_SUCCESS", status)
+	}
+}
+
+// TestFileHandleMap_RenamePath tests that renaming a directory moves the
+// handles open below it
+func TestFileHandleMap_RenamePath(t *testing.T) {
+	m := NewFileHandleMap()
+	dir := m.Allocate(nil, "old", true, 0, 0, FILE_OPEN, 0, 1, 1)
+	child := m.Allocate(nil, "old/sub/f.txt", false, 0, 0, FILE_OPEN, 0, 1, 1)
+	sibling := m.Allocate(nil, "older/f.txt", false, 0, 0, FILE_OPEN, 0, 1, 1)
+
+	m.renamePath("old", "new/dir")
+
+	if dir.Path != "new/dir" || child.Path != "new/dir/sub/f.txt" || sibling.Path != "older/f.txt" {
+		t.Errorf("paths = %q, %q, %q, want new/dir, new/dir/sub/f.txt, older/f.txt", dir.Path, child.Path, sibling.Path)
+	}
+	if got := m.GetOpenHandlesForPath("new/dir/sub/f.txt"); len(got) != 1 {
+		t.Errorf("handles at new/dir/sub/f.txt = %d, want 1", len(got))
+	}
+	if got := m.GetOpenHandlesForPath("old/sub/f.txt"); len(got) != 0 {
+		t.Errorf("handles at old/sub/f.txt = %d, want 0", len(got))
+	}
+}
+
+// TestQueryFilesystemInfo_VolumeIdentity tests that FileFsVolumeInformation
+// reports each share's label and serial, and that FileFsAttributeInformation
+// flags read-only shares
+func TestQueryFilesystemInfo_VolumeIdentity(t *testing.T) {
+	const FILE_READ_ONLY_VOLUME = 0x00080000
+	srv, _, tree := setupTestTree(t)
+	fs := tree.Share.FileSystem()
+
+	volume := func(share *Share) (serial uint32, label string) {
+		t.Helper()
+		buf, status := srv.handler.queryFilesystemInfo(share, FileFsVolumeInformation)
+		if status != STATUS_SUCCESS {
+			t.Fatalf("FileFsVolumeInformation status = %v", status)
+		}
+		labelLen := le.Uint32(buf[12:16])
+		if int(18+labelLen) != len(buf) {
+			t.Fatalf("VolumeLabelLength = %d in a %d-byte response", labelLen, len(buf))
+		}
+		return le.Uint32(buf[8:12]), DecodeUTF16LEToString(buf[18:])
+	}
+
+	serial, label := volume(NewShare(fs, ShareOptions{ShareName: "backup", VolumeLabel: "Snapshots", VolumeSerial: 0xCAFEF00D}))
+	if serial != 0xCAFEF00D || label != "Snapshots" {
+		t.Errorf("volume = %#x %q, want 0xcafef00d %q", serial, label, "Snapshots")
+	}
+
+	// Unconfigured shares are told apart by name, consistently
+	serialA, labelA := volume(NewShare(fs, ShareOptions{ShareName: "alpha"}))
+	serialB, labelB := volume(NewShare(fs, ShareOptions{ShareName: "beta"}))
+	if labelA != "alpha" || labelB != "beta" {
+		t.Errorf("default labels = %q, %q, want the share names", labelA, labelB)
+	}
+	if serialA == serialB || serialA == 0 {
+		t.Errorf("default serials = %#x, %#x, want distinct nonzero values", serialA, serialB)
+	}
+	if again, _ := volume(NewShare(fs, ShareOptions{ShareName: "alpha"})); again != serialA {
+		t.Errorf("serial of alpha = %#x, then %#x", serialA, again)
+	}
+
+	for _, readOnly := range []bool{false, true} {
+		buf, _ := srv.handler.queryFilesystemInfo(NewShare(fs, ShareOptions{ShareName: "ro", ReadOnly: readOnly}), FileFsAttributeInformation)
+		if got := le.Uint32(buf[0:4])&FILE_READ_ONLY_VOLUME != 0; got != readOnly {
+			t.Errorf("ReadOnly %v: FILE_READ_ONLY_VOLUME set = %v", readOnly, got)
+		}
+	}
+}
+
+// TestQueryFilesystemInfo_DeviceAndControl tests FileFsDeviceInformation
+// for read-only and read-write shares, and the FileFsControlInformation
+// defaults
+func TestQueryFilesystemInfo_DeviceAndControl(t *testing.T) {
+	const (
+		FILE_DEVICE_DISK      = 0x00000007
+		FILE_READ_ONLY_DEVICE = 0x00000002
+		FILE_REMOTE_DEVICE    = 0x00000010
+	)
+	srv, _, tree := setupTestTree(t)
+	fs := tree.Share.FileSystem()
+
+	for _, readOnly := range []bool{false, true} {
+		share := NewShare(fs, ShareOptions{ShareName: "dev", ReadOnly: readOnly})
+		buf, status := srv.handler.queryFilesystemInfo(share, FileFsDeviceInformation)
+		if status != STATUS_SUCCESS || len(buf) != 8 {
+			t.Fatalf("FileFsDeviceInformation = %d bytes, %v; want 8 bytes, STATUS_SUCCESS", len(buf), status)
+		}
+		if deviceType := le.Uint32(buf[0:4]); deviceType != FILE_DEVICE_DISK {
+			t.Errorf("DeviceType = %#x, want FILE_DEVICE_DISK", deviceType)
+		}
+		characteristics := le.Uint32(buf[4:8])
+		if characteristics&FILE_REMOTE_DEVICE == 0 {
+			t.Errorf("Characteristics = %#x, want FILE_REMOTE_DEVICE set", characteristics)
+		}
+		if got := characteristics&FILE_READ_ONLY_DEVICE != 0; got != readOnly {
+			t.Errorf("ReadOnly %v: FILE_READ_ONLY_DEVICE set = %v", readOnly, got)
+		}
+	}
+
+	buf, status := srv.handler.queryFilesystemInfo(tree.Share, FileFsControlInformation)
+	if status != STATUS_SUCCESS || len(buf) != 48 {
+		t.Fatalf("FileFsControlInformation = %d bytes, %v; want 48 bytes, STATUS_SUCCESS", len(buf), status)
+	}
+	if threshold, limit := le.Uint64(buf[24:32]), le.Uint64(buf[32:40]); threshold != ^uint64(0) || limit != ^uint64(0) {
+		t.Errorf("default quota threshold/limit = %#x/%#x, want unlimited", threshold, limit)
+	}
+	if flags := le.Uint32(buf[40:44]); flags != 0 {
+		t.Errorf("FileSystemControlFlags = %#x, want 0", flags)
+	}
+}
+
+// TestFilePositionInformation tests that a position set through
+// FilePositionInformation is where READ and WRITE at
+// FILE_USE_FILE_POINTER_POSITION start, and that they move it on
+func TestFilePositionInformation(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	share := tree.Share
+	f, _ := share.fs.Create("/pos.txt")
+	f.Write([]byte("0123456789abcdef"))
+	f.Close()
+
+	file, err := share.fs.OpenFile("/pos.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	of := share.fileHandles.Allocate(file, "/pos.txt", false, FILE_READ_DATA|FILE_WRITE_DATA,
+		FILE_SHARE_READ|FILE_SHARE_WRITE, FILE_OPEN, 0, tree.ID, session.ID)
+	defer share.fileHandles.Release(of.ID)
+
+	setPosition := func(buf []byte) NTStatus {
+		_, status := srv.handler.handleSetInfo(nil, testRequest(session, tree, SMB2_SET_INFO,
+			buildSetInfoRequest(of.ID, SMB2_0_INFO_FILE, FilePositionInformation, buf)))
+		return status
+	}
+	position := func() uint64 {
+		t.Helper()
+		resp, status := srv.handler.handleQueryInfo(nil, testRequest(session, tree, SMB2_QUERY_INFO,
+			buildQueryInfoRequest(of.ID, SMB2_0_INFO_FILE, FilePositionInformation, 0, 1024)))
+		if status != STATUS_SUCCESS {
+			t.Fatalf("QUERY_INFO status = %v, want STATUS_SUCCESS", status)
+		}
+		return le.Uint64(resp[8:])
+	}
+
+	if status := setPosition(le.AppendUint64(nil, 10)); status != STATUS_SUCCESS {
+		t.Fatalf("SET_INFO status = %v, want STATUS_SUCCESS", status)
+	}
+	if pos := position(); pos != 10 {
+		t.Errorf("CurrentByteOffset = %d, want 10", pos)
+	}
+
+	read := buildReadRequest(of.ID, 4)
+	le.PutUint64(read[8:], useFilePosition) // Offset
+	resp, status := srv.handler.handleRead(nil, testRequest(session, tree, SMB2_READ, read))
+	if status != STATUS_SUCCESS {
+		t.Fatalf("READ status = %v, want STATUS_SUCCESS", status)
+	}
+	if data := readData(t, resp); string(data) != "abcd" {
+		t.Errorf("READ at the file position = %q, want %q", data, "abcd")
+	}
+	if pos := position(); pos != 14 {
+		t.Errorf("CurrentByteOffset after READ = %d, want 14", pos)
+	}
+
+	if _, status := srv.handler.handleWrite(nil, testRequest(session, tree, SMB2_WRITE,
+		buildWriteRequest(of.ID, useFilePosition, []byte("XY")))); status != STATUS_SUCCESS {
+		t.Fatalf("WRITE status = %v, want STATUS_SUCCESS", status)
+	}
+	if data, _ := share.fs.ReadFile("/pos.txt"); string(data) != "0123456789abcdXY" {
+		t.Errorf("file after WRITE at the file position = %q", data)
+	}
+
+	// An explicit offset still wins
+	resp, _ = srv.handler.handleRead(nil, testRequest(session, tree, SMB2_READ, buildReadRequest(of.ID, 2)))
+	if data := readData(t, resp); string(data) != "01" {
+		t.Errorf("READ at offset 0 = %q, want %q", data, "01")
+	}
+
+	if status := setPosition(make([]byte, 4)); status != STATUS_INVALID_PARAMETER {
+		t.Errorf("SET_INFO with a short buffer status = %v, want STATUS_INVALID_PARAMETER", status)
+	}
+	if status := setPosition(le.AppendUint64(nil, 1<<63)); status != STATUS_INVALID_PARAMETER {
+		t.Errorf("SET_INFO past the largest offset status = %v, want STATUS_INVALID_PARAMETER", status)
+	}
+}
+
+// allocatorFS reports the allocation sizes in its map, and an error for
+// other files
+type allocatorFS struct {
+	absfs.FileSystem
+	sizes map[string]int64
+}
+
+func (a *allocatorFS) AllocatedSize(name string) (int64, error) {
+	if n, ok := a.sizes[name]; ok {
+		return n, nil
+	}
+	return 0, os.ErrNotExist
+}
+
+// TestAllocationSize_Allocator tests that AllocationSize is an empty file's
+// 0 and other sizes rounded up, unless the backend reports its own
+func TestAllocationSize_Allocator(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	share := tree.Share
+	for name, size := range map[string]int{"/empty": 0, "/plain.txt": 5000, "/sparse.bin": 100000} {
+		f, _ := share.fs.Create(name)
+		f.Write(make([]byte, size))
+		f.Close()
+	}
+
+	// standardInfo returns the AllocationSize in FileStandardInformation
+	standardInfo := func(name string) uint64 {
+		t.Helper()
+		file, err := share.fs.Open(name)
+		if err != nil {
+			t.Fatalf("Open() error = %v", err)
+		}
+		of := share.fileHandles.Allocate(file, name, false, FILE_READ_DATA, FILE_SHARE_READ, FILE_OPEN, 0, tree.ID, session.ID)
+		defer share.fileHandles.Release(of.ID)
+		resp, status := srv.handler.handleQueryInfo(nil, testRequest(session, tree, SMB2_QUERY_INFO,
+			buildQueryInfoRequest(of.ID, SMB2_0_INFO_FILE, FileStandardInformation, 0, 1024)))
+		if status != STATUS_SUCCESS {
+			t.Fatalf("QUERY_INFO status = %v, want STATUS_SUCCESS", status)
+		}
+		return le.Uint64(resp[8:])
+	}
+	// listed returns the AllocationSize in the FileDirectoryInformation
+	// entry for name
+	listed := func(name string) uint64 {
+		t.Helper()
+		dir, _ := share.fs.Open("/")
+		of := share.fileHandles.Allocate(dir, "/", true, GENERIC_READ, FILE_SHARE_READ, FILE_OPEN, FILE_DIRECTORY_FILE, tree.ID, session.ID)
+		defer share.fileHandles.Release(of.ID)
+		resp, status := srv.handler.handleQueryDirectory(nil, testRequest(session, tree, SMB2_QUERY_DIRECTORY,
+			buildQueryDirectoryRequest(of.ID, FileDirectoryInformation, 0, name[1:])))
+		if status != STATUS_SUCCESS {
+			t.Fatalf("QUERY_DIRECTORY status = %v, want STATUS_SUCCESS", status)
+		}
+		return le.Uint64(resp[8+48:]) // AllocationSize
+	}
+
+	for _, tt := range []struct {
+		name string
+		want uint64
+	}{{"/empty", 0}, {"/plain.txt", 8192}, {"/sparse.bin", 102400}} {
+		if alloc := standardInfo(tt.name); alloc != tt.want {
+			t.Errorf("AllocationSize of %s = %d, want %d", tt.name, alloc, tt.want)
+		}
+		if alloc := listed(tt.name); alloc != tt.want {
+			t.Errorf("listed AllocationSize of %s = %d, want %d", tt.name, alloc, tt.want)
+		}
+	}
+
+	// With an Allocator, the sparse file takes up only what the backend
+	// says; files it has no answer for are rounded up as before
+	share.fs = &allocatorFS{FileSystem: share.fs, sizes: map[string]int64{"/sparse.bin": 8192}}
+	for _, tt := range []struct {
+		name string
+		want uint64
+	}{{"/empty", 0}, {"/plain.txt", 8192}, {"/sparse.bin", 8192}} {
+		if alloc := standardInfo(tt.name); alloc != tt.want {
+			t.Errorf("AllocationSize of %s with an Allocator = %d, want %d", tt.name, alloc, tt.want)
+		}
+		if alloc := listed(tt.name); alloc != tt.want {
+			t.Errorf("listed AllocationSize of %s with an Allocator = %d, want %d", tt.name, alloc, tt.want)
+		}
+	}
+}
+
+// TestArchiveBit tests that a file's archive bit, once cleared through
+// FileBasicInformation, is set again by a write or truncate and follows
+// the file through a rename
+func TestArchiveBit(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	share := tree.Share
+	f, _ := share.fs.Create("/report.txt")
+	f.Write([]byte("draft"))
+	f.Close()
+
+	file, err := share.fs.OpenFile("/report.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	of := share.fileHandles.Allocate(file, "/report.txt", false, FILE_READ_DATA|FILE_WRITE_DATA|DELETE,
+		FILE_SHARE_READ|FILE_SHARE_WRITE, FILE_OPEN, 0, tree.ID, session.ID)
+	defer share.fileHandles.Release(of.ID)
+
+	setInfo := func(class uint8, buf []byte) {
+		t.Helper()
+		_, status := srv.handler.handleSetInfo(nil, testRequest(session, tree, SMB2_SET_INFO,
+			buildSetInfoRequest(of.ID, SMB2_0_INFO_FILE, class, buf)))
+		if status != STATUS_SUCCESS {
+			t.Fatalf("SET_INFO class %d status = %v, want STATUS_SUCCESS", class, status)
+		}
+	}
+	setAttributes := func(attrs uint32) {
+		t.Helper()
+		buf := make([]byte, 40)
+		le.PutUint32(buf[32:], attrs) // FileAttributes
+		setInfo(FileBasicInformation, buf)
+	}
+	// archived reports the archive bit in FileBasicInformation and in the
+	// file's directory entry
+	archived := func() (bool, bool) {
+		t.Helper()
+		resp, status := srv.handler.handleQueryInfo(nil, testRequest(session, tree, SMB2_QUERY_INFO,
+			buildQueryInfoRequest(of.ID, SMB2_0_INFO_FILE, FileBasicInformation, 0, 1024)))
+		if status != STATUS_SUCCESS {
+			t.Fatalf("QUERY_INFO status = %v, want STATUS_SUCCESS", status)
+		}
+		info := le.Uint32(resp[8+32:])
+
+		dir, _ := share.fs.Open("/")
+		dof := share.fileHandles.Allocate(dir, "/", true, GENERIC_READ, FILE_SHARE_READ, FILE_OPEN, FILE_DIRECTORY_FILE, tree.ID, session.ID)
+		defer share.fileHandles.Release(dof.ID)
+		resp, status = srv.handler.handleQueryDirectory(nil, testRequest(session, tree, SMB2_QUERY_DIRECTORY,
+			buildQueryDirectoryRequest(dof.ID, FileDirectoryInformation, 0, path.Base(of.Path))))
+		if status != STATUS_SUCCESS {
+			t.Fatalf("QUERY_DIRECTORY status = %v, want STATUS_SUCCESS", status)
+		}
+		listed := le.Uint32(resp[8+56:]) // FileAttributes
+		return info&FILE_ATTRIBUTE_ARCHIVE != 0, listed&FILE_ATTRIBUTE_ARCHIVE != 0
+	}
+	check := func(when string, want bool) {
+		t.Helper()
+		if info, listed := archived(); info != want || listed != want {
+			t.Errorf("archive bit %s = %v queried, %v listed, want %v", when, info, listed, want)
+		}
+	}
+
+	check("on a new file", true)
+
+	setAttributes(FILE_ATTRIBUTE_NORMAL)
+	check("after clearing it", false)
+	setAttributes(0) // Leaves the attributes alone
+	check("after a SET_INFO without attributes", false)
+
+	if _, status := srv.handler.handleWrite(nil, testRequest(session, tree, SMB2_WRITE,
+		buildWriteRequest(of.ID, 0, []byte("final")))); status != STATUS_SUCCESS {
+		t.Fatalf("WRITE status = %v, want STATUS_SUCCESS", status)
+	}
+	check("after a write", true)
+
+	setAttributes(FILE_ATTRIBUTE_NORMAL)
+	setInfo(FileEndOfFileInformation, le.AppendUint64(nil, 2))
+	check("after a truncate", true)
+
+	setAttributes(FILE_ATTRIBUTE_NORMAL)
+	setInfo(FileRenameInformation, buildRenameInformation("renamed.txt", false, 0))
+	check("after a rename", false)
+
+	setAttributes(FILE_ATTRIBUTE_ARCHIVE)
+	check("after setting it", true)
+}
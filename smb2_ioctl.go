@@ -1,5 +1,10 @@
 package smbfs
 
+import (
+	"encoding/binary"
+	"io"
+)
+
 // IOCTL control codes
 const (
 	// File system control codes
@@ -20,6 +25,25 @@ const (
 	FSCTL_VALIDATE_NEGOTIATE_INFO     uint32 = 0x00140204
 )
 
+// SMB2_0_IOCTL_IS_FSCTL marks an IOCTL request as a file system control
+const SMB2_0_IOCTL_IS_FSCTL uint32 = 0x00000001
+
+// Server-side copy limits (MS-SMB2 3.3.3 ServerSideCopyMaxNumberofChunks,
+// ServerSideCopyMaxChunkSize and ServerSideCopyMaxDataSize)
+const (
+	copyChunkMaxChunks    = 256
+	copyChunkMaxChunkSize = 1 << 20
+	copyChunkMaxTotalSize = 16 << 20
+)
+
+// Sizes of the server-side copy structures (MS-SMB2 2.2.31.1, 2.2.32.1, 2.2.32.3)
+const (
+	resumeKeyResponseSize = 32
+	copyChunkHeaderSize   = 32
+	copyChunkEntrySize    = 24
+	copyChunkResponseSize = 12
+)
+
 // handleIOCTL processes IOCTL requests
 // IOCTL is used for various control operations on files and named pipes
 func (h *SMBHandler) handleIOCTL(state *connState, msg *SMB2Message) ([]byte, NTStatus) {
@@ -59,9 +83,7 @@ func (h *SMBHandler) handleIOCTL(state *connState, msg *SMB2Message) ([]byte, NT
 	_ = r.ReadUint16() // Reserved
 	ctlCode := r.ReadUint32()
 
-	// Skip FileId for now
-	_ = r.ReadUint64() // FileId.Persistent
-	_ = r.ReadUint64() // FileId.Volatile
+	fileID := r.ReadFileID()
 
 	inputOffset := r.ReadUint32()
 	inputCount := r.ReadUint32()
@@ -94,16 +116,28 @@ func (h *SMBHandler) handleIOCTL(state *connState, msg *SMB2Message) ([]byte, NT
 		return h.buildErrorResponse(), STATUS_NOT_SUPPORTED
 
 	case FSCTL_DFS_GET_REFERRALS, FSCTL_DFS_GET_REFERRALS_EX:
-		// DFS referrals - return NOT_SUPPORTED (we don't implement DFS)
-		return h.buildErrorResponse(), STATUS_NOT_SUPPORTED
+		// DFS referrals for shares configured as DFS roots
+		return h.handleDFSReferral(ctlCode, fileID, inputBuffer, maxOutputResp)
 
 	case FSCTL_PIPE_TRANSCEIVE:
 		// Named pipe transceive - used for RPC over named pipes
-		return h.handlePipeTransceive(state, msg, inputBuffer, maxOutputResp)
+		return h.handlePipeTransceive(msg, fileID, inputBuffer, maxOutputResp)
 
 	case FSCTL_SRV_REQUEST_RESUME_KEY:
-		// Server-side copy resume key request
-		return h.buildErrorResponse(), STATUS_NOT_SUPPORTED
+		// Server-side copy: name the source file
+		return h.handleRequestResumeKey(msg, fileID, maxOutputResp)
+
+	case FSCTL_SRV_COPYCHUNK, FSCTL_SRV_COPYCHUNK_WRITE:
+		// Server-side copy: copy ranges of the source file into this one
+		return h.handleCopyChunk(msg, ctlCode, fileID, inputBuffer, maxOutputResp)
+
+	case FSCTL_GET_REPARSE_POINT:
+		// Read a symbolic link's target
+		return h.handleGetReparsePoint(msg, fileID, maxOutputResp)
+
+	case FSCTL_SET_REPARSE_POINT:
+		// Turn a newly created file into a symbolic link
+		return h.handleSetReparsePoint(msg, fileID, inputBuffer)
 
 	default:
 		h.server.logger.Debug("IOCTL: Unsupported control code 0x%08x", ctlCode)
@@ -111,6 +145,143 @@ func (h *SMBHandler) handleIOCTL(state *connState, msg *SMB2Message) ([]byte, NT
 	}
 }
 
+// handleRequestResumeKey handles FSCTL_SRV_REQUEST_RESUME_KEY
+// The key is the handle's FileID, which copychunk requests resolve against
+// the session's opens on the same share
+func (h *SMBHandler) handleRequestResumeKey(msg *SMB2Message, fileID FileID, maxOutput uint32) ([]byte, NTStatus) {
+	session, tree, status := h.validateTree(msg.Header)
+	if status != STATUS_SUCCESS {
+		return h.buildErrorResponse(), status
+	}
+
+	of := tree.Share.fileHandles.GetByTree(fileID, tree.ID, session.ID)
+	if of == nil {
+		return h.buildErrorResponse(), STATUS_FILE_CLOSED
+	}
+	if maxOutput < resumeKeyResponseSize {
+		return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+	}
+
+	h.server.logger.Debug("IOCTL: RequestResumeKey for %s", of.Path)
+
+	// SRV_REQUEST_RESUME_KEY response: ResumeKey (24), ContextLength (4), Context (4)
+	w := NewByteWriter(resumeKeyResponseSize)
+	w.WriteFileID(fileID)
+	w.WriteUint64(0) // Rest of the resume key
+	w.WriteUint32(0) // ContextLength
+	w.WriteUint32(0) // Context
+
+	return h.buildIOCTLResponse(FSCTL_SRV_REQUEST_RESUME_KEY, fileID, w.Bytes()), STATUS_SUCCESS
+}
+
+// copyChunk is one range of a SRV_COPYCHUNK_COPY request
+type copyChunk struct {
+	sourceOffset int64
+	targetOffset int64
+	length       uint32
+}
+
+// handleCopyChunk handles FSCTL_SRV_COPYCHUNK and FSCTL_SRV_COPYCHUNK_WRITE
+// Each chunk is copied from the file named by the resume key into the target
+// handle without the data passing through the client
+func (h *SMBHandler) handleCopyChunk(msg *SMB2Message, ctlCode uint32, fileID FileID, input []byte, maxOutput uint32) ([]byte, NTStatus) {
+	session, tree, status := h.validateTree(msg.Header)
+	if status != STATUS_SUCCESS {
+		return h.buildErrorResponse(), status
+	}
+
+	// SRV_COPYCHUNK_COPY: SourceKey (24), ChunkCount (4), Reserved (4), Chunks
+	if len(input) < copyChunkHeaderSize || maxOutput < copyChunkResponseSize {
+		return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+	}
+	r := NewByteReader(input)
+	sourceID := r.ReadFileID()
+	_ = r.ReadUint64() // Rest of the resume key
+	chunkCount := r.ReadUint32()
+	_ = r.ReadUint32() // Reserved
+
+	target := tree.Share.fileHandles.GetByTree(fileID, tree.ID, session.ID)
+	if target == nil {
+		return h.buildErrorResponse(), STATUS_FILE_CLOSED
+	}
+	source := tree.Share.fileHandles.GetBySession(sourceID, session.ID)
+	if source == nil {
+		return h.buildErrorResponse(), STATUS_OBJECT_NAME_NOT_FOUND
+	}
+
+	// The source must be readable; COPYCHUNK also requires read access on
+	// the target, COPYCHUNK_WRITE only write access
+	targetAccess := mapGenericAccess(target.Access)
+	if tree.IsReadOnly || targetAccess&FILE_WRITE_DATA == 0 ||
+		(ctlCode == FSCTL_SRV_COPYCHUNK && targetAccess&FILE_READ_DATA == 0) ||
+		mapGenericAccess(source.Access)&FILE_READ_DATA == 0 {
+		return h.buildErrorResponse(), STATUS_ACCESS_DENIED
+	}
+
+	if chunkCount > copyChunkMaxChunks || len(input) < copyChunkHeaderSize+int(chunkCount)*copyChunkEntrySize {
+		return h.copyChunkLimitsResponse(ctlCode, fileID), STATUS_INVALID_PARAMETER
+	}
+	chunks := make([]copyChunk, chunkCount)
+	var total uint64
+	for i := range chunks {
+		chunks[i] = copyChunk{
+			sourceOffset: int64(r.ReadUint64()),
+			targetOffset: int64(r.ReadUint64()),
+			length:       r.ReadUint32(),
+		}
+		_ = r.ReadUint32() // Reserved
+
+		total += uint64(chunks[i].length)
+		if chunks[i].length == 0 || chunks[i].length > copyChunkMaxChunkSize ||
+			chunks[i].sourceOffset < 0 || chunks[i].targetOffset < 0 {
+			return h.copyChunkLimitsResponse(ctlCode, fileID), STATUS_INVALID_PARAMETER
+		}
+	}
+	if total > copyChunkMaxTotalSize {
+		return h.copyChunkLimitsResponse(ctlCode, fileID), STATUS_INVALID_PARAMETER
+	}
+
+	h.server.logger.Debug("IOCTL: CopyChunk %d chunks (%d bytes) from %s to %s", chunkCount, total, source.Path, target.Path)
+
+	tree.Share.fileHandles.UpdateLastAccess(fileID)
+
+	var written uint32
+	for _, c := range chunks {
+		if h.requestContext(msg).Err() != nil {
+			return h.buildErrorResponse(), STATUS_CANCELLED
+		}
+		src := io.NewSectionReader(source.File, c.sourceOffset, int64(c.length))
+		dst := io.NewOffsetWriter(target.File, c.targetOffset)
+		n, err := io.CopyN(dst, src, int64(c.length))
+		written += uint32(n)
+		if err == io.EOF {
+			return h.buildErrorResponse(), STATUS_END_OF_FILE
+		}
+		if err != nil {
+			h.server.logger.Debug("IOCTL: CopyChunk from %s to %s failed after %d bytes: %v", source.Path, target.Path, written, err)
+			return h.buildErrorResponse(), mapGoErrorToNTStatus(err)
+		}
+	}
+
+	return h.buildIOCTLResponse(ctlCode, fileID, copyChunkResponse(chunkCount, 0, written)), STATUS_SUCCESS
+}
+
+// copyChunkLimitsResponse reports the server's copy limits, which is how a
+// copychunk request exceeding them is answered (MS-SMB2 3.3.5.15.6)
+func (h *SMBHandler) copyChunkLimitsResponse(ctlCode uint32, fileID FileID) []byte {
+	output := copyChunkResponse(copyChunkMaxChunks, copyChunkMaxChunkSize, copyChunkMaxTotalSize)
+	return h.buildIOCTLResponse(ctlCode, fileID, output)
+}
+
+// copyChunkResponse builds a SRV_COPYCHUNK_RESPONSE
+func copyChunkResponse(chunksWritten, chunkBytesWritten, totalBytesWritten uint32) []byte {
+	buf := make([]byte, copyChunkResponseSize)
+	binary.LittleEndian.PutUint32(buf[0:4], chunksWritten)
+	binary.LittleEndian.PutUint32(buf[4:8], chunkBytesWritten)
+	binary.LittleEndian.PutUint32(buf[8:12], totalBytesWritten)
+	return buf
+}
+
 // handleValidateNegotiateInfo handles FSCTL_VALIDATE_NEGOTIATE_INFO
 // This is a security feature to prevent downgrade attacks
 func (h *SMBHandler) handleValidateNegotiateInfo(input []byte, maxOutput uint32) ([]byte, NTStatus) {
@@ -122,18 +293,8 @@ func (h *SMBHandler) handleValidateNegotiateInfo(input []byte, maxOutput uint32)
 	return h.buildErrorResponse(), STATUS_NOT_SUPPORTED
 }
 
-// handlePipeTransceive handles FSCTL_PIPE_TRANSCEIVE for named pipe operations
-func (h *SMBHandler) handlePipeTransceive(state *connState, msg *SMB2Message, input []byte, maxOutput uint32) ([]byte, NTStatus) {
-	// Named pipe transceive is used for RPC calls over SMB
-	// For IPC$ share, this is where RPC requests would be processed
-	// For now, return NOT_SUPPORTED
-
-	h.server.logger.Debug("IOCTL: PipeTransceive requested (returning NOT_SUPPORTED)")
-	return h.buildErrorResponse(), STATUS_NOT_SUPPORTED
-}
-
 // buildIOCTLResponse builds an IOCTL response
-func (h *SMBHandler) buildIOCTLResponse(ctlCode uint32, fileID [16]byte, output []byte) []byte {
+func (h *SMBHandler) buildIOCTLResponse(ctlCode uint32, fileID FileID, output []byte) []byte {
 	// IOCTL response structure (MS-SMB2 2.2.32):
 	//   StructureSize (2): Must be 49
 	//   Reserved (2)
@@ -153,7 +314,7 @@ func (h *SMBHandler) buildIOCTLResponse(ctlCode uint32, fileID [16]byte, output
 	w.WriteUint16(49)     // StructureSize
 	w.WriteUint16(0)      // Reserved
 	w.WriteUint32(ctlCode)
-	w.WriteBytes(fileID[:]) // FileId
+	w.WriteFileID(fileID) // FileId
 
 	if outputLen > 0 {
 		outputOffset := SMB2HeaderSize + 48
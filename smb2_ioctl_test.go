@@ -0,0 +1,187 @@
+package smbfs
+
+import (
+	"bytes"
+	"testing"
+)
+
+// buildIOCTLRequest builds an IOCTL request payload with input as its buffer
+func buildIOCTLRequest(ctlCode uint32, fileID FileID, input []byte, maxOutput uint32) []byte {
+	w := NewByteWriter(56 + len(input))
+	w.WriteUint16(57) // StructureSize
+	w.WriteUint16(0)  // Reserved
+	w.WriteUint32(ctlCode)
+	w.WriteFileID(fileID)
+	if len(input) > 0 {
+		w.WriteUint32(SMB2HeaderSize + 56) // InputOffset
+	} else {
+		w.WriteUint32(0)
+	}
+	w.WriteUint32(uint32(len(input))) // InputCount
+	w.WriteUint32(0)                  // MaxInputResponse
+	w.WriteUint32(0)                  // OutputOffset
+	w.WriteUint32(0)                  // OutputCount
+	w.WriteUint32(maxOutput)          // MaxOutputResponse
+	w.WriteUint32(1)                  // Flags (SMB2_0_IOCTL_IS_FSCTL)
+	w.WriteUint32(0)                  // Reserved2
+	w.WriteBytes(input)
+	return w.Bytes()
+}
+
+// buildCopyChunkInput builds a SRV_COPYCHUNK_COPY structure
+func buildCopyChunkInput(key []byte, chunks []copyChunk) []byte {
+	w := NewByteWriter(copyChunkHeaderSize + len(chunks)*copyChunkEntrySize)
+	w.WriteBytes(key)
+	w.WriteUint32(uint32(len(chunks))) // ChunkCount
+	w.WriteUint32(0)                   // Reserved
+	for _, c := range chunks {
+		w.WriteUint64(uint64(c.sourceOffset))
+		w.WriteUint64(uint64(c.targetOffset))
+		w.WriteUint32(c.length)
+		w.WriteUint32(0) // Reserved
+	}
+	return w.Bytes()
+}
+
+// ioctlOutput returns the output buffer of an IOCTL response
+func ioctlOutput(t *testing.T, resp []byte) []byte {
+	t.Helper()
+	offset := int(le.Uint32(resp[32:36])) - SMB2HeaderSize
+	count := int(le.Uint32(resp[36:40]))
+	if offset < 0 || offset+count > len(resp) {
+		t.Fatalf("IOCTL output [%d:+%d] outside %d byte response", offset, count, len(resp))
+	}
+	return resp[offset : offset+count]
+}
+
+// openTestFile creates name with content and allocates a handle for it
+func openTestFile(t *testing.T, tree *TreeConnection, session *Session, name string, content []byte, access uint32) *OpenFile {
+	t.Helper()
+	share := tree.Share
+
+	f, err := share.fs.Create(name)
+	if err != nil {
+		t.Fatalf("Create(%s) error = %v", name, err)
+	}
+	if _, err := f.Write(content); err != nil {
+		t.Fatalf("Write(%s) error = %v", name, err)
+	}
+	of := share.fileHandles.Allocate(f, name, false, access, FILE_SHARE_READ|FILE_SHARE_WRITE, FILE_OPEN, 0, tree.ID, session.ID)
+	t.Cleanup(func() { share.fileHandles.Release(of.ID) })
+	return of
+}
+
+// TestHandleIOCTL_RequestResumeKey tests resume key issuance
+func TestHandleIOCTL_RequestResumeKey(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	of := openTestFile(t, tree, session, "/src.bin", []byte("data"), GENERIC_READ)
+
+	resp, status := srv.handler.handleIOCTL(nil, testRequest(session, tree, SMB2_IOCTL,
+		buildIOCTLRequest(FSCTL_SRV_REQUEST_RESUME_KEY, of.ID, nil, 32)))
+	if status != STATUS_SUCCESS {
+		t.Fatalf("REQUEST_RESUME_KEY status = %v, want STATUS_SUCCESS", status)
+	}
+
+	out := ioctlOutput(t, resp)
+	if len(out) != resumeKeyResponseSize {
+		t.Fatalf("resume key response = %d bytes, want %d", len(out), resumeKeyResponseSize)
+	}
+	if !bytes.Equal(out[:16], of.ID.Marshal()) {
+		t.Errorf("resume key = %x, want the source FileId %x", out[:24], of.ID.Marshal())
+	}
+	if contextLength := le.Uint32(out[24:28]); contextLength != 0 {
+		t.Errorf("ContextLength = %d, want 0", contextLength)
+	}
+
+	// Unknown handles get no key
+	_, status = srv.handler.handleIOCTL(nil, testRequest(session, tree, SMB2_IOCTL,
+		buildIOCTLRequest(FSCTL_SRV_REQUEST_RESUME_KEY, FileID{Persistent: 99, Volatile: 99}, nil, 32)))
+	if status != STATUS_FILE_CLOSED {
+		t.Errorf("REQUEST_RESUME_KEY(unknown handle) status = %v, want STATUS_FILE_CLOSED", status)
+	}
+}
+
+// TestHandleIOCTL_CopyChunk tests a multi-chunk server-side copy and the
+// handling of requests beyond the server's limits
+func TestHandleIOCTL_CopyChunk(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+
+	content := make([]byte, 2*copyChunkMaxChunkSize+1000)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	src := openTestFile(t, tree, session, "/src.bin", content, GENERIC_READ)
+	dst := openTestFile(t, tree, session, "/dst.bin", nil, GENERIC_READ|GENERIC_WRITE)
+
+	resp, status := srv.handler.handleIOCTL(nil, testRequest(session, tree, SMB2_IOCTL,
+		buildIOCTLRequest(FSCTL_SRV_REQUEST_RESUME_KEY, src.ID, nil, 32)))
+	if status != STATUS_SUCCESS {
+		t.Fatalf("REQUEST_RESUME_KEY status = %v", status)
+	}
+	key := ioctlOutput(t, resp)[:24]
+
+	// Copy out of order to show each chunk carries its own offsets
+	chunks := []copyChunk{
+		{sourceOffset: copyChunkMaxChunkSize, targetOffset: copyChunkMaxChunkSize, length: copyChunkMaxChunkSize},
+		{sourceOffset: 0, targetOffset: 0, length: copyChunkMaxChunkSize},
+		{sourceOffset: 2 * copyChunkMaxChunkSize, targetOffset: 2 * copyChunkMaxChunkSize, length: 1000},
+	}
+	copyReq := func(ctlCode uint32, key []byte, chunks []copyChunk) ([]byte, NTStatus) {
+		return srv.handler.handleIOCTL(nil, testRequest(session, tree, SMB2_IOCTL,
+			buildIOCTLRequest(ctlCode, dst.ID, buildCopyChunkInput(key, chunks), 24)))
+	}
+
+	resp, status = copyReq(FSCTL_SRV_COPYCHUNK, key, chunks)
+	if status != STATUS_SUCCESS {
+		t.Fatalf("COPYCHUNK status = %v, want STATUS_SUCCESS", status)
+	}
+	out := ioctlOutput(t, resp)
+	if got := le.Uint32(out[0:4]); got != 3 {
+		t.Errorf("ChunksWritten = %d, want 3", got)
+	}
+	if got := le.Uint32(out[8:12]); got != uint32(len(content)) {
+		t.Errorf("TotalBytesWritten = %d, want %d", got, len(content))
+	}
+
+	copied := make([]byte, len(content)+1)
+	n, _ := dst.File.ReadAt(copied, 0)
+	if n != len(content) || !bytes.Equal(copied[:n], content) {
+		t.Errorf("target holds %d bytes, content match %v", n, bytes.Equal(copied[:n], content))
+	}
+
+	// Requests beyond the limits fail and report the limits
+	tooLarge := []copyChunk{{length: copyChunkMaxChunkSize + 1}}
+	resp, status = copyReq(FSCTL_SRV_COPYCHUNK_WRITE, key, tooLarge)
+	if status != STATUS_INVALID_PARAMETER {
+		t.Fatalf("COPYCHUNK(oversized chunk) status = %v, want STATUS_INVALID_PARAMETER", status)
+	}
+	out = ioctlOutput(t, resp)
+	if le.Uint32(out[0:4]) != copyChunkMaxChunks || le.Uint32(out[4:8]) != copyChunkMaxChunkSize ||
+		le.Uint32(out[8:12]) != copyChunkMaxTotalSize {
+		t.Errorf("limits response = %x", out)
+	}
+
+	tooMuch := make([]copyChunk, 17)
+	for i := range tooMuch {
+		tooMuch[i] = copyChunk{length: copyChunkMaxChunkSize}
+	}
+	if _, status = copyReq(FSCTL_SRV_COPYCHUNK, key, tooMuch); status != STATUS_INVALID_PARAMETER {
+		t.Errorf("COPYCHUNK(over total size) status = %v, want STATUS_INVALID_PARAMETER", status)
+	}
+
+	// Bad keys, reads past the source's end, and targets without write
+	// access all fail
+	badKey := make([]byte, 24)
+	if _, status = copyReq(FSCTL_SRV_COPYCHUNK, badKey, chunks[:1]); status != STATUS_OBJECT_NAME_NOT_FOUND {
+		t.Errorf("COPYCHUNK(bad key) status = %v, want STATUS_OBJECT_NAME_NOT_FOUND", status)
+	}
+	pastEnd := []copyChunk{{sourceOffset: int64(len(content)) - 10, length: 100}}
+	if _, status = copyReq(FSCTL_SRV_COPYCHUNK, key, pastEnd); status != STATUS_END_OF_FILE {
+		t.Errorf("COPYCHUNK(past end of source) status = %v, want STATUS_END_OF_FILE", status)
+	}
+	_, status = srv.handler.handleIOCTL(nil, testRequest(session, tree, SMB2_IOCTL,
+		buildIOCTLRequest(FSCTL_SRV_COPYCHUNK, src.ID, buildCopyChunkInput(key, chunks[:1]), 24)))
+	if status != STATUS_ACCESS_DENIED {
+		t.Errorf("COPYCHUNK(read-only target) status = %v, want STATUS_ACCESS_DENIED", status)
+	}
+}
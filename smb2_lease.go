@@ -0,0 +1,467 @@
+package smbfs
+
+import (
+	"path"
+	"sync"
+)
+
+// SMB2 Oplock levels (CREATE request/response)
+const (
+	SMB2_OPLOCK_LEVEL_NONE      uint8 = 0x00
+	SMB2_OPLOCK_LEVEL_II        uint8 = 0x01
+	SMB2_OPLOCK_LEVEL_EXCLUSIVE uint8 = 0x08
+	SMB2_OPLOCK_LEVEL_BATCH     uint8 = 0x09
+	SMB2_OPLOCK_LEVEL_LEASE     uint8 = 0xFF
+)
+
+// SMB2 Lease states
+const (
+	SMB2_LEASE_NONE           uint32 = 0x00
+	SMB2_LEASE_READ_CACHING   uint32 = 0x01
+	SMB2_LEASE_HANDLE_CACHING uint32 = 0x02
+	SMB2_LEASE_WRITE_CACHING  uint32 = 0x04
+)
+
+// SMB2 Lease flags
+const (
+	SMB2_LEASE_FLAG_BREAK_IN_PROGRESS    uint32 = 0x02
+	SMB2_LEASE_FLAG_PARENT_LEASE_KEY_SET uint32 = 0x04
+)
+
+// SMB2_NOTIFY_BREAK_LEASE_FLAG_ACK_REQUIRED is set in a lease break
+// notification when the client must acknowledge the break
+const SMB2_NOTIFY_BREAK_LEASE_FLAG_ACK_REQUIRED uint32 = 0x01
+
+// Sizes of the SMB2_CREATE_REQUEST_LEASE create context data
+const (
+	leaseContextV1Size = 32
+	leaseContextV2Size = 52
+)
+
+// leaseRequest is a parsed SMB2_CREATE_REQUEST_LEASE(_V2) create context
+type leaseRequest struct {
+	Key          [16]byte
+	State        uint32
+	Flags        uint32
+	ParentKey    [16]byte
+	Epoch        uint16
+	Version      int // 1 or 2
+	HasParentKey bool
+}
+
+// parseLeaseRequest parses lease create context data
+func parseLeaseRequest(data []byte) (*leaseRequest, bool) {
+	if len(data) < leaseContextV1Size {
+		return nil, false
+	}
+
+	r := NewByteReader(data)
+	req := &leaseRequest{Version: 1}
+	copy(req.Key[:], r.ReadBytes(16)) // LeaseKey
+	req.State = r.ReadUint32()        // LeaseState
+	req.Flags = r.ReadUint32()        // LeaseFlags
+	_ = r.ReadUint64()                // LeaseDuration
+
+	if len(data) >= leaseContextV2Size {
+		req.Version = 2
+		copy(req.ParentKey[:], r.ReadBytes(16)) // ParentLeaseKey
+		req.Epoch = r.ReadUint16()              // Epoch
+		req.HasParentKey = req.Flags&SMB2_LEASE_FLAG_PARENT_LEASE_KEY_SET != 0
+	}
+
+	return req, true
+}
+
+// leaseID identifies a lease; lease keys are only unique per client
+type leaseID struct {
+	clientGUID [16]byte
+	key        [16]byte
+}
+
+// Lease is a directory lease granted to a client
+type Lease struct {
+	Key        [16]byte
+	ClientGUID [16]byte
+	ShareName  string
+	Path       string // Canonical path within the share
+	State      uint32 // Currently granted lease state
+	Epoch      uint16
+	Version    int
+
+	handles   int        // Open handles sharing this lease
+	breaking  bool       // Break sent, waiting for acknowledgment
+	breakTo   uint32     // State the lease is being broken to
+	conn      *connState // Connection to send breaks on
+	hasParent bool
+	parentKey [16]byte
+}
+
+// LeaseTable tracks leases granted by the server
+type LeaseTable struct {
+	mu     sync.Mutex
+	leases map[leaseID]*Lease
+	byPath map[string][]*Lease // share + path -> leases
+}
+
+// NewLeaseTable creates an empty lease table
+func NewLeaseTable() *LeaseTable {
+	return &LeaseTable{
+		leases: make(map[leaseID]*Lease),
+		byPath: make(map[string][]*Lease),
+	}
+}
+
+// leasePath returns the canonical form of a share-relative path
+func leasePath(p string) string {
+	return path.Clean("/" + p)
+}
+
+func leasePathKey(shareName, p string) string {
+	return shareName + ":" + p
+}
+
+// AcquireDirectoryLease grants (or reuses) a directory lease for an open
+// Directories can only hold read and handle caching. Returns nil if no
+// lease can be granted
+func (t *LeaseTable) AcquireDirectoryLease(state *connState, shareName, dirPath string, req *leaseRequest) *Lease {
+	return t.acquire(state, shareName, dirPath, req, SMB2_LEASE_READ_CACHING|SMB2_LEASE_HANDLE_CACHING)
+}
+
+// AcquireFileLease grants (or reuses) a file lease for an open. Files only
+// get read caching, the lease equivalent of a level II oplock, so breaking
+// one never waits for the client. Returns nil if no lease can be granted
+func (t *LeaseTable) AcquireFileLease(state *connState, shareName, filePath string, req *leaseRequest) *Lease {
+	return t.acquire(state, shareName, filePath, req, SMB2_LEASE_READ_CACHING)
+}
+
+// acquire grants the part of the requested lease state allowed by mask
+func (t *LeaseTable) acquire(state *connState, shareName, leasedPath string, req *leaseRequest, mask uint32) *Lease {
+	granted := req.State & mask
+	if granted&SMB2_LEASE_READ_CACHING == 0 {
+		// Handle caching without read caching is not a valid lease state
+		return nil
+	}
+
+	var clientGUID [16]byte
+	if state != nil {
+		clientGUID = state.clientGUID
+	}
+	id := leaseID{clientGUID: clientGUID, key: req.Key}
+	p := leasePath(leasedPath)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Re-opens by the same client with the same key share the existing lease
+	if lease, ok := t.leases[id]; ok {
+		if lease.ShareName != shareName || lease.Path != p {
+			// A lease key may only be used for one file
+			return nil
+		}
+		lease.handles++
+		if !lease.breaking && lease.State == SMB2_LEASE_NONE {
+			// Lease was broken earlier; grant caching again
+			lease.State = granted
+			lease.Epoch++
+		}
+		if state != nil {
+			lease.conn = state
+		}
+		return lease
+	}
+
+	lease := &Lease{
+		Key:        req.Key,
+		ClientGUID: clientGUID,
+		ShareName:  shareName,
+		Path:       p,
+		State:      granted,
+		Epoch:      req.Epoch + 1,
+		Version:    req.Version,
+		handles:    1,
+		conn:       state,
+		hasParent:  req.HasParentKey,
+		parentKey:  req.ParentKey,
+	}
+	t.leases[id] = lease
+	pk := leasePathKey(shareName, p)
+	t.byPath[pk] = append(t.byPath[pk], lease)
+
+	return lease
+}
+
+// Release drops one handle reference to a lease, removing it when unused
+func (t *LeaseTable) Release(lease *Lease) {
+	if lease == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lease.handles--
+	if lease.handles > 0 {
+		return
+	}
+	t.removeLocked(lease)
+}
+
+// ReleaseConn removes all leases whose breaks would be sent on state
+func (t *LeaseTable) ReleaseConn(state *connState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, lease := range t.leases {
+		if lease.conn == state {
+			t.removeLocked(lease)
+		}
+	}
+}
+
+func (t *LeaseTable) removeLocked(lease *Lease) {
+	delete(t.leases, leaseID{clientGUID: lease.ClientGUID, key: lease.Key})
+
+	pk := leasePathKey(lease.ShareName, lease.Path)
+	list := t.byPath[pk]
+	for i, l := range list {
+		if l == lease {
+			t.byPath[pk] = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(t.byPath[pk]) == 0 {
+		delete(t.byPath, pk)
+	}
+}
+
+// Lookup finds a lease by client and key
+func (t *LeaseTable) Lookup(clientGUID, key [16]byte) *Lease {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.leases[leaseID{clientGUID: clientGUID, key: key}]
+}
+
+// Count returns the number of active leases
+func (t *LeaseTable) Count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.leases)
+}
+
+// parentLeaseID returns the parent directory lease named by a v2 lease request
+func parentLeaseID(state *connState, req *leaseRequest) *leaseID {
+	if req == nil || !req.HasParentKey {
+		return nil
+	}
+	id := &leaseID{key: req.ParentKey}
+	if state != nil {
+		id.clientGUID = state.clientGUID
+	}
+	return id
+}
+
+// leaseBreak describes a break notification to send
+type leaseBreak struct {
+	conn        *connState
+	key         [16]byte
+	epoch       uint16
+	version     int
+	from        uint32
+	to          uint32
+	ackRequired bool
+}
+
+// breakLeases breaks every lease held on p to none, except the one
+// identified by except (the originator's own or parent directory lease)
+// Returns the notifications that must be sent
+func (t *LeaseTable) breakLeases(shareName, p string, except *leaseID) []leaseBreak {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var breaks []leaseBreak
+	for _, lease := range t.byPath[leasePathKey(shareName, leasePath(p))] {
+		if lease.State == SMB2_LEASE_NONE || lease.breaking {
+			continue
+		}
+		if except != nil && lease.ClientGUID == except.clientGUID && lease.Key == except.key {
+			continue
+		}
+
+		// A change to the file or directory's contents invalidates all cached state
+		b := leaseBreak{
+			conn:        lease.conn,
+			key:         lease.Key,
+			version:     lease.Version,
+			from:        lease.State,
+			to:          SMB2_LEASE_NONE,
+			ackRequired: lease.State&SMB2_LEASE_HANDLE_CACHING != 0,
+		}
+		if lease.Version >= 2 {
+			lease.Epoch++
+		}
+		b.epoch = lease.Epoch
+
+		if b.ackRequired {
+			lease.breaking = true
+			lease.breakTo = SMB2_LEASE_NONE
+		} else {
+			lease.State = SMB2_LEASE_NONE
+		}
+		breaks = append(breaks, b)
+	}
+	return breaks
+}
+
+// acknowledgeBreak completes an outstanding lease break
+func (t *LeaseTable) acknowledgeBreak(clientGUID, key [16]byte, newState uint32) (*Lease, NTStatus) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lease := t.leases[leaseID{clientGUID: clientGUID, key: key}]
+	if lease == nil {
+		return nil, STATUS_OBJECT_NAME_NOT_FOUND
+	}
+	if !lease.breaking {
+		return nil, STATUS_UNSUCCESSFUL
+	}
+	if newState&^lease.breakTo != 0 {
+		// Client may not keep more than it was broken to
+		return nil, STATUS_REQUEST_NOT_ACCEPTED
+	}
+
+	lease.State = newState
+	lease.breaking = false
+	return lease, STATUS_SUCCESS
+}
+
+// buildLeaseResponseContext builds the RqLs create context returned for a granted lease
+func buildLeaseResponseContext(lease *Lease) []byte {
+	var flags uint32
+	if lease.breaking {
+		flags |= SMB2_LEASE_FLAG_BREAK_IN_PROGRESS
+	}
+
+	if lease.Version < 2 {
+		w := NewByteWriter(leaseContextV1Size)
+		w.WriteBytes(lease.Key[:]) // LeaseKey
+		w.WriteUint32(lease.State) // LeaseState
+		w.WriteUint32(flags)       // LeaseFlags
+		w.WriteUint64(0)           // LeaseDuration
+		return w.Bytes()
+	}
+
+	if lease.hasParent {
+		flags |= SMB2_LEASE_FLAG_PARENT_LEASE_KEY_SET
+	}
+	w := NewByteWriter(leaseContextV2Size)
+	w.WriteBytes(lease.Key[:])       // LeaseKey
+	w.WriteUint32(lease.State)       // LeaseState
+	w.WriteUint32(flags)             // LeaseFlags
+	w.WriteUint64(0)                 // LeaseDuration
+	w.WriteBytes(lease.parentKey[:]) // ParentLeaseKey
+	w.WriteUint16(lease.Epoch)       // Epoch
+	w.WriteUint16(0)                 // Reserved
+	return w.Bytes()
+}
+
+// buildLeaseBreakNotification builds an SMB2 Lease Break Notification (MS-SMB2 2.2.23.2)
+func buildLeaseBreakNotification(b leaseBreak) *SMB2Message {
+	header := &SMB2Header{
+		StructureSize: SMB2HeaderSize,
+		Command:       SMB2_OPLOCK_BREAK,
+		Flags:         SMB2_FLAGS_SERVER_TO_REDIR,
+		MessageID:     0xFFFFFFFFFFFFFFFF, // Unsolicited notification
+	}
+	copy(header.ProtocolID[:], SMB2ProtocolID)
+
+	var flags uint32
+	if b.ackRequired {
+		flags |= SMB2_NOTIFY_BREAK_LEASE_FLAG_ACK_REQUIRED
+	}
+
+	w := NewByteWriter(44)
+	w.WriteUint16(44)      // StructureSize
+	w.WriteUint16(b.epoch) // NewEpoch
+	w.WriteUint32(flags)   // Flags
+	w.WriteBytes(b.key[:]) // LeaseKey
+	w.WriteUint32(b.from)  // CurrentLeaseState
+	w.WriteUint32(b.to)    // NewLeaseState
+	w.WriteUint32(0)       // BreakReason
+	w.WriteUint32(0)       // AccessMaskHint
+	w.WriteUint32(0)       // ShareMaskHint
+
+	return &SMB2Message{Header: header, Payload: w.Bytes()}
+}
+
+// breakParentDirectoryLease notifies holders of a lease on the directory
+// containing changedPath that its contents changed
+// except is the originating open's parent lease, if any
+func (h *SMBHandler) breakParentDirectoryLease(share *Share, changedPath string, except *leaseID) {
+	dir := path.Dir(leasePath(changedPath))
+	h.sendLeaseBreaks(dir, h.server.leases.breakLeases(share.Options().ShareName, dir, except))
+}
+
+// sendLeaseBreaks sends the notifications for leases broken on p
+func (h *SMBHandler) sendLeaseBreaks(p string, breaks []leaseBreak) {
+	for _, b := range breaks {
+		if b.conn == nil {
+			continue
+		}
+		h.server.logger.Debug("Breaking lease on %s (0x%x -> 0x%x, ack=%v)",
+			p, b.from, b.to, b.ackRequired)
+		h.sendBreakNotification(b.conn, buildLeaseBreakNotification(b))
+	}
+}
+
+// sendBreakNotification sends an unsolicited oplock or lease break
+// asynchronously, so a slow client cannot stall the request causing it
+func (h *SMBHandler) sendBreakNotification(conn *connState, msg *SMB2Message) {
+	go func() {
+		if _, err := h.server.sendMessage(conn, msg); err != nil {
+			h.server.logger.Debug("Failed to send break notification to %s: %v", conn.remoteAddr, err)
+		}
+	}()
+}
+
+// handleOplockBreak processes an SMB2 OPLOCK_BREAK acknowledgment
+// Only lease break acknowledgments are expected: the only oplock granted is
+// level II, whose breaks are never acknowledged
+func (h *SMBHandler) handleOplockBreak(state *connState, msg *SMB2Message) ([]byte, NTStatus) {
+	if _, status := h.validateSession(msg.Header); status != STATUS_SUCCESS {
+		return h.buildErrorResponse(), status
+	}
+
+	if len(msg.Payload) < 2 {
+		return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+	}
+
+	r := NewByteReader(msg.Payload)
+	structSize := r.ReadUint16()
+	if structSize != 36 || len(msg.Payload) < 36 {
+		// Oplock break acknowledgments (StructureSize 24) are never expected
+		return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+	}
+
+	_ = r.ReadUint16() // Reserved
+	_ = r.ReadUint32() // Flags
+	var key [16]byte
+	copy(key[:], r.ReadBytes(16)) // LeaseKey
+	leaseState := r.ReadUint32()  // LeaseState
+
+	lease, status := h.server.leases.acknowledgeBreak(state.clientGUID, key, leaseState)
+	if status != STATUS_SUCCESS {
+		return h.buildErrorResponse(), status
+	}
+
+	h.server.logger.Debug("OPLOCK_BREAK: lease on %s acknowledged (state=0x%x)", lease.Path, leaseState)
+
+	// Lease Break Response (MS-SMB2 2.2.25.2)
+	w := NewByteWriter(36)
+	w.WriteUint16(36)          // StructureSize
+	w.WriteUint16(0)           // Reserved
+	w.WriteUint32(0)           // Flags
+	w.WriteBytes(key[:])       // LeaseKey
+	w.WriteUint32(lease.State) // LeaseState
+	w.WriteUint64(0)           // LeaseDuration
+	return w.Bytes(), STATUS_SUCCESS
+}
@@ -0,0 +1,279 @@
+package smbfs
+
+import (
+	"context"
+	"time"
+)
+
+// SMB2_LOCK_ELEMENT flags (MS-SMB2 2.2.26.1)
+const (
+	SMB2_LOCKFLAG_SHARED_LOCK      uint32 = 0x00000001
+	SMB2_LOCKFLAG_EXCLUSIVE_LOCK   uint32 = 0x00000002
+	SMB2_LOCKFLAG_UNLOCK           uint32 = 0x00000004
+	SMB2_LOCKFLAG_FAIL_IMMEDIATELY uint32 = 0x00000010
+)
+
+// blockingLockWait bounds how long a blocking lock request waits for a
+// conflicting lock to go away. The request waits asynchronously, so other
+// requests on its connection are processed in the meantime
+const blockingLockWait = 5 * time.Second
+
+// byteRangeLock is a byte-range lock held through an open
+type byteRangeLock struct {
+	offset    uint64
+	length    uint64
+	exclusive bool
+	sessionID uint64
+}
+
+// overlaps reports whether two locks cover a common byte
+// Zero-length locks never conflict with anything
+func (l byteRangeLock) overlaps(offset, length uint64) bool {
+	if l.length == 0 || length == 0 {
+		return false
+	}
+	return offset < l.offset+l.length && l.offset < offset+length
+}
+
+// lockElement is one SMB2_LOCK_ELEMENT of a LOCK request
+type lockElement struct {
+	offset uint64
+	length uint64
+	flags  uint32
+}
+
+// lockConflictLocked reports whether of may not take the requested lock
+// because of locks held through any open of the same file. m.mu must be held
+func (m *FileHandleMap) lockConflictLocked(of *OpenFile, offset, length uint64, exclusive bool) bool {
+	for _, other := range m.byPath[of.Path] {
+		for _, l := range other.locks {
+			if !l.overlaps(offset, length) {
+				continue
+			}
+			// Shared locks coexist, and an open may share-lock
+			// a range it already holds exclusively
+			if exclusive || (l.exclusive && other != of) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IOConflict reports whether locks keep of from reading, or writing if
+// write is set, length bytes from offset. As on Windows, reads conflict with
+// exclusive locks held through other opens, and writes also with shared
+// locks, the open's own included
+func (m *FileHandleMap) IOConflict(of *OpenFile, offset, length uint64, write bool) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, other := range m.byPath[of.Path] {
+		for _, l := range other.locks {
+			if !l.overlaps(offset, length) {
+				continue
+			}
+			if l.exclusive && other != of || !l.exclusive && write {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TryLock grants a set of byte-range locks to an open, all or none
+// It returns false, leaving the lock table untouched, on any conflict
+func (m *FileHandleMap) TryLock(of *OpenFile, elements []lockElement) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.handles[of.ID] != of {
+		return false
+	}
+
+	granted := len(of.locks)
+	for _, e := range elements {
+		exclusive := e.flags&SMB2_LOCKFLAG_EXCLUSIVE_LOCK != 0
+		if m.lockConflictLocked(of, e.offset, e.length, exclusive) {
+			of.locks = of.locks[:granted]
+			return false
+		}
+		of.locks = append(of.locks, byteRangeLock{
+			offset:    e.offset,
+			length:    e.length,
+			exclusive: exclusive,
+			sessionID: of.SessionID,
+		})
+	}
+	return true
+}
+
+// Unlock releases byte-range locks held through an open
+// Each range must match a held lock exactly; if one does not, locks
+// released before it stay released and false is returned
+func (m *FileHandleMap) Unlock(of *OpenFile, elements []lockElement) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer m.notifyLockWaitersLocked()
+
+	for _, e := range elements {
+		found := false
+		for i, l := range of.locks {
+			if l.offset == e.offset && l.length == e.length {
+				of.locks = append(of.locks[:i], of.locks[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// lockWaitChan returns a channel closed the next time locks are released
+func (m *FileHandleMap) lockWaitChan() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.lockWait == nil {
+		m.lockWait = make(chan struct{})
+	}
+	return m.lockWait
+}
+
+// notifyLockWaitersLocked wakes blocked lock requests. m.mu must be held
+func (m *FileHandleMap) notifyLockWaitersLocked() {
+	if m.lockWait != nil {
+		close(m.lockWait)
+		m.lockWait = nil
+	}
+}
+
+// handleLock processes an SMB2 LOCK request
+func (h *SMBHandler) handleLock(state *connState, msg *SMB2Message, respHeader *SMB2Header) ([]byte, NTStatus) {
+	session, tree, status := h.validateTree(msg.Header)
+	if status != STATUS_SUCCESS {
+		return h.buildErrorResponse(), status
+	}
+
+	// Parse LOCK request (MS-SMB2 2.2.26)
+	if len(msg.Payload) < 48 {
+		return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+	}
+
+	r := NewByteReader(msg.Payload)
+	structSize := r.ReadUint16()
+	if structSize != 48 {
+		return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+	}
+
+	lockCount := int(r.ReadUint16())
+	_ = r.ReadUint32() // LockSequence
+	fileID := r.ReadFileID()
+
+	if lockCount == 0 || len(msg.Payload) < 24+lockCount*24 {
+		return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+	}
+
+	elements := make([]lockElement, lockCount)
+	for i := range elements {
+		elements[i].offset = r.ReadUint64()
+		elements[i].length = r.ReadUint64()
+		elements[i].flags = r.ReadUint32()
+		_ = r.ReadUint32() // Reserved
+	}
+
+	of := tree.Share.fileHandles.GetByTree(fileID, tree.ID, session.ID)
+	if of == nil {
+		return h.buildErrorResponse(), STATUS_FILE_CLOSED
+	}
+	if of.IsDir {
+		return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+	}
+
+	// A request either unlocks or locks, as determined by its first element;
+	// only a single lock may block (MS-SMB2 3.3.5.14)
+	unlock := elements[0].flags == SMB2_LOCKFLAG_UNLOCK
+	for _, e := range elements {
+		switch e.flags {
+		case SMB2_LOCKFLAG_UNLOCK:
+			if !unlock {
+				return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+			}
+		case SMB2_LOCKFLAG_SHARED_LOCK, SMB2_LOCKFLAG_EXCLUSIVE_LOCK:
+			if unlock || lockCount > 1 {
+				return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+			}
+		case SMB2_LOCKFLAG_SHARED_LOCK | SMB2_LOCKFLAG_FAIL_IMMEDIATELY,
+			SMB2_LOCKFLAG_EXCLUSIVE_LOCK | SMB2_LOCKFLAG_FAIL_IMMEDIATELY:
+			if unlock {
+				return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+			}
+		default:
+			return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+		}
+		if e.length > 0 && e.offset+e.length-1 < e.offset {
+			return h.buildErrorResponse(), STATUS_INVALID_LOCK_RANGE
+		}
+	}
+
+	handles := tree.Share.fileHandles
+
+	if unlock {
+		h.server.logger.Debug("LOCK: unlock %d range(s) on %s", lockCount, of.Path)
+		if !handles.Unlock(of, elements) {
+			return h.buildErrorResponse(), STATUS_RANGE_NOT_LOCKED
+		}
+		return buildLockResponse(), STATUS_SUCCESS
+	}
+
+	h.server.logger.Debug("LOCK: %d range(s) on %s (first: offset=%d length=%d flags=0x%x)",
+		lockCount, of.Path, elements[0].offset, elements[0].length, elements[0].flags)
+
+	if handles.TryLock(of, elements) {
+		return buildLockResponse(), STATUS_SUCCESS
+	}
+	if elements[0].flags&SMB2_LOCKFLAG_FAIL_IMMEDIATELY != 0 {
+		return h.buildErrorResponse(), STATUS_LOCK_NOT_GRANTED
+	}
+
+	// Wait for the range without holding up the connection
+	return h.goAsync(state, msg, respHeader, session, func(ctx context.Context) ([]byte, NTStatus) {
+		return h.waitForLock(ctx, handles, of, elements)
+	})
+}
+
+// waitForLock retries a blocking lock request each time locks are released
+// until it is granted, the open goes away or blockingLockWait passes
+func (h *SMBHandler) waitForLock(ctx context.Context, handles *FileHandleMap, of *OpenFile, elements []lockElement) ([]byte, NTStatus) {
+	deadline := time.After(blockingLockWait)
+	for {
+		// Take the wait channel before trying so a release in between is not missed
+		wait := handles.lockWaitChan()
+		if handles.TryLock(of, elements) {
+			return buildLockResponse(), STATUS_SUCCESS
+		}
+		if handles.Get(of.ID) != of {
+			return h.buildErrorResponse(), STATUS_FILE_CLOSED
+		}
+
+		select {
+		case <-wait:
+		case <-deadline:
+			h.server.logger.Debug("LOCK: timed out waiting for range on %s", of.Path)
+			return h.buildErrorResponse(), STATUS_LOCK_NOT_GRANTED
+		case <-ctx.Done():
+			return h.buildErrorResponse(), STATUS_CANCELLED
+		}
+	}
+}
+
+// buildLockResponse builds a LOCK response (MS-SMB2 2.2.27)
+func buildLockResponse() []byte {
+	w := NewByteWriter(4)
+	w.WriteUint16(4) // StructureSize
+	w.WriteUint16(0) // Reserved
+	return w.Bytes()
+}
@@ -0,0 +1,322 @@
+package smbfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+)
+
+// buildLockRequest builds a LOCK request payload
+func buildLockRequest(fileID FileID, elements ...lockElement) []byte {
+	w := NewByteWriter(24 + 24*len(elements))
+	w.WriteUint16(48)                    // StructureSize
+	w.WriteUint16(uint16(len(elements))) // LockCount
+	w.WriteUint32(0)                     // LockSequence
+	w.WriteFileID(fileID)
+	for _, e := range elements {
+		w.WriteUint64(e.offset)
+		w.WriteUint64(e.length)
+		w.WriteUint32(e.flags)
+		w.WriteUint32(0) // Reserved
+	}
+	return w.Bytes()
+}
+
+func sharedLock(offset, length uint64) lockElement {
+	return lockElement{offset, length, SMB2_LOCKFLAG_SHARED_LOCK | SMB2_LOCKFLAG_FAIL_IMMEDIATELY}
+}
+
+func exclusiveLock(offset, length uint64) lockElement {
+	return lockElement{offset, length, SMB2_LOCKFLAG_EXCLUSIVE_LOCK | SMB2_LOCKFLAG_FAIL_IMMEDIATELY}
+}
+
+func unlockRange(offset, length uint64) lockElement {
+	return lockElement{offset, length, SMB2_LOCKFLAG_UNLOCK}
+}
+
+// TestLock_ConflictMatrix tests lock compatibility between two opens of a file
+func TestLock_ConflictMatrix(t *testing.T) {
+	tests := []struct {
+		name   string
+		held   lockElement
+		second lockElement
+		same   bool // request through the holder's own open
+		want   NTStatus
+	}{
+		{"shared over shared", sharedLock(0, 100), sharedLock(50, 100), false, STATUS_SUCCESS},
+		{"exclusive over shared", sharedLock(0, 100), exclusiveLock(50, 100), false, STATUS_LOCK_NOT_GRANTED},
+		{"shared over exclusive", exclusiveLock(0, 100), sharedLock(50, 100), false, STATUS_LOCK_NOT_GRANTED},
+		{"exclusive over exclusive", exclusiveLock(0, 100), exclusiveLock(99, 1), false, STATUS_LOCK_NOT_GRANTED},
+		{"adjacent exclusive", exclusiveLock(0, 100), exclusiveLock(100, 100), false, STATUS_SUCCESS},
+		{"adjacent before", exclusiveLock(100, 100), exclusiveLock(0, 100), false, STATUS_SUCCESS},
+		{"zero length inside exclusive", exclusiveLock(0, 100), exclusiveLock(10, 0), false, STATUS_SUCCESS},
+		{"same open shared over exclusive", exclusiveLock(0, 100), sharedLock(0, 100), true, STATUS_SUCCESS},
+		{"same open exclusive over exclusive", exclusiveLock(0, 100), exclusiveLock(0, 100), true, STATUS_LOCK_NOT_GRANTED},
+		{"range overflow", sharedLock(0, 1), exclusiveLock(^uint64(0), 2), false, STATUS_INVALID_LOCK_RANGE},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, session, tree := setupTestTree(t)
+			handles := tree.Share.fileHandles
+			first := handles.Allocate(nil, "/f.txt", false, FILE_READ_DATA|FILE_WRITE_DATA, FILE_SHARE_READ|FILE_SHARE_WRITE, FILE_OPEN, 0, tree.ID, session.ID)
+			second := handles.Allocate(nil, "/f.txt", false, FILE_READ_DATA|FILE_WRITE_DATA, FILE_SHARE_READ|FILE_SHARE_WRITE, FILE_OPEN, 0, tree.ID, session.ID)
+			if tt.same {
+				second = first
+			}
+
+			if _, status := srv.handler.handleLock(nil, testRequest(session, tree, SMB2_LOCK, buildLockRequest(first.ID, tt.held)), nil); status != STATUS_SUCCESS {
+				t.Fatalf("first LOCK status = %v, want STATUS_SUCCESS", status)
+			}
+			if _, status := srv.handler.handleLock(nil, testRequest(session, tree, SMB2_LOCK, buildLockRequest(second.ID, tt.second)), nil); status != tt.want {
+				t.Errorf("second LOCK status = %v, want %v", status, tt.want)
+			}
+		})
+	}
+}
+
+// TestLock_Unlock tests unlocking held and never-held ranges
+func TestLock_Unlock(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	handles := tree.Share.fileHandles
+	first := handles.Allocate(nil, "/f.txt", false, FILE_WRITE_DATA, FILE_SHARE_WRITE, FILE_OPEN, 0, tree.ID, session.ID)
+	second := handles.Allocate(nil, "/f.txt", false, FILE_WRITE_DATA, FILE_SHARE_WRITE, FILE_OPEN, 0, tree.ID, session.ID)
+
+	lock := func(of *OpenFile, elements ...lockElement) NTStatus {
+		t.Helper()
+		_, status := srv.handler.handleLock(nil, testRequest(session, tree, SMB2_LOCK, buildLockRequest(of.ID, elements...)), nil)
+		return status
+	}
+
+	if status := lock(first, unlockRange(0, 10)); status != STATUS_RANGE_NOT_LOCKED {
+		t.Errorf("unlock of never-locked range = %v, want STATUS_RANGE_NOT_LOCKED", status)
+	}
+
+	if status := lock(first, exclusiveLock(0, 10), exclusiveLock(20, 10)); status != STATUS_SUCCESS {
+		t.Fatalf("LOCK status = %v, want STATUS_SUCCESS", status)
+	}
+	if status := lock(second, unlockRange(0, 10)); status != STATUS_RANGE_NOT_LOCKED {
+		t.Errorf("unlock through another open = %v, want STATUS_RANGE_NOT_LOCKED", status)
+	}
+	if status := lock(first, unlockRange(0, 5)); status != STATUS_RANGE_NOT_LOCKED {
+		t.Errorf("unlock of partial range = %v, want STATUS_RANGE_NOT_LOCKED", status)
+	}
+	if status := lock(first, unlockRange(0, 10)); status != STATUS_SUCCESS {
+		t.Errorf("unlock = %v, want STATUS_SUCCESS", status)
+	}
+	if status := lock(second, exclusiveLock(0, 10)); status != STATUS_SUCCESS {
+		t.Errorf("LOCK after unlock = %v, want STATUS_SUCCESS", status)
+	}
+	if status := lock(second, exclusiveLock(20, 10)); status != STATUS_LOCK_NOT_GRANTED {
+		t.Errorf("LOCK of still-held range = %v, want STATUS_LOCK_NOT_GRANTED", status)
+	}
+
+	// A failed multi-range request grants nothing
+	if status := lock(second, exclusiveLock(40, 10), exclusiveLock(20, 10)); status != STATUS_LOCK_NOT_GRANTED {
+		t.Errorf("LOCK with conflicting element = %v, want STATUS_LOCK_NOT_GRANTED", status)
+	}
+	if status := lock(first, exclusiveLock(40, 10)); status != STATUS_SUCCESS {
+		t.Errorf("LOCK of range from failed request = %v, want STATUS_SUCCESS", status)
+	}
+
+	// Mixing lock and unlock elements is invalid
+	if status := lock(first, unlockRange(40, 10), exclusiveLock(60, 10)); status != STATUS_INVALID_PARAMETER {
+		t.Errorf("mixed LOCK/UNLOCK = %v, want STATUS_INVALID_PARAMETER", status)
+	}
+}
+
+// TestLock_ReleasedOnClose tests that closing or logging off drops locks and
+// wakes a blocked request
+func TestLock_ReleasedOnClose(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	handles := tree.Share.fileHandles
+	holder := handles.Allocate(nil, "/f.txt", false, FILE_WRITE_DATA, FILE_SHARE_WRITE, FILE_OPEN, 0, tree.ID, session.ID)
+	waiter := handles.Allocate(nil, "/f.txt", false, FILE_WRITE_DATA, FILE_SHARE_WRITE, FILE_OPEN, 0, tree.ID, session.ID)
+
+	if _, status := srv.handler.handleLock(nil, testRequest(session, tree, SMB2_LOCK, buildLockRequest(holder.ID, exclusiveLock(0, 10))), nil); status != STATUS_SUCCESS {
+		t.Fatalf("LOCK status = %v, want STATUS_SUCCESS", status)
+	}
+
+	// Blocking request (no FAIL_IMMEDIATELY), answered asynchronously
+	conn := serveTestConn(t, srv)
+	blocking := lockElement{0, 10, SMB2_LOCKFLAG_EXCLUSIVE_LOCK}
+	conn.Write(frameRequests(false, testRequest(session, tree, SMB2_LOCK, buildLockRequest(waiter.ID, blocking))))
+	if interim := readTestResponse(t, conn); interim.Header.Status != STATUS_PENDING {
+		t.Fatalf("blocking LOCK returned %v while range was held", interim.Header.Status)
+	}
+
+	if err := handles.Release(holder.ID); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	if final := readTestResponse(t, conn); final.Header.Status != STATUS_SUCCESS {
+		t.Errorf("blocking LOCK status = %v, want STATUS_SUCCESS", final.Header.Status)
+	}
+
+	// Session teardown releases the waiter's lock as well
+	handles.ReleaseBySession(session.ID)
+	other := handles.Allocate(nil, "/f.txt", false, FILE_WRITE_DATA, FILE_SHARE_WRITE, FILE_OPEN, 0, tree.ID, session.ID)
+	if _, status := srv.handler.handleLock(nil, testRequest(session, tree, SMB2_LOCK, buildLockRequest(other.ID, exclusiveLock(0, 10))), nil); status != STATUS_SUCCESS {
+		t.Errorf("LOCK after ReleaseBySession = %v, want STATUS_SUCCESS", status)
+	}
+}
+
+// TestLock_EnforcedOnIO tests that READ and WRITE honor byte-range locks
+// held through any open of the file
+func TestLock_EnforcedOnIO(t *testing.T) {
+	tests := []struct {
+		name      string
+		held      lockElement
+		same      bool // I/O through the holder's own open
+		wantRead  NTStatus
+		wantWrite NTStatus
+	}{
+		{"exclusive, holder", exclusiveLock(0, 4), true, STATUS_SUCCESS, STATUS_SUCCESS},
+		{"exclusive, other open", exclusiveLock(0, 4), false, STATUS_FILE_LOCK_CONFLICT, STATUS_FILE_LOCK_CONFLICT},
+		{"shared, holder", sharedLock(0, 4), true, STATUS_SUCCESS, STATUS_FILE_LOCK_CONFLICT},
+		{"shared, other open", sharedLock(0, 4), false, STATUS_SUCCESS, STATUS_FILE_LOCK_CONFLICT},
+		{"outside the range", exclusiveLock(100, 4), false, STATUS_SUCCESS, STATUS_SUCCESS},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, session, tree := setupTestTree(t)
+			holder := openTestFile(t, tree, session, "/f.txt", []byte("0123456789"), FILE_READ_DATA|FILE_WRITE_DATA)
+			of := holder
+			if !tt.same {
+				of = openTestFile(t, tree, session, "/f.txt", []byte("0123456789"), FILE_READ_DATA|FILE_WRITE_DATA)
+			}
+
+			if _, status := srv.handler.handleLock(nil, testRequest(session, tree, SMB2_LOCK, buildLockRequest(holder.ID, tt.held)), nil); status != STATUS_SUCCESS {
+				t.Fatalf("LOCK status = %v, want STATUS_SUCCESS", status)
+			}
+			if _, status := srv.handler.handleRead(nil, testRequest(session, tree, SMB2_READ, buildReadRequest(of.ID, 10))); status != tt.wantRead {
+				t.Errorf("READ status = %v, want %v", status, tt.wantRead)
+			}
+			if _, status := srv.handler.handleWrite(nil, testRequest(session, tree, SMB2_WRITE, buildWriteRequest(of.ID, 0, []byte("ab")))); status != tt.wantWrite {
+				t.Errorf("WRITE status = %v, want %v", status, tt.wantWrite)
+			}
+		})
+	}
+}
+
+// TestFile_Lock tests byte-range locks taken by the client: an exclusive
+// lock refuses overlapping locks through another handle until it is
+// released, by Unlock or by closing the file
+func TestFile_Lock(t *testing.T) {
+	_, config := startLoopbackServer(t, ServerOptions{})
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	open := func() *File {
+		t.Helper()
+		f, err := fsys.OpenFile("/hello.txt", os.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("OpenFile() error = %v", err)
+		}
+		return f.(*File)
+	}
+	first, second := open(), open()
+	defer second.Close()
+
+	if err := first.Lock(0, 10, true); err != nil {
+		t.Fatalf("Lock() error = %v", err)
+	}
+	if err := second.Lock(5, 10, false); !errors.Is(err, ErrLockNotGranted) {
+		t.Errorf("overlapping Lock() error = %v, want ErrLockNotGranted", err)
+	}
+	if err := second.Lock(10, 10, true); err != nil {
+		t.Errorf("Lock() of an adjacent range error = %v", err)
+	}
+
+	// The locks are held by the file's own handle, so its I/O is unaffected
+	if _, err := first.Write([]byte("HELLO")); err != nil {
+		t.Errorf("Write() by the lock holder error = %v", err)
+	}
+
+	if err := first.Unlock(0, 5); !errors.Is(err, ErrNotLocked) {
+		t.Errorf("Unlock() of a different range error = %v, want ErrNotLocked", err)
+	}
+	if err := first.Unlock(0, 10); err != nil {
+		t.Fatalf("Unlock() error = %v", err)
+	}
+	if err := second.Lock(5, 5, false); err != nil {
+		t.Errorf("Lock() after Unlock() error = %v", err)
+	}
+
+	// Shared locks coexist, and closing the file releases its locks
+	third := open()
+	if err := third.Lock(5, 5, false); err != nil {
+		t.Errorf("shared Lock() of a shared range error = %v", err)
+	}
+	if err := third.Lock(10, 5, false); !errors.Is(err, ErrLockNotGranted) {
+		t.Errorf("Lock() of an exclusively locked range error = %v, want ErrLockNotGranted", err)
+	}
+	second.Close()
+	if err := third.Lock(10, 5, true); err != nil {
+		t.Errorf("Lock() after the holder closed error = %v", err)
+	}
+	third.Close()
+
+	if err := first.Lock(-1, 1, true); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("Lock() at a negative offset error = %v, want fs.ErrInvalid", err)
+	}
+	first.Close()
+	if err := first.Lock(0, 1, true); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("Lock() on a closed file error = %v, want fs.ErrClosed", err)
+	}
+}
+
+// TestFile_LockSameHandle tests that a locked range can be read and written
+// through the file that locked it, on a server that enforces locks, and not
+// through another handle
+func TestFile_LockSameHandle(t *testing.T) {
+	_, config := startLoopbackServer(t, ServerOptions{})
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	f, err := fsys.OpenFile("/hello.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	defer f.Close()
+	holder := f.(*File)
+
+	if err := holder.Lock(0, 5, true); err != nil {
+		t.Fatalf("Lock() error = %v", err)
+	}
+	if _, err := holder.WriteAt([]byte("HELLO"), 0); err != nil {
+		t.Errorf("WriteAt() of the locked range error = %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := holder.ReadAt(buf, 0); err != nil {
+		t.Errorf("ReadAt() of the locked range error = %v", err)
+	} else if string(buf) != "HELLO" {
+		t.Errorf("ReadAt() = %q, want %q", buf, "HELLO")
+	}
+
+	other, err := fsys.OpenFile("/hello.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	defer other.Close()
+	if _, err := other.(*File).ReadAt(buf, 0); err == nil {
+		t.Error("ReadAt() of the range locked through another handle succeeded")
+	}
+	if _, err := other.(*File).WriteAt([]byte("hello"), 0); err == nil {
+		t.Error("WriteAt() of the range locked through another handle succeeded")
+	}
+
+	if err := holder.Unlock(0, 5); err != nil {
+		t.Fatalf("Unlock() error = %v", err)
+	}
+	if _, err := other.(*File).ReadAt(buf, 0); err != nil {
+		t.Errorf("ReadAt() after Unlock() error = %v", err)
+	}
+}
@@ -1,5 +1,7 @@
 package smbfs
 
+import "slices"
+
 // handleNegotiateImpl handles the SMB2 NEGOTIATE request
 // This is the first message in the SMB2 protocol handshake where the client
 // and server agree on the SMB dialect version to use.
@@ -38,7 +40,7 @@ func (h *SMBHandler) handleNegotiateImpl(state *connState, msg *SMB2Message) ([]
 	// Handle SMB1 client upgrade
 	// If payload is empty, this is from handleSMB1Negotiate
 	if len(msg.Payload) == 0 {
-		return h.buildNegotiateResponse(opts.MaxDialect, [16]byte{}, 0, 0), STATUS_SUCCESS
+		return h.buildNegotiateResponse(opts.MaxDialect, [16]byte{}, 0, 0, SMB2_COMPRESSION_NONE), STATUS_SUCCESS
 	}
 
 	// Parse request
@@ -99,7 +101,8 @@ func (h *SMBHandler) handleNegotiateImpl(state *connState, msg *SMB2Message) ([]
 
 	// Store negotiation state
 	state.session = nil // Clear any previous session
-	state.dialect = selectedDialect
+	h.server.trackDialect(state, selectedDialect)
+	state.clientGUID = clientGUID
 
 	// Check if signing is required
 	// Client security mode bit 0x02 = signing required
@@ -117,12 +120,35 @@ func (h *SMBHandler) handleNegotiateImpl(state *connState, msg *SMB2Message) ([]
 		negContextOffset, negContextCount, selectedDialect.String(), len(msg.Payload), len(msg.RawBytes))
 
 	// For SMB 3.1.1, parse and log client negotiate contexts
+	var clientCiphers, clientCompression []uint16
 	if selectedDialect >= SMB3_1_1 && negContextCount > 0 {
-		h.parseClientNegotiateContexts(msg.RawBytes, negContextOffset, negContextCount)
+		clientCiphers, clientCompression = h.parseClientNegotiateContexts(msg.RawBytes, negContextOffset, negContextCount)
+	}
+
+	// Record whether the client can encrypt: SMB 3.0.x signals it with a
+	// capability and always uses AES-CCM; SMB 3.1.1 offers ciphers in a context
+	state.cipherID = 0
+	switch {
+	case selectedDialect >= SMB3_1_1:
+		for _, c := range clientCiphers {
+			if c == SMB2_ENCRYPTION_AES128_GCM {
+				state.cipherID = c
+			}
+		}
+	case selectedDialect >= SMB3_0:
+		if clientCapabilities&SMB2_GLOBAL_CAP_ENCRYPTION != 0 {
+			state.cipherID = SMB2_ENCRYPTION_AES128_CCM
+		}
+	}
+
+	// Compress with LZ77 if enabled and the client offers it (SMB 3.1.1)
+	state.compressionAlg = SMB2_COMPRESSION_NONE
+	if opts.EnableCompression && slices.Contains(clientCompression, SMB2_COMPRESSION_LZ77) {
+		state.compressionAlg = SMB2_COMPRESSION_LZ77
 	}
 
 	// Build and return response
-	return h.buildNegotiateResponse(selectedDialect, clientGUID, negContextOffset, negContextCount), STATUS_SUCCESS
+	return h.buildNegotiateResponse(selectedDialect, clientGUID, negContextOffset, negContextCount, state.compressionAlg), STATUS_SUCCESS
 }
 
 // selectDialect chooses the highest common dialect between client and server
@@ -156,6 +182,7 @@ func (h *SMBHandler) selectDialect(clientDialects []SMBDialect) SMBDialect {
 const (
 	SMB2_PREAUTH_INTEGRITY_CAPABILITIES uint16 = 0x0001
 	SMB2_ENCRYPTION_CAPABILITIES        uint16 = 0x0002
+	SMB2_COMPRESSION_CAPABILITIES       uint16 = 0x0003
 	SMB2_SIGNING_CAPABILITIES           uint16 = 0x0008
 )
 
@@ -171,7 +198,8 @@ const (
 )
 
 // buildNegotiateResponse constructs the SMB2 NEGOTIATE response
-func (h *SMBHandler) buildNegotiateResponse(dialect SMBDialect, clientGUID [16]byte, negContextOffset uint32, negContextCount uint16) []byte {
+// compressionAlg is the negotiated compression algorithm, if any
+func (h *SMBHandler) buildNegotiateResponse(dialect SMBDialect, clientGUID [16]byte, negContextOffset uint32, negContextCount uint16, compressionAlg uint16) []byte {
 	opts := h.server.options
 
 	// Determine security mode
@@ -180,9 +208,17 @@ func (h *SMBHandler) buildNegotiateResponse(dialect SMBDialect, clientGUID [16]b
 		securityMode |= SMB2_NEGOTIATE_SIGNING_REQUIRED
 	}
 
-	// Determine capabilities
-	// Always advertise LARGE_MTU for better performance
-	capabilities := SMB2_GLOBAL_CAP_LARGE_MTU
+	// Determine capabilities. SMB 2.0.2 has no multi-credit requests, so
+	// it gets neither LARGE_MTU nor sizes above what one credit covers
+	var capabilities uint32
+	maxTransact, maxRead, maxWrite := uint32(MaxTransactSize), opts.MaxReadSize, opts.MaxWriteSize
+	if dialect >= SMB2_1 {
+		capabilities |= SMB2_GLOBAL_CAP_LARGE_MTU
+	} else {
+		maxTransact = min(maxTransact, singleCreditMaxSize)
+		maxRead = min(maxRead, singleCreditMaxSize)
+		maxWrite = min(maxWrite, singleCreditMaxSize)
+	}
 
 	// Add DFS capability if we support it
 	capabilities |= SMB2_GLOBAL_CAP_DFS
@@ -198,6 +234,11 @@ func (h *SMBHandler) buildNegotiateResponse(dialect SMBDialect, clientGUID [16]b
 		capabilities |= SMB2_GLOBAL_CAP_PERSISTENT_HANDLES
 	}
 
+	// Leases are granted on directories and, with read caching only, on files
+	if dialect >= SMB2_1 {
+		capabilities |= SMB2_GLOBAL_CAP_LEASING
+	}
+
 	// Add directory leasing for SMB 3.0.2+
 	if dialect >= SMB3_0_2 {
 		capabilities |= SMB2_GLOBAL_CAP_DIRECTORY_LEASING
@@ -211,7 +252,7 @@ func (h *SMBHandler) buildNegotiateResponse(dialect SMBDialect, clientGUID [16]b
 	var negotiateContexts []byte
 	var contextCount uint16
 	if dialect >= SMB3_1_1 {
-		negotiateContexts, contextCount = h.buildNegotiateContexts()
+		negotiateContexts, contextCount = h.buildNegotiateContexts(compressionAlg)
 	}
 
 	// Build response
@@ -222,9 +263,9 @@ func (h *SMBHandler) buildNegotiateResponse(dialect SMBDialect, clientGUID [16]b
 	w.WriteUint16(contextCount)    // NegotiateContextCount (or Reserved for < SMB 3.1.1)
 	w.WriteGUID(opts.ServerGUID)   // ServerGUID
 	w.WriteUint32(capabilities)    // Capabilities
-	w.WriteUint32(MaxTransactSize) // MaxTransactSize
-	w.WriteUint32(opts.MaxReadSize)  // MaxReadSize
-	w.WriteUint32(opts.MaxWriteSize) // MaxWriteSize
+	w.WriteUint32(maxTransact)     // MaxTransactSize
+	w.WriteUint32(maxRead)         // MaxReadSize
+	w.WriteUint32(maxWrite)        // MaxWriteSize
 	w.WriteUint64(systemTime)        // SystemTime
 	w.WriteUint64(serverStartTime)   // ServerStartTime
 
@@ -258,8 +299,9 @@ func (h *SMBHandler) buildNegotiateResponse(dialect SMBDialect, clientGUID [16]b
 	return w.Bytes()
 }
 
-// buildNegotiateContexts builds the SMB 3.1.1 negotiate contexts
-func (h *SMBHandler) buildNegotiateContexts() ([]byte, uint16) {
+// buildNegotiateContexts builds the SMB 3.1.1 negotiate contexts, with a
+// compression context if compressionAlg was negotiated
+func (h *SMBHandler) buildNegotiateContexts(compressionAlg uint16) ([]byte, uint16) {
 	w := NewByteWriter(64)
 
 	// Context 1: SMB2_PREAUTH_INTEGRITY_CAPABILITIES
@@ -296,7 +338,24 @@ func (h *SMBHandler) buildNegotiateContexts() ([]byte, uint16) {
 	w.WriteUint32(0)                     // Reserved
 	w.WriteBytes(signData)
 
-	return w.Bytes(), 3 // Three contexts
+	if compressionAlg == SMB2_COMPRESSION_NONE {
+		return w.Bytes(), 3 // Three contexts
+	}
+
+	// Pad to 8-byte boundary before next context
+	signPadding := (8 - (len(signData) % 8)) % 8
+	for i := 0; i < signPadding; i++ {
+		w.WriteOneByte(0)
+	}
+
+	// Context 4: SMB2_COMPRESSION_CAPABILITIES
+	w.WriteUint16(SMB2_COMPRESSION_CAPABILITIES) // ContextType
+	compressData := h.buildCompressionContext(compressionAlg)
+	w.WriteUint16(uint16(len(compressData))) // DataLength
+	w.WriteUint32(0)                         // Reserved
+	w.WriteBytes(compressData)
+
+	return w.Bytes(), 4
 }
 
 // buildPreauthIntegrityContext builds the preauth integrity capabilities context
@@ -338,6 +397,19 @@ func (h *SMBHandler) buildEncryptionContext() []byte {
 	return w.Bytes()
 }
 
+// buildCompressionContext builds the compression capabilities context,
+// naming the one algorithm the server will use
+func (h *SMBHandler) buildCompressionContext(algorithm uint16) []byte {
+	w := NewByteWriter(10)
+
+	w.WriteUint16(1)         // CompressionAlgorithmCount
+	w.WriteUint16(0)         // Padding
+	w.WriteUint32(0)         // Flags: SMB2_COMPRESSION_CAPABILITIES_FLAG_NONE (no chaining)
+	w.WriteUint16(algorithm) // CompressionAlgorithms
+
+	return w.Bytes()
+}
+
 // SMB 3.1.1 Signing Algorithm IDs
 const (
 	SMB2_SIGNING_AES_CMAC    uint16 = 0x0001
@@ -359,8 +431,10 @@ func (h *SMBHandler) buildSigningCapabilitiesContext() []byte {
 	return w.Bytes()
 }
 
-// parseClientNegotiateContexts parses and logs client negotiate contexts for debugging
-func (h *SMBHandler) parseClientNegotiateContexts(rawBytes []byte, offset uint32, count uint16) {
+// parseClientNegotiateContexts parses and logs client negotiate contexts
+// It returns the ciphers offered in the client's encryption context and the
+// algorithms offered in its compression context
+func (h *SMBHandler) parseClientNegotiateContexts(rawBytes []byte, offset uint32, count uint16) (ciphers, compression []uint16) {
 	// Offset is from start of SMB2 header in the raw message
 	// rawBytes includes NetBIOS header (4 bytes) + SMB2 header (64 bytes) + payload
 	// So we need to offset by 4 (NetBIOS) to get to SMB2 header start
@@ -375,7 +449,7 @@ func (h *SMBHandler) parseClientNegotiateContexts(rawBytes []byte, offset uint32
 
 	if startOffset >= len(rawBytes) {
 		h.server.logger.Debug("NEGOTIATE: Context offset %d beyond message length %d", startOffset, len(rawBytes))
-		return
+		return nil, nil
 	}
 
 	h.server.logger.Debug("NEGOTIATE: Parsing %d client contexts at offset %d (adjusted=%d)", count, offset, startOffset)
@@ -392,8 +466,33 @@ func (h *SMBHandler) parseClientNegotiateContexts(rawBytes []byte, offset uint32
 			contextTypeName = "PREAUTH_INTEGRITY"
 		case SMB2_ENCRYPTION_CAPABILITIES:
 			contextTypeName = "ENCRYPTION"
-		case 0x0003:
+			// CipherCount (2) followed by the cipher IDs
+			data := rawBytes[pos+8:]
+			if int(dataLen) < len(data) {
+				data = data[:dataLen]
+			}
+			if len(data) >= 2 {
+				r := NewByteReader(data)
+				for n := r.ReadUint16(); n > 0 && r.Remaining() >= 2; n-- {
+					ciphers = append(ciphers, r.ReadUint16())
+				}
+			}
+		case SMB2_COMPRESSION_CAPABILITIES:
 			contextTypeName = "COMPRESSION"
+			// CompressionAlgorithmCount (2), Padding (2) and Flags (4)
+			// followed by the algorithm IDs
+			data := rawBytes[pos+8:]
+			if int(dataLen) < len(data) {
+				data = data[:dataLen]
+			}
+			if len(data) >= 8 {
+				r := NewByteReader(data)
+				n := r.ReadUint16()
+				r.Skip(6)
+				for ; n > 0 && r.Remaining() >= 2; n-- {
+					compression = append(compression, r.ReadUint16())
+				}
+			}
 		case 0x0005:
 			contextTypeName = "NETNAME_NEGOTIATE"
 		case 0x0006:
@@ -412,6 +511,7 @@ func (h *SMBHandler) parseClientNegotiateContexts(rawBytes []byte, offset uint32
 		padding := (8 - (int(dataLen) % 8)) % 8
 		pos += padding
 	}
+	return ciphers, compression
 }
 
 // formatDialects formats a slice of dialects for logging
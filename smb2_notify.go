@@ -0,0 +1,538 @@
+package smbfs
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// CHANGE_NOTIFY CompletionFilter flags (MS-SMB2 2.2.35)
+const (
+	FILE_NOTIFY_CHANGE_FILE_NAME    uint32 = 0x00000001
+	FILE_NOTIFY_CHANGE_DIR_NAME     uint32 = 0x00000002
+	FILE_NOTIFY_CHANGE_ATTRIBUTES   uint32 = 0x00000004
+	FILE_NOTIFY_CHANGE_SIZE         uint32 = 0x00000008
+	FILE_NOTIFY_CHANGE_LAST_WRITE   uint32 = 0x00000010
+	FILE_NOTIFY_CHANGE_LAST_ACCESS  uint32 = 0x00000020
+	FILE_NOTIFY_CHANGE_CREATION     uint32 = 0x00000040
+	FILE_NOTIFY_CHANGE_EA           uint32 = 0x00000080
+	FILE_NOTIFY_CHANGE_SECURITY     uint32 = 0x00000100
+	FILE_NOTIFY_CHANGE_STREAM_NAME  uint32 = 0x00000200
+	FILE_NOTIFY_CHANGE_STREAM_SIZE  uint32 = 0x00000400
+	FILE_NOTIFY_CHANGE_STREAM_WRITE uint32 = 0x00000800
+)
+
+// CHANGE_NOTIFY request flags
+const (
+	SMB2_WATCH_TREE uint16 = 0x0001
+)
+
+// FILE_NOTIFY_INFORMATION actions (MS-FSCC 2.7.1)
+const (
+	FILE_ACTION_ADDED            uint32 = 0x00000001
+	FILE_ACTION_REMOVED          uint32 = 0x00000002
+	FILE_ACTION_MODIFIED         uint32 = 0x00000003
+	FILE_ACTION_RENAMED_OLD_NAME uint32 = 0x00000004
+	FILE_ACTION_RENAMED_NEW_NAME uint32 = 0x00000005
+)
+
+// maxBufferedNotifyEvents bounds the changes kept for a watch between requests;
+// beyond this the client is told to re-enumerate the directory
+const maxBufferedNotifyEvents = 4096
+
+// ChangeEvent is a single change below a watched directory
+type ChangeEvent struct {
+	Action uint32 // FILE_ACTION_* value
+	Name   string // Path relative to the watched directory, '/' separated
+	IsDir  bool   // Whether the entry is a directory
+}
+
+// ChangeWatcher is implemented by filesystems that can report directory
+// changes natively. Shares on other filesystems are polled with ReadDir
+// every ServerOptions.ChangeNotifyInterval
+// Each value received is a group of changes observed together (such as the
+// two halves of a rename); the channel is closed when ctx is done
+type ChangeWatcher interface {
+	WatchDir(ctx context.Context, dir string, recursive bool) (<-chan []ChangeEvent, error)
+}
+
+// notifyKey identifies the directory handle a watch belongs to
+type notifyKey struct {
+	share *Share
+	id    FileID
+}
+
+// notifyRequest is an outstanding (async) CHANGE_NOTIFY request
+type notifyRequest struct {
+	asyncRequest
+	treeID    uint32
+	maxOutput uint32
+}
+
+// notifyWatch tracks changes for one directory handle
+type notifyWatch struct {
+	key       notifyKey
+	dir       string
+	recursive bool
+	filter    uint32
+	sessionID uint64
+	conn      *connState
+
+	events   []ChangeEvent
+	overflow bool
+	pending  []*notifyRequest
+	cancel   context.CancelFunc
+}
+
+// notifyManager owns all CHANGE_NOTIFY watches of a server
+type notifyManager struct {
+	server *Server
+
+	mu      sync.Mutex
+	watches map[notifyKey]*notifyWatch
+}
+
+// newNotifyManager creates an empty notify manager
+func newNotifyManager(server *Server) *notifyManager {
+	return &notifyManager{
+		server:  server,
+		watches: make(map[notifyKey]*notifyWatch),
+	}
+}
+
+// handleChangeNotify processes an SMB2 CHANGE_NOTIFY request
+// Buffered changes are returned immediately; otherwise an interim
+// STATUS_PENDING response is sent and the request completes asynchronously
+func (h *SMBHandler) handleChangeNotify(state *connState, msg *SMB2Message, respHeader *SMB2Header) ([]byte, NTStatus) {
+	session, tree, status := h.validateTree(msg.Header)
+	if status != STATUS_SUCCESS {
+		return h.buildErrorResponse(), status
+	}
+
+	if len(msg.Payload) < 32 {
+		return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+	}
+
+	r := NewByteReader(msg.Payload)
+	structSize := r.ReadUint16()
+	if structSize != 32 {
+		return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+	}
+
+	flags := r.ReadUint16()
+	outputBufferLength := r.ReadUint32()
+	fileID := r.ReadFileID()
+	completionFilter := r.ReadUint32()
+	_ = r.ReadUint32() // Reserved
+
+	of := tree.Share.fileHandles.GetByTree(fileID, tree.ID, session.ID)
+	if of == nil {
+		return h.buildErrorResponse(), STATUS_FILE_CLOSED
+	}
+	if !of.IsDir {
+		return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+	}
+
+	h.server.logger.Debug("CHANGE_NOTIFY: %s (filter=0x%x, flags=0x%x, maxOutput=%d)",
+		of.Path, completionFilter, flags, outputBufferLength)
+
+	m := h.server.notify
+	w, err := m.watch(tree.Share, of, state, flags&SMB2_WATCH_TREE != 0, completionFilter)
+	if err != nil {
+		h.server.logger.Warn("CHANGE_NOTIFY: failed to watch %s: %v", of.Path, err)
+		return h.buildErrorResponse(), mapGoErrorToNTStatus(err)
+	}
+
+	req := &notifyRequest{
+		asyncRequest: *h.newAsyncRequest(state, msg, session),
+		treeID:       tree.ID,
+		maxOutput:    outputBufferLength,
+	}
+
+	// Hold the connection's write lock until the interim response is out so
+	// a completion racing with registration cannot overtake it
+	state.writeMu.Lock()
+	defer state.writeMu.Unlock()
+
+	m.mu.Lock()
+	if len(w.events) > 0 || w.overflow {
+		payload, status := m.takeEventsLocked(w, outputBufferLength)
+		m.mu.Unlock()
+		return payload, status
+	}
+	w.pending = append(w.pending, req)
+	m.mu.Unlock()
+
+	h.sendInterim(&req.asyncRequest, respHeader)
+
+	// The final response is sent when changes arrive
+	return nil, STATUS_PENDING
+}
+
+// watch returns the watch for a directory handle, starting it on first use
+func (m *notifyManager) watch(share *Share, of *OpenFile, state *connState, recursive bool, filter uint32) (*notifyWatch, error) {
+	key := notifyKey{share: share, id: of.ID}
+
+	m.mu.Lock()
+	if w, ok := m.watches[key]; ok {
+		w.conn = state
+		m.mu.Unlock()
+		return w, nil
+	}
+	m.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(m.server.ctx)
+
+	var events <-chan []ChangeEvent
+	if cw, ok := share.FileSystem().(ChangeWatcher); ok {
+		ch, err := cw.WatchDir(ctx, of.Path, recursive)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		events = ch
+	} else {
+		events = pollChanges(ctx, share.FileSystem(), of.Path, recursive, m.server.options.ChangeNotifyInterval)
+	}
+
+	w := &notifyWatch{
+		key:       key,
+		dir:       of.Path,
+		recursive: recursive,
+		filter:    filter,
+		sessionID: of.SessionID,
+		conn:      state,
+		cancel:    cancel,
+	}
+
+	m.mu.Lock()
+	if existing, ok := m.watches[key]; ok {
+		// Lost a race with another request on the same handle
+		m.mu.Unlock()
+		cancel()
+		return existing, nil
+	}
+	m.watches[key] = w
+	m.mu.Unlock()
+
+	go func() {
+		for batch := range events {
+			m.deliver(w, batch)
+		}
+	}()
+
+	return w, nil
+}
+
+// deliver records changes for a watch and completes a pending request
+func (m *notifyManager) deliver(w *notifyWatch, batch []ChangeEvent) {
+	var matched []ChangeEvent
+	for _, ev := range batch {
+		if notifyFilterMatches(w.filter, ev) {
+			matched = append(matched, ev)
+		}
+	}
+	if len(matched) == 0 {
+		return
+	}
+
+	m.mu.Lock()
+	if m.watches[w.key] != w {
+		m.mu.Unlock()
+		return
+	}
+	if !w.overflow {
+		w.events = append(w.events, matched...)
+		if len(w.events) > maxBufferedNotifyEvents {
+			w.events = nil
+			w.overflow = true
+		}
+	}
+	if len(w.pending) == 0 {
+		m.mu.Unlock()
+		return
+	}
+	req := w.pending[0]
+	w.pending = w.pending[1:]
+	payload, status := m.takeEventsLocked(w, req.maxOutput)
+	m.mu.Unlock()
+
+	m.complete(req, payload, status)
+}
+
+// takeEventsLocked builds a CHANGE_NOTIFY response from buffered changes
+// and clears them. m.mu must be held
+func (m *notifyManager) takeEventsLocked(w *notifyWatch, maxOutput uint32) ([]byte, NTStatus) {
+	events := w.events
+	overflow := w.overflow
+	w.events = nil
+	w.overflow = false
+
+	buf := buildFileNotifyInformation(events)
+	if overflow || len(buf) > int(maxOutput) {
+		// Too many changes to describe; the client must re-enumerate
+		return buildChangeNotifyResponse(nil), STATUS_NOTIFY_ENUM_DIR
+	}
+	return buildChangeNotifyResponse(buf), STATUS_SUCCESS
+}
+
+// complete sends the final response for an async CHANGE_NOTIFY request
+func (m *notifyManager) complete(req *notifyRequest, payload []byte, status NTStatus) {
+	m.server.completeAsync(&req.asyncRequest, payload, status)
+}
+
+// remove stops watches selected by match and returns their pending requests
+func (m *notifyManager) remove(match func(w *notifyWatch) bool) []*notifyRequest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var pending []*notifyRequest
+	for key, w := range m.watches {
+		if !match(w) {
+			continue
+		}
+		w.cancel()
+		delete(m.watches, key)
+		pending = append(pending, w.pending...)
+		w.pending = nil
+	}
+	return pending
+}
+
+// closeHandle stops the watch on a handle being closed, completing its
+// outstanding requests with STATUS_NOTIFY_CLEANUP
+func (m *notifyManager) closeHandle(share *Share, id FileID) {
+	key := notifyKey{share: share, id: id}
+	for _, req := range m.remove(func(w *notifyWatch) bool { return w.key == key }) {
+		m.complete(req, buildChangeNotifyResponse(nil), STATUS_NOTIFY_CLEANUP)
+	}
+}
+
+// releaseSession stops all watches owned by a session that is going away
+func (m *notifyManager) releaseSession(sessionID uint64) {
+	for _, req := range m.remove(func(w *notifyWatch) bool { return w.sessionID == sessionID }) {
+		m.complete(req, buildChangeNotifyResponse(nil), STATUS_NOTIFY_CLEANUP)
+	}
+}
+
+// releaseConn stops watches whose requests arrived on a closed connection
+func (m *notifyManager) releaseConn(state *connState) {
+	m.remove(func(w *notifyWatch) bool { return w.conn == state })
+}
+
+// cancelRequest completes a pending request named by an SMB2 CANCEL
+func (m *notifyManager) cancelRequest(state *connState, header *SMB2Header) bool {
+	async := header.Flags&SMB2_FLAGS_ASYNC_COMMAND != 0
+	asyncID := uint64(header.Reserved) | uint64(header.TreeID)<<32
+
+	m.mu.Lock()
+	var found *notifyRequest
+	for _, w := range m.watches {
+		for i, req := range w.pending {
+			if req.conn != state {
+				continue
+			}
+			if (async && req.asyncID == asyncID) || (!async && req.messageID == header.MessageID) {
+				found = req
+				w.pending = append(w.pending[:i], w.pending[i+1:]...)
+				break
+			}
+		}
+		if found != nil {
+			break
+		}
+	}
+	m.mu.Unlock()
+
+	if found == nil {
+		return false
+	}
+	m.complete(found, buildChangeNotifyResponse(nil), STATUS_CANCELLED)
+	return true
+}
+
+// notifyFilterMatches reports whether a change is selected by a CompletionFilter
+func notifyFilterMatches(filter uint32, ev ChangeEvent) bool {
+	if ev.Action == FILE_ACTION_MODIFIED {
+		return filter&(FILE_NOTIFY_CHANGE_SIZE|FILE_NOTIFY_CHANGE_LAST_WRITE|FILE_NOTIFY_CHANGE_ATTRIBUTES) != 0
+	}
+	if ev.IsDir {
+		return filter&FILE_NOTIFY_CHANGE_DIR_NAME != 0
+	}
+	return filter&FILE_NOTIFY_CHANGE_FILE_NAME != 0
+}
+
+// buildFileNotifyInformation encodes changes as chained
+// FILE_NOTIFY_INFORMATION entries (MS-FSCC 2.7.1)
+func buildFileNotifyInformation(events []ChangeEvent) []byte {
+	w := NewByteWriter(64 * len(events))
+	prev := -1
+	for _, ev := range events {
+		// Entries are 4-byte aligned
+		for w.Len()%4 != 0 {
+			w.WriteOneByte(0)
+		}
+		start := w.Len()
+		if prev >= 0 {
+			w.SetUint32At(prev, uint32(start-prev))
+		}
+
+		name := EncodeStringToUTF16LE(strings.ReplaceAll(ev.Name, "/", "\\"))
+		w.WriteUint32(0)                 // NextEntryOffset (patched by next entry)
+		w.WriteUint32(ev.Action)         // Action
+		w.WriteUint32(uint32(len(name))) // FileNameLength
+		w.WriteBytes(name)               // FileName
+		prev = start
+	}
+	return w.Bytes()
+}
+
+// buildChangeNotifyResponse builds a CHANGE_NOTIFY response body (MS-SMB2 2.2.36)
+func buildChangeNotifyResponse(buf []byte) []byte {
+	w := NewByteWriter(8 + len(buf))
+	w.WriteUint16(9) // StructureSize
+	if len(buf) > 0 {
+		w.WriteUint16(SMB2HeaderSize + 8) // OutputBufferOffset
+	} else {
+		w.WriteUint16(0) // OutputBufferOffset
+	}
+	w.WriteUint32(uint32(len(buf))) // OutputBufferLength
+	if len(buf) > 0 {
+		w.WriteBytes(buf) // Buffer
+	} else {
+		w.WriteOneByte(0) // Buffer (structure requires one byte)
+	}
+	return w.Bytes()
+}
+
+// dirSnapshotEntry is the state of one entry seen by the polling watcher
+type dirSnapshotEntry struct {
+	isDir   bool
+	size    int64
+	modTime time.Time
+}
+
+// snapshotDir records the entries below dir (recursively if requested)
+func snapshotDir(fsys absfs.FileSystem, dir string, recursive bool) map[string]dirSnapshotEntry {
+	snap := make(map[string]dirSnapshotEntry)
+
+	var walk func(rel string)
+	walk = func(rel string) {
+		entries, err := fsys.ReadDir(path.Join(dir, rel))
+		if err != nil {
+			return
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			name := path.Join(rel, entry.Name())
+			snap[name] = dirSnapshotEntry{
+				isDir:   entry.IsDir(),
+				size:    info.Size(),
+				modTime: info.ModTime(),
+			}
+			if recursive && entry.IsDir() {
+				walk(name)
+			}
+		}
+	}
+	walk("")
+
+	return snap
+}
+
+// diffSnapshots describes the changes between two snapshots
+// A removal and an addition of identical entries in the same directory are
+// reported as a rename
+func diffSnapshots(before, after map[string]dirSnapshotEntry) []ChangeEvent {
+	var removed, added, modified []string
+	for name, old := range before {
+		cur, ok := after[name]
+		if !ok {
+			removed = append(removed, name)
+		} else if !old.isDir && (cur.size != old.size || !cur.modTime.Equal(old.modTime)) {
+			modified = append(modified, name)
+		}
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(removed)
+	sort.Strings(added)
+	sort.Strings(modified)
+
+	var events []ChangeEvent
+	paired := make(map[string]bool)
+	for _, oldName := range removed {
+		old := before[oldName]
+		newName := ""
+		for _, candidate := range added {
+			cur := after[candidate]
+			if !paired[candidate] && path.Dir(candidate) == path.Dir(oldName) &&
+				cur.isDir == old.isDir && cur.size == old.size && cur.modTime.Equal(old.modTime) {
+				newName = candidate
+				break
+			}
+		}
+		if newName == "" {
+			events = append(events, ChangeEvent{Action: FILE_ACTION_REMOVED, Name: oldName, IsDir: old.isDir})
+			continue
+		}
+		paired[newName] = true
+		events = append(events,
+			ChangeEvent{Action: FILE_ACTION_RENAMED_OLD_NAME, Name: oldName, IsDir: old.isDir},
+			ChangeEvent{Action: FILE_ACTION_RENAMED_NEW_NAME, Name: newName, IsDir: old.isDir})
+	}
+	for _, name := range added {
+		if !paired[name] {
+			events = append(events, ChangeEvent{Action: FILE_ACTION_ADDED, Name: name, IsDir: after[name].isDir})
+		}
+	}
+	for _, name := range modified {
+		events = append(events, ChangeEvent{Action: FILE_ACTION_MODIFIED, Name: name})
+	}
+	return events
+}
+
+// pollChanges watches dir by diffing ReadDir snapshots every interval
+// The returned channel is closed when ctx is done
+func pollChanges(ctx context.Context, fsys absfs.FileSystem, dir string, recursive bool, interval time.Duration) <-chan []ChangeEvent {
+	ch := make(chan []ChangeEvent, 1)
+	before := snapshotDir(fsys, dir, recursive)
+
+	go func() {
+		defer close(ch)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			after := snapshotDir(fsys, dir, recursive)
+			if events := diffSnapshots(before, after); len(events) > 0 {
+				select {
+				case ch <- events:
+				case <-ctx.Done():
+					return
+				}
+			}
+			before = after
+		}
+	}()
+
+	return ch
+}
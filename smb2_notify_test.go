@@ -0,0 +1,334 @@
+package smbfs
+
+import (
+	"io"
+	"io/fs"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/absfs/memfs"
+)
+
+// syncFS serializes directory scans with changes made by a test, since memfs
+// is not safe for concurrent use
+type syncFS struct {
+	*memfs.FileSystem
+	mu sync.Mutex
+}
+
+// ReadDir returns entries whose info was captured under the lock
+func (s *syncFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.FileSystem.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]fs.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, fs.FileInfoToDirEntry(info))
+	}
+	return out, nil
+}
+
+// change runs fn while no directory scan is in progress
+func (s *syncFS) change(t *testing.T, fn func() error) {
+	t.Helper()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := fn(); err != nil {
+		t.Fatalf("change error = %v", err)
+	}
+}
+
+// setupNotifyTree returns a tree connection on a share backed by syncFS
+// with an empty /watch directory, polled every 10ms
+func setupNotifyTree(t *testing.T) (*Server, *Session, *TreeConnection, *syncFS) {
+	t.Helper()
+
+	srv := setupTestServer(t)
+	srv.options.ChangeNotifyInterval = 10 * time.Millisecond
+
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+	if err := mfs.Mkdir("/watch", 0755); err != nil {
+		t.Fatalf("Mkdir() error = %v", err)
+	}
+	fsys := &syncFS{FileSystem: mfs}
+	if err := srv.AddShare(fsys, ShareOptions{ShareName: "test"}); err != nil {
+		t.Fatalf("AddShare() error = %v", err)
+	}
+
+	session := srv.sessions.CreateSession(SMB3_1_1, [16]byte{}, "127.0.0.1")
+	session.SetValid("testuser", "", false, nil)
+	tree := session.AddTreeConnection("test", srv.GetShare("test"), false)
+
+	// Stop pollers before the test's pipes are closed
+	t.Cleanup(func() { srv.cancel() })
+
+	return srv, session, tree, fsys
+}
+
+// buildChangeNotifyRequest builds a CHANGE_NOTIFY request payload
+func buildChangeNotifyRequest(fileID FileID, flags uint16, filter uint32) []byte {
+	w := NewByteWriter(32)
+	w.WriteUint16(32)    // StructureSize
+	w.WriteUint16(flags) // Flags
+	w.WriteUint32(65536) // OutputBufferLength
+	w.WriteFileID(fileID)
+	w.WriteUint32(filter) // CompletionFilter
+	w.WriteUint32(0)      // Reserved
+	return w.Bytes()
+}
+
+// parseFileNotifyInformation decodes chained FILE_NOTIFY_INFORMATION entries
+func parseFileNotifyInformation(t *testing.T, buf []byte) []ChangeEvent {
+	t.Helper()
+
+	var events []ChangeEvent
+	for off := 0; ; {
+		if off+12 > len(buf) {
+			t.Fatalf("FILE_NOTIFY_INFORMATION truncated at offset %d", off)
+		}
+		next := le.Uint32(buf[off:])
+		nameLen := int(le.Uint32(buf[off+8:]))
+		name := DecodeUTF16LEToString(buf[off+12 : off+12+nameLen])
+		events = append(events, ChangeEvent{Action: le.Uint32(buf[off+4:]), Name: name})
+		if next == 0 {
+			return events
+		}
+		off += int(next)
+	}
+}
+
+// notifyClient reads messages the server writes to one end of a pipe
+type notifyClient struct {
+	t    *testing.T
+	msgs chan []byte
+}
+
+func newNotifyClient(t *testing.T, conn net.Conn) *notifyClient {
+	c := &notifyClient{t: t, msgs: make(chan []byte, 16)}
+	go func() {
+		defer close(c.msgs)
+		for {
+			nbHeader := make([]byte, 4)
+			if _, err := io.ReadFull(conn, nbHeader); err != nil {
+				return
+			}
+			raw := make([]byte, int(nbHeader[1])<<16|int(nbHeader[2])<<8|int(nbHeader[3]))
+			if _, err := io.ReadFull(conn, raw); err != nil {
+				return
+			}
+			c.msgs <- raw
+		}
+	}()
+	return c
+}
+
+// next returns the next CHANGE_NOTIFY message from the server
+func (c *notifyClient) next() (*SMB2Header, []byte) {
+	c.t.Helper()
+
+	select {
+	case raw, ok := <-c.msgs:
+		if !ok {
+			c.t.Fatal("Connection closed while waiting for CHANGE_NOTIFY response")
+		}
+		header, err := UnmarshalSMB2Header(raw)
+		if err != nil {
+			c.t.Fatalf("UnmarshalSMB2Header() error = %v", err)
+		}
+		if header.Command != SMB2_CHANGE_NOTIFY {
+			c.t.Fatalf("Command = %s, want CHANGE_NOTIFY", CommandName(header.Command))
+		}
+		return header, raw[SMB2HeaderSize:]
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("Timed out waiting for CHANGE_NOTIFY response")
+	}
+	return nil, nil
+}
+
+// TestChangeNotify_PollingWatcher tests that creating, renaming and deleting
+// a file complete outstanding CHANGE_NOTIFY requests with the matching actions
+func TestChangeNotify_PollingWatcher(t *testing.T) {
+	srv, session, tree, fsys := setupNotifyTree(t)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	state := &connState{conn: serverConn, remoteAddr: "watcher"}
+	client := newNotifyClient(t, clientConn)
+
+	resp, status := srv.handler.handleCreate(state,
+		testRequest(session, tree, SMB2_CREATE, buildCreateRequest("watch", FILE_OPEN, FILE_DIRECTORY_FILE, nil)), nil)
+	if status != STATUS_SUCCESS {
+		t.Fatalf("CREATE status = %v, want STATUS_SUCCESS", status)
+	}
+	dirID := UnmarshalFileID(resp[64:80])
+
+	var messageID uint64
+	notify := func() {
+		t.Helper()
+		messageID++
+		msg := testRequest(session, tree, SMB2_CHANGE_NOTIFY,
+			buildChangeNotifyRequest(dirID, 0, FILE_NOTIFY_CHANGE_FILE_NAME|FILE_NOTIFY_CHANGE_DIR_NAME))
+		msg.Header.MessageID = messageID
+		respHeader := &SMB2Header{Command: SMB2_CHANGE_NOTIFY, MessageID: messageID, SessionID: session.ID, TreeID: tree.ID}
+		if payload, status := srv.handler.handleChangeNotify(state, msg, respHeader); payload != nil || status != STATUS_PENDING {
+			t.Fatalf("CHANGE_NOTIFY = (%d bytes, %v), want pending", len(payload), status)
+		}
+		interim, _ := client.next()
+		if interim.Status != STATUS_PENDING || interim.Flags&SMB2_FLAGS_ASYNC_COMMAND == 0 {
+			t.Fatalf("interim response status=%v flags=0x%x, want async STATUS_PENDING", interim.Status, interim.Flags)
+		}
+	}
+	expect := func(want ...ChangeEvent) {
+		t.Helper()
+		header, payload := client.next()
+		if header.Status != STATUS_SUCCESS {
+			t.Fatalf("CHANGE_NOTIFY status = %v, want STATUS_SUCCESS", header.Status)
+		}
+		if header.MessageID != messageID {
+			t.Errorf("MessageID = %d, want %d", header.MessageID, messageID)
+		}
+		offset := int(le.Uint16(payload[2:4])) - SMB2HeaderSize
+		length := int(le.Uint32(payload[4:8]))
+		if got := parseFileNotifyInformation(t, payload[offset:offset+length]); !reflect.DeepEqual(got, want) {
+			t.Errorf("events = %+v, want %+v", got, want)
+		}
+	}
+
+	notify()
+	fsys.change(t, func() error {
+		f, err := fsys.Create("/watch/a.txt")
+		if err != nil {
+			return err
+		}
+		f.Write([]byte("data"))
+		return f.Close()
+	})
+	expect(ChangeEvent{Action: FILE_ACTION_ADDED, Name: "a.txt"})
+
+	notify()
+	fsys.change(t, func() error { return fsys.Rename("/watch/a.txt", "/watch/b.txt") })
+	expect(ChangeEvent{Action: FILE_ACTION_RENAMED_OLD_NAME, Name: "a.txt"},
+		ChangeEvent{Action: FILE_ACTION_RENAMED_NEW_NAME, Name: "b.txt"})
+
+	notify()
+	fsys.change(t, func() error { return fsys.Remove("/watch/b.txt") })
+	expect(ChangeEvent{Action: FILE_ACTION_REMOVED, Name: "b.txt"})
+
+	// Closing the directory completes the outstanding request
+	notify()
+	if _, status := srv.handler.handleClose(state, testRequest(session, tree, SMB2_CLOSE, buildCloseRequest(dirID))); status != STATUS_SUCCESS {
+		t.Fatalf("CLOSE status = %v, want STATUS_SUCCESS", status)
+	}
+	if header, _ := client.next(); header.Status != STATUS_NOTIFY_CLEANUP {
+		t.Errorf("status after CLOSE = %v, want STATUS_NOTIFY_CLEANUP", header.Status)
+	}
+	if got := len(srv.notify.watches); got != 0 {
+		t.Errorf("watches after CLOSE = %d, want 0", got)
+	}
+}
+
+// TestChangeNotify_BufferedAndCancel tests that changes made between requests
+// are returned synchronously and that CANCEL completes a pending request
+func TestChangeNotify_BufferedAndCancel(t *testing.T) {
+	srv, session, tree, fsys := setupNotifyTree(t)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	state := &connState{conn: serverConn, remoteAddr: "watcher"}
+	client := newNotifyClient(t, clientConn)
+
+	resp, status := srv.handler.handleCreate(state,
+		testRequest(session, tree, SMB2_CREATE, buildCreateRequest("watch", FILE_OPEN, FILE_DIRECTORY_FILE, nil)), nil)
+	if status != STATUS_SUCCESS {
+		t.Fatalf("CREATE status = %v, want STATUS_SUCCESS", status)
+	}
+	dirID := UnmarshalFileID(resp[64:80])
+
+	msg := testRequest(session, tree, SMB2_CHANGE_NOTIFY, buildChangeNotifyRequest(dirID, 0, FILE_NOTIFY_CHANGE_DIR_NAME))
+	msg.Header.MessageID = 7
+	respHeader := &SMB2Header{Command: SMB2_CHANGE_NOTIFY, MessageID: 7}
+	if _, status := srv.handler.handleChangeNotify(state, msg, respHeader); status != STATUS_PENDING {
+		t.Fatalf("CHANGE_NOTIFY status = %v, want STATUS_PENDING", status)
+	}
+	interim, _ := client.next()
+
+	// A file is filtered out; the subdirectory completes the request
+	fsys.change(t, func() error {
+		f, err := fsys.Create("/watch/ignored.txt")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		return fsys.Mkdir("/watch/sub", 0755)
+	})
+	header, payload := client.next()
+	if header.Status != STATUS_SUCCESS {
+		t.Fatalf("CHANGE_NOTIFY status = %v, want STATUS_SUCCESS", header.Status)
+	}
+	want := []ChangeEvent{{Action: FILE_ACTION_ADDED, Name: "sub"}}
+	if got := parseFileNotifyInformation(t, payload[8:]); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %+v, want %+v", got, want)
+	}
+
+	// Changes seen while no request is outstanding are buffered
+	fsys.change(t, func() error { return fsys.Remove("/watch/sub") })
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		srv.notify.mu.Lock()
+		n := 0
+		for _, w := range srv.notify.watches {
+			n += len(w.events)
+		}
+		srv.notify.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for buffered change")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	payload, status = srv.handler.handleChangeNotify(state, msg, respHeader)
+	if status != STATUS_SUCCESS {
+		t.Fatalf("buffered CHANGE_NOTIFY status = %v, want STATUS_SUCCESS", status)
+	}
+	want = []ChangeEvent{{Action: FILE_ACTION_REMOVED, Name: "sub"}}
+	if got := parseFileNotifyInformation(t, payload[8:]); !reflect.DeepEqual(got, want) {
+		t.Errorf("buffered events = %+v, want %+v", got, want)
+	}
+
+	// CANCEL by AsyncId
+	if _, status := srv.handler.handleChangeNotify(state, msg, respHeader); status != STATUS_PENDING {
+		t.Fatalf("CHANGE_NOTIFY status = %v, want STATUS_PENDING", status)
+	}
+	interim, _ = client.next()
+	cancel := &SMB2Message{Header: &SMB2Header{
+		Command:  SMB2_CANCEL,
+		Flags:    SMB2_FLAGS_ASYNC_COMMAND,
+		Reserved: interim.Reserved,
+		TreeID:   interim.TreeID,
+	}}
+	if resp, err := srv.handler.HandleMessage(state, cancel); err != nil || resp != nil {
+		t.Fatalf("HandleMessage(CANCEL) = (%v, %v), want no response", resp, err)
+	}
+	if header, _ := client.next(); header.Status != STATUS_CANCELLED {
+		t.Errorf("status after CANCEL = %v, want STATUS_CANCELLED", header.Status)
+	}
+}
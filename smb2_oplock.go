@@ -0,0 +1,136 @@
+package smbfs
+
+// Access rights whose use on a file invalidates other clients' cached reads
+const oplockBreakAccess = FILE_WRITE_DATA | FILE_APPEND_DATA | DELETE
+
+// oplockBreak describes an oplock break notification to send
+type oplockBreak struct {
+	conn   *connState
+	fileID FileID
+}
+
+// conflictsWithCaching reports whether an open can change the file's data,
+// breaking the read caching granted to other opens
+func conflictsWithCaching(access, createAction uint32) bool {
+	return mapGenericAccess(access)&oplockBreakAccess != 0 ||
+		createAction == FILE_OVERWRITTEN || createAction == FILE_SUPERSEDED
+}
+
+// canCacheReads reports whether of may be granted read caching: no other
+// open of the same file may be able to change its data
+func (m *FileHandleMap) canCacheReads(of *OpenFile) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, other := range m.byPath[of.Path] {
+		if other != of && mapGenericAccess(other.Access)&oplockBreakAccess != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// grantOplock grants of a level II oplock if read caching is allowed,
+// recording the connection its break will be sent on
+func (m *FileHandleMap) grantOplock(of *OpenFile, conn *connState) bool {
+	if !m.canCacheReads(of) {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	of.OplockLevel = SMB2_OPLOCK_LEVEL_II
+	of.oplockConn = conn
+	return true
+}
+
+// oplockLevel returns the oplock currently held by of
+func (m *FileHandleMap) oplockLevel(of *OpenFile) uint8 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return of.OplockLevel
+}
+
+// breakOplocks breaks the level II oplocks held on path by opens other than
+// except to none. Returns the notifications that must be sent
+func (m *FileHandleMap) breakOplocks(path string, except *OpenFile) []oplockBreak {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var breaks []oplockBreak
+	for _, of := range m.byPath[path] {
+		if of == except || of.OplockLevel == SMB2_OPLOCK_LEVEL_NONE {
+			continue
+		}
+		of.OplockLevel = SMB2_OPLOCK_LEVEL_NONE
+		breaks = append(breaks, oplockBreak{conn: of.oplockConn, fileID: of.ID})
+		of.oplockConn = nil
+	}
+	return breaks
+}
+
+// grantCaching grants a new file or directory open the oplock or lease it
+// asked for, within what the server supports: directory leases with read
+// and handle caching, and read caching on files as a level II oplock or a
+// read lease. Exclusive and batch oplock requests get level II
+func (h *SMBHandler) grantCaching(state *connState, share *Share, of *OpenFile, oplockLevel uint8, leaseReq *leaseRequest) {
+	if share.Options().DisableOplocks {
+		return
+	}
+
+	switch {
+	case leaseReq != nil && of.IsDir:
+		of.Lease = h.server.leases.AcquireDirectoryLease(state, share.Options().ShareName, of.Path, leaseReq)
+	case leaseReq != nil:
+		if share.fileHandles.canCacheReads(of) {
+			of.Lease = h.server.leases.AcquireFileLease(state, share.Options().ShareName, of.Path, leaseReq)
+		}
+	case oplockLevel != SMB2_OPLOCK_LEVEL_NONE && oplockLevel != SMB2_OPLOCK_LEVEL_LEASE && !of.IsDir:
+		if share.fileHandles.grantOplock(of, state) {
+			h.server.logger.Debug("CREATE: level II oplock granted on %s", of.Path)
+		}
+	}
+}
+
+// breakFileCaching breaks the oplocks and leases other opens hold on of's
+// file, which of is about to change. The opener's own lease (leaseReq) is
+// kept
+func (h *SMBHandler) breakFileCaching(state *connState, share *Share, of *OpenFile, leaseReq *leaseRequest) {
+	for _, b := range share.fileHandles.breakOplocks(of.Path, of) {
+		if b.conn == nil {
+			continue
+		}
+		h.server.logger.Debug("Breaking level II oplock on %s (FileID=%d/%d)",
+			of.Path, b.fileID.Persistent, b.fileID.Volatile)
+		h.sendBreakNotification(b.conn, buildOplockBreakNotification(b.fileID, SMB2_OPLOCK_LEVEL_NONE))
+	}
+
+	var except *leaseID
+	if leaseReq != nil {
+		except = &leaseID{key: leaseReq.Key}
+		if state != nil {
+			except.clientGUID = state.clientGUID
+		}
+	}
+	h.sendLeaseBreaks(of.Path, h.server.leases.breakLeases(share.Options().ShareName, of.Path, except))
+}
+
+// buildOplockBreakNotification builds an SMB2 Oplock Break Notification (MS-SMB2 2.2.23.1)
+func buildOplockBreakNotification(fileID FileID, level uint8) *SMB2Message {
+	header := &SMB2Header{
+		StructureSize: SMB2HeaderSize,
+		Command:       SMB2_OPLOCK_BREAK,
+		Flags:         SMB2_FLAGS_SERVER_TO_REDIR,
+		MessageID:     0xFFFFFFFFFFFFFFFF, // Unsolicited notification
+	}
+	copy(header.ProtocolID[:], SMB2ProtocolID)
+
+	w := NewByteWriter(24)
+	w.WriteUint16(24)     // StructureSize
+	w.WriteOneByte(level) // OplockLevel
+	w.WriteOneByte(0)     // Reserved
+	w.WriteUint32(0)      // Reserved2
+	w.WriteFileID(fileID)
+
+	return &SMB2Message{Header: header, Payload: w.Bytes()}
+}
@@ -0,0 +1,175 @@
+package smbfs
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// buildOplockCreateRequest builds a CREATE request for name asking for the
+// given access and oplock level
+func buildOplockCreateRequest(name string, access uint32, oplockLevel uint8) []byte {
+	req := buildCreateRequest(name, FILE_OPEN_IF, FILE_NON_DIRECTORY_FILE, nil)
+	req[3] = oplockLevel             // RequestedOplockLevel
+	le.PutUint32(req[24:28], access) // DesiredAccess
+	return req
+}
+
+// readBreakNotification reads an unsolicited OPLOCK_BREAK from the client
+// end of a connection and returns its payload
+func readBreakNotification(t *testing.T, conn net.Conn) []byte {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	nbHeader := make([]byte, 4)
+	if _, err := io.ReadFull(conn, nbHeader); err != nil {
+		t.Fatalf("Failed to read break notification: %v", err)
+	}
+	raw := make([]byte, int(nbHeader[1])<<16|int(nbHeader[2])<<8|int(nbHeader[3]))
+	if _, err := io.ReadFull(conn, raw); err != nil {
+		t.Fatalf("Failed to read break notification: %v", err)
+	}
+
+	header, err := UnmarshalSMB2Header(raw)
+	if err != nil {
+		t.Fatalf("UnmarshalSMB2Header() error = %v", err)
+	}
+	if header.Command != SMB2_OPLOCK_BREAK || header.MessageID != 0xFFFFFFFFFFFFFFFF {
+		t.Fatalf("notification = %s (MessageID 0x%x), want unsolicited OPLOCK_BREAK",
+			CommandName(header.Command), header.MessageID)
+	}
+	return raw[SMB2HeaderSize:]
+}
+
+// TestOplock_LevelIIBreakOnWriteOpen tests that a reader gets a level II
+// oplock and loses it when another session opens the file for writing
+func TestOplock_LevelIIBreakOnWriteOpen(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	f, _ := tree.Share.fs.Create("/shared.txt")
+	f.Close()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	owner := &connState{conn: serverConn, remoteAddr: "owner", clientGUID: [16]byte{1}}
+
+	resp, status := srv.handler.handleCreate(owner, testRequest(session, tree, SMB2_CREATE,
+		buildOplockCreateRequest("shared.txt", GENERIC_READ, SMB2_OPLOCK_LEVEL_BATCH)), nil)
+	if status != STATUS_SUCCESS {
+		t.Fatalf("CREATE status = %v, want STATUS_SUCCESS", status)
+	}
+	if resp[2] != SMB2_OPLOCK_LEVEL_II {
+		t.Fatalf("OplockLevel = 0x%02x, want level II", resp[2])
+	}
+	first := UnmarshalFileID(resp[64:80])
+
+	// A second reader (with no connection to send its break on) shares the
+	// oplock level without breaking the first
+	resp, _ = srv.handler.handleCreate(nil, testRequest(session, tree, SMB2_CREATE,
+		buildOplockCreateRequest("shared.txt", GENERIC_READ, SMB2_OPLOCK_LEVEL_II)), nil)
+	if resp[2] != SMB2_OPLOCK_LEVEL_II {
+		t.Errorf("second reader OplockLevel = 0x%02x, want level II", resp[2])
+	}
+
+	// A writer from another session breaks the readers' oplocks; it is then
+	// the only open that may change the file, so it may cache reads itself
+	session2, tree2 := newTestSession(t, srv, "writer")
+	resp, status = srv.handler.handleCreate(&connState{}, testRequest(session2, tree2, SMB2_CREATE,
+		buildOplockCreateRequest("shared.txt", GENERIC_READ|GENERIC_WRITE, SMB2_OPLOCK_LEVEL_II)), nil)
+	if status != STATUS_SUCCESS {
+		t.Fatalf("writer CREATE status = %v, want STATUS_SUCCESS", status)
+	}
+	if resp[2] != SMB2_OPLOCK_LEVEL_II {
+		t.Errorf("writer OplockLevel = 0x%02x, want level II", resp[2])
+	}
+
+	payload := readBreakNotification(t, clientConn)
+	if le.Uint16(payload[0:2]) != 24 {
+		t.Fatalf("StructureSize = %d, want 24 (oplock break)", le.Uint16(payload[0:2]))
+	}
+	if payload[2] != SMB2_OPLOCK_LEVEL_NONE {
+		t.Errorf("break OplockLevel = 0x%02x, want none", payload[2])
+	}
+	if got := UnmarshalFileID(payload[8:24]); got != first {
+		t.Errorf("break FileId = %v, want %v", got, first)
+	}
+
+	if of := tree.Share.fileHandles.Get(first); of.OplockLevel != SMB2_OPLOCK_LEVEL_NONE {
+		t.Errorf("first handle OplockLevel = 0x%02x after break, want none", of.OplockLevel)
+	}
+}
+
+// TestOplock_FileLease tests that a file lease is granted read caching only
+// and broken, without acknowledgment, by a writer
+func TestOplock_FileLease(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	f, _ := tree.Share.fs.Create("/leased.txt")
+	f.Close()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	owner := &connState{conn: serverConn, remoteAddr: "owner", clientGUID: [16]byte{1}}
+
+	leaseKey := [16]byte{0x11, 0x22}
+	req := buildCreateRequest("leased.txt", FILE_OPEN, FILE_NON_DIRECTORY_FILE, &leaseKey)
+	le.PutUint32(req[24:28], GENERIC_READ) // DesiredAccess
+	resp, status := srv.handler.handleCreate(owner, testRequest(session, tree, SMB2_CREATE, req), nil)
+	if status != STATUS_SUCCESS {
+		t.Fatalf("CREATE status = %v, want STATUS_SUCCESS", status)
+	}
+	if resp[2] != SMB2_OPLOCK_LEVEL_LEASE {
+		t.Fatalf("OplockLevel = 0x%02x, want lease", resp[2])
+	}
+	lease := srv.leases.Lookup(owner.clientGUID, leaseKey)
+	if lease == nil || lease.State != SMB2_LEASE_READ_CACHING {
+		t.Fatalf("lease = %+v, want read caching only", lease)
+	}
+
+	_, status = srv.handler.handleCreate(&connState{clientGUID: [16]byte{2}}, testRequest(session, tree, SMB2_CREATE,
+		buildOplockCreateRequest("leased.txt", GENERIC_WRITE, SMB2_OPLOCK_LEVEL_NONE)), nil)
+	if status != STATUS_SUCCESS {
+		t.Fatalf("writer CREATE status = %v, want STATUS_SUCCESS", status)
+	}
+
+	payload := readBreakNotification(t, clientConn)
+	if le.Uint16(payload[0:2]) != 44 {
+		t.Fatalf("StructureSize = %d, want 44 (lease break)", le.Uint16(payload[0:2]))
+	}
+	if le.Uint32(payload[4:8])&SMB2_NOTIFY_BREAK_LEASE_FLAG_ACK_REQUIRED != 0 {
+		t.Error("break of a read lease should not require acknowledgment")
+	}
+	if lease.State != SMB2_LEASE_NONE {
+		t.Errorf("lease state after break = 0x%x, want 0", lease.State)
+	}
+}
+
+// TestOplock_Disabled tests that ShareOptions.DisableOplocks suppresses
+// oplocks and leases
+func TestOplock_Disabled(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	tree.Share.options.DisableOplocks = true
+	if err := tree.Share.fs.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("Mkdir() error = %v", err)
+	}
+
+	leaseKey := [16]byte{0x33}
+	tests := []struct {
+		name string
+		req  []byte
+	}{
+		{"oplock", buildOplockCreateRequest("f.txt", GENERIC_READ, SMB2_OPLOCK_LEVEL_II)},
+		{"directory lease", buildCreateRequest("dir", FILE_OPEN, FILE_DIRECTORY_FILE, &leaseKey)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, status := srv.handler.handleCreate(&connState{}, testRequest(session, tree, SMB2_CREATE, tt.req), nil)
+			if status != STATUS_SUCCESS {
+				t.Fatalf("CREATE status = %v, want STATUS_SUCCESS", status)
+			}
+			if resp[2] != SMB2_OPLOCK_LEVEL_NONE {
+				t.Errorf("OplockLevel = 0x%02x, want none", resp[2])
+			}
+		})
+	}
+}
@@ -0,0 +1,354 @@
+package smbfs
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// namedPipe is an open instance of a named pipe on IPC$
+// The only pipe served is srvsvc: each PDU written to it is answered with
+// one or more reply messages, which READ and FSCTL_PIPE_TRANSCEIVE return
+// one message at a time
+type namedPipe struct {
+	server *Server
+	name   string
+
+	mu        sync.Mutex
+	bound     bool     // A BIND accepted the srvsvc interface
+	contextID uint16   // Presentation context of the accepted bind
+	maxFrag   int      // Largest reply fragment the client accepts
+	replies   [][]byte // Reply messages not yet read
+}
+
+// openPipe returns a new instance of the named pipe, or nil if it is unknown
+// Names are accepted with or without a leading \PIPE\
+func (s *Server) openPipe(name string) *namedPipe {
+	name = strings.ToLower(strings.TrimLeft(name, `\/`))
+	name = strings.TrimPrefix(strings.TrimPrefix(name, `pipe\`), "pipe/")
+	if name != "srvsvc" {
+		return nil
+	}
+	return &namedPipe{server: s, name: name, maxFrag: rpcMaxFragSize}
+}
+
+// write processes a PDU written to the pipe and queues the replies
+func (p *namedPipe) write(pdu []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.replies = append(p.replies, p.handleRPC(pdu)...)
+}
+
+// read returns up to limit bytes of the next reply message; more is set if
+// part of the message is left for the next read
+func (p *namedPipe) read(limit int) (data []byte, more, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.replies) == 0 {
+		return nil, false, false
+	}
+	msg := p.replies[0]
+	if len(msg) > limit {
+		p.replies[0] = msg[limit:]
+		return msg[:limit], true, true
+	}
+	p.replies = p.replies[1:]
+	return msg, false, true
+}
+
+// handleRPC answers a DCE/RPC PDU; malformed PDUs get no reply
+func (p *namedPipe) handleRPC(pdu []byte) [][]byte {
+	h, err := parseRPCHeader(pdu)
+	if err != nil {
+		p.server.logger.Debug("PIPE %s: dropping malformed PDU: %v", p.name, err)
+		return nil
+	}
+
+	switch h.packetType {
+	case rpcPacketBind:
+		maxRecvFrag, contextID, results, err := parseRPCBind(pdu, h.fragLength)
+		if err != nil {
+			return [][]byte{buildRPCFault(h.callID, 0, rpcFaultProtoError)}
+		}
+		for _, res := range results {
+			if res.result == rpcContextAccepted {
+				p.bound, p.contextID = true, contextID
+			}
+		}
+		if maxRecvFrag >= 1432 && int(maxRecvFrag) < p.maxFrag {
+			p.maxFrag = int(maxRecvFrag)
+		}
+		return [][]byte{buildRPCBindAck(h.callID, uint16(p.maxFrag), p.name, results)}
+
+	case rpcPacketRequest:
+		return p.handleRequest(h, pdu)
+
+	default:
+		return [][]byte{buildRPCFault(h.callID, 0, rpcFaultProtoError)}
+	}
+}
+
+// handleRequest answers a srvsvc REQUEST; only NetrShareEnum is implemented
+func (p *namedPipe) handleRequest(h rpcHeader, pdu []byte) [][]byte {
+	if h.fragLength < rpcRequestHeaderSize || !p.bound ||
+		h.flags&(rpcFlagFirstFrag|rpcFlagLastFrag) != rpcFlagFirstFrag|rpcFlagLastFrag {
+		// Requests are small enough that clients never fragment them
+		return [][]byte{buildRPCFault(h.callID, p.contextID, rpcFaultProtoError)}
+	}
+	opnum := le.Uint16(pdu[22:24])
+	stub := pdu[rpcRequestHeaderSize:h.fragLength]
+
+	if opnum != srvsvcOpNetrShareEnum {
+		p.server.logger.Debug("PIPE %s: unsupported opnum %d", p.name, opnum)
+		return [][]byte{buildRPCFault(h.callID, p.contextID, rpcFaultOpRangeError)}
+	}
+
+	level, resume, err := parseNetrShareEnumRequest(stub)
+	if err != nil {
+		return [][]byte{buildRPCFault(h.callID, p.contextID, rpcFaultBadStubData)}
+	}
+	p.server.logger.Debug("PIPE %s: NetrShareEnum level %d", p.name, level)
+
+	resp := buildNetrShareEnumResponse(level, p.server.enumerableShares(), resume)
+	return buildRPCResponses(h.callID, p.contextID, resp, p.maxFrag)
+}
+
+// enumerableShares returns the shares NetrShareEnum reports: every share
+// that is not hidden, sorted by name
+func (s *Server) enumerableShares() []srvsvcShare {
+	s.sharesMu.RLock()
+	defer s.sharesMu.RUnlock()
+
+	var shares []srvsvcShare
+	for name, share := range s.shares {
+		if share.Options().Hidden {
+			continue
+		}
+
+		var shareType uint32
+		switch share.GetShareType() {
+		case SMBShareTypePipe:
+			shareType = stypeIPC
+		case SMBShareTypePrint:
+			shareType = stypePrintq
+		default:
+			shareType = stypeDisktree
+		}
+		if strings.HasSuffix(name, "$") {
+			shareType |= stypeSpecial
+		}
+
+		shares = append(shares, srvsvcShare{name: name, shareType: shareType, comment: share.Options().Comment})
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].name < shares[j].name })
+	return shares
+}
+
+// isPipeFileCommand reports whether cmd operates on an open, and so must be
+// served by the pipe handlers on IPC$
+func isPipeFileCommand(cmd uint16) bool {
+	switch cmd {
+	case SMB2_CREATE, SMB2_CLOSE, SMB2_READ, SMB2_WRITE, SMB2_FLUSH, SMB2_LOCK,
+		SMB2_QUERY_DIRECTORY, SMB2_QUERY_INFO, SMB2_SET_INFO, SMB2_CHANGE_NOTIFY:
+		return true
+	}
+	return false
+}
+
+// onPipeTree reports whether a request is for a valid tree on a pipe share
+func (h *SMBHandler) onPipeTree(header *SMB2Header) bool {
+	_, tree, status := h.validateTree(header)
+	return status == STATUS_SUCCESS && tree.Share.GetShareType() == SMBShareTypePipe
+}
+
+// dispatchPipe routes a request on IPC$ to its pipe handler
+// Opens there have no file behind them, so file-only commands are refused
+func (h *SMBHandler) dispatchPipe(msg *SMB2Message) ([]byte, NTStatus) {
+	session, tree, _ := h.validateTree(msg.Header)
+
+	switch msg.Header.Command {
+	case SMB2_CREATE:
+		return h.handlePipeCreate(session, tree, msg)
+	case SMB2_CLOSE:
+		return h.handlePipeClose(session, tree, msg)
+	case SMB2_READ:
+		return h.handlePipeRead(session, tree, msg)
+	case SMB2_WRITE:
+		return h.handlePipeWrite(session, tree, msg)
+	case SMB2_FLUSH:
+		// Replies are produced synchronously, so there is nothing to flush
+		w := NewByteWriter(4)
+		w.WriteUint16(4) // StructureSize
+		w.WriteUint16(0) // Reserved
+		return w.Bytes(), STATUS_SUCCESS
+	default:
+		return h.buildErrorResponse(), STATUS_NOT_SUPPORTED
+	}
+}
+
+// handlePipeCreate opens a named pipe
+func (h *SMBHandler) handlePipeCreate(session *Session, tree *TreeConnection, msg *SMB2Message) ([]byte, NTStatus) {
+	if len(msg.Payload) < 56 {
+		return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+	}
+
+	r := NewByteReader(msg.Payload)
+	if r.ReadUint16() != 57 {
+		return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+	}
+	r.Skip(22) // SecurityFlags through Reserved
+	desiredAccess := r.ReadUint32()
+	_ = r.ReadUint32() // FileAttributes
+	shareAccess := r.ReadUint32()
+	createDisposition := r.ReadUint32()
+	createOptions := r.ReadUint32()
+	nameOffset := r.ReadUint16()
+	nameLength := r.ReadUint16()
+
+	nameStart := int(nameOffset) - SMB2HeaderSize
+	if nameStart < 0 || nameStart+int(nameLength) > len(msg.Payload) {
+		return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+	}
+	name := DecodeUTF16LEToString(msg.Payload[nameStart : nameStart+int(nameLength)])
+
+	pipe := h.server.openPipe(name)
+	if pipe == nil {
+		h.server.logger.Debug("CREATE: unknown pipe %q", name)
+		return h.buildErrorResponse(), STATUS_OBJECT_NAME_NOT_FOUND
+	}
+
+	of := tree.Share.fileHandles.Allocate(nil, pipe.name, false, desiredAccess, shareAccess,
+		createDisposition, createOptions, tree.ID, session.ID)
+	of.Pipe = pipe
+
+	h.server.logger.Debug("CREATE: opened pipe %s (FileID=%d/%d)", pipe.name, of.ID.Persistent, of.ID.Volatile)
+
+	// Build response (structure size 89)
+	w := NewByteWriter(88)
+	w.WriteUint16(89)                      // StructureSize
+	w.WriteOneByte(SMB2_OPLOCK_LEVEL_NONE) // OplockLevel
+	w.WriteOneByte(0)                      // Flags
+	w.WriteUint32(FILE_OPENED)             // CreateAction
+	w.WriteZeros(32)                       // Creation, LastAccess, LastWrite and Change times
+	w.WriteUint64(0)                       // AllocationSize
+	w.WriteUint64(0)                       // EndOfFile
+	w.WriteUint32(FILE_ATTRIBUTE_NORMAL)   // FileAttributes
+	w.WriteUint32(0)                       // Reserved2
+	w.WriteFileID(of.ID)
+	w.WriteUint32(0) // CreateContextsOffset
+	w.WriteUint32(0) // CreateContextsLength
+
+	return w.Bytes(), STATUS_SUCCESS
+}
+
+// handlePipeClose closes a named pipe, discarding unread replies
+func (h *SMBHandler) handlePipeClose(session *Session, tree *TreeConnection, msg *SMB2Message) ([]byte, NTStatus) {
+	if len(msg.Payload) < 24 || le.Uint16(msg.Payload[0:2]) != 24 {
+		return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+	}
+
+	r := NewByteReader(msg.Payload)
+	r.Skip(2)
+	flags := r.ReadUint16()
+	r.Skip(4) // Reserved
+	fileID := r.ReadFileID()
+
+	if tree.Share.fileHandles.GetByTree(fileID, tree.ID, session.ID) == nil {
+		return h.buildErrorResponse(), STATUS_FILE_CLOSED
+	}
+	tree.Share.fileHandles.Release(fileID)
+
+	// Build response (structure size 60); pipes have no attributes to return
+	w := NewByteWriter(60)
+	w.WriteUint16(60)    // StructureSize
+	w.WriteUint16(flags) // Flags
+	w.WriteUint32(0)     // Reserved
+	w.WriteZeros(52)     // Times, sizes and attributes
+
+	return w.Bytes(), STATUS_SUCCESS
+}
+
+// handlePipeRead returns the next reply message
+// A message longer than the read is returned in parts with STATUS_BUFFER_OVERFLOW
+func (h *SMBHandler) handlePipeRead(session *Session, tree *TreeConnection, msg *SMB2Message) ([]byte, NTStatus) {
+	if len(msg.Payload) < 48 || le.Uint16(msg.Payload[0:2]) != 49 {
+		return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+	}
+
+	r := NewByteReader(msg.Payload)
+	r.Skip(4) // StructureSize, Padding, Flags
+	length := r.ReadUint32()
+	_ = r.ReadUint64() // Offset
+	fileID := r.ReadFileID()
+
+	of := tree.Share.fileHandles.GetByTree(fileID, tree.ID, session.ID)
+	if of == nil {
+		return h.buildErrorResponse(), STATUS_FILE_CLOSED
+	}
+
+	data, more, ok := of.Pipe.read(int(min(length, h.server.options.MaxReadSize)))
+	if !ok {
+		return h.buildErrorResponse(), STATUS_PIPE_EMPTY
+	}
+
+	status := STATUS_SUCCESS
+	if more {
+		status = STATUS_BUFFER_OVERFLOW
+	}
+	return buildReadResponse(data), status
+}
+
+// handlePipeWrite submits a PDU to a named pipe
+func (h *SMBHandler) handlePipeWrite(session *Session, tree *TreeConnection, msg *SMB2Message) ([]byte, NTStatus) {
+	if len(msg.Payload) < 48 || le.Uint16(msg.Payload[0:2]) != 49 {
+		return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+	}
+
+	r := NewByteReader(msg.Payload)
+	r.Skip(2)
+	dataOffset := r.ReadUint16()
+	length := r.ReadUint32()
+	_ = r.ReadUint64() // Offset
+	fileID := r.ReadFileID()
+
+	of := tree.Share.fileHandles.GetByTree(fileID, tree.ID, session.ID)
+	if of == nil {
+		return h.buildErrorResponse(), STATUS_FILE_CLOSED
+	}
+
+	dataStart := int(dataOffset) - SMB2HeaderSize
+	if dataStart < 0 || dataStart+int(length) > len(msg.Payload) {
+		return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+	}
+	of.Pipe.write(msg.Payload[dataStart : dataStart+int(length)])
+
+	return buildWriteResponse(length), STATUS_SUCCESS
+}
+
+// handlePipeTransceive handles FSCTL_PIPE_TRANSCEIVE: it writes a PDU and
+// returns the first reply message in the same exchange
+// Output beyond maxOutput is left for READ and reported with STATUS_BUFFER_OVERFLOW
+func (h *SMBHandler) handlePipeTransceive(msg *SMB2Message, fileID FileID, input []byte, maxOutput uint32) ([]byte, NTStatus) {
+	session, tree, status := h.validateTree(msg.Header)
+	if status != STATUS_SUCCESS {
+		return h.buildErrorResponse(), status
+	}
+
+	of := tree.Share.fileHandles.GetByTree(fileID, tree.ID, session.ID)
+	if of == nil {
+		return h.buildErrorResponse(), STATUS_FILE_CLOSED
+	}
+	if of.Pipe == nil {
+		return h.buildErrorResponse(), STATUS_INVALID_DEVICE_REQUEST
+	}
+
+	of.Pipe.write(input)
+	output, more, _ := of.Pipe.read(int(maxOutput))
+
+	status = STATUS_SUCCESS
+	if more {
+		status = STATUS_BUFFER_OVERFLOW
+	}
+	return h.buildIOCTLResponse(FSCTL_PIPE_TRANSCEIVE, fileID, output), status
+}
@@ -0,0 +1,265 @@
+package smbfs
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/absfs/memfs"
+)
+
+// buildReadRequest builds a READ request payload
+func buildReadRequest(fileID FileID, length uint32) []byte {
+	w := NewByteWriter(49)
+	w.WriteUint16(49) // StructureSize
+	w.WriteOneByte(0) // Padding
+	w.WriteOneByte(0) // Flags
+	w.WriteUint32(length)
+	w.WriteUint64(0) // Offset
+	w.WriteFileID(fileID)
+	w.WriteUint32(1) // MinimumCount
+	w.WriteUint32(0) // Channel
+	w.WriteUint32(0) // RemainingBytes
+	w.WriteUint16(0) // ReadChannelInfoOffset
+	w.WriteUint16(0) // ReadChannelInfoLength
+	w.WriteOneByte(0)
+	return w.Bytes()
+}
+
+// readData returns the data of a READ response
+func readData(t *testing.T, resp []byte) []byte {
+	t.Helper()
+	if len(resp) < 16 {
+		t.Fatalf("READ response is %d bytes", len(resp))
+	}
+	return resp[16 : 16+le.Uint32(resp[4:8])]
+}
+
+// TestPipe_Srvsvc tests a srvsvc session on IPC$: BIND through
+// FSCTL_PIPE_TRANSCEIVE with a reply larger than the output buffer, then
+// NetrShareEnum through WRITE and READ
+func TestPipe_Srvsvc(t *testing.T) {
+	srv, session, _ := setupTestTree(t)
+	fs, _ := memfs.NewFS()
+	srv.AddShare(fs, ShareOptions{ShareName: "docs", Comment: "Documents"})
+	srv.AddShare(fs, ShareOptions{ShareName: "printer", ShareType: SMBShareTypePrint, Comment: "Laser"})
+	srv.AddShare(fs, ShareOptions{ShareName: "admin$", Hidden: true})
+	ipc := session.AddTreeConnection("IPC$", srv.GetShare("IPC$"), false)
+
+	request := func(cmd uint16, payload []byte) ([]byte, NTStatus) {
+		return srv.handler.dispatch(nil, testRequest(session, ipc, cmd, payload), &SMB2Header{})
+	}
+
+	if _, status := request(SMB2_CREATE, buildCreateRequest("lsarpc", FILE_OPEN, 0, nil)); status != STATUS_OBJECT_NAME_NOT_FOUND {
+		t.Errorf("CREATE(lsarpc) status = %v, want STATUS_OBJECT_NAME_NOT_FOUND", status)
+	}
+	resp, status := request(SMB2_CREATE, buildCreateRequest(`\PIPE\srvsvc`, FILE_OPEN, 0, nil))
+	if status != STATUS_SUCCESS {
+		t.Fatalf("CREATE(srvsvc) status = %v", status)
+	}
+	r := NewByteReader(resp)
+	r.Skip(64) // Through Reserved2
+	fileID := r.ReadFileID()
+
+	// The bind ack does not fit in 16 bytes; the rest is read with READ
+	resp, status = srv.handler.handleIOCTL(nil, testRequest(session, ipc, SMB2_IOCTL,
+		buildIOCTLRequest(FSCTL_PIPE_TRANSCEIVE, fileID, buildRPCBind(7), 16)))
+	if status != STATUS_BUFFER_OVERFLOW {
+		t.Fatalf("TRANSCEIVE(bind) status = %v, want STATUS_BUFFER_OVERFLOW", status)
+	}
+	bindAck := append([]byte(nil), ioctlOutput(t, resp)...)
+	if len(bindAck) != 16 {
+		t.Fatalf("TRANSCEIVE(bind) returned %d bytes, want 16", len(bindAck))
+	}
+	resp, status = request(SMB2_READ, buildReadRequest(fileID, 4096))
+	if status != STATUS_SUCCESS {
+		t.Fatalf("READ(bind ack) status = %v", status)
+	}
+	bindAck = append(bindAck, readData(t, resp)...)
+	if err := parseRPCBindAck(bindAck, 7); err != nil {
+		t.Fatalf("parseRPCBindAck() error = %v", err)
+	}
+
+	enum := buildRPCRequest(8, srvsvcOpNetrShareEnum, buildNetrShareEnumRequest("127.0.0.1"))
+	if _, status = request(SMB2_WRITE, buildWriteRequest(fileID, 0, enum)); status != STATUS_SUCCESS {
+		t.Fatalf("WRITE(NetrShareEnum) status = %v", status)
+	}
+	resp, status = request(SMB2_READ, buildReadRequest(fileID, 4096))
+	if status != STATUS_SUCCESS {
+		t.Fatalf("READ(NetrShareEnum) status = %v", status)
+	}
+	stub, last, err := parseRPCResponse(readData(t, resp), 8)
+	if err != nil || !last {
+		t.Fatalf("parseRPCResponse() last = %v, error = %v", last, err)
+	}
+	shares, err := parseNetrShareEnumResponse(stub)
+	if err != nil {
+		t.Fatalf("parseNetrShareEnumResponse() error = %v", err)
+	}
+	want := []srvsvcShare{
+		{name: "docs", shareType: stypeDisktree, comment: "Documents"},
+		{name: "printer", shareType: stypePrintq, comment: "Laser"},
+		{name: "test", shareType: stypeDisktree},
+	}
+	if fmt.Sprint(shares) != fmt.Sprint(want) {
+		t.Errorf("NetrShareEnum = %v, want %v", shares, want)
+	}
+
+	// Nothing is left to read, and file-only commands are refused
+	if _, status = request(SMB2_READ, buildReadRequest(fileID, 4096)); status != STATUS_PIPE_EMPTY {
+		t.Errorf("READ(empty pipe) status = %v, want STATUS_PIPE_EMPTY", status)
+	}
+	if _, status = request(SMB2_QUERY_INFO, nil); status != STATUS_NOT_SUPPORTED {
+		t.Errorf("QUERY_INFO on pipe status = %v, want STATUS_NOT_SUPPORTED", status)
+	}
+
+	if _, status = request(SMB2_CLOSE, buildCloseRequest(fileID)); status != STATUS_SUCCESS {
+		t.Fatalf("CLOSE status = %v", status)
+	}
+	if _, status = request(SMB2_READ, buildReadRequest(fileID, 4096)); status != STATUS_FILE_CLOSED {
+		t.Errorf("READ after CLOSE status = %v, want STATUS_FILE_CLOSED", status)
+	}
+}
+
+// TestPipe_SrvsvcErrors tests the replies to requests srvsvc cannot serve
+func TestPipe_SrvsvcErrors(t *testing.T) {
+	srv := setupTestServer(t)
+
+	faultStatus := func(t *testing.T, replies [][]byte) uint32 {
+		t.Helper()
+		if len(replies) != 1 || replies[0][2] != rpcPacketFault {
+			t.Fatalf("replies = %x, want one FAULT", replies)
+		}
+		return le.Uint32(replies[0][rpcRequestHeaderSize:])
+	}
+
+	// Requests before a bind
+	pipe := srv.openPipe("srvsvc")
+	enum := buildRPCRequest(1, srvsvcOpNetrShareEnum, buildNetrShareEnumRequest("srv"))
+	if got := faultStatus(t, pipe.handleRPC(enum)); got != rpcFaultProtoError {
+		t.Errorf("unbound request fault = 0x%x, want nca_s_proto_error", got)
+	}
+
+	// Binds to other interfaces are rejected
+	bind := buildRPCBind(2)
+	bind[32] ^= 0xFF // Abstract syntax UUID
+	ack := pipe.handleRPC(bind)
+	if err := parseRPCBindAck(ack[0], 2); err == nil {
+		t.Error("bind to an unknown interface was accepted")
+	}
+
+	pipe.handleRPC(buildRPCBind(3))
+	if got := faultStatus(t, pipe.handleRPC(buildRPCRequest(4, 16, nil))); got != rpcFaultOpRangeError {
+		t.Errorf("unknown opnum fault = 0x%x, want nca_s_op_rng_error", got)
+	}
+	if got := faultStatus(t, pipe.handleRPC(buildRPCRequest(5, srvsvcOpNetrShareEnum, []byte{1}))); got != rpcFaultBadStubData {
+		t.Errorf("truncated stub fault = 0x%x, want rpc_x_bad_stub_data", got)
+	}
+
+	// Levels other than 1 fail inside the call
+	stub := buildNetrShareEnumRequest("srv")
+	le.PutUint32(stub[len(stub)-28:], 2) // InfoStruct.Level
+	replies := pipe.handleRPC(buildRPCRequest(6, srvsvcOpNetrShareEnum, stub))
+	resp, _, err := parseRPCResponse(replies[0], 6)
+	if err != nil {
+		t.Fatalf("parseRPCResponse(level 2) error = %v", err)
+	}
+	if status := le.Uint32(resp[len(resp)-4:]); status != srvsvcErrorInvalidLevel {
+		t.Errorf("level 2 WERROR = 0x%x, want ERROR_INVALID_LEVEL", status)
+	}
+}
+
+// TestBuildRPCResponses tests that a large reply is split into fragments
+// that reassemble into the original stub
+func TestBuildRPCResponses(t *testing.T) {
+	var shares []srvsvcShare
+	for i := 0; i < 200; i++ {
+		shares = append(shares, srvsvcShare{name: fmt.Sprintf("share%03d", i), comment: fmt.Sprintf("Share number %d", i)})
+	}
+	stub := buildNetrShareEnumResponse(1, shares, true)
+
+	frags := buildRPCResponses(9, 0, stub, rpcMaxFragSize)
+	if len(frags) < 2 {
+		t.Fatalf("%d byte stub sent in %d fragment(s)", len(stub), len(frags))
+	}
+
+	var got []byte
+	for i, frag := range frags {
+		if len(frag) > rpcMaxFragSize {
+			t.Errorf("fragment %d is %d bytes, over the %d byte limit", i, len(frag), rpcMaxFragSize)
+		}
+		if first := frag[3]&rpcFlagFirstFrag != 0; first != (i == 0) {
+			t.Errorf("fragment %d PFC_FIRST_FRAG = %v", i, first)
+		}
+		data, last, err := parseRPCResponse(frag, 9)
+		if err != nil {
+			t.Fatalf("parseRPCResponse(fragment %d) error = %v", i, err)
+		}
+		if last != (i == len(frags)-1) {
+			t.Errorf("fragment %d PFC_LAST_FRAG = %v", i, last)
+		}
+		got = append(got, data...)
+	}
+
+	decoded, err := parseNetrShareEnumResponse(got)
+	if err != nil {
+		t.Fatalf("parseNetrShareEnumResponse() error = %v", err)
+	}
+	if fmt.Sprint(decoded) != fmt.Sprint(shares) {
+		t.Error("reassembled reply does not decode to the original shares")
+	}
+}
+
+// TestListShares_Loopback tests share enumeration against the in-repo
+// server, with this package's client and with go-smb2's own
+func TestListShares_Loopback(t *testing.T) {
+	srv, config := startLoopbackServer(t, ServerOptions{})
+	fs, _ := memfs.NewFS()
+	for _, opts := range []ShareOptions{
+		{ShareName: "public", Comment: "Public files"},
+		{ShareName: "laser", ShareType: SMBShareTypePrint, Comment: "Second floor printer"},
+		{ShareName: "backup$", Hidden: true, Comment: "Hidden"},
+	} {
+		if err := srv.AddShare(fs, opts); err != nil {
+			t.Fatalf("AddShare(%s) error = %v", opts.ShareName, err)
+		}
+	}
+
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	shares, err := fsys.ListShares(context.Background())
+	if err != nil {
+		t.Fatalf("ListShares() error = %v", err)
+	}
+	want := []ShareInfo{
+		{Name: "data", Type: ShareTypeDisk},
+		{Name: "laser", Type: ShareTypePrintQueue, Comment: "Second floor printer"},
+		{Name: "public", Type: ShareTypeDisk, Comment: "Public files"},
+	}
+	if fmt.Sprint(shares) != fmt.Sprint(want) {
+		t.Errorf("ListShares() = %v, want %v", shares, want)
+	}
+
+	// go-smb2 enumerates through FSCTL_PIPE_TRANSCEIVE rather than WRITE/READ
+	conn, err := fsys.pool.get(context.Background())
+	if err != nil {
+		t.Fatalf("pool.get() error = %v", err)
+	}
+	defer fsys.pool.put(conn)
+	names, err := conn.session.SMBSession.(*realSMBSession).session.ListSharenames()
+	if err != nil {
+		t.Fatalf("ListSharenames() error = %v", err)
+	}
+	if fmt.Sprint(names) != "[data laser public]" {
+		t.Errorf("ListSharenames() = %v, want [data laser public]", names)
+	}
+
+	// The filesystem keeps working after the IPC$ tree is disconnected
+	if data, err := fsys.ReadFile("/hello.txt"); err != nil || string(data) != "hello" {
+		t.Errorf("ReadFile() after ListShares = %q, %v", data, err)
+	}
+}
@@ -0,0 +1,263 @@
+package smbfs
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+)
+
+// SymlinkFS is implemented by filesystems that support symbolic links.
+// Shares backed by such a filesystem expose links to clients as
+// IO_REPARSE_TAG_SYMLINK reparse points; memfs and osfs both implement it
+type SymlinkFS interface {
+	Lstat(name string) (os.FileInfo, error)
+	Readlink(name string) (string, error)
+	Symlink(oldname, newname string) error
+}
+
+// SYMLINK_FLAG_RELATIVE marks a symbolic link target as relative to the
+// link's directory (MS-FSCC 2.1.2.4)
+const SYMLINK_FLAG_RELATIVE uint32 = 0x00000001
+
+// Symbolic link reparse data buffer layout (MS-FSCC 2.1.2.4)
+const (
+	reparseHeaderSize        = 8  // ReparseTag, ReparseDataLength, Reserved
+	symlinkReparseHeaderSize = 20 // Reparse header plus the name offsets, lengths and Flags
+)
+
+// reparseTag returns the reparse tag reported for a file with the given
+// attributes; symbolic links are the only reparse points the server exposes
+func reparseTag(attrs uint32) uint32 {
+	if attrs&FILE_ATTRIBUTE_REPARSE_POINT != 0 {
+		return IO_REPARSE_TAG_SYMLINK
+	}
+	return 0
+}
+
+// lstatLink returns the info for name if it is a symbolic link on a
+// filesystem that supports them
+func (s *Share) lstatLink(name string) (os.FileInfo, bool) {
+	sl, ok := s.FileSystem().(SymlinkFS)
+	if !ok {
+		return nil, false
+	}
+	info, err := sl.Lstat(name)
+	if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		return nil, false
+	}
+	return info, true
+}
+
+// buildSymlinkReparseBuffer encodes a link target as a symbolic link reparse
+// data buffer. Targets are stored with forward slashes by the filesystem and
+// sent with backslashes; anything not starting at the share root is relative
+func buildSymlinkReparseBuffer(target string) []byte {
+	var flags uint32
+	if !strings.HasPrefix(target, "/") {
+		flags = SYMLINK_FLAG_RELATIVE
+	}
+	name := EncodeStringToUTF16LE(strings.ReplaceAll(target, "/", "\\"))
+
+	dataLen := symlinkReparseHeaderSize - reparseHeaderSize + 2*len(name)
+
+	w := NewByteWriter(reparseHeaderSize + dataLen)
+	w.WriteUint32(IO_REPARSE_TAG_SYMLINK) // ReparseTag
+	w.WriteUint16(uint16(dataLen))        // ReparseDataLength
+	w.WriteUint16(0)                      // Reserved
+	w.WriteUint16(0)                      // SubstituteNameOffset
+	w.WriteUint16(uint16(len(name)))      // SubstituteNameLength
+	w.WriteUint16(uint16(len(name)))      // PrintNameOffset
+	w.WriteUint16(uint16(len(name)))      // PrintNameLength
+	w.WriteUint32(flags)                  // Flags
+	w.WriteBytes(name)                    // SubstituteName
+	w.WriteBytes(name)                    // PrintName
+	return w.Bytes()
+}
+
+// parseSymlinkReparseBuffer decodes the target of a symbolic link reparse
+// data buffer into the filesystem's form. NT object prefixes are dropped,
+// so \??\C:\dir becomes C:/dir
+func parseSymlinkReparseBuffer(b []byte) (string, bool) {
+	if len(b) < symlinkReparseHeaderSize {
+		return "", false
+	}
+	r := NewByteReader(b)
+	if r.ReadUint32() != IO_REPARSE_TAG_SYMLINK {
+		return "", false
+	}
+	dataLen := int(r.ReadUint16())
+	_ = r.ReadUint16() // Reserved
+	subOffset := int(r.ReadUint16())
+	subLength := int(r.ReadUint16())
+	_ = r.ReadUint16() // PrintNameOffset
+	_ = r.ReadUint16() // PrintNameLength
+	_ = r.ReadUint32() // Flags
+
+	if dataLen < symlinkReparseHeaderSize-reparseHeaderSize || reparseHeaderSize+dataLen > len(b) {
+		return "", false
+	}
+	pathBuffer := b[symlinkReparseHeaderSize : reparseHeaderSize+dataLen]
+	if subLength == 0 || subLength%2 != 0 || subOffset+subLength > len(pathBuffer) {
+		return "", false
+	}
+
+	target := DecodeUTF16LEToString(pathBuffer[subOffset : subOffset+subLength])
+	target = strings.TrimPrefix(target, `\??\`)
+	return strings.ReplaceAll(target, "\\", "/"), true
+}
+
+// withinShare reports whether target, relative to the directory of the link
+// at name, stays within the share. Absolute and drive targets never do: the
+// server and its clients would follow them outside the share root
+func withinShare(name, target string) bool {
+	if strings.HasPrefix(target, "/") || len(target) >= 2 && target[1] == ':' {
+		return false
+	}
+	depth := 0
+	if dir := path.Dir(path.Join("/", name)); dir != "/" {
+		depth = strings.Count(dir, "/")
+	}
+	for _, elem := range strings.Split(target, "/") {
+		switch elem {
+		case "", ".":
+		case "..":
+			if depth == 0 {
+				return false
+			}
+			depth--
+		default:
+			depth++
+		}
+	}
+	return true
+}
+
+// handleGetReparsePoint handles FSCTL_GET_REPARSE_POINT, returning the
+// target of a symbolic link opened with FILE_OPEN_REPARSE_POINT
+func (h *SMBHandler) handleGetReparsePoint(msg *SMB2Message, fileID FileID, maxOutput uint32) ([]byte, NTStatus) {
+	session, tree, status := h.validateTree(msg.Header)
+	if status != STATUS_SUCCESS {
+		return h.buildErrorResponse(), status
+	}
+
+	of := tree.Share.fileHandles.GetByTree(fileID, tree.ID, session.ID)
+	if of == nil {
+		return h.buildErrorResponse(), STATUS_FILE_CLOSED
+	}
+
+	if _, ok := tree.Share.lstatLink(of.Path); !ok {
+		return h.buildErrorResponse(), STATUS_NOT_A_REPARSE_POINT
+	}
+	target, err := tree.Share.FileSystem().(SymlinkFS).Readlink(of.Path)
+	if err != nil {
+		return h.buildErrorResponse(), mapGoErrorToNTStatus(err)
+	}
+
+	h.server.logger.Debug("IOCTL: GetReparsePoint %s -> %s", of.Path, target)
+
+	output := buildSymlinkReparseBuffer(target)
+	if uint32(len(output)) > maxOutput {
+		return h.buildErrorResponse(), STATUS_BUFFER_TOO_SMALL
+	}
+	return h.buildIOCTLResponse(FSCTL_GET_REPARSE_POINT, fileID, output), STATUS_SUCCESS
+}
+
+// handleSetReparsePoint handles FSCTL_SET_REPARSE_POINT
+// The handle's file or directory must be empty; it is replaced by a symbolic
+// link, which the handle refers to from then on. Only relative targets that
+// stay within the share are accepted
+func (h *SMBHandler) handleSetReparsePoint(msg *SMB2Message, fileID FileID, input []byte) ([]byte, NTStatus) {
+	session, tree, status := h.validateTree(msg.Header)
+	if status != STATUS_SUCCESS {
+		return h.buildErrorResponse(), status
+	}
+
+	of := tree.Share.fileHandles.GetByTree(fileID, tree.ID, session.ID)
+	if of == nil {
+		return h.buildErrorResponse(), STATUS_FILE_CLOSED
+	}
+	if tree.IsReadOnly || mapGenericAccess(of.Access)&(FILE_WRITE_DATA|FILE_WRITE_ATTRIBUTES) == 0 {
+		return h.buildErrorResponse(), STATUS_ACCESS_DENIED
+	}
+
+	sl, ok := tree.Share.FileSystem().(SymlinkFS)
+	if !ok {
+		return h.buildErrorResponse(), STATUS_NOT_SUPPORTED
+	}
+	if len(input) < reparseHeaderSize {
+		return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+	}
+	if le.Uint32(input[0:4]) != IO_REPARSE_TAG_SYMLINK {
+		return h.buildErrorResponse(), STATUS_NOT_SUPPORTED
+	}
+	target, ok := parseSymlinkReparseBuffer(input)
+	if !ok {
+		return h.buildErrorResponse(), STATUS_IO_REPARSE_DATA_INVALID
+	}
+	if le.Uint32(input[16:20])&SYMLINK_FLAG_RELATIVE == 0 || !withinShare(of.Path, target) {
+		return h.buildErrorResponse(), STATUS_ACCESS_DENIED
+	}
+
+	// Only an empty placeholder, as created just before by the client, can
+	// become a link without losing data
+	if _, isLink := tree.Share.lstatLink(of.Path); !isLink {
+		info, err := of.File.Stat()
+		if err != nil {
+			return h.buildErrorResponse(), mapGoErrorToNTStatus(err)
+		}
+		if info.IsDir() {
+			if entries, _ := tree.Share.FileSystem().ReadDir(of.Path); len(entries) > 0 {
+				return h.buildErrorResponse(), STATUS_DIRECTORY_NOT_EMPTY
+			}
+		} else if info.Size() > 0 {
+			return h.buildErrorResponse(), STATUS_INVALID_PARAMETER
+		}
+	}
+
+	h.server.logger.Debug("IOCTL: SetReparsePoint %s -> %s", of.Path, target)
+
+	if err := tree.Share.FileSystem().Remove(of.Path); err != nil {
+		return h.buildErrorResponse(), mapGoErrorToNTStatus(err)
+	}
+	if err := sl.Symlink(target, of.Path); err != nil {
+		return h.buildErrorResponse(), mapGoErrorToNTStatus(err)
+	}
+	info, err := sl.Lstat(of.Path)
+	if err != nil {
+		return h.buildErrorResponse(), mapGoErrorToNTStatus(err)
+	}
+
+	of.File.Close()
+	of.File = &symlinkFile{name: of.Path, info: info}
+	of.IsDir = false
+
+	return h.buildIOCTLResponse(FSCTL_SET_REPARSE_POINT, fileID, nil), STATUS_SUCCESS
+}
+
+// symlinkFile is the handle of a symbolic link opened with
+// FILE_OPEN_REPARSE_POINT. Only its metadata is accessible; its target is
+// read with FSCTL_GET_REPARSE_POINT
+type symlinkFile struct {
+	name string
+	info os.FileInfo
+}
+
+func (f *symlinkFile) invalid(op string) error {
+	return &os.PathError{Op: op, Path: f.name, Err: fs.ErrInvalid}
+}
+
+func (f *symlinkFile) Name() string                       { return f.name }
+func (f *symlinkFile) Stat() (os.FileInfo, error)         { return f.info, nil }
+func (f *symlinkFile) Close() error                       { return nil }
+func (f *symlinkFile) Sync() error                        { return nil }
+func (f *symlinkFile) Read([]byte) (int, error)           { return 0, f.invalid("read") }
+func (f *symlinkFile) ReadAt([]byte, int64) (int, error)  { return 0, f.invalid("read") }
+func (f *symlinkFile) Write([]byte) (int, error)          { return 0, f.invalid("write") }
+func (f *symlinkFile) WriteAt([]byte, int64) (int, error) { return 0, f.invalid("write") }
+func (f *symlinkFile) WriteString(string) (int, error)    { return 0, f.invalid("write") }
+func (f *symlinkFile) Seek(int64, int) (int64, error)     { return 0, f.invalid("seek") }
+func (f *symlinkFile) Truncate(int64) error               { return f.invalid("truncate") }
+func (f *symlinkFile) Readdir(int) ([]os.FileInfo, error) { return nil, f.invalid("readdir") }
+func (f *symlinkFile) Readdirnames(int) ([]string, error) { return nil, f.invalid("readdir") }
+func (f *symlinkFile) ReadDir(int) ([]fs.DirEntry, error) { return nil, f.invalid("readdir") }
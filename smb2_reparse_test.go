@@ -0,0 +1,300 @@
+package smbfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+// TestSymlinkReparseBuffer tests encoding and decoding symbolic link reparse data
+func TestSymlinkReparseBuffer(t *testing.T) {
+	tests := []struct {
+		target   string
+		relative bool
+	}{
+		{target: "/dir/file.txt"},
+		{target: "file.txt", relative: true},
+		{target: "../other/file.txt", relative: true},
+	}
+	for _, tt := range tests {
+		buf := buildSymlinkReparseBuffer(tt.target)
+		if got := le.Uint32(buf[0:4]); got != IO_REPARSE_TAG_SYMLINK {
+			t.Errorf("%s: ReparseTag = 0x%x, want 0x%x", tt.target, got, IO_REPARSE_TAG_SYMLINK)
+		}
+		if got := int(le.Uint16(buf[4:6])); got != len(buf)-reparseHeaderSize {
+			t.Errorf("%s: ReparseDataLength = %d, want %d", tt.target, got, len(buf)-reparseHeaderSize)
+		}
+		if relative := le.Uint32(buf[16:20])&SYMLINK_FLAG_RELATIVE != 0; relative != tt.relative {
+			t.Errorf("%s: relative = %v, want %v", tt.target, relative, tt.relative)
+		}
+		got, ok := parseSymlinkReparseBuffer(buf)
+		if !ok || got != tt.target {
+			t.Errorf("parseSymlinkReparseBuffer(build(%q)) = %q, %v", tt.target, got, ok)
+		}
+	}
+
+	// Windows clients send absolute targets as NT object paths
+	buf := buildSymlinkReparseBuffer(`/??/C:/data`)
+	if got, ok := parseSymlinkReparseBuffer(buf); !ok || got != "C:/data" {
+		t.Errorf("parseSymlinkReparseBuffer(NT path) = %q, %v, want C:/data", got, ok)
+	}
+
+	valid := buildSymlinkReparseBuffer("file.txt")
+	malformed := map[string][]byte{
+		"short":        valid[:symlinkReparseHeaderSize-1],
+		"wrong tag":    append([]byte{0x03, 0x00, 0x00, 0xA0}, valid[4:]...),
+		"data overrun": append(append([]byte{}, valid[:4]...), append([]byte{0xFF, 0x00}, valid[6:]...)...),
+		"name overrun": append(append([]byte{}, valid[:10]...), append([]byte{0xFF, 0x00}, valid[12:]...)...),
+		"empty name":   append(append([]byte{}, valid[:10]...), append([]byte{0x00, 0x00}, valid[12:]...)...),
+	}
+	for name, buf := range malformed {
+		if _, ok := parseSymlinkReparseBuffer(buf); ok {
+			t.Errorf("parseSymlinkReparseBuffer(%s) succeeded, want failure", name)
+		}
+	}
+}
+
+// TestHandleIOCTL_ReparsePoint tests creating a symbolic link with
+// FSCTL_SET_REPARSE_POINT and reading it back with FSCTL_GET_REPARSE_POINT
+func TestHandleIOCTL_ReparsePoint(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	mfs := tree.Share.fs.(*memfs.FileSystem)
+
+	// The client creates an empty placeholder and turns it into a link
+	placeholder := openTestFile(t, tree, session, "/link", nil, FILE_WRITE_ATTRIBUTES|DELETE)
+	input := buildSymlinkReparseBuffer("missing.txt")
+	if _, status := srv.handler.handleIOCTL(nil,
+		testRequest(session, tree, SMB2_IOCTL, buildIOCTLRequest(FSCTL_SET_REPARSE_POINT, placeholder.ID, input, 0))); status != STATUS_SUCCESS {
+		t.Fatalf("SET_REPARSE_POINT status = %v, want STATUS_SUCCESS", status)
+	}
+	if target, err := mfs.Readlink("/link"); err != nil || target != "missing.txt" {
+		t.Fatalf("Readlink() = %q, %v, want missing.txt", target, err)
+	}
+	buf, status := srv.handler.queryFileInfo(tree.Share, placeholder, FileAttributeTagInformation)
+	if status != STATUS_SUCCESS {
+		t.Fatalf("FileAttributeTagInformation status = %v", status)
+	}
+	if le.Uint32(buf[0:4])&FILE_ATTRIBUTE_REPARSE_POINT == 0 || le.Uint32(buf[4:8]) != IO_REPARSE_TAG_SYMLINK {
+		t.Errorf("FileAttributeTagInformation = attrs 0x%x, tag 0x%x", le.Uint32(buf[0:4]), le.Uint32(buf[4:8]))
+	}
+
+	// The dangling link can only be opened as a reparse point
+	if _, status := srv.handler.handleCreate(nil,
+		testRequest(session, tree, SMB2_CREATE, buildCreateRequest("link", FILE_OPEN, 0, nil)), nil); status != STATUS_OBJECT_NAME_NOT_FOUND {
+		t.Errorf("CREATE without FILE_OPEN_REPARSE_POINT status = %v, want STATUS_OBJECT_NAME_NOT_FOUND", status)
+	}
+	resp, status := srv.handler.handleCreate(nil,
+		testRequest(session, tree, SMB2_CREATE, buildCreateRequest("link", FILE_OPEN, FILE_OPEN_REPARSE_POINT, nil)), nil)
+	if status != STATUS_SUCCESS {
+		t.Fatalf("CREATE with FILE_OPEN_REPARSE_POINT status = %v, want STATUS_SUCCESS", status)
+	}
+	if attrs := le.Uint32(resp[56:60]); attrs&FILE_ATTRIBUTE_REPARSE_POINT == 0 {
+		t.Errorf("CREATE FileAttributes = 0x%x, want FILE_ATTRIBUTE_REPARSE_POINT", attrs)
+	}
+	linkID := UnmarshalFileID(resp[64:80])
+	defer tree.Share.fileHandles.Release(linkID)
+
+	resp, status = srv.handler.handleIOCTL(nil,
+		testRequest(session, tree, SMB2_IOCTL, buildIOCTLRequest(FSCTL_GET_REPARSE_POINT, linkID, nil, 1024)))
+	if status != STATUS_SUCCESS {
+		t.Fatalf("GET_REPARSE_POINT status = %v, want STATUS_SUCCESS", status)
+	}
+	if target, ok := parseSymlinkReparseBuffer(ioctlOutput(t, resp)); !ok || target != "missing.txt" {
+		t.Errorf("GET_REPARSE_POINT target = %q, %v, want missing.txt", target, ok)
+	}
+	if _, status := srv.handler.handleIOCTL(nil,
+		testRequest(session, tree, SMB2_IOCTL, buildIOCTLRequest(FSCTL_GET_REPARSE_POINT, linkID, nil, 8))); status != STATUS_BUFFER_TOO_SMALL {
+		t.Errorf("GET_REPARSE_POINT into 8 bytes status = %v, want STATUS_BUFFER_TOO_SMALL", status)
+	}
+
+	// A regular file is not a reparse point, and one with data cannot become one
+	file := openTestFile(t, tree, session, "/data.txt", []byte("data"), GENERIC_READ|GENERIC_WRITE)
+	if _, status := srv.handler.handleIOCTL(nil,
+		testRequest(session, tree, SMB2_IOCTL, buildIOCTLRequest(FSCTL_GET_REPARSE_POINT, file.ID, nil, 1024))); status != STATUS_NOT_A_REPARSE_POINT {
+		t.Errorf("GET_REPARSE_POINT on a file status = %v, want STATUS_NOT_A_REPARSE_POINT", status)
+	}
+	if _, status := srv.handler.handleIOCTL(nil,
+		testRequest(session, tree, SMB2_IOCTL, buildIOCTLRequest(FSCTL_SET_REPARSE_POINT, file.ID, input, 0))); status != STATUS_INVALID_PARAMETER {
+		t.Errorf("SET_REPARSE_POINT on a non-empty file status = %v, want STATUS_INVALID_PARAMETER", status)
+	}
+
+	empty := openTestFile(t, tree, session, "/empty.txt", nil, GENERIC_READ|GENERIC_WRITE)
+	if _, status := srv.handler.handleIOCTL(nil,
+		testRequest(session, tree, SMB2_IOCTL, buildIOCTLRequest(FSCTL_SET_REPARSE_POINT, empty.ID, input[:12], 0))); status != STATUS_IO_REPARSE_DATA_INVALID {
+		t.Errorf("SET_REPARSE_POINT with truncated data status = %v, want STATUS_IO_REPARSE_DATA_INVALID", status)
+	}
+	readOnly := openTestFile(t, tree, session, "/readonly.txt", nil, GENERIC_READ)
+	if _, status := srv.handler.handleIOCTL(nil,
+		testRequest(session, tree, SMB2_IOCTL, buildIOCTLRequest(FSCTL_SET_REPARSE_POINT, readOnly.ID, input, 0))); status != STATUS_ACCESS_DENIED {
+		t.Errorf("SET_REPARSE_POINT without write access status = %v, want STATUS_ACCESS_DENIED", status)
+	}
+}
+
+// TestHandleIOCTL_SetReparsePointTarget tests that links may only point
+// within the share
+func TestHandleIOCTL_SetReparsePointTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		relative bool
+		want     NTStatus
+	}{
+		{"relative", "../hello.txt", true, STATUS_SUCCESS},
+		{"relative through subdirectory", "sub/../../hello.txt", true, STATUS_SUCCESS},
+		{"absolute", "/hello.txt", false, STATUS_ACCESS_DENIED},
+		{"absolute flagged relative", "/hello.txt", true, STATUS_ACCESS_DENIED},
+		{"NT path", "/??/C:/data", false, STATUS_ACCESS_DENIED},
+		{"NT path flagged relative", "/??/C:/data", true, STATUS_ACCESS_DENIED},
+		{"drive relative", "C:data", true, STATUS_ACCESS_DENIED},
+		{"above share root", "../../etc/passwd", true, STATUS_ACCESS_DENIED},
+		{"above share root through subdirectory", "sub/../../../etc/passwd", true, STATUS_ACCESS_DENIED},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, session, tree := setupTestTree(t)
+			tree.Share.fs.Mkdir("/dir", 0755)
+			placeholder := openTestFile(t, tree, session, "/dir/link", nil, FILE_WRITE_ATTRIBUTES|DELETE)
+
+			input := buildSymlinkReparseBuffer(tt.target)
+			var flags uint32
+			if tt.relative {
+				flags = SYMLINK_FLAG_RELATIVE
+			}
+			le.PutUint32(input[16:20], flags)
+
+			if _, status := srv.handler.handleIOCTL(nil,
+				testRequest(session, tree, SMB2_IOCTL, buildIOCTLRequest(FSCTL_SET_REPARSE_POINT, placeholder.ID, input, 0))); status != tt.want {
+				t.Fatalf("SET_REPARSE_POINT to %s status = %v, want %v", tt.target, status, tt.want)
+			}
+			if _, linked := tree.Share.lstatLink("/dir/link"); linked != (tt.want == STATUS_SUCCESS) {
+				t.Errorf("placeholder is a link = %v after SET_REPARSE_POINT status %v", linked, tt.want)
+			}
+		})
+	}
+}
+
+// TestQueryFilesystemInfo_ReparsePoints tests that reparse point support is
+// advertised only for filesystems with symbolic links
+func TestQueryFilesystemInfo_ReparsePoints(t *testing.T) {
+	const FILE_SUPPORTS_REPARSE_POINTS = 0x00000080
+	srv := setupTestServer(t)
+
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("Failed to create memfs: %v", err)
+	}
+	buf, _ := srv.handler.queryFilesystemInfo(NewShare(mfs, ShareOptions{ShareName: "links"}), FileFsAttributeInformation)
+	if le.Uint32(buf[0:4])&FILE_SUPPORTS_REPARSE_POINTS == 0 {
+		t.Error("memfs share should advertise FILE_SUPPORTS_REPARSE_POINTS")
+	}
+
+	// Embedding the interface hides memfs's link methods
+	noLinks := struct{ absfs.FileSystem }{mfs}
+	buf, _ = srv.handler.queryFilesystemInfo(NewShare(noLinks, ShareOptions{ShareName: "nolinks"}), FileFsAttributeInformation)
+	if le.Uint32(buf[0:4])&FILE_SUPPORTS_REPARSE_POINTS != 0 {
+		t.Error("share without SymlinkFS should not advertise FILE_SUPPORTS_REPARSE_POINTS")
+	}
+}
+
+// TestSymlink_Loopback tests creating and reading symbolic links through the client
+func TestSymlink_Loopback(t *testing.T) {
+	_, config := startLoopbackServer(t, ServerOptions{})
+
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	if err := fsys.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("Mkdir() error = %v", err)
+	}
+	links := map[string]string{
+		"/dir/hello":    "../hello.txt",
+		"/dir/dangling": "../missing.txt",
+	}
+	for link, target := range links {
+		if err := fsys.Symlink(target, link); err != nil {
+			t.Fatalf("Symlink(%s, %s) error = %v", target, link, err)
+		}
+	}
+
+	for link, target := range links {
+		got, err := fsys.Readlink(link)
+		if err != nil || got != target {
+			t.Errorf("Readlink(%s) = %q, %v, want %q", link, got, err, target)
+		}
+		info, err := fsys.Lstat(link)
+		if err != nil {
+			t.Fatalf("Lstat(%s) error = %v", link, err)
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			t.Errorf("Lstat(%s) mode = %v, want a symlink", link, info.Mode())
+		}
+	}
+
+	entries, err := fsys.ReadDir("/dir")
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	if len(entries) != len(links) {
+		t.Fatalf("ReadDir() returned %d entries, want %d", len(entries), len(links))
+	}
+	for _, entry := range entries {
+		if entry.Type()&fs.ModeSymlink == 0 {
+			t.Errorf("ReadDir() entry %s type = %v, want a symlink", entry.Name(), entry.Type())
+		}
+	}
+
+	// Stat and Open follow the link
+	info, err := fsys.Stat("/dir/hello")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if info.Mode()&fs.ModeSymlink != 0 || info.Size() != int64(len("hello")) {
+		t.Errorf("Stat() mode = %v, size = %d, want the target's", info.Mode(), info.Size())
+	}
+	f, err := fsys.Open("/dir/hello")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || string(data) != "hello" {
+		t.Errorf("read through link = %q, %v, want hello", data, err)
+	}
+	if _, err := fsys.Stat("/dir/dangling"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat() of dangling link error = %v, want fs.ErrNotExist", err)
+	}
+
+	// Links cannot point outside the share or replace existing files, and
+	// Readlink needs a link
+	if err := fsys.Symlink("/hello.txt", "/dir/absolute"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Symlink() to an absolute target error = %v, want fs.ErrPermission", err)
+	}
+	if _, err := fsys.Lstat("/dir/absolute"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Lstat() of refused link error = %v, want fs.ErrNotExist", err)
+	}
+	if err := fsys.Symlink("../hello.txt", "/dir/hello"); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Symlink() over an existing link error = %v, want fs.ErrExist", err)
+	}
+	if _, err := fsys.Readlink("/hello.txt"); err == nil {
+		t.Error("Readlink() of a regular file should fail")
+	}
+
+	// Removing a link leaves its target alone
+	if err := fsys.Remove("/dir/hello"); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if _, err := fsys.Lstat("/dir/hello"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Lstat() after Remove error = %v, want fs.ErrNotExist", err)
+	}
+	if _, err := fsys.Stat("/hello.txt"); err != nil {
+		t.Errorf("Stat() of link target after Remove error = %v", err)
+	}
+}
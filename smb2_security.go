@@ -0,0 +1,423 @@
+package smbfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"strconv"
+	"strings"
+)
+
+// Security information requested in QUERY_INFO AdditionalInformation (MS-SMB2 2.2.37)
+const (
+	OWNER_SECURITY_INFORMATION uint32 = 0x00000001
+	GROUP_SECURITY_INFORMATION uint32 = 0x00000002
+	DACL_SECURITY_INFORMATION  uint32 = 0x00000004
+	SACL_SECURITY_INFORMATION  uint32 = 0x00000008
+)
+
+// Security descriptor control flags (MS-DTYP 2.4.6)
+const (
+	SE_DACL_PRESENT  uint16 = 0x0004
+	SE_SELF_RELATIVE uint16 = 0x8000
+)
+
+// ACE types and flags (MS-DTYP 2.4.4.1)
+const (
+	ACCESS_ALLOWED_ACE_TYPE uint8 = 0x00
+	ACCESS_DENIED_ACE_TYPE  uint8 = 0x01
+
+	OBJECT_INHERIT_ACE    uint8 = 0x01
+	CONTAINER_INHERIT_ACE uint8 = 0x02
+)
+
+// Standard file access masks (MS-SMB2 2.2.13.1.1)
+const (
+	FILE_ALL_ACCESS      uint32 = 0x001F01FF
+	FILE_GENERIC_READ    uint32 = 0x00120089
+	FILE_GENERIC_WRITE   uint32 = 0x00120116
+	FILE_GENERIC_EXECUTE uint32 = 0x001200A0
+)
+
+const (
+	sidRevision        = 1
+	aclRevision        = 2
+	securityHeaderSize = 20 // Self-relative SECURITY_DESCRIPTOR header
+	aclHeaderSize      = 8
+	aceHeaderSize      = 8 // AceType, AceFlags, AceSize, Mask
+)
+
+// SID is a Windows security identifier (MS-DTYP 2.4.2)
+type SID struct {
+	Authority      uint64 // IdentifierAuthority (48 bits)
+	SubAuthorities []uint32
+}
+
+// Well-known SIDs
+var (
+	SIDEveryone = SID{Authority: 1, SubAuthorities: []uint32{0}}       // S-1-1-0
+	SIDGuests   = SID{Authority: 5, SubAuthorities: []uint32{32, 546}} // S-1-5-32-546
+)
+
+// ParseSID parses the string form of a SID, such as S-1-5-32-544
+func ParseSID(s string) (SID, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) < 3 || !strings.EqualFold(parts[0], "S") || parts[1] != "1" {
+		return SID{}, fmt.Errorf("invalid SID %q", s)
+	}
+	authority, err := strconv.ParseUint(parts[2], 10, 48)
+	if err != nil {
+		return SID{}, fmt.Errorf("invalid SID %q: %w", s, err)
+	}
+	sid := SID{Authority: authority}
+	for _, p := range parts[3:] {
+		sub, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return SID{}, fmt.Errorf("invalid SID %q: %w", s, err)
+		}
+		sid.SubAuthorities = append(sid.SubAuthorities, uint32(sub))
+	}
+	if len(sid.SubAuthorities) > 15 {
+		return SID{}, fmt.Errorf("invalid SID %q: too many sub-authorities", s)
+	}
+	return sid, nil
+}
+
+// String returns the S-1-... form of the SID
+func (s SID) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "S-%d-%d", sidRevision, s.Authority)
+	for _, sub := range s.SubAuthorities {
+		fmt.Fprintf(&b, "-%d", sub)
+	}
+	return b.String()
+}
+
+// Equal reports whether two SIDs are the same
+func (s SID) Equal(other SID) bool {
+	if s.Authority != other.Authority || len(s.SubAuthorities) != len(other.SubAuthorities) {
+		return false
+	}
+	for i, sub := range s.SubAuthorities {
+		if other.SubAuthorities[i] != sub {
+			return false
+		}
+	}
+	return true
+}
+
+// size returns the length of the SID's binary form
+func (s SID) size() int {
+	return 8 + 4*len(s.SubAuthorities)
+}
+
+// Marshal encodes the SID in its binary form
+func (s SID) Marshal() []byte {
+	buf := make([]byte, s.size())
+	buf[0] = sidRevision
+	buf[1] = byte(len(s.SubAuthorities))
+	for i := 0; i < 6; i++ {
+		buf[2+i] = byte(s.Authority >> (8 * (5 - i))) // Big-endian
+	}
+	for i, sub := range s.SubAuthorities {
+		binary.LittleEndian.PutUint32(buf[8+4*i:], sub)
+	}
+	return buf
+}
+
+// UnmarshalSID decodes a binary SID
+func UnmarshalSID(data []byte) (SID, error) {
+	if len(data) < 8 || data[0] != sidRevision {
+		return SID{}, ErrInvalidMessage
+	}
+	count := int(data[1])
+	if count > 15 || len(data) < 8+4*count {
+		return SID{}, ErrInvalidMessage
+	}
+
+	var sid SID
+	for i := 0; i < 6; i++ {
+		sid.Authority = sid.Authority<<8 | uint64(data[2+i])
+	}
+	for i := 0; i < count; i++ {
+		sid.SubAuthorities = append(sid.SubAuthorities, binary.LittleEndian.Uint32(data[8+4*i:]))
+	}
+	return sid, nil
+}
+
+// ACE is an access-allowed or access-denied entry of an ACL (MS-DTYP 2.4.4.2)
+type ACE struct {
+	Type  uint8
+	Flags uint8
+	Mask  uint32
+	SID   SID
+}
+
+// ACL is an access control list (MS-DTYP 2.4.5)
+type ACL []ACE
+
+// size returns the length of the ACL's binary form
+func (a ACL) size() int {
+	n := aclHeaderSize
+	for _, ace := range a {
+		n += aceHeaderSize + ace.SID.size()
+	}
+	return n
+}
+
+// Marshal encodes the ACL in its binary form
+func (a ACL) Marshal() []byte {
+	w := NewByteWriter(a.size())
+	w.WriteOneByte(aclRevision)     // AclRevision
+	w.WriteOneByte(0)               // Sbz1
+	w.WriteUint16(uint16(a.size())) // AclSize
+	w.WriteUint16(uint16(len(a)))   // AceCount
+	w.WriteUint16(0)                // Sbz2
+	for _, ace := range a {
+		w.WriteOneByte(ace.Type)                              // AceType
+		w.WriteOneByte(ace.Flags)                             // AceFlags
+		w.WriteUint16(uint16(aceHeaderSize + ace.SID.size())) // AceSize
+		w.WriteUint32(ace.Mask)                               // Mask
+		w.WriteBytes(ace.SID.Marshal())                       // Sid
+	}
+	return w.Bytes()
+}
+
+// UnmarshalACL decodes a binary ACL. Only ACEs carrying a mask and a SID
+// (access-allowed and access-denied) are supported
+func UnmarshalACL(data []byte) (ACL, error) {
+	if len(data) < aclHeaderSize {
+		return nil, ErrInvalidMessage
+	}
+	size := int(binary.LittleEndian.Uint16(data[2:4]))
+	count := int(binary.LittleEndian.Uint16(data[4:6]))
+	if size < aclHeaderSize || size > len(data) {
+		return nil, ErrInvalidMessage
+	}
+
+	acl := make(ACL, 0, count)
+	pos := aclHeaderSize
+	for i := 0; i < count; i++ {
+		if pos+aceHeaderSize > size {
+			return nil, ErrInvalidMessage
+		}
+		aceSize := int(binary.LittleEndian.Uint16(data[pos+2 : pos+4]))
+		if aceSize < aceHeaderSize || pos+aceSize > size {
+			return nil, ErrInvalidMessage
+		}
+		ace := ACE{
+			Type:  data[pos],
+			Flags: data[pos+1],
+			Mask:  binary.LittleEndian.Uint32(data[pos+4 : pos+8]),
+		}
+		if ace.Type != ACCESS_ALLOWED_ACE_TYPE && ace.Type != ACCESS_DENIED_ACE_TYPE {
+			return nil, ErrInvalidMessage
+		}
+		sid, err := UnmarshalSID(data[pos+aceHeaderSize : pos+aceSize])
+		if err != nil {
+			return nil, err
+		}
+		ace.SID = sid
+		acl = append(acl, ace)
+		pos += aceSize
+	}
+	return acl, nil
+}
+
+// SecurityDescriptor is a self-relative security descriptor (MS-DTYP 2.4.6)
+// Nil Owner or Group and a DACL without SE_DACL_PRESENT are left out
+type SecurityDescriptor struct {
+	Control uint16
+	Owner   *SID
+	Group   *SID
+	DACL    ACL
+}
+
+// Marshal encodes the descriptor in self-relative form
+func (sd *SecurityDescriptor) Marshal() []byte {
+	control := sd.Control | SE_SELF_RELATIVE
+
+	size := securityHeaderSize
+	var ownerOffset, groupOffset, daclOffset int
+	if sd.Owner != nil {
+		ownerOffset = size
+		size += sd.Owner.size()
+	}
+	if sd.Group != nil {
+		groupOffset = size
+		size += sd.Group.size()
+	}
+	if control&SE_DACL_PRESENT != 0 {
+		daclOffset = size
+		size += sd.DACL.size()
+	}
+
+	w := NewByteWriter(size)
+	w.WriteOneByte(1)                  // Revision
+	w.WriteOneByte(0)                  // Sbz1
+	w.WriteUint16(control)             // Control
+	w.WriteUint32(uint32(ownerOffset)) // OffsetOwner
+	w.WriteUint32(uint32(groupOffset)) // OffsetGroup
+	w.WriteUint32(0)                   // OffsetSacl
+	w.WriteUint32(uint32(daclOffset))  // OffsetDacl
+	if sd.Owner != nil {
+		w.WriteBytes(sd.Owner.Marshal())
+	}
+	if sd.Group != nil {
+		w.WriteBytes(sd.Group.Marshal())
+	}
+	if control&SE_DACL_PRESENT != 0 {
+		w.WriteBytes(sd.DACL.Marshal())
+	}
+	return w.Bytes()
+}
+
+// UnmarshalSecurityDescriptor decodes a self-relative security descriptor
+// The SACL, if any, is ignored
+func UnmarshalSecurityDescriptor(data []byte) (*SecurityDescriptor, error) {
+	if len(data) < securityHeaderSize || data[0] != 1 {
+		return nil, ErrInvalidMessage
+	}
+	sd := &SecurityDescriptor{Control: binary.LittleEndian.Uint16(data[2:4])}
+	if sd.Control&SE_SELF_RELATIVE == 0 {
+		return nil, ErrInvalidMessage
+	}
+
+	section := func(offset uint32) ([]byte, error) {
+		if offset < securityHeaderSize || int(offset) >= len(data) {
+			return nil, ErrInvalidMessage
+		}
+		return data[offset:], nil
+	}
+
+	if offset := binary.LittleEndian.Uint32(data[4:8]); offset != 0 {
+		b, err := section(offset)
+		if err != nil {
+			return nil, err
+		}
+		owner, err := UnmarshalSID(b)
+		if err != nil {
+			return nil, err
+		}
+		sd.Owner = &owner
+	}
+	if offset := binary.LittleEndian.Uint32(data[8:12]); offset != 0 {
+		b, err := section(offset)
+		if err != nil {
+			return nil, err
+		}
+		group, err := UnmarshalSID(b)
+		if err != nil {
+			return nil, err
+		}
+		sd.Group = &group
+	}
+	if offset := binary.LittleEndian.Uint32(data[16:20]); offset != 0 && sd.Control&SE_DACL_PRESENT != 0 {
+		b, err := section(offset)
+		if err != nil {
+			return nil, err
+		}
+		if sd.DACL, err = UnmarshalACL(b); err != nil {
+			return nil, err
+		}
+	}
+	return sd, nil
+}
+
+// domainSID returns the SID of the server's local account domain,
+// S-1-5-21-x-y-z, derived from the server GUID so it is stable per server
+func (s *Server) domainSID() SID {
+	guid := s.options.ServerGUID
+	return SID{Authority: 5, SubAuthorities: []uint32{
+		21,
+		binary.LittleEndian.Uint32(guid[0:4]),
+		binary.LittleEndian.Uint32(guid[4:8]),
+		binary.LittleEndian.Uint32(guid[8:12]),
+	}}
+}
+
+// sessionSIDs returns the owner and primary group SIDs of a session's
+// user. The server has no account database, so users get a RID in the
+// server's domain hashed from their name; guests map to BUILTIN\Guests
+func (s *Server) sessionSIDs(session *Session) (owner, group SID) {
+	if session.IsGuest {
+		return SIDGuests, SIDGuests
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(session.Domain + `\` + session.Username)))
+	rid := 1000 + h.Sum32()%(1<<30) // Above the well-known RIDs
+
+	domain := s.domainSID()
+	owner = SID{Authority: domain.Authority, SubAuthorities: append(append([]uint32{}, domain.SubAuthorities...), rid)}
+	group = SID{Authority: domain.Authority, SubAuthorities: append(append([]uint32{}, domain.SubAuthorities...), 513)} // Domain Users
+	return owner, group
+}
+
+// modeAccessMask maps one rwx triplet of a file mode to file access rights
+func modeAccessMask(perm fs.FileMode, readOnly bool) uint32 {
+	var mask uint32
+	if perm&4 != 0 {
+		mask |= FILE_GENERIC_READ
+	}
+	if perm&2 != 0 && !readOnly {
+		mask |= FILE_GENERIC_WRITE
+	}
+	if perm&1 != 0 {
+		mask |= FILE_GENERIC_EXECUTE
+	}
+	return mask
+}
+
+// buildSecurityDescriptor builds the descriptor reported for a file: the
+// session's user owns it with full control (read and execute on a
+// read-only tree), and the group and Everyone get the rights of the
+// file's group and other permission bits. Only the parts selected by
+// additionalInfo are included
+func (h *SMBHandler) buildSecurityDescriptor(session *Session, tree *TreeConnection, info fs.FileInfo, additionalInfo uint32) *SecurityDescriptor {
+	owner, group := h.server.sessionSIDs(session)
+	sd := &SecurityDescriptor{}
+	if additionalInfo&OWNER_SECURITY_INFORMATION != 0 {
+		sd.Owner = &owner
+	}
+	if additionalInfo&GROUP_SECURITY_INFORMATION != 0 {
+		sd.Group = &group
+	}
+	if additionalInfo&DACL_SECURITY_INFORMATION == 0 {
+		return sd
+	}
+
+	var flags uint8
+	if info.IsDir() {
+		flags = OBJECT_INHERIT_ACE | CONTAINER_INHERIT_ACE
+	}
+	ownerMask := FILE_ALL_ACCESS
+	if tree.IsReadOnly {
+		ownerMask = FILE_GENERIC_READ | FILE_GENERIC_EXECUTE
+	}
+
+	sd.Control |= SE_DACL_PRESENT
+	sd.DACL = ACL{{Type: ACCESS_ALLOWED_ACE_TYPE, Flags: flags, Mask: ownerMask, SID: owner}}
+	perm := info.Mode().Perm()
+	if mask := modeAccessMask(perm>>3, tree.IsReadOnly); mask != 0 && !group.Equal(owner) {
+		sd.DACL = append(sd.DACL, ACE{Type: ACCESS_ALLOWED_ACE_TYPE, Flags: flags, Mask: mask, SID: group})
+	}
+	if mask := modeAccessMask(perm, tree.IsReadOnly); mask != 0 {
+		sd.DACL = append(sd.DACL, ACE{Type: ACCESS_ALLOWED_ACE_TYPE, Flags: flags, Mask: mask, SID: SIDEveryone})
+	}
+	return sd
+}
+
+// querySecurityInfo handles QUERY_INFO for SMB2_0_INFO_SECURITY
+func (h *SMBHandler) querySecurityInfo(session *Session, tree *TreeConnection, of *OpenFile, additionalInfo uint32) ([]byte, NTStatus) {
+	if mapGenericAccess(of.Access)&READ_CONTROL == 0 {
+		return nil, STATUS_ACCESS_DENIED
+	}
+
+	info, err := of.File.Stat()
+	if err != nil {
+		return nil, mapGoErrorToNTStatus(err)
+	}
+	return h.buildSecurityDescriptor(session, tree, info, additionalInfo).Marshal(), STATUS_SUCCESS
+}
@@ -0,0 +1,226 @@
+package smbfs
+
+import (
+	"testing"
+)
+
+// buildQueryInfoRequest builds a QUERY_INFO request payload
+func buildQueryInfoRequest(fileID FileID, infoType, infoClass uint8, additionalInfo, maxOutput uint32) []byte {
+	w := NewByteWriter(41)
+	w.WriteUint16(41)             // StructureSize
+	w.WriteOneByte(infoType)      // InfoType
+	w.WriteOneByte(infoClass)     // FileInfoClass
+	w.WriteUint32(maxOutput)      // OutputBufferLength
+	w.WriteUint16(0)              // InputBufferOffset
+	w.WriteUint16(0)              // Reserved
+	w.WriteUint32(0)              // InputBufferLength
+	w.WriteUint32(additionalInfo) // AdditionalInformation
+	w.WriteUint32(0)              // Flags
+	w.WriteFileID(fileID)         // FileId
+	w.WriteOneByte(0)             // Buffer
+	return w.Bytes()
+}
+
+// TestParseSID tests conversion between the string and binary forms of SIDs
+func TestParseSID(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantErr bool
+	}{
+		{"S-1-1-0", false},
+		{"S-1-5-32-544", false},
+		{"S-1-5-21-3623811015-3361044348-30300820-1013", false},
+		{"S-1-5", false},
+		{"S-2-5-32", true},
+		{"X-1-5-32", true},
+		{"S-1-5-abc", true},
+		{"S-1-5-4294967296", true},
+		{"S-1", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			sid, err := ParseSID(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSID() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := sid.String(); got != tt.in {
+				t.Errorf("String() = %q, want %q", got, tt.in)
+			}
+			decoded, err := UnmarshalSID(sid.Marshal())
+			if err != nil {
+				t.Fatalf("UnmarshalSID() error = %v", err)
+			}
+			if !decoded.Equal(sid) {
+				t.Errorf("UnmarshalSID() = %v, want %v", decoded, sid)
+			}
+		})
+	}
+
+	if _, err := UnmarshalSID([]byte{1, 2, 0, 0, 0, 0, 0, 5, 32, 0, 0, 0}); err == nil {
+		t.Error("UnmarshalSID() of a truncated SID succeeded")
+	}
+}
+
+// TestSecurityDescriptor_RoundTrip tests that a marshaled descriptor
+// parses back to the same owner, group and DACL
+func TestSecurityDescriptor_RoundTrip(t *testing.T) {
+	owner, _ := ParseSID("S-1-5-21-1-2-3-1001")
+	group, _ := ParseSID("S-1-5-21-1-2-3-513")
+	sd := &SecurityDescriptor{
+		Control: SE_DACL_PRESENT,
+		Owner:   &owner,
+		Group:   &group,
+		DACL: ACL{
+			{Type: ACCESS_ALLOWED_ACE_TYPE, Flags: OBJECT_INHERIT_ACE, Mask: FILE_ALL_ACCESS, SID: owner},
+			{Type: ACCESS_DENIED_ACE_TYPE, Mask: FILE_GENERIC_WRITE, SID: SIDGuests},
+			{Type: ACCESS_ALLOWED_ACE_TYPE, Mask: FILE_GENERIC_READ, SID: SIDEveryone},
+		},
+	}
+
+	data := sd.Marshal()
+	got, err := UnmarshalSecurityDescriptor(data)
+	if err != nil {
+		t.Fatalf("UnmarshalSecurityDescriptor() error = %v", err)
+	}
+	if got.Control != SE_DACL_PRESENT|SE_SELF_RELATIVE {
+		t.Errorf("Control = 0x%04x, want 0x%04x", got.Control, SE_DACL_PRESENT|SE_SELF_RELATIVE)
+	}
+	if got.Owner == nil || !got.Owner.Equal(owner) {
+		t.Errorf("Owner = %v, want %v", got.Owner, owner)
+	}
+	if got.Group == nil || !got.Group.Equal(group) {
+		t.Errorf("Group = %v, want %v", got.Group, group)
+	}
+	if len(got.DACL) != len(sd.DACL) {
+		t.Fatalf("DACL has %d ACEs, want %d", len(got.DACL), len(sd.DACL))
+	}
+	for i, ace := range got.DACL {
+		want := sd.DACL[i]
+		if ace.Type != want.Type || ace.Flags != want.Flags || ace.Mask != want.Mask || !ace.SID.Equal(want.SID) {
+			t.Errorf("ACE %d = %+v, want %+v", i, ace, want)
+		}
+	}
+
+	// Corrupt offsets and sizes are rejected
+	for _, corrupt := range [][]byte{data[:10], append([]byte{2}, data[1:]...)} {
+		if _, err := UnmarshalSecurityDescriptor(corrupt); err == nil {
+			t.Errorf("UnmarshalSecurityDescriptor(% x) succeeded", corrupt)
+		}
+	}
+	bad := append([]byte(nil), data...)
+	le.PutUint32(bad[16:20], uint32(len(bad)+8)) // OffsetDacl past the end
+	if _, err := UnmarshalSecurityDescriptor(bad); err == nil {
+		t.Error("UnmarshalSecurityDescriptor() with a DACL offset past the end succeeded")
+	}
+}
+
+// TestHandleQueryInfo_Security tests the descriptor returned for
+// SMB2_0_INFO_SECURITY
+func TestHandleQueryInfo_Security(t *testing.T) {
+	const allInfo = OWNER_SECURITY_INFORMATION | GROUP_SECURITY_INFORMATION | DACL_SECURITY_INFORMATION
+
+	tests := []struct {
+		name      string
+		readOnly  bool
+		access    uint32
+		info      uint32
+		maxOutput uint32
+		want      NTStatus
+		wantACEs  []uint32 // Expected DACL masks: owner, group, Everyone
+	}{
+		{"full descriptor", false, GENERIC_READ, allInfo, 4096, STATUS_SUCCESS,
+			[]uint32{FILE_ALL_ACCESS, FILE_GENERIC_READ | FILE_GENERIC_WRITE, FILE_GENERIC_READ}},
+		{"read-only tree", true, GENERIC_READ, allInfo, 4096, STATUS_SUCCESS,
+			[]uint32{FILE_GENERIC_READ | FILE_GENERIC_EXECUTE, FILE_GENERIC_READ, FILE_GENERIC_READ}},
+		{"owner only", false, READ_CONTROL, OWNER_SECURITY_INFORMATION, 4096, STATUS_SUCCESS, nil},
+		{"buffer too small", false, GENERIC_READ, allInfo, 16, STATUS_BUFFER_TOO_SMALL, nil},
+		{"no READ_CONTROL", false, FILE_READ_DATA, allInfo, 4096, STATUS_ACCESS_DENIED, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, session, tree := setupTestTree(t)
+			tree.IsReadOnly = tt.readOnly
+			of := openTestFile(t, tree, session, "/acl.txt", nil, tt.access)
+			if err := tree.Share.fs.Chmod("/acl.txt", 0664); err != nil {
+				t.Fatalf("Chmod() error = %v", err)
+			}
+
+			resp, status := srv.handler.handleQueryInfo(nil, testRequest(session, tree, SMB2_QUERY_INFO,
+				buildQueryInfoRequest(of.ID, SMB2_0_INFO_SECURITY, 0, tt.info, tt.maxOutput)))
+			if status != tt.want {
+				t.Fatalf("QUERY_INFO status = %v, want %v", status, tt.want)
+			}
+			if status == STATUS_BUFFER_TOO_SMALL {
+				full, _ := srv.handler.querySecurityInfo(session, tree, of, tt.info)
+				if le.Uint32(resp[4:8]) != 4 || le.Uint32(resp[8:12]) != uint32(len(full)) {
+					t.Errorf("ErrorData = % x, want the needed size %d", resp[4:], len(full))
+				}
+				return
+			}
+			if status != STATUS_SUCCESS {
+				return
+			}
+
+			sd, err := UnmarshalSecurityDescriptor(resp[8 : 8+le.Uint32(resp[4:8])])
+			if err != nil {
+				t.Fatalf("UnmarshalSecurityDescriptor() error = %v", err)
+			}
+			owner, group := srv.sessionSIDs(session)
+			if sd.Owner == nil || !sd.Owner.Equal(owner) {
+				t.Errorf("Owner = %v, want %v", sd.Owner, owner)
+			}
+			if tt.info&GROUP_SECURITY_INFORMATION == 0 {
+				if sd.Group != nil || sd.Control&SE_DACL_PRESENT != 0 {
+					t.Errorf("descriptor has parts that were not requested: %+v", sd)
+				}
+				return
+			}
+			if sd.Group == nil || !sd.Group.Equal(group) {
+				t.Errorf("Group = %v, want %v", sd.Group, group)
+			}
+
+			wantSIDs := []SID{owner, group, SIDEveryone}
+			if len(sd.DACL) != len(tt.wantACEs) {
+				t.Fatalf("DACL = %+v, want %d ACEs", sd.DACL, len(tt.wantACEs))
+			}
+			for i, ace := range sd.DACL {
+				if ace.Type != ACCESS_ALLOWED_ACE_TYPE || ace.Mask != tt.wantACEs[i] || !ace.SID.Equal(wantSIDs[i]) {
+					t.Errorf("ACE %d = {type %d, mask 0x%x, %v}, want allow 0x%x for %v",
+						i, ace.Type, ace.Mask, ace.SID, tt.wantACEs[i], wantSIDs[i])
+				}
+			}
+		})
+	}
+}
+
+// TestSessionSIDs tests that users get stable, distinct SIDs in the
+// server's domain and guests map to BUILTIN\Guests
+func TestSessionSIDs(t *testing.T) {
+	srv, session, _ := setupTestTree(t)
+	other := srv.sessions.CreateSession(SMB3_1_1, [16]byte{}, "127.0.0.1")
+	other.SetValid("someoneelse", "", false, nil)
+
+	a, _ := srv.sessionSIDs(session)
+	b, group := srv.sessionSIDs(other)
+	again, _ := srv.sessionSIDs(session)
+	if a.Equal(b) {
+		t.Errorf("different users share SID %v", a)
+	}
+	if !a.Equal(again) {
+		t.Errorf("SID not stable: %v then %v", a, again)
+	}
+	if got := group.SubAuthorities[len(group.SubAuthorities)-1]; got != 513 {
+		t.Errorf("group RID = %d, want 513", got)
+	}
+
+	guest := srv.sessions.CreateSession(SMB3_1_1, [16]byte{}, "127.0.0.1")
+	guest.SetValid("", "", true, nil)
+	if owner, _ := srv.sessionSIDs(guest); !owner.Equal(SIDGuests) {
+		t.Errorf("guest owner = %v, want %v", owner, SIDGuests)
+	}
+}
@@ -1,5 +1,7 @@
 package smbfs
 
+import "strings"
+
 // SMB2 Session Setup flags
 const (
 	SMB2_SESSION_FLAG_BINDING uint16 = 0x01 // Session binding (multi-channel)
@@ -63,20 +65,13 @@ func (h *SMBHandler) handleSessionSetupImpl(state *connState, msg *SMB2Message,
 	}
 
 	// Get or create session
+	// PreviousSessionId never selects the session to authenticate; the old
+	// session is only torn down once the new one is established
 	var session *Session
 	var isNewSession bool
 
-	// Check if reconnecting to previous session
-	if previousSessionID != 0 {
-		session = h.server.sessions.GetSession(previousSessionID)
-		if session != nil {
-			h.server.logger.Debug("SESSION_SETUP: Reconnecting to session %d", previousSessionID)
-			isNewSession = false
-		}
-	}
-
-	// If no existing session (or reconnect failed), check current session ID
-	if session == nil && msg.Header.SessionID != 0 {
+	// Check current session ID (continuing multi-stage auth)
+	if msg.Header.SessionID != 0 {
 		session = h.server.sessions.GetSession(msg.Header.SessionID)
 		if session != nil {
 			h.server.logger.Debug("SESSION_SETUP: Continuing session %d", msg.Header.SessionID)
@@ -102,11 +97,14 @@ func (h *SMBHandler) handleSessionSetupImpl(state *connState, msg *SMB2Message,
 		authenticator = session.Authenticator
 	} else {
 		// Create NTLM authenticator for new sessions
-		authenticator = NewNTLMAuthenticator(
+		ntlm := NewNTLMAuthenticator(
 			h.server.options.ServerName,
-			h.server.options.Users,
+			h.server.options.userStore(),
 			h.server.options.AllowGuest,
 		)
+		ntlm.SetAllowWeakNTLM(h.server.options.AllowWeakNTLM)
+		ntlm.SetLogger(h.server.logger, h.server.options.LogSecrets)
+		authenticator = ntlm
 		session.Authenticator = authenticator
 	}
 
@@ -152,20 +150,47 @@ func (h *SMBHandler) handleSessionSetupImpl(state *connState, msg *SMB2Message,
 	}
 
 	// Authentication succeeded - derive signing key from session key
+	// Guest and anonymous sessions are never signed (MS-SMB2 3.3.5.5.3), so
+	// they get no signing key even if the authenticator produced a session key
 	var signingKey []byte
-	if authResult.SessionKey != nil {
+	if authResult.SessionKey != nil && !authResult.IsGuest && !authResult.IsNull {
 		signingKey = DeriveSigningKey(authResult.SessionKey, state.dialect, state.preauthHash)
 		h.server.logger.Debug("SESSION_SETUP: Derived signing key (dialect=%s, keyLen=%d)",
 			state.dialect.String(), len(signingKey))
 	}
 
+	// Derive cipher keys when the client can encrypt (SMB 3.0+)
+	canEncrypt := authResult.SessionKey != nil && !authResult.IsGuest && !authResult.IsNull &&
+		state.dialect >= SMB3_0 && state.cipherID != 0
+	if h.server.options.EncryptData && !canEncrypt {
+		h.server.logger.Warn("SESSION_SETUP: Encryption required but not available (dialect=%s, guest=%v)",
+			state.dialect.String(), authResult.IsGuest)
+		if isNewSession {
+			h.server.sessions.DestroySession(session.ID)
+		}
+		return h.buildErrorResponse(), STATUS_ACCESS_DENIED
+	}
+	if canEncrypt {
+		session.EncryptionKey, session.DecryptionKey = DeriveEncryptionKeys(
+			authResult.SessionKey, state.dialect, state.preauthHash)
+		session.CipherID = state.cipherID
+		session.EncryptData = h.server.options.EncryptData
+	}
+
 	// Mark session as valid with derived signing key
-	session.SetValid(authResult.Username, authResult.Domain, authResult.IsGuest, signingKey)
+	session.SetValid(authResult.Username, authResult.Domain, authResult.IsGuest || authResult.IsNull, signingKey)
 	state.session = session
+	h.server.trackSession(state, session, true)
 
 	h.server.logger.Info("SESSION_SETUP: Session %d established - User=%s, Guest=%v, Signing=%v",
 		session.ID, authResult.Username, authResult.IsGuest, signingKey != nil)
 
+	// A client reconnecting after an unclean disconnect names its old session
+	// so the server can drop it and its open handles now (MS-SMB2 3.3.5.5.3)
+	if previousSessionID != 0 && previousSessionID != session.ID {
+		h.destroyPreviousSession(previousSessionID, session)
+	}
+
 	// Update response header with session ID
 	respHeader.SessionID = session.ID
 
@@ -182,9 +207,15 @@ func (h *SMBHandler) handleSessionSetupImpl(state *connState, msg *SMB2Message,
 
 	// Set session flags
 	var sessionFlags uint16
-	if authResult.IsGuest {
+	// The flags tell the client not to sign requests on this session
+	if authResult.IsNull {
+		sessionFlags |= SMB2_SESSION_FLAG_IS_NULL
+	} else if authResult.IsGuest {
 		sessionFlags |= SMB2_SESSION_FLAG_IS_GUEST
 	}
+	if session.EncryptData {
+		sessionFlags |= SMB2_SESSION_FLAG_ENCRYPT
+	}
 	w.WriteUint16(sessionFlags)
 
 	// Security buffer (for response blob from authenticator)
@@ -205,6 +236,37 @@ func (h *SMBHandler) handleSessionSetupImpl(state *connState, msg *SMB2Message,
 	return w.Bytes(), STATUS_SUCCESS
 }
 
+// destroyPreviousSession tears down a session replaced by a reconnect
+// The previous session must belong to the same user, so a client cannot
+// close another user's session by naming its ID
+func (h *SMBHandler) destroyPreviousSession(previousSessionID uint64, session *Session) {
+	prev := h.server.sessions.GetSession(previousSessionID)
+	if prev == nil {
+		h.server.logger.Debug("SESSION_SETUP: Previous session %d not found", previousSessionID)
+		return
+	}
+
+	if prev.State != SessionStateValid || prev.IsGuest || session.IsGuest ||
+		!strings.EqualFold(prev.Username, session.Username) ||
+		!strings.EqualFold(prev.Domain, session.Domain) {
+		h.server.logger.Warn("SESSION_SETUP: Ignoring PreviousSessionId %d: not owned by %s",
+			previousSessionID, session.Username)
+		return
+	}
+
+	h.server.logger.Info("SESSION_SETUP: Session %d replaces previous session %d (User=%s)",
+		session.ID, previousSessionID, session.Username)
+
+	h.server.disconnectDurableHandles(prev.ID)
+	for _, tree := range prev.GetAllTreeConnections() {
+		if tree.Share != nil {
+			tree.Share.fileHandles.ReleaseByTree(tree.ID, prev.ID)
+		}
+	}
+	h.server.notify.releaseSession(prev.ID)
+	h.server.sessions.DestroySession(prev.ID)
+}
+
 // handleLogoffImpl implements the LOGOFF command handler
 // This destroys the session and releases all associated resources
 func (h *SMBHandler) handleLogoffImpl(state *connState, msg *SMB2Message) ([]byte, NTStatus) {
@@ -234,24 +296,31 @@ func (h *SMBHandler) handleLogoffImpl(state *connState, msg *SMB2Message) ([]byt
 
 	h.server.logger.Info("LOGOFF: Session %d (User=%s)", session.ID, session.Username)
 
-	// Get all tree connections before destroying session
-	trees := session.GetAllTreeConnections()
-
-	// Clean up file handles for each tree connection
-	for _, tree := range trees {
-		// Release all file handles for this tree/session combination
-		if tree.Share != nil {
-			h.server.logger.Debug("LOGOFF: Releasing file handles for tree %d (share=%s)",
-				tree.ID, tree.ShareName)
-			tree.Share.fileHandles.ReleaseByTree(tree.ID, session.ID)
+	// Pending requests of the session, such as blocking locks, complete
+	// with STATUS_CANCELLED
+	h.server.async.releaseSession(session.ID)
+
+	// Close every open of the session as CLOSE would, dropping its locks,
+	// leases and enumeration state and honoring delete-on-close. Durable
+	// handles go too: a client that logs off will not reconnect them
+	for _, share := range h.server.shareList() {
+		for _, of := range share.fileHandles.all() {
+			if of.SessionID == session.ID {
+				h.server.logger.Debug("LOGOFF: Closing %s on share %s", of.Path, share.Options().ShareName)
+				h.closeOpenFile(share, of)
+			}
 		}
 	}
 
+	// Complete outstanding CHANGE_NOTIFY requests for the session
+	h.server.notify.releaseSession(session.ID)
+
 	// Destroy the session (this also removes all tree connections)
 	h.server.sessions.DestroySession(session.ID)
 
 	// Clear session from connection state
 	state.session = nil
+	h.server.trackSession(state, session, false)
 
 	// Build LOGOFF response
 	// Structure: MS-SMB2 2.2.8
@@ -7,7 +7,6 @@ import (
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/binary"
-	"log"
 )
 
 // SMB2 signature field is at offset 48 in the SMB2 header (16 bytes)
@@ -44,16 +43,6 @@ func SignMessage(message []byte, signingKey []byte, dialect SMBDialect) []byte {
 		signature = computeHMACSHA256(msgCopy, signingKey)
 	}
 
-	// Debug logging
-	log.Printf("[DEBUG] SignMessage: dialect=%s, keyLen=%d, msgLen=%d, sigLen=%d",
-		dialect.String(), len(signingKey), len(message), len(signature))
-	if len(signingKey) >= 16 {
-		log.Printf("[DEBUG] SignMessage: signingKey=%x (first 16)", signingKey[:16])
-	}
-	if len(signature) >= 16 {
-		log.Printf("[DEBUG] SignMessage: signature=%x", signature[:16])
-	}
-
 	return signature
 }
 
@@ -196,7 +185,6 @@ func xorBytes(dst, src []byte) {
 func DeriveSigningKey(sessionKey []byte, dialect SMBDialect, preauthHash []byte) []byte {
 	if dialect < SMB3_0 {
 		// SMB 2.x uses session key directly
-		log.Printf("[DEBUG] DeriveSigningKey: SMB 2.x - using session key directly")
 		return sessionKey
 	}
 
@@ -206,18 +194,13 @@ func DeriveSigningKey(sessionKey []byte, dialect SMBDialect, preauthHash []byte)
 		// SMB 3.1.1 uses different label and preauth hash as context
 		label = []byte("SMBSigningKey\x00")
 		context = preauthHash
-		log.Printf("[DEBUG] DeriveSigningKey: SMB 3.1.1 - full preauthHash=%x (len=%d)",
-			preauthHash, len(preauthHash))
 	} else {
 		// SMB 3.0/3.0.2 (or SMB 3.1.1 without preauthHash)
 		label = []byte("SMB2AESCMAC\x00")
 		context = []byte("SmbSign\x00")
-		log.Printf("[DEBUG] DeriveSigningKey: SMB 3.0 style - preauthHash len=%d", len(preauthHash))
 	}
 
-	signingKey := kdfSP800108(sessionKey, label, context, 16)
-	log.Printf("[DEBUG] DeriveSigningKey: sessionKey=%x signingKey=%x", sessionKey, signingKey)
-	return signingKey
+	return kdfSP800108(sessionKey, label, context, 16)
 }
 
 // kdfSP800108 implements the SP800-108 KDF in Counter Mode with HMAC-SHA256
@@ -317,15 +300,5 @@ func UpdatePreauthHash(currentHash []byte, message []byte) []byte {
 	h := sha512.New()
 	h.Write(currentHash)
 	h.Write(message)
-	newHash := h.Sum(nil)
-
-	// Show first 16 bytes of message for debugging
-	msgPreview := message
-	if len(msgPreview) > 16 {
-		msgPreview = msgPreview[:16]
-	}
-	log.Printf("[DEBUG] UpdatePreauthHash: prevHash=%x... msgLen=%d msgStart=%x newHash=%x...",
-		currentHash[:16], len(message), msgPreview, newHash[:16])
-
-	return newHash
+	return h.Sum(nil)
 }
@@ -71,6 +71,14 @@ func (h *SMBHandler) handleTreeConnectImpl(state *connState, msg *SMB2Message, r
 		return h.buildErrorResponse(), STATUS_ACCESS_DENIED
 	}
 
+	// An encrypted share is only reachable from sessions that can encrypt
+	encryptShare := share.Options().EncryptData
+	if encryptShare && session.EncryptionKey == nil {
+		h.server.logger.Warn("TREE_CONNECT: Share %s requires encryption, session %d cannot encrypt",
+			shareName, session.ID)
+		return h.buildErrorResponse(), STATUS_ACCESS_DENIED
+	}
+
 	// Create tree connection via session.AddTreeConnection()
 	tree := session.AddTreeConnection(shareName, share, share.IsReadOnly())
 
@@ -85,30 +93,28 @@ func (h *SMBHandler) handleTreeConnectImpl(state *connState, msg *SMB2Message, r
 	w.WriteOneByte(uint8(share.GetShareType())) // ShareType from share config
 	w.WriteOneByte(0)                           // Reserved
 
-	// ShareFlags - manual caching (most compatible)
-	// Bits 0-3: caching policy (0 = manual caching of documents)
-	shareFlags := uint32(0)
-	w.WriteUint32(shareFlags)
+	// ShareFlags - the share's offline caching policy (bits 4-5), then
+	// what clients must know about encryption and enumeration
+	shareFlags := uint32(share.Options().CachingMode) & shareFlagsCachingMask
+	if encryptShare {
+		shareFlags |= SMB2_SHAREFLAG_ENCRYPT_DATA
+	}
+	if share.enumeratesByAccess() {
+		shareFlags |= SMB2_SHAREFLAG_ACCESS_BASED_DIRECTORY_ENUM
+	}
 
-	// Capabilities - don't claim DFS since we don't support it
+	// Capabilities - DFS only for shares that are DFS roots
 	capabilities := uint32(0)
+	if len(share.Options().DFSLinks) > 0 {
+		shareFlags |= SMB2_SHAREFLAG_DFS | SMB2_SHAREFLAG_DFS_ROOT
+		capabilities |= SMB2_SHARE_CAP_DFS
+	}
+	w.WriteUint32(shareFlags)
 	w.WriteUint32(capabilities)
 
 	// MaximalAccess - use specific access rights, not MAXIMUM_ALLOWED
 	// MAXIMUM_ALLOWED (0x02000000) is a request flag, not appropriate in response
-	var maximalAccess uint32
-	if share.IsReadOnly() {
-		// Read-only access
-		maximalAccess = FILE_READ_DATA | FILE_READ_ATTRIBUTES | FILE_READ_EA | READ_CONTROL | SYNCHRONIZE
-	} else {
-		// Full access - standard file access rights
-		maximalAccess = FILE_READ_DATA | FILE_WRITE_DATA | FILE_APPEND_DATA |
-			FILE_READ_EA | FILE_WRITE_EA |
-			FILE_EXECUTE | FILE_DELETE_CHILD |
-			FILE_READ_ATTRIBUTES | FILE_WRITE_ATTRIBUTES |
-			DELETE | READ_CONTROL | WRITE_DAC | WRITE_OWNER | SYNCHRONIZE
-	}
-	w.WriteUint32(maximalAccess)
+	w.WriteUint32(maximalAccess(share.IsReadOnly()))
 
 	return w.Bytes(), STATUS_SUCCESS
 }
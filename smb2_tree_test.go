@@ -0,0 +1,95 @@
+package smbfs
+
+import (
+	"testing"
+
+	"github.com/absfs/memfs"
+)
+
+// buildTreeConnectRequest builds a TREE_CONNECT request for the UNC path
+func buildTreeConnectRequest(path string) []byte {
+	name := EncodeStringToUTF16LE(path)
+	req := make([]byte, 8, 8+len(name))
+	le.PutUint16(req[0:2], 9)                 // StructureSize
+	le.PutUint16(req[4:6], SMB2HeaderSize+8)  // PathOffset
+	le.PutUint16(req[6:8], uint16(len(name))) // PathLength
+	return append(req, name...)
+}
+
+// TestTreeConnect_ShareFlags tests that the TREE_CONNECT response carries
+// the share's type, caching policy, encryption and enumeration flags and
+// capabilities as configured
+func TestTreeConnect_ShareFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		options   ShareOptions
+		wantType  uint8
+		wantFlags uint32
+		wantCaps  uint32
+	}{
+		{"default", ShareOptions{}, SMB2_SHARE_TYPE_DISK, SMB2_SHAREFLAG_MANUAL_CACHING, 0},
+		{"auto caching", ShareOptions{CachingMode: CachingModeAuto}, SMB2_SHARE_TYPE_DISK,
+			SMB2_SHAREFLAG_AUTO_CACHING, 0},
+		{"programs cached", ShareOptions{CachingMode: CachingModeVDO}, SMB2_SHARE_TYPE_DISK,
+			SMB2_SHAREFLAG_VDO_CACHING, 0},
+		{"no caching", ShareOptions{CachingMode: CachingModeNone}, SMB2_SHARE_TYPE_DISK,
+			SMB2_SHAREFLAG_NO_CACHING, 0},
+		{"encrypted", ShareOptions{EncryptData: true}, SMB2_SHARE_TYPE_DISK,
+			SMB2_SHAREFLAG_ENCRYPT_DATA, 0},
+		{"access based enumeration",
+			ShareOptions{AccessBasedEnumeration: true, AccessChecker: hrChecker{}, CachingMode: CachingModeNone},
+			SMB2_SHARE_TYPE_DISK, SMB2_SHAREFLAG_ACCESS_BASED_DIRECTORY_ENUM | SMB2_SHAREFLAG_NO_CACHING, 0},
+		{"DFS root", ShareOptions{DFSLinks: map[string]string{"docs": `\\other\docs`}}, SMB2_SHARE_TYPE_DISK,
+			SMB2_SHAREFLAG_DFS | SMB2_SHAREFLAG_DFS_ROOT, SMB2_SHARE_CAP_DFS},
+		{"pipe", ShareOptions{ShareType: SMBShareTypePipe}, SMB2_SHARE_TYPE_PIPE, 0, 0},
+		{"printer", ShareOptions{ShareType: SMBShareTypePrint, CachingMode: CachingModeAuto},
+			SMB2_SHARE_TYPE_PRINT, SMB2_SHAREFLAG_AUTO_CACHING, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := setupTestServer(t)
+			mfs, err := memfs.NewFS()
+			if err != nil {
+				t.Fatalf("Failed to create memfs: %v", err)
+			}
+			tt.options.ShareName = "share"
+			if err := srv.AddShare(mfs, tt.options); err != nil {
+				t.Fatalf("AddShare() error = %v", err)
+			}
+
+			session := srv.sessions.CreateSession(SMB3_1_1, [16]byte{}, "127.0.0.1")
+			session.SetValid("testuser", "", false, nil)
+			session.EncryptionKey = make([]byte, 16)
+
+			respHeader := &SMB2Header{}
+			msg := testRequest(session, &TreeConnection{}, SMB2_TREE_CONNECT, buildTreeConnectRequest(`\\server\share`))
+			resp, status := srv.handler.handleTreeConnectImpl(nil, msg, respHeader)
+			if status != STATUS_SUCCESS {
+				t.Fatalf("TREE_CONNECT status = %v, want STATUS_SUCCESS", status)
+			}
+			if len(resp) != 16 || le.Uint16(resp[0:2]) != 16 {
+				t.Fatalf("TREE_CONNECT response = %x, want a 16-byte structure", resp)
+			}
+			if got := resp[2]; got != tt.wantType {
+				t.Errorf("ShareType = %d, want %d", got, tt.wantType)
+			}
+			if got := le.Uint32(resp[4:8]); got != tt.wantFlags {
+				t.Errorf("ShareFlags = 0x%x, want 0x%x", got, tt.wantFlags)
+			}
+			if got := le.Uint32(resp[8:12]); got != tt.wantCaps {
+				t.Errorf("Capabilities = 0x%x, want 0x%x", got, tt.wantCaps)
+			}
+			if respHeader.TreeID == 0 || session.GetTreeConnection(respHeader.TreeID) == nil {
+				t.Errorf("TreeID = %d, want the new tree connection's", respHeader.TreeID)
+			}
+		})
+	}
+
+	// Caching policies outside the four defined are refused
+	srv := setupTestServer(t)
+	mfs, _ := memfs.NewFS()
+	if err := srv.AddShare(mfs, ShareOptions{ShareName: "bad", CachingMode: 0x40}); err == nil {
+		t.Error("AddShare() with an undefined caching mode succeeded")
+	}
+}
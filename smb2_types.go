@@ -1,6 +1,7 @@
 package smbfs
 
 import (
+	"context"
 	"encoding/binary"
 	"time"
 )
@@ -64,6 +65,8 @@ type NTStatus uint32
 const (
 	STATUS_SUCCESS                  NTStatus = 0x00000000
 	STATUS_PENDING                  NTStatus = 0x00000103
+	STATUS_NOTIFY_CLEANUP           NTStatus = 0x0000010B
+	STATUS_NOTIFY_ENUM_DIR          NTStatus = 0x0000010C
 	STATUS_BUFFER_OVERFLOW          NTStatus = 0x80000005
 	STATUS_NO_MORE_FILES            NTStatus = 0x80000006
 	STATUS_INVALID_PARAMETER        NTStatus = 0xC000000D
@@ -71,30 +74,45 @@ const (
 	STATUS_END_OF_FILE              NTStatus = 0xC0000011
 	STATUS_MORE_PROCESSING_REQUIRED NTStatus = 0xC0000016
 	STATUS_ACCESS_DENIED            NTStatus = 0xC0000022
+	STATUS_BUFFER_TOO_SMALL         NTStatus = 0xC0000023
 	STATUS_OBJECT_NAME_INVALID      NTStatus = 0xC0000033
 	STATUS_OBJECT_NAME_NOT_FOUND    NTStatus = 0xC0000034
 	STATUS_OBJECT_NAME_COLLISION    NTStatus = 0xC0000035
 	STATUS_OBJECT_PATH_NOT_FOUND    NTStatus = 0xC000003A
 	STATUS_SHARING_VIOLATION        NTStatus = 0xC0000043
+	STATUS_FILE_LOCK_CONFLICT       NTStatus = 0xC0000054
+	STATUS_LOCK_NOT_GRANTED         NTStatus = 0xC0000055
 	STATUS_DELETE_PENDING           NTStatus = 0xC0000056
 	STATUS_PRIVILEGE_NOT_HELD       NTStatus = 0xC0000061
 	STATUS_LOGON_FAILURE            NTStatus = 0xC000006D
 	STATUS_ACCOUNT_RESTRICTION      NTStatus = 0xC000006E
 	STATUS_PASSWORD_EXPIRED         NTStatus = 0xC0000071
+	STATUS_EAS_NOT_SUPPORTED        NTStatus = 0xC000004F
+	STATUS_RANGE_NOT_LOCKED         NTStatus = 0xC000007E
+	STATUS_DISK_FULL                NTStatus = 0xC000007F
 	STATUS_INSUFFICIENT_RESOURCES   NTStatus = 0xC000009A
 	STATUS_FILE_IS_A_DIRECTORY      NTStatus = 0xC00000BA
 	STATUS_BAD_NETWORK_NAME         NTStatus = 0xC00000CC
 	STATUS_NOT_SAME_DEVICE          NTStatus = 0xC00000D4
 	STATUS_FILE_RENAMED             NTStatus = 0xC00000D5
+	STATUS_PIPE_EMPTY               NTStatus = 0xC00000D9
 	STATUS_NOT_A_DIRECTORY          NTStatus = 0xC0000103
 	STATUS_FILE_CLOSED              NTStatus = 0xC0000128
+	STATUS_INVALID_LOCK_RANGE       NTStatus = 0xC00001A1
 	STATUS_CANCELLED                NTStatus = 0xC0000120
+	STATUS_CANNOT_DELETE            NTStatus = 0xC0000121
 	STATUS_NETWORK_NAME_DELETED     NTStatus = 0xC00000C9
 	STATUS_USER_SESSION_DELETED     NTStatus = 0xC0000203
 	STATUS_NOT_FOUND                NTStatus = 0xC0000225
+	STATUS_PATH_NOT_COVERED         NTStatus = 0xC0000257
+	STATUS_NOT_A_REPARSE_POINT      NTStatus = 0xC0000275
+	STATUS_IO_REPARSE_DATA_INVALID  NTStatus = 0xC0000278
 	STATUS_INVALID_DEVICE_REQUEST   NTStatus = 0xC0000010
 	STATUS_DIRECTORY_NOT_EMPTY      NTStatus = 0xC0000101
 	STATUS_NOT_SUPPORTED            NTStatus = 0xC00000BB
+	STATUS_UNSUCCESSFUL             NTStatus = 0xC0000001
+	STATUS_NOT_IMPLEMENTED          NTStatus = 0xC0000002
+	STATUS_REQUEST_NOT_ACCEPTED     NTStatus = 0xC00000D0
 )
 
 // IsSuccess returns true if status indicates success
@@ -114,6 +132,10 @@ func (s NTStatus) String() string {
 		return "STATUS_SUCCESS"
 	case STATUS_PENDING:
 		return "STATUS_PENDING"
+	case STATUS_NOTIFY_CLEANUP:
+		return "STATUS_NOTIFY_CLEANUP"
+	case STATUS_NOTIFY_ENUM_DIR:
+		return "STATUS_NOTIFY_ENUM_DIR"
 	case STATUS_BUFFER_OVERFLOW:
 		return "STATUS_BUFFER_OVERFLOW"
 	case STATUS_NO_MORE_FILES:
@@ -128,6 +150,8 @@ func (s NTStatus) String() string {
 		return "STATUS_MORE_PROCESSING_REQUIRED"
 	case STATUS_ACCESS_DENIED:
 		return "STATUS_ACCESS_DENIED"
+	case STATUS_BUFFER_TOO_SMALL:
+		return "STATUS_BUFFER_TOO_SMALL"
 	case STATUS_OBJECT_NAME_INVALID:
 		return "STATUS_OBJECT_NAME_INVALID"
 	case STATUS_OBJECT_NAME_NOT_FOUND:
@@ -138,24 +162,52 @@ func (s NTStatus) String() string {
 		return "STATUS_OBJECT_PATH_NOT_FOUND"
 	case STATUS_SHARING_VIOLATION:
 		return "STATUS_SHARING_VIOLATION"
+	case STATUS_FILE_LOCK_CONFLICT:
+		return "STATUS_FILE_LOCK_CONFLICT"
+	case STATUS_LOCK_NOT_GRANTED:
+		return "STATUS_LOCK_NOT_GRANTED"
 	case STATUS_LOGON_FAILURE:
 		return "STATUS_LOGON_FAILURE"
+	case STATUS_EAS_NOT_SUPPORTED:
+		return "STATUS_EAS_NOT_SUPPORTED"
+	case STATUS_RANGE_NOT_LOCKED:
+		return "STATUS_RANGE_NOT_LOCKED"
+	case STATUS_DISK_FULL:
+		return "STATUS_DISK_FULL"
 	case STATUS_FILE_IS_A_DIRECTORY:
 		return "STATUS_FILE_IS_A_DIRECTORY"
 	case STATUS_BAD_NETWORK_NAME:
 		return "STATUS_BAD_NETWORK_NAME"
+	case STATUS_PIPE_EMPTY:
+		return "STATUS_PIPE_EMPTY"
 	case STATUS_NOT_A_DIRECTORY:
 		return "STATUS_NOT_A_DIRECTORY"
 	case STATUS_FILE_CLOSED:
 		return "STATUS_FILE_CLOSED"
+	case STATUS_INVALID_LOCK_RANGE:
+		return "STATUS_INVALID_LOCK_RANGE"
 	case STATUS_CANCELLED:
 		return "STATUS_CANCELLED"
+	case STATUS_CANNOT_DELETE:
+		return "STATUS_CANNOT_DELETE"
+	case STATUS_PATH_NOT_COVERED:
+		return "STATUS_PATH_NOT_COVERED"
 	case STATUS_NOT_FOUND:
 		return "STATUS_NOT_FOUND"
+	case STATUS_NOT_A_REPARSE_POINT:
+		return "STATUS_NOT_A_REPARSE_POINT"
+	case STATUS_IO_REPARSE_DATA_INVALID:
+		return "STATUS_IO_REPARSE_DATA_INVALID"
 	case STATUS_DIRECTORY_NOT_EMPTY:
 		return "STATUS_DIRECTORY_NOT_EMPTY"
 	case STATUS_NOT_SUPPORTED:
 		return "STATUS_NOT_SUPPORTED"
+	case STATUS_UNSUCCESSFUL:
+		return "STATUS_UNSUCCESSFUL"
+	case STATUS_NOT_IMPLEMENTED:
+		return "STATUS_NOT_IMPLEMENTED"
+	case STATUS_REQUEST_NOT_ACCEPTED:
+		return "STATUS_REQUEST_NOT_ACCEPTED"
 	default:
 		return "STATUS_UNKNOWN"
 	}
@@ -253,6 +305,30 @@ type SMB2Message struct {
 	// Signing information (set when message should be signed)
 	SigningKey []byte     // Key to use for signing
 	Dialect    SMBDialect // Dialect for signing algorithm selection
+
+	// Encryption information
+	Encrypted     bool   // Request arrived in a transform header
+	EncryptionKey []byte // Key to encrypt with (response is not signed when set)
+	CipherID      uint16 // Cipher for EncryptionKey
+
+	// Algorithm to compress the response with, if it is worth it
+	// (SMB2_COMPRESSION_NONE for none)
+	CompressionAlg uint16
+
+	// Status a related compound request fails with because the request
+	// before it failed (STATUS_SUCCESS otherwise)
+	relatedStatus NTStatus
+
+	// File operation the request performed, for the share's AuditHook
+	audit *AuditEvent
+
+	// The request outran AsyncThreshold and is recorded when its final
+	// response is sent
+	deferred bool
+
+	// Cancelled by a CANCEL naming a request that outran AsyncThreshold
+	// (nil for requests handled synchronously)
+	ctx context.Context
 }
 
 // FileID is a 128-bit SMB2 file identifier
@@ -422,6 +498,10 @@ const (
 	SMB2_SHAREFLAG_ENABLE_HASH_V1              uint32 = 0x00002000
 	SMB2_SHAREFLAG_ENABLE_HASH_V2              uint32 = 0x00004000
 	SMB2_SHAREFLAG_ENCRYPT_DATA                uint32 = 0x00008000
+
+	// shareFlagsCachingMask covers the bits of ShareFlags that hold the
+	// caching policy
+	shareFlagsCachingMask uint32 = 0x00000030
 )
 
 // SMB2 Share Capabilities
@@ -496,3 +576,18 @@ const (
 	FileFsObjectIdInformation  uint8 = 8
 	FileFsSectorSizeInformation uint8 = 11
 )
+
+// File Alignment Requirements (FileAlignmentInformation, MS-FSCC 2.4.3)
+// Each value is the required alignment in bytes minus one
+const (
+	FILE_BYTE_ALIGNMENT     uint32 = 0x00000000
+	FILE_WORD_ALIGNMENT     uint32 = 0x00000001
+	FILE_LONG_ALIGNMENT     uint32 = 0x00000003
+	FILE_QUAD_ALIGNMENT     uint32 = 0x00000007
+	FILE_OCTA_ALIGNMENT     uint32 = 0x0000000f
+	FILE_32_BYTE_ALIGNMENT  uint32 = 0x0000001f
+	FILE_64_BYTE_ALIGNMENT  uint32 = 0x0000003f
+	FILE_128_BYTE_ALIGNMENT uint32 = 0x0000007f
+	FILE_256_BYTE_ALIGNMENT uint32 = 0x000000ff
+	FILE_512_BYTE_ALIGNMENT uint32 = 0x000001ff
+)
@@ -4,10 +4,10 @@ import (
 	"context"
 	"fmt"
 	"io/fs"
-	"net"
+	"os"
 	"time"
 
-	"github.com/hirochachacha/go-smb2"
+	"github.com/absfs/smbfs/internal/smb2"
 )
 
 // realSMBSession wraps a go-smb2 Session to implement SMBSession.
@@ -43,11 +43,96 @@ func (sh *realSMBShare) OpenFile(name string, flag int, perm fs.FileMode) (SMBFi
 	return &realSMBFile{file: file}, nil
 }
 
+// OpenFileShareDelete opens a file like OpenFile, letting others delete or
+// rename it while it is open.
+func (sh *realSMBShare) OpenFileShareDelete(name string, flag int, perm fs.FileMode) (SMBFile, error) {
+	file, err := sh.share.OpenFileShareDelete(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &realSMBFile{file: file}, nil
+}
+
+// OpenAccess opens an existing file or directory with the given access
+// rights, for requests on its handle.
+func (sh *realSMBShare) OpenAccess(name string, access uint32) (SMBFile, error) {
+	file, err := sh.share.OpenAccess(name, access)
+	if err != nil {
+		return nil, err
+	}
+	return &realSMBFile{file: file}, nil
+}
+
+// Ioctl sends an FSCTL that is not bound to a file and returns its output.
+func (sh *realSMBShare) Ioctl(ctlCode uint32, input []byte, maxOutput uint32) ([]byte, error) {
+	return sh.share.Ioctl(ctlCode, input, maxOutput)
+}
+
 // Stat returns file info for the specified path.
 func (sh *realSMBShare) Stat(name string) (fs.FileInfo, error) {
 	return sh.share.Stat(name)
 }
 
+// Lstat returns file info for the specified path without following a
+// symbolic link.
+func (sh *realSMBShare) Lstat(name string) (fs.FileInfo, error) {
+	return sh.share.Lstat(name)
+}
+
+// Readlink returns the target of a symbolic link.
+func (sh *realSMBShare) Readlink(name string) (string, error) {
+	return sh.share.Readlink(name)
+}
+
+// Symlink creates linkpath as a symbolic link to target.
+func (sh *realSMBShare) Symlink(target, linkpath string) error {
+	return sh.share.Symlink(target, linkpath)
+}
+
+// WithContext returns a view of the share whose requests use ctx.
+func (sh *realSMBShare) WithContext(ctx context.Context) SMBShare {
+	return &realSMBShare{share: sh.share.WithContext(ctx)}
+}
+
+// CopyFile copies src to dst, creating or truncating dst, and removes dst
+// if the copy fails. go-smb2 uses a server-side copy (FSCTL_SRV_COPYCHUNK)
+// and falls back to reading and writing through the client if the server
+// does not support it.
+func (sh *realSMBShare) CopyFile(src, dst string) (int64, error) {
+	in, err := sh.share.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := sh.share.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := out.ReadFrom(in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = sh.share.Remove(dst)
+	}
+	return n, err
+}
+
+// Statfs returns the total, free and caller-available bytes of the volume
+// holding name, from its FileFsFullSizeInformation.
+func (sh *realSMBShare) Statfs(name string) (total, free, available uint64, err error) {
+	info, err := sh.share.Statfs(name)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	// go-smb2 reports BytesPerSector as the block size and
+	// SectorsPerAllocationUnit as the fragment size
+	unit := info.BlockSize() * info.FragmentSize()
+	return info.TotalBlockCount() * unit, info.FreeBlockCount() * unit, info.AvailableBlockCount() * unit, nil
+}
+
 // Mkdir creates a directory.
 func (sh *realSMBShare) Mkdir(name string, perm fs.FileMode) error {
 	return sh.share.Mkdir(name, perm)
@@ -68,6 +153,12 @@ func (sh *realSMBShare) Chmod(name string, mode fs.FileMode) error {
 	return sh.share.Chmod(name, mode)
 }
 
+// SetAttributes sets the Windows attributes of the named file with SET_INFO
+// FileBasicInformation.
+func (sh *realSMBShare) SetAttributes(name string, attrs uint32) error {
+	return sh.share.SetAttributes(name, attrs)
+}
+
 // Chtimes changes the access and modification times of a file.
 func (sh *realSMBShare) Chtimes(name string, atime, mtime time.Time) error {
 	return sh.share.Chtimes(name, atime, mtime)
@@ -93,11 +184,27 @@ func (f *realSMBFile) Write(p []byte) (n int, err error) {
 	return f.file.Write(p)
 }
 
+// ReadAt reads len(p) bytes at offset off without moving the file offset.
+func (f *realSMBFile) ReadAt(p []byte, off int64) (n int, err error) {
+	return f.file.ReadAt(p, off)
+}
+
+// WriteAt writes len(p) bytes at offset off without moving the file offset.
+func (f *realSMBFile) WriteAt(p []byte, off int64) (n int, err error) {
+	return f.file.WriteAt(p, off)
+}
+
 // Seek sets the offset for the next Read or Write.
 func (f *realSMBFile) Seek(offset int64, whence int) (int64, error) {
 	return f.file.Seek(offset, whence)
 }
 
+// WithContext returns a view of the file whose requests use ctx. Closing
+// the view closes the file.
+func (f *realSMBFile) WithContext(ctx context.Context) SMBFile {
+	return &realSMBFile{file: f.file.WithContext(ctx)}
+}
+
 // Close closes the file.
 func (f *realSMBFile) Close() error {
 	return f.file.Close()
@@ -113,33 +220,60 @@ func (f *realSMBFile) Readdir(n int) ([]fs.FileInfo, error) {
 	return f.file.Readdir(n)
 }
 
+// Truncate changes the size of the file with SET_INFO
+// FileEndOfFileInformation.
+func (f *realSMBFile) Truncate(size int64) error {
+	return f.file.Truncate(size)
+}
+
+// QueryInfo returns the file's information of the given class.
+func (f *realSMBFile) QueryInfo(class uint8, input []byte, maxOutput uint32) ([]byte, error) {
+	return f.file.QueryInfo(class, input, maxOutput)
+}
+
+// SetInfo sets the file's information of the given class.
+func (f *realSMBFile) SetInfo(class uint8, input []byte) error {
+	return f.file.SetInfo(class, input)
+}
+
+// Lock sends a LOCK request for a byte range on the file's handle.
+func (f *realSMBFile) Lock(offset, length uint64, flags uint32) error {
+	return f.file.Lock(offset, length, flags)
+}
+
+// SetAttributes sets the file's Windows attributes with SET_INFO
+// FileBasicInformation.
+func (f *realSMBFile) SetAttributes(attrs uint32) error {
+	return f.file.SetAttributes(attrs)
+}
+
 // RealConnectionFactory implements ConnectionFactory using real SMB connections.
 type RealConnectionFactory struct{}
 
 // CreateConnection creates a real SMB connection.
 func (f *RealConnectionFactory) CreateConnection(config *Config) (SMBSession, SMBShare, error) {
-	addr := fmt.Sprintf("%s:%d", config.Server, config.Port)
+	addr := config.address()
 
-	// Create TCP connection with timeout
-	dialer := &net.Dialer{
-		Timeout: config.ConnTimeout,
+	initiator, err := newInitiator(config)
+	if err != nil {
+		return nil, nil, err
 	}
 
+	// Create TCP connection with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), config.ConnTimeout)
 	defer cancel()
 
-	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+	netConn, err := config.dial(ctx)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
 	}
 
 	// Create SMB session
 	d := &smb2.Dialer{
-		Initiator: &smb2.NTLMInitiator{
-			User:     config.Username,
-			Password: config.Password,
-			Domain:   config.Domain,
+		Negotiator: smb2.Negotiator{
+			RequireMessageSigning: config.signingRequired(),
 		},
+		Initiator: initiator,
 	}
 
 	session, err := d.Dial(netConn)
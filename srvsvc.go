@@ -0,0 +1,538 @@
+package smbfs
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf16"
+)
+
+// DCE/RPC connection-oriented PDU types (C706 12.6.4)
+const (
+	rpcPacketRequest  = 0
+	rpcPacketResponse = 2
+	rpcPacketFault    = 3
+	rpcPacketBind     = 11
+	rpcPacketBindAck  = 12
+)
+
+// DCE/RPC PDU flags
+const (
+	rpcFlagFirstFrag = 0x01
+	rpcFlagLastFrag  = 0x02
+)
+
+// DCE/RPC framing
+const (
+	rpcHeaderSize        = 16   // Common header
+	rpcRequestHeaderSize = 24   // Common header + alloc_hint, p_cont_id, opnum
+	rpcMaxFragSize       = 4280 // Fragment size offered in BIND and BIND_ACK
+	rpcDataRepLE         = 0x10 // Little-endian integers, ASCII characters, IEEE floats
+)
+
+// DCE/RPC BIND_ACK presentation context results
+const (
+	rpcContextAccepted         = 0
+	rpcContextProviderRejected = 2
+
+	rpcReasonAbstractSyntaxNotSupported = 1
+)
+
+// DCE/RPC fault statuses
+const (
+	rpcFaultOpRangeError = 0x1C010002 // nca_s_op_rng_error
+	rpcFaultProtoError   = 0x1C01000B // nca_s_proto_error
+	rpcFaultBadStubData  = 0x000006F7 // rpc_x_bad_stub_data
+)
+
+// MS-SRVS NetrShareEnum
+const (
+	srvsvcOpNetrShareEnum = 15
+
+	srvsvcErrorInvalidLevel = 0x0000007C // ERROR_INVALID_LEVEL
+)
+
+// Share types reported by NetrShareEnum (MS-SRVS 2.2.2.4)
+const (
+	stypeDisktree = 0x00000000
+	stypePrintq   = 0x00000001
+	stypeIPC      = 0x00000003
+	stypeSpecial  = 0x80000000
+)
+
+// rpcSyntax is a presentation syntax identifier: an interface or transfer
+// syntax UUID in wire order and its version
+type rpcSyntax struct {
+	uuid    [16]byte
+	version uint32 // Major version in the low 16 bits, minor in the high 16 bits
+}
+
+var (
+	// srvsvcSyntax is the srvsvc interface 4b324fc8-1670-01d3-1278-5a47bf6ee188 v3.0
+	srvsvcSyntax = rpcSyntax{
+		uuid:    [16]byte{0xc8, 0x4f, 0x32, 0x4b, 0x70, 0x16, 0xd3, 0x01, 0x12, 0x78, 0x5a, 0x47, 0xbf, 0x6e, 0xe1, 0x88},
+		version: 3,
+	}
+
+	// ndrSyntax is the NDR transfer syntax 8a885d04-1ceb-11c9-9fe8-08002b104860 v2
+	ndrSyntax = rpcSyntax{
+		uuid:    [16]byte{0x04, 0x5d, 0x88, 0x8a, 0xeb, 0x1c, 0xc9, 0x11, 0x9f, 0xe8, 0x08, 0x00, 0x2b, 0x10, 0x48, 0x60},
+		version: 2,
+	}
+)
+
+// errMalformedRPC reports a DCE/RPC PDU or NDR stub that cannot be decoded
+var errMalformedRPC = errors.New("malformed DCE/RPC packet")
+
+// rpcHeader is the common header of a connection-oriented DCE/RPC PDU
+type rpcHeader struct {
+	packetType uint8
+	flags      uint8
+	fragLength uint16
+	callID     uint32
+}
+
+// parseRPCHeader parses and validates the common header of pdu
+func parseRPCHeader(pdu []byte) (rpcHeader, error) {
+	if len(pdu) < rpcHeaderSize {
+		return rpcHeader{}, errMalformedRPC
+	}
+	h := rpcHeader{
+		packetType: pdu[2],
+		flags:      pdu[3],
+		fragLength: le.Uint16(pdu[8:10]),
+		callID:     le.Uint32(pdu[12:16]),
+	}
+	if pdu[0] != 5 || pdu[1] != 0 || pdu[4] != rpcDataRepLE ||
+		int(h.fragLength) < rpcHeaderSize || int(h.fragLength) > len(pdu) {
+		return rpcHeader{}, errMalformedRPC
+	}
+	return h, nil
+}
+
+// writeRPCHeader writes a common header; the fragment length is patched by
+// finishRPCPacket
+func writeRPCHeader(w *ByteWriter, packetType, flags uint8, callID uint32) {
+	w.WriteOneByte(5) // Version
+	w.WriteOneByte(0) // VersionMinor
+	w.WriteOneByte(packetType)
+	w.WriteOneByte(flags)
+	w.WriteUint32(rpcDataRepLE) // Data representation
+	w.WriteUint16(0)            // FragLength
+	w.WriteUint16(0)            // AuthLength
+	w.WriteUint32(callID)
+}
+
+// finishRPCPacket stores the fragment length and returns the PDU
+func finishRPCPacket(w *ByteWriter) []byte {
+	w.SetUint16At(8, uint16(w.Len()))
+	return w.Bytes()
+}
+
+// buildRPCBind builds a BIND offering the srvsvc interface over NDR
+func buildRPCBind(callID uint32) []byte {
+	w := NewByteWriter(72)
+	writeRPCHeader(w, rpcPacketBind, rpcFlagFirstFrag|rpcFlagLastFrag, callID)
+	w.WriteUint16(rpcMaxFragSize) // MaxXmitFrag
+	w.WriteUint16(rpcMaxFragSize) // MaxRecvFrag
+	w.WriteUint32(0)              // AssocGroupId
+	w.WriteOneByte(1)             // NumContextItems
+	w.WriteZeros(3)
+	w.WriteUint16(0)  // ContextId
+	w.WriteOneByte(1) // NumTransferSyntaxes
+	w.WriteOneByte(0)
+	w.WriteBytes(srvsvcSyntax.uuid[:])
+	w.WriteUint32(srvsvcSyntax.version)
+	w.WriteBytes(ndrSyntax.uuid[:])
+	w.WriteUint32(ndrSyntax.version)
+	return finishRPCPacket(w)
+}
+
+// parseRPCBindAck checks that a BIND_ACK accepted the first presentation context
+func parseRPCBindAck(pdu []byte, callID uint32) error {
+	h, err := parseRPCHeader(pdu)
+	if err != nil {
+		return err
+	}
+	if h.packetType != rpcPacketBindAck || h.callID != callID {
+		return fmt.Errorf("%w: unexpected reply to BIND (type %d)", errMalformedRPC, h.packetType)
+	}
+
+	r := NewByteReader(pdu[:h.fragLength])
+	r.Skip(rpcHeaderSize + 8) // MaxXmitFrag, MaxRecvFrag, AssocGroupId
+	secAddrLen := int(r.ReadUint16())
+	r.Skip(secAddrLen)
+	r.Seek((r.Position() + 3) &^ 3)
+	if r.Remaining() < 4+24 {
+		return errMalformedRPC
+	}
+	r.Skip(4) // NumResults, padding
+	if result := r.ReadUint16(); result != rpcContextAccepted {
+		return fmt.Errorf("srvsvc presentation context rejected (result %d, reason %d)", result, r.ReadUint16())
+	}
+	return nil
+}
+
+// ndrWriter encodes NDR (transfer syntax v2) stub data
+type ndrWriter struct {
+	*ByteWriter
+	nextReferent uint32
+}
+
+func newNDRWriter(capacity int) *ndrWriter {
+	return &ndrWriter{ByteWriter: NewByteWriter(capacity), nextReferent: 0x00020000}
+}
+
+// align pads the stub to a multiple of n bytes
+func (w *ndrWriter) align(n int) {
+	if pad := w.Len() % n; pad != 0 {
+		w.WriteZeros(n - pad)
+	}
+}
+
+// writePointer writes a unique pointer's referent ID, or null if !present
+func (w *ndrWriter) writePointer(present bool) {
+	if !present {
+		w.WriteUint32(0)
+		return
+	}
+	w.WriteUint32(w.nextReferent)
+	w.nextReferent += 4
+}
+
+// writeString writes a NUL-terminated conformant varying UTF-16 string
+func (w *ndrWriter) writeString(s string) {
+	chars := utf16.Encode([]rune(s))
+	count := uint32(len(chars) + 1)
+	w.align(4)
+	w.WriteUint32(count) // MaxCount
+	w.WriteUint32(0)     // Offset
+	w.WriteUint32(count) // ActualCount
+	for _, c := range chars {
+		w.WriteUint16(c)
+	}
+	w.WriteUint16(0)
+	w.align(4)
+}
+
+// ndrReader decodes NDR stub data, failing sticky on truncated input
+type ndrReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *ndrReader) align(n int) {
+	r.pos = (r.pos + n - 1) &^ (n - 1)
+}
+
+func (r *ndrReader) uint32() uint32 {
+	r.align(4)
+	if r.err != nil || r.pos+4 > len(r.data) {
+		r.err = errMalformedRPC
+		return 0
+	}
+	v := le.Uint32(r.data[r.pos:])
+	r.pos += 4
+	return v
+}
+
+// string reads a conformant varying UTF-16 string, dropping the terminator
+func (r *ndrReader) string() string {
+	_ = r.uint32() // MaxCount
+	offset := r.uint32()
+	count := r.uint32()
+	if r.err != nil || offset != 0 || int(count) > (len(r.data)-r.pos)/2 {
+		r.err = errMalformedRPC
+		return ""
+	}
+	chars := make([]uint16, count)
+	for i := range chars {
+		chars[i] = le.Uint16(r.data[r.pos+2*i:])
+	}
+	r.pos += 2 * int(count)
+	for len(chars) > 0 && chars[len(chars)-1] == 0 {
+		chars = chars[:len(chars)-1]
+	}
+	return string(utf16.Decode(chars))
+}
+
+// srvsvcShare is one SHARE_INFO_1 entry
+type srvsvcShare struct {
+	name      string
+	shareType uint32
+	comment   string
+}
+
+// buildNetrShareEnumRequest builds the stub of a level 1 NetrShareEnum call
+func buildNetrShareEnumRequest(serverName string) []byte {
+	w := newNDRWriter(64 + 2*len(serverName))
+	w.writePointer(true) // ServerName
+	w.writeString(`\\` + serverName)
+	w.WriteUint32(1)     // InfoStruct.Level
+	w.WriteUint32(1)     // InfoStruct.ShareInfo union switch
+	w.writePointer(true) // Level1 container
+	w.WriteUint32(0)     // EntriesRead
+	w.writePointer(false)
+	w.WriteUint32(0xFFFFFFFF) // PreferedMaximumLength
+	w.writePointer(false)     // ResumeHandle
+	return w.Bytes()
+}
+
+// parseNetrShareEnumRequest returns the requested level and whether the
+// caller passed a resume handle
+func parseNetrShareEnumRequest(stub []byte) (level uint32, resume bool, err error) {
+	r := &ndrReader{data: stub}
+	if r.uint32() != 0 { // ServerName
+		_ = r.string()
+	}
+	level = r.uint32()
+	_ = r.uint32() // Union switch
+	if r.uint32() != 0 {
+		_ = r.uint32() // EntriesRead
+		if r.uint32() != 0 {
+			// Callers pass an empty container to be filled in
+			return 0, false, errMalformedRPC
+		}
+	}
+	_ = r.uint32() // PreferedMaximumLength
+	if r.uint32() != 0 {
+		_ = r.uint32()
+		resume = true
+	}
+	return level, resume, r.err
+}
+
+// buildNetrShareEnumResponse builds the stub of a NetrShareEnum reply
+// listing shares at level 1; other levels fail with ERROR_INVALID_LEVEL
+func buildNetrShareEnumResponse(level uint32, shares []srvsvcShare, resume bool) []byte {
+	w := newNDRWriter(64 + 64*len(shares))
+	w.WriteUint32(level) // InfoStruct.Level
+	w.WriteUint32(level) // Union switch
+
+	if level != 1 {
+		w.writePointer(false) // Container
+		w.WriteUint32(0)      // TotalEntries
+		w.writePointer(false) // ResumeHandle
+		w.WriteUint32(srvsvcErrorInvalidLevel)
+		return w.Bytes()
+	}
+
+	w.writePointer(true) // Level1 container
+	w.WriteUint32(uint32(len(shares)))
+	w.writePointer(len(shares) > 0)
+	if len(shares) > 0 {
+		w.WriteUint32(uint32(len(shares))) // MaxCount
+		for _, s := range shares {
+			w.writePointer(true) // shi1_netname
+			w.WriteUint32(s.shareType)
+			w.writePointer(true) // shi1_remark
+		}
+		for _, s := range shares {
+			w.writeString(s.name)
+			w.writeString(s.comment)
+		}
+	}
+	w.WriteUint32(uint32(len(shares))) // TotalEntries
+	w.writePointer(resume)
+	if resume {
+		w.WriteUint32(0)
+	}
+	w.WriteUint32(0) // WERROR
+	return w.Bytes()
+}
+
+// parseNetrShareEnumResponse decodes a level 1 NetrShareEnum reply
+func parseNetrShareEnumResponse(stub []byte) ([]srvsvcShare, error) {
+	r := &ndrReader{data: stub}
+	level := r.uint32()
+	_ = r.uint32() // Union switch
+	if r.err == nil && level != 1 {
+		return nil, errMalformedRPC
+	}
+
+	var shares []srvsvcShare
+	if r.uint32() != 0 {
+		count := r.uint32()
+		if r.uint32() != 0 {
+			if r.uint32() != count || int(count) > len(stub)/12 {
+				return nil, errMalformedRPC
+			}
+			shares = make([]srvsvcShare, count)
+			hasName := make([]bool, count)
+			hasComment := make([]bool, count)
+			for i := range shares {
+				hasName[i] = r.uint32() != 0
+				shares[i].shareType = r.uint32()
+				hasComment[i] = r.uint32() != 0
+			}
+			for i := range shares {
+				if hasName[i] {
+					shares[i].name = r.string()
+				}
+				if hasComment[i] {
+					shares[i].comment = r.string()
+				}
+			}
+		}
+	}
+	_ = r.uint32() // TotalEntries
+	if r.uint32() != 0 {
+		_ = r.uint32() // ResumeHandle
+	}
+	status := r.uint32()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if status != 0 {
+		return nil, fmt.Errorf("NetrShareEnum failed: WERROR 0x%08x", status)
+	}
+	return shares, nil
+}
+
+// buildRPCRequest builds a single-fragment REQUEST carrying stub
+func buildRPCRequest(callID uint32, opnum uint16, stub []byte) []byte {
+	w := NewByteWriter(rpcRequestHeaderSize + len(stub))
+	writeRPCHeader(w, rpcPacketRequest, rpcFlagFirstFrag|rpcFlagLastFrag, callID)
+	w.WriteUint32(uint32(len(stub))) // AllocHint
+	w.WriteUint16(0)                 // ContextId
+	w.WriteUint16(opnum)
+	w.WriteBytes(stub)
+	return finishRPCPacket(w)
+}
+
+// parseRPCResponse returns the stub carried by one RESPONSE fragment and
+// whether it is the last one
+func parseRPCResponse(pdu []byte, callID uint32) (stub []byte, last bool, err error) {
+	h, err := parseRPCHeader(pdu)
+	if err != nil {
+		return nil, false, err
+	}
+	if h.callID != callID || int(h.fragLength) < rpcRequestHeaderSize {
+		return nil, false, errMalformedRPC
+	}
+	switch h.packetType {
+	case rpcPacketResponse:
+		return pdu[rpcRequestHeaderSize:h.fragLength], h.flags&rpcFlagLastFrag != 0, nil
+	case rpcPacketFault:
+		if h.fragLength < rpcRequestHeaderSize+4 {
+			return nil, false, errMalformedRPC
+		}
+		return nil, false, fmt.Errorf("RPC fault 0x%08x", le.Uint32(pdu[rpcRequestHeaderSize:]))
+	default:
+		return nil, false, fmt.Errorf("%w: unexpected reply to REQUEST (type %d)", errMalformedRPC, h.packetType)
+	}
+}
+
+// rpcPresentationResult is the outcome of one BIND presentation context
+type rpcPresentationResult struct {
+	result, reason uint16
+	transfer       rpcSyntax
+}
+
+// parseRPCBind returns the fragment size the client can receive and the
+// result for each presentation context it proposed; only srvsvc over NDR is
+// accepted
+func parseRPCBind(pdu []byte, fragLength uint16) (maxRecvFrag uint16, contextID uint16, results []rpcPresentationResult, err error) {
+	r := NewByteReader(pdu[:fragLength])
+	r.Skip(rpcHeaderSize)
+	_ = r.ReadUint16() // MaxXmitFrag
+	maxRecvFrag = r.ReadUint16()
+	_ = r.ReadUint32() // AssocGroupId
+	numContexts := int(r.ReadOneByte())
+	r.Skip(3)
+
+	for i := 0; i < numContexts; i++ {
+		if r.Remaining() < 24 {
+			return 0, 0, nil, errMalformedRPC
+		}
+		id := r.ReadUint16()
+		numTransfers := int(r.ReadOneByte())
+		r.Skip(1)
+		var abstract rpcSyntax
+		copy(abstract.uuid[:], r.ReadBytes(16))
+		abstract.version = r.ReadUint32()
+		if r.Remaining() < 20*numTransfers {
+			return 0, 0, nil, errMalformedRPC
+		}
+
+		res := rpcPresentationResult{result: rpcContextProviderRejected, reason: rpcReasonAbstractSyntaxNotSupported}
+		for j := 0; j < numTransfers; j++ {
+			var transfer rpcSyntax
+			copy(transfer.uuid[:], r.ReadBytes(16))
+			transfer.version = r.ReadUint32()
+			if abstract == srvsvcSyntax && transfer == ndrSyntax && res.result != rpcContextAccepted {
+				res = rpcPresentationResult{result: rpcContextAccepted, transfer: ndrSyntax}
+				contextID = id
+			}
+		}
+		results = append(results, res)
+	}
+	return maxRecvFrag, contextID, results, nil
+}
+
+// buildRPCBindAck builds the BIND_ACK for a bind to the named pipe
+func buildRPCBindAck(callID uint32, maxXmitFrag uint16, pipeName string, results []rpcPresentationResult) []byte {
+	w := NewByteWriter(64 + 24*len(results))
+	writeRPCHeader(w, rpcPacketBindAck, rpcFlagFirstFrag|rpcFlagLastFrag, callID)
+	w.WriteUint16(maxXmitFrag)
+	w.WriteUint16(rpcMaxFragSize) // MaxRecvFrag
+	w.WriteUint32(0x12345)        // AssocGroupId
+
+	secAddr := `\PIPE\` + pipeName + "\x00"
+	w.WriteUint16(uint16(len(secAddr)))
+	w.WriteBytes([]byte(secAddr))
+	if pad := w.Len() % 4; pad != 0 {
+		w.WriteZeros(4 - pad)
+	}
+
+	w.WriteOneByte(uint8(len(results)))
+	w.WriteZeros(3)
+	for _, res := range results {
+		w.WriteUint16(res.result)
+		w.WriteUint16(res.reason)
+		w.WriteBytes(res.transfer.uuid[:])
+		w.WriteUint32(res.transfer.version)
+	}
+	return finishRPCPacket(w)
+}
+
+// buildRPCResponses splits stub across RESPONSE fragments of at most
+// maxFrag bytes
+func buildRPCResponses(callID uint32, contextID uint16, stub []byte, maxFrag int) [][]byte {
+	chunk := (maxFrag - rpcRequestHeaderSize) &^ 7
+	var pdus [][]byte
+	for first := true; first || len(stub) > 0; first = false {
+		n := min(chunk, len(stub))
+		var flags uint8
+		if first {
+			flags |= rpcFlagFirstFrag
+		}
+		if n == len(stub) {
+			flags |= rpcFlagLastFrag
+		}
+
+		w := NewByteWriter(rpcRequestHeaderSize + n)
+		writeRPCHeader(w, rpcPacketResponse, flags, callID)
+		w.WriteUint32(uint32(len(stub))) // AllocHint
+		w.WriteUint16(contextID)
+		w.WriteOneByte(0) // CancelCount
+		w.WriteOneByte(0) // Reserved
+		w.WriteBytes(stub[:n])
+		pdus = append(pdus, finishRPCPacket(w))
+		stub = stub[n:]
+	}
+	return pdus
+}
+
+// buildRPCFault builds a FAULT reporting status for a call
+func buildRPCFault(callID uint32, contextID uint16, status uint32) []byte {
+	w := NewByteWriter(rpcRequestHeaderSize + 8)
+	writeRPCHeader(w, rpcPacketFault, rpcFlagFirstFrag|rpcFlagLastFrag, callID)
+	w.WriteUint32(0) // AllocHint
+	w.WriteUint16(contextID)
+	w.WriteOneByte(0) // CancelCount
+	w.WriteOneByte(0) // Reserved
+	w.WriteUint32(status)
+	w.WriteUint32(0) // Reserved
+	return finishRPCPacket(w)
+}
@@ -0,0 +1,64 @@
+package smbfs
+
+import (
+	"io/fs"
+)
+
+// StreamFS is implemented by filesystems whose files can carry named
+// (alternate) data streams. Shares backed by one list the streams in
+// FileStreamInformation alongside the unnamed data stream
+type StreamFS interface {
+	// Streams returns the named streams of the file at name, not including
+	// its unnamed data stream
+	Streams(name string) ([]StreamInfo, error)
+}
+
+// StreamInfo describes a named data stream of a file
+type StreamInfo struct {
+	Name string // Stream name without the leading colon or ":$DATA" suffix
+	Size int64  // Stream size in bytes
+}
+
+// defaultStreamName is the name of a file's unnamed data stream
+const defaultStreamName = "::$DATA"
+
+// buildFileStreamInformation creates a FileStreamInformation response
+// (MS-FSCC 2.4.43): the unnamed data stream of a file, then its named
+// streams when the filesystem implements StreamFS. Directories have no
+// unnamed data stream
+func (s *Share) buildFileStreamInformation(name string, info fs.FileInfo) []byte {
+	type stream struct {
+		name       string
+		size       uint64
+		allocation uint64
+	}
+	var streams []stream
+	if !info.IsDir() {
+		streams = append(streams, stream{defaultStreamName, uint64(info.Size()), s.allocationSize(name, info)})
+	}
+	if sfs, ok := s.FileSystem().(StreamFS); ok {
+		if named, err := sfs.Streams(name); err == nil {
+			for _, st := range named {
+				size := uint64(max(st.Size, 0))
+				streams = append(streams, stream{":" + st.Name + ":$DATA", size, roundAllocation(size)})
+			}
+		}
+	}
+
+	w := NewByteWriter(64 * len(streams))
+	for i, st := range streams {
+		start := w.Len()
+		streamName := EncodeStringToUTF16LE(st.name)
+		w.WriteUint32(0)                       // NextEntryOffset (patched below)
+		w.WriteUint32(uint32(len(streamName))) // StreamNameLength
+		w.WriteUint64(st.size)                 // StreamSize
+		w.WriteUint64(st.allocation)           // StreamAllocationSize
+		w.WriteBytes(streamName)               // StreamName
+		if i < len(streams)-1 {
+			// Entries are 8-byte aligned
+			w.WritePadTo8()
+			w.SetUint32At(start, uint32(w.Len()-start))
+		}
+	}
+	return w.Bytes()
+}
@@ -0,0 +1,151 @@
+package smbfs
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stallingProxy is a stub server that relays connections to a real one
+// until it is told to stall, after which requests get no answer, as from a
+// server that has hung
+type stallingProxy struct {
+	l       net.Listener
+	target  string
+	stalled atomic.Bool
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+// startStallingProxy starts a proxy for the server at target
+func startStallingProxy(t *testing.T, target string) *stallingProxy {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	p := &stallingProxy{l: l, target: target}
+	t.Cleanup(p.close)
+	go p.serve()
+	return p
+}
+
+func (p *stallingProxy) serve() {
+	for {
+		client, err := p.l.Accept()
+		if err != nil {
+			return
+		}
+		server, err := net.Dial("tcp", p.target)
+		if err != nil {
+			client.Close()
+			continue
+		}
+		p.mu.Lock()
+		p.conns = append(p.conns, client, server)
+		p.mu.Unlock()
+
+		go io.Copy(server, client)
+		go p.relayResponses(client, server)
+	}
+}
+
+// relayResponses copies responses to the client until the proxy stalls,
+// then swallows them
+func (p *stallingProxy) relayResponses(client, server net.Conn) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := server.Read(buf)
+		if n > 0 && !p.stalled.Load() {
+			client.Write(buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// port returns the port the proxy listens on
+func (p *stallingProxy) port() int {
+	return p.l.Addr().(*net.TCPAddr).Port
+}
+
+func (p *stallingProxy) close() {
+	p.l.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+}
+
+// TestOpTimeout_HungServer tests that operations on a server that stops
+// answering fail within OpTimeout, that the connection is then replaced,
+// and that a connection idle for longer than OpTimeout is still usable
+func TestOpTimeout_HungServer(t *testing.T) {
+	const opTimeout = 200 * time.Millisecond
+
+	srv, config := startLoopbackServer(t, ServerOptions{})
+	proxy := startStallingProxy(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(srv.options.Port)))
+
+	cfg := *config
+	cfg.Port = proxy.port()
+	cfg.OpTimeout = opTimeout
+	cfg.RetryPolicy = &RetryPolicy{MaxAttempts: 1}
+	fsys, err := New(&cfg)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	if _, err := fsys.Stat("/hello.txt"); err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	f, err := fsys.Open("/hello.txt")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer f.Close()
+
+	// The deadline of one operation does not carry over to the next
+	time.Sleep(2 * opTimeout)
+	if _, err := fsys.Stat("/hello.txt"); err != nil {
+		t.Fatalf("Stat() after idling past OpTimeout error = %v", err)
+	}
+	if _, err := f.Stat(); err != nil {
+		t.Fatalf("File.Stat() after idling past OpTimeout error = %v", err)
+	}
+
+	proxy.stalled.Store(true)
+	timed := func(name string, op func() error) {
+		t.Helper()
+		start := time.Now()
+		err := op()
+		elapsed := time.Since(start)
+		if err == nil {
+			t.Errorf("%s on a hung server succeeded", name)
+		}
+		if elapsed > 5*opTimeout {
+			t.Errorf("%s on a hung server took %v, want about %v", name, elapsed, opTimeout)
+		}
+	}
+	timed("Stat()", func() error {
+		_, err := fsys.Stat("/hello.txt")
+		return err
+	})
+	timed("Read()", func() error {
+		_, err := f.Read(make([]byte, 5))
+		return err
+	})
+
+	// Connections that timed out are not reused
+	proxy.stalled.Store(false)
+	if _, err := fsys.Stat("/hello.txt"); err != nil {
+		t.Errorf("Stat() after the server recovered error = %v", err)
+	}
+}
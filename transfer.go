@@ -0,0 +1,182 @@
+package smbfs
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// DefaultTransferChunkSize is the read/write size used by transfers when
+// TransferOptions.ChunkSize is not set.
+const DefaultTransferChunkSize = 1 << 20
+
+// TransferOptions controls Upload, Download and CopyFile.
+type TransferOptions struct {
+	// Context cancels the transfer, aborting the in-flight read or write.
+	// Defaults to the filesystem's context.
+	Context context.Context
+
+	// Progress, if set, is called after each chunk with the bytes
+	// transferred so far and the total size (-1 if unknown). It is called
+	// from the transferring goroutine with no locks held.
+	Progress func(bytesDone, total int64)
+
+	// ChunkSize is the size of each read and write (default: 1 MiB).
+	ChunkSize int
+}
+
+// Upload copies r to the named file, creating or truncating it, and returns
+// the number of bytes written. If the transfer fails or is cancelled, the
+// partial file is removed and the bytes written before the failure are
+// returned along with the error (ctx.Err() on cancellation).
+func (fsys *FileSystem) Upload(r io.Reader, name string, opts TransferOptions) (int64, error) {
+	ctx := fsys.transferContext(opts)
+
+	f, err := fsys.OpenFileContext(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := transfer(ctx, f, r, readerSize(r), opts)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = fsys.Remove(name)
+		return n, err
+	}
+	return n, nil
+}
+
+// Download copies the named file to w and returns the number of bytes
+// written. On failure or cancellation it returns the bytes written to w so
+// far along with the error (ctx.Err() on cancellation).
+func (fsys *FileSystem) Download(name string, w io.Writer, opts TransferOptions) (int64, error) {
+	ctx := fsys.transferContext(opts)
+
+	f, err := fsys.OpenFileContext(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return transfer(ctx, w, f, readerSize(f), opts)
+}
+
+// CopyFile copies the file src to dst on the share, creating or truncating
+// dst, and returns the number of bytes copied. A partially written dst is
+// removed if the copy fails or is cancelled.
+//
+// Without a Context or Progress callback in opts the server copies the data
+// itself (FSCTL_SRV_COPYCHUNK) when it supports it, so it never passes
+// through the client; otherwise the file is streamed in chunks.
+func (fsys *FileSystem) CopyFile(src, dst string, opts TransferOptions) (int64, error) {
+	if opts.Context == nil && opts.Progress == nil {
+		if n, ok, err := fsys.serverCopy(src, dst); ok {
+			return n, err
+		}
+	}
+
+	ctx := fsys.transferContext(opts)
+
+	in, err := fsys.OpenFileContext(ctx, src, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	return fsys.Upload(in, dst, opts)
+}
+
+// serverCopy copies src to dst with a share-side copy. ok is false if the
+// share cannot copy files itself.
+func (fsys *FileSystem) serverCopy(src, dst string) (n int64, ok bool, err error) {
+	for _, name := range []string{src, dst} {
+		if err := validatePath(name); err != nil {
+			return 0, true, wrapPathError("copy", name, err)
+		}
+	}
+	src = fsys.pathNorm.normalize(src)
+	dst = fsys.pathNorm.normalize(dst)
+
+	conn, err := fsys.pool.get(fsys.ctx)
+	if err != nil {
+		return 0, true, wrapPathError("copy", src, err)
+	}
+	defer fsys.pool.put(conn)
+
+	copier, ok := conn.share.(interface {
+		CopyFile(src, dst string) (int64, error)
+	})
+	if !ok {
+		return 0, false, nil
+	}
+
+	n, err = copier.CopyFile(toSMBPath(src), toSMBPath(dst))
+	fsys.cache.invalidate(dst)
+	if err != nil {
+		return n, true, wrapPathError("copy", src, convertError(err))
+	}
+	return n, true, nil
+}
+
+// transferContext returns the context a transfer runs under.
+func (fsys *FileSystem) transferContext(opts TransferOptions) context.Context {
+	if opts.Context != nil {
+		return opts.Context
+	}
+	return fsys.ctx
+}
+
+// transfer copies src to dst in chunks, checking ctx between chunks and
+// reporting progress after each one.
+func transfer(ctx context.Context, dst io.Writer, src io.Reader, total int64, opts TransferOptions) (int64, error) {
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultTransferChunkSize
+	}
+	buf := make([]byte, chunkSize)
+
+	var done int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return done, err
+		}
+
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			nw, werr := dst.Write(buf[:nr])
+			done += int64(nw)
+			if werr == nil && nw < nr {
+				werr = io.ErrShortWrite
+			}
+			if werr != nil {
+				return done, contextError(ctx, werr)
+			}
+			if opts.Progress != nil {
+				opts.Progress(done, total)
+			}
+		}
+
+		if rerr == io.EOF {
+			return done, nil
+		}
+		if rerr != nil {
+			return done, contextError(ctx, rerr)
+		}
+	}
+}
+
+// readerSize returns the size of r if it is known, or -1.
+func readerSize(r io.Reader) int64 {
+	switch v := r.(type) {
+	case interface{ Len() int }:
+		return int64(v.Len())
+	case interface{ Stat() (fs.FileInfo, error) }:
+		if info, err := v.Stat(); err == nil && info.Mode().IsRegular() {
+			return info.Size()
+		}
+	}
+	return -1
+}
@@ -0,0 +1,398 @@
+package smbfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+// progressRecorder records progress callbacks and checks they are monotonic
+type progressRecorder struct {
+	t      *testing.T
+	calls  int
+	last   int64
+	total  int64
+	onCall func(done int64)
+}
+
+func (p *progressRecorder) record(done, total int64) {
+	p.t.Helper()
+	if done < p.last {
+		p.t.Errorf("progress went backwards: %d after %d", done, p.last)
+	}
+	if p.calls > 0 && total != p.total {
+		p.t.Errorf("progress total changed from %d to %d", p.total, total)
+	}
+	p.calls++
+	p.last, p.total = done, total
+	if p.onCall != nil {
+		p.onCall(done)
+	}
+}
+
+func randomData(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+// TestTransfer_UploadDownload tests complete transfers in both directions
+func TestTransfer_UploadDownload(t *testing.T) {
+	_, config := startLoopbackServer(t, ServerOptions{})
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	data := randomData(t, 1<<20+123)
+	opts := TransferOptions{ChunkSize: 64 << 10}
+
+	up := &progressRecorder{t: t}
+	opts.Progress = up.record
+	n, err := fsys.Upload(bytes.NewReader(data), "/big.bin", opts)
+	if err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+	if n != int64(len(data)) || up.last != n || up.total != n {
+		t.Errorf("Upload() = %d, last progress %d/%d, want %d", n, up.last, up.total, len(data))
+	}
+
+	var out bytes.Buffer
+	down := &progressRecorder{t: t}
+	opts.Progress = down.record
+	if n, err = fsys.Download("/big.bin", &out, opts); err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if n != int64(len(data)) || !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("Download() = %d bytes, content match %v", n, bytes.Equal(out.Bytes(), data))
+	}
+	if down.total != int64(len(data)) {
+		t.Errorf("Download() progress total = %d, want %d", down.total, len(data))
+	}
+
+	opts.Progress = nil
+	if n, err = fsys.CopyFile("/big.bin", "/copy.bin", opts); err != nil || n != int64(len(data)) {
+		t.Fatalf("CopyFile() = %d, %v", n, err)
+	}
+	got, err := fsys.ReadFile("/copy.bin")
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("ReadFile(copy) error = %v, content match %v", err, bytes.Equal(got, data))
+	}
+}
+
+// TestTransfer_CancelHalfway tests cancelling transfers from the progress
+// callback: they stop at the next chunk with the bytes done so far, and a
+// cancelled upload leaves no partial file
+func TestTransfer_CancelHalfway(t *testing.T) {
+	_, config := startLoopbackServer(t, ServerOptions{})
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	data := randomData(t, 4<<20)
+	if _, err := fsys.Upload(bytes.NewReader(data), "/big.bin", TransferOptions{}); err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+
+	half := int64(len(data) / 2)
+	for _, dir := range []string{"download", "upload"} {
+		t.Run(dir, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var cancelledAt int64
+			rec := &progressRecorder{t: t, onCall: func(done int64) {
+				if done >= half && cancelledAt == 0 {
+					cancelledAt = done
+					cancel()
+				}
+			}}
+			opts := TransferOptions{Context: ctx, Progress: rec.record, ChunkSize: 64 << 10}
+
+			var out bytes.Buffer
+			var n int64
+			var err error
+			if dir == "download" {
+				n, err = fsys.Download("/big.bin", &out, opts)
+			} else {
+				n, err = fsys.Upload(bytes.NewReader(data), "/partial.bin", opts)
+			}
+
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("%s error = %v, want context.Canceled", dir, err)
+			}
+			if n != cancelledAt || rec.last != cancelledAt {
+				t.Errorf("%s bytes done = %d (last progress %d), want %d", dir, n, rec.last, cancelledAt)
+			}
+			if n >= int64(len(data)) {
+				t.Errorf("%s completed (%d bytes) despite cancellation", dir, n)
+			}
+
+			if dir == "download" {
+				if int64(out.Len()) != n || !bytes.Equal(out.Bytes(), data[:n]) {
+					t.Errorf("downloaded %d bytes, want the first %d of the file", out.Len(), n)
+				}
+			} else if _, err := fsys.Stat("/partial.bin"); err == nil {
+				t.Error("partial upload left behind after cancellation")
+			}
+		})
+	}
+}
+
+// TestTransfer_CancelInFlight tests that cancelling the context of a file
+// opened with OpenFileContext aborts a read the server has not answered,
+// and that the file can still be closed afterwards
+func TestTransfer_CancelInFlight(t *testing.T) {
+	const stall = 2 * time.Second
+	_, config := startLoopbackServer(t, ServerOptions{
+		EnableChaos: true,
+		Chaos: &ChaosConfig{Faults: map[uint16]ChaosFault{
+			SMB2_READ: {Delay: stall, Count: 1},
+		}},
+	})
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	f, err := fsys.OpenFileContext(ctx, "/hello.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFileContext() error = %v", err)
+	}
+
+	start := time.Now()
+	var out bytes.Buffer
+	n, err := transfer(ctx, &out, f, -1, TransferOptions{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("transfer() error = %v, want context.DeadlineExceeded", err)
+	}
+	if n != 0 {
+		t.Errorf("transfer() bytes done = %d, want 0", n)
+	}
+	if elapsed := time.Since(start); elapsed >= stall {
+		t.Errorf("read returned after %v, not before the stalled READ completed", elapsed)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Errorf("Close() after cancellation error = %v", err)
+	}
+	got, err := fsys.ReadFile("/hello.txt")
+	if err != nil || string(got) != "hello" {
+		t.Errorf("ReadFile() after cancelled read = %q, %v", got, err)
+	}
+}
+
+// TestFile_ReadContext tests that a read aborted by its own context leaves
+// the file usable at the same offset, and that requests bound to another
+// context still end with the context the file was opened with
+func TestFile_ReadContext(t *testing.T) {
+	const stall = 2 * time.Second
+	_, config := startLoopbackServer(t, ServerOptions{
+		EnableChaos: true,
+		Chaos: &ChaosConfig{Faults: map[uint16]ChaosFault{
+			SMB2_READ: {Delay: stall, Count: 1},
+		}},
+	})
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	openCtx, cancelOpen := context.WithCancel(context.Background())
+	defer cancelOpen()
+	file, err := fsys.OpenFileContext(openCtx, "/hello.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFileContext() error = %v", err)
+	}
+	f := file.(*File)
+	defer f.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := f.ReadContext(ctx, make([]byte, 2)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ReadContext() error = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed >= stall {
+		t.Errorf("ReadContext() returned after %v, not before the stalled READ completed", elapsed)
+	}
+
+	buf := make([]byte, 2)
+	if n, err := f.ReadContext(context.Background(), buf); err != nil || string(buf[:n]) != "he" {
+		t.Fatalf("ReadContext() after an aborted read = %q, %v, want \"he\"", buf[:n], err)
+	}
+	buf = make([]byte, 3)
+	if n, err := f.Read(buf); err != nil || string(buf[:n]) != "llo" {
+		t.Fatalf("Read() after ReadContext() = %q, %v, want \"llo\"", buf[:n], err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek() error = %v", err)
+	}
+	cancelOpen()
+	if _, err := f.ReadContext(context.Background(), buf); !errors.Is(err, context.Canceled) {
+		t.Errorf("ReadContext() after the open's context was cancelled error = %v, want context.Canceled", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("Close() after the open's context was cancelled error = %v", err)
+	}
+}
+
+// TestCopyFile_ServerSide tests that CopyFile has the server copy the data:
+// every READ fails, so the copy only succeeds if no data passes through the
+// client
+func TestCopyFile_ServerSide(t *testing.T) {
+	srv, config := startLoopbackServer(t, ServerOptions{
+		EnableChaos: true,
+		Chaos: &ChaosConfig{Faults: map[uint16]ChaosFault{
+			SMB2_READ: {Status: STATUS_ACCESS_DENIED},
+		}},
+	})
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	data := randomData(t, 3<<20+17)
+	if _, err := fsys.Upload(bytes.NewReader(data), "/big.bin", TransferOptions{}); err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+
+	n, err := fsys.CopyFile("/big.bin", "/copy.bin", TransferOptions{})
+	if err != nil {
+		t.Fatalf("CopyFile() error = %v", err)
+	}
+	if n != int64(len(data)) {
+		t.Errorf("CopyFile() = %d, want %d", n, len(data))
+	}
+
+	f, err := srv.GetShare("data").fs.Open("/copy.bin")
+	if err != nil {
+		t.Fatalf("Open(copy) on server error = %v", err)
+	}
+	defer f.Close()
+	got := make([]byte, len(data)+1)
+	m, _ := f.ReadAt(got, 0)
+	if m != len(data) || !bytes.Equal(got[:m], data) {
+		t.Errorf("server copy holds %d bytes, content match %v", m, bytes.Equal(got[:m], data))
+	}
+
+	// With a progress callback the copy is streamed, so it now fails
+	opts := TransferOptions{Progress: func(int64, int64) {}}
+	if _, err := fsys.CopyFile("/big.bin", "/copy2.bin", opts); err == nil {
+		t.Error("streamed CopyFile() succeeded with every READ failing")
+	}
+}
+
+// TestFile_ReadFromWriteTo tests that io.Copy into and out of a File uses
+// the buffer sizes from the config rather than io.Copy's own
+func TestFile_ReadFromWriteTo(t *testing.T) {
+	srv, config := startLoopbackServer(t, ServerOptions{})
+	config.ReadBufferSize = 1 << 20
+	config.WriteBufferSize = 1 << 20
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+	data := randomData(t, 4<<20+100)
+
+	// copyCount runs copyFn and returns the requests of command it took
+	copyCount := func(command uint16, copyFn func() (int64, error)) uint64 {
+		t.Helper()
+		before := srv.Metrics().Commands[command]
+		n, err := copyFn()
+		if err != nil || n != int64(len(data)) {
+			t.Fatalf("Copy() = %d, %v, want %d", n, err, len(data))
+		}
+		return srv.Metrics().Commands[command] - before
+	}
+	// The wrappers hide io.ReaderFrom and io.WriterTo, as well as
+	// bytes.Reader's WriteTo, giving io.Copy's plain 32KB loop
+	type reader struct{ io.Reader }
+	type writer struct{ io.Writer }
+
+	upload := func(name string, naive bool) uint64 {
+		t.Helper()
+		f, err := fsys.Create(name)
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+		defer f.Close()
+		return copyCount(SMB2_WRITE, func() (int64, error) {
+			if naive {
+				return io.Copy(writer{f}, reader{bytes.NewReader(data)})
+			}
+			return io.Copy(f, reader{bytes.NewReader(data)})
+		})
+	}
+	download := func(name string, naive bool) uint64 {
+		t.Helper()
+		f, err := fsys.Open(name)
+		if err != nil {
+			t.Fatalf("Open() error = %v", err)
+		}
+		defer f.Close()
+		var out bytes.Buffer
+		count := copyCount(SMB2_READ, func() (int64, error) {
+			if naive {
+				return io.Copy(writer{&out}, reader{f})
+			}
+			return io.Copy(&out, f)
+		})
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Errorf("%s downloaded %d bytes differing from the %d uploaded", name, out.Len(), len(data))
+		}
+		return count
+	}
+
+	naiveWrites := upload("/naive.bin", true)
+	fastWrites := upload("/fast.bin", false)
+	if fastWrites != 5 || fastWrites >= naiveWrites {
+		t.Errorf("ReadFrom took %d writes and the naive copy %d, want 5 and more", fastWrites, naiveWrites)
+	}
+
+	naiveReads := download("/naive.bin", true)
+	fastReads := download("/fast.bin", false)
+	if fastReads >= naiveReads {
+		t.Errorf("WriteTo took %d reads and the naive copy %d, want fewer", fastReads, naiveReads)
+	}
+
+	// The file offset follows the data copied
+	f, err := fsys.OpenFile("/fast.bin", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	defer f.Close()
+	if _, err := io.CopyN(io.Discard, f, 1000); err != nil {
+		t.Fatalf("CopyN() error = %v", err)
+	}
+	if n, err := f.(*File).WriteTo(io.Discard); err != nil || n != int64(len(data)-1000) {
+		t.Errorf("WriteTo() after 1000 bytes = %d, %v, want %d", n, err, len(data)-1000)
+	}
+	if n, err := f.(*File).ReadFrom(bytes.NewReader([]byte("tail"))); err != nil || n != 4 {
+		t.Errorf("ReadFrom() at EOF = %d, %v, want 4", n, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if info.Size() != int64(len(data)+4) {
+		t.Errorf("size after ReadFrom at EOF = %d, want %d", info.Size(), len(data)+4)
+	}
+}
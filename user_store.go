@@ -0,0 +1,71 @@
+package smbfs
+
+import (
+	"strings"
+
+	"golang.org/x/crypto/md4"
+)
+
+// UserStore supplies the credentials NTLM logons are checked against. NTLM
+// only needs the NT hash of a user's password (MD4 of its UTF-16LE
+// encoding), so a store can keep hashes at rest instead of passwords
+type UserStore interface {
+	// NTHash returns the 16-byte NT hash of username's password, or false
+	// if there is no such user. Usernames should match without regard to
+	// case, as Windows usernames do
+	NTHash(username string) ([]byte, bool)
+}
+
+// PasswordUsers is a UserStore of plaintext passwords, keyed by username
+type PasswordUsers map[string]string
+
+// NTHash hashes the password of username
+func (u PasswordUsers) NTHash(username string) ([]byte, bool) {
+	password, ok := u[username]
+	if !ok {
+		for name, p := range u {
+			if strings.EqualFold(name, username) {
+				password, ok = p, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return nil, false
+	}
+	return NTPasswordHash(password), true
+}
+
+// NTHashUsers is a UserStore of NT hashes, keyed by username. Hashes can be
+// computed with NTPasswordHash
+type NTHashUsers map[string][]byte
+
+// NTHash returns the stored hash of username
+func (u NTHashUsers) NTHash(username string) ([]byte, bool) {
+	if hash, ok := u[username]; ok {
+		return hash, true
+	}
+	for name, hash := range u {
+		if strings.EqualFold(name, username) {
+			return hash, true
+		}
+	}
+	return nil, false
+}
+
+// NTPasswordHash computes the NT hash of password (MD4 of its UTF-16LE
+// encoding), the form a UserStore returns
+func NTPasswordHash(password string) []byte {
+	h := md4.New()
+	h.Write(EncodeStringToUTF16LE(password))
+	return h.Sum(nil)
+}
+
+// userStore returns the store logons are checked against: UserStore if set,
+// otherwise the plaintext Users
+func (o *ServerOptions) userStore() UserStore {
+	if o.UserStore != nil {
+		return o.UserStore
+	}
+	return PasswordUsers(o.Users)
+}
@@ -0,0 +1,198 @@
+package smbfs
+
+import (
+	"context"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// walkPrefetch is the most subdirectory listings WalkDir keeps ahead of the
+// walk, counting those still being read and those read but not yet walked.
+const walkPrefetch = 4
+
+// WalkDir walks the file tree rooted at root, calling fn for each file or
+// directory in the tree, including root, as fs.WalkDir does: in lexical
+// order, with the same handling of fs.SkipDir, fs.SkipAll and errors.
+//
+// The entries passed to fn carry the file information returned by their
+// directory's listing, so walking a tree takes one listing per directory
+// and no request per file. While fn runs, the listings of the
+// subdirectories it will visit next are read in the background, a few at
+// a time, so their round trips overlap.
+func (fsys *FileSystem) WalkDir(root string, fn fs.WalkDirFunc) error {
+	info, err := fsys.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		w := newDirWalker(fsys)
+		defer w.close()
+		err = w.walk(root, fs.FileInfoToDirEntry(info), fn)
+	}
+	if err == fs.SkipDir || err == fs.SkipAll {
+		return nil
+	}
+	return err
+}
+
+// dirWalker reads directory listings for WalkDir, some of them ahead of
+// time.
+type dirWalker struct {
+	fsys   *FileSystem
+	ctx    context.Context
+	cancel context.CancelFunc
+	slots  chan struct{} // One token per listing kept ahead of the walk
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	pending map[string]*dirListing // Listings read ahead, by directory
+}
+
+// dirListing is a directory listing read ahead of the walk.
+type dirListing struct {
+	entries   []fs.DirEntry
+	err       error
+	done      chan struct{}
+	forgotten bool // The walk will not use it; release its slot when done
+}
+
+func newDirWalker(fsys *FileSystem) *dirWalker {
+	ctx, cancel := context.WithCancel(fsys.ctx)
+	return &dirWalker{
+		fsys:    fsys,
+		ctx:     ctx,
+		cancel:  cancel,
+		slots:   make(chan struct{}, walkPrefetch),
+		pending: make(map[string]*dirListing),
+	}
+}
+
+// close abandons the listings still being read and waits for them.
+func (w *dirWalker) close() {
+	w.cancel()
+	w.wg.Wait()
+}
+
+// walk mirrors the recursion of fs.WalkDir.
+func (w *dirWalker) walk(name string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(name, d, nil); err != nil || !d.IsDir() {
+		if err == fs.SkipDir && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+
+	entries, err := w.list(name)
+	if err != nil {
+		err = fn(name, d, err)
+		if err != nil {
+			if err == fs.SkipDir && d.IsDir() {
+				err = nil
+			}
+			return err
+		}
+	}
+
+	// Subdirectories left unvisited after SkipDir or an error give up
+	// their slots
+	defer func() {
+		for _, e := range entries {
+			if e.IsDir() {
+				w.forget(path.Join(name, e.Name()))
+			}
+		}
+	}()
+	for _, e := range entries {
+		if e.IsDir() {
+			w.prefetch(path.Join(name, e.Name()))
+		}
+	}
+
+	for _, e := range entries {
+		if err := w.walk(path.Join(name, e.Name()), e, fn); err != nil {
+			if err == fs.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// readDir lists a directory sorted by name, as fs.ReadDir does.
+func (w *dirWalker) readDir(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	entries, err := w.fsys.ReadDirContext(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	// The listing may be the cache's own slice
+	entries = slices.Clone(entries)
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
+
+// prefetch starts reading the listing of name if a slot is free.
+func (w *dirWalker) prefetch(name string) {
+	select {
+	case w.slots <- struct{}{}:
+	default:
+		return
+	}
+
+	l := &dirListing{done: make(chan struct{})}
+	w.mu.Lock()
+	w.pending[name] = l
+	w.mu.Unlock()
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		entries, err := w.readDir(w.ctx, name)
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		l.entries, l.err = entries, err
+		close(l.done)
+		if l.forgotten {
+			<-w.slots
+		}
+	}()
+}
+
+// list returns the listing of name, read ahead or read now.
+func (w *dirWalker) list(name string) ([]fs.DirEntry, error) {
+	w.mu.Lock()
+	l := w.pending[name]
+	delete(w.pending, name)
+	w.mu.Unlock()
+
+	if l == nil {
+		return w.readDir(w.fsys.ctx, name)
+	}
+	<-l.done
+	<-w.slots
+	return l.entries, l.err
+}
+
+// forget drops the listing of name, if it was read ahead, freeing its
+// slot once it has been read.
+func (w *dirWalker) forget(name string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	l := w.pending[name]
+	if l == nil {
+		return
+	}
+	delete(w.pending, name)
+	select {
+	case <-l.done:
+		<-w.slots
+	default:
+		l.forgotten = true
+	}
+}
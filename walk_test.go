@@ -0,0 +1,135 @@
+package smbfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// walkRecord is what a WalkDirFunc saw of one entry
+type walkRecord struct {
+	path  string
+	isDir bool
+	size  int64
+}
+
+// recordWalk returns a WalkDirFunc appending to records, which skips the
+// directories in skip
+func recordWalk(t *testing.T, records *[]walkRecord, skip map[string]bool) fs.WalkDirFunc {
+	return func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			t.Errorf("WalkDirFunc(%s) error = %v", p, err)
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			t.Errorf("Info(%s) error = %v", p, err)
+			return err
+		}
+		r := walkRecord{path: p, isDir: d.IsDir()}
+		if !r.isDir {
+			r.size = info.Size()
+		}
+		*records = append(*records, r)
+		if skip[p] {
+			return fs.SkipDir
+		}
+		return nil
+	}
+}
+
+// TestFileSystem_WalkDir tests that WalkDir visits what fs.WalkDir does,
+// in the same order, with one listing per directory and no per-file stats
+func TestFileSystem_WalkDir(t *testing.T) {
+	const dirs, filesPerDir = 12, 5
+
+	srv, config := startLoopbackServer(t, ServerOptions{})
+	mfs := srv.GetShare("data").fs
+	for i := 0; i < dirs; i++ {
+		dir := fmt.Sprintf("/tree/d%02d", i)
+		if i%3 == 2 {
+			dir = fmt.Sprintf("/tree/d%02d/nested", i-1)
+		}
+		if err := mfs.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("MkdirAll(%s) error = %v", dir, err)
+		}
+		for j := 0; j < filesPerDir; j++ {
+			writeShareFile(t, srv, fmt.Sprintf("%s/f%d.txt", dir, j), make([]byte, i*10+j))
+		}
+	}
+	if err := mfs.Mkdir("/tree/empty", 0755); err != nil {
+		t.Fatalf("Mkdir() error = %v", err)
+	}
+
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	sub, err := fsys.Sub("/")
+	if err != nil {
+		t.Fatalf("Sub() error = %v", err)
+	}
+	var want []walkRecord
+	if err := fs.WalkDir(sub, "tree", recordWalk(t, &want, nil)); err != nil {
+		t.Fatalf("fs.WalkDir() error = %v", err)
+	}
+	for i := range want {
+		want[i].path = "/" + want[i].path
+	}
+
+	before := srv.Metrics().Commands
+	var got []walkRecord
+	if err := fsys.WalkDir("/tree", recordWalk(t, &got, nil)); err != nil {
+		t.Fatalf("WalkDir() error = %v", err)
+	}
+	after := srv.Metrics().Commands
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("WalkDir() visited\n%v\nwant\n%v", got, want)
+	}
+
+	// One open per directory listed, plus the stat of the root
+	directories := 0
+	for _, r := range want {
+		if r.isDir {
+			directories++
+		}
+	}
+	if creates := after[SMB2_CREATE] - before[SMB2_CREATE]; creates > uint64(directories+1) {
+		t.Errorf("WalkDir() sent %d CREATEs for %d directories", creates, directories)
+	}
+
+	// SkipDir leaves a directory's contents out, and SkipAll ends the walk
+	got = nil
+	if err := fsys.WalkDir("/tree", recordWalk(t, &got, map[string]bool{"/tree/d01": true})); err != nil {
+		t.Fatalf("WalkDir() with SkipDir error = %v", err)
+	}
+	for _, r := range got {
+		if strings.HasPrefix(r.path, "/tree/d01/") {
+			t.Errorf("WalkDir() visited %s inside a skipped directory", r.path)
+		}
+	}
+	visited := 0
+	err = fsys.WalkDir("/tree", func(p string, d fs.DirEntry, err error) error {
+		visited++
+		if visited == 3 {
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if err != nil || visited != 3 {
+		t.Errorf("WalkDir() with SkipAll = %v after %d entries, want nil after 3", err, visited)
+	}
+
+	// A missing root is reported to fn
+	err = fsys.WalkDir("/missing", func(p string, d fs.DirEntry, err error) error {
+		return err
+	})
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("WalkDir() of a missing root error = %v, want not exist", err)
+	}
+}
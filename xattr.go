@@ -0,0 +1,210 @@
+package smbfs
+
+import (
+	"errors"
+	"io/fs"
+	"sort"
+)
+
+// XattrFS is implemented by filesystems that store extended attributes.
+// Shares backed by one expose them to clients as SMB extended attributes
+// (EAs) through FileFullEaInformation
+type XattrFS interface {
+	// GetXattr returns the value of attribute attr of the file at name, or
+	// an error matching fs.ErrNotExist if the file has no such attribute
+	GetXattr(name, attr string) ([]byte, error)
+
+	// SetXattr sets attribute attr of the file at name. A nil value
+	// removes the attribute
+	SetXattr(name, attr string, value []byte) error
+
+	// ListXattr returns the names of the attributes of the file at name
+	ListXattr(name string) ([]string, error)
+}
+
+// extendedAttribute is one entry of a FILE_FULL_EA_INFORMATION list
+type extendedAttribute struct {
+	name  string
+	value []byte
+}
+
+// maxEaNameLength is the longest EA name the EaNameLength byte can describe
+const maxEaNameLength = 255
+
+// encodeFullEaInformation encodes EAs as a FILE_FULL_EA_INFORMATION list
+// (MS-FSCC 2.4.15). Entries are 4-byte aligned
+func encodeFullEaInformation(eas []extendedAttribute) []byte {
+	w := NewByteWriter(64 * len(eas))
+	for i, ea := range eas {
+		start := w.Len()
+		w.WriteUint32(0)                     // NextEntryOffset (patched below)
+		w.WriteOneByte(0)                    // Flags
+		w.WriteOneByte(uint8(len(ea.name)))  // EaNameLength
+		w.WriteUint16(uint16(len(ea.value))) // EaValueLength
+		w.WriteBytes([]byte(ea.name))        // EaName
+		w.WriteOneByte(0)                    // EaName terminator
+		w.WriteBytes(ea.value)               // EaValue
+		if i < len(eas)-1 {
+			w.WriteZeros((4 - (w.Len()-start)%4) % 4)
+			w.SetUint32At(start, uint32(w.Len()-start))
+		}
+	}
+	return w.Bytes()
+}
+
+// parseFullEaInformation decodes a FILE_FULL_EA_INFORMATION list
+func parseFullEaInformation(buf []byte) ([]extendedAttribute, error) {
+	var eas []extendedAttribute
+	for len(buf) > 0 {
+		if len(buf) < 8 {
+			return nil, errors.New("short EA entry")
+		}
+		next := le.Uint32(buf[0:4])
+		nameLen := int(buf[5])
+		valueLen := int(le.Uint16(buf[6:8]))
+		end := 8 + nameLen + 1 + valueLen
+		if end > len(buf) || (next != 0 && (int(next) < end || int(next) > len(buf))) {
+			return nil, errors.New("invalid EA entry")
+		}
+		eas = append(eas, extendedAttribute{
+			name:  string(buf[8 : 8+nameLen]),
+			value: buf[8+nameLen+1 : end],
+		})
+		if next == 0 {
+			break
+		}
+		buf = buf[next:]
+	}
+	return eas, nil
+}
+
+// encodeGetEaInformation encodes EA names as a FILE_GET_EA_INFORMATION list
+// (MS-FSCC 2.4.15.1), which selects the EAs a query returns
+func encodeGetEaInformation(names []string) []byte {
+	w := NewByteWriter(16 * len(names))
+	for i, name := range names {
+		start := w.Len()
+		w.WriteUint32(0)                 // NextEntryOffset (patched below)
+		w.WriteOneByte(uint8(len(name))) // EaNameLength
+		w.WriteBytes([]byte(name))       // EaName
+		w.WriteOneByte(0)                // EaName terminator
+		if i < len(names)-1 {
+			w.WriteZeros((4 - (w.Len()-start)%4) % 4)
+			w.SetUint32At(start, uint32(w.Len()-start))
+		}
+	}
+	return w.Bytes()
+}
+
+// parseGetEaInformation decodes a FILE_GET_EA_INFORMATION list
+func parseGetEaInformation(buf []byte) ([]string, error) {
+	var names []string
+	for len(buf) > 0 {
+		if len(buf) < 5 {
+			return nil, errors.New("short EA name entry")
+		}
+		next := le.Uint32(buf[0:4])
+		nameLen := int(buf[4])
+		end := 5 + nameLen
+		if end > len(buf) || (next != 0 && (int(next) < end || int(next) > len(buf))) {
+			return nil, errors.New("invalid EA name entry")
+		}
+		names = append(names, string(buf[5:end]))
+		if next == 0 {
+			break
+		}
+		buf = buf[next:]
+	}
+	return names, nil
+}
+
+// extendedAttributes returns the EAs of the file at name: those named, or
+// all of them if names is empty. A named EA the file lacks is returned with
+// an empty value. Filesystems without XattrFS have no EAs
+func (s *Share) extendedAttributes(name string, names []string) ([]extendedAttribute, error) {
+	xfs, ok := s.FileSystem().(XattrFS)
+	if !ok {
+		return nil, nil
+	}
+	if len(names) == 0 {
+		all, err := xfs.ListXattr(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, attr := range all {
+			if attr != "" && len(attr) <= maxEaNameLength {
+				names = append(names, attr)
+			}
+		}
+		sort.Strings(names)
+	}
+
+	eas := make([]extendedAttribute, 0, len(names))
+	for _, attr := range names {
+		value, err := xfs.GetXattr(name, attr)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		eas = append(eas, extendedAttribute{name: attr, value: value})
+	}
+	return eas, nil
+}
+
+// eaSize returns the size of the FileFullEaInformation list of the file at
+// name, reported as EaSize so clients know how much to ask for
+func (s *Share) eaSize(name string) uint32 {
+	eas, err := s.extendedAttributes(name, nil)
+	if err != nil || len(eas) == 0 {
+		return 0
+	}
+	return uint32(len(encodeFullEaInformation(eas)))
+}
+
+// queryFileFullEaInformation returns the EAs of an open file, limited to the
+// FILE_GET_EA_INFORMATION list in input if there is one
+func (h *SMBHandler) queryFileFullEaInformation(share *Share, of *OpenFile, input []byte) ([]byte, NTStatus) {
+	if mapGenericAccess(of.Access)&FILE_READ_EA == 0 {
+		return nil, STATUS_ACCESS_DENIED
+	}
+	names, err := parseGetEaInformation(input)
+	if err != nil {
+		return nil, STATUS_INVALID_PARAMETER
+	}
+	eas, err := share.extendedAttributes(of.Path, names)
+	if err != nil {
+		h.server.logger.Debug("QUERY_INFO: failed to read EAs of %s: %v", of.Path, err)
+		return nil, mapGoErrorToNTStatus(err)
+	}
+	return encodeFullEaInformation(eas), STATUS_SUCCESS
+}
+
+// setFileFullEaInformation sets the EAs in a FILE_FULL_EA_INFORMATION list
+// on an open file. An EA with an empty value is removed
+func (h *SMBHandler) setFileFullEaInformation(share *Share, of *OpenFile, buffer []byte) NTStatus {
+	if mapGenericAccess(of.Access)&FILE_WRITE_EA == 0 {
+		return STATUS_ACCESS_DENIED
+	}
+	xfs, ok := share.FileSystem().(XattrFS)
+	if !ok {
+		return STATUS_EAS_NOT_SUPPORTED
+	}
+	eas, err := parseFullEaInformation(buffer)
+	if err != nil {
+		return STATUS_INVALID_PARAMETER
+	}
+
+	for _, ea := range eas {
+		if ea.name == "" {
+			return STATUS_INVALID_PARAMETER
+		}
+		var value []byte
+		if len(ea.value) > 0 {
+			value = append([]byte(nil), ea.value...)
+		}
+		h.server.logger.Debug("SET_INFO: setting EA %s on %s (%d bytes)", ea.name, of.Path, len(value))
+		if err := xfs.SetXattr(of.Path, ea.name, value); err != nil && (value != nil || !errors.Is(err, fs.ErrNotExist)) {
+			return mapGoErrorToNTStatus(err)
+		}
+	}
+	return STATUS_SUCCESS
+}
@@ -0,0 +1,123 @@
+package smbfs
+
+import (
+	"io/fs"
+)
+
+// xattrQuerySize is the largest EA list requested from the server.
+const xattrQuerySize = 64 * 1024
+
+// Getxattr returns the value of the extended attribute attr of the named
+// file. SMB does not distinguish an empty attribute from a missing one;
+// both are reported as ErrNoXattr.
+func (fsys *FileSystem) Getxattr(name, attr string) ([]byte, error) {
+	if err := validateXattrName(attr); err != nil {
+		return nil, wrapPathError("getxattr", name, err)
+	}
+
+	var value []byte
+	err := fsys.withRawHandle("getxattr", name, FILE_READ_EA, func(f infoFile) error {
+		buf, err := f.QueryInfo(FileFullEaInformation, encodeGetEaInformation([]string{attr}), xattrQuerySize)
+		if err != nil {
+			return err
+		}
+		eas, err := parseFullEaInformation(buf)
+		if err != nil {
+			return err
+		}
+		for _, ea := range eas {
+			if ea.name == attr && len(ea.value) > 0 {
+				value = append([]byte(nil), ea.value...)
+				return nil
+			}
+		}
+		return ErrNoXattr
+	})
+	return value, err
+}
+
+// Setxattr sets the extended attribute attr of the named file. An empty
+// value removes the attribute, as SMB has no separate request for that.
+func (fsys *FileSystem) Setxattr(name, attr string, value []byte) error {
+	if err := validateXattrName(attr); err != nil {
+		return wrapPathError("setxattr", name, err)
+	}
+	if len(value) > 0xFFFF {
+		return wrapPathError("setxattr", name, fs.ErrInvalid)
+	}
+
+	buf := encodeFullEaInformation([]extendedAttribute{{name: attr, value: value}})
+	return fsys.withRawHandle("setxattr", name, FILE_WRITE_EA, func(f infoFile) error {
+		return f.SetInfo(FileFullEaInformation, buf)
+	})
+}
+
+// Listxattr returns the names of the extended attributes of the named file.
+// A server whose filesystem does not store extended attributes lists none.
+func (fsys *FileSystem) Listxattr(name string) ([]string, error) {
+	var names []string
+	err := fsys.withRawHandle("listxattr", name, FILE_READ_EA, func(f infoFile) error {
+		buf, err := f.QueryInfo(FileFullEaInformation, nil, xattrQuerySize)
+		if err != nil {
+			return err
+		}
+		eas, err := parseFullEaInformation(buf)
+		if err != nil {
+			return err
+		}
+		for _, ea := range eas {
+			names = append(names, ea.name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+// infoFile is an open file whose information classes can be queried and
+// set directly, for information go-smb2 has no method for, such as
+// extended attributes.
+type infoFile interface {
+	QueryInfo(class uint8, input []byte, maxOutput uint32) ([]byte, error)
+	SetInfo(class uint8, input []byte) error
+}
+
+// withRawHandle opens the named file with access on a pooled connection and
+// calls fn with it.
+func (fsys *FileSystem) withRawHandle(op, name string, access uint32, fn func(f infoFile) error) error {
+	if err := validatePath(name); err != nil {
+		return wrapPathError(op, name, err)
+	}
+	name = fsys.pathNorm.normalize(name)
+
+	conn, err := fsys.pool.get(fsys.ctx)
+	if err != nil {
+		return wrapPathError(op, name, err)
+	}
+	defer fsys.pool.put(conn)
+
+	opener, ok := conn.share.(interface {
+		OpenAccess(name string, access uint32) (SMBFile, error)
+	})
+	if !ok {
+		return wrapPathError(op, name, ErrNotImplemented)
+	}
+	file, err := opener.OpenAccess(toSMBPath(name), access|FILE_READ_ATTRIBUTES)
+	if err != nil {
+		return wrapPathError(op, name, err)
+	}
+	defer file.Close()
+
+	f, ok := file.(infoFile)
+	if !ok {
+		return wrapPathError(op, name, ErrNotImplemented)
+	}
+	return wrapPathError(op, name, fn(f))
+}
+
+// validateXattrName checks that attr can be sent as an EA name.
+func validateXattrName(attr string) error {
+	if attr == "" || len(attr) > maxEaNameLength {
+		return fs.ErrInvalid
+	}
+	return nil
+}
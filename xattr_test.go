@@ -0,0 +1,196 @@
+package smbfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+// xattrFS keeps extended attributes for a filesystem in memory
+type xattrFS struct {
+	absfs.FileSystem
+	mu    sync.Mutex
+	attrs map[string]map[string][]byte
+}
+
+func newXattrFS(fsys absfs.FileSystem) *xattrFS {
+	return &xattrFS{FileSystem: fsys, attrs: make(map[string]map[string][]byte)}
+}
+
+func (x *xattrFS) GetXattr(name, attr string) ([]byte, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	value, ok := x.attrs[name][attr]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return value, nil
+}
+
+func (x *xattrFS) SetXattr(name, attr string, value []byte) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if value == nil {
+		delete(x.attrs[name], attr)
+		return nil
+	}
+	if x.attrs[name] == nil {
+		x.attrs[name] = make(map[string][]byte)
+	}
+	x.attrs[name][attr] = value
+	return nil
+}
+
+func (x *xattrFS) ListXattr(name string) ([]string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var names []string
+	for attr := range x.attrs[name] {
+		names = append(names, attr)
+	}
+	return names, nil
+}
+
+// TestFullEaInformation_Handlers tests setting, reading back and listing EAs
+// through SET_INFO and QUERY_INFO
+func TestFullEaInformation_Handlers(t *testing.T) {
+	srv, session, tree := setupTestTree(t)
+	share := tree.Share
+	f, _ := share.fs.Create("/tagged.txt")
+	f.Close()
+
+	open := func(access uint32) *OpenFile {
+		t.Helper()
+		file, err := share.fs.OpenFile("/tagged.txt", os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("OpenFile() error = %v", err)
+		}
+		return share.fileHandles.Allocate(file, "/tagged.txt", false, access,
+			FILE_SHARE_READ|FILE_SHARE_WRITE, FILE_OPEN, 0, tree.ID, session.ID)
+	}
+	of := open(FILE_READ_EA | FILE_WRITE_EA)
+	query := func(of *OpenFile, names ...string) ([]extendedAttribute, NTStatus) {
+		t.Helper()
+		req := buildQueryInfoRequest(of.ID, SMB2_0_INFO_FILE, FileFullEaInformation, 0, 4096)
+		if len(names) > 0 {
+			input := encodeGetEaInformation(names)
+			le.PutUint16(req[8:10], uint16(SMB2HeaderSize+len(req))) // InputBufferOffset
+			le.PutUint32(req[12:16], uint32(len(input)))             // InputBufferLength
+			req = append(req, input...)
+		}
+		resp, status := srv.handler.handleQueryInfo(nil, testRequest(session, tree, SMB2_QUERY_INFO, req))
+		if status != STATUS_SUCCESS {
+			return nil, status
+		}
+		eas, err := parseFullEaInformation(resp[8 : 8+le.Uint32(resp[4:8])])
+		if err != nil {
+			t.Fatalf("parseFullEaInformation() error = %v", err)
+		}
+		return eas, status
+	}
+	set := func(of *OpenFile, eas ...extendedAttribute) NTStatus {
+		t.Helper()
+		_, status := srv.handler.handleSetInfo(nil, testRequest(session, tree, SMB2_SET_INFO,
+			buildSetInfoRequest(of.ID, SMB2_0_INFO_FILE, FileFullEaInformation, encodeFullEaInformation(eas))))
+		return status
+	}
+
+	// Without XattrFS there are no EAs, and none can be set
+	if eas, status := query(of); status != STATUS_SUCCESS || len(eas) != 0 {
+		t.Errorf("EAs without XattrFS = %v, %v, want none", eas, status)
+	}
+	if status := set(of, extendedAttribute{"user.tag", []byte("red")}); status != STATUS_EAS_NOT_SUPPORTED {
+		t.Errorf("SET_INFO without XattrFS status = %v, want STATUS_EAS_NOT_SUPPORTED", status)
+	}
+
+	xfs := newXattrFS(share.fs)
+	share.fs = xfs
+	if status := set(of, extendedAttribute{"user.tag", []byte("red")}, extendedAttribute{"security.selinux", []byte("system_u:object_r")}); status != STATUS_SUCCESS {
+		t.Fatalf("SET_INFO status = %v, want STATUS_SUCCESS", status)
+	}
+	if got, _ := xfs.GetXattr("/tagged.txt", "user.tag"); string(got) != "red" {
+		t.Errorf("backend user.tag = %q, want red", got)
+	}
+
+	eas, status := query(of)
+	if status != STATUS_SUCCESS || len(eas) != 2 {
+		t.Fatalf("EAs = %v, %v, want 2", eas, status)
+	}
+	if eas[0].name != "security.selinux" || string(eas[0].value) != "system_u:object_r" ||
+		eas[1].name != "user.tag" || string(eas[1].value) != "red" {
+		t.Errorf("EAs = %q, want security.selinux and user.tag", eas)
+	}
+
+	// Named queries return just those EAs, with an empty value if missing
+	eas, _ = query(of, "user.tag", "user.missing")
+	if len(eas) != 2 || string(eas[0].value) != "red" || eas[1].name != "user.missing" || len(eas[1].value) != 0 {
+		t.Errorf("named EAs = %q, want user.tag=red and an empty user.missing", eas)
+	}
+
+	// An empty value removes the EA
+	if status := set(of, extendedAttribute{"user.tag", nil}); status != STATUS_SUCCESS {
+		t.Fatalf("SET_INFO removing an EA status = %v, want STATUS_SUCCESS", status)
+	}
+	if eas, _ := query(of); len(eas) != 1 || eas[0].name != "security.selinux" {
+		t.Errorf("EAs after removal = %q, want security.selinux", eas)
+	}
+
+	// EAs need FILE_READ_EA and FILE_WRITE_EA
+	limited := open(FILE_READ_ATTRIBUTES)
+	if _, status := query(limited); status != STATUS_ACCESS_DENIED {
+		t.Errorf("QUERY_INFO without FILE_READ_EA status = %v, want STATUS_ACCESS_DENIED", status)
+	}
+	if status := set(limited, extendedAttribute{"user.tag", []byte("x")}); status != STATUS_ACCESS_DENIED {
+		t.Errorf("SET_INFO without FILE_WRITE_EA status = %v, want STATUS_ACCESS_DENIED", status)
+	}
+}
+
+// TestXattr_Client tests the client's extended attribute methods against a
+// server whose filesystem stores them
+func TestXattr_Client(t *testing.T) {
+	srv, config := startLoopbackServer(t, ServerOptions{})
+	share := srv.GetShare("data")
+	share.fs = newXattrFS(share.fs)
+
+	fsys, err := New(config)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fsys.Close()
+
+	if names, err := fsys.Listxattr("/hello.txt"); err != nil || len(names) != 0 {
+		t.Errorf("Listxattr() before setting = %v, %v, want none", names, err)
+	}
+	if err := fsys.Setxattr("/hello.txt", "user.xdg.tags", []byte("work,urgent")); err != nil {
+		t.Fatalf("Setxattr() error = %v", err)
+	}
+	if err := fsys.Setxattr("/hello.txt", "user.comment", []byte("draft")); err != nil {
+		t.Fatalf("Setxattr() error = %v", err)
+	}
+
+	value, err := fsys.Getxattr("/hello.txt", "user.xdg.tags")
+	if err != nil || string(value) != "work,urgent" {
+		t.Errorf("Getxattr() = %q, %v, want work,urgent", value, err)
+	}
+	names, err := fsys.Listxattr("/hello.txt")
+	if err != nil || len(names) != 2 || names[0] != "user.comment" || names[1] != "user.xdg.tags" {
+		t.Errorf("Listxattr() = %v, %v, want [user.comment user.xdg.tags]", names, err)
+	}
+
+	if _, err := fsys.Getxattr("/hello.txt", "user.missing"); !errors.Is(err, ErrNoXattr) {
+		t.Errorf("Getxattr() of a missing attribute error = %v, want ErrNoXattr", err)
+	}
+	if err := fsys.Setxattr("/hello.txt", "user.comment", nil); err != nil {
+		t.Fatalf("Setxattr() removing error = %v", err)
+	}
+	if _, err := fsys.Getxattr("/hello.txt", "user.comment"); !errors.Is(err, ErrNoXattr) {
+		t.Errorf("Getxattr() of a removed attribute error = %v, want ErrNoXattr", err)
+	}
+	if _, err := fsys.Listxattr("/missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Listxattr() of a missing file error = %v, want fs.ErrNotExist", err)
+	}
+}